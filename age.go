@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// instanceAge is how long ago one instance was launched.
+type instanceAge struct {
+	InstanceID   string
+	Name         string
+	InstanceType string
+	State        string
+	CreatedBy    string
+	LaunchTime   time.Time
+	Age          time.Duration
+	Old          bool
+}
+
+// instanceAges returns the age of the instances at now, oldest first. Those
+// launched at least maxAge ago are old.
+func instanceAges(instances []types.Instance, maxAge time.Duration, now time.Time) []instanceAge {
+	var ages []instanceAge
+	for _, i := range instances {
+		a := instanceAge{
+			InstanceID:   aws.ToString(i.InstanceId),
+			Name:         tagName(i.Tags),
+			InstanceType: string(i.InstanceType),
+			CreatedBy:    vmcreate.TagValue(&i, createdByTag),
+			LaunchTime:   aws.ToTime(i.LaunchTime),
+		}
+		if i.State != nil {
+			a.State = string(i.State.Name)
+		}
+		if !a.LaunchTime.IsZero() {
+			a.Age = now.Sub(a.LaunchTime)
+			a.Old = a.Age >= maxAge
+		}
+		ages = append(ages, a)
+	}
+	sort.SliceStable(ages, func(a, b int) bool {
+		return ages[a].LaunchTime.Before(ages[b].LaunchTime)
+	})
+	return ages
+}
+
+// formatAge prints d in days and hours, or hours and minutes under a day.
+func formatAge(d time.Duration) string {
+	hours := int(d.Hours())
+	switch {
+	case hours < 24:
+		return fmt.Sprintf("%dh%dm", hours, int(d.Minutes())%60)
+	case hours%24 == 0:
+		return fmt.Sprintf("%dd", hours/24)
+	}
+	return fmt.Sprintf("%dd%dh", hours/24, hours%24)
+}
+
+func AgeReportCmd(name *string, value *string, maxAge *time.Duration, notifyOld *bool) {
+	// Without a tag, the instances created by aws-vmcreate are reported.
+	filters := []types.Filter{vmcreate.StateFilter(vmcreate.LiveStates...), vmcreate.TagKeyFilter(createdByTag)}
+	if *name != "" && *value != "" {
+		filters[1] = vmcreate.TagFilter(*name, strings.Split(*value, ",")...)
+	} else if *name != "" {
+		filters[1] = vmcreate.TagKeyFilter(*name)
+	}
+	instances, err := provisioner.List(context.TODO(), filters...)
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error listing the instances:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	if len(instances) == 0 {
+		fmt.Println("No instances found")
+		return
+	}
+
+	ages := instanceAges(instances, *maxAge, time.Now())
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tNAME\tTYPE\tSTATE\tLAUNCHED\tAGE\tCREATED BY\tFLAG")
+	var old []string
+	for _, a := range ages {
+		launched, age, mark := "-", "-", ""
+		if !a.LaunchTime.IsZero() {
+			launched, age = a.LaunchTime.Local().Format("2006-01-02 15:04"), formatAge(a.Age)
+		}
+		if a.Old {
+			mark = "OLD"
+			old = append(old, a.InstanceID)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", a.InstanceID, a.Name, a.InstanceType, a.State, launched, age, firstNonEmpty(a.CreatedBy, "-"), mark)
+	}
+	w.Flush()
+
+	if len(old) == 0 {
+		fmt.Printf("None of the %d instances is older than %s\n", len(ages), formatAge(*maxAge))
+		return
+	}
+	fmt.Printf("%d of %d instances are older than %s\n", len(old), len(ages), formatAge(*maxAge))
+	if !*notifyOld {
+		return
+	}
+	// The config is optional for age-report, it only adds notifications.
+	config, err := loadConfig()
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		commandErr = err
+		return
+	}
+	if config.Notifications == nil {
+		progressln("No notifications are configured in data/config.json, not sending the summary")
+		return
+	}
+	notify(context.TODO(), config.Notifications, &Event{Command: "age-report", Status: fmt.Sprintf("found %d instances older than %s", len(old), formatAge(*maxAge)), TagKey: *name, TagValue: *value, InstanceIDs: old})
+}
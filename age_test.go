@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestInstanceAges(t *testing.T) {
+	now := time.Now()
+	instance := func(id string, age time.Duration) types.Instance {
+		return types.Instance{InstanceId: aws.String(id), LaunchTime: aws.Time(now.Add(-age))}
+	}
+	ages := instanceAges([]types.Instance{
+		instance("i-new", time.Hour),
+		instance("i-forgotten", 90*24*time.Hour),
+		instance("i-week", 7*24*time.Hour),
+	}, 7*24*time.Hour, now)
+
+	var got []string
+	for _, a := range ages {
+		s := a.InstanceID + "=" + formatAge(a.Age)
+		if a.Old {
+			s += " old"
+		}
+		got = append(got, s)
+	}
+	if want := "i-forgotten=90d old,i-week=7d old,i-new=1h0m"; strings.Join(got, ",") != want {
+		t.Errorf("got %s, want %s", strings.Join(got, ","), want)
+	}
+}
+
+func TestFormatAge(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		90 * time.Minute:    "1h30m",
+		26 * time.Hour:      "1d2h",
+		14 * 24 * time.Hour: "14d",
+	} {
+		if got := formatAge(d); got != want {
+			t.Errorf("formatAge(%s) = %s, want %s", d, got, want)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+
+	"aws-vmcreate/internal/awsapi"
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// alertsTargetID is the ID of the SNS target on alert rules.
+const alertsTargetID = "aws-vmcreate-sns"
+
+var eventBridgeClient EventBridgeRuleAPI
+
+// EventBridgeRuleAPI defines the interface for the PutRule, PutTargets, RemoveTargets and DeleteRule functions.
+// We use this interface to test the functions using a mocked service.
+type EventBridgeRuleAPI interface {
+	PutRule(ctx context.Context, params *awsapi.PutRuleInput) (*awsapi.PutRuleOutput, error)
+
+	PutTargets(ctx context.Context, params *awsapi.PutTargetsInput) (*awsapi.PutTargetsOutput, error)
+
+	RemoveTargets(ctx context.Context, params *awsapi.RemoveTargetsInput) error
+
+	DeleteRule(ctx context.Context, params *awsapi.DeleteRuleInput) error
+}
+
+var ruleNameInvalid = regexp.MustCompile(`[^.\-_A-Za-z0-9]`)
+
+// alertsRuleName returns the name of the rule for a tag group.
+func alertsRuleName(name string, value string) string {
+	rule := ruleNameInvalid.ReplaceAllString("aws-vmcreate-alerts-"+name+"-"+value, "_")
+	if len(rule) > 64 {
+		rule = rule[:64]
+	}
+	return rule
+}
+
+// taggedInstanceIDs returns the IDs of the instances, other than terminated
+// ones, carrying the tag.
+func taggedInstanceIDs(c context.Context, name string, value string) ([]string, error) {
+	instances, err := provisioner.List(c, vmcreate.TagFilter(name, value), vmcreate.StateFilter(vmcreate.LiveStates...))
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, i := range instances {
+		ids = append(ids, aws.ToString(i.InstanceId))
+	}
+	return ids, nil
+}
+
+// stateChangePattern matches EC2 state-change notifications for the instances.
+// The events carry no tags, so the instances are listed by ID.
+func stateChangePattern(instanceIDs []string) (string, error) {
+	pattern, err := json.Marshal(map[string]interface{}{
+		"source":      []string{"aws.ec2"},
+		"detail-type": []string{"EC2 Instance State-change Notification"},
+		"detail": map[string]interface{}{
+			"instance-id": instanceIDs,
+		},
+	})
+	return string(pattern), err
+}
+
+func EnableAlertsCmd(name *string, value *string, topicArn *string) {
+	ids, err := taggedInstanceIDs(context.TODO(), *name, *value)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error listing the instances:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+	if len(ids) == 0 {
+		fmt.Println("No instances tagged " + *name + "=" + *value)
+		return
+	}
+
+	pattern, err := stateChangePattern(ids)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error building the event pattern:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+
+	rule := alertsRuleName(*name, *value)
+	_, err = eventBridgeClient.PutRule(context.TODO(), &awsapi.PutRuleInput{
+		Name:         rule,
+		EventPattern: pattern,
+		State:        "ENABLED",
+		Description:  "State changes of instances tagged " + *name + "=" + *value,
+		Tags:         []awsapi.Tag{{Key: "managed-by", Value: "aws-vmcreate"}},
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error creating the rule:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+
+	result, err := eventBridgeClient.PutTargets(context.TODO(), &awsapi.PutTargetsInput{
+		Rule:    rule,
+		Targets: []awsapi.Target{{Id: alertsTargetID, Arn: *topicArn}},
+	})
+	if err == nil && result.FailedEntryCount > 0 {
+		err = errors.New(result.FailedEntries[0].ErrorCode + ": " + result.FailedEntries[0].ErrorMessage)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error adding the SNS target:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+
+	fmt.Printf("Enabled alerts rule %s for %d instances, sending to %s\n", rule, len(ids), *topicArn)
+	progressln("The topic policy must allow events.amazonaws.com to publish. Re-run after creating instances to include them.")
+}
+
+func DisableAlertsCmd(name *string, value *string) {
+	rule := alertsRuleName(*name, *value)
+
+	err := eventBridgeClient.RemoveTargets(context.TODO(), &awsapi.RemoveTargetsInput{
+		Rule: rule,
+		Ids:  []string{alertsTargetID},
+	})
+	if err == nil {
+		err = eventBridgeClient.DeleteRule(context.TODO(), &awsapi.DeleteRuleInput{Name: rule})
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error removing the rule:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+
+	fmt.Println("Disabled alerts rule " + rule)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeEventBridge keeps the rules and their targets in memory.
+type fakeEventBridge struct {
+	rules   map[string]*awsapi.PutRuleInput
+	targets map[string][]awsapi.Target
+	// failTarget fails every target with the error code.
+	failTarget string
+}
+
+func useFakeEventBridge(t *testing.T) *fakeEventBridge {
+	fake := &fakeEventBridge{rules: map[string]*awsapi.PutRuleInput{}, targets: map[string][]awsapi.Target{}}
+	previous := eventBridgeClient
+	eventBridgeClient = fake
+	t.Cleanup(func() { eventBridgeClient = previous })
+	return fake
+}
+
+func (f *fakeEventBridge) PutRule(ctx context.Context, params *awsapi.PutRuleInput) (*awsapi.PutRuleOutput, error) {
+	f.rules[params.Name] = params
+	return &awsapi.PutRuleOutput{RuleArn: "arn:aws:events:us-east-1:123456789012:rule/" + params.Name}, nil
+}
+
+func (f *fakeEventBridge) PutTargets(ctx context.Context, params *awsapi.PutTargetsInput) (*awsapi.PutTargetsOutput, error) {
+	if f.failTarget != "" {
+		return &awsapi.PutTargetsOutput{FailedEntryCount: 1, FailedEntries: []awsapi.FailedEntry{{TargetId: params.Targets[0].Id, ErrorCode: f.failTarget, ErrorMessage: "the target is not allowed"}}}, nil
+	}
+	f.targets[params.Rule] = params.Targets
+	return &awsapi.PutTargetsOutput{}, nil
+}
+
+func (f *fakeEventBridge) RemoveTargets(ctx context.Context, params *awsapi.RemoveTargetsInput) error {
+	delete(f.targets, params.Rule)
+	return nil
+}
+
+func (f *fakeEventBridge) DeleteRule(ctx context.Context, params *awsapi.DeleteRuleInput) error {
+	delete(f.rules, params.Name)
+	return nil
+}
+
+func TestAlertsRuleName(t *testing.T) {
+	if got := alertsRuleName("team", "data eng/ml"); got != "aws-vmcreate-alerts-team-data_eng_ml" {
+		t.Errorf("got %q", got)
+	}
+	if got := alertsRuleName("Name", strings.Repeat("x", 80)); len(got) != 64 || !strings.HasPrefix(got, "aws-vmcreate-alerts-Name-x") {
+		t.Errorf("got %q (%d)", got, len(got))
+	}
+}
+
+func TestAlertsCommand(t *testing.T) {
+	fake := useFakeEC2(t)
+	events := useFakeEventBridge(t)
+	const topic = "arn:aws:sns:us-east-1:123456789012:alerts"
+	web1 := fake.AddInstance(tagged("team", "web"))
+	web2 := fake.AddInstance(tagged("team", "web"))
+	gone := tagged("team", "web")
+	gone.State = &types.InstanceState{Name: types.InstanceStateNameTerminated}
+	fake.AddInstance(gone)
+	fake.AddInstance(tagged("team", "data"))
+
+	stdout, stderr, code := runCLIExit(t, false, "alerts", "enable", "--tag", "team=web", "--sns-topic", topic)
+	if code != 0 {
+		t.Fatalf("exit code %d:\n%s", code, stderr)
+	}
+	rule := events.rules["aws-vmcreate-alerts-team-web"]
+	if rule == nil || rule.State != "ENABLED" || !strings.Contains(stdout, "Enabled alerts rule aws-vmcreate-alerts-team-web for 2 instances") {
+		t.Fatalf("rules %v, printed:\n%s", events.rules, stdout)
+	}
+	var pattern struct {
+		Source []string `json:"source"`
+		Detail struct {
+			InstanceID []string `json:"instance-id"`
+		} `json:"detail"`
+	}
+	if err := json.Unmarshal([]byte(rule.EventPattern), &pattern); err != nil {
+		t.Fatal(err)
+	}
+	if ids := pattern.Detail.InstanceID; len(ids) != 2 || !contains(ids, web1) || !contains(ids, web2) || pattern.Source[0] != "aws.ec2" {
+		t.Errorf("pattern %s", rule.EventPattern)
+	}
+	if targets := events.targets[rule.Name]; len(targets) != 1 || targets[0].Arn != topic || targets[0].Id != alertsTargetID {
+		t.Errorf("targets %+v", targets)
+	}
+
+	if stdout, _ := runCLIStreams(t, false, "alerts", "disable", "--tag", "team=web"); len(events.rules) != 0 || len(events.targets) != 0 || !strings.Contains(stdout, "Disabled alerts rule aws-vmcreate-alerts-team-web") {
+		t.Errorf("rules %v, targets %v, printed:\n%s", events.rules, events.targets, stdout)
+	}
+
+	// A target EventBridge refuses fails the command.
+	events.failTarget = "AccessDeniedException"
+	if _, stderr, code := runCLIExit(t, false, "alerts", "enable", "--tag", "team=web", "--sns-topic", topic); code != 1 || !strings.Contains(stderr, "AccessDeniedException: the target is not allowed") {
+		t.Errorf("exit code %d:\n%s", code, stderr)
+	}
+
+	if stdout, _ := runCLIStreams(t, false, "alerts", "enable", "--tag", "team=none", "--sns-topic", topic); !strings.Contains(stdout, "No instances tagged team=none") {
+		t.Errorf("printed:\n%s", stdout)
+	}
+}
@@ -0,0 +1,40 @@
+package vmcreatev1
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// BearerToken authenticates calls to `aws-vmcreate grpc-serve` with the API
+// token it was started with.
+type BearerToken string
+
+// GetRequestMetadata implements credentials.PerRPCCredentials.
+func (t BearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+// RequireTransportSecurity implements credentials.PerRPCCredentials. The
+// token is sent over plaintext connections too, as the REST API sends it;
+// pass grpc.WithTransportCredentials to Dial to use TLS.
+func (t BearerToken) RequireTransportSecurity() bool {
+	return false
+}
+
+// Dial connects to the ProvisioningService at target, such as
+// localhost:8080, authenticating with token. The connection is plaintext
+// unless opts choose transport credentials. Close the returned connection
+// when done with the client.
+func Dial(target string, token string, opts ...grpc.DialOption) (ProvisioningServiceClient, *grpc.ClientConn, error) {
+	opts = append([]grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithPerRPCCredentials(BearerToken(token)),
+	}, opts...)
+	conn, err := grpc.Dial(target, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewProvisioningServiceClient(conn), conn, nil
+}
@@ -0,0 +1,10 @@
+// Package vmcreatev1 is the gRPC provisioning API served by
+// `aws-vmcreate grpc-serve`, which mirrors the REST API of `aws-vmcreate
+// serve`.
+//
+// The message types, server interface and client are generated from
+// vmcreate.proto with protoc-gen-go and protoc-gen-go-grpc and checked in;
+// Dial connects a client that authenticates with the API token.
+package vmcreatev1
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative vmcreate.proto
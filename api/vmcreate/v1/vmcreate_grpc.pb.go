@@ -0,0 +1,231 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: vmcreate.proto
+
+// The provisioning operations of aws-vmcreate, served by
+// `aws-vmcreate grpc-serve` and mirroring the REST API of `aws-vmcreate serve`.
+
+package vmcreatev1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	ProvisioningService_CreateInstance_FullMethodName   = "/vmcreate.v1.ProvisioningService/CreateInstance"
+	ProvisioningService_DeleteInstance_FullMethodName   = "/vmcreate.v1.ProvisioningService/DeleteInstance"
+	ProvisioningService_ListInstances_FullMethodName    = "/vmcreate.v1.ProvisioningService/ListInstances"
+	ProvisioningService_DescribeInstance_FullMethodName = "/vmcreate.v1.ProvisioningService/DescribeInstance"
+)
+
+// ProvisioningServiceClient is the client API for ProvisioningService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ProvisioningServiceClient interface {
+	// CreateInstance launches and tags a single instance.
+	CreateInstance(ctx context.Context, in *CreateInstanceRequest, opts ...grpc.CallOption) (*Instance, error)
+	// DeleteInstance terminates an instance.
+	DeleteInstance(ctx context.Context, in *DeleteInstanceRequest, opts ...grpc.CallOption) (*DeleteInstanceResponse, error)
+	// ListInstances lists instances, optionally restricted to a tag.
+	ListInstances(ctx context.Context, in *ListInstancesRequest, opts ...grpc.CallOption) (*ListInstancesResponse, error)
+	// DescribeInstance returns a single instance.
+	DescribeInstance(ctx context.Context, in *DescribeInstanceRequest, opts ...grpc.CallOption) (*Instance, error)
+}
+
+type provisioningServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewProvisioningServiceClient(cc grpc.ClientConnInterface) ProvisioningServiceClient {
+	return &provisioningServiceClient{cc}
+}
+
+func (c *provisioningServiceClient) CreateInstance(ctx context.Context, in *CreateInstanceRequest, opts ...grpc.CallOption) (*Instance, error) {
+	out := new(Instance)
+	err := c.cc.Invoke(ctx, ProvisioningService_CreateInstance_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *provisioningServiceClient) DeleteInstance(ctx context.Context, in *DeleteInstanceRequest, opts ...grpc.CallOption) (*DeleteInstanceResponse, error) {
+	out := new(DeleteInstanceResponse)
+	err := c.cc.Invoke(ctx, ProvisioningService_DeleteInstance_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *provisioningServiceClient) ListInstances(ctx context.Context, in *ListInstancesRequest, opts ...grpc.CallOption) (*ListInstancesResponse, error) {
+	out := new(ListInstancesResponse)
+	err := c.cc.Invoke(ctx, ProvisioningService_ListInstances_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *provisioningServiceClient) DescribeInstance(ctx context.Context, in *DescribeInstanceRequest, opts ...grpc.CallOption) (*Instance, error) {
+	out := new(Instance)
+	err := c.cc.Invoke(ctx, ProvisioningService_DescribeInstance_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ProvisioningServiceServer is the server API for ProvisioningService service.
+// All implementations must embed UnimplementedProvisioningServiceServer
+// for forward compatibility
+type ProvisioningServiceServer interface {
+	// CreateInstance launches and tags a single instance.
+	CreateInstance(context.Context, *CreateInstanceRequest) (*Instance, error)
+	// DeleteInstance terminates an instance.
+	DeleteInstance(context.Context, *DeleteInstanceRequest) (*DeleteInstanceResponse, error)
+	// ListInstances lists instances, optionally restricted to a tag.
+	ListInstances(context.Context, *ListInstancesRequest) (*ListInstancesResponse, error)
+	// DescribeInstance returns a single instance.
+	DescribeInstance(context.Context, *DescribeInstanceRequest) (*Instance, error)
+	mustEmbedUnimplementedProvisioningServiceServer()
+}
+
+// UnimplementedProvisioningServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedProvisioningServiceServer struct {
+}
+
+func (UnimplementedProvisioningServiceServer) CreateInstance(context.Context, *CreateInstanceRequest) (*Instance, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateInstance not implemented")
+}
+func (UnimplementedProvisioningServiceServer) DeleteInstance(context.Context, *DeleteInstanceRequest) (*DeleteInstanceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteInstance not implemented")
+}
+func (UnimplementedProvisioningServiceServer) ListInstances(context.Context, *ListInstancesRequest) (*ListInstancesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListInstances not implemented")
+}
+func (UnimplementedProvisioningServiceServer) DescribeInstance(context.Context, *DescribeInstanceRequest) (*Instance, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DescribeInstance not implemented")
+}
+func (UnimplementedProvisioningServiceServer) mustEmbedUnimplementedProvisioningServiceServer() {}
+
+// UnsafeProvisioningServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ProvisioningServiceServer will
+// result in compilation errors.
+type UnsafeProvisioningServiceServer interface {
+	mustEmbedUnimplementedProvisioningServiceServer()
+}
+
+func RegisterProvisioningServiceServer(s grpc.ServiceRegistrar, srv ProvisioningServiceServer) {
+	s.RegisterService(&ProvisioningService_ServiceDesc, srv)
+}
+
+func _ProvisioningService_CreateInstance_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateInstanceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProvisioningServiceServer).CreateInstance(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ProvisioningService_CreateInstance_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProvisioningServiceServer).CreateInstance(ctx, req.(*CreateInstanceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProvisioningService_DeleteInstance_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteInstanceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProvisioningServiceServer).DeleteInstance(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ProvisioningService_DeleteInstance_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProvisioningServiceServer).DeleteInstance(ctx, req.(*DeleteInstanceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProvisioningService_ListInstances_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListInstancesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProvisioningServiceServer).ListInstances(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ProvisioningService_ListInstances_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProvisioningServiceServer).ListInstances(ctx, req.(*ListInstancesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProvisioningService_DescribeInstance_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DescribeInstanceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProvisioningServiceServer).DescribeInstance(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ProvisioningService_DescribeInstance_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProvisioningServiceServer).DescribeInstance(ctx, req.(*DescribeInstanceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ProvisioningService_ServiceDesc is the grpc.ServiceDesc for ProvisioningService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ProvisioningService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "vmcreate.v1.ProvisioningService",
+	HandlerType: (*ProvisioningServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateInstance",
+			Handler:    _ProvisioningService_CreateInstance_Handler,
+		},
+		{
+			MethodName: "DeleteInstance",
+			Handler:    _ProvisioningService_DeleteInstance_Handler,
+		},
+		{
+			MethodName: "ListInstances",
+			Handler:    _ProvisioningService_ListInstances_Handler,
+		},
+		{
+			MethodName: "DescribeInstance",
+			Handler:    _ProvisioningService_DescribeInstance_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "vmcreate.proto",
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// approvedByTag names who approved the create of the instance.
+const approvedByTag = "aws-vmcreate:approved-by"
+
+// approvalParameterPrefix is where approve records decisions for the SNS
+// approval flow, one parameter per request.
+const approvalParameterPrefix = "/aws-vmcreate/approvals/"
+
+// approvalPollInterval is how often a pending approval is checked.
+var approvalPollInterval = 10 * time.Second
+
+// errNotApproved is returned when a create is denied or its approval times out.
+var errNotApproved = errors.New("not approved")
+
+// SSMApprovalAPI defines the interface for the parameter functions the approvals are recorded with.
+// We use this interface to test the functions using a mocked service.
+type SSMApprovalAPI interface {
+	GetParameter(ctx context.Context, params *awsapi.GetParameterInput) (*awsapi.GetParameterOutput, error)
+	PutParameter(ctx context.Context, params *awsapi.PutParameterInput) (*awsapi.PutParameterOutput, error)
+}
+
+// ApprovalConfig makes creates wait for a second person's approval before
+// launching. The request is posted to URL, which answers with the decision
+// or keeps it pending, or published to SNSTopic for an approver to run
+// approve.
+type ApprovalConfig struct {
+	// Tags select the creates that need approval, those with every one of
+	// them. Without tags, every create does.
+	Tags     map[string]string `json:"tags,omitempty"`
+	URL      string            `json:"url,omitempty"`
+	SNSTopic string            `json:"sns_topic,omitempty"`
+	// Timeout is how long a create waits for the decision, 30m by default.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// required reports whether a create with tags needs approval.
+func (a *ApprovalConfig) required(tags map[string]string) bool {
+	for k, v := range a.Tags {
+		if tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// ApprovalRequest is what the approver is asked to approve.
+type ApprovalRequest struct {
+	ID           string            `json:"id"`
+	Command      string            `json:"command"`
+	RequestedBy  string            `json:"requested_by"`
+	Region       string            `json:"region"`
+	InstanceType string            `json:"instance_type"`
+	ImageID      string            `json:"image_id"`
+	Count        int               `json:"count"`
+	Tags         map[string]string `json:"tags"`
+	Time         time.Time         `json:"time"`
+}
+
+// approvalDecision is the answer to a request: pending, approved or
+// denied. Approved decisions carry the approval token.
+type approvalDecision struct {
+	Status   string `json:"status"`
+	Token    string `json:"token,omitempty"`
+	Approver string `json:"approver,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// newApprovalID returns a random id for an approval request.
+func newApprovalID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// awaitApproval asks for the approval of req and waits for the decision
+// until the timeout. It returns an errNotApproved error unless a second
+// person approved it with a token.
+func awaitApproval(c context.Context, a *ApprovalConfig, req *ApprovalRequest, httpClient aws.HTTPClient, topics SNSPublishAPI, parameters SSMApprovalAPI) (*approvalDecision, error) {
+	timeout := 30 * time.Minute
+	if a.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(a.Timeout); err != nil {
+			return nil, fmt.Errorf("approval timeout: %w", err)
+		}
+	}
+	c, cancel := context.WithTimeout(c, timeout)
+	defer cancel()
+
+	// next checks the decision again while it is pending.
+	var decision *approvalDecision
+	var next func() (*approvalDecision, error)
+	switch {
+	case a.URL != "":
+		var err error
+		if decision, err = approvalCall(c, httpClient, http.MethodPost, a.URL, req); err != nil {
+			return nil, err
+		}
+		url := strings.TrimRight(a.URL, "/") + "/" + req.ID
+		next = func() (*approvalDecision, error) {
+			return approvalCall(c, httpClient, http.MethodGet, url, nil)
+		}
+	case a.SNSTopic != "":
+		message, err := json.MarshalIndent(req, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		_, err = PublishMessage(c, topics, &awsapi.PublishInput{
+			TopicArn: a.SNSTopic,
+			Subject:  "aws-vmcreate approval requested for " + req.ID,
+			Message:  string(message) + "\n\nApprove with: aws-vmcreate approve " + req.ID + "\nDeny with: aws-vmcreate approve " + req.ID + " --deny",
+		})
+		if err != nil {
+			return nil, fmt.Errorf("publishing the approval request: %w", err)
+		}
+		next = func() (*approvalDecision, error) {
+			return recordedApproval(c, parameters, req.ID)
+		}
+	default:
+		return nil, errors.New("approval needs a url or an sns_topic")
+	}
+
+	for {
+		switch {
+		case decision != nil && decision.Status == "approved":
+			if decision.Token == "" {
+				return nil, fmt.Errorf("%w: request %s was approved without a token", errNotApproved, req.ID)
+			}
+			if decision.Approver != "" && decision.Approver == req.RequestedBy {
+				return nil, fmt.Errorf("%w: request %s was approved by its requester, a second person must approve it", errNotApproved, req.ID)
+			}
+			return decision, nil
+		case decision != nil && decision.Status == "denied":
+			return nil, fmt.Errorf("%w: request %s was denied by %s: %s", errNotApproved, req.ID, firstNonEmpty(decision.Approver, "the approver"), firstNonEmpty(decision.Reason, "no reason given"))
+		}
+		select {
+		case <-c.Done():
+			return nil, fmt.Errorf("%w: no decision on request %s within %s", errNotApproved, req.ID, timeout)
+		case <-time.After(approvalPollInterval):
+		}
+		var err error
+		if decision, err = next(); err != nil && c.Err() == nil {
+			return nil, err
+		}
+	}
+}
+
+// approvalCall sends payload, if any, to url and returns the decision it
+// answers with.
+func approvalCall(c context.Context, httpClient aws.HTTPClient, method string, url string, payload interface{}) (*approvalDecision, error) {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(c, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	decision := &approvalDecision{}
+	if err := json.NewDecoder(resp.Body).Decode(decision); err != nil {
+		return nil, fmt.Errorf("decoding the decision of %s: %w", url, err)
+	}
+	return decision, nil
+}
+
+// recordedApproval returns the decision approve recorded for the request,
+// or nil while there is none.
+func recordedApproval(c context.Context, parameters SSMApprovalAPI, id string) (*approvalDecision, error) {
+	result, err := parameters.GetParameter(c, &awsapi.GetParameterInput{Name: approvalParameterPrefix + id})
+	var apiErr *awsapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == "ParameterNotFound" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	decision := &approvalDecision{}
+	if err := json.Unmarshal([]byte(result.Parameter.Value), decision); err != nil {
+		return nil, fmt.Errorf("decoding the decision on %s: %w", id, err)
+	}
+	return decision, nil
+}
+
+// recordApproval records the caller's decision on the request. A request
+// is decided once, the first decision stands.
+func recordApproval(c context.Context, parameters SSMApprovalAPI, id string, deny bool, reason string) (*approvalDecision, error) {
+	principal, err := lookupPrincipal(c)
+	if err != nil {
+		return nil, fmt.Errorf("looking up the approver: %w", err)
+	}
+	decision := &approvalDecision{Status: "approved", Token: newApprovalID(), Approver: principal}
+	if deny {
+		decision = &approvalDecision{Status: "denied", Approver: principal, Reason: reason}
+	}
+	value, err := json.Marshal(decision)
+	if err != nil {
+		return nil, err
+	}
+	_, err = parameters.PutParameter(c, &awsapi.PutParameterInput{Name: approvalParameterPrefix + id, Value: string(value), Type: "String"})
+	var apiErr *awsapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == "ParameterAlreadyExists" {
+		return nil, fmt.Errorf("request %s has already been decided", id)
+	}
+	return decision, err
+}
+
+func ApproveCmd(id string, deny *bool, reason *string) {
+	decision, err := recordApproval(context.TODO(), ssmClient, id, *deny, *reason)
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error recording the decision:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	if decision.Status == "denied" {
+		fmt.Println("Denied request " + id)
+		return
+	}
+	fmt.Println("Approved request " + id + " with token " + decision.Token)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+	"aws-vmcreate/pkg/vmcreate"
+)
+
+// fakeApprovals is a parameter store that approve records decisions in.
+type fakeApprovals struct {
+	mu         sync.Mutex
+	parameters map[string]string
+}
+
+func (f *fakeApprovals) GetParameter(ctx context.Context, params *awsapi.GetParameterInput) (*awsapi.GetParameterOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	value, ok := f.parameters[params.Name]
+	if !ok {
+		return nil, &awsapi.Error{StatusCode: 400, Code: "ParameterNotFound"}
+	}
+	return &awsapi.GetParameterOutput{Parameter: awsapi.Parameter{Name: params.Name, Value: value}}, nil
+}
+
+func (f *fakeApprovals) PutParameter(ctx context.Context, params *awsapi.PutParameterInput) (*awsapi.PutParameterOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.parameters[params.Name]; ok && !params.Overwrite {
+		return nil, &awsapi.Error{StatusCode: 400, Code: "ParameterAlreadyExists"}
+	}
+	f.parameters[params.Name] = params.Value
+	return &awsapi.PutParameterOutput{Version: 1}, nil
+}
+
+// fakeApprovalTopic approves every request it is published with.
+type fakeApprovalTopic struct {
+	parameters *fakeApprovals
+	messages   []string
+}
+
+func (f *fakeApprovalTopic) Publish(ctx context.Context, params *awsapi.PublishInput) (*awsapi.PublishOutput, error) {
+	f.messages = append(f.messages, params.Message)
+	id := strings.TrimPrefix(params.Subject, "aws-vmcreate approval requested for ")
+	principal := lookupPrincipal
+	lookupPrincipal = func(context.Context) (string, error) { return "arn:aws:iam::123456789012:user/approver", nil }
+	defer func() { lookupPrincipal = principal }()
+	if _, err := recordApproval(ctx, f.parameters, id, false, ""); err != nil {
+		return nil, err
+	}
+	return &awsapi.PublishOutput{MessageId: "1"}, nil
+}
+
+func useFastApprovals(t *testing.T) {
+	interval := approvalPollInterval
+	approvalPollInterval = time.Millisecond
+	t.Cleanup(func() { approvalPollInterval = interval })
+}
+
+// approvalServer answers the request with pending until it was checked
+// polls times, then with decision.
+func approvalServer(t *testing.T, polls int, decision approvalDecision) *httptest.Server {
+	var mu sync.Mutex
+	checks := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodPost {
+			var req ApprovalRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+				t.Errorf("request = %+v, %v", req, err)
+			}
+		} else {
+			checks++
+		}
+		if checks < polls {
+			json.NewEncoder(w).Encode(approvalDecision{Status: "pending"})
+			return
+		}
+		json.NewEncoder(w).Encode(decision)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestApprovalRequired(t *testing.T) {
+	a := &ApprovalConfig{Tags: map[string]string{"env": "prod"}}
+	if !a.required(map[string]string{"env": "prod", "team": "web"}) {
+		t.Error("prod create does not need approval")
+	}
+	if a.required(map[string]string{"env": "dev"}) {
+		t.Error("dev create needs approval")
+	}
+	if !(&ApprovalConfig{}).required(nil) {
+		t.Error("create does not need approval without tags")
+	}
+}
+
+func TestAwaitApprovalURL(t *testing.T) {
+	useFastApprovals(t)
+	c := context.Background()
+	req := &ApprovalRequest{ID: "abc", RequestedBy: "arn:aws:iam::123456789012:user/tester"}
+
+	server := approvalServer(t, 3, approvalDecision{Status: "approved", Token: "tok", Approver: "arn:aws:iam::123456789012:user/approver"})
+	decision, err := awaitApproval(c, &ApprovalConfig{URL: server.URL}, req, server.Client(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Token != "tok" {
+		t.Errorf("token = %q, want tok", decision.Token)
+	}
+
+	server = approvalServer(t, 1, approvalDecision{Status: "denied", Approver: "arn:aws:iam::123456789012:user/approver", Reason: "change freeze"})
+	_, err = awaitApproval(c, &ApprovalConfig{URL: server.URL}, req, server.Client(), nil, nil)
+	if !errors.Is(err, errNotApproved) || !strings.Contains(err.Error(), "change freeze") {
+		t.Errorf("denied error = %v", err)
+	}
+
+	server = approvalServer(t, 0, approvalDecision{Status: "approved", Token: "tok", Approver: req.RequestedBy})
+	if _, err := awaitApproval(c, &ApprovalConfig{URL: server.URL}, req, server.Client(), nil, nil); !errors.Is(err, errNotApproved) {
+		t.Errorf("self-approval error = %v", err)
+	}
+
+	server = approvalServer(t, 1, approvalDecision{Status: "approved"})
+	if _, err := awaitApproval(c, &ApprovalConfig{URL: server.URL}, req, server.Client(), nil, nil); !errors.Is(err, errNotApproved) {
+		t.Errorf("approval without token error = %v", err)
+	}
+
+	server = approvalServer(t, 1000, approvalDecision{})
+	_, err = awaitApproval(c, &ApprovalConfig{URL: server.URL, Timeout: "20ms"}, req, server.Client(), nil, nil)
+	if !errors.Is(err, errNotApproved) || !strings.Contains(err.Error(), "within") {
+		t.Errorf("timeout error = %v", err)
+	}
+}
+
+func TestAwaitApprovalSNS(t *testing.T) {
+	useFakeEC2(t)
+	useFastApprovals(t)
+	c := context.Background()
+	parameters := &fakeApprovals{parameters: map[string]string{}}
+	topic := &fakeApprovalTopic{parameters: parameters}
+	req := &ApprovalRequest{ID: "abc", RequestedBy: "arn:aws:iam::123456789012:user/tester", InstanceType: "t3.micro"}
+
+	decision, err := awaitApproval(c, &ApprovalConfig{SNSTopic: "arn:aws:sns:us-east-1:123456789012:approvals"}, req, nil, topic, parameters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Approver != "arn:aws:iam::123456789012:user/approver" || decision.Token == "" {
+		t.Errorf("decision = %+v", decision)
+	}
+	if len(topic.messages) != 1 || !strings.Contains(topic.messages[0], "aws-vmcreate approve abc") {
+		t.Errorf("messages = %q", topic.messages)
+	}
+
+	// The first decision stands.
+	if _, err := recordApproval(c, parameters, "abc", true, "too late"); err == nil {
+		t.Error("second decision was recorded")
+	}
+}
+
+func TestAwaitApprovalSNSSelfApproved(t *testing.T) {
+	useFakeEC2(t)
+	useFastApprovals(t)
+	c := context.Background()
+	parameters := &fakeApprovals{parameters: map[string]string{}}
+	if _, err := recordApproval(c, parameters, "abc", false, ""); err != nil {
+		t.Fatal(err)
+	}
+	req := &ApprovalRequest{ID: "abc", RequestedBy: "arn:aws:iam::123456789012:user/tester"}
+	_, err := awaitApproval(c, &ApprovalConfig{SNSTopic: "arn:aws:sns:us-east-1:123456789012:approvals"}, req, nil, &fakeNoopTopic{}, parameters)
+	if !errors.Is(err, errNotApproved) {
+		t.Errorf("self-approval error = %v", err)
+	}
+}
+
+type fakeNoopTopic struct{}
+
+func (fakeNoopTopic) Publish(ctx context.Context, params *awsapi.PublishInput) (*awsapi.PublishOutput, error) {
+	return &awsapi.PublishOutput{}, nil
+}
+
+func TestServeCreateApproval(t *testing.T) {
+	fake := useFakeEC2(t)
+	useFastApprovals(t)
+	create := func(decision approvalDecision) *http.Response {
+		t.Helper()
+		approvals := approvalServer(t, 1, decision)
+		previous := awsConfig.HTTPClient
+		awsConfig.HTTPClient = approvals.Client()
+		t.Cleanup(func() { awsConfig.HTTPClient = previous })
+		server := httptest.NewServer(&apiServer{
+			token: "secret",
+			config: ConfigMap{
+				InstanceType: "t2.micro",
+				ImageId:      "ami-api",
+				Approval:     &ApprovalConfig{Tags: map[string]string{"env": "prod"}, URL: approvals.URL},
+			},
+		})
+		defer server.Close()
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/v1/instances", strings.NewReader(`{"tag_key": "env", "tag_value": "prod"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := create(approvalDecision{Status: "denied", Approver: "arn:aws:iam::123456789012:user/approver", Reason: "change freeze"})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("denied create got %s", resp.Status)
+	}
+	if n := len(liveInstances(fake)); n != 0 {
+		t.Fatalf("launched %d instances without approval", n)
+	}
+
+	resp = create(approvalDecision{Status: "approved", Token: "tok", Approver: "arn:aws:iam::123456789012:user/approver"})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("approved create got %s", resp.Status)
+	}
+	live := liveInstances(fake)
+	if len(live) != 1 || vmcreate.TagValue(&live[0], approvedByTag) != "arn:aws:iam::123456789012:user/approver" {
+		t.Errorf("approved create launched %+v", live)
+	}
+}
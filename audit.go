@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// AuditConfig controls the audit log of the commands that change or access
+// instances. It is written locally unless disabled, and copied to S3 when a
+// bucket is set.
+type AuditConfig struct {
+	Disabled bool   `json:"disabled,omitempty"`
+	Path     string `json:"path,omitempty"`
+	S3Bucket string `json:"s3_bucket,omitempty"`
+	S3Prefix string `json:"s3_prefix,omitempty"`
+}
+
+// AuditRecord is one command run in the audit log.
+type AuditRecord struct {
+	Time        time.Time `json:"time"`
+	User        string    `json:"user"`
+	Principal   string    `json:"principal,omitempty"`
+	Profile     string    `json:"profile,omitempty"`
+	Region      string    `json:"region"`
+	Command     string    `json:"command"`
+	Args        []string  `json:"args"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	InstanceIDs []string  `json:"instance_ids,omitempty"`
+	RequestIDs  []string  `json:"request_ids,omitempty"`
+}
+
+// auditedCommands are the commands recorded in the audit log.
+var auditedCommands = map[string]bool{
+	"create": true, "delete": true, "resize": true, "alerts": true,
+	"connect": true, "tunnel": true, "cp": true, "quarantine": true,
+}
+
+// audit collects the record of the command being run.
+var audit struct {
+	sync.Mutex
+	record *AuditRecord
+}
+
+// lookupPrincipal returns the ARN of the AWS identity running the command.
+var lookupPrincipal = func(c context.Context) (string, error) {
+	identity, err := sts.NewFromConfig(awsConfig).GetCallerIdentity(c, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", err
+	}
+	return *identity.Arn, nil
+}
+
+// startAudit begins the audit record of command.
+func startAudit(command string, instanceID string) {
+	audit.Lock()
+	defer audit.Unlock()
+	audit.record = nil
+	if !auditedCommands[command] {
+		return
+	}
+	audit.record = &AuditRecord{Time: time.Now().UTC(), Command: command, Args: redactArgs(os.Args[1:])}
+	if instanceID != "" {
+		audit.record.InstanceIDs = []string{instanceID}
+	}
+}
+
+// auditInstances adds the instances a command acted on to its record.
+func auditInstances(ids []string) {
+	audit.Lock()
+	defer audit.Unlock()
+	if audit.record != nil {
+		audit.record.InstanceIDs = append(audit.record.InstanceIDs, ids...)
+	}
+}
+
+// recordRequestIDs adds the request id of every SDK call to the audit
+// record, so the calls can be found in CloudTrail.
+func recordRequestIDs(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("AuditRequestIDs", func(
+		c context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+	) (middleware.InitializeOutput, middleware.Metadata, error) {
+		out, metadata, err := next.HandleInitialize(c, in)
+		if id, ok := awsmiddleware.GetRequestIDMetadata(metadata); ok {
+			audit.Lock()
+			if audit.record != nil {
+				audit.record.RequestIDs = append(audit.record.RequestIDs, awsmiddleware.GetServiceID(c)+"."+awsmiddleware.GetOperationName(c)+":"+id)
+			}
+			audit.Unlock()
+		}
+		return out, metadata, err
+	}), middleware.After)
+}
+
+// writeAudit completes the audit record with the outcome of the command and
+// appends it to the log.
+func writeAudit(err error) {
+	audit.Lock()
+	record := audit.record
+	audit.record = nil
+	audit.Unlock()
+	if record == nil {
+		return
+	}
+
+	config, _ := loadConfig()
+	settings := config.Audit
+	if settings == nil {
+		settings = &AuditConfig{}
+	}
+	if settings.Disabled {
+		return
+	}
+
+	record.Status = "success"
+	if err != nil {
+		record.Status = "failure"
+		record.Error = err.Error()
+	}
+	if u, err := user.Current(); err == nil {
+		record.User = u.Username
+	}
+	record.Profile = os.Getenv("AWS_PROFILE")
+	record.Region = awsConfig.Region
+	c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if principal, err := lookupPrincipal(c); err == nil {
+		record.Principal = principal
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error encoding the audit record:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	if err := appendAudit(auditPath(settings), line); err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error writing the audit log:")
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if settings.S3Bucket != "" {
+		// Objects can't be appended to, so each record is its own object.
+		var suffix [4]byte
+		rand.Read(suffix[:])
+		key := path.Join(settings.S3Prefix, record.Time.Format("2006/01/02"), record.Time.Format("150405.000000000")+"-"+hex.EncodeToString(suffix[:])+".json")
+		if err := s3Client.PutObject(c, settings.S3Bucket, key, bytes.NewReader(line), int64(len(line))); err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error copying the audit record to S3:")
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+// auditPath returns the local audit log, by default in ~/.aws/aws-vmcreate.
+func auditPath(settings *AuditConfig) string {
+	if settings.Path != "" {
+		return settings.Path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "aws-vmcreate-audit.log"
+	}
+	return filepath.Join(home, ".aws", "aws-vmcreate", "audit.log")
+}
+
+func appendAudit(file string, line []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// redactArgs hides the values of flags that carry secrets.
+func redactArgs(args []string) []string {
+	out := make([]string, len(args))
+	redactNext := false
+	for i, arg := range args {
+		if redactNext {
+			out[i] = "REDACTED"
+			redactNext = false
+			continue
+		}
+		out[i] = arg
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !sensitiveParam(name) {
+			continue
+		}
+		if hasValue {
+			out[i] = arg[:strings.Index(arg, "=")+1] + "REDACTED"
+		} else {
+			redactNext = true
+		}
+	}
+	return out
+}
+
+// readAudit returns the records of the local audit log, oldest first.
+func readAudit(file string) ([]AuditRecord, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		var r AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, n, err)
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+func HistoryCmd(command *string, instanceID *string, since *time.Duration) {
+	config, err := loadConfig()
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		commandErr = err
+		return
+	}
+	settings := config.Audit
+	if settings == nil {
+		settings = &AuditConfig{}
+	}
+
+	records, err := readAudit(auditPath(settings))
+	if os.IsNotExist(err) {
+		fmt.Println("No commands have been audited yet")
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error reading the audit log:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tUSER\tPRINCIPAL\tCOMMAND\tSTATUS\tINSTANCES\tARGS")
+	for _, r := range records {
+		switch {
+		case *command != "" && r.Command != *command:
+			continue
+		case *since > 0 && r.Time.Before(time.Now().Add(-*since)):
+			continue
+		case *instanceID != "" && !contains(r.InstanceIDs, *instanceID):
+			continue
+		}
+		fmt.Fprintln(w, strings.Join([]string{
+			r.Time.Local().Format(time.RFC3339),
+			r.User,
+			r.Principal,
+			r.Command,
+			r.Status,
+			strings.Join(r.InstanceIDs, ","),
+			strings.Join(r.Args, " "),
+		}, "\t"))
+	}
+	w.Flush()
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	fake := useFakeEC2(t)
+
+	runCLI(t, "create", "--tag", "Name=web-1", "--mfa-token=123456")
+	id := fake.Instances()[0].InstanceId
+	fake.Fail("RunInstances", errors.New("InsufficientInstanceCapacity"))
+	runCLI(t, "create", "--tag", "Name=web-2")
+	runCLI(t, "list")
+	runCLI(t, "delete", "--tag", "Name=web-1")
+
+	records, err := readAudit(filepath.Join(os.Getenv("HOME"), ".aws", "aws-vmcreate", "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("audited %d commands, want create, create and delete: %+v", len(records), records)
+	}
+	created, failed, deleted := records[0], records[1], records[2]
+	if created.Command != "create" || created.Status != "success" || !contains(created.InstanceIDs, *id) {
+		t.Errorf("create record %+v", created)
+	}
+	if created.Principal != "arn:aws:iam::123456789012:user/tester" || created.User == "" {
+		t.Errorf("create record does not say who ran it: %+v", created)
+	}
+	if args := strings.Join(created.Args, " "); args != "create --tag Name=web-1 --mfa-token=REDACTED" {
+		t.Errorf("create args %q", args)
+	}
+	if failed.Status != "failure" || !strings.Contains(failed.Error, "InsufficientInstanceCapacity") {
+		t.Errorf("failed create record %+v", failed)
+	}
+	if deleted.Command != "delete" || !contains(deleted.InstanceIDs, *id) {
+		t.Errorf("delete record %+v", deleted)
+	}
+
+	out := runCLI(t, "history", "-i", *id)
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 4 || !strings.Contains(out, "TIME") {
+		t.Errorf("history of %s:\n%s", *id, out)
+	}
+	out = runCLI(t, "history", "delete")
+	if strings.Contains(out, "web-2") || !strings.Contains(out, "delete --tag Name=web-1") {
+		t.Errorf("history of delete:\n%s", out)
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	got := redactArgs([]string{"create", "--k8s-token", "abcdef.0123", "-api-token-file", "/tmp/token", "--external-id=ops", "-n", "Name"})
+	want := "create --k8s-token REDACTED -api-token-file REDACTED --external-id=ops -n Name"
+	if strings.Join(got, " ") != want {
+		t.Errorf("redactArgs = %q", strings.Join(got, " "))
+	}
+}
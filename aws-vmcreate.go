@@ -3,12 +3,19 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
+	"io"
 	"os"
 	"strings"
+	"time"
 
 	"fmt"
 
+	"aws-vmcreate/internal/awsapi"
+	"aws-vmcreate/internal/telemetry"
+	"aws-vmcreate/pkg/vmcreate"
+
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
@@ -17,275 +24,1821 @@ import (
 
 var client *ec2.Client
 
-// EC2CreateInstanceAPI defines the interface for the RunInstances and CreateTags functions.
-// We use this interface to test the functions using a mocked service.
-type EC2CreateInstanceAPI interface {
-	RunInstances(ctx context.Context,
-		params *ec2.RunInstancesInput,
-		optFns ...func(*ec2.Options)) (*ec2.RunInstancesOutput, error)
-
-	CreateTags(ctx context.Context,
-		params *ec2.CreateTagsInput,
-		optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error)
-
-	TerminateInstances(ctx context.Context,
-		params *ec2.TerminateInstancesInput,
-		optFns ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error)
-
-	// ModifyInstanceAttribute(ctx context.Context,
-	// 	params *ec2.ModifyInstanceAttributeInput,
-	// 	optFns ...func(*ec2.Options)) (*ec2.ModifyInstanceAttributeOutput, error)
-	// StopInstances(ctx context.Context,
-	// 	params *ec2.StopInstancesInput,
-	// 	optFns ...func(*ec2.Options)) (*ec2.StopInstancesOutput, error)
+// provisioner creates, lists and deletes the instances for every command.
+var provisioner *vmcreate.Provisioner
+
+// instanceProvider is the backend instances are created in, ec2 or memory,
+// as chosen with --provider or the provider of data/config.json.
+var instanceProvider = "ec2"
+
+// memoryProvider keeps the instances of --provider memory. It lives as long
+// as the process, so serve and the daemon keep their instances between
+// requests and reconciles.
+var memoryProvider = vmcreate.NewMemoryProvider()
+
+// awsConfig is the shared configuration the service clients are created from.
+var awsConfig aws.Config
+
+// CreateOptions holds the optional steps run after an instance is launched.
+type CreateOptions struct {
+	// ProvisionScript is a local script run on the instance once it is reachable.
+	ProvisionScript  string
+	ProvisionVia     string
+	ProvisionTimeout time.Duration
+	OSUser           string
+	// HealthCheck is an http, https or tcp URL that must respond before the
+	// create is reported as successful. An empty host means the instance.
+	HealthCheck   string
+	HealthTimeout time.Duration
+	// DNSZone and DNSName register an A record for the instance. DNSName may
+	// use the {{name}} and {{id}} placeholders.
+	DNSZone     string
+	DNSName     string
+	DNSPublicIP bool
+	// TargetGroupArn registers the instance with a load balancer target group
+	// once it has passed the health check.
+	TargetGroupArn string
+	// EFSMount is a file system mounted at boot through user data.
+	EFSMount *EFSMount
+	// K8sJoin joins the instance to a Kubernetes cluster at boot.
+	K8sJoin *K8sJoin
+	// CIRunner installs Docker and a CI build agent at boot.
+	CIRunner *CIRunner
+	// Count is the number of instances to launch, each going through the
+	// steps after launch.
+	Count int
+	// Rollback terminates the instances, and removes their DNS records and
+	// target registrations, when a step fails instead of keeping them.
+	Rollback bool
+	// InstanceType, ImageID and SubnetID override data/config.json.
+	InstanceType string
+	ImageID      string
+	SubnetID     string
+	// SubnetStrategy overrides the subnet_strategy of data/config.json.
+	SubnetStrategy string
+	// KeyName is the EC2 key pair the instance is launched with.
+	KeyName string
+	// InstanceProfile overrides the IAM instance profile of data/config.json.
+	InstanceProfile string
+	// GPUDrivers installs the NVIDIA drivers at boot on GPU instances.
+	GPUDrivers bool
+	// Enclaves launches the instance with Nitro Enclaves enabled, and
+	// NitroTPM requires the instance type and image to support a NitroTPM.
+	Enclaves bool
+	NitroTPM bool
+	// MetadataTags lets software on the instance read its tags from IMDS.
+	MetadataTags bool
+	// CloudWatchLogs ships the logs of the instance to a log group with the
+	// CloudWatch agent, installed at boot.
+	CloudWatchLogs *CloudWatchLogs
+	// WaitStatusChecks waits for the status checks of the instance to pass
+	// before the steps that use it.
+	WaitStatusChecks bool
+	// NoSourceDestCheck turns off the source/destination check after launch,
+	// for NAT and routing appliances.
+	NoSourceDestCheck bool
+	// ExtraTags are added to the instance besides the selecting tag.
+	ExtraTags map[string]string
+	// OverrideBudget launches even when the projected spend passes the
+	// budget of data/config.json.
+	OverrideBudget bool
+	// PrivateIPs are the private addresses of the instances, one each,
+	// instead of those of the private_ip_pool of data/config.json.
+	PrivateIPs []string
+	// FromWarmPool starts warm instances of the tag, instance type and
+	// image before launching new ones.
+	FromWarmPool bool
+}
+
+// DeleteOptions holds the optional steps run before instances are terminated.
+type DeleteOptions struct {
+	DNSZone        string
+	DNSName        string
+	TargetGroupArn string
+	DrainTimeout   time.Duration
+	// Regions, when set, deletes in each of them instead of the default region.
+	Regions []string
+	// Drain is run on each instance before it is terminated, the drain of
+	// data/config.json unless set.
+	Drain *Drain
+	// Count, when set, terminates only that many of the pending and running
+	// instances, those TerminationPolicy chooses first.
+	Count             int
+	TerminationPolicy string
 }
 
 type ConfigMap struct {
+	// Region is the region commands run in when neither AWS_REGION nor the
+	// profile sets one.
+	Region       string `json:"region,omitempty"`
 	InstanceType string `json:"instance_type"`
 	ImageId      string `json:"image_id"`
+	SubnetId     string `json:"subnet_id,omitempty"`
+	// SubnetStrategy chooses the subnet when subnet_id is not set, among
+	// SubnetIds or the default subnets of the default VPC: most-free-ips,
+	// round-robin-az, cheapest-az-spot or "same-as tag:KEY=VALUE".
+	SubnetStrategy string   `json:"subnet_strategy,omitempty"`
+	SubnetIds      []string `json:"subnet_ids,omitempty"`
+	// SecurityGroupIds replace the VPC's default security group.
+	SecurityGroupIds []string `json:"security_group_ids,omitempty"`
+	// IamInstanceProfile is the name of the instance profile instances are
+	// launched with, e.g. one made by iam profile create.
+	IamInstanceProfile string `json:"iam_instance_profile,omitempty"`
+	// EndpointURL sends every AWS call to a single endpoint such as LocalStack.
+	// Endpoints overrides it per service, keyed by signing name, e.g. "ec2".
+	EndpointURL    string            `json:"endpoint_url,omitempty"`
+	Endpoints      map[string]string `json:"endpoints,omitempty"`
+	S3UsePathStyle bool              `json:"s3_use_path_style,omitempty"`
+	// Provider is where instances are created: ec2, or memory to keep them
+	// in the memory of the process without launching anything.
+	Provider string `json:"provider,omitempty"`
+	// Notifications are sent when commands succeed or fail.
+	Notifications *Notifications `json:"notifications,omitempty"`
+	// RegionFailover lists, in order of preference, the regions create tries
+	// when the default region runs out of capacity or quota.
+	RegionFailover []FailoverRegion `json:"region_failover,omitempty"`
+	// Audit configures the log of the commands that were run.
+	Audit *AuditConfig `json:"audit,omitempty"`
+	// Lock is the fleet lock create, delete and the daemon take, as
+	// dynamodb://TABLE or s3://BUCKET/PREFIX.
+	Lock string `json:"lock,omitempty"`
+	// State is the state store the lifecycle of the instances is kept in,
+	// as dynamodb://TABLE[/KEY] or s3://BUCKET/KEY. It is a local file by
+	// default.
+	State string `json:"state,omitempty"`
+	// Tags are added to every instance create launches. The tags of the
+	// command line win.
+	Tags map[string]string `json:"tags,omitempty"`
+	// Groups are saved tag filters that --group selects instances by,
+	// KEY=VALUE[,VALUE] by name.
+	Groups map[string]string `json:"groups,omitempty"`
+	// RootVolume changes the size, type or encryption of the root volume.
+	RootVolume *RootVolume `json:"root_volume,omitempty"`
+	// PrivateIPPool is the addresses and CIDR blocks of the subnet that
+	// create gives its instances their private addresses from.
+	PrivateIPPool []string `json:"private_ip_pool,omitempty"`
+	// UserData is shell commands run at first boot, after those of the
+	// tool's own options.
+	UserData string `json:"user_data,omitempty"`
+	// InstanceLimits cap how many instances create and the daemon leave
+	// running.
+	InstanceLimits
+	// Budget is the monthly spend create keeps the instances under.
+	Budget *BudgetConfig `json:"budget,omitempty"`
+	// Approval makes creates wait for a second person's approval.
+	Approval *ApprovalConfig `json:"approval,omitempty"`
+	// Hooks run the organization's own steps around creates and deletes.
+	Hooks *Hooks `json:"hooks,omitempty"`
+	// CMDB is where created instances are registered and deleted ones
+	// retired.
+	CMDB *CMDBConfig `json:"cmdb,omitempty"`
+	// Forensics is where quarantine --capture sends what it collects.
+	Forensics *ForensicsConfig `json:"forensics,omitempty"`
+	// Drain is what delete and scale do on each instance before
+	// terminating it.
+	Drain *Drain `json:"drain,omitempty"`
+	// Preset names the preset of the config's presets that was applied to
+	// it. The presets themselves are not kept once one is applied.
+	Preset string `json:"preset,omitempty"`
 }
 
-// MakeInstance creates an Amazon Elastic Compute Cloud (Amazon EC2) instance.
-// Inputs:
-//
-//	c is the context of the method call, which includes the AWS Region.
-//	api is the interface that defines the method call.
-//	input defines the input arguments to the service call.
-//
-// Output:
-//
-//	If success, a RunInstancesOutput object containing the result of the service call and nil.
-//	Otherwise, nil and an error from the call to RunInstances.
-func MakeInstance(c context.Context, api EC2CreateInstanceAPI, input *ec2.RunInstancesInput) (*ec2.RunInstancesOutput, error) {
-	return api.RunInstances(c, input)
-}
-
-// MakeTags creates tags for an Amazon Elastic Compute Cloud (Amazon EC2) instance.
-// Inputs:
-//
-//	c is the context of the method call, which includes the AWS Region.
-//	api is the interface that defines the method call.
-//	input defines the input arguments to the service call.
-//
-// Output:
-//
-//	If success, a CreateTagsOutput object containing the result of the service call and nil.
-//	Otherwise, nil and an error from the call to CreateTags.
-func MakeTags(c context.Context, api EC2CreateInstanceAPI, input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
-	return api.CreateTags(c, input)
-}
+// configPath is the provisioning config, which init writes.
+const configPath = "data/config.json"
 
-// DeleteInstance deletes an Amazon Elastic Compute Cloud (Amazon EC2) instance.
-// Inputs:
-//
-//	c is the context of the method call, which includes the AWS Region.
-//	api is the interface that defines the method call.
-//	input defines the input arguments to the service call.
-//
-// Output:
-//
-//	If success, a TerminateInstancesInput object containing the result of the service call and nil.
-//	Otherwise, nil and an error from the call to TerminateInstances.
-func DeleteInstance(c context.Context, api EC2CreateInstanceAPI, input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
-	return api.TerminateInstances(c, input)
-}
+// loadConfig reads the provisioning config from data/config.json, or the
+// file, S3 object, parameter or URL of --config. The config is validated
+// against config.schema.json, whose errors give the line and column of each
+// problem. The preset it or --preset selects overrides its settings, the
+// AWS_VMCREATE_ variables and then --set override both, and the schema's
+// defaults fill in omitted fields. Without a local file, the overrides
+// alone make the config.
+func loadConfig() (ConfigMap, error) {
+	var config ConfigMap
 
-// func UpdateInstanceAttribute(c context.Context, api EC2CreateInstanceAPI, input *ec2.ModifyInstanceAttributeInput) (*ec2.ModifyInstanceAttributeOutput, error) {
-// 	return api.ModifyInstanceAttribute(c, input)
-// }
+	overrides := configOverrides(os.Environ(), configSets)
+	if configPreset != "" {
+		overrides = append(overrides, configOverride{Source: "--preset", Path: []string{"preset"}, Value: configPreset})
+	}
+	data, source, err := readConfig()
+	if os.IsNotExist(err) && len(overrides) > 0 {
+		data, err = []byte("{}"), nil
+	}
+	if err != nil {
+		return config, err
+	}
+	if err := configSchema.Validate(source, data); err != nil {
+		return config, err
+	}
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return config, err
+	}
+	if err := applyPreset(doc, overrides); err != nil {
+		return config, err
+	}
+	if err := applyConfigOverrides(doc, overrides); err != nil {
+		return config, err
+	}
+	if data, err = json.Marshal(doc); err != nil {
+		return config, err
+	}
+	data, err = configSchema.ApplyDefaults(data)
+	if err != nil {
+		return config, err
+	}
 
-// func PauseInstances(c context.Context, api EC2CreateInstanceAPI, input *ec2.StopInstancesInput) (*ec2.StopInstancesOutput, error) {
-// 	return api.StopInstances(c, input)
-// }
+	err = json.Unmarshal(data, &config)
+	return config, err
+}
 
-func DeleteInstancesCmd(name *string, value *string) {
+func DeleteInstancesCmd(name *string, value *string, opts *DeleteOptions) {
 
 	var instanceIds = make([]string, 0)
 
+	// The config is optional for delete, it only adds notifications, hooks
+	// and the CMDB.
+	config, err := loadConfig()
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		commandErr = err
+		return
+	}
+	event := &Event{Command: "delete", TagKey: *name, TagValue: *value}
+	if opts.Drain == nil {
+		opts.Drain = config.Drain
+	}
+
 	val := strings.Split(*value, ",")
-	tag := "tag:" + *name
 
-	describeInput := &ec2.DescribeInstancesInput{
-		Filters: []types.Filter{
-			{
-				Name:   aws.String(tag),
-				Values: val,
+	if len(opts.Regions) > 0 {
+		deleteInRegions(*name, val, opts, event)
+		notify(context.TODO(), config.Notifications, event)
+		return
+	}
+
+	filters := []types.Filter{vmcreate.TagFilter(*name, val...)}
+	if opts.Count > 0 {
+		filters = append(filters, vmcreate.StateFilter("pending", "running"))
+	}
+	instances, err := provisioner.List(commandContext, filters...)
+	if err == nil && opts.Count > 0 {
+		instances, err = chooseTerminations(commandContext, instances, opts.Count, opts.TerminationPolicy)
+	}
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error fetching the status of the instance")
+		fmt.Fprintln(os.Stderr, err)
+		event.Status, event.Error = "failure", err.Error()
+		notify(context.TODO(), config.Notifications, event)
+		return
+	}
+	for _, i := range instances {
+		instanceIds = append(instanceIds, *i.InstanceId)
+	}
+	progressln("Instance IDs:")
+	progressln(instanceIds)
+	event.InstanceIDs = instanceIds
+
+	terminated, err := deleteInstances(commandContext, config, "delete", *name, *value, instances, opts)
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error terminating the instance:")
+		fmt.Fprintln(os.Stderr, err)
+		event.Status, event.Error = "failure", err.Error()
+		notify(context.TODO(), config.Notifications, event)
+		return
+	}
+	if len(terminated) == 0 {
+		fmt.Fprintln(os.Stderr, "No instances found with tag "+*name+"="+*value)
+		return
+	}
+	for _, id := range terminated {
+		printResult("Terminated instance with id: "+id, id)
+	}
+	event.Status = "success"
+	notify(context.TODO(), config.Notifications, event)
+}
+
+// deleteInstances terminates the instances the way delete does: once the
+// pre-delete hooks of config pass, taking each out of service first, and
+// then retiring them from the CMDB and running the post-delete hooks. It
+// returns the ids of those terminated.
+func deleteInstances(c context.Context, config ConfigMap, command string, tagKey string, tagValue string, instances []types.Instance, opts *DeleteOptions) ([]string, error) {
+	if h := config.Hooks; h != nil && len(instances) > 0 {
+		err := runHooks(c, h, h.PreDelete, &HookPayload{Hook: "pre-delete", TagKey: tagKey, TagValue: tagValue, Instances: hookInstances(instances)})
+		if err != nil {
+			return nil, fmt.Errorf("running the pre-delete hooks: %w", err)
+		}
+	}
+	recordLifecycle(c, command, instances, awsConfig.Region, phaseDraining, "")
+	var ids []string
+	var ops []operation
+	for n := range instances {
+		i := &instances[n]
+		ids = append(ids, *i.InstanceId)
+		ops = append(ops, operation{
+			Name: "taking " + *i.InstanceId + " out of service",
+			Run: func(c context.Context) error {
+				beforeTerminate(c, ssmClient, elbv2Client, i, tagKey, opts)
+				return nil
 			},
-		},
+		})
 	}
-	result, err := client.DescribeInstances(context.TODO(), describeInput)
+	newOperationQueue("delete").Run(c, ops)
+
+	terminated, err := provisioner.Delete(c, ids)
 	if err != nil {
-		fmt.Println("Got an error fetching the status of the instance")
-		fmt.Println(err)
-	} else {
-		for _, r := range result.Reservations {
-			fmt.Println("Instance IDs:")
-			for _, i := range r.Instances {
-				instanceIds = append(instanceIds, *i.InstanceId)
-			}
-			fmt.Println(instanceIds)
+		return nil, err
+	}
+	if len(terminated) == 0 {
+		return nil, nil
+	}
+	recordLifecycle(c, command, instancesOf(terminated), "", phaseTerminated, "")
+	if config.CMDB != nil {
+		updateCMDB(config.CMDB, hookInstances(instances), true)
+	}
+	if h := config.Hooks; h != nil {
+		runPostHooks(c, h, h.PostDelete, &HookPayload{Hook: "post-delete", TagKey: tagKey, TagValue: tagValue, Instances: hookInstances(instances)})
+	}
+	return terminated, nil
+}
+
+// beforeTerminate drains the instance and takes it out of the target group,
+// its CI service and DNS. Failures are reported but do not stop the delete.
+func beforeTerminate(c context.Context, ssm *awsapi.SSM, elbv2 *awsapi.ELBv2, i *types.Instance, tagKey string, opts *DeleteOptions) {
+	if opts.Drain != nil {
+		if err := drainInstance(c, opts.Drain, ssm, elbv2, i); err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error draining the instance:")
+			fmt.Fprintln(os.Stderr, err)
 		}
+	}
 
-		input := &ec2.TerminateInstancesInput{
-			InstanceIds: instanceIds,
-			DryRun:      new(bool),
+	if opts.TargetGroupArn != "" {
+		err := deregisterTarget(c, elbv2, opts.TargetGroupArn, *i.InstanceId, boundedWait(opts.DrainTimeout))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error deregistering the instance from the target group:")
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+
+	if err := deregisterCIRunner(c, ssm, i, ssm.Region()); err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error deregistering the CI runner:")
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	if opts.DNSZone != "" {
+		dnsName := instanceDNSName(opts.DNSName, opts.DNSZone, vmcreate.TagValue(i, tagKey), *i.InstanceId)
+		if err := deregisterDNS(c, route53Client, opts.DNSZone, dnsName); err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error removing the DNS record "+dnsName+":")
+			fmt.Fprintln(os.Stderr, err)
+		} else {
+			progressln("Removed DNS record " + dnsName)
 		}
+	}
+}
+
+// deleteInRegions terminates the tagged instances in every region of opts
+// concurrently. A region that fails is reported without affecting the
+// others; the event collects the instances of all of them.
+func deleteInRegions(name string, values []string, opts *DeleteOptions, event *Event) {
+	type regionResult struct {
+		ids []string
+		err error
+	}
+	results := make([]regionResult, len(opts.Regions))
+
+	forEachConcurrently(len(opts.Regions), func(n int) {
+		region := opts.Regions[n]
+		cfg := awsConfig.Copy()
+		cfg.Region = region
+		p := provisionerFor(cfg)
 
-		result, err := DeleteInstance(context.TODO(), client, input)
+		instances, err := p.List(commandContext, vmcreate.TagFilter(name, values...), vmcreate.StateFilter(vmcreate.LiveStates...))
 		if err != nil {
-			fmt.Println("Got an error terminating the instance:")
-			fmt.Println(err)
+			results[n].err = err
 			return
 		}
 
-		fmt.Println("Terminated instance with id: ", *result.TerminatingInstances[0].InstanceId)
+		// A target group only holds instances of its own region.
+		regionOpts := *opts
+		if arnRegion(opts.TargetGroupArn) != region {
+			regionOpts.TargetGroupArn = ""
+		}
+		ssm, elbv2 := awsapi.NewSSM(cfg), awsapi.NewELBv2(cfg)
+		var ids []string
+		recordLifecycle(context.TODO(), "delete", instances, region, phaseDraining, "")
+		for i := range instances {
+			ids = append(ids, aws.ToString(instances[i].InstanceId))
+			beforeTerminate(commandContext, ssm, elbv2, &instances[i], name, &regionOpts)
+		}
+		results[n].ids, results[n].err = p.Delete(commandContext, ids)
+		recordLifecycle(context.TODO(), "delete", instancesOf(results[n].ids), region, phaseTerminated, "")
+	})
+
+	var failed []string
+	for n, r := range results {
+		region := opts.Regions[n]
+		switch {
+		case r.err != nil:
+			fmt.Fprintln(os.Stderr, "["+region+"] Got an error terminating the instances:")
+			fmt.Fprintln(os.Stderr, r.err)
+			failed = append(failed, region+": "+r.err.Error())
+		case len(r.ids) == 0:
+			fmt.Fprintln(os.Stderr, "["+region+"] No instances found with tag "+name+"="+strings.Join(values, ","))
+		default:
+			for _, id := range r.ids {
+				printResult("["+region+"] Terminated instance with id: "+id, id)
+			}
+			event.InstanceIDs = append(event.InstanceIDs, r.ids...)
+		}
 	}
-}
 
-func CreateInstancesCmd(name *string, value *string) {
-	// Create separate values if required.
-	minMaxCount := int32(1)
+	event.Status = "success"
+	if len(failed) > 0 {
+		event.Status, event.Error = "failure", strings.Join(failed, "; ")
+	}
+}
 
-	file, err := os.Open("data/config.json")
+func CreateInstancesCmd(name *string, value *string, opts *CreateOptions, run *CreateRun) {
+	config, err := loadConfig()
 	if err != nil {
-		fmt.Println("Error opening config file:", err)
-		os.Exit(1)
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		exit(1)
+	}
+	config.InstanceType = firstNonEmpty(opts.InstanceType, config.InstanceType)
+	config.ImageId = firstNonEmpty(opts.ImageID, config.ImageId)
+	config.SubnetId = firstNonEmpty(opts.SubnetID, config.SubnetId)
+	config.IamInstanceProfile = firstNonEmpty(opts.InstanceProfile, config.IamInstanceProfile)
+	if config.SubnetId == "" {
+		if config.SubnetId, err = resolveSubnet(commandContext, client, config, opts.SubnetStrategy); err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error choosing a subnet:")
+			fmt.Fprintln(os.Stderr, err)
+			notify(context.TODO(), config.Notifications, &Event{Command: "create", Status: "failure", TagKey: *name, TagValue: *value, Error: err.Error()})
+			exit(1)
+		}
 	}
-	defer file.Close()
 
-	var config ConfigMap
-	if err := json.NewDecoder(file).Decode(&config); err != nil {
-		fmt.Println("Error decoding config:", err)
-		os.Exit(1)
+	// run is the progress of the create, kept for create --resume, and
+	// created what it has made so far, for a rollback to undo.
+	if run == nil {
+		run = newCreateRun(*name, *value, opts)
+	}
+	invocationRunID = run.ID
+	created := &run.Created
+
+	// fail reports a failed create and exits, rolling back what was created
+	// if the user asked for it.
+	fail := func(err error) {
+		event := &Event{Command: "create", Status: "failure", TagKey: *name, TagValue: *value, Error: err.Error(), InstanceIDs: created.InstanceIDs}
+		notify(context.TODO(), config.Notifications, event)
+		failCreate(run)
+	}
+
+	var userData []string
+	if opts.EFSMount != nil {
+		// Without a subnet the AZ is only known after launch, so it is checked then.
+		if config.SubnetId != "" {
+			az, err := subnetAvailabilityZone(commandContext, config.SubnetId)
+			if err == nil {
+				err = checkMountTarget(commandContext, efsClient, opts.EFSMount, az)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Got an error validating the EFS mount:")
+				fmt.Fprintln(os.Stderr, err)
+				fail(err)
+			}
+		}
+		userData = append(userData, efsUserData(opts.EFSMount, awsConfig.Region))
+	}
+	if opts.K8sJoin != nil {
+		userData = append(userData, k8sJoinUserData(opts.K8sJoin))
+	}
+
+	tags := map[string]string{}
+	for k, v := range config.Tags {
+		tags[k] = v
+	}
+	for k, v := range opts.ExtraTags {
+		tags[k] = v
+	}
+	tags[*name] = *value
+	if opts.CIRunner != nil {
+		if err := opts.CIRunner.validate(commandContext, secretsManagerClient); err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error validating the CI runner:")
+			fmt.Fprintln(os.Stderr, err)
+			fail(err)
+		}
+		userData = append(userData, ciRunnerUserData(opts.CIRunner, secretsManagerClient.Region()))
+		for k, v := range opts.CIRunner.tags() {
+			tags[k] = v
+		}
+	}
+
+	if opts.CloudWatchLogs != nil {
+		if err := grantCloudWatchLogs(commandContext, iamClient, config.IamInstanceProfile, partition(awsConfig.Region)); err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error granting the CloudWatch agent its permissions:")
+			fmt.Fprintln(os.Stderr, err)
+			fail(err)
+		}
+		userData = append(userData, cloudWatchAgentUserData(opts.CloudWatchLogs))
+	}
+
+	launchType, err := findInstanceType(commandContext, instanceTypesClient, awsConfig.Region, config.InstanceType)
+	if errors.Is(err, errInstanceTypeNotOffered) {
+		fmt.Fprintln(os.Stderr, "Got an error validating the instance type:")
+		fmt.Fprintln(os.Stderr, err)
+		fail(err)
+	}
+	if launchType != nil {
+		if err := checkAcceleratedLaunch(commandContext, client, config, launchType, opts.GPUDrivers); err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error validating the accelerated launch:")
+			fmt.Fprintln(os.Stderr, err)
+			fail(err)
+		}
+		if opts.GPUDrivers {
+			userData = append(userData, nvidiaDriverUserData())
+		}
+		if err := checkConfidentialLaunch(commandContext, client, launchType, config.ImageId, opts.Enclaves, opts.NitroTPM); err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error validating the confidential computing options:")
+			fmt.Fprintln(os.Stderr, err)
+			fail(err)
+		}
+	}
+	var rootVolume *types.BlockDeviceMapping
+	if config.RootVolume != nil {
+		if rootVolume, err = rootVolumeMapping(commandContext, client, config.ImageId, config.RootVolume); err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error validating the root volume:")
+			fmt.Fprintln(os.Stderr, err)
+			fail(err)
+		}
+	}
+	if err := validateFailover(config.RegionFailover); err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		exit(1)
+	}
+	// The EFS file system and the target group only exist in the default
+	// region, so those creates cannot move.
+	failover := config.RegionFailover
+	if len(failover) > 0 && (opts.EFSMount != nil || opts.TargetGroupArn != "") {
+		fmt.Fprintln(os.Stderr, "Region failover is disabled with -efs and -target-group-arn")
+		failover = nil
+	}
+	// The root device is that of the image of the default region.
+	if len(failover) > 0 && rootVolume != nil {
+		fmt.Fprintln(os.Stderr, "Region failover is disabled with root_volume")
+		failover = nil
+	}
+
+	count := opts.Count
+	if count == 0 {
+		count = 1
+	}
+	if count > 1 && opts.DNSZone != "" && !strings.Contains(opts.DNSName, "{{id}}") {
+		fmt.Fprintln(os.Stderr, "With --count, --dns-name must use {{id}} so that each instance gets its own record")
+		exit(1)
+	}
+
+	var privateIPs []string
+	if len(opts.PrivateIPs) > 0 || len(config.PrivateIPPool) > 0 {
+		if privateIPs, err = choosePrivateIPs(commandContext, networkInterfacesClient, config.SubnetId, opts.PrivateIPs, config.PrivateIPPool, count); err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error choosing the private addresses:")
+			fmt.Fprintln(os.Stderr, err)
+			fail(err)
+		}
+		// The addresses belong to the subnet of the default region.
+		if len(failover) > 0 {
+			fmt.Fprintln(os.Stderr, "Region failover is disabled with private addresses")
+			failover = nil
+		}
+	}
+	// Warm instances keep the addresses they were launched with.
+	fromWarmPool := opts.FromWarmPool
+	if fromWarmPool && len(privateIPs) > 0 {
+		fmt.Fprintln(os.Stderr, "The warm pool is not used with private addresses")
+		fromWarmPool = false
 	}
 
-	// instanceType := &config.InstanceType
+	if opts.MetadataTags {
+		if err := checkMetadataTagKeys(tags); err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error validating the tags:")
+			fmt.Fprintln(os.Stderr, err)
+			fail(err)
+		}
+	}
+	if config.Preset != "" {
+		tags[presetTag] = config.Preset
+	}
+	tags[runIDTag] = run.ID
 
-	input := &ec2.RunInstancesInput{
-		ImageId:      aws.String(config.ImageId),
-		InstanceType: (types.InstanceType)(config.InstanceType),
-		MinCount:     &minMaxCount,
-		MaxCount:     &minMaxCount,
+	launch := &launchPlan{
+		Command:        "create",
+		TagKey:         *name,
+		TagValue:       *value,
+		InstanceType:   config.InstanceType,
+		ImageID:        config.ImageId,
+		Count:          count,
+		Tags:           tags,
+		OverrideBudget: opts.OverrideBudget,
+	}
+	if err := beforeLaunch(commandContext, config, launch); err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error before the launch:")
+		fmt.Fprintln(os.Stderr, err)
+		if errors.Is(err, errOverBudget) {
+			fmt.Fprintln(os.Stderr, "Pass --override-budget to launch anyway")
+		}
+		fail(err)
 	}
 
-	result, err := MakeInstance(context.TODO(), client, input)
+	if config.UserData != "" {
+		userData = append(userData, config.UserData)
+	}
+	// The config is kept by its hash so that diff can compare it later.
+	configHash, err := recordConfig(config)
 	if err != nil {
-		fmt.Println("Got an error creating an instance:")
-		fmt.Println(err)
+		fmt.Fprintln(os.Stderr, "Got an error recording the config, diff will only compare the instance's settings:")
+		fmt.Fprintln(os.Stderr, err)
+	}
+	progressln("Starting create run " + run.ID)
+	saveRun(context.TODO(), run)
+	requestedAt := time.Now()
+	// The instances are tagged as they launch.
+	steps := newStepTimer()
+	// warm are the instances started from the warm pool, and instances those
+	// launched.
+	var warm, instances []types.Instance
+	var region string
+	err = steps.run("", "launch and tag", func() error {
+		in := &vmcreate.CreateInput{
+			Tags:         withProvenance(commandContext, tags, configHash),
+			Count:        count,
+			InstanceType: config.InstanceType,
+			ImageID:      config.ImageId,
+			SubnetID:     config.SubnetId,
+			UserData:     buildUserData(userData),
+			Customize: launchCustomization(launchOptions{
+				KeyName:          opts.KeyName,
+				SecurityGroupIDs: config.SecurityGroupIds,
+				InstanceProfile:  config.IamInstanceProfile,
+				Enclaves:         opts.Enclaves,
+				MetadataTags:     opts.MetadataTags,
+				RootVolume:       rootVolume,
+			}),
+		}
+		var err error
+		region = awsConfig.Region
+		if fromWarmPool {
+			if warm, err = startWarmInstances(commandContext, *name, *value, config.InstanceType, config.ImageId, count); err != nil {
+				return err
+			}
+			if len(warm) > 0 {
+				// The warm instances are of the default region, and now of this run.
+				failover = nil
+				if err := provisioner.Tag(commandContext, instanceIDs(warm), tags); err != nil {
+					fmt.Fprintln(os.Stderr, "Warning: could not tag the warm instances: "+err.Error())
+				}
+			}
+			if in.Count -= len(warm); in.Count == 0 {
+				return nil
+			}
+		}
+		if len(privateIPs) > 0 {
+			instances, err = launchAtPrivateIPs(commandContext, in, privateIPs)
+		} else {
+			instances, region, err = createWithFailover(commandContext, in, failover)
+		}
+		if err != nil && len(warm) > 0 {
+			// The warm instances go back to the pool rather than being left
+			// running for a create that failed.
+			if serr := provisioner.Stop(commandContext, instanceIDs(warm)); serr != nil {
+				fmt.Fprintln(os.Stderr, "Got an error stopping the warm instances again:")
+				fmt.Fprintln(os.Stderr, serr)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error creating an instance:")
+		fmt.Fprintln(os.Stderr, err)
+		notify(context.TODO(), config.Notifications, &Event{Command: "create", Status: "failure", TagKey: *name, TagValue: *value, Error: err.Error()})
+		finishRun(context.TODO(), run)
 		return
 	}
+	for _, instance := range warm {
+		printResult("Started warm instance with ID "+*instance.InstanceId+" in "+region, *instance.InstanceId)
+	}
+	for _, instance := range instances {
+		printResult("Created tagged instance with ID "+*instance.InstanceId+" in "+region, *instance.InstanceId)
+	}
+	recordLifecycleAt(context.TODO(), "create", instances, region, phaseRequested, "", requestedAt)
+	instances = append(warm, instances...)
+	run.launched(context.TODO(), instances, region)
+	recordLifecycle(context.TODO(), "create", instances, region, phaseLaunching, "")
+	afterLaunch(instances, region, config, run, steps, fail)
+}
 
-	tagInput := &ec2.CreateTagsInput{
-		Resources: []string{*result.Instances[0].InstanceId},
-		Tags: []types.Tag{
-			{
-				Key:   name,
-				Value: value,
-			},
-		},
+// afterLaunch runs the steps after launch on the instances of the run and
+// reports the create.
+func afterLaunch(instances []types.Instance, region string, config ConfigMap, run *CreateRun, steps *stepTimer, fail func(error)) {
+	opts := run.Options
+	name, value := &run.TagKey, &run.TagValue
+	for _, instance := range instances {
+		createdInstanceSteps(&instance, config, run, steps, fail)
 	}
 
-	_, err = MakeTags(context.TODO(), client, tagInput)
-	if err != nil {
-		fmt.Println("Got an error tagging the instance:")
-		fmt.Println(err)
+	if ciOutput != "" || resultFile != "" {
+		// The addresses are only known once the instances run.
+		var running []types.Instance
+		for _, instance := range instances {
+			i, err := provisioner.WaitForRunning(commandContext, *instance.InstanceId, boundedWait(opts.ProvisionTimeout))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Got an error waiting for the instance, its addresses are left out of the outputs:")
+				fmt.Fprintln(os.Stderr, err)
+				i = &instance
+			}
+			running = append(running, *i)
+		}
+		recordCIInstances(running, region)
+		resultInstances(running, region, run.Created.DNSNames)
+	}
+	if config.CMDB != nil {
+		updateCMDB(config.CMDB, hookInstances(instances), false)
+	}
+	postCreateHooks(context.TODO(), config, *name, *value, instances)
+	notify(context.TODO(), config.Notifications, &Event{
+		Command:     "create",
+		Status:      "success",
+		TagKey:      *name,
+		TagValue:    *value,
+		InstanceIDs: run.InstanceIDs,
+	})
+	finishRun(context.TODO(), run)
+	steps.summary()
+}
+
+// createdInstanceSteps runs the steps after launch on one of the created
+// instances, reporting them with their times, and recording what they
+// register for a rollback and the steps done for a resume.
+func createdInstanceSteps(instance *types.Instance, config ConfigMap, run *CreateRun, steps *stepTimer, fail func(error)) {
+	opts, created := run.Options, &run.Created
+	instanceID := *instance.InstanceId
+	if opts.NoSourceDestCheck || opts.DNSZone != "" || opts.ProvisionScript != "" || opts.HealthCheck != "" || opts.TargetGroupArn != "" {
+		recordLifecycle(context.TODO(), "create", []types.Instance{*instance}, "", phaseBootstrapping, "")
+	}
+	if opts.EFSMount != nil && config.SubnetId == "" {
+		az := aws.ToString(instance.Placement.AvailabilityZone)
+		if err := checkMountTarget(commandContext, efsClient, opts.EFSMount, az); err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error validating the EFS mount:")
+			fmt.Fprintln(os.Stderr, err)
+			fail(err)
+		}
+	}
+
+	// The steps that change the instance or need its addresses wait once
+	// for it to run.
+	running := instance
+	if opts.NoSourceDestCheck || opts.DNSZone != "" || opts.TargetGroupArn != "" || opts.WaitStatusChecks {
+		err := steps.run(instanceID, "wait running", func() error {
+			var err error
+			running, err = provisioner.WaitForRunning(commandContext, instanceID, boundedWait(opts.ProvisionTimeout))
+			return err
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error waiting for the instance:")
+			fmt.Fprintln(os.Stderr, err)
+			fail(err)
+		}
+	}
+	if opts.WaitStatusChecks {
+		err := steps.run(instanceID, "wait status checks", func() error {
+			return waitForStatusChecks(commandContext, client, instanceID, boundedWait(opts.ProvisionTimeout))
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error waiting for the status checks:")
+			fmt.Fprintln(os.Stderr, err)
+			fail(err)
+		}
+	}
+
+	if opts.NoSourceDestCheck && !run.done(instanceID, stepSourceDestCheck) {
+		err := steps.run(instanceID, "source/destination check", func() error {
+			return provisioner.SetSourceDestCheck(commandContext, instanceID, false)
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error disabling the source/destination check:")
+			fmt.Fprintln(os.Stderr, err)
+			fail(err)
+		}
+		progressln("Disabled the source/destination check of instance with ID " + instanceID)
+		run.complete(context.TODO(), instanceID, stepSourceDestCheck)
+	}
+
+	if opts.DNSZone != "" && !run.done(instanceID, stepDNS) {
+		dnsName := instanceDNSName(opts.DNSName, opts.DNSZone, run.TagValue, instanceID)
+		var ip string
+		err := steps.run(instanceID, "dns", func() error {
+			var err error
+			ip, err = registerDNS(commandContext, route53Client, running, opts.DNSZone, dnsName, opts.DNSPublicIP)
+			return err
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error registering the DNS record:")
+			fmt.Fprintln(os.Stderr, err)
+			fail(err)
+		}
+		created.DNSNames = append(created.DNSNames, dnsName)
+		progressln("Registered " + dnsName + " -> " + ip)
+		run.complete(context.TODO(), instanceID, stepDNS)
+	}
+
+	if opts.ProvisionScript != "" && !run.done(instanceID, stepProvision) {
+		err := steps.run(instanceID, "provision", func() error {
+			return provisionInstance(commandContext, ssmClient, instanceID, opts.ProvisionScript, opts.ProvisionVia, opts.OSUser, boundedWait(opts.ProvisionTimeout))
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error provisioning the instance:")
+			fmt.Fprintln(os.Stderr, err)
+			fail(err)
+		}
+		progressln("Provisioned instance with ID " + instanceID)
+		run.complete(context.TODO(), instanceID, stepProvision)
+	}
+
+	if opts.HealthCheck != "" && !run.done(instanceID, stepHealthCheck) {
+		err := steps.run(instanceID, "health check", func() error {
+			return waitForHealthy(commandContext, instanceID, opts.HealthCheck, boundedWait(opts.HealthTimeout))
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error health checking the instance:")
+			fmt.Fprintln(os.Stderr, err)
+			fail(err)
+		}
+		progressln("Instance with ID " + instanceID + " is healthy")
+		run.complete(context.TODO(), instanceID, stepHealthCheck)
+	}
+
+	if opts.TargetGroupArn != "" && !run.done(instanceID, stepTargetGroup) {
+		// A failed registration may still have registered the target.
+		created.Targets = append(created.Targets, instanceID)
+		err := steps.run(instanceID, "target group", func() error {
+			return registerTarget(commandContext, elbv2Client, opts.TargetGroupArn, instanceID, boundedWait(opts.HealthTimeout))
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error registering the instance with the target group:")
+			fmt.Fprintln(os.Stderr, err)
+			fail(err)
+		}
+		progressln("Instance with ID " + instanceID + " is in service")
+		run.complete(context.TODO(), instanceID, stepTargetGroup)
+	}
+	recordLifecycle(context.TODO(), "create", []types.Instance{*instance}, "", phaseReady, "")
+}
+
+func ResizeInstanceCmd(instanceID *string, instanceType *string) {
+	// The config is optional for resize, it only adds notifications.
+	config, err := loadConfig()
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		commandErr = err
 		return
 	}
+	event := &Event{Command: "resize", InstanceIDs: []string{*instanceID}}
+	fail := func(err error) {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error resizing the instance:")
+		fmt.Fprintln(os.Stderr, err)
+		event.Status, event.Error = "failure", err.Error()
+		notify(context.TODO(), config.Notifications, event)
+	}
 
-	fmt.Println("Created tagged instance with ID " + *result.Instances[0].InstanceId)
-
-	//Testing change of instanceType
-	// fmt.Println("Updating instance type of instance with ID " + *result.Instances[0].InstanceId)
-	// time.Sleep(30 * time.Second)
-
-	// instanceID := *result.Instances[0].InstanceId
-	// newInstanceType := "t2.nano"
-
-	// //Stopping instances before changing instance type
-	// fmt.Println("Stopping instances before changing instance type")
-	// stopInstancesInput := &ec2.StopInstancesInput{
-	// 	InstanceIds: []string{instanceID},
-	// 	Force:       aws.Bool(false),
-	// }
-	// _, err = PauseInstances(context.TODO(), client, stopInstancesInput)
-	// if err != nil {
-	// 	fmt.Println("Got an error stoping the instance:")
-	// 	fmt.Println(err)
-	// 	return
-	// }
-
-	// //this sleep for letting ec2 stop
-	// time.Sleep(60 * time.Second)
-	// Wait for the instance to be stopped
-	// for {
-	// 	describeOutput, err := svc.DescribeInstances(context.Background(), &ec2.DescribeInstancesInput{
-	// 		InstanceIds: []string{instanceID},
-	// 	})
-	// 	if err != nil {
-	// 		fmt.Println("Error describing instance:", err)
-	// 		return
-	// 	}
-	// 	if describeOutput.Reservations[0].Instances[0].State.Name == ec2.InstanceStateNameStopped {
-	// 		break
-	// 	}
-	// 	time.Sleep(5 * time.Second)
-	// }
-
-	// Modify the instance type
-	// _, err = svc.ModifyInstanceAttribute(context.Background(), &ec2.ModifyInstanceAttributeInput{
-	// 	InstanceId: &instanceID,
-	// 	InstanceType: &ec2.AttributeValue{
-	// 		Value: &newInstanceType,
-	// 	},
-
-	// attributeInput := &ec2.ModifyInstanceAttributeInput{
-	// 	InstanceId: &instanceID,
-	// 	InstanceType: &types.AttributeValue{
-	// 		Value: &newInstanceType,
-	// 	},
-	// }
-
-	// _, err = UpdateInstanceAttribute(context.TODO(), client, attributeInput)
-	// if err != nil {
-	// 	fmt.Println("Got an error updating the instance:")
-	// 	fmt.Println(err)
-	// 	return
-	// }
+	// An unknown type is caught before the instance is stopped for nothing.
+	if _, err := findInstanceType(context.TODO(), instanceTypesClient, awsConfig.Region, *instanceType); errors.Is(err, errInstanceTypeNotOffered) {
+		fail(err)
+		return
+	}
+	progressln("Resizing instance with ID " + *instanceID + " to " + *instanceType)
+	if err := provisioner.Resize(context.TODO(), *instanceID, *instanceType); err != nil {
+		fail(err)
+		return
+	}
+	printResult("Resized instance with ID "+*instanceID, *instanceID)
+	event.Status = "success"
+	notify(context.TODO(), config.Notifications, event)
+}
 
+// launchOptions are the RunInstances settings create adds to those of the
+// Provisioner.
+type launchOptions struct {
+	KeyName          string
+	SecurityGroupIDs []string
+	InstanceProfile  string
+	Enclaves         bool
+	// MetadataTags lets software on the instance read its tags from IMDS.
+	MetadataTags bool
+	// RootVolume replaces the image's mapping of its root device.
+	RootVolume *types.BlockDeviceMapping
 }
+
+// launchCustomization returns a RunInstances customization launching with
+// the options, or nil without any.
+func launchCustomization(o launchOptions) func(*ec2.RunInstancesInput) {
+	if o.KeyName == "" && len(o.SecurityGroupIDs) == 0 && o.InstanceProfile == "" && !o.Enclaves && !o.MetadataTags && o.RootVolume == nil {
+		return nil
+	}
+	return func(in *ec2.RunInstancesInput) {
+		if o.Enclaves {
+			in.EnclaveOptions = &types.EnclaveOptionsRequest{Enabled: aws.Bool(true)}
+		}
+		if o.MetadataTags {
+			in.MetadataOptions = &types.InstanceMetadataOptionsRequest{InstanceMetadataTags: types.InstanceMetadataTagsStateEnabled}
+		}
+		if o.InstanceProfile != "" {
+			in.IamInstanceProfile = &types.IamInstanceProfileSpecification{Name: aws.String(o.InstanceProfile)}
+		}
+		if o.KeyName != "" {
+			in.KeyName = aws.String(o.KeyName)
+		}
+		if len(o.SecurityGroupIDs) > 0 {
+			in.SecurityGroupIds = o.SecurityGroupIDs
+		}
+		if o.RootVolume != nil {
+			in.BlockDeviceMappings = append(in.BlockDeviceMappings, *o.RootVolume)
+		}
+	}
+}
+
+// failCreate rolls back what the create made when requested, and exits
+// non-zero so that callers see the create as failed. A run that is kept
+// can be resumed once the cause of the failure is fixed.
+func failCreate(run *CreateRun) {
+	created := &run.Created
+	if run.Options.Rollback {
+		created.rollback(context.TODO(), run.Options)
+		if len(run.InstanceIDs) > 0 {
+			finishRun(context.TODO(), run)
+		}
+	} else if len(created.InstanceIDs) > 0 {
+		progressln("Keeping instances with ids " + strings.Join(created.InstanceIDs, ", ") + " (--on-failure rollback terminates them)")
+		progressln("Resume the create with create --resume " + run.ID)
+	}
+	exit(1)
+}
+
 func init() {
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+	cfg, err := loadAWSConfig()
 	if err != nil {
 		panic("configuration error, " + err.Error())
 	}
-	client = ec2.NewFromConfig(cfg)
+	newClients(cfg)
+}
 
+// loadAWSConfig loads the shared AWS configuration, with the MFA prompt and
+// session cache for profiles that need them.
+func loadAWSConfig(optFns ...func(*config.LoadOptions) error) (aws.Config, error) {
+	mfaOptions, mfaCachePath := mfaLoadOptions(context.TODO())
+	cfg, err := config.LoadDefaultConfig(context.TODO(), append(mfaOptions, optFns...)...)
+	if err != nil {
+		return cfg, err
+	}
+	if mfaCachePath != "" {
+		cfg.Credentials = aws.NewCredentialsCache(&fileCredentialsCache{path: mfaCachePath, provider: cfg.Credentials})
+	}
+	cfg.APIOptions = append(cfg.APIOptions, recordRequestIDs)
+	return cfg, nil
 }
+
+// newClients creates the service clients from cfg. It is called again when
+// the command line changes the configuration, e.g. with --endpoint-url.
+func newClients(cfg aws.Config) {
+	awsConfig = cfg
+	client = ec2.NewFromConfig(cfg)
+	instanceTypesClient = client
+	networkInterfacesClient = client
+	terminationOrderClient = client
+	provisioner = vmcreate.NewWithProvider(selectedProvider(client))
+	instanceConnectClient = awsapi.NewInstanceConnect(cfg)
+	ssmClient = awsapi.NewSSM(cfg)
+	iamClient = awsapi.NewIAM(cfg)
+	s3Client = awsapi.NewS3(cfg)
+	route53Client = awsapi.NewRoute53(cfg)
+	elbv2Client = awsapi.NewELBv2(cfg)
+	efsClient = awsapi.NewEFS(cfg)
+	secretsManagerClient = awsapi.NewSecretsManager(cfg)
+	eventBridgeClient = awsapi.NewEventBridge(cfg)
+	organizationsClient = awsapi.NewOrganizations(cfg)
+	cloudTrailClient = awsapi.NewCloudTrail(cfg)
+	cloudWatchClient = awsapi.NewCloudWatch(cfg)
+	serviceQuotasClient = awsapi.NewServiceQuotas(cfg)
+	dynamoDBClient = awsapi.NewDynamoDB(cfg)
+	savingsPlansClient = awsapi.NewSavingsPlans(cfg)
+	budgetsClient = awsapi.NewBudgets(cfg)
+	costExplorerClient = awsapi.NewCostExplorer(cfg)
+	taggingClient = awsapi.NewTagging(cfg)
+}
+
 func main() {
-	fmt.Println("Provisioning/De-provisioning EC2 in progress")
+	// A command that failed exits with 1, so that scripts can tell.
+	commandErr = nil
+	defer func() {
+		if commandErr != nil {
+			osExit(1)
+		}
+	}()
 	command := flag.String("c", "", "command  create or delete")
 	name := flag.String("n", "", "The name of the tag to attach to the instance")
 	value := flag.String("v", "", "The value of the tag to attach to the instance")
-	// imageId := flag.String("i", "", "The instance id of the instance")
-	// instanceTypeString := flag.String("t", "", "The type of the instance")
+	tag := flag.String("tag", "", "The tag to select instances by, as KEY=VALUE (same as -n KEY -v VALUE)")
+	group := flag.String("group", "", "The group of data/config.json or group create to select instances by, instead of a tag")
+	instanceID := flag.String("i", "", "The instance id of the instance")
+	osUser := flag.String("u", "ec2-user", "The OS user to connect as")
+	usePrivateIP := flag.Bool("private-ip", false, "Connect to the private IP address of the instance")
+	remotePort := flag.Int("remote-port", 0, "The port on the instance to forward to")
+	localPort := flag.Int("local-port", 0, "The local port to listen on (defaults to the remote port)")
+	keyPath := flag.String("key", "", "The private key to copy files with (defaults to an ephemeral key), or where rotate-key writes the new one")
+	bucket := flag.String("bucket", "", "The S3 bucket to stage copies to instances without a public IP")
+	provisionScript := flag.String("provision", "", "A script to run on the instance once it is reachable")
+	provisionVia := flag.String("provision-via", "ssm", "How to run the provisioning script, ssm or ssh")
+	provisionTimeout := flag.Duration("provision-timeout", 10*time.Minute, "How long to wait for the instance to be reachable")
+	healthCheck := flag.String("health-check", "", "A URL such as http://:8080/healthz or tcp://:22 that must respond after create")
+	createTimeout := flag.Duration("create-timeout", 0, "How long create may take in all, its AWS calls and waits included, before it fails")
+	deleteTimeout := flag.Duration("delete-timeout", 0, "How long delete may take in all, its AWS calls and waits included, before it fails")
+	waitTimeoutFlag := flag.Duration("wait-timeout", 0, "The longest any wait of a command may take, such as for an instance to run or a target to drain")
+	healthTimeout := flag.Duration("health-timeout", 5*time.Minute, "How long to wait for the health check to pass")
+	dnsZone := flag.String("dns-zone", "", "The Route 53 hosted zone to register instances in")
+	dnsName := flag.String("dns-name", "{{name}}", "The record name to register, {{name}} is the tag value and {{id}} the instance id")
+	dnsPublicIP := flag.Bool("dns-public-ip", false, "Register the public IP instead of the private IP")
+	targetGroupArn := flag.String("target-group-arn", "", "The load balancer target group to register instances with")
+	drainTimeout := flag.Duration("drain-timeout", 10*time.Minute, "How long to wait for connections to drain before terminating")
+	efsMount := flag.String("efs", "", "An EFS file system to mount at boot, e.g. fs-12345:/mnt/shared")
+	k8sJoin := flag.String("k8s-join", "", "Join the instance to a Kubernetes cluster at boot, kubeadm or eks")
+	k8sEndpoint := flag.String("k8s-endpoint", "", "The Kubernetes API server endpoint")
+	k8sToken := flag.String("k8s-token", "", "The kubeadm bootstrap token")
+	k8sCAHash := flag.String("k8s-ca-hash", "", "The kubeadm discovery CA certificate hash")
+	k8sCluster := flag.String("k8s-cluster", "", "The EKS cluster name")
+	k8sCAData := flag.String("k8s-ca-data", "", "The base64 encoded EKS cluster CA certificate")
+	cloudWatchLogs := flag.String("cloudwatch-logs", "", "Ship the system logs, and those of --log-files, to this CloudWatch Logs group with the CloudWatch agent")
+	logFiles := flag.String("log-files", "", "Comma separated application log files --cloudwatch-logs ships too, e.g. /var/log/app/*.log")
+	ciRunner := flag.String("ci-runner", "", "Install Docker and a CI runner at boot, github or gitlab")
+	ciURL := flag.String("ci-url", "", "The GitHub repository/organization or GitLab instance URL to register the runner with")
+	ciTokenSecret := flag.String("ci-token-secret", "", "The Secrets Manager secret holding the runner registration token")
+	snsTopic := flag.String("sns-topic", "", "The SNS topic ARN alerts are sent to")
+	desiredState := flag.String("desired-state", "", "The YAML or JSON file describing the fleet the daemon maintains")
+	interval := flag.Duration("interval", time.Minute, "How often the daemon reconciles the fleet, or the tui and list --watch refresh (10s unless set)")
+	prune := flag.Bool("prune", false, "Terminate instances of groups that are no longer in the desired state")
+	dryRun := flag.Bool("dry-run", false, "Report the changes without making them")
+	listen := flag.String("listen", ":8080", "The address the API server (serve or grpc-serve) listens on")
+	since := flag.Duration("since", 0, "Only show the history of this long ago, e.g. 24h")
+	replaceAfter := flag.Duration("replace-unhealthy", 0, "Have the daemon replace instances whose status checks have failed for this long, e.g. 10m")
+	metricsListen := flag.String("metrics-listen", "", "The address the daemon serves Prometheus metrics on, e.g. :9100")
+	metricsTag := flag.String("metrics-tag", groupTag, "The tag key of the instances counted on /metrics, whose values label them")
+	apiTokenFile := flag.String("api-token-file", "", "A file holding the bearer token API clients must send")
+	onFailure := flag.String("on-failure", "keep", "What create does with what it made when a step fails, rollback or keep")
+	runID := flag.String("run-id", "", "The run, as printed when it starts and tagged as aws-vmcreate:run-id, that cleanup deletes everything of")
+	resume := flag.String("resume", "", "Resume the interrupted create with this run ID, which create prints when it starts")
+	terminateOnFailure := flag.Bool("terminate-on-failure", false, "Same as --on-failure rollback")
+	count := flag.Int("count", 1, "The number of instances to create")
+	providerName := flag.String("provider", "", "Where instances are created, ec2 or memory (kept in the process, for trying serve and the daemon); defaults to the provider of data/config.json, then ec2")
+	endpointURL := flag.String("endpoint-url", os.Getenv("AWS_ENDPOINT_URL"), "Send all AWS calls to this endpoint, e.g. http://localhost:4566 for LocalStack")
+	s3PathStyle := flag.Bool("s3-path-style", false, "Use path-style S3 URLs, as LocalStack and moto expect")
+	useFIPSEndpoint := flag.Bool("use-fips-endpoint", false, "Use FIPS 140-2 validated endpoints, e.g. in GovCloud")
+	useDualStackEndpoint := flag.Bool("use-dualstack-endpoint", false, "Use dual-stack (IPv4 and IPv6) endpoints, e.g. from IPv6-only networks")
+	debugAWS := flag.Bool("debug-aws", false, "Log every AWS call, with its parameters, latency, request id and retries, to stderr")
+	caBundle := flag.String("ca-bundle", "", "A PEM file of CA certificates to trust instead of the system ones, e.g. behind a TLS-intercepting proxy")
+	regions := flag.String("regions", "", "Comma separated regions to list or delete in, concurrently")
+	allRegions := flag.Bool("all-regions", false, "List or delete in every region enabled for the account")
+	allAccounts := flag.Bool("all-accounts", false, "List instances in every account of the AWS Organization")
+	accountRole := flag.String("account-role", "OrganizationAccountAccessRole", "The role assumed in each account with --all-accounts")
+	allResources := flag.Bool("all-resources", false, "List every resource tagged managed-by=aws-vmcreate, not just instances")
+	flag.StringVar(&mfaToken, "mfa-token", "", "The MFA code for profiles with mfa_serial (prompted for when missing)")
+	roleArn := flag.String("role-arn", "", "An IAM role to assume, e.g. in another account, before provisioning")
+	externalID := flag.String("external-id", "", "The external ID required by the role's trust policy")
+	roleSessionName := flag.String("role-session-name", "aws-vmcreate", "The session name recorded in CloudTrail for the assumed role")
+	instanceType := flag.String("t", "", "The type of the instance")
+	imageID := flag.String("image-id", "", "The AMI to create the instance from, instead of the one in data/config.json")
+	subnetID := flag.String("subnet-id", "", "The subnet to create the instance in, instead of the one in data/config.json")
+	subnetStrategy := flag.String("subnet-strategy", "", "How create chooses a subnet when none is given: most-free-ips, round-robin-az, cheapest-az-spot or \"same-as tag:KEY=VALUE\"")
+	scaleTo := flag.Int("to", -1, "The number of running instances of the tag scale launches or terminates instances to reach")
+	perZone := flag.String("per-zone", "", "The number of running instances scale keeps in the subnet of each zone, as SUBNET=N pairs, comma separated, instead of --to")
+	terminationPolicy := flag.String("termination-policy", "oldest-first", "Which instances scale and delete --count terminate first: oldest-first, newest-first, cheapest-az-first, unhealthy-first, or drain for those draining, then not yet ready, then the newest")
+	fromWarmPool := flag.Bool("from-warm-pool", false, "Have create start stopped warm instances of the tag, instance type and image, put on standby, before launching new ones")
+	privateIPs := flag.String("private-ips", "", "The private addresses of the instances create launches, comma separated, one an instance, instead of those of private_ip_pool")
+	keyName := flag.String("key-name", "", "The EC2 key pair to create the instance with")
+	extraTags := flag.String("extra-tags", "", "More tags to create the instance with, as KEY=VALUE,KEY=VALUE")
+	family := flag.String("family", "", "Only list the instance types of this family, e.g. c6i")
+	minVCPUs := flag.Int("min-vcpus", 0, "Only list the instance types with at least this many vCPUs")
+	minMemory := flag.Float64("min-memory", 0, "Only list the instance types with at least this much memory, in GiB")
+	arch := flag.String("arch", "", "Only list the instance types of this architecture, x86_64 or arm64")
+	flag.DurationVar(&instanceTypeCacheTTL, "cache-ttl", instanceTypeCacheTTL, "How long the instance types of a region are cached, 0 to list them again")
+	watch := flag.Bool("watch", false, "Keep refreshing the list in place, highlighting state changes")
+	interactive := flag.Bool("interactive", false, "Choose the region, OS, size, key pair, network and tags of create, or the settings of init, from lists")
+	forceInit := flag.Bool("force", false, "Let init replace an existing data/config.json, or state push an older state")
+	rate := flag.Float64("rate", ec2MutatingRate, "Mutating EC2 calls a second the changes to many instances are made at, at most 8 at a time (--concurrency)")
+	concurrency := flag.Int("concurrency", 8, "How many instances the changes to many instances are made to at once")
+	lock := flag.String("lock", "", "Lock the tag group create, delete or the daemon changes, in dynamodb://TABLE or s3://BUCKET/PREFIX")
+	stateSpec := flag.String("state", "", "Keep the lifecycle of the instances in dynamodb://TABLE[/KEY] or s3://BUCKET/KEY instead of ~/.aws/aws-vmcreate/state.json")
+	configSets = nil
+	flag.StringVar(&configPreset, "preset", "", "Apply a preset of data/config.json, e.g. gpu-training, over its other settings")
+	remoteConfigs = nil
+	flag.StringVar(&configSource, "config", "", "Read the provisioning config from a file, s3://BUCKET/KEY, ssm://PARAMETER or an https:// URL instead of data/config.json")
+	ciInstances = nil
+	flag.StringVar(&ciOutput, "ci-output", "", "Write the created instances for a CI system, github for $GITHUB_OUTPUT and error annotations, or dotenv")
+	flag.StringVar(&ciOutputFile, "ci-output-file", "aws-vmcreate.env", "The file --ci-output dotenv writes")
+	flag.BoolVar(&quiet, "quiet", false, "Print only the identifiers of the results, e.g. the IDs of the created instances, and no progress")
+	flag.StringVar(&resultFile, "result-file", "", "Write a JSON summary of the command to the file: the instances with their addresses, DNS names, key and errors")
+	flag.Var(&configSets, "set", "Override a setting of data/config.json as KEY=VALUE, e.g. instance_type=t3.large or tags.team=web, repeatable")
+	flag.DurationVar(&lockTTL, "lock-ttl", lockTTL, "How long a lock is held before others may take it over")
+	flag.DurationVar(&lockWait, "lock-wait", 0, "How long to wait for a lock held by someone else, instead of failing")
+	metadataTags := flag.String("metadata-tags", "off", "on lets software on the instance read its tags from the instance metadata")
+	enclaves := flag.Bool("enclaves", false, "Launch with Nitro Enclaves enabled, checking that the instance type supports them")
+	nitroTPM := flag.Bool("nitro-tpm", false, "Check that the instance type and image support NitroTPM before launching")
+	gpuDrivers := flag.Bool("gpu-drivers", false, "Install the NVIDIA drivers at boot on GPU instances whose image lacks them")
+	maxAge := flag.Duration("max-age", 7*24*time.Hour, "How old age-report flags instances from, e.g. 72h")
+	notifyOld := flag.Bool("notify", false, "Send age-report's summary of the old instances to the configured notifications")
+	idleWindow := flag.Duration("window", 24*time.Hour, "How far back idle-check and rightsize look at the metrics")
+	scan := flag.Bool("scan", false, "Only scan for missing patches with patch, without installing them")
+	noReboot := flag.Bool("no-reboot", false, "Do not reboot the instances patch installs patches needing a reboot on")
+	apply := flag.Bool("apply", false, "Resize the instances to the types rightsize recommends")
+	cpuThreshold := flag.Float64("cpu-threshold", 5, "The peak average CPU utilization, in percent, below which idle-check finds an instance idle")
+	networkThreshold := flag.Float64("network-threshold", 5, "The peak network traffic, in MB per hour, below which idle-check finds an instance idle")
+	stopIdle := flag.Bool("stop", false, "Stop the instances idle-check finds idle")
+	overrideBudget := flag.Bool("override-budget", false, "Create even when the projected spend of the month passes the budget of data/config.json")
+	deny := flag.Bool("deny", false, "Deny the request with approve instead of approving it")
+	reason := flag.String("reason", "", "Why approve --deny denies the request, or why quarantine isolates the instance")
+	capture := flag.Bool("capture", false, "Have quarantine capture the volatile data and snapshot the volumes to the forensics bucket and account before it isolates the instance")
+	waitStatusChecks := flag.Bool("wait-status-checks", false, "Let create wait for the status checks of the instances to pass")
+	noSourceDestCheck := flag.Bool("no-source-dest-check", false, "Turn off the source/destination check after launch, for NAT and routing instances")
+	instanceProfile := flag.String("instance-profile", "", "The IAM instance profile to create the instance with, instead of the one in data/config.json")
+	resourceName := flag.String("name", "", "The name of the role and instance profile iam profile create makes, of the network network create and delete manage, of the environment of env, or the Name tag of the instance of the commands taking -i")
+	manifest := flag.String("manifest", "env.yaml", "The YAML or JSON manifest of the instances, network and DNS records env up creates")
+	envTTL := flag.Duration("ttl", 0, "How long the environment of env up lives, after which env down --expired removes it")
+	expired := flag.Bool("expired", false, "Tear down every environment whose --ttl has run out with env down")
+	policies := flag.String("policies", "AmazonSSMManagedInstanceCore", "Comma separated managed policies, by name or ARN, iam profile create attaches to the role")
+	protocol := flag.String("protocol", "tcp", "The protocol of the sg rule, tcp, udp, icmp or all")
+	port := flag.String("port", "", "The port or port range of the sg rule, e.g. 443 or 8000-8100")
+	cidr := flag.String("cidr", "", "The IPv4 or IPv6 CIDR the sg rule allows, or the IPv4 CIDR of the VPC network create makes (default 10.0.0.0/16)")
+	sourceGroup := flag.String("source-group", "", "The security group the sg rule allows, instead of a CIDR")
+	allowFrom := flag.String("allow-from", "", "The instances sg sync allows into the security groups of --tag, and their port, as tag:KEY=VALUE:PORT")
+	syncBy := flag.String("sync-by", "ip", "Whether sg sync allows the private ip of each instance of --allow-from or their sg")
+	egress := flag.Bool("egress", false, "Change an egress rule instead of an ingress rule")
+	ruleDescription := flag.String("description", "", "The description of the sg rule")
+	force := flag.Bool("i-know-what-im-doing", false, "Allow sg rules that open sensitive ports or all traffic to the internet")
+	fix := flag.String("fix", "", "The sg audit findings to fix: all, finding numbers or kinds, e.g. 1,3 or world-open")
+	yes := flag.Bool("yes", false, "Go ahead without asking for confirmation, with cleanup, rightsize --apply and events migrate")
+	azs := flag.Int("azs", 2, "The number of availability zones network create spreads its subnets over")
+	nat := flag.Bool("nat", false, "Give the private subnets of network create a NAT gateway, which is billed hourly")
+
+	args := parseArgs()
+	diagnostics = os.Stderr
+	if quiet {
+		diagnostics = io.Discard
+	}
+	progressln("Provisioning/De-provisioning EC2 in progress")
+
+	// The command and instance may also be given positionally, e.g. "tunnel i-0123 --remote-port 5432".
+	if *command == "" && len(args) > 0 {
+		*command, args = args[0], args[1:]
+	}
+	if tagKey, tagValue, ok := strings.Cut(*tag, "="); ok {
+		*name, *value = tagKey, tagValue
+	}
 
-	flag.Parse()
+	if err := telemetry.ConfigureFromEnv(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error configuring telemetry:", err)
+		osExit(1)
+	}
+	opts := awsOptions{
+		EndpointURL:          *endpointURL,
+		Provider:             *providerName,
+		S3PathStyle:          *s3PathStyle,
+		RoleArn:              *roleArn,
+		ExternalID:           *externalID,
+		RoleSessionName:      *roleSessionName,
+		CABundle:             *caBundle,
+		UseFIPSEndpoint:      *useFIPSEndpoint,
+		UseDualStackEndpoint: *useDualStackEndpoint,
+		DebugAWS:             *debugAWS,
+		Telemetry:            telemetry.Enabled(),
+		IgnoreConfigErrors:   *command == "init" || *command == "validate",
+	}
+	if err := reloadAWSConfig(opts); err != nil {
+		fmt.Fprintln(os.Stderr, "Error configuring AWS:", err)
+		osExit(1)
+	}
+	if *command != "login" {
+		if err := ensureSSOSession(context.TODO()); err != nil {
+			fmt.Fprintln(os.Stderr, "Error configuring AWS:", err)
+			osExit(1)
+		}
+	}
+	if err := configureAWS(opts); err != nil {
+		fmt.Fprintln(os.Stderr, "Error configuring AWS:", err)
+		osExit(1)
+	}
 
 	if *command == "" {
-		fmt.Println("You must supply an command  start or stop (-c start")
+		failCommand("You must supply an command  start or stop (-c start")
+		return
+	}
+
+	var createTags map[string]string
+	if *command == "create" {
+		var err error
+		if createTags, err = parseTags(*extraTags); err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error parsing --extra-tags:", err)
+			commandErr = err
+			return
+		}
+		if *metadataTags != "on" && *metadataTags != "off" {
+			failCommand("--metadata-tags must be on or off")
+			return
+		}
+	}
+	if *command == "create" && *interactive {
+		if !stdinIsTerminal() {
+			failCommand("The --interactive create needs a terminal")
+			return
+		}
+		choice, err := runWizard(context.TODO(), os.Stdin, os.Stdout, client, wizardChoice{
+			Region:       awsConfig.Region,
+			ImageID:      *imageID,
+			InstanceType: *instanceType,
+			KeyName:      *keyName,
+			SubnetID:     *subnetID,
+			TagValue:     *value,
+			ExtraTags:    createTags,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			commandErr = err
+			return
+		}
+		if !choice.Launch {
+			return
+		}
+		if choice.Region != awsConfig.Region {
+			cfg := awsConfig.Copy()
+			cfg.Region = choice.Region
+			newClients(cfg)
+		}
+		*name, *value = choice.TagKey, choice.TagValue
+		*imageID, *instanceType, *subnetID, *keyName = choice.ImageID, choice.InstanceType, choice.SubnetID, choice.KeyName
+		createTags = choice.ExtraTags
+	}
+
+	if instanceCommands[*command] && *instanceID == "" && *resourceName != "" {
+		id, err := resolveInstanceName(context.TODO(), provisioner, *resourceName)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			commandErr = err
+			return
+		}
+		*instanceID = id
+	}
+	switch *command {
+	case "connect", "tunnel", "resize", "who-created", "diff", "debug-clone", "quarantine":
+		if *instanceID == "" && len(args) > 0 {
+			*instanceID = args[0]
+		}
+		if *instanceID == "" && stdinIsTerminal() {
+			picked, err := pickInstance(context.TODO(), "Pick the instance to "+*command)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				commandErr = err
+				return
+			}
+			*instanceID = aws.ToString(picked.InstanceId)
+		}
+		if *instanceID == "" {
+			failCommand("You must supply an instance id (-i INSTANCE_ID or --name NAME)")
+			return
+		}
+	case "create", "delete", "alerts", "standby", "activate", "scale", "rotate-key":
+		// delete takes the instances by tag, and so a picked instance by its
+		// name along with any other instance of the name.
+		if *command == "delete" && (*name == "" || *value == "") && *group == "" && stdinIsTerminal() {
+			picked, err := pickInstance(context.TODO(), "Pick the instance to delete")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				commandErr = err
+				return
+			}
+			if *name, *value = "Name", vmcreate.TagValue(picked, "Name"); *value == "" {
+				failCommand(aws.ToString(picked.InstanceId) + " has no Name tag to delete it by")
+				return
+			}
+			progressln("Deleting the instances named " + *value)
+		}
+		// A resumed create selects the instances of its run.
+		if (*name == "" || *value == "") && *group == "" && (*command != "create" || *resume == "") {
+			failCommand("You must supply a name and value for the tag (-n NAME -v VALUE) or a group (--group NAME)")
+			return
+		}
+		if *command == "scale" && (*scaleTo < 0) == (*perZone == "") {
+			failCommand("You must supply the number of instances to scale to (--to N) or of each zone (--per-zone SUBNET=N,...)")
+			return
+		}
+		if !contains(terminationPolicies, *terminationPolicy) {
+			failCommand("--termination-policy must be one of " + strings.Join(terminationPolicies, ", "))
+			return
+		}
+		if *command == "delete" && flagPassed("count") && (*count < 1 || *regions != "" || *allRegions) {
+			failCommand("delete --count must be at least 1, and cannot be combined with --regions")
+			return
+		}
+	}
+
+	if ciOutput != "" && ciOutput != "github" && ciOutput != "dotenv" {
+		failCommand("--ci-output must be github or dotenv")
 		return
 	}
+	ciCommand = *command
 
-	if *name == "" || *value == "" {
-		fmt.Println("You must supply a name and value for the tag (-n NAME -v VALUE)")
+	metricsTagKey = *metricsTag
+	if *rate <= 0 || *concurrency < 1 {
+		failCommand("--rate and --concurrency must be positive")
 		return
 	}
+	operationRate, operationConcurrency = *rate, *concurrency
+	commandContext, waitTimeout = context.Background(), *waitTimeoutFlag
+	if waitTimeout > 0 {
+		provisioner = vmcreate.NewWithProvider(provisioner.Provider(), vmcreate.WithWaitTimeout(waitTimeout))
+	}
+	if timeout := map[string]time.Duration{"create": *createTimeout, "delete": *deleteTimeout}[*command]; timeout > 0 {
+		var cancel context.CancelFunc
+		commandContext, cancel = context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+	}
+	startCommand(*command)
+	startResult(*command, *keyName, *keyPath)
+	startAudit(*command, *instanceID)
+	defer endCommand()
 
-	if *command == "create" {
-		CreateInstancesCmd(name, value)
+	// The groups of group create are kept in the state store.
+	if stateCommands[*command] || *group != "" {
+		spec := *stateSpec
+		if spec == "" {
+			config, _ := loadConfig()
+			spec = config.State
+		}
+		var err error
+		if stateStore, err = newStateStore(spec); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			commandErr = err
+			return
+		}
+	}
+	if *group != "" && *command != "group" {
+		config, _ := loadConfig()
+		var err error
+		if *name, *value, err = lookupGroup(context.TODO(), config, stateStore, *group); err != nil {
+			commandErr = err
+			fmt.Fprintln(os.Stderr, "Got an error selecting the group:")
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+	}
+	var resumed *CreateRun
+	if *command == "create" && *resume != "" {
+		var err error
+		if resumed, err = loadRun(context.TODO(), *resume); err != nil {
+			commandErr = err
+			fmt.Fprintln(os.Stderr, "Got an error resuming the create:")
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		*name, *value = resumed.TagKey, resumed.TagValue
 	}
 
-	if *command == "delete" {
-		DeleteInstancesCmd(name, value)
+	switch *command {
+	case "create", "delete", "daemon", "scale":
+		spec := *lock
+		if spec == "" {
+			// The config is optional here, create reports it missing.
+			config, _ := loadConfig()
+			spec = config.Lock
+		}
+		var err error
+		if fleetLocker, err = newFleetLock(spec); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			commandErr = err
+			return
+		}
+		if *command != "daemon" {
+			if err := acquireFleetLock(commandContext, *name+"="+*value); err != nil {
+				commandErr = err
+				fmt.Fprintln(os.Stderr, "Got an error locking the fleet:")
+				fmt.Fprintln(os.Stderr, err)
+				return
+			}
+		}
+	}
+
+	var regionList []string
+	if *regions != "" || *allRegions {
+		var err error
+		if regionList, err = resolveRegions(context.TODO(), client, *regions, *allRegions); err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error resolving the regions:")
+			fmt.Fprintln(os.Stderr, err)
+			commandErr = err
+			return
+		}
+	}
+
+	switch *command {
+	case "create", "scale":
+		if resumed != nil {
+			resumeCreate(resumed)
+			return
+		}
+		var mount *EFSMount
+		if *efsMount != "" {
+			var err error
+			if mount, err = parseEFSMount(*efsMount); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				commandErr = err
+				return
+			}
+		}
+		var join *K8sJoin
+		if *k8sJoin != "" {
+			join = &K8sJoin{
+				Mode:        *k8sJoin,
+				Endpoint:    *k8sEndpoint,
+				Token:       *k8sToken,
+				CAHash:      *k8sCAHash,
+				ClusterName: *k8sCluster,
+				CAData:      *k8sCAData,
+			}
+			if err := join.validate(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				commandErr = err
+				return
+			}
+		}
+		if *onFailure != "rollback" && *onFailure != "keep" {
+			failCommand("--on-failure must be rollback or keep")
+			return
+		}
+		var logs *CloudWatchLogs
+		if *cloudWatchLogs != "" {
+			var err error
+			if logs, err = parseCloudWatchLogs(*cloudWatchLogs, *logFiles); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				commandErr = err
+				return
+			}
+		}
+		var runner *CIRunner
+		if *ciRunner != "" {
+			runner = &CIRunner{Kind: *ciRunner, URL: *ciURL, TokenSecret: *ciTokenSecret}
+		}
+		var ips []string
+		if *privateIPs != "" {
+			ips = strings.Split(*privateIPs, ",")
+		}
+		opts := &CreateOptions{
+			ProvisionScript:   *provisionScript,
+			ProvisionVia:      *provisionVia,
+			ProvisionTimeout:  *provisionTimeout,
+			OSUser:            *osUser,
+			HealthCheck:       *healthCheck,
+			HealthTimeout:     *healthTimeout,
+			DNSZone:           *dnsZone,
+			DNSName:           *dnsName,
+			DNSPublicIP:       *dnsPublicIP,
+			TargetGroupArn:    *targetGroupArn,
+			EFSMount:          mount,
+			K8sJoin:           join,
+			CIRunner:          runner,
+			CloudWatchLogs:    logs,
+			Count:             *count,
+			Rollback:          *onFailure == "rollback" || *terminateOnFailure,
+			InstanceType:      *instanceType,
+			ImageID:           *imageID,
+			SubnetID:          *subnetID,
+			SubnetStrategy:    *subnetStrategy,
+			KeyName:           *keyName,
+			InstanceProfile:   *instanceProfile,
+			NoSourceDestCheck: *noSourceDestCheck,
+			WaitStatusChecks:  *waitStatusChecks,
+			GPUDrivers:        *gpuDrivers,
+			Enclaves:          *enclaves,
+			NitroTPM:          *nitroTPM,
+			MetadataTags:      *metadataTags == "on",
+			ExtraTags:         createTags,
+			OverrideBudget:    *overrideBudget,
+			PrivateIPs:        ips,
+			FromWarmPool:      *fromWarmPool,
+		}
+		if *command == "scale" {
+			var zones []ZoneCount
+			if *perZone != "" {
+				var err error
+				if zones, err = parseZoneCounts(*perZone); err != nil {
+					failCommand("--per-zone: " + err.Error())
+					return
+				}
+			}
+			ScaleCmd(name, value, *scaleTo, zones, *terminationPolicy, opts, &DeleteOptions{
+				DNSZone:        *dnsZone,
+				DNSName:        *dnsName,
+				TargetGroupArn: *targetGroupArn,
+				DrainTimeout:   *drainTimeout,
+			}, dryRun)
+			return
+		}
+		CreateInstancesCmd(name, value, opts, nil)
+	case "delete":
+		deleteCount := 0
+		if flagPassed("count") {
+			deleteCount = *count
+		}
+		DeleteInstancesCmd(name, value, &DeleteOptions{
+			DNSZone:           *dnsZone,
+			DNSName:           *dnsName,
+			TargetGroupArn:    *targetGroupArn,
+			DrainTimeout:      *drainTimeout,
+			Regions:           regionList,
+			Count:             deleteCount,
+			TerminationPolicy: *terminationPolicy,
+		})
+	case "connect":
+		ConnectInstanceCmd(instanceID, osUser, usePrivateIP)
+	case "tunnel":
+		if *remotePort == 0 {
+			failCommand("You must supply the port to forward to (--remote-port PORT)")
+			return
+		}
+		TunnelInstanceCmd(instanceID, remotePort, localPort)
+	case "resize":
+		if *instanceType == "" {
+			failCommand("You must supply the new instance type (-t TYPE)")
+			return
+		}
+		ResizeInstanceCmd(instanceID, instanceType)
+	case "cp":
+		if len(args) != 2 {
+			failCommand("You must supply a source and destination (cp SRC INSTANCE_ID:DST or cp INSTANCE_ID:SRC DST)")
+			return
+		}
+		CopyFilesCmd(&args[0], &args[1], osUser, keyPath, bucket)
+	case "daemon":
+		if *desiredState == "" {
+			failCommand("You must supply the desired state file (--desired-state FILE)")
+			return
+		}
+		DaemonCmd(desiredState, interval, prune, dryRun, metricsListen, replaceAfter)
+	case "serve":
+		ServeCmd(listen, apiTokenFile)
+	case "grpc-serve":
+		GRPCServeCmd(listen, apiTokenFile)
+	case "login":
+		LoginCmd()
+	case "who-created":
+		WhoCreatedCmd(instanceID)
+	case "diff":
+		DiffCmd(instanceID)
+	case "debug-clone":
+		DebugCloneCmd(instanceID, instanceType, keyName, cidr)
+	case "quarantine":
+		QuarantineCmd(instanceID, reason, capture)
+	case "approve":
+		if len(args) != 1 {
+			failCommand("You must supply the request to approve (approve REQUEST_ID [--deny --reason REASON])")
+			return
+		}
+		ApproveCmd(args[0], deny, reason)
+	case "history":
+		var historyCommand string
+		if len(args) > 0 {
+			historyCommand = args[0]
+		}
+		// Anything but a command is an instance, whose lifecycle is shown.
+		if _, ok := commandActions[historyCommand]; historyCommand != "" && !ok {
+			LifecycleHistoryCmd(historyCommand)
+			return
+		}
+		HistoryCmd(&historyCommand, instanceID, since)
+	case "init":
+		InitCmd(interactive, forceInit)
+	case "validate":
+		ValidateCmd(instanceType, imageID, subnetID, keyName)
+	case "types":
+		if len(args) != 1 || args[0] != "list" {
+			failCommand("You must supply list (types list --family c6i --min-vcpus 8)")
+			return
+		}
+		TypesCmd(instanceTypeFilter{Family: *family, MinVCPUs: *minVCPUs, MinMemoryGiB: *minMemory, Architecture: *arch})
+	case "cleanup":
+		if *runID != "" {
+			CleanupRunCmd(*runID, dryRun, yes)
+			return
+		}
+		CleanupCmd(dryRun, yes)
+	case "sg":
+		if len(args) == 1 && args[0] == "audit" {
+			SGAuditCmd(fix)
+			return
+		}
+		if len(args) == 1 && args[0] == "sync" {
+			sync := SGSync{Tag: *tag, AllowFrom: *allowFrom, Protocol: *protocol, By: *syncBy}
+			if _, err := sync.parse(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				commandErr = err
+				return
+			}
+			SGSyncCmd(sync, dryRun)
+			return
+		}
+		if len(args) != 2 || (args[0] != "authorize" && args[0] != "revoke") {
+			failCommand("You must supply audit, sync, or authorize or revoke and the group (sg authorize GROUP_ID --port 443 --cidr 10.0.0.0/8)")
+			return
+		}
+		rule, err := parseSGRule(*protocol, *port, *cidr, *sourceGroup, *ruleDescription, *egress)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			commandErr = err
+			return
+		}
+		SGRuleCmd(args[0], args[1], rule, *force)
+	case "state":
+		valid := len(args) == 1 && (args[0] == "pull" || args[0] == "sync") ||
+			len(args) == 2 && (args[0] == "push" || args[0] == "unlock")
+		if !valid {
+			failCommand("You must supply pull, sync, push and the state file, or unlock and the lock key (state unlock env=prod)")
+			return
+		}
+		StateCmd(args[0], args[1:], lock, forceInit, dryRun)
+	case "group":
+		valid := len(args) == 1 && args[0] == "list" ||
+			len(args) == 2 && (args[0] == "create" && *tag != "" || args[0] == "delete")
+		if !valid {
+			failCommand("You must supply list, create and the name of the group with its filter, or delete and the name (group create staging-web --tag role=staging-web)")
+			return
+		}
+		GroupCmd(args[0], args[1:], tag)
+	case "network":
+		if len(args) != 1 || (args[0] != "create" && args[0] != "delete") {
+			failCommand("You must supply create or delete (network create --name dev --azs 2 --nat)")
+			return
+		}
+		if *resourceName == "" {
+			failCommand("You must supply the name of the network (--name NAME)")
+			return
+		}
+		if args[0] == "delete" {
+			NetworkDeleteCmd(resourceName)
+			return
+		}
+		if *cidr == "" {
+			*cidr = "10.0.0.0/16"
+		}
+		if *azs < 1 {
+			failCommand("--azs must be at least 1")
+			return
+		}
+		NetworkCreateCmd(networkOptions{Name: *resourceName, CIDR: *cidr, AZs: *azs, NAT: *nat})
+	case "env":
+		if len(args) != 1 || (args[0] != "up" && args[0] != "down" && args[0] != "list") {
+			failCommand("You must supply up, down or list (env up --name pr-1234 --ttl 6h, env down --name pr-1234)")
+			return
+		}
+		if args[0] != "list" && !(args[0] == "down" && *expired) && *resourceName == "" {
+			failCommand("You must supply the name of the environment (--name NAME)")
+			return
+		}
+		if strings.ContainsAny(*resourceName, "/\\") {
+			failCommand("The name of the environment cannot contain a slash")
+			return
+		}
+		EnvCmd(args[0], resourceName, manifest, envTTL, expired)
+	case "iam":
+		if len(args) != 2 || args[0] != "profile" || args[1] != "create" {
+			failCommand("You must supply profile create (iam profile create --name vm-ssm --policies AmazonSSMManagedInstanceCore)")
+			return
+		}
+		if *resourceName == "" {
+			failCommand("You must supply the name of the role and instance profile (--name NAME)")
+			return
+		}
+		IAMProfileCreateCmd(resourceName, strings.Split(*policies, ","))
+	case "iam-policy":
+		IAMPolicyCmd(args, lock, iamPolicyFeatures{
+			Provision:         *provisionScript != "",
+			ProvisionVia:      *provisionVia,
+			DNSZone:           *dnsZone,
+			TargetGroupArn:    *targetGroupArn,
+			EFS:               *efsMount != "",
+			CITokenSecret:     *ciTokenSecret,
+			Bucket:            *bucket,
+			Interactive:       *interactive,
+			Regions:           *regions != "" || *allRegions,
+			AllAccounts:       *allAccounts,
+			AllResources:      *allResources,
+			CleanupRunID:      *runID != "",
+			AccountRole:       *accountRole,
+			InstanceProfile:   *instanceProfile,
+			SubnetStrategy:    *subnetStrategy,
+			NoSourceDestCheck: *noSourceDestCheck,
+			WaitStatusChecks:  *waitStatusChecks,
+			InstanceType:      *instanceType,
+			NitroTPM:          *nitroTPM,
+			CloudWatchLogs:    *cloudWatchLogs != "",
+			ConfigSource:      configSource,
+			Capture:           *capture,
+			PrivateIPs:        *privateIPs != "",
+			FromWarmPool:      *fromWarmPool,
+			TerminationPolicy: *terminationPolicy,
+		})
+	case "tui":
+		if !stdinIsTerminal() {
+			failCommand("The tui needs a terminal")
+			return
+		}
+		refresh := *interval
+		if !flagPassed("interval") {
+			refresh = 10 * time.Second
+		}
+		TUICmd(name, value, &refresh, osUser, usePrivateIP)
+	case "list":
+		if *allResources {
+			ListResourcesCmd(name, value)
+			return
+		}
+		refresh := *interval
+		if !flagPassed("interval") {
+			refresh = 10 * time.Second
+		}
+		ListInstancesCmd(name, value, regionList, allAccounts, accountRole, watch, &refresh)
+	case "coverage":
+		CoverageCmd()
+	case "events":
+		if len(args) > 1 || (len(args) == 1 && args[0] != "migrate") {
+			failCommand("You must supply nothing to list the events, or migrate (events migrate --tag env=prod)")
+			return
+		}
+		action := ""
+		if len(args) == 1 {
+			action = args[0]
+		}
+		EventsCmd(action, name, value, dryRun, yes)
+	case "standby":
+		StandbyCmd(name, value, dryRun)
+	case "activate":
+		ActivateCmd(name, value, dryRun)
+	case "status":
+		StatusCmd(name, value)
+	case "patch":
+		PatchCmd(name, value, scan, noReboot)
+	case "rotate-key":
+		RotateKeyCmd(name, value, osUser, keyPath, dryRun)
+	case "rightsize":
+		RightsizeCmd(name, value, idleWindow, apply, dryRun, yes)
+	case "age-report":
+		AgeReportCmd(name, value, maxAge, notifyOld)
+	case "idle-check":
+		IdleCheckCmd(name, value, idleWindow, idleThresholds{CPU: *cpuThreshold, NetworkMB: *networkThreshold}, stopIdle, dryRun)
+	case "alerts":
+		switch {
+		case len(args) == 1 && args[0] == "enable":
+			if *snsTopic == "" {
+				failCommand("You must supply the topic to send alerts to (--sns-topic ARN)")
+				return
+			}
+			EnableAlertsCmd(name, value, snsTopic)
+		case len(args) == 1 && args[0] == "disable":
+			DisableAlertsCmd(name, value)
+		default:
+			failCommand("You must supply enable or disable (alerts enable --tag KEY=VALUE --sns-topic ARN)")
+		}
+	default:
+		failCommand("Unknown command " + *command)
+	}
+}
+
+// flagPassed reports whether the flag was set on the command line.
+func flagPassed(name string) bool {
+	passed := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = true
+		}
+	})
+	return passed
+}
+
+// parseArgs parses the command line flags, allowing them to be mixed with
+// positional arguments, and returns the positional arguments in order.
+func parseArgs() []string {
+	var positional []string
+	args := os.Args[1:]
+	for {
+		flag.CommandLine.Parse(args)
+		args = flag.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
 	}
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// awsOptions are the command line settings that change how the service
+// clients are configured.
+type awsOptions struct {
+	EndpointURL string
+	S3PathStyle bool
+	// Provider is the backend instances are created in, ec2 or memory.
+	Provider string
+	// RoleArn is assumed before any other call, e.g. to provision into a
+	// member account from a central tooling account.
+	RoleArn         string
+	ExternalID      string
+	RoleSessionName string
+	// CABundle, UseFIPSEndpoint and UseDualStackEndpoint are applied when the
+	// shared configuration is loaded, so they also reach the credential
+	// providers.
+	CABundle             string
+	UseFIPSEndpoint      bool
+	UseDualStackEndpoint bool
+	// DebugAWS logs every SDK call to stderr and Telemetry traces them.
+	DebugAWS  bool
+	Telemetry bool
+	// IgnoreConfigErrors configures AWS without data/config.json when it
+	// does not load, for init to replace it and validate to report why.
+	IgnoreConfigErrors bool
+}
+
+// configureAWS recreates the service clients when the command line or
+// data/config.json changes the AWS configuration. Flags win over the config
+// file.
+func configureAWS(opts awsOptions) error {
+	config, err := loadConfig()
+	if err != nil && !os.IsNotExist(err) {
+		if !opts.IgnoreConfigErrors {
+			return fmt.Errorf("loading the config: %w", err)
+		}
+		config = ConfigMap{}
+	}
+
+	cfg := awsConfig.Copy()
+	changed := false
+
+	if cfg.Region == "" && config.Region != "" {
+		cfg.Region = config.Region
+		changed = true
+	}
+
+	endpointURL := opts.EndpointURL
+	if endpointURL == "" {
+		endpointURL = config.EndpointURL
+	}
+	if endpointURL != "" || len(config.Endpoints) > 0 {
+		urls := []string{endpointURL}
+		for _, u := range config.Endpoints {
+			urls = append(urls, u)
+		}
+		for _, u := range urls {
+			if parsed, err := url.Parse(u); u != "" && (err != nil || parsed.Scheme == "" || parsed.Host == "") {
+				return fmt.Errorf("%q is not an endpoint URL such as http://localhost:4566", u)
+			}
+		}
+		cfg.EndpointResolverWithOptions = endpointResolver(endpointURL, config.Endpoints)
+		changed = true
+	}
+
+	if opts.RoleArn != "" {
+		if err := assumeRole(&cfg, opts); err != nil {
+			return err
+		}
+		changed = true
+	}
+
+	provider := firstNonEmpty(opts.Provider, config.Provider, "ec2")
+	if provider != "ec2" && provider != "memory" {
+		return fmt.Errorf("%q is not a provider, use ec2 or memory", provider)
+	}
+	instanceProvider = provider
+
+	if changed {
+		newClients(cfg)
+	} else if provider == "memory" {
+		provisioner = vmcreate.NewWithProvider(memoryProvider)
+	}
+	s3Client.UsePathStyle = opts.S3PathStyle || config.S3UsePathStyle
+	return nil
+}
+
+// selectedProvider is the Provider of instanceProvider, making its EC2
+// calls through api.
+func selectedProvider(api vmcreate.EC2CreateInstanceAPI) vmcreate.Provider {
+	if instanceProvider == "memory" {
+		return memoryProvider
+	}
+	return vmcreate.NewEC2Provider(api)
+}
+
+// endpointResolver resolves services to the endpoints configured for them,
+// falling back to defaultURL and then to the regular AWS endpoints.
+func endpointResolver(defaultURL string, endpoints map[string]string) aws.EndpointResolverWithOptions {
+	return aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+		endpointURL := defaultURL
+		if u, ok := endpoints[strings.ToLower(service)]; ok {
+			endpointURL = u
+		}
+		if endpointURL == "" {
+			return aws.Endpoint{}, &aws.EndpointNotFoundError{}
+		}
+		return aws.Endpoint{
+			URL:               endpointURL,
+			HostnameImmutable: true,
+			SigningRegion:     region,
+			Source:            aws.EndpointSourceCustom,
+		}, nil
+	})
+}
+
+// reloadAWSConfig loads the AWS configuration again with the settings that
+// have to be in place before any credentials are fetched. The CA bundle
+// replaces the system certificates, like the ca_bundle profile setting and
+// AWS_CA_BUNDLE; proxies keep coming from HTTPS_PROXY and NO_PROXY.
+func reloadAWSConfig(opts awsOptions) error {
+	var loadOptions []func(*config.LoadOptions) error
+	if opts.CABundle != "" {
+		pem, err := os.ReadFile(opts.CABundle)
+		if err != nil {
+			return fmt.Errorf("reading the CA bundle: %w", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s contains no PEM certificates", opts.CABundle)
+		}
+		loadOptions = append(loadOptions, config.WithCustomCABundle(bytes.NewReader(pem)))
+	}
+	if opts.UseFIPSEndpoint {
+		loadOptions = append(loadOptions, config.WithUseFIPSEndpoint(aws.FIPSEndpointStateEnabled))
+	}
+	if opts.UseDualStackEndpoint {
+		loadOptions = append(loadOptions, config.WithUseDualStackEndpoint(aws.DualStackEndpointStateEnabled))
+	}
+	var apiOptions []func(*middleware.Stack) error
+	if opts.DebugAWS {
+		apiOptions = append(apiOptions, addDebugLogging)
+	}
+	if opts.Telemetry {
+		apiOptions = append(apiOptions, addTelemetry)
+	}
+	if len(apiOptions) > 0 {
+		loadOptions = append(loadOptions, config.WithAPIOptions(apiOptions))
+	}
+	if len(loadOptions) == 0 {
+		return nil
+	}
+
+	cfg, err := loadAWSConfig(loadOptions...)
+	if err != nil {
+		return err
+	}
+	newClients(cfg)
+	return nil
+}
+
+// assumeRole replaces the credentials of cfg with those of the role. They are
+// fetched once up front so that a denied AssumeRole is reported as such
+// rather than as the failure of the first provisioning call.
+func assumeRole(cfg *aws.Config, opts awsOptions) error {
+	sessionName := opts.RoleSessionName
+	if sessionName == "" {
+		sessionName = "aws-vmcreate"
+	}
+
+	provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(*cfg), opts.RoleArn, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = sessionName
+		if opts.ExternalID != "" {
+			o.ExternalID = aws.String(opts.ExternalID)
+		}
+	})
+	cfg.Credentials = aws.NewCredentialsCache(provider)
+
+	if _, err := cfg.Credentials.Retrieve(context.TODO()); err != nil {
+		return fmt.Errorf("assuming %s: %w", opts.RoleArn, err)
+	}
+	return nil
+}
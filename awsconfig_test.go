@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+func TestCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	previous := awsConfig
+	t.Cleanup(func() { newClients(previous) })
+
+	if err := postJSON(context.TODO(), server.URL, "ping"); err == nil {
+		t.Fatal("the test server is trusted without the CA bundle")
+	}
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(bundle, cert, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadAWSConfig(awsOptions{CABundle: bundle}); err != nil {
+		t.Fatal(err)
+	}
+	if err := postJSON(context.TODO(), server.URL, "ping"); err != nil {
+		t.Errorf("the CA bundle is not trusted: %v", err)
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(empty, []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadAWSConfig(awsOptions{CABundle: empty}); err == nil || !strings.Contains(err.Error(), "no PEM certificates") {
+		t.Errorf("reloadAWSConfig(awsOptions{CABundle: empty}) = %v", err)
+	}
+}
+
+func TestFIPSAndDualStackEndpoints(t *testing.T) {
+	previous := awsConfig
+	t.Cleanup(func() { newClients(previous) })
+	t.Setenv("AWS_REGION", "us-gov-west-1")
+
+	if err := reloadAWSConfig(awsOptions{UseFIPSEndpoint: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ssmClient.Endpoint(); got != "https://ssm-fips.us-gov-west-1.amazonaws.com" {
+		t.Errorf("FIPS endpoint = %s", got)
+	}
+
+	if err := reloadAWSConfig(awsOptions{UseFIPSEndpoint: true, UseDualStackEndpoint: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ssmClient.Endpoint(); got != "https://ssm-fips.us-gov-west-1.api.aws" {
+		t.Errorf("FIPS dual-stack endpoint = %s", got)
+	}
+	if got := s3Client.Endpoint(); got != "https://s3-fips.dualstack.us-gov-west-1.amazonaws.com" {
+		t.Errorf("S3 FIPS dual-stack endpoint = %s", got)
+	}
+}
+
+func TestEndpointOverrides(t *testing.T) {
+	previous := awsConfig
+	t.Cleanup(func() { newClients(previous) })
+	useConfig(t, ConfigMap{Endpoints: map[string]string{"s3": "http://s3.local:9000"}})
+
+	if err := configureAWS(awsOptions{EndpointURL: "http://localhost:4566"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ssmClient.Endpoint(); got != "http://localhost:4566" {
+		t.Errorf("SSM endpoint = %s", got)
+	}
+	if got := s3Client.Endpoint(); got != "http://s3.local:9000" {
+		t.Errorf("S3 endpoint = %s", got)
+	}
+
+	// Services without an endpoint of their own fall back to AWS.
+	_, err := endpointResolver("", map[string]string{"s3": "http://s3.local:9000"}).ResolveEndpoint("EC2", "eu-west-1")
+	var notFound *aws.EndpointNotFoundError
+	if !errors.As(err, &notFound) {
+		t.Errorf("EC2 resolved with %v", err)
+	}
+
+	if err := configureAWS(awsOptions{EndpointURL: "localhost:4566"}); err == nil || !strings.Contains(err.Error(), "is not an endpoint URL") {
+		t.Errorf("configureAWS with localhost:4566 = %v", err)
+	}
+}
+
+func TestAssumeRole(t *testing.T) {
+	var form []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = append(form, r.Form.Encode())
+		if r.Form.Get("RoleArn") == "arn:aws:iam::210987654321:role/denied" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`<ErrorResponse><Error><Type>Sender</Type><Code>AccessDenied</Code><Message>not authorized to perform sts:AssumeRole</Message></Error><RequestId>req-1</RequestId></ErrorResponse>`))
+			return
+		}
+		w.Write([]byte(`<AssumeRoleResponse><AssumeRoleResult><Credentials>
+<AccessKeyId>ASIAMEMBER</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>token</SessionToken><Expiration>2099-01-01T00:00:00Z</Expiration>
+</Credentials></AssumeRoleResult></AssumeRoleResponse>`))
+	}))
+	defer server.Close()
+
+	cfg := aws.Config{
+		Region:                      "us-east-1",
+		Credentials:                 credentials.NewStaticCredentialsProvider("AKIDTOOLING", "secret", ""),
+		EndpointResolverWithOptions: endpointResolver(server.URL, nil),
+		HTTPClient:                  server.Client(),
+	}
+	opts := awsOptions{RoleArn: "arn:aws:iam::210987654321:role/provisioner", ExternalID: "ext-1"}
+	if err := assumeRole(&cfg, opts); err != nil {
+		t.Fatal(err)
+	}
+	creds, err := cfg.Credentials.Retrieve(context.TODO())
+	if err != nil || creds.AccessKeyID != "ASIAMEMBER" {
+		t.Errorf("credentials %+v, %v", creds, err)
+	}
+	if len(form) != 1 || !strings.Contains(form[0], "RoleSessionName=aws-vmcreate") || !strings.Contains(form[0], "ExternalId=ext-1") {
+		t.Errorf("AssumeRole with %q", form)
+	}
+
+	// A denied role is reported when it is assumed, not on the first call.
+	cfg.Credentials = credentials.NewStaticCredentialsProvider("AKIDTOOLING", "secret", "")
+	opts = awsOptions{RoleArn: "arn:aws:iam::210987654321:role/denied", RoleSessionName: "ci"}
+	if err := assumeRole(&cfg, opts); err == nil || !strings.Contains(err.Error(), "assuming arn:aws:iam::210987654321:role/denied") || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Errorf("got %v", err)
+	}
+	if !strings.Contains(form[len(form)-1], "RoleSessionName=ci") {
+		t.Errorf("AssumeRole with %q", form[len(form)-1])
+	}
+}
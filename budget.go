@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+	"aws-vmcreate/pkg/vmcreate"
+)
+
+var budgetsClient BudgetsAPI
+
+var costExplorerClient CostExplorerAPI
+
+// errOverBudget is returned when a create would push the projected spend
+// of the month over the budget.
+var errOverBudget = errors.New("over budget")
+
+// BudgetsAPI defines the interface for the DescribeBudget function.
+// We use this interface to test the functions using a mocked service.
+type BudgetsAPI interface {
+	DescribeBudget(ctx context.Context, params *awsapi.DescribeBudgetInput) (*awsapi.DescribeBudgetOutput, error)
+}
+
+// CostExplorerAPI defines the interface for the GetCostAndUsage function.
+// We use this interface to test the functions using a mocked service.
+type CostExplorerAPI interface {
+	GetCostAndUsage(ctx context.Context, params *awsapi.GetCostAndUsageInput) (*awsapi.GetCostAndUsageOutput, error)
+}
+
+// BudgetConfig is the monthly spend create keeps the tool's instances
+// under: an AWS Budgets budget, or a limit checked against the Cost
+// Explorer actuals of the instances with TagKey.
+type BudgetConfig struct {
+	Name         string  `json:"name,omitempty"`
+	MonthlyLimit float64 `json:"monthly_limit_usd,omitempty"`
+	// TagKey is the cost allocation tag of the instances, which must be
+	// activated in the billing console. It is aws-vmcreate:created-by by
+	// default.
+	TagKey string `json:"tag_key,omitempty"`
+}
+
+// budgetProjection is the spend of the month projected with a launch.
+type budgetProjection struct {
+	// Source says where Current comes from.
+	Source string
+	Limit  float64
+	// Current is the spend of the month projected without the launch.
+	Current float64
+	// Launch is the cost of the launched instances for the rest of the month.
+	Launch float64
+	// Unpriced is set when the instance type has no known price, so that
+	// the launch is not counted.
+	Unpriced bool
+}
+
+// Projected is the spend of the month with the launch.
+func (p *budgetProjection) Projected() float64 {
+	return p.Current + p.Launch
+}
+
+func (p *budgetProjection) String() string {
+	s := fmt.Sprintf("The projected spend of the month is $%.2f (%s $%.2f plus $%.2f for the new instances), the budget is $%.2f",
+		p.Projected(), p.Source, p.Current, p.Launch, p.Limit)
+	if p.Unpriced {
+		s += "; the instance type has no known price, so the new instances are not counted"
+	}
+	return s
+}
+
+// hoursLeftInMonth returns the hours from now to the end of the month, UTC
+// as billing is.
+func hoursLeftInMonth(now time.Time) float64 {
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	return next.Sub(now).Hours()
+}
+
+// parseSpend returns the US dollars of s.
+func parseSpend(s awsapi.Spend) (float64, error) {
+	if s.Unit != "" && s.Unit != "USD" {
+		return 0, fmt.Errorf("the budget is in %s, only USD is supported", s.Unit)
+	}
+	return strconv.ParseFloat(s.Amount, 64)
+}
+
+// projectBudget projects the spend of the month when count instances of
+// instanceType are launched now. With a budget name, the budget's forecast
+// is the current spend; otherwise it is the Cost Explorer actuals so far
+// plus the running instances with the tag until the end of the month.
+func projectBudget(c context.Context, budgets BudgetsAPI, costs CostExplorerAPI, b *BudgetConfig, instanceType string, count int, now time.Time) (*budgetProjection, error) {
+	hours := hoursLeftInMonth(now)
+	p := &budgetProjection{}
+	if price, ok := hourlyPrice(instanceType); ok {
+		p.Launch = price * float64(count) * hours
+	} else {
+		p.Unpriced = true
+	}
+
+	if b.Name != "" {
+		principal, err := lookupPrincipal(c)
+		if err != nil {
+			return nil, fmt.Errorf("looking up the account: %w", err)
+		}
+		arn := strings.Split(principal, ":")
+		if len(arn) < 5 {
+			return nil, fmt.Errorf("no account in %s", principal)
+		}
+		result, err := budgets.DescribeBudget(c, &awsapi.DescribeBudgetInput{AccountId: arn[4], BudgetName: b.Name})
+		if err != nil {
+			return nil, fmt.Errorf("describing the budget %s: %w", b.Name, err)
+		}
+		budget := result.Budget
+		if budget.BudgetLimit == nil {
+			return nil, fmt.Errorf("the budget %s has no fixed limit", b.Name)
+		}
+		if p.Limit, err = parseSpend(*budget.BudgetLimit); err != nil {
+			return nil, err
+		}
+		spend, source := budget.CalculatedSpend.ActualSpend, "actual spend"
+		if f := budget.CalculatedSpend.ForecastedSpend; f != nil {
+			spend, source = *f, "forecast"
+		}
+		if p.Current, err = parseSpend(spend); err != nil {
+			return nil, err
+		}
+		p.Source = "budget " + b.Name + " " + source
+		return p, nil
+	}
+
+	tagKey := firstNonEmpty(b.TagKey, createdByTag)
+	p.Limit, p.Source = b.MonthlyLimit, "spend so far and running instances"
+	now = now.UTC()
+	input := &awsapi.GetCostAndUsageInput{
+		// The end is exclusive, and must be after the start on the first.
+		TimePeriod:  awsapi.DateInterval{Start: now.Format("2006-01") + "-01", End: now.AddDate(0, 0, 1).Format("2006-01-02")},
+		Granularity: "MONTHLY",
+		Metrics:     []string{"UnblendedCost"},
+		Filter:      &awsapi.Expression{Not: &awsapi.Expression{Tags: &awsapi.TagValues{Key: tagKey, MatchOptions: []string{"ABSENT"}}}},
+	}
+	for {
+		result, err := costs.GetCostAndUsage(c, input)
+		if err != nil {
+			return nil, fmt.Errorf("getting the costs of %s: %w", tagKey, err)
+		}
+		for _, r := range result.ResultsByTime {
+			amount, err := strconv.ParseFloat(r.Total["UnblendedCost"].Amount, 64)
+			if err != nil {
+				return nil, fmt.Errorf("getting the costs of %s: %w", tagKey, err)
+			}
+			p.Current += amount
+		}
+		if result.NextPageToken == "" {
+			break
+		}
+		input.NextPageToken = result.NextPageToken
+	}
+
+	running, err := provisioner.List(c, vmcreate.StateFilter("pending", "running"), vmcreate.TagKeyFilter(tagKey))
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range running {
+		price, _ := hourlyPrice(string(i.InstanceType))
+		p.Current += price * hours
+	}
+	return p, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+type fakeBudgets map[string]awsapi.Budget
+
+func (f fakeBudgets) DescribeBudget(ctx context.Context, params *awsapi.DescribeBudgetInput) (*awsapi.DescribeBudgetOutput, error) {
+	budget, ok := f[params.AccountId+"/"+params.BudgetName]
+	if !ok {
+		return nil, &awsapi.Error{StatusCode: 400, Code: "NotFoundException"}
+	}
+	return &awsapi.DescribeBudgetOutput{Budget: budget}, nil
+}
+
+// fakeCostExplorer answers with one page per amount, recording the filters.
+type fakeCostExplorer struct {
+	amounts []string
+	inputs  []awsapi.GetCostAndUsageInput
+}
+
+func (f *fakeCostExplorer) GetCostAndUsage(ctx context.Context, params *awsapi.GetCostAndUsageInput) (*awsapi.GetCostAndUsageOutput, error) {
+	f.inputs = append(f.inputs, *params)
+	out := &awsapi.GetCostAndUsageOutput{ResultsByTime: []awsapi.ResultByTime{
+		{Total: map[string]awsapi.MetricValue{"UnblendedCost": {Amount: f.amounts[len(f.inputs)-1], Unit: "USD"}}},
+	}}
+	if len(f.inputs) < len(f.amounts) {
+		out.NextPageToken = "next"
+	}
+	return out, nil
+}
+
+func TestHoursLeftInMonth(t *testing.T) {
+	now := time.Date(2026, time.February, 27, 12, 0, 0, 0, time.UTC)
+	if got := hoursLeftInMonth(now); got != 36 {
+		t.Errorf("hours left = %v, want 36", got)
+	}
+}
+
+func TestProjectBudget(t *testing.T) {
+	fake := useFakeEC2(t)
+	fake.AddInstance(types.Instance{
+		InstanceType: types.InstanceTypeT3Large,
+		Tags:         []types.Tag{{Key: aws.String(createdByTag), Value: aws.String("arn:aws:iam::123456789012:user/tester")}},
+	})
+	c := context.Background()
+	// Ten hours are left in the month.
+	now := time.Date(2026, time.March, 31, 14, 0, 0, 0, time.UTC)
+
+	budgets := fakeBudgets{"123456789012/vm-fleet": {
+		BudgetName:  "vm-fleet",
+		BudgetLimit: &awsapi.Spend{Amount: "100.0", Unit: "USD"},
+		CalculatedSpend: awsapi.CalculatedSpend{
+			ActualSpend:     awsapi.Spend{Amount: "60.0", Unit: "USD"},
+			ForecastedSpend: &awsapi.Spend{Amount: "95.0", Unit: "USD"},
+		},
+	}}
+	p, err := projectBudget(c, budgets, nil, &BudgetConfig{Name: "vm-fleet"}, "g5.xlarge", 1, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Limit != 100 || p.Current != 95 || math.Abs(p.Launch-10.06) > 1e-9 || p.Projected() <= p.Limit {
+		t.Errorf("got %+v, want the forecast plus ten hours of g5.xlarge over the limit", p)
+	}
+	if _, err := projectBudget(c, budgets, nil, &BudgetConfig{Name: "missing"}, "t3.micro", 1, now); err == nil {
+		t.Error("a missing budget was accepted")
+	}
+
+	costs := &fakeCostExplorer{amounts: []string{"12.5", "2.5"}}
+	p, err = projectBudget(c, nil, costs, &BudgetConfig{MonthlyLimit: 20}, "unknown.type", 2, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 15 spent, plus ten hours of the running t3.large.
+	if want := 15 + 0.0832*10; math.Abs(p.Current-want) > 1e-9 || p.Launch != 0 || !p.Unpriced || p.Limit != 20 {
+		t.Errorf("got %+v, want current %v", p, want)
+	}
+	in := costs.inputs[0]
+	if in.TimePeriod.Start != "2026-03-01" || in.TimePeriod.End != "2026-04-01" || in.Filter.Not.Tags.Key != createdByTag {
+		t.Errorf("asked for %+v", in)
+	}
+	if costs.inputs[1].NextPageToken != "next" {
+		t.Error("the second page was not requested")
+	}
+}
+
+func TestBudgetRefusesEveryLaunch(t *testing.T) {
+	fake := useFakeEC2(t)
+	previous := costExplorerClient
+	t.Cleanup(func() { costExplorerClient = previous })
+	config := ConfigMap{InstanceType: "t3.micro", ImageId: "ami-web", Budget: &BudgetConfig{MonthlyLimit: 20}}
+
+	costExplorerClient = &fakeCostExplorer{amounts: []string{"25"}}
+	server := httptest.NewServer(&apiServer{token: "secret", config: config})
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/v1/instances", strings.NewReader(`{"tag_key": "Name", "tag_value": "api-1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("serve create over the budget got %s", resp.Status)
+	}
+
+	costExplorerClient = &fakeCostExplorer{amounts: []string{"25"}}
+	state := &DesiredState{Groups: []DesiredGroup{{Name: "web", Count: 2, InstanceType: "t3.micro", ImageId: "ami-web"}}, Config: config}
+	if err := reconcile(context.Background(), state, false, false); !errors.Is(err, errOverBudget) {
+		t.Errorf("reconcile over the budget got %v", err)
+	}
+
+	if n := len(liveInstances(fake)); n != 0 {
+		t.Errorf("launched %d instances over the budget", n)
+	}
+}
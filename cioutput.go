@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// ciOutput is the CI system --ci-output writes the results of the command
+// for: github, for the step outputs in $GITHUB_OUTPUT and error
+// annotations, or dotenv, for a file of AWS_VMCREATE_ variables such as a
+// GitLab dotenv report.
+var ciOutput string
+
+// ciOutputFile is the file --ci-output dotenv writes.
+var ciOutputFile string
+
+// ciCommand is the command the CI outputs are written for.
+var ciCommand string
+
+// ciInstances and ciRegion are what create made, for the CI outputs.
+var (
+	ciInstances []types.Instance
+	ciRegion    string
+)
+
+// recordCIInstances keeps the created instances for the CI outputs.
+func recordCIInstances(instances []types.Instance, region string) {
+	ciInstances = append(ciInstances, instances...)
+	ciRegion = region
+}
+
+// ciOutputs returns the outputs of the created instances, by name.
+func ciOutputs(instances []types.Instance, region string) [][2]string {
+	var ids, private, public []string
+	for _, i := range instances {
+		ids = append(ids, aws.ToString(i.InstanceId))
+		private = append(private, aws.ToString(i.PrivateIpAddress))
+		public = append(public, aws.ToString(i.PublicIpAddress))
+	}
+	first := func(s []string) string {
+		if len(s) == 0 {
+			return ""
+		}
+		return s[0]
+	}
+	return [][2]string{
+		{"instance_id", first(ids)},
+		{"instance_ids", strings.Join(ids, ",")},
+		{"private_ip", first(private)},
+		{"private_ips", strings.Join(private, ",")},
+		{"public_ip", first(public)},
+		{"public_ips", strings.Join(public, ",")},
+		{"region", region},
+	}
+}
+
+// escapeAnnotation escapes the message of a GitHub workflow command.
+func escapeAnnotation(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// appendLines appends the lines to the file.
+func appendLines(file string, lines []string) error {
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeCIOutput writes the results of the command for --ci-output: the
+// created instances when there are some, and an annotation of the error
+// when it failed.
+func writeCIOutput(err error) {
+	switch ciOutput {
+	case "github":
+		if err != nil {
+			fmt.Println("::error title=aws-vmcreate " + ciCommand + "::" + escapeAnnotation(err.Error()))
+		}
+		if len(ciInstances) == 0 {
+			return
+		}
+		file := os.Getenv("GITHUB_OUTPUT")
+		if file == "" {
+			fmt.Println("::warning title=aws-vmcreate " + ciCommand + "::GITHUB_OUTPUT is not set, the instance outputs are not written")
+			return
+		}
+		var lines []string
+		for _, o := range ciOutputs(ciInstances, ciRegion) {
+			lines = append(lines, o[0]+"="+o[1])
+		}
+		if err := appendLines(file, lines); err != nil {
+			fmt.Println("::warning title=aws-vmcreate " + ciCommand + "::" + escapeAnnotation("writing the outputs: "+err.Error()))
+		}
+	case "dotenv":
+		if len(ciInstances) == 0 {
+			return
+		}
+		var lines []string
+		for _, o := range ciOutputs(ciInstances, ciRegion) {
+			lines = append(lines, "AWS_VMCREATE_"+strings.ToUpper(o[0])+"="+o[1])
+		}
+		if err := os.WriteFile(ciOutputFile, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error writing "+ciOutputFile+":")
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
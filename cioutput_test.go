@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCIOutputGitHub(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1"})
+	output := filepath.Join(t.TempDir(), "github_output")
+	t.Setenv("GITHUB_OUTPUT", output)
+
+	runCLI(t, "create", "--tag", "Name=pr-42", "--count", "2", "--ci-output", "github")
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instances := fake.Instances()
+	for _, want := range []string{
+		"instance_id=" + *instances[0].InstanceId + "\n",
+		"instance_ids=" + *instances[0].InstanceId + "," + *instances[1].InstanceId + "\n",
+		"private_ip=" + *instances[0].PrivateIpAddress + "\n",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("outputs are missing %q:\n%s", want, data)
+		}
+	}
+}
+
+func TestCIOutputGitHubError(t *testing.T) {
+	useFakeEC2(t)
+	useConfig(t, ConfigMap{})
+
+	out := runCLI(t, "diff", "i-missing", "--ci-output", "github")
+	if !strings.Contains(out, "::error title=aws-vmcreate diff::") {
+		t.Errorf("no error annotation in:\n%s", out)
+	}
+}
+
+func TestCIOutputDotenv(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1"})
+
+	runCLI(t, "create", "--tag", "Name=pr-42", "--ci-output", "dotenv", "--ci-output-file", "vm.env")
+
+	data, err := os.ReadFile("vm.env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "AWS_VMCREATE_INSTANCE_ID=" + *fake.Instances()[0].InstanceId + "\n"; !strings.Contains(string(data), want) {
+		t.Errorf("dotenv is missing %q:\n%s", want, data)
+	}
+}
+
+func TestEscapeAnnotation(t *testing.T) {
+	if got := escapeAnnotation("100% full\nretry"); got != "100%25 full%0Aretry" {
+		t.Errorf("escaped = %q", got)
+	}
+}
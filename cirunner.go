@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"aws-vmcreate/internal/awsapi"
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+const (
+	// githubRunnerVersion is the GitHub Actions runner release installed by the preset.
+	githubRunnerVersion = "2.301.1"
+
+	// ciRunnerTag and ciSecretTag record the preset on the instance so that
+	// delete knows to deregister the runner.
+	ciRunnerTag = "aws-vmcreate:ci-runner"
+	ciSecretTag = "aws-vmcreate:ci-token-secret"
+)
+
+var secretsManagerClient *awsapi.SecretsManager
+
+// SecretsManagerAPI defines the interface for the DescribeSecret function.
+// We use this interface to test the functions using a mocked service.
+type SecretsManagerAPI interface {
+	DescribeSecret(ctx context.Context,
+		params *awsapi.DescribeSecretInput) (*awsapi.DescribeSecretOutput, error)
+}
+
+// CIRunner is a CI build agent installed on the instance at boot.
+type CIRunner struct {
+	// Kind is "github" or "gitlab".
+	Kind string
+	// URL is the GitHub repository or organization URL, or the GitLab instance URL.
+	URL string
+	// TokenSecret is the Secrets Manager secret holding the registration
+	// token. The instance reads it with its own instance profile, so the token
+	// never appears in user data.
+	TokenSecret string
+}
+
+func (r *CIRunner) validate(c context.Context, api SecretsManagerAPI) error {
+	if r.Kind != "github" && r.Kind != "gitlab" {
+		return fmt.Errorf("unknown CI runner %q, must be github or gitlab", r.Kind)
+	}
+	if r.URL == "" || r.TokenSecret == "" {
+		return fmt.Errorf("the %s runner needs -ci-url and -ci-token-secret", r.Kind)
+	}
+	_, err := api.DescribeSecret(c, &awsapi.DescribeSecretInput{SecretId: r.TokenSecret})
+	return err
+}
+
+// tags returns the tags that identify the runner on the instance.
+func (r *CIRunner) tags() map[string]string {
+	return map[string]string{
+		ciRunnerTag: r.Kind,
+		ciSecretTag: r.TokenSecret,
+	}
+}
+
+// readTokenScript reads the registration token into $TOKEN on the instance.
+func readTokenScript(secret string, region string) string {
+	return fmt.Sprintf("TOKEN=$(aws secretsmanager get-secret-value --region %s --secret-id %s --query SecretString --output text)\n",
+		shellQuote(region), shellQuote(secret))
+}
+
+// ciRunnerUserData returns the boot script that installs Docker and registers
+// the runner.
+func ciRunnerUserData(r *CIRunner, region string) string {
+	script := `if command -v yum; then yum install -y docker; else apt-get update && apt-get install -y docker.io; fi
+systemctl enable --now docker
+` + readTokenScript(r.TokenSecret, region)
+
+	if r.Kind == "github" {
+		return script + fmt.Sprintf(`mkdir -p /opt/actions-runner && cd /opt/actions-runner
+curl -fsSL -o runner.tar.gz https://github.com/actions/runner/releases/download/v%[1]s/actions-runner-linux-x64-%[1]s.tar.gz
+tar xzf runner.tar.gz
+./bin/installdependencies.sh
+export RUNNER_ALLOW_RUNASROOT=1
+./config.sh --unattended --url %[2]s --token "$TOKEN" --name "$(hostname)" --labels aws-vmcreate
+./svc.sh install
+./svc.sh start
+`, githubRunnerVersion, shellQuote(r.URL))
+	}
+
+	return script + fmt.Sprintf(`if command -v yum; then
+  curl -fsSL https://packages.gitlab.com/install/repositories/runner/gitlab-runner/script.rpm.sh | bash
+  yum install -y gitlab-runner
+else
+  curl -fsSL https://packages.gitlab.com/install/repositories/runner/gitlab-runner/script.deb.sh | bash
+  apt-get install -y gitlab-runner
+fi
+gitlab-runner register --non-interactive --url %s --registration-token "$TOKEN" --executor docker --docker-image alpine:latest --description "$(hostname)" --tag-list aws-vmcreate
+`, shellQuote(r.URL))
+}
+
+// deregisterCIRunner removes the runner installed by the preset from its CI
+// service over SSM. Instances without the preset tags are left alone.
+func deregisterCIRunner(c context.Context, api SSMCommandAPI, instance *types.Instance, region string) error {
+	kind := vmcreate.TagValue(instance, ciRunnerTag)
+	if kind == "" {
+		return nil
+	}
+
+	var commands []string
+	switch kind {
+	case "github":
+		commands = []string{
+			"cd /opt/actions-runner",
+			"./svc.sh stop",
+			"./svc.sh uninstall",
+			readTokenScript(vmcreate.TagValue(instance, ciSecretTag), region) +
+				`RUNNER_ALLOW_RUNASROOT=1 ./config.sh remove --token "$TOKEN"`,
+		}
+	case "gitlab":
+		commands = []string{"gitlab-runner unregister --all-runners"}
+	default:
+		return fmt.Errorf("unknown CI runner %q", kind)
+	}
+
+	progressln("Deregistering " + kind + " runner on " + aws.ToString(instance.InstanceId))
+	_, err := runShellCommands(c, api, aws.ToString(instance.InstanceId), commands, nil)
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeSecrets knows the secrets with the names.
+type fakeSecrets []string
+
+func (f fakeSecrets) DescribeSecret(ctx context.Context, params *awsapi.DescribeSecretInput) (*awsapi.DescribeSecretOutput, error) {
+	for _, name := range f {
+		if name == params.SecretId {
+			return &awsapi.DescribeSecretOutput{Name: name}, nil
+		}
+	}
+	return nil, errors.New("ResourceNotFoundException: Secrets Manager can't find the specified secret.")
+}
+
+func TestCIRunnerValidate(t *testing.T) {
+	secrets := fakeSecrets{"ci/token"}
+	for _, tc := range []struct {
+		runner CIRunner
+		err    string
+	}{
+		{runner: CIRunner{Kind: "github", URL: "https://github.com/acme/app", TokenSecret: "ci/token"}},
+		{runner: CIRunner{Kind: "gitlab", URL: "https://gitlab.example.com", TokenSecret: "ci/token"}},
+		{runner: CIRunner{Kind: "jenkins", URL: "https://ci", TokenSecret: "ci/token"}, err: `unknown CI runner "jenkins"`},
+		{runner: CIRunner{Kind: "github", TokenSecret: "ci/token"}, err: "the github runner needs -ci-url and -ci-token-secret"},
+		{runner: CIRunner{Kind: "github", URL: "https://github.com/acme/app", TokenSecret: "ci/other"}, err: "ResourceNotFoundException"},
+	} {
+		err := tc.runner.validate(context.Background(), secrets)
+		if (tc.err == "") != (err == nil) || err != nil && !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%+v: got %v, want %q", tc.runner, err, tc.err)
+		}
+	}
+}
+
+func TestCIRunnerUserData(t *testing.T) {
+	readToken := "TOKEN=$(aws secretsmanager get-secret-value --region 'eu-west-1' --secret-id 'ci/token' --query SecretString --output text)\n"
+
+	github := ciRunnerUserData(&CIRunner{Kind: "github", URL: "https://github.com/acme/app", TokenSecret: "ci/token"}, "eu-west-1")
+	for _, want := range []string{
+		"systemctl enable --now docker\n" + readToken,
+		"/download/v" + githubRunnerVersion + "/actions-runner-linux-x64-" + githubRunnerVersion + ".tar.gz\n",
+		`./config.sh --unattended --url 'https://github.com/acme/app' --token "$TOKEN"`,
+		"./svc.sh start\n",
+	} {
+		if !strings.Contains(github, want) {
+			t.Errorf("the github boot script is missing %q:\n%s", want, github)
+		}
+	}
+
+	gitlab := ciRunnerUserData(&CIRunner{Kind: "gitlab", URL: "https://gitlab.example.com", TokenSecret: "ci/token"}, "eu-west-1")
+	for _, want := range []string{
+		readToken,
+		`gitlab-runner register --non-interactive --url 'https://gitlab.example.com' --registration-token "$TOKEN" --executor docker`,
+	} {
+		if !strings.Contains(gitlab, want) {
+			t.Errorf("the gitlab boot script is missing %q:\n%s", want, gitlab)
+		}
+	}
+	// The token itself is only ever read on the instance.
+	if strings.Contains(github+gitlab, "--token ci/token") {
+		t.Error("the boot script has the secret name as the token")
+	}
+}
+
+func TestDeregisterCIRunner(t *testing.T) {
+	defer func(interval time.Duration) { commandPollInterval = interval }(commandPollInterval)
+	commandPollInterval = time.Millisecond
+	r := &CIRunner{Kind: "github", URL: "https://github.com/acme/app", TokenSecret: "ci/token"}
+	instance := &types.Instance{InstanceId: aws.String("i-0123")}
+	for k, v := range r.tags() {
+		instance.Tags = append(instance.Tags, types.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+
+	ssm := &fakeDrainSSM{}
+	if err := deregisterCIRunner(context.Background(), ssm, instance, "eu-west-1"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"cd /opt/actions-runner",
+		"./svc.sh stop",
+		"./svc.sh uninstall",
+		readTokenScript("ci/token", "eu-west-1") + `RUNNER_ALLOW_RUNASROOT=1 ./config.sh remove --token "$TOKEN"`,
+	}
+	if len(ssm.sent) != 1 || !reflect.DeepEqual(ssm.sent[0], want) {
+		t.Errorf("sent %q, want %q", ssm.sent, want)
+	}
+
+	// Instances without the preset are left alone.
+	ssm = &fakeDrainSSM{}
+	if err := deregisterCIRunner(context.Background(), ssm, &types.Instance{InstanceId: aws.String("i-0456")}, "eu-west-1"); err != nil || len(ssm.sent) != 0 {
+		t.Errorf("got %v, sent %q", err, ssm.sent)
+	}
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// CleanupEC2API defines the interface for the functions cleanup finds and
+// deletes orphaned resources with.
+// We use this interface to test the functions using a mocked service.
+type CleanupEC2API interface {
+	ec2.DescribeInstancesAPIClient
+	ec2.DescribeVolumesAPIClient
+	ec2.DescribeNetworkInterfacesAPIClient
+	ec2.DescribeSecurityGroupsAPIClient
+
+	DescribeAddresses(ctx context.Context,
+		params *ec2.DescribeAddressesInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeAddressesOutput, error)
+
+	DescribeKeyPairs(ctx context.Context,
+		params *ec2.DescribeKeyPairsInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeKeyPairsOutput, error)
+
+	DeleteVolume(ctx context.Context,
+		params *ec2.DeleteVolumeInput,
+		optFns ...func(*ec2.Options)) (*ec2.DeleteVolumeOutput, error)
+
+	DeleteNetworkInterface(ctx context.Context,
+		params *ec2.DeleteNetworkInterfaceInput,
+		optFns ...func(*ec2.Options)) (*ec2.DeleteNetworkInterfaceOutput, error)
+
+	ReleaseAddress(ctx context.Context,
+		params *ec2.ReleaseAddressInput,
+		optFns ...func(*ec2.Options)) (*ec2.ReleaseAddressOutput, error)
+
+	DeleteSecurityGroup(ctx context.Context,
+		params *ec2.DeleteSecurityGroupInput,
+		optFns ...func(*ec2.Options)) (*ec2.DeleteSecurityGroupOutput, error)
+
+	DeleteKeyPair(ctx context.Context,
+		params *ec2.DeleteKeyPairInput,
+		optFns ...func(*ec2.Options)) (*ec2.DeleteKeyPairOutput, error)
+}
+
+// The kinds of resources cleanup deletes, in the order it deletes them:
+// network interfaces go before the security groups they use.
+const (
+	orphanAddress          = "elastic-ip"
+	orphanNetworkInterface = "network-interface"
+	orphanVolume           = "volume"
+	orphanSecurityGroup    = "security-group"
+	orphanKeyPair          = "key-pair"
+	orphanImage            = "image"
+	orphanSnapshot         = "snapshot"
+	orphanNetwork          = "network"
+)
+
+// RunCleanupAPI defines the interface for the functions cleanup --run-id
+// finds and deletes the resources of a run with.
+// We use this interface to test the functions using a mocked service.
+type RunCleanupAPI interface {
+	CleanupEC2API
+	ec2.DescribeImagesAPIClient
+	ec2.DescribeSnapshotsAPIClient
+	ec2.DescribeVpcsAPIClient
+
+	DeregisterImage(ctx context.Context,
+		params *ec2.DeregisterImageInput,
+		optFns ...func(*ec2.Options)) (*ec2.DeregisterImageOutput, error)
+
+	DeleteSnapshot(ctx context.Context,
+		params *ec2.DeleteSnapshotInput,
+		optFns ...func(*ec2.Options)) (*ec2.DeleteSnapshotOutput, error)
+}
+
+// orphan is a resource tagged by aws-vmcreate that no instance uses anymore.
+type orphan struct {
+	Kind   string
+	ID     string
+	Name   string
+	Detail string
+}
+
+func tagName(tags []types.Tag) string {
+	return tagValue(tags, "Name")
+}
+
+func tagValue(tags []types.Tag, key string) string {
+	for _, t := range tags {
+		if aws.ToString(t.Key) == key {
+			return aws.ToString(t.Value)
+		}
+	}
+	return ""
+}
+
+// findOrphans returns the resources tagged with createdByTag whose instance
+// is gone: unassociated Elastic IPs, available network interfaces and
+// volumes, security groups no network interface uses, and key pairs no live
+// instance accepts, since its launch or a rotate-key.
+func findOrphans(c context.Context, api CleanupEC2API) ([]orphan, error) {
+	tagged := []types.Filter{{Name: aws.String("tag-key"), Values: []string{createdByTag}}}
+	var orphans []orphan
+
+	addresses, err := api.DescribeAddresses(c, &ec2.DescribeAddressesInput{Filters: tagged})
+	if err != nil {
+		return nil, fmt.Errorf("listing the Elastic IPs: %w", err)
+	}
+	for _, a := range addresses.Addresses {
+		if a.AssociationId == nil {
+			orphans = append(orphans, orphan{Kind: orphanAddress, ID: aws.ToString(a.AllocationId), Name: tagName(a.Tags), Detail: aws.ToString(a.PublicIp)})
+		}
+	}
+
+	groupsInUse := map[string]bool{}
+	interfaces := ec2.NewDescribeNetworkInterfacesPaginator(api, &ec2.DescribeNetworkInterfacesInput{})
+	for interfaces.HasMorePages() {
+		page, err := interfaces.NextPage(c)
+		if err != nil {
+			return nil, fmt.Errorf("listing the network interfaces: %w", err)
+		}
+		for _, n := range page.NetworkInterfaces {
+			if n.Status == types.NetworkInterfaceStatusAvailable && hasTag(n.TagSet, createdByTag) {
+				orphans = append(orphans, orphan{Kind: orphanNetworkInterface, ID: aws.ToString(n.NetworkInterfaceId), Name: tagName(n.TagSet), Detail: aws.ToString(n.PrivateIpAddress)})
+				continue
+			}
+			for _, g := range n.Groups {
+				groupsInUse[aws.ToString(g.GroupId)] = true
+			}
+		}
+	}
+
+	volumes := ec2.NewDescribeVolumesPaginator(api, &ec2.DescribeVolumesInput{Filters: append([]types.Filter{
+		{Name: aws.String("status"), Values: []string{"available"}},
+	}, tagged...)})
+	for volumes.HasMorePages() {
+		page, err := volumes.NextPage(c)
+		if err != nil {
+			return nil, fmt.Errorf("listing the volumes: %w", err)
+		}
+		for _, v := range page.Volumes {
+			orphans = append(orphans, orphan{Kind: orphanVolume, ID: aws.ToString(v.VolumeId), Name: tagName(v.Tags), Detail: fmt.Sprintf("%d GiB %s", aws.ToInt32(v.Size), v.VolumeType)})
+		}
+	}
+
+	groups := ec2.NewDescribeSecurityGroupsPaginator(api, &ec2.DescribeSecurityGroupsInput{Filters: tagged})
+	for groups.HasMorePages() {
+		page, err := groups.NextPage(c)
+		if err != nil {
+			return nil, fmt.Errorf("listing the security groups: %w", err)
+		}
+		for _, g := range page.SecurityGroups {
+			// The groups of a network are deleted with it, by network delete.
+			if !groupsInUse[aws.ToString(g.GroupId)] && !hasTag(g.Tags, networkTag) {
+				orphans = append(orphans, orphan{Kind: orphanSecurityGroup, ID: aws.ToString(g.GroupId), Name: aws.ToString(g.GroupName), Detail: aws.ToString(g.VpcId)})
+			}
+		}
+	}
+
+	keys, err := api.DescribeKeyPairs(c, &ec2.DescribeKeyPairsInput{Filters: tagged})
+	if err != nil {
+		return nil, fmt.Errorf("listing the key pairs: %w", err)
+	}
+	if len(keys.KeyPairs) > 0 {
+		keysInUse := map[string]bool{}
+		instances := ec2.NewDescribeInstancesPaginator(api, &ec2.DescribeInstancesInput{Filters: []types.Filter{
+			{Name: aws.String("instance-state-name"), Values: []string{"pending", "running", "stopping", "stopped", "shutting-down"}},
+		}})
+		for instances.HasMorePages() {
+			page, err := instances.NextPage(c)
+			if err != nil {
+				return nil, fmt.Errorf("listing the instances: %w", err)
+			}
+			for _, r := range page.Reservations {
+				for _, i := range r.Instances {
+					keysInUse[currentKeyName(&i)] = true
+				}
+			}
+		}
+		for _, k := range keys.KeyPairs {
+			if !keysInUse[aws.ToString(k.KeyName)] {
+				orphans = append(orphans, orphan{Kind: orphanKeyPair, ID: aws.ToString(k.KeyPairId), Name: aws.ToString(k.KeyName), Detail: aws.ToString(k.KeyFingerprint)})
+			}
+		}
+	}
+	return orphans, nil
+}
+
+// findRunResources returns the resources tagged with the run, besides its
+// instances, in the order they are deleted in: Elastic IPs, available
+// network interfaces and volumes, security groups, key pairs, images, their
+// snapshots and last the networks, which are deleted whole. What belongs to
+// a network is left to its deletion.
+func findRunResources(c context.Context, api RunCleanupAPI, runID string) ([]orphan, error) {
+	tagged := []types.Filter{{Name: aws.String("tag:" + runIDTag), Values: []string{runID}}}
+	var resources []orphan
+
+	addresses, err := api.DescribeAddresses(c, &ec2.DescribeAddressesInput{Filters: tagged})
+	if err != nil {
+		return nil, fmt.Errorf("listing the Elastic IPs: %w", err)
+	}
+	for _, a := range addresses.Addresses {
+		if !hasTag(a.Tags, networkTag) {
+			resources = append(resources, orphan{Kind: orphanAddress, ID: aws.ToString(a.AllocationId), Name: tagName(a.Tags), Detail: aws.ToString(a.PublicIp)})
+		}
+	}
+
+	interfaces := ec2.NewDescribeNetworkInterfacesPaginator(api, &ec2.DescribeNetworkInterfacesInput{Filters: append([]types.Filter{
+		{Name: aws.String("status"), Values: []string{"available"}},
+	}, tagged...)})
+	for interfaces.HasMorePages() {
+		page, err := interfaces.NextPage(c)
+		if err != nil {
+			return nil, fmt.Errorf("listing the network interfaces: %w", err)
+		}
+		for _, n := range page.NetworkInterfaces {
+			resources = append(resources, orphan{Kind: orphanNetworkInterface, ID: aws.ToString(n.NetworkInterfaceId), Name: tagName(n.TagSet), Detail: aws.ToString(n.PrivateIpAddress)})
+		}
+	}
+
+	volumes := ec2.NewDescribeVolumesPaginator(api, &ec2.DescribeVolumesInput{Filters: append([]types.Filter{
+		{Name: aws.String("status"), Values: []string{"available"}},
+	}, tagged...)})
+	for volumes.HasMorePages() {
+		page, err := volumes.NextPage(c)
+		if err != nil {
+			return nil, fmt.Errorf("listing the volumes: %w", err)
+		}
+		for _, v := range page.Volumes {
+			resources = append(resources, orphan{Kind: orphanVolume, ID: aws.ToString(v.VolumeId), Name: tagName(v.Tags), Detail: fmt.Sprintf("%d GiB %s", aws.ToInt32(v.Size), v.VolumeType)})
+		}
+	}
+
+	groups := ec2.NewDescribeSecurityGroupsPaginator(api, &ec2.DescribeSecurityGroupsInput{Filters: tagged})
+	for groups.HasMorePages() {
+		page, err := groups.NextPage(c)
+		if err != nil {
+			return nil, fmt.Errorf("listing the security groups: %w", err)
+		}
+		for _, g := range page.SecurityGroups {
+			if !hasTag(g.Tags, networkTag) {
+				resources = append(resources, orphan{Kind: orphanSecurityGroup, ID: aws.ToString(g.GroupId), Name: aws.ToString(g.GroupName), Detail: aws.ToString(g.VpcId)})
+			}
+		}
+	}
+
+	keys, err := api.DescribeKeyPairs(c, &ec2.DescribeKeyPairsInput{Filters: tagged})
+	if err != nil {
+		return nil, fmt.Errorf("listing the key pairs: %w", err)
+	}
+	for _, k := range keys.KeyPairs {
+		resources = append(resources, orphan{Kind: orphanKeyPair, ID: aws.ToString(k.KeyPairId), Name: aws.ToString(k.KeyName), Detail: aws.ToString(k.KeyFingerprint)})
+	}
+
+	images, err := api.DescribeImages(c, &ec2.DescribeImagesInput{Owners: []string{"self"}, Filters: tagged})
+	if err != nil {
+		return nil, fmt.Errorf("listing the images: %w", err)
+	}
+	for _, i := range images.Images {
+		resources = append(resources, orphan{Kind: orphanImage, ID: aws.ToString(i.ImageId), Name: aws.ToString(i.Name), Detail: aws.ToString(i.CreationDate)})
+	}
+
+	snapshots := ec2.NewDescribeSnapshotsPaginator(api, &ec2.DescribeSnapshotsInput{OwnerIds: []string{"self"}, Filters: tagged})
+	for snapshots.HasMorePages() {
+		page, err := snapshots.NextPage(c)
+		if err != nil {
+			return nil, fmt.Errorf("listing the snapshots: %w", err)
+		}
+		for _, s := range page.Snapshots {
+			resources = append(resources, orphan{Kind: orphanSnapshot, ID: aws.ToString(s.SnapshotId), Name: tagName(s.Tags), Detail: fmt.Sprintf("%d GiB of %s", aws.ToInt32(s.VolumeSize), aws.ToString(s.VolumeId))})
+		}
+	}
+
+	vpcs, err := api.DescribeVpcs(c, &ec2.DescribeVpcsInput{Filters: tagged})
+	if err != nil {
+		return nil, fmt.Errorf("listing the VPCs: %w", err)
+	}
+	for _, v := range vpcs.Vpcs {
+		if name := tagValue(v.Tags, networkTag); name != "" {
+			resources = append(resources, orphan{Kind: orphanNetwork, ID: name, Name: name, Detail: aws.ToString(v.VpcId)})
+		}
+	}
+	return resources, nil
+}
+
+// deleteRunResource deletes the resource of a run, deleting networks with
+// networks.
+func deleteRunResource(c context.Context, api RunCleanupAPI, networks NetworkAPI, r orphan) error {
+	var err error
+	switch r.Kind {
+	case orphanImage:
+		_, err = api.DeregisterImage(c, &ec2.DeregisterImageInput{ImageId: aws.String(r.ID)})
+	case orphanSnapshot:
+		_, err = api.DeleteSnapshot(c, &ec2.DeleteSnapshotInput{SnapshotId: aws.String(r.ID)})
+	case orphanNetwork:
+		err = deleteNetwork(c, networks, r.ID)
+	default:
+		err = deleteOrphan(c, api, r)
+	}
+	return err
+}
+
+func hasTag(tags []types.Tag, key string) bool {
+	for _, t := range tags {
+		if aws.ToString(t.Key) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteOrphan deletes the resource.
+func deleteOrphan(c context.Context, api CleanupEC2API, o orphan) error {
+	var err error
+	switch o.Kind {
+	case orphanAddress:
+		_, err = api.ReleaseAddress(c, &ec2.ReleaseAddressInput{AllocationId: aws.String(o.ID)})
+	case orphanNetworkInterface:
+		_, err = api.DeleteNetworkInterface(c, &ec2.DeleteNetworkInterfaceInput{NetworkInterfaceId: aws.String(o.ID)})
+	case orphanVolume:
+		_, err = api.DeleteVolume(c, &ec2.DeleteVolumeInput{VolumeId: aws.String(o.ID)})
+	case orphanSecurityGroup:
+		_, err = api.DeleteSecurityGroup(c, &ec2.DeleteSecurityGroupInput{GroupId: aws.String(o.ID)})
+	case orphanKeyPair:
+		_, err = api.DeleteKeyPair(c, &ec2.DeleteKeyPairInput{KeyPairId: aws.String(o.ID)})
+	default:
+		err = fmt.Errorf("cannot delete a %s", o.Kind)
+	}
+	return err
+}
+
+// confirm asks the question on the terminal and reports whether the answer
+// was yes.
+func confirm(question string) bool {
+	fmt.Fprint(os.Stderr, question+" (y/n) ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func CleanupCmd(dryRun *bool, yes *bool) {
+	orphans, err := findOrphans(context.TODO(), client)
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error finding orphaned resources:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	if len(orphans) == 0 {
+		fmt.Println("No orphaned resources found")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tID\tNAME\tDETAIL")
+	for _, o := range orphans {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", o.Kind, o.ID, o.Name, o.Detail)
+	}
+	w.Flush()
+
+	if *dryRun {
+		fmt.Printf("%d orphaned resources would be deleted\n", len(orphans))
+		return
+	}
+	if !*yes {
+		if !stdinIsTerminal() {
+			failCommand("Pass --yes to delete without a terminal to confirm on")
+			return
+		}
+		if !confirm(fmt.Sprintf("Delete these %d resources?", len(orphans))) {
+			return
+		}
+	}
+
+	deleted := 0
+	for _, o := range orphans {
+		if err := deleteOrphan(context.TODO(), client, o); err != nil {
+			commandErr = err
+			fmt.Fprintln(os.Stderr, "Got an error deleting "+o.Kind+" "+o.ID+":")
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		deleted++
+		fmt.Println("Deleted " + o.Kind + " " + o.ID)
+	}
+	fmt.Printf("Deleted %d of %d orphaned resources\n", deleted, len(orphans))
+}
+
+// CleanupRunCmd deletes everything the run made: what a create recorded in
+// the state is rolled back, and the instances and resources tagged with the
+// run are terminated and deleted.
+func CleanupRunCmd(runID string, dryRun *bool, yes *bool) {
+	c := context.TODO()
+	instances, err := provisioner.List(c, vmcreate.TagFilter(runIDTag, runID), vmcreate.StateFilter(vmcreate.LiveStates...))
+	if err == nil {
+		var resources []orphan
+		resources, err = findRunResources(c, client, runID)
+		if err == nil {
+			err = cleanupRun(c, client, client, runID, instances, resources, *dryRun, *yes)
+		}
+	}
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error cleaning up run "+runID+":")
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// cleanupRun lists what the run made and, unless dryRun, deletes it once
+// confirmed. The resources are looked up again once the instances are gone,
+// for the volumes and network interfaces they leave behind.
+func cleanupRun(c context.Context, api RunCleanupAPI, networks NetworkAPI, runID string, instances []types.Instance, resources []orphan, dryRun bool, yes bool) error {
+	run, _ := loadRun(c, runID)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tID\tNAME\tDETAIL")
+	listed := 0
+	if run != nil {
+		for _, name := range run.Created.DNSNames {
+			fmt.Fprintf(w, "dns-record\t%s\t\t%s\n", name, run.Options.DNSZone)
+		}
+		for _, id := range run.Created.Targets {
+			fmt.Fprintf(w, "target\t%s\t\t%s\n", id, run.Options.TargetGroupArn)
+		}
+		listed += len(run.Created.DNSNames) + len(run.Created.Targets)
+	}
+	for _, i := range instances {
+		fmt.Fprintf(w, "instance\t%s\t%s\t%s\n", aws.ToString(i.InstanceId), tagName(i.Tags), instanceState(&i))
+	}
+	for _, r := range resources {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Kind, r.ID, r.Name, r.Detail)
+	}
+	listed += len(instances) + len(resources)
+	if listed == 0 && run == nil {
+		fmt.Println("Nothing of run " + runID + " is left")
+		return nil
+	}
+	w.Flush()
+
+	if dryRun {
+		fmt.Printf("%d resources of run %s would be deleted\n", listed, runID)
+		return nil
+	}
+	if !yes {
+		if !stdinIsTerminal() {
+			return errors.New("pass --yes to delete without a terminal to confirm on")
+		}
+		if !confirm(fmt.Sprintf("Delete these %d resources?", listed)) {
+			return nil
+		}
+	}
+
+	rolledBack := map[string]bool{}
+	if run != nil {
+		run.Created.rollback(c, run.Options)
+		finishRun(c, run)
+		for _, id := range run.Created.InstanceIDs {
+			rolledBack[id] = true
+		}
+	}
+	var ids []string
+	for _, i := range instances {
+		if !rolledBack[aws.ToString(i.InstanceId)] {
+			ids = append(ids, aws.ToString(i.InstanceId))
+		}
+	}
+	if len(ids) > 0 {
+		progressln("Terminating instances with ids " + strings.Join(ids, ", "))
+		if _, err := provisioner.Delete(c, ids); err != nil {
+			return fmt.Errorf("terminating the instances: %w", err)
+		}
+		recordLifecycle(c, "cleanup", instancesOf(ids), "", phaseTerminated, "run "+runID+" cleaned up")
+	}
+	if len(instances) > 0 {
+		if err := waitTerminated(c, vmcreate.TagFilter(runIDTag, runID)); err != nil {
+			return err
+		}
+		var err error
+		if resources, err = findRunResources(c, api, runID); err != nil {
+			return err
+		}
+	}
+
+	deleted := 0
+	for _, r := range resources {
+		if err := deleteRunResource(c, api, networks, r); err != nil {
+			commandErr = err
+			fmt.Fprintln(os.Stderr, "Got an error deleting "+r.Kind+" "+r.ID+":")
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		deleted++
+		fmt.Println("Deleted " + r.Kind + " " + r.ID)
+	}
+	fmt.Printf("Terminated %d instances and deleted %d of %d resources of run %s\n", len(instances), deleted, len(resources), runID)
+	return nil
+}
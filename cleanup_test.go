@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"aws-vmcreate/pkg/vmcreate"
+	"aws-vmcreate/pkg/vmcreate/vmcreatetest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeCleanupEC2 answers the describe calls of cleanup from its fields, which
+// hold what the tag filters would return, and records what is deleted.
+type fakeCleanupEC2 struct {
+	*vmcreatetest.FakeEC2
+	addresses  []types.Address
+	interfaces []types.NetworkInterface
+	volumes    []types.Volume
+	groups     []types.SecurityGroup
+	keys       []types.KeyPairInfo
+	deleted    []string
+}
+
+func (f *fakeCleanupEC2) DescribeAddresses(ctx context.Context, params *ec2.DescribeAddressesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeAddressesOutput, error) {
+	return &ec2.DescribeAddressesOutput{Addresses: f.addresses}, nil
+}
+
+func (f *fakeCleanupEC2) DescribeNetworkInterfaces(ctx context.Context, params *ec2.DescribeNetworkInterfacesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeNetworkInterfacesOutput, error) {
+	return &ec2.DescribeNetworkInterfacesOutput{NetworkInterfaces: f.interfaces}, nil
+}
+
+func (f *fakeCleanupEC2) DescribeVolumes(ctx context.Context, params *ec2.DescribeVolumesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeVolumesOutput, error) {
+	return &ec2.DescribeVolumesOutput{Volumes: f.volumes}, nil
+}
+
+func (f *fakeCleanupEC2) DescribeSecurityGroups(ctx context.Context, params *ec2.DescribeSecurityGroupsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSecurityGroupsOutput, error) {
+	return &ec2.DescribeSecurityGroupsOutput{SecurityGroups: f.groups}, nil
+}
+
+func (f *fakeCleanupEC2) DescribeKeyPairs(ctx context.Context, params *ec2.DescribeKeyPairsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeKeyPairsOutput, error) {
+	return &ec2.DescribeKeyPairsOutput{KeyPairs: f.keys}, nil
+}
+
+func (f *fakeCleanupEC2) DeleteVolume(ctx context.Context, params *ec2.DeleteVolumeInput, optFns ...func(*ec2.Options)) (*ec2.DeleteVolumeOutput, error) {
+	f.deleted = append(f.deleted, aws.ToString(params.VolumeId))
+	return &ec2.DeleteVolumeOutput{}, nil
+}
+
+func (f *fakeCleanupEC2) DeleteNetworkInterface(ctx context.Context, params *ec2.DeleteNetworkInterfaceInput, optFns ...func(*ec2.Options)) (*ec2.DeleteNetworkInterfaceOutput, error) {
+	f.deleted = append(f.deleted, aws.ToString(params.NetworkInterfaceId))
+	return &ec2.DeleteNetworkInterfaceOutput{}, nil
+}
+
+func (f *fakeCleanupEC2) ReleaseAddress(ctx context.Context, params *ec2.ReleaseAddressInput, optFns ...func(*ec2.Options)) (*ec2.ReleaseAddressOutput, error) {
+	f.deleted = append(f.deleted, aws.ToString(params.AllocationId))
+	return &ec2.ReleaseAddressOutput{}, nil
+}
+
+func (f *fakeCleanupEC2) DeleteSecurityGroup(ctx context.Context, params *ec2.DeleteSecurityGroupInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSecurityGroupOutput, error) {
+	f.deleted = append(f.deleted, aws.ToString(params.GroupId))
+	return &ec2.DeleteSecurityGroupOutput{}, nil
+}
+
+func (f *fakeCleanupEC2) DeleteKeyPair(ctx context.Context, params *ec2.DeleteKeyPairInput, optFns ...func(*ec2.Options)) (*ec2.DeleteKeyPairOutput, error) {
+	f.deleted = append(f.deleted, aws.ToString(params.KeyPairId))
+	return &ec2.DeleteKeyPairOutput{}, nil
+}
+
+func TestFindOrphansRotatedKey(t *testing.T) {
+	fake := &fakeCleanupEC2{
+		FakeEC2: vmcreatetest.NewFakeEC2(),
+		keys:    []types.KeyPairInfo{{KeyPairId: aws.String("key-old"), KeyName: aws.String("dev")}, {KeyPairId: aws.String("key-new"), KeyName: aws.String("dev-20240501-120000")}},
+	}
+	// The instance was launched with dev and rotated to the new key pair.
+	i := tagged(keyNameTag, "dev-20240501-120000")
+	i.KeyName = aws.String("dev")
+	fake.AddInstance(i)
+
+	orphans, err := findOrphans(context.Background(), fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[0].ID != "key-old" {
+		t.Errorf("orphans = %+v, want only the key pair it was launched with", orphans)
+	}
+}
+
+func TestFindOrphans(t *testing.T) {
+	provenance := []types.Tag{{Key: aws.String(createdByTag), Value: aws.String("arn:aws:iam::111122223333:user/alice")}}
+	fake := &fakeCleanupEC2{
+		FakeEC2: vmcreatetest.NewFakeEC2(),
+		addresses: []types.Address{
+			{AllocationId: aws.String("eipalloc-free"), PublicIp: aws.String("203.0.113.10")},
+			{AllocationId: aws.String("eipalloc-used"), AssociationId: aws.String("eipassoc-1")},
+		},
+		interfaces: []types.NetworkInterface{
+			{NetworkInterfaceId: aws.String("eni-free"), Status: types.NetworkInterfaceStatusAvailable, TagSet: provenance, Groups: []types.GroupIdentifier{{GroupId: aws.String("sg-free")}}},
+			{NetworkInterfaceId: aws.String("eni-untagged"), Status: types.NetworkInterfaceStatusAvailable},
+			{NetworkInterfaceId: aws.String("eni-used"), Status: types.NetworkInterfaceStatusInUse, TagSet: provenance, Groups: []types.GroupIdentifier{{GroupId: aws.String("sg-used")}}},
+		},
+		volumes: []types.Volume{{VolumeId: aws.String("vol-free"), Size: aws.Int32(8), VolumeType: types.VolumeTypeGp3}},
+		groups: []types.SecurityGroup{
+			{GroupId: aws.String("sg-free")},
+			{GroupId: aws.String("sg-used")},
+			{GroupId: aws.String("sg-network"), Tags: []types.Tag{{Key: aws.String(networkTag), Value: aws.String("dev")}}},
+		},
+		keys: []types.KeyPairInfo{{KeyPairId: aws.String("key-free"), KeyName: aws.String("old")}, {KeyPairId: aws.String("key-used"), KeyName: aws.String("deploy")}},
+	}
+	fake.AddInstance(types.Instance{KeyName: aws.String("deploy")})
+
+	orphans, err := findOrphans(context.Background(), fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, o := range orphans {
+		ids = append(ids, o.ID)
+		if err := deleteOrphan(context.Background(), fake, o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The network interface goes before the security group it used.
+	want := "eipalloc-free eni-free vol-free sg-free key-free"
+	if got := strings.Join(ids, " "); got != want {
+		t.Errorf("orphans = %s, want %s", got, want)
+	}
+	if got := strings.Join(fake.deleted, " "); got != want {
+		t.Errorf("deleted = %s, want %s", got, want)
+	}
+}
+
+// fakeRunCleanupEC2 adds the images, snapshots and VPCs of a run to
+// fakeCleanupEC2.
+type fakeRunCleanupEC2 struct {
+	*fakeCleanupEC2
+	images    []types.Image
+	snapshots []types.Snapshot
+	vpcs      []types.Vpc
+}
+
+func (f *fakeRunCleanupEC2) DescribeImages(ctx context.Context, params *ec2.DescribeImagesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeImagesOutput, error) {
+	return &ec2.DescribeImagesOutput{Images: f.images}, nil
+}
+
+func (f *fakeRunCleanupEC2) DescribeSnapshots(ctx context.Context, params *ec2.DescribeSnapshotsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSnapshotsOutput, error) {
+	return &ec2.DescribeSnapshotsOutput{Snapshots: f.snapshots}, nil
+}
+
+func (f *fakeRunCleanupEC2) DescribeVpcs(ctx context.Context, params *ec2.DescribeVpcsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeVpcsOutput, error) {
+	return &ec2.DescribeVpcsOutput{Vpcs: f.vpcs}, nil
+}
+
+func (f *fakeRunCleanupEC2) DeregisterImage(ctx context.Context, params *ec2.DeregisterImageInput, optFns ...func(*ec2.Options)) (*ec2.DeregisterImageOutput, error) {
+	f.deleted = append(f.deleted, aws.ToString(params.ImageId))
+	return &ec2.DeregisterImageOutput{}, nil
+}
+
+func (f *fakeRunCleanupEC2) DeleteSnapshot(ctx context.Context, params *ec2.DeleteSnapshotInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSnapshotOutput, error) {
+	f.deleted = append(f.deleted, aws.ToString(params.SnapshotId))
+	return &ec2.DeleteSnapshotOutput{}, nil
+}
+
+func TestCleanupRun(t *testing.T) {
+	fake := useFakeEC2(t)
+	envPollInterval = time.Millisecond
+	t.Cleanup(func() { envPollInterval = 5 * time.Second })
+	c := context.Background()
+	for _, run := range []string{"run-1", "run-1", "run-2"} {
+		fake.AddInstance(tagged(runIDTag, run))
+	}
+	// The run failed after its launch was recorded.
+	putRun(t, &CreateRun{ID: "run-1", Options: &CreateOptions{}})
+	ofNetwork := []types.Tag{{Key: aws.String(networkTag), Value: aws.String("dev")}}
+	api := &fakeRunCleanupEC2{
+		fakeCleanupEC2: &fakeCleanupEC2{
+			FakeEC2:   fake,
+			addresses: []types.Address{{AllocationId: aws.String("eipalloc-nat"), Tags: ofNetwork}},
+			volumes:   []types.Volume{{VolumeId: aws.String("vol-1")}},
+			groups:    []types.SecurityGroup{{GroupId: aws.String("sg-1")}},
+		},
+		images:    []types.Image{{ImageId: aws.String("ami-1")}},
+		snapshots: []types.Snapshot{{SnapshotId: aws.String("snap-1")}},
+	}
+
+	instances, err := provisioner.List(c, vmcreate.TagFilter(runIDTag, "run-1"), vmcreate.StateFilter(vmcreate.LiveStates...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resources, err := findRunResources(c, api, "run-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cleanupRun(c, api, nil, "run-1", instances, resources, false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// The address of the network is left to the network's deletion, and the
+	// other run is untouched.
+	if got, want := strings.Join(api.deleted, " "), "vol-1 sg-1 ami-1 snap-1"; got != want {
+		t.Errorf("deleted = %s, want %s", got, want)
+	}
+	if live := liveInstances(fake); len(live) != 1 || vmcreate.TagValue(&live[0], runIDTag) != "run-2" {
+		t.Errorf("left %v", instanceIDs(live))
+	}
+	if state := loadState(t); state.Runs["run-1"] != nil {
+		t.Error("the run was kept in the state")
+	}
+}
+
+func TestProvenanceRunID(t *testing.T) {
+	useFakeEC2(t)
+	tags := withProvenance(context.Background(), nil, "")
+	if tags[runIDTag] == "" || withProvenance(context.Background(), nil, "")[runIDTag] != tags[runIDTag] {
+		t.Errorf("run tags = %q", tags[runIDTag])
+	}
+	if tags := withProvenance(context.Background(), map[string]string{runIDTag: "create-run"}, ""); tags[runIDTag] != "create-run" {
+		t.Errorf("the run of the create was replaced with %q", tags[runIDTag])
+	}
+}
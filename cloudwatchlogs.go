@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"aws-vmcreate/internal/awsapi"
+)
+
+// cloudWatchAgentPolicy is the AWS managed policy letting the CloudWatch
+// agent create log groups and streams and put log events.
+const cloudWatchAgentPolicy = "CloudWatchAgentServerPolicy"
+
+// cloudWatchAgentConfig is where the boot script writes the agent config.
+const cloudWatchAgentConfig = "/opt/aws/amazon-cloudwatch-agent/etc/aws-vmcreate.json"
+
+// systemLogFiles are the system logs shipped on every distribution; those
+// the image does not write are skipped by the agent.
+var systemLogFiles = []string{"/var/log/messages", "/var/log/syslog", "/var/log/secure", "/var/log/auth.log", "/var/log/cloud-init-output.log"}
+
+var logGroupName = regexp.MustCompile(`^[A-Za-z0-9._/#-]{1,512}$`)
+
+// CloudWatchLogsAPI defines the interface for the IAM functions granting the instance role the CloudWatch agent policy.
+// We use this interface to test the functions using a mocked service.
+type CloudWatchLogsAPI interface {
+	GetInstanceProfile(ctx context.Context, profileName string) (*awsapi.GetInstanceProfileOutput, error)
+	AttachRolePolicy(ctx context.Context, roleName, policyArn string) error
+}
+
+// CloudWatchLogs ships the system logs, and the application logs of Files,
+// of the instance to a CloudWatch Logs group with the CloudWatch agent.
+type CloudWatchLogs struct {
+	LogGroup string
+	// Files are more log files, which may use wildcards, e.g. /var/log/app/*.log.
+	Files []string
+}
+
+// parseCloudWatchLogs parses the log group and the comma separated log files.
+func parseCloudWatchLogs(logGroup string, files string) (*CloudWatchLogs, error) {
+	if !logGroupName.MatchString(logGroup) {
+		return nil, fmt.Errorf("invalid log group %q, it may only use letters, digits and ._/#-", logGroup)
+	}
+	l := &CloudWatchLogs{LogGroup: logGroup}
+	for _, f := range strings.Split(files, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		if !strings.HasPrefix(f, "/") {
+			return nil, fmt.Errorf("the log file %q must be an absolute path", f)
+		}
+		l.Files = append(l.Files, f)
+	}
+	return l, nil
+}
+
+// agentConfig returns the CloudWatch agent config collecting the logs, each
+// file in a stream named after the instance and the file.
+func (l *CloudWatchLogs) agentConfig() string {
+	type collected struct {
+		FilePath      string `json:"file_path"`
+		LogGroupName  string `json:"log_group_name"`
+		LogStreamName string `json:"log_stream_name"`
+	}
+	// Stream names cannot hold * or :.
+	streamName := strings.NewReplacer("*", "_", ":", "_")
+	var files []collected
+	for _, f := range append(append([]string(nil), systemLogFiles...), l.Files...) {
+		files = append(files, collected{FilePath: f, LogGroupName: l.LogGroup, LogStreamName: "{instance_id}" + streamName.Replace(f)})
+	}
+	config := map[string]interface{}{
+		"agent": map[string]string{"run_as_user": "root"},
+		"logs": map[string]interface{}{
+			"logs_collected": map[string]interface{}{"files": map[string]interface{}{"collect_list": files}},
+		},
+	}
+	data, _ := json.MarshalIndent(config, "", "  ")
+	return string(data)
+}
+
+// cloudWatchAgentUserData returns the boot script that installs the
+// CloudWatch agent, from the distribution on Amazon Linux and from the
+// agent's package on Debian and Ubuntu, and starts it with the config.
+func cloudWatchAgentUserData(l *CloudWatchLogs) string {
+	return fmt.Sprintf(`# CloudWatch agent (--cloudwatch-logs)
+if command -v dnf >/dev/null; then
+  dnf install -y amazon-cloudwatch-agent
+elif command -v yum >/dev/null; then
+  yum install -y amazon-cloudwatch-agent
+else
+  curl -fsSLo /tmp/amazon-cloudwatch-agent.deb "https://s3.amazonaws.com/amazoncloudwatch-agent/ubuntu/$(dpkg --print-architecture)/latest/amazon-cloudwatch-agent.deb"
+  dpkg -i -E /tmp/amazon-cloudwatch-agent.deb
+fi
+mkdir -p $(dirname %[1]s)
+cat > %[1]s <<'AGENT_CONFIG'
+%[2]s
+AGENT_CONFIG
+/opt/aws/amazon-cloudwatch-agent/bin/amazon-cloudwatch-agent-ctl -a fetch-config -m ec2 -s -c file:%[1]s
+`, cloudWatchAgentConfig, l.agentConfig())
+}
+
+// grantCloudWatchLogs attaches the CloudWatch agent policy to the role of
+// the instance profile, which is a no-op when it is already attached.
+func grantCloudWatchLogs(c context.Context, api CloudWatchLogsAPI, profileName string, partition string) error {
+	if profileName == "" {
+		return fmt.Errorf("--cloudwatch-logs needs an instance profile for the agent to send the logs with, " +
+			"create one with iam profile create --policies AmazonSSMManagedInstanceCore," + cloudWatchAgentPolicy)
+	}
+	profile, err := api.GetInstanceProfile(c, profileName)
+	if err != nil {
+		return fmt.Errorf("reading the instance profile %s: %w", profileName, err)
+	}
+	if len(profile.InstanceProfile.Roles) == 0 {
+		return fmt.Errorf("the instance profile %s holds no role", profileName)
+	}
+	role := profile.InstanceProfile.Roles[0].RoleName
+	if err := api.AttachRolePolicy(c, role, managedPolicyARN(partition, cloudWatchAgentPolicy)); err != nil {
+		return fmt.Errorf("attaching %s to the role %s: %w", cloudWatchAgentPolicy, role, err)
+	}
+	fmt.Println("Granted the role " + role + " " + cloudWatchAgentPolicy)
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"aws-vmcreate/internal/awsapi"
+)
+
+func TestParseCloudWatchLogs(t *testing.T) {
+	l, err := parseCloudWatchLogs("/aws-vmcreate/dev", "/var/log/app/*.log, /opt/app/server.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(l.Files, ",") != "/var/log/app/*.log,/opt/app/server.log" {
+		t.Errorf("files = %v", l.Files)
+	}
+	for _, bad := range [][2]string{{"dev logs", ""}, {"", ""}, {"/dev", "app.log"}} {
+		if _, err := parseCloudWatchLogs(bad[0], bad[1]); err == nil {
+			t.Errorf("%q %q: expected an error", bad[0], bad[1])
+		}
+	}
+}
+
+func TestCloudWatchAgentConfig(t *testing.T) {
+	l := &CloudWatchLogs{LogGroup: "/aws-vmcreate/dev", Files: []string{"/var/log/app/*.log"}}
+	var config struct {
+		Logs struct {
+			LogsCollected struct {
+				Files struct {
+					CollectList []map[string]string `json:"collect_list"`
+				} `json:"files"`
+			} `json:"logs_collected"`
+		} `json:"logs"`
+	}
+	if err := json.Unmarshal([]byte(l.agentConfig()), &config); err != nil {
+		t.Fatal(err)
+	}
+	files := config.Logs.LogsCollected.Files.CollectList
+	if len(files) != len(systemLogFiles)+1 {
+		t.Fatalf("collects %d files, want the system logs and the application log", len(files))
+	}
+	app := files[len(files)-1]
+	if app["file_path"] != "/var/log/app/*.log" || app["log_group_name"] != "/aws-vmcreate/dev" || app["log_stream_name"] != "{instance_id}/var/log/app/_.log" {
+		t.Errorf("application log = %v", app)
+	}
+	if script := cloudWatchAgentUserData(l); !strings.Contains(script, "fetch-config -m ec2 -s -c file:"+cloudWatchAgentConfig) {
+		t.Errorf("the boot script does not start the agent:\n%s", script)
+	}
+}
+
+func TestGrantCloudWatchLogs(t *testing.T) {
+	fake := &fakeIAM{roles: map[string][]string{"web-role": nil}, profiles: map[string]*awsapi.InstanceProfile{
+		"web": {InstanceProfileName: "web", Roles: []awsapi.Role{{RoleName: "web-role"}}},
+	}}
+	if err := grantCloudWatchLogs(context.Background(), fake, "web", "aws"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.roles["web-role"]; len(got) != 1 || got[0] != "arn:aws:iam::aws:policy/CloudWatchAgentServerPolicy" {
+		t.Errorf("the role has %v attached", got)
+	}
+	if err := grantCloudWatchLogs(context.Background(), fake, "", "aws"); err == nil {
+		t.Error("expected an error without an instance profile")
+	}
+}
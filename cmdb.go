@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// SecretValueAPI defines the interface for the GetSecretValue function the CMDB credentials are read with.
+// We use this interface to test the functions using a mocked service.
+type SecretValueAPI interface {
+	GetSecretValue(ctx context.Context, params *awsapi.GetSecretValueInput) (*awsapi.GetSecretValueOutput, error)
+}
+
+// CMDBConfig registers created instances in a CMDB and retires them when
+// they are deleted: in a ServiceNow table, or with a generic REST API that
+// instances are posted to at Endpoint and deleted from at Endpoint/ID.
+type CMDBConfig struct {
+	// Type is servicenow or rest, rest by default.
+	Type string `json:"type,omitempty"`
+	// Endpoint is the ServiceNow instance, e.g. https://acme.service-now.com,
+	// or the collection URL of the REST API.
+	Endpoint string `json:"endpoint"`
+	// Table is the ServiceNow table, cmdb_ci_ec2_instance by default.
+	Table string `json:"table,omitempty"`
+	// CredentialsSecret is the Secrets Manager secret holding the JSON
+	// "username" and "password", or the "token", the CMDB is called with.
+	CredentialsSecret string `json:"credentials_secret,omitempty"`
+	// Fields map the CMDB's fields to templates of the instance, such as
+	// {{id}}, {{private_ip}} or {{tag:Name}}.
+	Fields map[string]string `json:"fields,omitempty"`
+	// RetireFields are set on the ServiceNow records of deleted instances,
+	// install_status 7 (Retired) by default.
+	RetireFields map[string]string `json:"retire_fields,omitempty"`
+}
+
+// defaultCMDBFields are the fields of each CMDB type without Fields.
+var defaultCMDBFields = map[string]map[string]string{
+	"servicenow": {
+		"object_id":  "{{id}}",
+		"name":       "{{tag:Name}}",
+		"ip_address": "{{private_ip}}",
+	},
+	"rest": {
+		"id":                "{{id}}",
+		"name":              "{{tag:Name}}",
+		"instance_type":     "{{instance_type}}",
+		"image_id":          "{{image_id}}",
+		"region":            "{{region}}",
+		"availability_zone": "{{availability_zone}}",
+		"private_ip":        "{{private_ip}}",
+		"public_ip":         "{{public_ip}}",
+	},
+}
+
+// cmdbTagField is a {{tag:KEY}} template.
+var cmdbTagField = regexp.MustCompile(`\{\{tag:([^}]+)\}\}`)
+
+// cmdbCredentials is the value of the CredentialsSecret.
+type cmdbCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+}
+
+// cmdbClient calls the CMDB of a config.
+type cmdbClient struct {
+	config      *CMDBConfig
+	kind        string
+	httpClient  aws.HTTPClient
+	credentials cmdbCredentials
+}
+
+// newCMDBClient returns a client for the CMDB, with the credentials read
+// from the secret.
+func newCMDBClient(c context.Context, config *CMDBConfig, secrets SecretValueAPI, httpClient aws.HTTPClient) (*cmdbClient, error) {
+	k := &cmdbClient{config: config, kind: firstNonEmpty(config.Type, "rest"), httpClient: httpClient}
+	if _, ok := defaultCMDBFields[k.kind]; !ok {
+		return nil, fmt.Errorf("unknown CMDB type %q, must be servicenow or rest", config.Type)
+	}
+	if config.CredentialsSecret != "" {
+		result, err := secrets.GetSecretValue(c, &awsapi.GetSecretValueInput{SecretId: config.CredentialsSecret})
+		if err != nil {
+			return nil, fmt.Errorf("reading the CMDB credentials: %w", err)
+		}
+		if err := json.Unmarshal([]byte(result.SecretString), &k.credentials); err != nil {
+			return nil, fmt.Errorf("the CMDB credentials in %s are not JSON with a username and password or a token: %w", config.CredentialsSecret, err)
+		}
+	}
+	return k, nil
+}
+
+// fields returns the record of the instance.
+func (k *cmdbClient) fields(i HookInstance) map[string]string {
+	templates := k.config.Fields
+	if len(templates) == 0 {
+		templates = defaultCMDBFields[k.kind]
+	}
+	replacer := strings.NewReplacer(
+		"{{id}}", i.ID,
+		"{{instance_type}}", i.InstanceType,
+		"{{image_id}}", i.ImageID,
+		"{{region}}", awsConfig.Region,
+		"{{availability_zone}}", i.AvailabilityZone,
+		"{{private_ip}}", i.PrivateIP,
+		"{{public_ip}}", i.PublicIP,
+	)
+	record := map[string]string{}
+	for field, template := range templates {
+		record[field] = cmdbTagField.ReplaceAllStringFunc(replacer.Replace(template), func(m string) string {
+			return i.Tags[cmdbTagField.FindStringSubmatch(m)[1]]
+		})
+	}
+	return record
+}
+
+// keyField returns the field the instance id is kept in, which ServiceNow
+// records of deleted instances are found by.
+func (k *cmdbClient) keyField() (string, error) {
+	templates := k.config.Fields
+	if len(templates) == 0 {
+		templates = defaultCMDBFields[k.kind]
+	}
+	var keys []string
+	for field, template := range templates {
+		if template == "{{id}}" {
+			keys = append(keys, field)
+		}
+	}
+	if len(keys) == 0 {
+		return "", fmt.Errorf("no CMDB field is {{id}}, which the records of deleted instances are found by")
+	}
+	sort.Strings(keys)
+	return keys[0], nil
+}
+
+// do calls the CMDB, decoding the answer into out unless it is nil.
+func (k *cmdbClient) do(c context.Context, method string, url string, payload interface{}, out interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(c, method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	switch {
+	case k.credentials.Token != "":
+		req.Header.Set("Authorization", "Bearer "+k.credentials.Token)
+	case k.credentials.Username != "":
+		req.SetBasicAuth(k.credentials.Username, k.credentials.Password)
+	}
+	resp, err := k.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && method == http.MethodDelete {
+		// The instance was never registered or already retired.
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s returned %s", method, url, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// tableURL returns the URL of the ServiceNow table.
+func (k *cmdbClient) tableURL() string {
+	return strings.TrimRight(k.config.Endpoint, "/") + "/api/now/table/" + firstNonEmpty(k.config.Table, "cmdb_ci_ec2_instance")
+}
+
+// register adds the instance to the CMDB.
+func (k *cmdbClient) register(c context.Context, i HookInstance) error {
+	if k.kind == "servicenow" {
+		return k.do(c, http.MethodPost, k.tableURL(), k.fields(i), nil)
+	}
+	return k.do(c, http.MethodPost, k.config.Endpoint, k.fields(i), nil)
+}
+
+// retire marks the instance's ServiceNow record retired, or deletes it
+// from the REST API.
+func (k *cmdbClient) retire(c context.Context, i HookInstance) error {
+	if k.kind != "servicenow" {
+		return k.do(c, http.MethodDelete, strings.TrimRight(k.config.Endpoint, "/")+"/"+url.PathEscape(i.ID), nil, nil)
+	}
+	key, err := k.keyField()
+	if err != nil {
+		return err
+	}
+	query := url.Values{"sysparm_query": {key + "=" + i.ID}, "sysparm_fields": {"sys_id"}}
+	var found struct {
+		Result []struct {
+			SysID string `json:"sys_id"`
+		} `json:"result"`
+	}
+	if err := k.do(c, http.MethodGet, k.tableURL()+"?"+query.Encode(), nil, &found); err != nil {
+		return err
+	}
+	if len(found.Result) == 0 {
+		return fmt.Errorf("no record of %s in the CMDB", i.ID)
+	}
+	fields := k.config.RetireFields
+	if len(fields) == 0 {
+		fields = map[string]string{"install_status": "7"}
+	}
+	for _, r := range found.Result {
+		if err := k.do(c, http.MethodPatch, k.tableURL()+"/"+r.SysID, fields, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncCMDB registers the instances in the CMDB, or retires them. Every
+// instance is tried, and the errors are returned together.
+func syncCMDB(c context.Context, config *CMDBConfig, secrets SecretValueAPI, httpClient aws.HTTPClient, instances []HookInstance, retire bool) error {
+	k, err := newCMDBClient(c, config, secrets, httpClient)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, i := range instances {
+		call := k.register
+		if retire {
+			call = k.retire
+		}
+		if err := call(c, i); err != nil {
+			failed = append(failed, i.ID+": "+err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// updateCMDB registers or retires the instances of a create or delete.
+// Failures are reported but do not fail the command.
+func updateCMDB(config *CMDBConfig, instances []HookInstance, retire bool) {
+	// The AWS HTTP client carries the proxy and CA bundle settings.
+	err := syncCMDB(context.TODO(), config, secretsManagerClient, awsConfig.HTTPClient, instances, retire)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error updating the CMDB:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	if retire {
+		progressln(fmt.Sprintf("Retired %d instances in the CMDB", len(instances)))
+	} else {
+		progressln(fmt.Sprintf("Registered %d instances in the CMDB", len(instances)))
+	}
+}
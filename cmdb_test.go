@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"aws-vmcreate/internal/awsapi"
+)
+
+type fakeSecretValues map[string]string
+
+func (f fakeSecretValues) GetSecretValue(ctx context.Context, params *awsapi.GetSecretValueInput) (*awsapi.GetSecretValueOutput, error) {
+	value, ok := f[params.SecretId]
+	if !ok {
+		return nil, &awsapi.Error{StatusCode: 400, Code: "ResourceNotFoundException"}
+	}
+	return &awsapi.GetSecretValueOutput{Name: params.SecretId, SecretString: value}, nil
+}
+
+// cmdbCall is a request the fake CMDB received.
+type cmdbCall struct {
+	Method string
+	Path   string
+	Query  string
+	Auth   string
+	Body   map[string]string
+}
+
+func fakeCMDB(t *testing.T, sysIDs map[string]string) (*httptest.Server, *[]cmdbCall) {
+	var mu sync.Mutex
+	var calls []cmdbCall
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := cmdbCall{Method: r.Method, Path: r.URL.Path, Query: r.URL.Query().Get("sysparm_query"), Auth: r.Header.Get("Authorization")}
+		json.NewDecoder(r.Body).Decode(&call.Body)
+		mu.Lock()
+		calls = append(calls, call)
+		mu.Unlock()
+		if r.Method == http.MethodGet {
+			_, id, _ := strings.Cut(call.Query, "=")
+			var result []map[string]string
+			if sysID, ok := sysIDs[id]; ok {
+				result = append(result, map[string]string{"sys_id": sysID})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": result})
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestSyncCMDBServiceNow(t *testing.T) {
+	c := context.Background()
+	server, calls := fakeCMDB(t, map[string]string{"i-1": "abc123"})
+	secrets := fakeSecretValues{"cmdb": `{"username": "svc", "password": "pw"}`}
+	config := &CMDBConfig{Type: "servicenow", Endpoint: server.URL, CredentialsSecret: "cmdb"}
+	instances := []HookInstance{{ID: "i-1", PrivateIP: "10.0.0.5", Tags: map[string]string{"Name": "web-1"}}}
+
+	if err := syncCMDB(c, config, secrets, server.Client(), instances, false); err != nil {
+		t.Fatal(err)
+	}
+	post := (*calls)[0]
+	if post.Method != http.MethodPost || post.Path != "/api/now/table/cmdb_ci_ec2_instance" || !strings.HasPrefix(post.Auth, "Basic ") {
+		t.Errorf("register call = %+v", post)
+	}
+	if post.Body["object_id"] != "i-1" || post.Body["name"] != "web-1" || post.Body["ip_address"] != "10.0.0.5" {
+		t.Errorf("record = %v", post.Body)
+	}
+
+	if err := syncCMDB(c, config, secrets, server.Client(), instances, true); err != nil {
+		t.Fatal(err)
+	}
+	find, patch := (*calls)[1], (*calls)[2]
+	if find.Method != http.MethodGet || find.Query != "object_id=i-1" {
+		t.Errorf("find call = %+v", find)
+	}
+	if patch.Method != http.MethodPatch || patch.Path != "/api/now/table/cmdb_ci_ec2_instance/abc123" || patch.Body["install_status"] != "7" {
+		t.Errorf("retire call = %+v", patch)
+	}
+
+	// Instances without a record are reported.
+	err := syncCMDB(c, config, secrets, server.Client(), []HookInstance{{ID: "i-2"}}, true)
+	if err == nil || !strings.Contains(err.Error(), "i-2") {
+		t.Errorf("retiring an unknown instance = %v", err)
+	}
+}
+
+func TestSyncCMDBREST(t *testing.T) {
+	c := context.Background()
+	server, calls := fakeCMDB(t, nil)
+	secrets := fakeSecretValues{"cmdb": `{"token": "tok"}`}
+	config := &CMDBConfig{
+		Endpoint:          server.URL + "/hosts",
+		CredentialsSecret: "cmdb",
+		Fields:            map[string]string{"hostname": "{{tag:Name}}.example.internal", "instance": "{{id}}"},
+	}
+	instances := []HookInstance{{ID: "i-1", Tags: map[string]string{"Name": "web-1"}}}
+
+	if err := syncCMDB(c, config, secrets, server.Client(), instances, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncCMDB(c, config, secrets, server.Client(), instances, true); err != nil {
+		t.Fatal(err)
+	}
+	post, del := (*calls)[0], (*calls)[1]
+	if post.Path != "/hosts" || post.Auth != "Bearer tok" || post.Body["hostname"] != "web-1.example.internal" || post.Body["instance"] != "i-1" {
+		t.Errorf("register call = %+v", post)
+	}
+	if del.Method != http.MethodDelete || del.Path != "/hosts/i-1" {
+		t.Errorf("retire call = %+v", del)
+	}
+
+	if err := syncCMDB(c, &CMDBConfig{Endpoint: server.URL, CredentialsSecret: "missing"}, secrets, server.Client(), instances, false); err == nil {
+		t.Error("missing credentials secret was not reported")
+	}
+}
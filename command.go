@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+)
+
+// SSMCommandAPI defines the interface for the SendCommand and GetCommandInvocation functions.
+// We use this interface to test the functions using a mocked service.
+type SSMCommandAPI interface {
+	SendCommand(ctx context.Context,
+		params *awsapi.SendCommandInput) (*awsapi.SendCommandOutput, error)
+
+	GetCommandInvocation(ctx context.Context,
+		params *awsapi.GetCommandInvocationInput) (*awsapi.GetCommandInvocationOutput, error)
+}
+
+// RunCommand runs an AWS Systems Manager document on Amazon Elastic Compute Cloud (Amazon EC2) instances.
+// Inputs:
+//
+//	c is the context of the method call, which includes the AWS Region.
+//	api is the interface that defines the method call.
+//	input defines the input arguments to the service call.
+//
+// Output:
+//
+//	If success, a SendCommandOutput object containing the result of the service call and nil.
+//	Otherwise, nil and an error from the call to SendCommand.
+func RunCommand(c context.Context, api SSMCommandAPI, input *awsapi.SendCommandInput) (*awsapi.SendCommandOutput, error) {
+	return api.SendCommand(c, input)
+}
+
+// GetCommandResult fetches the status and output of a command on an Amazon Elastic Compute Cloud (Amazon EC2) instance.
+// Inputs:
+//
+//	c is the context of the method call, which includes the AWS Region.
+//	api is the interface that defines the method call.
+//	input defines the input arguments to the service call.
+//
+// Output:
+//
+//	If success, a GetCommandInvocationOutput object containing the result of the service call and nil.
+//	Otherwise, nil and an error from the call to GetCommandInvocation.
+func GetCommandResult(c context.Context, api SSMCommandAPI, input *awsapi.GetCommandInvocationInput) (*awsapi.GetCommandInvocationOutput, error) {
+	return api.GetCommandInvocation(c, input)
+}
+
+// runShellCommands runs commands on the instance with AWS-RunShellScript and
+// waits for them to finish, copying their output to out as it arrives when
+// out is not nil. It returns an error if the commands did not complete
+// successfully, along with the invocation when one is available.
+func runShellCommands(c context.Context, api SSMCommandAPI, instanceID string, commands []string, out io.Writer) (*awsapi.GetCommandInvocationOutput, error) {
+	sent, err := RunCommand(c, api, &awsapi.SendCommandInput{
+		InstanceIds:  []string{instanceID},
+		DocumentName: "AWS-RunShellScript",
+		Parameters:   map[string][]string{"commands": commands},
+		Comment:      "aws-vmcreate",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return waitForCommand(c, api, sent.Command.CommandId, instanceID, out)
+}
+
+// commandPollInterval is how often waitForCommand checks on a command.
+var commandPollInterval = 2 * time.Second
+
+// waitForCommand waits for the command to finish on the instance, copying
+// its output to out as it arrives when out is not nil. It returns an error
+// if the command did not complete successfully, along with the invocation
+// when one is available.
+func waitForCommand(c context.Context, api SSMCommandAPI, commandID string, instanceID string, out io.Writer) (*awsapi.GetCommandInvocationOutput, error) {
+	input := &awsapi.GetCommandInvocationInput{
+		CommandId:  commandID,
+		InstanceId: instanceID,
+	}
+	printed := 0
+	for {
+		select {
+		case <-c.Done():
+			return nil, c.Err()
+		case <-time.After(commandPollInterval):
+		}
+
+		invocation, err := GetCommandResult(c, api, input)
+		var apiErr *awsapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == "InvocationDoesNotExist" {
+			// The invocation is not visible until shortly after SendCommand returns.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if out != nil && len(invocation.StandardOutputContent) > printed {
+			io.WriteString(out, invocation.StandardOutputContent[printed:])
+			printed = len(invocation.StandardOutputContent)
+		}
+
+		switch invocation.Status {
+		case "Pending", "InProgress", "Delayed":
+			continue
+		case "Success":
+			return invocation, nil
+		default:
+			if out != nil && invocation.StandardErrorContent != "" {
+				io.WriteString(out, invocation.StandardErrorContent)
+			}
+			return invocation, fmt.Errorf("command %s %s (exit code %d)", invocation.CommandId, invocation.StatusDetails, invocation.ResponseCode)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// ConfidentialAPI defines the interface for the DescribeImages function the NitroTPM check uses.
+// We use this interface to test the functions using a mocked service.
+type ConfidentialAPI interface {
+	DescribeImages(ctx context.Context,
+		params *ec2.DescribeImagesInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeImagesOutput, error)
+}
+
+// noEnclaveFamilies are the Nitro families without Nitro Enclaves.
+var noEnclaveFamilies = []string{"a1", "t3", "t3a", "t4g", "mac1", "mac2"}
+
+// enclaveSupport returns why the instance type cannot run Nitro Enclaves,
+// or nil when it can: it must be a Nitro type, outside the burstable and
+// Mac families, with enough vCPUs to give some to the enclave.
+func enclaveSupport(t *instanceType) error {
+	family := t.Family()
+	minVCPUs := int32(4)
+	if contains(t.Architectures, "arm64") {
+		minVCPUs = 2
+	}
+	switch {
+	case !t.Nitro:
+		return fmt.Errorf("%s is not a Nitro instance type, which Nitro Enclaves need", t.Name)
+	case contains(noEnclaveFamilies, family) || strings.HasPrefix(family, "u-"):
+		return fmt.Errorf("the %s family does not support Nitro Enclaves", family)
+	case t.VCPUs < minVCPUs:
+		return fmt.Errorf("%s has %d vCPUs, Nitro Enclaves need at least %d", t.Name, t.VCPUs, minVCPUs)
+	}
+	return nil
+}
+
+// nitroTPMSupport returns why the instance type and image cannot run with
+// a NitroTPM, or nil when they can: a virtualized Nitro type booting with
+// UEFI, and an image registered with TPM 2.0 support and UEFI boot.
+func nitroTPMSupport(t *instanceType, image types.Image) error {
+	imageID := aws.ToString(image.ImageId)
+	switch {
+	case !t.Nitro || strings.HasSuffix(t.Name, ".metal"):
+		return fmt.Errorf("%s is not a virtualized Nitro instance type, which NitroTPM needs", t.Name)
+	// Types cached before boot modes were recorded have none, and are not refused.
+	case len(t.BootModes) > 0 && !contains(t.BootModes, string(types.BootModeTypeUefi)):
+		return fmt.Errorf("%s does not boot with UEFI, which NitroTPM needs", t.Name)
+	case image.TpmSupport != types.TpmSupportValuesV20:
+		return fmt.Errorf("%s is not registered with TPM 2.0 support (--tpm-support v2.0 when registering it)", imageID)
+	case image.BootMode != types.BootModeValuesUefi:
+		return fmt.Errorf("%s does not boot with UEFI, which NitroTPM needs", imageID)
+	}
+	return nil
+}
+
+// checkConfidentialLaunch checks that the instance type, and for NitroTPM
+// the image, support the confidential computing features requested.
+func checkConfidentialLaunch(c context.Context, api ConfidentialAPI, t *instanceType, imageID string, enclaves bool, nitroTPM bool) error {
+	if enclaves {
+		if err := enclaveSupport(t); err != nil {
+			return err
+		}
+	}
+	if !nitroTPM {
+		return nil
+	}
+	images, err := api.DescribeImages(c, &ec2.DescribeImagesInput{ImageIds: []string{imageID}})
+	if err != nil {
+		return fmt.Errorf("describing the image: %w", err)
+	}
+	if len(images.Images) == 0 {
+		return fmt.Errorf("image %s not found", imageID)
+	}
+	return nitroTPMSupport(t, images.Images[0])
+}
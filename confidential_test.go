@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeImages answers DescribeImages from its images.
+type fakeImages []types.Image
+
+func (f fakeImages) DescribeImages(ctx context.Context, params *ec2.DescribeImagesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeImagesOutput, error) {
+	out := &ec2.DescribeImagesOutput{}
+	for _, i := range f {
+		if aws.ToString(i.ImageId) == params.ImageIds[0] {
+			out.Images = append(out.Images, i)
+		}
+	}
+	return out, nil
+}
+
+func TestEnclaveSupport(t *testing.T) {
+	for _, test := range []struct {
+		t       instanceType
+		refused string
+	}{
+		{instanceType{Name: "m6i.xlarge", VCPUs: 4, Nitro: true, Architectures: []string{"x86_64"}}, ""},
+		{instanceType{Name: "c7g.large", VCPUs: 2, Nitro: true, Architectures: []string{"arm64"}}, ""},
+		{instanceType{Name: "m6i.large", VCPUs: 2, Nitro: true, Architectures: []string{"x86_64"}}, "at least 4"},
+		{instanceType{Name: "t3.2xlarge", VCPUs: 8, Nitro: true, Architectures: []string{"x86_64"}}, "t3 family"},
+		{instanceType{Name: "m4.xlarge", VCPUs: 4, Architectures: []string{"x86_64"}}, "not a Nitro"},
+	} {
+		err := enclaveSupport(&test.t)
+		if test.refused == "" && err != nil {
+			t.Errorf("%s: %v", test.t.Name, err)
+		}
+		if test.refused != "" && (err == nil || !strings.Contains(err.Error(), test.refused)) {
+			t.Errorf("%s: got %v, want it refused for %s", test.t.Name, err, test.refused)
+		}
+	}
+}
+
+func TestNitroTPMSupport(t *testing.T) {
+	api := fakeImages{
+		{ImageId: aws.String("ami-tpm"), TpmSupport: types.TpmSupportValuesV20, BootMode: types.BootModeValuesUefi},
+		{ImageId: aws.String("ami-legacy"), BootMode: types.BootModeValuesLegacyBios},
+	}
+	m6i := &instanceType{Name: "m6i.large", Nitro: true, BootModes: []string{"legacy-bios", "uefi"}}
+	c := context.Background()
+	if err := checkConfidentialLaunch(c, api, m6i, "ami-tpm", false, true); err != nil {
+		t.Errorf("ami-tpm on m6i.large: %v", err)
+	}
+	for _, test := range []struct {
+		t       *instanceType
+		imageID string
+		refused string
+	}{
+		{m6i, "ami-legacy", "TPM 2.0"},
+		{&instanceType{Name: "m6i.metal", Nitro: true}, "ami-tpm", "not a virtualized Nitro"},
+		{&instanceType{Name: "m6i.large", Nitro: true, BootModes: []string{"legacy-bios"}}, "ami-tpm", "does not boot with UEFI"},
+		{m6i, "ami-missing", "not found"},
+	} {
+		err := checkConfidentialLaunch(c, api, test.t, test.imageID, false, true)
+		if err == nil || !strings.Contains(err.Error(), test.refused) {
+			t.Errorf("%s on %s: got %v, want it refused for %s", test.imageID, test.t.Name, err, test.refused)
+		}
+	}
+}
+
+func TestLaunchCustomizationEnclaves(t *testing.T) {
+	in := &ec2.RunInstancesInput{}
+	launchCustomization(launchOptions{Enclaves: true})(in)
+	if in.EnclaveOptions == nil || !aws.ToBool(in.EnclaveOptions.Enabled) {
+		t.Errorf("EnclaveOptions = %v, want enabled", in.EnclaveOptions)
+	}
+	if launchCustomization(launchOptions{}) != nil {
+		t.Error("want no customization without any option")
+	}
+}
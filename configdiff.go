@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// configSnapshotDir keeps a copy of every config instances were created
+// from, named by its hash, by default in ~/.aws/aws-vmcreate/configs.
+func configSnapshotDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join("aws-vmcreate", "configs")
+	}
+	return filepath.Join(home, ".aws", "aws-vmcreate", "configs")
+}
+
+// recordConfig keeps config as the snapshot of its hash and returns the
+// hash, which create tags the instances with.
+func recordConfig(config ConfigMap) (string, error) {
+	hash := hashConfig(config)
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return hash, err
+	}
+	dir := configSnapshotDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return hash, err
+	}
+	return hash, os.WriteFile(filepath.Join(dir, hash+".json"), append(data, '\n'), 0o600)
+}
+
+// recordedConfig returns the snapshot of hash, or nil when it was recorded
+// elsewhere or not at all.
+func recordedConfig(hash string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(filepath.Join(configSnapshotDir(), path.Base(hash)+".json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	return doc, json.Unmarshal(data, &doc)
+}
+
+// instanceConfig returns the settings that can be read back from the
+// instance itself, for instances without a recorded config.
+func instanceConfig(i *types.Instance) map[string]interface{} {
+	doc := map[string]interface{}{
+		"instance_type": string(i.InstanceType),
+		"image_id":      aws.ToString(i.ImageId),
+		"subnet_id":     aws.ToString(i.SubnetId),
+	}
+	var groups []interface{}
+	for _, g := range i.SecurityGroups {
+		groups = append(groups, aws.ToString(g.GroupId))
+	}
+	if len(groups) > 0 {
+		doc["security_group_ids"] = groups
+	}
+	if i.IamInstanceProfile != nil {
+		// Profiles are launched by name, the instance only has the ARN.
+		doc["iam_instance_profile"] = path.Base(aws.ToString(i.IamInstanceProfile.Arn))
+	}
+	return doc
+}
+
+// flattenConfig adds the settings of v to out keyed like --set, e.g.
+// root_volume.size_gb, with their values as JSON. Lists are kept whole.
+func flattenConfig(prefix string, v interface{}, out map[string]string) {
+	if doc, ok := v.(map[string]interface{}); ok {
+		for k, child := range doc {
+			key := k
+			if prefix != "" {
+				key = prefix + "." + k
+			}
+			flattenConfig(key, child, out)
+		}
+		return
+	}
+	if v == nil || v == "" || v == false {
+		return
+	}
+	data, _ := json.Marshal(v)
+	out[prefix] = string(data)
+}
+
+// configChange is a setting that differs between two configs. An empty
+// side is a setting that is not set there.
+type configChange struct {
+	Key      string
+	Launched string
+	Current  string
+}
+
+// diffConfigs returns the settings of current that differ from launched,
+// sorted by key. Only the keys of only are compared when it is not nil.
+func diffConfigs(launched, current map[string]interface{}, only []string) []configChange {
+	before, after := map[string]string{}, map[string]string{}
+	flattenConfig("", launched, before)
+	flattenConfig("", current, after)
+	keys := map[string]bool{}
+	for k := range before {
+		keys[k] = true
+	}
+	for k := range after {
+		keys[k] = true
+	}
+
+	var changes []configChange
+	for k := range keys {
+		if only != nil && !contains(only, k) {
+			continue
+		}
+		if before[k] != after[k] {
+			changes = append(changes, configChange{Key: k, Launched: before[k], Current: after[k]})
+		}
+	}
+	sort.Slice(changes, func(a, b int) bool { return changes[a].Key < changes[b].Key })
+	return changes
+}
+
+// configDoc returns config as the document of data/config.json.
+func configDoc(config ConfigMap) (map[string]interface{}, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	return doc, json.Unmarshal(data, &doc)
+}
+
+func DiffCmd(instanceID *string) {
+	instance, err := provisioner.Describe(context.TODO(), *instanceID)
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error describing the instance:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	// The instance is compared with the preset it was created from.
+	if configPreset == "" {
+		configPreset = vmcreate.TagValue(instance, presetTag)
+	}
+	config, err := loadConfig()
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		return
+	}
+	current, err := configDoc(config)
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		return
+	}
+
+	hash := vmcreate.TagValue(instance, configHashTag)
+	var launched map[string]interface{}
+	if hash != "" {
+		if launched, err = recordedConfig(hash); err != nil {
+			commandErr = err
+			fmt.Fprintln(os.Stderr, "Got an error reading the recorded config:")
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+	}
+	var only []string
+	switch {
+	case hash == hashConfig(config):
+		fmt.Println(*instanceID + " was launched with the current config (" + hash + ")")
+		return
+	case launched != nil:
+		fmt.Println(*instanceID + " was launched with config " + hash + ", the current config is " + hashConfig(config))
+	default:
+		// Without the snapshot, only what the instance shows can be compared.
+		launched = instanceConfig(instance)
+		for k := range launched {
+			only = append(only, k)
+		}
+		only = append(only, "iam_instance_profile")
+		if hash == "" {
+			progressln(*instanceID + " has no " + configHashTag + " tag, comparing the config with the instance's settings")
+		} else {
+			progressln("Config " + hash + " of " + *instanceID + " was not recorded here, comparing the config with the instance's settings")
+		}
+	}
+
+	changes := diffConfigs(launched, current, only)
+	if len(changes) == 0 {
+		fmt.Println("No settings differ")
+		return
+	}
+	for _, c := range changes {
+		switch {
+		case c.Launched == "":
+			fmt.Printf("+ %s: %s\n", c.Key, c.Current)
+		case c.Current == "":
+			fmt.Printf("- %s: %s\n", c.Key, c.Launched)
+		default:
+			fmt.Printf("~ %s: %s -> %s\n", c.Key, c.Launched, c.Current)
+		}
+	}
+}
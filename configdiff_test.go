@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestDiffConfigs(t *testing.T) {
+	launched := map[string]interface{}{
+		"instance_type": "t3.micro",
+		"subnet_id":     "subnet-1",
+		"tags":          map[string]interface{}{"team": "web"},
+	}
+	current := map[string]interface{}{
+		"instance_type": "t3.large",
+		"subnet_id":     "",
+		"tags":          map[string]interface{}{"team": "web"},
+		"root_volume":   map[string]interface{}{"size_gb": 50.0},
+	}
+	var got []string
+	for _, c := range diffConfigs(launched, current, nil) {
+		got = append(got, c.Key+": "+c.Launched+" -> "+c.Current)
+	}
+	want := `instance_type: "t3.micro" -> "t3.large",root_volume.size_gb:  -> 50,subnet_id: "subnet-1" -> `
+	if strings.Join(got, ",") != want {
+		t.Errorf("got %s, want %s", strings.Join(got, ","), want)
+	}
+	if changes := diffConfigs(launched, current, []string{"subnet_id"}); len(changes) != 1 {
+		t.Errorf("only subnet_id compared, got %v", changes)
+	}
+}
+
+func TestDiffCommand(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1"})
+	t.Cleanup(func() { configSets = nil })
+	runCLI(t, "create", "--tag", "Name=web-1")
+	id := aws.ToString(fake.Instances()[0].InstanceId)
+
+	if out := runCLI(t, "diff", id); !strings.Contains(out, "was launched with the current config") {
+		t.Errorf("unchanged config:\n%s", out)
+	}
+	out := runCLI(t, "diff", id, "--set", "instance_type=t3.large", "--set", "tags.team=web")
+	for _, want := range []string{`~ instance_type: "t3.micro" -> "t3.large"`, `+ tags.team: "web"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s in\n%s", want, out)
+		}
+	}
+
+	// Elsewhere, only the settings of the instance can be compared.
+	if err := os.RemoveAll(configSnapshotDir()); err != nil {
+		t.Fatal(err)
+	}
+	out = runCLI(t, "diff", id, "--set", "tags.team=web")
+	if !strings.Contains(out, "was not recorded here") || strings.Contains(out, "tags.team") {
+		t.Errorf("without the snapshot:\n%s", out)
+	}
+}
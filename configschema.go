@@ -0,0 +1,128 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"aws-vmcreate/internal/jsonschema"
+)
+
+// configSchemaJSON documents data/config.json. Point an editor at it with
+// "$schema": "./config.schema.json" for completion.
+//
+//go:embed config.schema.json
+var configSchemaJSON []byte
+
+// configSchema validates data/config.json and fills in its defaults.
+var configSchema = jsonschema.MustCompile(configSchemaJSON)
+
+// configEnvPrefix starts the environment variables that override settings
+// of data/config.json, e.g. AWS_VMCREATE_INSTANCE_TYPE. Nested settings are
+// separated by two underscores, as in AWS_VMCREATE_TAGS__TEAM.
+const configEnvPrefix = "AWS_VMCREATE_"
+
+// configSets are the --set KEY=VALUE overrides of data/config.json.
+var configSets setFlag
+
+// configPreset is the --preset applied to the config.
+var configPreset string
+
+// setFlag collects the values of a flag that can be repeated.
+type setFlag []string
+
+func (s *setFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *setFlag) Set(value string) error {
+	if key, _, ok := strings.Cut(value, "="); !ok || key == "" {
+		return errors.New("must be KEY=VALUE")
+	}
+	*s = append(*s, value)
+	return nil
+}
+
+// configOverride replaces one setting of data/config.json.
+type configOverride struct {
+	// Source is where the override comes from, the flag or the variable.
+	Source string
+	Path   []string
+	Value  string
+}
+
+// configOverrides returns the overrides of the environment and then of
+// --set, so that applied in order the flags win. Variables of the prefix
+// that name no setting, such as AWS_VMCREATE_API_TOKEN, are not overrides.
+func configOverrides(environ []string, sets []string) []configOverride {
+	var overrides []configOverride
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, configEnvPrefix) {
+			continue
+		}
+		path := strings.Split(strings.ToLower(strings.TrimPrefix(name, configEnvPrefix)), "__")
+		if configSchema.Properties[path[0]] == nil {
+			continue
+		}
+		overrides = append(overrides, configOverride{Source: name, Path: path, Value: value})
+	}
+	for _, kv := range sets {
+		key, value, _ := strings.Cut(kv, "=")
+		overrides = append(overrides, configOverride{Source: "--set " + key, Path: strings.Split(key, "."), Value: value})
+	}
+	return overrides
+}
+
+// applyConfigOverrides sets the overrides in the decoded config doc.
+func applyConfigOverrides(doc map[string]interface{}, overrides []configOverride) error {
+	for _, o := range overrides {
+		if err := configSchema.Set(doc, o.Path, o.Value); err != nil {
+			return fmt.Errorf("%s: %w", o.Source, err)
+		}
+	}
+	return nil
+}
+
+// applyPreset merges the preset selected by the doc's preset setting, or by
+// an override of it, into doc, and removes the presets. Settings that are
+// objects, such as tags, are merged key by key. The overrides themselves
+// are applied after it.
+func applyPreset(doc map[string]interface{}, overrides []configOverride) error {
+	name, _ := doc["preset"].(string)
+	for _, o := range overrides {
+		if len(o.Path) == 1 && o.Path[0] == "preset" {
+			name = o.Value
+		}
+	}
+	presets, _ := doc["presets"].(map[string]interface{})
+	delete(doc, "presets")
+	if name == "" {
+		return nil
+	}
+	preset, ok := presets[name].(map[string]interface{})
+	if !ok {
+		var names []string
+		for n := range presets {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			return fmt.Errorf("unknown preset %q, the config has no presets", name)
+		}
+		return fmt.Errorf("unknown preset %q, the config has %s", name, strings.Join(names, ", "))
+	}
+	for k, v := range preset {
+		base, baseIsObject := doc[k].(map[string]interface{})
+		if fields, ok := v.(map[string]interface{}); ok && baseIsObject {
+			for field, fv := range fields {
+				base[field] = fv
+			}
+			continue
+		}
+		doc[k] = v
+	}
+	return nil
+}
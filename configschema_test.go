@@ -0,0 +1,164 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"aws-vmcreate/pkg/vmcreate"
+)
+
+func TestConfigSchema(t *testing.T) {
+	data, err := os.ReadFile("data/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := configSchema.Validate("data/config.json", data); err != nil {
+		t.Errorf("the sample config is invalid: %v", err)
+	}
+	// Every setting of ConfigMap must be in the schema, or it is rejected.
+	for _, field := range []string{"instance_type", "image_id", "subnet_id", "subnet_strategy", "subnet_ids", "security_group_ids",
+		"iam_instance_profile", "endpoint_url", "endpoints", "s3_use_path_style", "provider", "notifications", "region_failover", "audit", "lock", "region", "tags", "root_volume", "private_ip_pool", "user_data", "preset", "max_instances", "max_instances_per_tag", "budget", "approval", "hooks", "drain", "cmdb", "forensics", "state"} {
+		if configSchema.Properties[field] == nil {
+			t.Errorf("%s is not in config.schema.json", field)
+		}
+	}
+}
+
+func TestLoadConfigValidates(t *testing.T) {
+	useConfig(t, ConfigMap{})
+	write := func(data string) {
+		if err := os.WriteFile("data/config.json", []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"image_id": "ami-0d0ca2066b861631c"}`)
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.InstanceType != "t3.micro" {
+		t.Errorf("instance type = %q, want the schema default", config.InstanceType)
+	}
+
+	write(`{
+  "instance_type": 2,
+  "imageid": "ami-1",
+  "region_failover": [{"region": "us-west-2"}]
+}`)
+	_, err = loadConfig()
+	want := []string{
+		"data/config.json:2:20: /instance_type: must be a string, not a number",
+		`data/config.json:3:3: /: unknown property "imageid", did you mean "image_id"?`,
+		`data/config.json:4:23: /region_failover/0: "image_id" is required`,
+	}
+	if err == nil || err.Error() != strings.Join(want, "\n") {
+		t.Errorf("got %v, want\n%s", err, strings.Join(want, "\n"))
+	}
+}
+
+func TestLoadConfigOverrides(t *testing.T) {
+	useConfig(t, ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1", Tags: map[string]string{"team": "db"}})
+	t.Cleanup(func() { configSets = nil })
+
+	t.Setenv("AWS_VMCREATE_INSTANCE_TYPE", "t3.small")
+	t.Setenv("AWS_VMCREATE_TAGS__TEAM", "web")
+	t.Setenv("AWS_VMCREATE_API_TOKEN", "not a setting")
+	configSets = setFlag{"instance_type=t3.large", "root_volume.size_gb=50", "security_group_ids=sg-1,sg-2"}
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.InstanceType != "t3.large" {
+		t.Errorf("instance type = %q, want --set to win over the environment", config.InstanceType)
+	}
+	if config.Tags["team"] != "web" || config.ImageId != "ami-1" {
+		t.Errorf("tags %v and image %q, want the environment over the file", config.Tags, config.ImageId)
+	}
+	if config.RootVolume == nil || config.RootVolume.SizeGB != 50 || strings.Join(config.SecurityGroupIds, ",") != "sg-1,sg-2" {
+		t.Errorf("root volume %+v and security groups %v not set", config.RootVolume, config.SecurityGroupIds)
+	}
+
+	for _, test := range []struct {
+		set  string
+		want string
+	}{
+		{"root_volume.size_gb=big", `--set root_volume.size_gb: "big" is not an integer`},
+		{"instance_typ=t3.large", "--set instance_typ: unknown setting instance_typ"},
+		{"root_volume.type=gp9", "--set root_volume.type: "},
+	} {
+		configSets = setFlag{test.set}
+		if _, err := loadConfig(); err == nil || !strings.HasPrefix(err.Error(), test.want) {
+			t.Errorf("--set %s: got %v, want %s", test.set, err, test.want)
+		}
+	}
+
+	configSets = nil
+	if err := os.Remove("data/config.json"); err != nil {
+		t.Fatal(err)
+	}
+	if config, err := loadConfig(); err != nil || config.InstanceType != "t3.small" {
+		t.Errorf("without the file, got %+v, %v, want the environment's instance type", config, err)
+	}
+}
+
+func TestLoadConfigPresets(t *testing.T) {
+	useConfig(t, ConfigMap{})
+	t.Cleanup(func() { configSets, configPreset = nil, "" })
+	data := `{
+  "instance_type": "t3.micro",
+  "image_id": "ami-1",
+  "tags": {"team": "ml", "env": "dev"},
+  "presets": {
+    "gpu-training": {"instance_type": "g5.xlarge", "root_volume": {"size_gb": 200}, "tags": {"env": "train"}, "user_data": "nvidia-smi"},
+    "small-dev": {"instance_type": "t3.small"}
+  }
+}`
+	if err := os.WriteFile("data/config.json", []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	configPreset = "gpu-training"
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Preset != "gpu-training" || config.InstanceType != "g5.xlarge" || config.ImageId != "ami-1" || config.UserData != "nvidia-smi" {
+		t.Errorf("got %+v, want the preset over the config", config)
+	}
+	if config.Tags["team"] != "ml" || config.Tags["env"] != "train" || config.RootVolume == nil || config.RootVolume.SizeGB != 200 {
+		t.Errorf("tags %v and root volume %+v, want the preset merged in", config.Tags, config.RootVolume)
+	}
+
+	configSets = setFlag{"instance_type=g5.2xlarge"}
+	if config, err = loadConfig(); err != nil || config.InstanceType != "g5.2xlarge" {
+		t.Errorf("got %q, %v, want --set over the preset", config.InstanceType, err)
+	}
+
+	configSets, configPreset = nil, "windows-rdp"
+	if _, err := loadConfig(); err == nil || err.Error() != `unknown preset "windows-rdp", the config has gpu-training, small-dev` {
+		t.Errorf("got %v", err)
+	}
+
+	configPreset = ""
+	t.Setenv("AWS_VMCREATE_PRESET", "small-dev")
+	if config, err = loadConfig(); err != nil || config.InstanceType != "t3.small" {
+		t.Errorf("got %q, %v, want the preset of the environment", config.InstanceType, err)
+	}
+}
+
+func TestCreateTagsPreset(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{})
+	t.Cleanup(func() { configPreset = "" })
+	if err := os.WriteFile("data/config.json", []byte(`{"image_id": "ami-1", "presets": {"small-dev": {"instance_type": "t3.small"}}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	runCLI(t, "create", "--tag", "Name=dev-1", "--preset", "small-dev")
+
+	i := fake.Instances()[0]
+	if got := vmcreate.TagValue(&i, presetTag); got != "small-dev" || i.InstanceType != "t3.small" {
+		t.Errorf("%s = %q and type %s, want the small-dev preset", presetTag, got, i.InstanceType)
+	}
+}
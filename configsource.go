@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// configSource is where --config reads the provisioning config from: a
+// file, s3://BUCKET/KEY, ssm://PARAMETER or an https:// URL. Empty is
+// data/config.json.
+var configSource string
+
+// remoteConfigs caches the configs read from S3, Parameter Store and URLs,
+// which are read once per run however often the config is loaded.
+var remoteConfigs map[string][]byte
+
+// S3GetObjectAPI defines the interface for the GetObject function shared configs are read with.
+// We use this interface to test the functions using a mocked service.
+type S3GetObjectAPI interface {
+	GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, int64, error)
+}
+
+// SSMParameterAPI defines the interface for the GetParameter function shared configs are read with.
+// We use this interface to test the functions using a mocked service.
+type SSMParameterAPI interface {
+	GetParameter(ctx context.Context, params *awsapi.GetParameterInput) (*awsapi.GetParameterOutput, error)
+}
+
+// isRemoteConfig reports whether source is read over the network.
+func isRemoteConfig(source string) bool {
+	return strings.HasPrefix(source, "s3://") || strings.HasPrefix(source, "ssm://") || strings.HasPrefix(source, "https://")
+}
+
+// readConfigSource returns the contents of the config at source. Local
+// files keep the errors of os.ReadFile, so that a missing one can be told
+// apart; a missing remote config is an error like any other.
+func readConfigSource(c context.Context, source string, objects S3GetObjectAPI, parameters SSMParameterAPI, httpClient aws.HTTPClient) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(source, "s3://"):
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(source, "s3://"), "/")
+		if bucket == "" || key == "" {
+			return nil, fmt.Errorf("%q is not an S3 object such as s3://bucket/config.json", source)
+		}
+		body, _, err := objects.GetObject(c, bucket, key)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", source, err)
+		}
+		defer body.Close()
+		return io.ReadAll(body)
+
+	case strings.HasPrefix(source, "ssm://"):
+		// Names with a path are hierarchical and start with a slash, which
+		// ssm://team/fleet leaves out.
+		name := strings.TrimPrefix(source, "ssm://")
+		if strings.Contains(name, "/") && !strings.HasPrefix(name, "/") {
+			name = "/" + name
+		}
+		if strings.Trim(name, "/") == "" {
+			return nil, fmt.Errorf("%q is not a parameter such as ssm://team/fleet-config", source)
+		}
+		result, err := parameters.GetParameter(c, &awsapi.GetParameterInput{Name: name, WithDecryption: true})
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", source, err)
+		}
+		return []byte(result.Parameter.Value), nil
+
+	case strings.HasPrefix(source, "https://"):
+		req, err := http.NewRequestWithContext(c, http.MethodGet, source, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return nil, fmt.Errorf("%s returned %s", source, resp.Status)
+		}
+		return io.ReadAll(resp.Body)
+
+	case strings.Contains(source, "://"):
+		return nil, fmt.Errorf("%q is not a config source, use a file, s3://, ssm:// or https://", source)
+	}
+	return os.ReadFile(source)
+}
+
+// readConfig returns the contents of the config --config names, and the
+// name its validation errors are reported against.
+func readConfig() ([]byte, string, error) {
+	source := configSource
+	if source == "" {
+		source = configPath
+	}
+	if !isRemoteConfig(source) {
+		data, err := readConfigSource(context.TODO(), source, nil, nil, nil)
+		return data, source, err
+	}
+	if data, ok := remoteConfigs[source]; ok {
+		return data, source, nil
+	}
+	// The AWS HTTP client carries the proxy and CA bundle settings.
+	data, err := readConfigSource(context.TODO(), source, s3Client, ssmClient, awsConfig.HTTPClient)
+	if err != nil {
+		return nil, source, err
+	}
+	if remoteConfigs == nil {
+		remoteConfigs = map[string][]byte{}
+	}
+	remoteConfigs[source] = data
+	return data, source, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"aws-vmcreate/internal/awsapi"
+)
+
+// fakeParameters answers GetParameter from a map of names to values.
+type fakeParameters map[string]string
+
+func (f fakeParameters) GetParameter(ctx context.Context, params *awsapi.GetParameterInput) (*awsapi.GetParameterOutput, error) {
+	value, ok := f[params.Name]
+	if !ok {
+		return nil, &awsapi.Error{StatusCode: 400, Code: "ParameterNotFound"}
+	}
+	return &awsapi.GetParameterOutput{Parameter: awsapi.Parameter{Name: params.Name, Value: value}}, nil
+}
+
+func TestReadConfigSource(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/web.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"instance_type": "t3.small"}`))
+	}))
+	defer server.Close()
+	objects := &fakeS3Lock{objects: map[string][]byte{"fleets/web.json": []byte(`{"instance_type": "t3.medium"}`)}}
+	parameters := fakeParameters{"/team/web": `{"instance_type": "t3.large"}`, "web": `{}`}
+	c := context.Background()
+
+	for source, want := range map[string]string{
+		"s3://configs/fleets/web.json": `{"instance_type": "t3.medium"}`,
+		"ssm://team/web":               `{"instance_type": "t3.large"}`,
+		"ssm:///team/web":              `{"instance_type": "t3.large"}`,
+		"ssm://web":                    `{}`,
+		server.URL + "/web.json":       `{"instance_type": "t3.small"}`,
+	} {
+		data, err := readConfigSource(c, source, objects, parameters, server.Client())
+		if err != nil || string(data) != want {
+			t.Errorf("%s: got %s, %v, want %s", source, data, err, want)
+		}
+	}
+
+	for source, want := range map[string]string{
+		"s3://configs":                  "not an S3 object",
+		"s3://configs/fleets/db.json":   "NoSuchKey",
+		"ssm://team/db":                 "ParameterNotFound",
+		server.URL + "/db.json":         "404 Not Found",
+		"http://example.com/web.json":   "not a config source",
+		"ftp://example.com/config.json": "not a config source",
+	} {
+		if _, err := readConfigSource(c, source, objects, parameters, server.Client()); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %s", source, err, want)
+		}
+	}
+}
+
+func TestLoadConfigFromSource(t *testing.T) {
+	useConfig(t, ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1"})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"instance_type": "t3.small", "image_id": "ami-2",}`))
+	}))
+	defer server.Close()
+	previous := awsConfig.HTTPClient
+	awsConfig.HTTPClient = server.Client()
+	t.Cleanup(func() {
+		awsConfig.HTTPClient = previous
+		configSource, remoteConfigs = "", nil
+	})
+
+	configSource = server.URL + "/web.json"
+	_, err := loadConfig()
+	if err == nil || !strings.HasPrefix(err.Error(), configSource+":1:") {
+		t.Errorf("got %v, want the error reported against the URL", err)
+	}
+
+	// A remote config is read once per run.
+	remoteConfigs = map[string][]byte{configSource: []byte(`{"instance_type": "t3.small", "image_id": "ami-2"}`)}
+	config, err := loadConfig()
+	if err != nil || config.InstanceType != "t3.small" || config.ImageId != "ami-2" {
+		t.Errorf("got %+v, %v", config, err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+var instanceConnectClient EC2InstanceConnectAPI
+
+// EC2InstanceConnectAPI defines the interface for the SendSSHPublicKey function.
+// We use this interface to test the functions using a mocked service.
+type EC2InstanceConnectAPI interface {
+	SendSSHPublicKey(ctx context.Context,
+		params *awsapi.SendSSHPublicKeyInput) (*awsapi.SendSSHPublicKeyOutput, error)
+}
+
+// PushSSHPublicKey pushes an SSH public key to an Amazon Elastic Compute Cloud (Amazon EC2) instance.
+// Inputs:
+//
+//	c is the context of the method call, which includes the AWS Region.
+//	api is the interface that defines the method call.
+//	input defines the input arguments to the service call.
+//
+// Output:
+//
+//	If success, a SendSSHPublicKeyOutput object containing the result of the service call and nil.
+//	Otherwise, nil and an error from the call to SendSSHPublicKey.
+func PushSSHPublicKey(c context.Context, api EC2InstanceConnectAPI, input *awsapi.SendSSHPublicKeyInput) (*awsapi.SendSSHPublicKeyOutput, error) {
+	return api.SendSSHPublicKey(c, input)
+}
+
+// writeEphemeralKey generates an RSA key pair, writes the private key to dir
+// and returns its path together with the public key in authorized_keys format.
+func writeEphemeralKey(dir string) (string, string, error) {
+	privatePEM, publicKey, err := generateSSHKey("aws-vmcreate")
+	if err != nil {
+		return "", "", err
+	}
+	keyPath := filepath.Join(dir, "id_rsa")
+	if err := os.WriteFile(keyPath, privatePEM, 0600); err != nil {
+		return "", "", err
+	}
+	return keyPath, publicKey, nil
+}
+
+// generateSSHKey generates an RSA key pair and returns the private key as PEM
+// and the public key in authorized_keys format, ending with comment.
+func generateSSHKey(comment string) ([]byte, string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, "", err
+	}
+	privatePEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+
+	// The ssh-rsa wire format is the key type, exponent and modulus, each
+	// prefixed with its length.
+	var blob []byte
+	for _, field := range [][]byte{
+		[]byte("ssh-rsa"),
+		mpint(big.NewInt(int64(key.E))),
+		mpint(key.N),
+	} {
+		blob = binary.BigEndian.AppendUint32(blob, uint32(len(field)))
+		blob = append(blob, field...)
+	}
+
+	return privatePEM, "ssh-rsa " + base64.StdEncoding.EncodeToString(blob) + " " + comment, nil
+}
+
+// mpint encodes n as an SSH multiple precision integer, without the length prefix.
+func mpint(n *big.Int) []byte {
+	b := n.Bytes()
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return b
+}
+
+// sshArgs returns the options ssh and scp connect with, offering only the
+// key at keyPath.
+func sshArgs(keyPath string) []string {
+	return []string{"-i", keyPath, "-o", "IdentitiesOnly=yes", "-o", "StrictHostKeyChecking=accept-new"}
+}
+
+// pushEphemeralKey generates a key pair in dir and pushes its public key to
+// the instance for osUser. It returns the path of the private key, which sshd
+// accepts for the next 60 seconds.
+func pushEphemeralKey(c context.Context, instance *types.Instance, osUser string, dir string) (string, error) {
+	keyPath, publicKey, err := writeEphemeralKey(dir)
+	if err != nil {
+		return "", err
+	}
+
+	input := &awsapi.SendSSHPublicKeyInput{
+		InstanceId:     aws.ToString(instance.InstanceId),
+		InstanceOSUser: osUser,
+		SSHPublicKey:   publicKey,
+	}
+	if instance.Placement != nil {
+		input.AvailabilityZone = aws.ToString(instance.Placement.AvailabilityZone)
+	}
+
+	if _, err := PushSSHPublicKey(c, instanceConnectClient, input); err != nil {
+		return "", err
+	}
+	return keyPath, nil
+}
+
+func ConnectInstanceCmd(instanceID *string, osUser *string, usePrivateIP *bool) {
+	instance, err := provisioner.Describe(context.TODO(), *instanceID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error fetching the instance:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+
+	if instance.State == nil || instance.State.Name != types.InstanceStateNameRunning {
+		failCommand("Instance " + *instanceID + " is not running")
+		return
+	}
+
+	host := aws.ToString(instance.PublicIpAddress)
+	if *usePrivateIP || host == "" {
+		host = aws.ToString(instance.PrivateIpAddress)
+	}
+
+	dir, err := os.MkdirTemp("", "aws-vmcreate-connect")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error creating the key directory:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	keyPath, err := pushEphemeralKey(context.TODO(), instance, *osUser, dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error pushing the ephemeral key:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+
+	// The pushed key is only accepted for 60 seconds, so connect straight away.
+	progressln("Connecting to " + *osUser + "@" + host)
+	cmd := exec.Command("ssh", append(sshArgs(keyPath), *osUser+"@"+host)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error from the SSH session:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+	}
+}
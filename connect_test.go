@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeInstanceConnect records the keys pushed to instances.
+type fakeInstanceConnect struct {
+	pushed []*awsapi.SendSSHPublicKeyInput
+}
+
+func (f *fakeInstanceConnect) SendSSHPublicKey(ctx context.Context, params *awsapi.SendSSHPublicKeyInput) (*awsapi.SendSSHPublicKeyOutput, error) {
+	f.pushed = append(f.pushed, params)
+	return &awsapi.SendSSHPublicKeyOutput{Success: true}, nil
+}
+
+func useFakeInstanceConnect(t *testing.T) *fakeInstanceConnect {
+	fake := &fakeInstanceConnect{}
+	previous := instanceConnectClient
+	instanceConnectClient = fake
+	t.Cleanup(func() { instanceConnectClient = previous })
+	return fake
+}
+
+// fakeCommand puts an executable named name first on PATH, which writes its
+// arguments, one a line, to the returned file and exits with code.
+func fakeCommand(t *testing.T, name string, code int) string {
+	t.Helper()
+	dir := t.TempDir()
+	args := filepath.Join(dir, name+".args")
+	body := "#!/bin/sh\nfor a in \"$@\"; do echo \"$a\"; done > " + shellQuote(args) + "\nexit " + strconv.Itoa(code) + "\n"
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return args
+}
+
+func readArgs(t *testing.T, file string) []string {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestGenerateSSHKey(t *testing.T) {
+	privatePEM, publicKey, err := generateSSHKey("me@host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(privatePEM)
+	if block == nil {
+		t.Fatal("the private key is not PEM")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := strings.Fields(publicKey)
+	if len(fields) != 3 || fields[0] != "ssh-rsa" || fields[2] != "me@host" {
+		t.Fatalf("public key = %q", publicKey)
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The blob starts with the key type and ends with the modulus.
+	if n := binary.BigEndian.Uint32(blob); string(blob[4:4+n]) != "ssh-rsa" {
+		t.Errorf("blob starts with %q", blob[4:4+n])
+	}
+	if modulus := key.N.Bytes(); !strings.HasSuffix(string(blob), string(modulus)) {
+		t.Error("the blob does not end with the modulus of the private key")
+	}
+}
+
+func TestConnectCommand(t *testing.T) {
+	fake := useFakeEC2(t)
+	pushed := useFakeInstanceConnect(t)
+	id := fake.AddInstance(types.Instance{
+		State:           &types.InstanceState{Name: types.InstanceStateNameRunning},
+		PublicIpAddress: aws.String("203.0.113.7"),
+		Placement:       &types.Placement{AvailabilityZone: aws.String("us-east-1a")},
+	})
+	args := fakeCommand(t, "ssh", 0)
+
+	if _, stderr, code := runCLIExit(t, false, "connect", id, "-u", "admin"); code != 0 {
+		t.Fatalf("exit code %d:\n%s", code, stderr)
+	}
+	if len(pushed.pushed) != 1 || pushed.pushed[0].InstanceOSUser != "admin" || pushed.pushed[0].AvailabilityZone != "us-east-1a" {
+		t.Fatalf("pushed %+v", pushed.pushed)
+	}
+	got := readArgs(t, args)
+	want := []string{"-i", got[1], "-o", "IdentitiesOnly=yes", "-o", "StrictHostKeyChecking=accept-new", "admin@203.0.113.7"}
+	if strings.Join(got, " ") != strings.Join(want, " ") || filepath.Base(got[1]) != "id_rsa" {
+		t.Errorf("ssh %q, want %q", got, want)
+	}
+
+	// A failed session fails the command.
+	fakeCommand(t, "ssh", 255)
+	if _, stderr, code := runCLIExit(t, false, "connect", id); code != 1 || !strings.Contains(stderr, "Got an error from the SSH session:") {
+		t.Errorf("exit code %d:\n%s", code, stderr)
+	}
+}
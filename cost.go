@@ -0,0 +1,24 @@
+package main
+
+// hourlyPrices are approximate on-demand Linux prices in US dollars in
+// us-east-1. They are estimates only: other regions, operating systems and
+// discounts such as Savings Plans cost differently.
+var hourlyPrices = map[string]float64{
+	"t2.nano": 0.0058, "t2.micro": 0.0116, "t2.small": 0.023, "t2.medium": 0.0464, "t2.large": 0.0928,
+	"t3.nano": 0.0052, "t3.micro": 0.0104, "t3.small": 0.0208, "t3.medium": 0.0416, "t3.large": 0.0832,
+	"t3.xlarge": 0.1664, "t3.2xlarge": 0.3328,
+	"t3a.micro": 0.0094, "t3a.small": 0.0188, "t3a.medium": 0.0376, "t3a.large": 0.0752,
+	"t4g.micro": 0.0084, "t4g.small": 0.0168, "t4g.medium": 0.0336, "t4g.large": 0.0672,
+	"m5.large": 0.096, "m5.xlarge": 0.192, "m5.2xlarge": 0.384,
+	"m6i.large": 0.096, "m6i.xlarge": 0.192, "m6i.2xlarge": 0.384,
+	"m7i.large": 0.1008, "m7i.xlarge": 0.2016,
+	"c5.large": 0.085, "c5.xlarge": 0.17, "c6i.large": 0.085, "c6i.xlarge": 0.17,
+	"r5.large": 0.126, "r6i.large": 0.126, "r6i.xlarge": 0.252,
+	"g4dn.xlarge": 0.526, "g5.xlarge": 1.006, "p3.2xlarge": 3.06,
+}
+
+// hourlyPrice returns the estimated hourly price of the instance type.
+func hourlyPrice(instanceType string) (float64, bool) {
+	price, ok := hourlyPrices[instanceType]
+	return price, ok
+}
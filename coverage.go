@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+var savingsPlansClient *awsapi.SavingsPlans
+
+// CoverageEC2API defines the interface for the functions coverage lists instances and reservations with.
+// We use this interface to test the functions using a mocked service.
+type CoverageEC2API interface {
+	ec2.DescribeInstancesAPIClient
+
+	DescribeReservedInstances(ctx context.Context,
+		params *ec2.DescribeReservedInstancesInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeReservedInstancesOutput, error)
+}
+
+// SavingsPlansAPI defines the interface for the DescribeSavingsPlans function.
+// We use this interface to test the functions using a mocked service.
+type SavingsPlansAPI interface {
+	DescribeSavingsPlans(ctx context.Context, params *awsapi.DescribeSavingsPlansInput) (*awsapi.DescribeSavingsPlansOutput, error)
+}
+
+// The ways an instance can be paid for.
+const (
+	coveredZonalRI     = "reserved (zonal)"
+	coveredRegionalRI  = "reserved"
+	coveredSavingsPlan = "savings plan"
+	coveredOnDemand    = "on-demand"
+)
+
+// coverageRow is how one running instance is paid for.
+type coverageRow struct {
+	InstanceID   string
+	Name         string
+	InstanceType string
+	Zone         string
+	Coverage     string
+}
+
+// normalizationFactor returns the size of the instance type in the units
+// regional Linux reservations are shared out in, e.g. 4 for a large. Metal
+// sizes are not size flexible.
+func normalizationFactor(instanceType string) (float64, bool) {
+	_, size, _ := strings.Cut(instanceType, ".")
+	factors := map[string]float64{"nano": 0.25, "micro": 0.5, "small": 1, "medium": 2, "large": 4, "xlarge": 8}
+	if f, ok := factors[size]; ok {
+		return f, true
+	}
+	if n, err := strconv.Atoi(strings.TrimSuffix(size, "xlarge")); err == nil && strings.HasSuffix(size, "xlarge") {
+		return 8 * float64(n), true
+	}
+	return 0, false
+}
+
+// billingPlatform reduces a platform or product description, such as
+// "Linux/UNIX (Amazon VPC)", to the platform reservations match on.
+func billingPlatform(description string) string {
+	switch {
+	case description == "" || strings.HasPrefix(description, "Linux/UNIX"):
+		return "linux"
+	case strings.HasPrefix(description, "Windows"):
+		return "windows"
+	}
+	return strings.ToLower(description)
+}
+
+// instanceCoverage works out how each running instance is paid for, the way
+// EC2 applies discounts: zonal reservations first, then regional ones, which
+// are shared across the sizes of a family for Linux, then Savings Plans.
+// Savings Plan commitments are spent at the estimated on-demand prices, so
+// their coverage is an estimate that errs towards on-demand.
+func instanceCoverage(instances []types.Instance, reserved []types.ReservedInstances, plans []awsapi.SavingsPlan, region string) []coverageRow {
+	zonal := map[string]int32{}
+	regional := map[string]int32{}
+	familyUnits := map[string]float64{}
+	for _, r := range reserved {
+		instanceType, platform := string(r.InstanceType), billingPlatform(string(r.ProductDescription))
+		count := aws.ToInt32(r.InstanceCount)
+		factor, flexible := normalizationFactor(instanceType)
+		switch {
+		case r.Scope == types.ScopeAvailabilityZone:
+			zonal[instanceType+"|"+platform+"|"+aws.ToString(r.AvailabilityZone)] += count
+		case platform == "linux" && flexible:
+			family, _, _ := strings.Cut(instanceType, ".")
+			familyUnits[family] += float64(count) * factor
+		default:
+			regional[instanceType+"|"+platform] += count
+		}
+	}
+	commitments := make([]float64, len(plans))
+	for n, p := range plans {
+		commitments[n], _ = strconv.ParseFloat(p.Commitment, 64)
+	}
+
+	sorted := append([]types.Instance(nil), instances...)
+	sort.Slice(sorted, func(a, b int) bool { return aws.ToString(sorted[a].InstanceId) < aws.ToString(sorted[b].InstanceId) })
+	rows := make([]coverageRow, len(sorted))
+	for n, i := range sorted {
+		rows[n] = coverageRow{InstanceID: aws.ToString(i.InstanceId), Name: tagName(i.Tags), InstanceType: string(i.InstanceType), Coverage: coveredOnDemand}
+		if i.Placement != nil {
+			rows[n].Zone = aws.ToString(i.Placement.AvailabilityZone)
+		}
+	}
+
+	platform := func(n int) string { return billingPlatform(aws.ToString(sorted[n].PlatformDetails)) }
+	for n := range rows {
+		if key := rows[n].InstanceType + "|" + platform(n) + "|" + rows[n].Zone; zonal[key] > 0 {
+			zonal[key]--
+			rows[n].Coverage = coveredZonalRI
+		}
+	}
+	for n := range rows {
+		if rows[n].Coverage != coveredOnDemand {
+			continue
+		}
+		family, _, _ := strings.Cut(rows[n].InstanceType, ".")
+		factor, flexible := normalizationFactor(rows[n].InstanceType)
+		if key := rows[n].InstanceType + "|" + platform(n); regional[key] > 0 {
+			regional[key]--
+			rows[n].Coverage = coveredRegionalRI
+		} else if platform(n) == "linux" && flexible && familyUnits[family] >= factor {
+			familyUnits[family] -= factor
+			rows[n].Coverage = coveredRegionalRI
+		}
+	}
+	for n := range rows {
+		if rows[n].Coverage != coveredOnDemand {
+			continue
+		}
+		family, _, _ := strings.Cut(rows[n].InstanceType, ".")
+		price, _ := hourlyPrice(rows[n].InstanceType)
+		for p, plan := range plans {
+			applies := plan.SavingsPlanType == "Compute" ||
+				(plan.SavingsPlanType == "EC2Instance" && plan.Ec2InstanceFamily == family && plan.Region == region)
+			if applies && commitments[p] > 0 {
+				commitments[p] -= price
+				rows[n].Coverage = coveredSavingsPlan
+				break
+			}
+		}
+	}
+	return rows
+}
+
+// listReservations returns the active Reserved Instances of the region and
+// the active Savings Plans of the account.
+func listReservations(c context.Context, api CoverageEC2API, plansAPI SavingsPlansAPI) ([]types.ReservedInstances, []awsapi.SavingsPlan, error) {
+	reserved, err := api.DescribeReservedInstances(c, &ec2.DescribeReservedInstancesInput{Filters: []types.Filter{
+		{Name: aws.String("state"), Values: []string{"active"}},
+	}})
+	if err != nil {
+		return nil, nil, fmt.Errorf("listing the Reserved Instances: %w", err)
+	}
+	var plans []awsapi.SavingsPlan
+	input := &awsapi.DescribeSavingsPlansInput{States: []string{"active"}}
+	for {
+		page, err := plansAPI.DescribeSavingsPlans(c, input)
+		if err != nil {
+			return nil, nil, fmt.Errorf("listing the Savings Plans: %w", err)
+		}
+		plans = append(plans, page.SavingsPlans...)
+		if page.NextToken == "" {
+			break
+		}
+		input.NextToken = page.NextToken
+	}
+	return reserved.ReservedInstances, plans, nil
+}
+
+func CoverageCmd() {
+	var instances []types.Instance
+	pages := ec2.NewDescribeInstancesPaginator(client, &ec2.DescribeInstancesInput{Filters: []types.Filter{
+		{Name: aws.String("tag-key"), Values: []string{createdByTag}},
+		{Name: aws.String("instance-state-name"), Values: []string{"running"}},
+	}})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(context.TODO())
+		if err != nil {
+			commandErr = err
+			fmt.Fprintln(os.Stderr, "Got an error listing the instances:")
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		for _, r := range page.Reservations {
+			instances = append(instances, r.Instances...)
+		}
+	}
+	if len(instances) == 0 {
+		fmt.Println("No running instances created by aws-vmcreate")
+		return
+	}
+
+	reserved, plans, err := listReservations(context.TODO(), client, savingsPlansClient)
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error listing the reservations:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	rows := instanceCoverage(instances, reserved, plans, awsConfig.Region)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tNAME\tTYPE\tZONE\tCOVERAGE")
+	uncovered := map[string]int{}
+	var families []string
+	onDemand, hourly := 0, 0.0
+	for _, r := range rows {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.InstanceID, r.Name, r.InstanceType, r.Zone, r.Coverage)
+		if r.Coverage != coveredOnDemand {
+			continue
+		}
+		onDemand++
+		price, _ := hourlyPrice(r.InstanceType)
+		hourly += price
+		family, _, _ := strings.Cut(r.InstanceType, ".")
+		if uncovered[family] == 0 {
+			families = append(families, family)
+		}
+		uncovered[family]++
+	}
+	w.Flush()
+
+	if onDemand == 0 {
+		fmt.Printf("All %d instances are covered by Reserved Instances or Savings Plans\n", len(rows))
+		return
+	}
+	fmt.Printf("%d of %d instances run on-demand, about $%.4f/hour (estimated us-east-1 Linux prices)\n", onDemand, len(rows), hourly)
+	sort.Strings(families)
+	for _, f := range families {
+		fmt.Printf("  %s: %d on-demand, a regional Reserved Instance or an EC2 Instance Savings Plan for %s would cover them\n", f, uncovered[f], f)
+	}
+	progressln("Reservations bought in another account of the organization are not listed here, run coverage with its credentials too")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"aws-vmcreate/internal/awsapi"
+	"aws-vmcreate/pkg/vmcreate/vmcreatetest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeReservations answers DescribeReservedInstances and, a page per call,
+// DescribeSavingsPlans.
+type fakeReservations struct {
+	*vmcreatetest.FakeEC2
+	reserved []types.ReservedInstances
+	plans    [][]awsapi.SavingsPlan
+}
+
+func (f *fakeReservations) DescribeReservedInstances(ctx context.Context, params *ec2.DescribeReservedInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeReservedInstancesOutput, error) {
+	return &ec2.DescribeReservedInstancesOutput{ReservedInstances: f.reserved}, nil
+}
+
+func (f *fakeReservations) DescribeSavingsPlans(ctx context.Context, params *awsapi.DescribeSavingsPlansInput) (*awsapi.DescribeSavingsPlansOutput, error) {
+	page := 0
+	if params.NextToken != "" {
+		page = int(params.NextToken[0] - '0')
+	}
+	out := &awsapi.DescribeSavingsPlansOutput{SavingsPlans: f.plans[page]}
+	if page+1 < len(f.plans) {
+		out.NextToken = string(rune('0' + page + 1))
+	}
+	return out, nil
+}
+
+func coverageInstance(id, instanceType, zone, platform string) types.Instance {
+	return types.Instance{
+		InstanceId:      aws.String(id),
+		InstanceType:    types.InstanceType(instanceType),
+		Placement:       &types.Placement{AvailabilityZone: aws.String(zone)},
+		PlatformDetails: aws.String(platform),
+	}
+}
+
+func TestInstanceCoverage(t *testing.T) {
+	instances := []types.Instance{
+		coverageInstance("i-6", "t3.micro", "us-east-1a", "Linux/UNIX"),
+		coverageInstance("i-1", "m5.large", "us-east-1a", "Linux/UNIX"),
+		coverageInstance("i-2", "m5.large", "us-east-1b", "Linux/UNIX"),
+		coverageInstance("i-3", "m5.large", "us-east-1b", "Linux/UNIX"),
+		coverageInstance("i-4", "m5.large", "us-east-1b", "Windows"),
+		coverageInstance("i-5", "c5.large", "us-east-1a", "Linux/UNIX"),
+	}
+	fake := &fakeReservations{FakeEC2: vmcreatetest.NewFakeEC2(), reserved: []types.ReservedInstances{
+		{InstanceType: "m5.large", InstanceCount: aws.Int32(1), Scope: types.ScopeAvailabilityZone,
+			AvailabilityZone: aws.String("us-east-1a"), ProductDescription: types.RIProductDescription("Linux/UNIX")},
+		// An unused zonal reservation, which covers nothing elsewhere.
+		{InstanceType: "m5.large", InstanceCount: aws.Int32(1), Scope: types.ScopeAvailabilityZone,
+			AvailabilityZone: aws.String("us-east-1c"), ProductDescription: types.RIProductDescription("Linux/UNIX")},
+		// An xlarge covers two larges of the family.
+		{InstanceType: "m5.xlarge", InstanceCount: aws.Int32(1), Scope: types.ScopeRegional, ProductDescription: types.RIProductDescription("Linux/UNIX (Amazon VPC)")},
+	}, plans: [][]awsapi.SavingsPlan{
+		{{SavingsPlanType: "EC2Instance", Ec2InstanceFamily: "c5", Region: "us-east-1", Commitment: "0.1"}},
+		{{SavingsPlanType: "Compute", Commitment: "0.05"}},
+	}}
+
+	reserved, plans, err := listReservations(context.Background(), fake, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plans) != 2 {
+		t.Fatalf("listed %d savings plans, want the 2 of both pages", len(plans))
+	}
+	var got []string
+	for _, r := range instanceCoverage(instances, reserved, plans, "us-east-1") {
+		got = append(got, r.InstanceID+"="+r.Coverage)
+	}
+	want := "i-1=reserved (zonal),i-2=reserved,i-3=reserved,i-4=savings plan,i-5=savings plan,i-6=on-demand"
+	if strings.Join(got, ",") != want {
+		t.Errorf("got %s, want %s", strings.Join(got, ","), want)
+	}
+}
+
+func TestNormalizationFactor(t *testing.T) {
+	for instanceType, want := range map[string]float64{"t3.nano": 0.25, "m5.large": 4, "m5.xlarge": 8, "m5.12xlarge": 96} {
+		if got, ok := normalizationFactor(instanceType); !ok || got != want {
+			t.Errorf("%s: got %g, want %g", instanceType, got, want)
+		}
+	}
+	if _, ok := normalizationFactor("m5.metal"); ok {
+		t.Error("metal sizes are not size flexible")
+	}
+}
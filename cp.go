@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+var s3Client *awsapi.S3
+
+// S3ObjectAPI defines the interface for the object functions used to stage file transfers.
+// We use this interface to test the functions using a mocked service.
+type S3ObjectAPI interface {
+	PutObject(ctx context.Context, bucket, key string, body io.Reader, size int64) error
+	GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, int64, error)
+	DeleteObject(ctx context.Context, bucket, key string) error
+	PresignObject(ctx context.Context, method, bucket, key string, expires time.Duration) (string, error)
+}
+
+// progressReader reports how much of an object has been transferred.
+type progressReader struct {
+	r       io.Reader
+	label   string
+	total   int64
+	done    int64
+	printed time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.done += int64(n)
+	if time.Since(p.printed) > 500*time.Millisecond || err == io.EOF {
+		p.printed = time.Now()
+		percent := int64(100)
+		if p.total > 0 {
+			percent = p.done * 100 / p.total
+		}
+		fmt.Fprintf(diagnostics, "\r%s %3d%% (%d/%d bytes)", p.label, percent, p.done, p.total)
+		if err == io.EOF {
+			fmt.Fprintln(diagnostics)
+		}
+	}
+	return n, err
+}
+
+// splitRemotePath splits an "INSTANCE_ID:PATH" argument. ok is false for local paths.
+func splitRemotePath(arg string) (instanceID string, remotePath string, ok bool) {
+	if !strings.HasPrefix(arg, "i-") {
+		return "", "", false
+	}
+	instanceID, remotePath, ok = strings.Cut(arg, ":")
+	return instanceID, remotePath, ok
+}
+
+// shellQuote quotes s for use as a single sh argument.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// copyWithSCP copies between localPath and remotePath over SCP, pushing an
+// ephemeral key with EC2 Instance Connect unless keyPath is set.
+func copyWithSCP(c context.Context, host string, osUser string, keyPath string, localPath string, remotePath string, upload bool, pushKey func(dir string) (string, error)) error {
+	if keyPath == "" {
+		dir, err := os.MkdirTemp("", "aws-vmcreate-cp")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		if keyPath, err = pushKey(dir); err != nil {
+			return err
+		}
+	}
+
+	remote := osUser + "@" + host + ":" + remotePath
+	args := sshArgs(keyPath)
+	if upload {
+		args = append(args, localPath, remote)
+	} else {
+		args = append(args, remote, localPath)
+	}
+
+	cmd := exec.CommandContext(c, "scp", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// copyWithS3 stages the file in bucket and has the instance fetch or push it
+// with a presigned URL over SSM, so the instance needs neither a public IP nor
+// S3 permissions of its own.
+func copyWithS3(c context.Context, api S3ObjectAPI, commands SSMCommandAPI, bucket string, instanceID string, localPath string, remotePath string, upload bool) error {
+	key := fmt.Sprintf("aws-vmcreate/cp/%s/%d/%s", instanceID, time.Now().UnixNano(), path.Base(remotePath))
+	defer api.DeleteObject(c, bucket, key)
+
+	if upload {
+		file, err := os.Open(localPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+
+		body := &progressReader{r: file, label: "Uploading " + localPath, total: info.Size()}
+		if err := api.PutObject(c, bucket, key, body, info.Size()); err != nil {
+			return err
+		}
+
+		url, err := api.PresignObject(c, http.MethodGet, bucket, key, 15*time.Minute)
+		if err != nil {
+			return err
+		}
+		_, err = runShellCommands(c, commands, instanceID, []string{
+			"curl -fsSL -o " + shellQuote(remotePath) + " " + shellQuote(url),
+		}, nil)
+		return err
+	}
+
+	url, err := api.PresignObject(c, http.MethodPut, bucket, key, 15*time.Minute)
+	if err != nil {
+		return err
+	}
+	if _, err := runShellCommands(c, commands, instanceID, []string{
+		"curl -fsS -X PUT -T " + shellQuote(remotePath) + " " + shellQuote(url),
+	}, nil); err != nil {
+		return err
+	}
+
+	object, size, err := api.GetObject(c, bucket, key)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	file, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, &progressReader{r: object, label: "Downloading " + remotePath, total: size})
+	return err
+}
+
+func CopyFilesCmd(src *string, dst *string, osUser *string, keyPath *string, bucket *string) {
+	instanceID, remotePath, upload := splitRemotePath(*dst)
+	localPath := *src
+	if !upload {
+		var ok bool
+		if instanceID, remotePath, ok = splitRemotePath(*src); !ok {
+			failCommand("One of the paths must be on an instance (INSTANCE_ID:PATH)")
+			return
+		}
+		localPath = *dst
+	}
+
+	instance, err := provisioner.Describe(context.TODO(), instanceID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error fetching the instance:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+
+	host := aws.ToString(instance.PublicIpAddress)
+	switch {
+	case host != "":
+		pushKey := func(dir string) (string, error) {
+			return pushEphemeralKey(context.TODO(), instance, *osUser, dir)
+		}
+		err = copyWithSCP(context.TODO(), host, *osUser, *keyPath, localPath, remotePath, upload, pushKey)
+	case *bucket != "":
+		progressln("Instance " + instanceID + " has no public IP, staging the transfer through s3://" + *bucket)
+		err = copyWithS3(context.TODO(), s3Client, ssmClient, *bucket, instanceID, localPath, remotePath, upload)
+	default:
+		failCommand("Instance " + instanceID + " has no public IP, supply a staging bucket (--bucket BUCKET)")
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error copying the file:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+
+	printResult("Copied "+*src+" to "+*dst, *dst)
+}
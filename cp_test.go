@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeS3 keeps objects in memory. The instance's side of a download is
+// played by remote: presigning a PUT stores it, as the instance's upload
+// would.
+type fakeS3 struct {
+	objects map[string][]byte
+	deleted []string
+	remote  []byte
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, bucket, key string, body io.Reader, size int64) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	f.objects[bucket+"/"+key] = data
+	return nil
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, int64, error) {
+	data := f.objects[bucket+"/"+key]
+	return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+func (f *fakeS3) DeleteObject(ctx context.Context, bucket, key string) error {
+	f.deleted = append(f.deleted, bucket+"/"+key)
+	return nil
+}
+
+func (f *fakeS3) PresignObject(ctx context.Context, method, bucket, key string, expires time.Duration) (string, error) {
+	if method == "PUT" {
+		f.objects[bucket+"/"+key] = f.remote
+	}
+	return "https://" + bucket + ".s3.amazonaws.com/" + key + "?method=" + method, nil
+}
+
+func TestSplitRemotePath(t *testing.T) {
+	for _, tc := range []struct {
+		arg, instanceID, remotePath string
+		ok                          bool
+	}{
+		{"i-0123:/etc/hosts", "i-0123", "/etc/hosts", true},
+		{"i-0123:relative/file", "i-0123", "relative/file", true},
+		{"i-0123:C:/odd", "i-0123", "C:/odd", true},
+		{"i-0123", "i-0123", "", false},
+		{"./i-0123:file", "", "", false},
+		{"/tmp/file", "", "", false},
+	} {
+		instanceID, remotePath, ok := splitRemotePath(tc.arg)
+		if instanceID != tc.instanceID || remotePath != tc.remotePath || ok != tc.ok {
+			t.Errorf("splitRemotePath(%q) = %q, %q, %v", tc.arg, instanceID, remotePath, ok)
+		}
+	}
+}
+
+func TestCopyWithS3(t *testing.T) {
+	defer func(interval time.Duration) { commandPollInterval = interval }(commandPollInterval)
+	commandPollInterval = time.Millisecond
+	dir := t.TempDir()
+	local := filepath.Join(dir, "app.tar")
+	if err := os.WriteFile(local, []byte("archive"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s3 := &fakeS3{objects: map[string][]byte{}}
+	ssm := &fakeDrainSSM{}
+	if err := copyWithS3(context.Background(), s3, ssm, "staging", "i-0123", local, "/opt/app's.tar", true); err != nil {
+		t.Fatal(err)
+	}
+	if len(s3.objects) != 1 || len(s3.deleted) != 1 {
+		t.Fatalf("objects %v, deleted %v", s3.objects, s3.deleted)
+	}
+	key := s3.deleted[0]
+	if !strings.HasPrefix(key, "staging/aws-vmcreate/cp/i-0123/") || !strings.HasSuffix(key, "/app's.tar") || string(s3.objects[key]) != "archive" {
+		t.Errorf("staged %q: %q", key, s3.objects[key])
+	}
+	url := "https://staging.s3.amazonaws.com/" + strings.TrimPrefix(key, "staging/") + "?method=GET"
+	want := []string{`curl -fsSL -o '/opt/app'\''s.tar' ` + shellQuote(url)}
+	if len(ssm.sent) != 1 || !reflect.DeepEqual(ssm.sent[0], want) {
+		t.Errorf("sent %q, want %q", ssm.sent, want)
+	}
+
+	// A download has the instance put the file, then fetches it.
+	s3 = &fakeS3{objects: map[string][]byte{}, remote: []byte("log lines")}
+	ssm = &fakeDrainSSM{}
+	downloaded := filepath.Join(dir, "app.log")
+	if err := copyWithS3(context.Background(), s3, ssm, "staging", "i-0123", downloaded, "/var/log/app.log", false); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(downloaded); err != nil || string(data) != "log lines" {
+		t.Errorf("downloaded %q, %v", data, err)
+	}
+	if len(ssm.sent) != 1 || !strings.HasPrefix(ssm.sent[0][0], "curl -fsS -X PUT -T '/var/log/app.log' 'https://staging.s3.amazonaws.com/") || len(s3.deleted) != 1 {
+		t.Errorf("sent %q, deleted %v", ssm.sent, s3.deleted)
+	}
+}
+
+func TestCopyWithSCP(t *testing.T) {
+	args := fakeCommand(t, "scp", 0)
+	pushKey := func(dir string) (string, error) {
+		t.Fatal("pushed a key with one given")
+		return "", nil
+	}
+
+	if err := copyWithSCP(context.Background(), "203.0.113.10", "ec2-user", "/keys/id", "app.tar", "/opt/app.tar", true, pushKey); err != nil {
+		t.Fatal(err)
+	}
+	want := append(sshArgs("/keys/id"), "app.tar", "ec2-user@203.0.113.10:/opt/app.tar")
+	if got := readArgs(t, args); !reflect.DeepEqual(got, want) {
+		t.Errorf("upload scp %q, want %q", got, want)
+	}
+
+	// Without a key, an ephemeral one is pushed and used for a download.
+	var pushed string
+	pushKey = func(dir string) (string, error) {
+		pushed = filepath.Join(dir, "id_rsa")
+		return pushed, nil
+	}
+	if err := copyWithSCP(context.Background(), "203.0.113.10", "ubuntu", "", "app.log", "/var/log/app.log", false, pushKey); err != nil {
+		t.Fatal(err)
+	}
+	want = append(sshArgs(pushed), "ubuntu@203.0.113.10:/var/log/app.log", "app.log")
+	if got := readArgs(t, args); pushed == "" || !reflect.DeepEqual(got, want) {
+		t.Errorf("download scp %q, want %q", got, want)
+	}
+
+	fakeCommand(t, "scp", 1)
+	if err := copyWithSCP(context.Background(), "203.0.113.10", "ec2-user", "/keys/id", "app.tar", "/opt/app.tar", true, pushKey); err == nil {
+		t.Error("a failed scp did not fail the copy")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// runIDTag tags the instances a create launches with its run, so that a
+// resumed run finds the instances of a launch it was interrupted before
+// recording. Everything else an invocation makes is tagged with its run
+// too, for cleanup --run-id.
+const runIDTag = "aws-vmcreate:run-id"
+
+// The steps after launch a create records for each instance once they are
+// done, so that a resumed run skips them.
+const (
+	stepSourceDestCheck = "source-dest-check"
+	stepDNS             = "dns"
+	stepProvision       = "provision"
+	stepHealthCheck     = "health-check"
+	stepTargetGroup     = "target-group"
+)
+
+// CreateRun is the progress of a create. It is kept in the state store
+// until the create succeeds or is rolled back, so that an interrupted
+// create can be resumed with create --resume RUN_ID instead of starting
+// over.
+type CreateRun struct {
+	ID       string         `json:"id"`
+	TagKey   string         `json:"tag_key"`
+	TagValue string         `json:"tag_value"`
+	Options  *CreateOptions `json:"options"`
+	Started  time.Time      `json:"started"`
+	// Region and InstanceIDs are recorded once the instances are launched.
+	Region      string   `json:"region,omitempty"`
+	InstanceIDs []string `json:"instance_ids,omitempty"`
+	// Steps are the steps done on each instance, by ID.
+	Steps map[string][]string `json:"steps,omitempty"`
+	// Created is what the run has made, for the rollback of a resumed run.
+	Created createdResources `json:"created"`
+}
+
+// newRunID returns a new run ID, sorting by the time it was made.
+func newRunID(now time.Time) string {
+	var suffix [3]byte
+	rand.Read(suffix[:])
+	return now.Format("20060102-150405-") + hex.EncodeToString(suffix[:])
+}
+
+// newCreateRun starts the run of a create.
+func newCreateRun(tagKey, tagValue string, opts *CreateOptions) *CreateRun {
+	now := time.Now().UTC()
+	return &CreateRun{
+		ID:       newRunID(now),
+		TagKey:   tagKey,
+		TagValue: tagValue,
+		Options:  opts,
+		Started:  now,
+	}
+}
+
+// done reports whether the step was done on the instance.
+func (r *CreateRun) done(instanceID, step string) bool {
+	for _, s := range r.Steps[instanceID] {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// complete records the step as done on the instance.
+func (r *CreateRun) complete(c context.Context, instanceID, step string) {
+	if r.Steps == nil {
+		r.Steps = map[string][]string{}
+	}
+	r.Steps[instanceID] = append(r.Steps[instanceID], step)
+	saveRun(c, r)
+}
+
+// launched records the instances the run launched in region.
+func (r *CreateRun) launched(c context.Context, instances []types.Instance, region string) {
+	r.Region = region
+	for _, i := range instances {
+		r.InstanceIDs = append(r.InstanceIDs, aws.ToString(i.InstanceId))
+	}
+	r.Created.InstanceIDs = r.InstanceIDs
+	saveRun(c, r)
+}
+
+// saveRun writes the run to the state store. Like the lifecycle, the
+// progress is a record of the create, so failures are only reported: the
+// create goes on but can no longer be resumed.
+func saveRun(c context.Context, run *CreateRun) {
+	err := updateState(c, stateStore, func(state *State) error {
+		if state.Runs == nil {
+			state.Runs = map[string]*CreateRun{}
+		}
+		state.Runs[run.ID] = run
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error recording the progress of the create, it cannot be resumed:")
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// finishRun removes the run from the state store once there is nothing
+// left to resume.
+func finishRun(c context.Context, run *CreateRun) {
+	err := updateState(c, stateStore, func(state *State) error {
+		delete(state.Runs, run.ID)
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error removing the create run "+run.ID+" from the state:")
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// loadRun returns the run of the state store with the ID.
+func loadRun(c context.Context, id string) (*CreateRun, error) {
+	state, err := stateStore.Load(c)
+	if err != nil {
+		return nil, err
+	}
+	run := state.Runs[id]
+	if run == nil {
+		return nil, fmt.Errorf("no create run %s is in the state, it finished or was rolled back", id)
+	}
+	return run, nil
+}
+
+// resumeCreate goes on with an interrupted create from the first step it
+// did not finish. A run that did not record its launch looks for the
+// instances tagged with its ID, and launches them again when there are
+// none.
+func resumeCreate(run *CreateRun) {
+	c := commandContext
+	invocationRunID = run.ID
+	progressln("Resuming create run " + run.ID + " of " + run.TagKey + "=" + run.TagValue)
+	if len(run.InstanceIDs) == 0 {
+		instances, err := provisioner.List(c, vmcreate.TagFilter(runIDTag, run.ID), vmcreate.StateFilter("pending", "running"))
+		if err != nil {
+			commandErr = err
+			fmt.Fprintln(os.Stderr, "Got an error looking for the instances of the run:")
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		if len(instances) == 0 {
+			progressln("The run launched no instances, launching them")
+			CreateInstancesCmd(&run.TagKey, &run.TagValue, run.Options, run)
+			return
+		}
+		run.launched(context.TODO(), instances, awsConfig.Region)
+	}
+	// A create that failed over has its instances in another region.
+	if run.Region != awsConfig.Region {
+		cfg := awsConfig.Copy()
+		cfg.Region = run.Region
+		newClients(cfg)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		exit(1)
+	}
+	config.SubnetId = firstNonEmpty(run.Options.SubnetID, config.SubnetId)
+	instances, err := provisioner.List(c, vmcreate.InstanceIDFilter(run.InstanceIDs...))
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error looking up the instances of the run:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	fail := func(err error) {
+		event := &Event{Command: "create", Status: "failure", TagKey: run.TagKey, TagValue: run.TagValue, Error: err.Error(), InstanceIDs: run.InstanceIDs}
+		notify(context.TODO(), config.Notifications, event)
+		failCreate(run)
+	}
+	afterLaunch(instances, run.Region, config, run, newStepTimer(), fail)
+}
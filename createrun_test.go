@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// putRun stores run in the state as an interrupted create left it.
+func putRun(t *testing.T, run *CreateRun) {
+	t.Helper()
+	err := updateState(context.Background(), stateStore, func(state *State) error {
+		state.Runs = map[string]*CreateRun{run.ID: run}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func loadState(t *testing.T) *State {
+	t.Helper()
+	state, err := stateStore.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestCreateFinishesItsRun(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1"})
+
+	out := runCLI(t, "create", "--tag", "Name=web-1")
+	i := fake.Instances()[0]
+	runID := vmcreate.TagValue(&i, runIDTag)
+	if runID == "" || !strings.Contains(out, "Starting create run "+runID) {
+		t.Fatalf("run %q, create printed %q", runID, out)
+	}
+	if runs := loadState(t).Runs; len(runs) != 0 {
+		t.Errorf("the finished run was kept: %+v", runs)
+	}
+}
+
+func TestResumeCreate(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1"})
+	id := fake.AddInstance(types.Instance{Tags: []types.Tag{{Key: aws.String("Name"), Value: aws.String("nat-1")}}})
+	run := &CreateRun{
+		ID:          "20261014-120000-abcdef",
+		TagKey:      "Name",
+		TagValue:    "nat-1",
+		Options:     &CreateOptions{NoSourceDestCheck: true},
+		Region:      awsConfig.Region,
+		InstanceIDs: []string{id},
+		Created:     createdResources{InstanceIDs: []string{id}},
+	}
+	putRun(t, run)
+
+	runCLI(t, "create", "--resume", run.ID)
+	if countCalls(fake.Calls(), "ModifyInstanceAttribute") != 1 {
+		t.Errorf("calls = %v", fake.Calls())
+	}
+	if fake.Instance(id).SourceDestCheck == nil || *fake.Instance(id).SourceDestCheck {
+		t.Error("the source/destination check is still on")
+	}
+	state := loadState(t)
+	if len(state.Runs) != 0 {
+		t.Errorf("the resumed run was kept: %+v", state.Runs)
+	}
+	if m := state.Instances[id]; m == nil || m.Phase != phaseReady {
+		t.Errorf("state of %s = %+v", id, m)
+	}
+	if n := len(liveInstances(fake)); n != 1 {
+		t.Errorf("%d instances, the resume launched again", n)
+	}
+}
+
+func TestResumeCreateSkipsDoneSteps(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1"})
+	id := fake.AddInstance(types.Instance{})
+	putRun(t, &CreateRun{
+		ID:          "20261014-120000-abcdef",
+		TagKey:      "Name",
+		TagValue:    "nat-1",
+		Options:     &CreateOptions{NoSourceDestCheck: true},
+		Region:      awsConfig.Region,
+		InstanceIDs: []string{id},
+		Steps:       map[string][]string{id: {stepSourceDestCheck}},
+	})
+
+	runCLI(t, "create", "--resume", "20261014-120000-abcdef")
+	if countCalls(fake.Calls(), "ModifyInstanceAttribute") != 0 {
+		t.Errorf("a done step ran again: %v", fake.Calls())
+	}
+}
+
+func TestResumeCreateFindsUnrecordedLaunch(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1"})
+	// The create was interrupted between the launch and its record.
+	id := fake.AddInstance(types.Instance{Tags: []types.Tag{{Key: aws.String(runIDTag), Value: aws.String("20261014-120000-abcdef")}}})
+	putRun(t, &CreateRun{ID: "20261014-120000-abcdef", TagKey: "Name", TagValue: "web-1", Options: &CreateOptions{}})
+
+	runCLI(t, "create", "--resume", "20261014-120000-abcdef")
+	if n := len(liveInstances(fake)); n != 1 {
+		t.Errorf("%d instances, want the one already launched", n)
+	}
+	if m := loadState(t).Instances[id]; m == nil || m.Phase != phaseReady {
+		t.Errorf("state of %s = %+v", id, m)
+	}
+}
+
+func TestResumeUnknownRun(t *testing.T) {
+	useFakeEC2(t)
+	useConfig(t, ConfigMap{})
+	if out := runCLI(t, "create", "--resume", "nope"); !strings.Contains(out, "no create run nope") {
+		t.Errorf("resume printed %q", out)
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"aws-vmcreate/internal/metrics"
+	"aws-vmcreate/internal/telemetry"
+	"aws-vmcreate/internal/yaml"
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// groupTag identifies the desired-state group an instance belongs to.
+const groupTag = "aws-vmcreate:group"
+
+// DesiredState is the fleet the daemon keeps running, read from a YAML or
+// JSON file.
+type DesiredState struct {
+	Groups []DesiredGroup `json:"groups"`
+	// SGSyncs are the security group rules kept in line with the instances
+	// they allow in, as sg sync makes them.
+	SGSyncs []SGSync `json:"sg_syncs,omitempty"`
+	// Config is data/config.json, whose checks launches go through.
+	Config ConfigMap `json:"-"`
+}
+
+// DesiredGroup is a set of identical instances.
+type DesiredGroup struct {
+	Name         string            `json:"name"`
+	Count        int               `json:"count"`
+	InstanceType string            `json:"instance_type"`
+	ImageId      string            `json:"image_id"`
+	SubnetId     string            `json:"subnet_id,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+	// Zones, when set, pin the instances to availability zones, and count
+	// is their total. The daemon launches the instances a zone is missing
+	// there, as after a zone failure, and terminates the extra ones.
+	Zones []ZoneCount `json:"zones,omitempty"`
+	// DNSZone, DNSName and DNSPublicIP are the record of each instance, as
+	// create registers it, that moves to the instance replacing it.
+	DNSZone     string `json:"dns_zone,omitempty"`
+	DNSName     string `json:"dns_name,omitempty"`
+	DNSPublicIP bool   `json:"dns_public_ip,omitempty"`
+}
+
+// loadDesiredState reads and validates a desired-state file.
+func loadDesiredState(path string) (*DesiredState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &DesiredState{}
+	if filepath.Ext(path) == ".json" {
+		err = json.Unmarshal(data, state)
+	} else {
+		err = yaml.Unmarshal(data, state)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	seen := map[string]bool{}
+	for i, g := range state.Groups {
+		switch {
+		case g.Name == "":
+			return nil, fmt.Errorf("%s: group %d has no name", path, i+1)
+		case seen[g.Name]:
+			return nil, fmt.Errorf("%s: group %s is defined twice", path, g.Name)
+		case g.Count < 0:
+			return nil, fmt.Errorf("%s: group %s has a negative count", path, g.Name)
+		case len(g.Zones) > 0 && g.Count != 0 && g.Count != zoneTotal(g.Zones):
+			return nil, fmt.Errorf("%s: group %s has a count of %d but its zones add up to %d", path, g.Name, g.Count, zoneTotal(g.Zones))
+		}
+		for _, z := range g.Zones {
+			if err := z.validate(); err != nil {
+				return nil, fmt.Errorf("%s: group %s: %w", path, g.Name, err)
+			}
+		}
+		if len(g.Zones) > 0 {
+			g.Count = zoneTotal(g.Zones)
+			state.Groups[i].Count = g.Count
+		}
+		if g.Count > 0 && (g.InstanceType == "" || g.ImageId == "") {
+			return nil, fmt.Errorf("%s: group %s needs instance_type and image_id", path, g.Name)
+		}
+		seen[g.Name] = true
+	}
+	for i, sync := range state.SGSyncs {
+		if _, err := sync.parse(); err != nil {
+			return nil, fmt.Errorf("%s: sg sync %d: %w", path, i+1, err)
+		}
+	}
+	return state, nil
+}
+
+// groupInstances returns the live instances of each group, oldest first.
+func groupInstances(c context.Context) (map[string][]types.Instance, error) {
+	instances, err := provisioner.List(c, vmcreate.TagKeyFilter(groupTag), vmcreate.StateFilter(vmcreate.LiveStates...))
+	if err != nil {
+		return nil, err
+	}
+
+	groups := map[string][]types.Instance{}
+	for _, i := range instances {
+		name := vmcreate.TagValue(&i, groupTag)
+		groups[name] = append(groups[name], i)
+	}
+	return groups, nil
+}
+
+// reconcileGroup launches missing instances, terminates extra ones and
+// restores drifted tags. The extras are those already draining, then those
+// not yet ready, then the newest, by the lifecycle of the state. A group
+// with zones is reconciled zone by zone, and instances outside its zones
+// are extra.
+func reconcileGroup(c context.Context, g DesiredGroup, instances []types.Instance, config ConfigMap, dryRun bool) error {
+	want := map[string]string{groupTag: g.Name}
+	for k, v := range g.Tags {
+		want[k] = v
+	}
+	phases := lifecyclePhases(c)
+	if !dryRun {
+		// The daemon does not bootstrap the instances it launches, so they
+		// are ready once they run.
+		var running []types.Instance
+		for _, i := range instances {
+			if phases[aws.ToString(i.InstanceId)] == phaseLaunching && i.State != nil && i.State.Name == types.InstanceStateNameRunning {
+				running = append(running, i)
+				phases[aws.ToString(i.InstanceId)] = phaseReady
+			}
+		}
+		recordLifecycle(c, "daemon", running, "", phaseReady, "running")
+	}
+
+	kept := keepFirst(instances, phases)
+	var missing []ZoneCount
+	var extra []types.Instance
+	switch {
+	case len(g.Zones) > 0:
+		missing, extra = planZones(g.Zones, kept)
+	case len(kept) < g.Count:
+		missing = []ZoneCount{{SubnetId: g.SubnetId, Count: g.Count - len(kept)}}
+	case len(kept) > g.Count:
+		extra = kept[g.Count:]
+	}
+
+	var launchErrs []error
+	// The launches are tagged as the checks before them leave the tags, and
+	// want stays what the kept instances are compared with.
+	tags := map[string]string{}
+	for k, v := range want {
+		tags[k] = v
+	}
+	if total := zoneTotal(missing); total > 0 {
+		launch := &launchPlan{
+			Command:      "daemon",
+			TagKey:       groupTag,
+			TagValue:     g.Name,
+			InstanceType: g.InstanceType,
+			ImageID:      g.ImageId,
+			Count:        total,
+			Tags:         tags,
+		}
+		var err error
+		if dryRun {
+			// A dry run launches nothing, so it waits for no approval.
+			err = checkInstanceLimits(c, config.InstanceLimits, groupTag, g.Name, total)
+		} else {
+			err = beforeLaunch(c, config, launch)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, z := range missing {
+		if len(g.Zones) > 0 {
+			progressln(fmt.Sprintf("[%s] launching %d instances in %s", g.Name, z.Count, z))
+		} else {
+			progressln(fmt.Sprintf("[%s] launching %d instances", g.Name, z.Count))
+		}
+		if dryRun {
+			continue
+		}
+		in := &vmcreate.CreateInput{
+			Tags:         withProvenance(c, tags, hashConfig(g)),
+			Count:        z.Count,
+			InstanceType: g.InstanceType,
+			ImageID:      g.ImageId,
+			SubnetID:     z.SubnetId,
+		}
+		if zone := z.Zone; zone != "" {
+			in.Customize = func(input *ec2.RunInstancesInput) {
+				input.Placement = &types.Placement{AvailabilityZone: aws.String(zone)}
+			}
+		}
+		launched, err := provisioner.Create(c, in)
+		if err != nil {
+			// A zone short of capacity does not hold up the others, and is
+			// launched into again on the next reconcile.
+			launchErrs = append(launchErrs, fmt.Errorf("launching in %s: %w", z, err))
+			continue
+		}
+		recordLifecycle(c, "daemon", launched, awsConfig.Region, phaseLaunching, "group "+g.Name)
+		countAction(g.Name, "launch", len(launched))
+		for _, i := range launched {
+			progressln(fmt.Sprintf("[%s] launched %s", g.Name, aws.ToString(i.InstanceId)))
+		}
+		postCreateHooks(c, config, groupTag, g.Name, launched)
+	}
+
+	ids := instanceIDs(extra)
+	if len(extra) > 0 {
+		progressln(fmt.Sprintf("[%s] terminating %v", g.Name, ids))
+		if !dryRun {
+			if _, err := provisioner.Delete(c, ids); err != nil {
+				return err
+			}
+			recordLifecycle(c, "daemon", extra, "", phaseTerminated, "group "+g.Name+" scaled in")
+			countAction(g.Name, "terminate", len(ids))
+		}
+	}
+
+	for _, i := range kept {
+		if contains(ids, aws.ToString(i.InstanceId)) {
+			continue
+		}
+		drifted := map[string]string{}
+		for k, v := range want {
+			if vmcreate.TagValue(&i, k) != v {
+				drifted[k] = v
+			}
+		}
+		if len(drifted) == 0 {
+			continue
+		}
+		progressln(fmt.Sprintf("[%s] restoring %d drifted tags on %s", g.Name, len(drifted), aws.ToString(i.InstanceId)))
+		if dryRun {
+			continue
+		}
+		if err := provisioner.Tag(c, []string{aws.ToString(i.InstanceId)}, drifted); err != nil {
+			return err
+		}
+		countAction(g.Name, "retag", 1)
+	}
+	if len(launchErrs) > 1 {
+		return fmt.Errorf("%d zones failed to launch, first error: %w", len(launchErrs), launchErrs[0])
+	}
+	if len(launchErrs) > 0 {
+		return launchErrs[0]
+	}
+	return nil
+}
+
+// lifecyclePhases returns the phase of each instance of the state store,
+// empty when it cannot be loaded.
+func lifecyclePhases(c context.Context) map[string]lifecyclePhase {
+	phases := map[string]lifecyclePhase{}
+	state, err := stateStore.Load(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error loading the state, the lifecycle of the instances is not known:")
+		fmt.Fprintln(os.Stderr, err)
+		return phases
+	}
+	for id, m := range state.Instances {
+		phases[id] = m.Phase
+	}
+	return phases
+}
+
+// keepFirst orders the instances, oldest first, by how much they are worth
+// keeping: ready ones, and those the state does not know, before those
+// still launching or bootstrapping, before those already draining.
+func keepFirst(instances []types.Instance, phases map[string]lifecyclePhase) []types.Instance {
+	rank := func(i types.Instance) int {
+		switch phases[aws.ToString(i.InstanceId)] {
+		case phaseDraining:
+			return 2
+		case phaseRequested, phaseLaunching, phaseBootstrapping:
+			return 1
+		}
+		return 0
+	}
+	sorted := append([]types.Instance(nil), instances...)
+	sort.SliceStable(sorted, func(a, b int) bool { return rank(sorted[a]) < rank(sorted[b]) })
+	return sorted
+}
+
+// reconcile brings the fleet in line with state. Groups that are no longer
+// in the file are only terminated when prune is set.
+func reconcile(c context.Context, state *DesiredState, prune bool, dryRun bool) error {
+	live, err := groupInstances(c)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, g := range state.Groups {
+		if err := reconcileLocked(c, g, live[g.Name], state.Config, dryRun); err != nil {
+			metricsRegistry.Add("vmcreate_reconcile_errors_total", metrics.Labels{"group": g.Name}, 1)
+			errs = append(errs, fmt.Errorf("group %s: %w", g.Name, err))
+		}
+		delete(live, g.Name)
+	}
+
+	if prune {
+		for name, instances := range live {
+			if err := reconcileLocked(c, DesiredGroup{Name: name}, instances, state.Config, dryRun); err != nil {
+				metricsRegistry.Add("vmcreate_reconcile_errors_total", metrics.Labels{"group": name}, 1)
+				errs = append(errs, fmt.Errorf("group %s: %w", name, err))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%d groups failed to reconcile, first error: %w", len(errs), errs[0])
+	}
+	return nil
+}
+
+// reconcileLocked reconciles the group while holding its fleet lock, so that
+// a pipeline changing the group at the same time does not race the daemon.
+// Dry runs change nothing and take no lock.
+func reconcileLocked(c context.Context, g DesiredGroup, instances []types.Instance, config ConfigMap, dryRun bool) error {
+	if dryRun {
+		return reconcileGroup(c, g, instances, config, dryRun)
+	}
+	key := groupTag + "=" + g.Name
+	if err := acquireFleetLock(c, key); err != nil {
+		return err
+	}
+	defer releaseFleetLock(c, key)
+	return reconcileGroup(c, g, instances, config, dryRun)
+}
+
+// countAction counts n instances changed by a reconcile.
+func countAction(group string, action string, n int) {
+	metricsRegistry.Add("vmcreate_reconcile_actions_total", metrics.Labels{"group": group, "action": action}, float64(n))
+}
+
+func DaemonCmd(desiredStatePath *string, interval *time.Duration, prune *bool, dryRun *bool, metricsListen *string, replaceAfter *time.Duration) {
+	// The config is optional for the daemon, it only adds notifications and
+	// the checks before launches.
+	config, err := loadConfig()
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		commandErr = err
+		return
+	}
+
+	c, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *metricsListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metricsRegistry)
+		server := &http.Server{Addr: *metricsListen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			<-c.Done()
+			server.Close()
+		}()
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fmt.Fprintln(os.Stderr, "Got an error serving the metrics:")
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}()
+		progressln("Serving metrics on " + *metricsListen + "/metrics")
+	}
+
+	var state *DesiredState
+	var modTime time.Time
+	nextReconcile := time.Now()
+
+	progressln("Reconciling the fleet against " + *desiredStatePath + " every " + interval.String())
+	if *replaceAfter > 0 {
+		progressln("Replacing instances whose status checks have failed for " + replaceAfter.String())
+	}
+	for {
+		// The file is polled for changes, which trigger an immediate reconcile.
+		if info, err := os.Stat(*desiredStatePath); err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error reading the desired state:")
+			fmt.Fprintln(os.Stderr, err)
+		} else if !info.ModTime().Equal(modTime) {
+			loaded, err := loadDesiredState(*desiredStatePath)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Got an error loading the desired state, keeping the previous one:")
+				fmt.Fprintln(os.Stderr, err)
+			} else {
+				if state != nil {
+					progressln("Desired state changed, reconciling")
+				}
+				loaded.Config = config
+				state = loaded
+				nextReconcile = time.Now()
+			}
+			modTime = info.ModTime()
+		}
+
+		if state != nil && !time.Now().Before(nextReconcile) {
+			rc, span := telemetry.Start(c, "reconcile", telemetry.KindInternal, telemetry.Bool("dry_run", *dryRun))
+			if *replaceAfter > 0 {
+				// Replacements go first, so that the reconcile sees the group as it is afterwards.
+				if err := replaceUnhealthy(rc, client, route53Client, state, *replaceAfter, *dryRun, config.Notifications); err != nil {
+					fmt.Fprintln(os.Stderr, "Got an error replacing the unhealthy instances:")
+					fmt.Fprintln(os.Stderr, err)
+				}
+			}
+			err := reconcile(rc, state, *prune, *dryRun)
+			span.End(err)
+			metricsRegistry.Add("vmcreate_reconcile_runs_total", nil, 1)
+			if err != nil {
+				telemetry.Count("vmcreate.reconcile.errors", 1)
+				fmt.Fprintln(os.Stderr, "Got an error reconciling the fleet:")
+				fmt.Fprintln(os.Stderr, err)
+			}
+			// The rules follow the instances the reconcile launched and terminated.
+			for _, sync := range state.SGSyncs {
+				changes, err := syncSecurityGroups(rc, client, sync, config.SecurityGroupIds, *dryRun)
+				for _, change := range changes {
+					progressln(change)
+				}
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "Got an error syncing the security groups of "+sync.Tag+":")
+					fmt.Fprintln(os.Stderr, err)
+				}
+			}
+			flushTelemetry()
+			nextReconcile = time.Now().Add(*interval)
+		}
+
+		select {
+		case <-c.Done():
+			progressln("Stopping the daemon")
+			return
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
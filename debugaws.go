@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// debugOutput receives the --debug-aws log, one line per API call.
+var debugOutput io.Writer = os.Stderr
+
+// sensitiveParams are the substrings of parameter names whose values are
+// never logged.
+var sensitiveParams = []string{"password", "secret", "token", "userdata", "keymaterial", "privatekey"}
+
+// addDebugLogging logs every call made by the SDK clients: the operation, its
+// parameters, the latency, the request id and any retried attempts.
+func addDebugLogging(stack *middleware.Stack) error {
+	// After, so that the service metadata naming the operation is set.
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("DebugAWS", func(
+		c context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+	) (middleware.InitializeOutput, middleware.Metadata, error) {
+		start := time.Now()
+		out, metadata, err := next.HandleInitialize(c, in)
+		logAWSCall(c, in.Parameters, time.Since(start), metadata, err)
+		return out, metadata, err
+	}), middleware.After)
+}
+
+func logAWSCall(c context.Context, params interface{}, latency time.Duration, metadata middleware.Metadata, err error) {
+	line := fmt.Sprintf("[aws] %s.%s %s", awsmiddleware.GetServiceID(c), awsmiddleware.GetOperationName(c), latency.Round(time.Millisecond))
+	if id, ok := awsmiddleware.GetRequestIDMetadata(metadata); ok {
+		line += " request-id=" + id
+	}
+	if attempts, ok := retry.GetAttemptResults(metadata); ok {
+		line += fmt.Sprintf(" attempts=%d", len(attempts.Results))
+		var retried []string
+		for _, a := range attempts.Results {
+			if a.Retried && a.Err != nil {
+				retried = append(retried, a.Err.Error())
+			}
+		}
+		if len(retried) > 0 {
+			line += " retried=[" + strings.Join(retried, "; ") + "]"
+		}
+	}
+	line += " params=" + redactParams(params)
+	if err != nil {
+		line += " error=" + err.Error()
+	}
+	fmt.Fprintln(debugOutput, line)
+}
+
+// redactParams renders the operation input as JSON, without empty fields and
+// with the values of sensitive ones replaced.
+func redactParams(params interface{}) string {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Sprintf("<%v>", err)
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return fmt.Sprintf("<%v>", err)
+	}
+	data, _ = json.Marshal(redactValue(v))
+	return string(data)
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			if list, ok := value.([]interface{}); value == nil || value == "" || ok && len(list) == 0 {
+				delete(v, k)
+			} else if sensitiveParam(k) {
+				v[k] = "REDACTED"
+			} else {
+				v[k] = redactValue(value)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+	}
+	return v
+}
+
+func sensitiveParam(name string) bool {
+	// Pagination and idempotency tokens are safe and useful to see.
+	if name == "NextToken" || name == "ClientToken" {
+		return false
+	}
+	name = strings.ToLower(name)
+	for _, s := range sensitiveParams {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
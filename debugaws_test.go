@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/smithy-go/middleware"
+)
+
+func TestDebugAWSLogging(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("X-Amzn-Requestid", fmt.Sprintf("req-%d", calls))
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `<Response><Errors><Error><Code>RequestLimitExceeded</Code><Message>slow down</Message></Error></Errors><RequestID>req-1</RequestID></Response>`)
+			return
+		}
+		fmt.Fprint(w, `<RunInstancesResponse><requestId>req-2</requestId></RunInstancesResponse>`)
+	}))
+	defer server.Close()
+
+	var log bytes.Buffer
+	previous := debugOutput
+	debugOutput = &log
+	defer func() { debugOutput = previous }()
+
+	cfg := awsConfig.Copy()
+	cfg.Region = "us-east-1"
+	cfg.Credentials = aws.AnonymousCredentials{}
+	cfg.EndpointResolverWithOptions = endpointResolver(server.URL, nil)
+	cfg.APIOptions = []func(*middleware.Stack) error{addDebugLogging}
+	_, err := ec2.NewFromConfig(cfg).RunInstances(context.TODO(), &ec2.RunInstancesInput{
+		ImageId:  aws.String("ami-0123"),
+		MinCount: aws.Int32(1),
+		MaxCount: aws.Int32(1),
+		UserData: aws.String("c2VjcmV0"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := log.String()
+	for _, want := range []string{"[aws] EC2.RunInstances", "request-id=req-2", "attempts=2", "RequestLimitExceeded", `"ImageId":"ami-0123"`, `"UserData":"REDACTED"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log is missing %s:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "c2VjcmV0") || strings.Contains(out, `"InstanceType"`) {
+		t.Errorf("log has secrets or empty fields:\n%s", out)
+	}
+}
+
+func TestDebugAWSLoggingOfOtherServices(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amzn-RequestId", "req-1")
+		fmt.Fprint(w, `{"Parameter": {"Value": "v"}}`)
+	}))
+	defer server.Close()
+
+	var log bytes.Buffer
+	previous := debugOutput
+	debugOutput = &log
+	defer func() { debugOutput = previous }()
+
+	cfg := awsConfig.Copy()
+	cfg.Region = "us-east-1"
+	cfg.Credentials = credentials.NewStaticCredentialsProvider("AKID", "secret", "")
+	cfg.EndpointResolverWithOptions = endpointResolver(server.URL, nil)
+	cfg.APIOptions = []func(*middleware.Stack) error{addDebugLogging}
+	if _, err := awsapi.NewSSM(cfg).GetParameter(context.TODO(), &awsapi.GetParameterInput{Name: "/app/token"}); err != nil {
+		t.Fatal(err)
+	}
+
+	out := log.String()
+	for _, want := range []string{"[aws] SSM.GetParameter", "request-id=req-1", "attempts=1", `"Name":"/app/token"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log is missing %s:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// debugCloneTag names the instance a debug clone, and its image and
+// snapshots, were made from.
+const debugCloneTag = "aws-vmcreate:debug-clone-of"
+
+// debugCloneTimeout is how long debug-clone waits for the snapshots of the
+// image to complete.
+var debugCloneTimeout = 30 * time.Minute
+
+// QuarantineAPI defines the interface for the functions quarantine security groups are made with.
+// We use this interface to test the functions using a mocked service.
+type QuarantineAPI interface {
+	CreateSecurityGroup(ctx context.Context,
+		params *ec2.CreateSecurityGroupInput,
+		optFns ...func(*ec2.Options)) (*ec2.CreateSecurityGroupOutput, error)
+
+	RevokeSecurityGroupEgress(ctx context.Context,
+		params *ec2.RevokeSecurityGroupEgressInput,
+		optFns ...func(*ec2.Options)) (*ec2.RevokeSecurityGroupEgressOutput, error)
+
+	AuthorizeSecurityGroupIngress(ctx context.Context,
+		params *ec2.AuthorizeSecurityGroupIngressInput,
+		optFns ...func(*ec2.Options)) (*ec2.AuthorizeSecurityGroupIngressOutput, error)
+}
+
+// DebugCloneAPI defines the interface for the functions debug-clone uses.
+// We use this interface to test the functions using a mocked service.
+type DebugCloneAPI interface {
+	QuarantineAPI
+	ec2.DescribeImagesAPIClient
+
+	CreateImage(ctx context.Context,
+		params *ec2.CreateImageInput,
+		optFns ...func(*ec2.Options)) (*ec2.CreateImageOutput, error)
+}
+
+// createQuarantineGroup makes a security group in the VPC that allows no
+// traffic at all, not even the egress new groups allow by default, except
+// SSH from allowCIDR when it is set.
+func createQuarantineGroup(c context.Context, api QuarantineAPI, vpcID string, name string, tags map[string]string, allowCIDR string) (string, error) {
+	group, err := api.CreateSecurityGroup(c, &ec2.CreateSecurityGroupInput{
+		GroupName:         aws.String(name),
+		Description:       aws.String("aws-vmcreate quarantine, allows no traffic"),
+		VpcId:             aws.String(vpcID),
+		TagSpecifications: tagSpecification(types.ResourceTypeSecurityGroup, tags, name),
+	})
+	if err != nil {
+		return "", fmt.Errorf("creating the quarantine security group: %w", err)
+	}
+	groupID := aws.ToString(group.GroupId)
+
+	_, err = api.RevokeSecurityGroupEgress(c, &ec2.RevokeSecurityGroupEgressInput{
+		GroupId: aws.String(groupID),
+		IpPermissions: []types.IpPermission{{
+			IpProtocol: aws.String("-1"),
+			IpRanges:   []types.IpRange{{CidrIp: aws.String("0.0.0.0/0")}},
+		}},
+	})
+	if err != nil {
+		return groupID, fmt.Errorf("removing the egress of %s: %w", groupID, err)
+	}
+
+	if allowCIDR != "" {
+		_, err = api.AuthorizeSecurityGroupIngress(c, &ec2.AuthorizeSecurityGroupIngressInput{
+			GroupId: aws.String(groupID),
+			IpPermissions: []types.IpPermission{{
+				IpProtocol: aws.String("tcp"),
+				FromPort:   aws.Int32(22),
+				ToPort:     aws.Int32(22),
+				IpRanges:   []types.IpRange{{CidrIp: aws.String(allowCIDR), Description: aws.String("aws-vmcreate quarantine access")}},
+			}},
+		})
+		if err != nil {
+			return groupID, fmt.Errorf("allowing SSH from %s: %w", allowCIDR, err)
+		}
+	}
+	return groupID, nil
+}
+
+// debugClone is what debug-clone made.
+type debugClone struct {
+	ImageID         string
+	SnapshotIDs     []string
+	SecurityGroupID string
+	Instance        *types.Instance
+}
+
+// cloneForDebugging snapshots the volumes of the instance into an image,
+// without rebooting it, and launches a copy of it in a quarantine security
+// group of its own, once the checks of config allow it. The copy gets no
+// instance profile, so that it cannot act with the original's permissions,
+// and no public IP. What was made is returned even when it fails.
+func cloneForDebugging(c context.Context, api DebugCloneAPI, config ConfigMap, instanceID string, instanceType string, keyName string, allowCIDR string) (*debugClone, error) {
+	clone := &debugClone{}
+	original, err := provisioner.Describe(c, instanceID)
+	if err != nil {
+		return clone, err
+	}
+	if aws.ToString(original.VpcId) == "" {
+		return clone, fmt.Errorf("instance %s is not in a VPC", instanceID)
+	}
+
+	stamp := time.Now().UTC().Format("20060102-150405")
+	name := "debug-clone-" + instanceID + "-" + stamp
+	tags := resourceTags(c, original, map[string]string{debugCloneTag: instanceID})
+	launchTags := map[string]string{"Name": name}
+	for k, v := range tags {
+		launchTags[k] = v
+	}
+	// The checks go first, so that a refused clone leaves no image behind.
+	launch := &launchPlan{
+		Command:      "debug-clone",
+		TagKey:       debugCloneTag,
+		TagValue:     instanceID,
+		InstanceType: firstNonEmpty(instanceType, string(original.InstanceType)),
+		ImageID:      aws.ToString(original.ImageId),
+		Count:        1,
+		Tags:         launchTags,
+	}
+	if err := beforeLaunch(c, config, launch); err != nil {
+		return clone, fmt.Errorf("launching the clone: %w", err)
+	}
+
+	image, err := api.CreateImage(c, &ec2.CreateImageInput{
+		InstanceId:  aws.String(instanceID),
+		Name:        aws.String(name),
+		Description: aws.String("aws-vmcreate debug clone of " + instanceID),
+		NoReboot:    aws.Bool(true),
+		TagSpecifications: append(
+			tagSpecification(types.ResourceTypeImage, tags, name),
+			tagSpecification(types.ResourceTypeSnapshot, tags, name)...),
+	})
+	if err != nil {
+		return clone, fmt.Errorf("snapshotting %s: %w", instanceID, err)
+	}
+	clone.ImageID = aws.ToString(image.ImageId)
+	progressln("Snapshotting the volumes of " + instanceID + " into " + clone.ImageID)
+
+	if err := ec2.NewImageAvailableWaiter(api).Wait(c, &ec2.DescribeImagesInput{ImageIds: []string{clone.ImageID}}, boundedWait(debugCloneTimeout)); err != nil {
+		return clone, fmt.Errorf("waiting for %s: %w", clone.ImageID, err)
+	}
+	images, err := api.DescribeImages(c, &ec2.DescribeImagesInput{ImageIds: []string{clone.ImageID}})
+	if err != nil {
+		return clone, err
+	}
+	for _, i := range images.Images {
+		for _, m := range i.BlockDeviceMappings {
+			if m.Ebs != nil && m.Ebs.SnapshotId != nil {
+				clone.SnapshotIDs = append(clone.SnapshotIDs, aws.ToString(m.Ebs.SnapshotId))
+			}
+		}
+	}
+
+	if clone.SecurityGroupID, err = createQuarantineGroup(c, api, aws.ToString(original.VpcId), name, tags, allowCIDR); err != nil {
+		return clone, err
+	}
+
+	launched, err := provisioner.Create(c, &vmcreate.CreateInput{
+		Tags:         launchTags,
+		InstanceType: launch.InstanceType,
+		ImageID:      clone.ImageID,
+		Customize: func(in *ec2.RunInstancesInput) {
+			// The subnet and group go on the interface, so that a subnet
+			// which maps public IPs on launch does not give the clone one.
+			in.NetworkInterfaces = []types.InstanceNetworkInterfaceSpecification{{
+				DeviceIndex:              aws.Int32(0),
+				SubnetId:                 original.SubnetId,
+				Groups:                   []string{clone.SecurityGroupID},
+				AssociatePublicIpAddress: aws.Bool(false),
+			}}
+			in.SubnetId = nil
+			in.SecurityGroupIds = nil
+			in.UserData = nil
+			in.IamInstanceProfile = nil
+			if keyName := firstNonEmpty(keyName, aws.ToString(original.KeyName)); keyName != "" {
+				in.KeyName = aws.String(keyName)
+			}
+		},
+	})
+	if err != nil {
+		return clone, fmt.Errorf("launching the clone: %w", err)
+	}
+	clone.Instance = &launched[0]
+	postCreateHooks(c, config, debugCloneTag, instanceID, launched)
+	return clone, nil
+}
+
+func DebugCloneCmd(instanceID *string, instanceType *string, keyName *string, allowCIDR *string) {
+	// The config is optional for debug-clone, it only adds the checks
+	// before the launch.
+	config, err := loadConfig()
+	if err != nil && !os.IsNotExist(err) {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		return
+	}
+	clone, err := cloneForDebugging(context.TODO(), client, config, *instanceID, *instanceType, *keyName, *allowCIDR)
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error cloning the instance:")
+		fmt.Fprintln(os.Stderr, err)
+	}
+	var cleanup []string
+	if clone.Instance != nil {
+		id := aws.ToString(clone.Instance.InstanceId)
+		fmt.Println("Launched debug clone " + id + " of " + *instanceID + " in quarantine security group " + clone.SecurityGroupID)
+		if ip := aws.ToString(clone.Instance.PrivateIpAddress); ip != "" {
+			fmt.Println("Private IP: " + ip)
+		}
+		if *allowCIDR != "" {
+			fmt.Println("SSH is allowed from " + *allowCIDR + ": aws-vmcreate connect " + id + " --private-ip")
+		} else {
+			progressln("No traffic is allowed, use the EC2 serial console or pass --cidr to allow SSH")
+		}
+		cleanup = append(cleanup, "aws ec2 terminate-instances --instance-ids "+id)
+	}
+	if clone.SecurityGroupID != "" {
+		cleanup = append(cleanup, "aws ec2 delete-security-group --group-id "+clone.SecurityGroupID)
+	}
+	if clone.ImageID != "" {
+		cleanup = append(cleanup, "aws ec2 deregister-image --image-id "+clone.ImageID)
+	}
+	for _, s := range clone.SnapshotIDs {
+		cleanup = append(cleanup, "aws ec2 delete-snapshot --snapshot-id "+s)
+	}
+	if len(cleanup) > 0 {
+		fmt.Println("Remove the clone when done with:")
+		fmt.Println("  " + strings.Join(cleanup, "\n  "))
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeDebugClone makes images and security groups, and keeps the last
+// RunInstances call.
+type fakeDebugClone struct {
+	*fakeSecurityGroups
+	images []types.Image
+	run    *ec2.RunInstancesInput
+}
+
+func (f *fakeDebugClone) CreateImage(ctx context.Context, params *ec2.CreateImageInput, optFns ...func(*ec2.Options)) (*ec2.CreateImageOutput, error) {
+	f.changes = append(f.changes, "create-image "+aws.ToString(params.InstanceId))
+	id := "ami-clone"
+	f.images = append(f.images, types.Image{
+		ImageId:             aws.String(id),
+		State:               types.ImageStateAvailable,
+		BlockDeviceMappings: []types.BlockDeviceMapping{{Ebs: &types.EbsBlockDevice{SnapshotId: aws.String("snap-1")}}},
+	})
+	return &ec2.CreateImageOutput{ImageId: aws.String(id)}, nil
+}
+
+func (f *fakeDebugClone) DescribeImages(ctx context.Context, params *ec2.DescribeImagesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeImagesOutput, error) {
+	return &ec2.DescribeImagesOutput{Images: f.images}, nil
+}
+
+func (f *fakeDebugClone) CreateSecurityGroup(ctx context.Context, params *ec2.CreateSecurityGroupInput, optFns ...func(*ec2.Options)) (*ec2.CreateSecurityGroupOutput, error) {
+	f.changes = append(f.changes, "create-group "+aws.ToString(params.VpcId))
+	return &ec2.CreateSecurityGroupOutput{GroupId: aws.String("sg-quarantine")}, nil
+}
+
+func (f *fakeDebugClone) RunInstances(ctx context.Context, params *ec2.RunInstancesInput, optFns ...func(*ec2.Options)) (*ec2.RunInstancesOutput, error) {
+	f.run = params
+	return f.FakeEC2.RunInstances(ctx, params, optFns...)
+}
+
+func TestCloneForDebugging(t *testing.T) {
+	fake := useFakeEC2(t)
+	api := &fakeDebugClone{fakeSecurityGroups: &fakeSecurityGroups{FakeEC2: fake}}
+	provisioner = vmcreate.New(api, vmcreate.WithWaitTimeout(5*time.Second))
+	original := fake.AddInstance(types.Instance{
+		InstanceType:       types.InstanceTypeM5Large,
+		ImageId:            aws.String("ami-1"),
+		VpcId:              aws.String("vpc-1"),
+		SubnetId:           aws.String("subnet-1"),
+		KeyName:            aws.String("prod"),
+		IamInstanceProfile: &types.IamInstanceProfile{Arn: aws.String("arn:aws:iam::123456789012:instance-profile/prod")},
+	})
+
+	clone, err := cloneForDebugging(context.Background(), api, ConfigMap{}, original, "", "", "10.1.2.3/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clone.ImageID != "ami-clone" || len(clone.SnapshotIDs) != 1 || clone.SecurityGroupID != "sg-quarantine" {
+		t.Errorf("clone = %+v", clone)
+	}
+	want := []string{
+		"create-image " + original,
+		"create-group vpc-1",
+		"revoke-egress sg-quarantine -1 0.0.0.0/0",
+		"authorize-ingress sg-quarantine tcp 10.1.2.3/32",
+	}
+	if strings.Join(api.changes, "\n") != strings.Join(want, "\n") {
+		t.Errorf("changes = %q, want %q", api.changes, want)
+	}
+
+	run := api.run
+	if aws.ToString(run.ImageId) != "ami-clone" || run.InstanceType != types.InstanceTypeM5Large || aws.ToString(run.KeyName) != "prod" {
+		t.Errorf("launched %s %s with key %s", aws.ToString(run.ImageId), run.InstanceType, aws.ToString(run.KeyName))
+	}
+	if run.IamInstanceProfile != nil || run.SubnetId != nil || len(run.SecurityGroupIds) != 0 {
+		t.Errorf("clone launched with the profile, subnet or groups outside its interface: %+v", run)
+	}
+	nic := run.NetworkInterfaces[0]
+	if aws.ToString(nic.SubnetId) != "subnet-1" || nic.Groups[0] != "sg-quarantine" || aws.ToBool(nic.AssociatePublicIpAddress) {
+		t.Errorf("interface = %+v", nic)
+	}
+	if got := vmcreate.TagValue(clone.Instance, debugCloneTag); got != original {
+		t.Errorf("%s = %q", debugCloneTag, got)
+	}
+	if got := vmcreate.TagValue(clone.Instance, createdByTag); got == "" {
+		t.Errorf("the clone has no %s tag", createdByTag)
+	}
+}
+
+func TestQuarantineGroupWithoutAccess(t *testing.T) {
+	api := &fakeDebugClone{fakeSecurityGroups: &fakeSecurityGroups{}}
+	if _, err := createQuarantineGroup(context.Background(), api, "vpc-1", "q", nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.changes) != 2 || !strings.HasPrefix(api.changes[1], "revoke-egress") {
+		t.Errorf("changes = %q, want only the egress revoked", api.changes)
+	}
+}
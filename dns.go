@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// dnsTTL is the TTL of the A records registered for instances.
+const dnsTTL = 60
+
+var route53Client *awsapi.Route53
+
+// Route53API defines the interface for the hosted zone and record set functions.
+// We use this interface to test the functions using a mocked service.
+type Route53API interface {
+	ListHostedZonesByName(ctx context.Context, dnsName string) (*awsapi.ListHostedZonesByNameOutput, error)
+
+	ListResourceRecordSets(ctx context.Context, zoneID, name, recordType string) (*awsapi.ListResourceRecordSetsOutput, error)
+
+	ChangeResourceRecordSets(ctx context.Context, zoneID string, batch *awsapi.ChangeBatch) (*awsapi.ChangeResourceRecordSetsOutput, error)
+}
+
+// ChangeRecords applies a batch of changes to an Amazon Route 53 hosted zone.
+// Inputs:
+//
+//	c is the context of the method call, which includes the AWS Region.
+//	api is the interface that defines the method call.
+//	zoneID is the hosted zone to change.
+//	batch defines the changes to apply.
+//
+// Output:
+//
+//	If success, a ChangeResourceRecordSetsOutput object containing the result of the service call and nil.
+//	Otherwise, nil and an error from the call to ChangeResourceRecordSets.
+func ChangeRecords(c context.Context, api Route53API, zoneID string, batch *awsapi.ChangeBatch) (*awsapi.ChangeResourceRecordSetsOutput, error) {
+	return api.ChangeResourceRecordSets(c, zoneID, batch)
+}
+
+// fqdn returns name as a fully qualified domain name with a trailing dot.
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+// findHostedZone returns the ID of the hosted zone named zone.
+func findHostedZone(c context.Context, api Route53API, zone string) (string, error) {
+	result, err := api.ListHostedZonesByName(c, zone)
+	if err != nil {
+		return "", err
+	}
+	for _, z := range result.HostedZones {
+		if strings.EqualFold(z.Name, fqdn(zone)) {
+			return z.Id, nil
+		}
+	}
+	return "", fmt.Errorf("hosted zone %s not found", zone)
+}
+
+// instanceDNSName expands the {{name}} and {{id}} placeholders of template
+// and qualifies the result with zone.
+func instanceDNSName(template string, zone string, tagValue string, instanceID string) string {
+	name := strings.NewReplacer("{{name}}", tagValue, "{{id}}", instanceID).Replace(template)
+	if !strings.HasSuffix(fqdn(name), fqdn(zone)) {
+		name = name + "." + zone
+	}
+	return fqdn(strings.ToLower(name))
+}
+
+// registerDNS upserts an A record for the instance in zone. The record points
+// at the private IP, or the public IP when usePublicIP is set.
+func registerDNS(c context.Context, api Route53API, instance *types.Instance, zone string, name string, usePublicIP bool) (string, error) {
+	ip := aws.ToString(instance.PrivateIpAddress)
+	if usePublicIP {
+		ip = aws.ToString(instance.PublicIpAddress)
+	}
+	if ip == "" {
+		return "", fmt.Errorf("instance %s has no IP address to register", aws.ToString(instance.InstanceId))
+	}
+
+	zoneID, err := findHostedZone(c, api, zone)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = ChangeRecords(c, api, zoneID, &awsapi.ChangeBatch{
+		Comment: "aws-vmcreate " + aws.ToString(instance.InstanceId),
+		Changes: []awsapi.Change{
+			{
+				Action: "UPSERT",
+				ResourceRecordSet: awsapi.ResourceRecordSet{
+					Name:            name,
+					Type:            "A",
+					TTL:             dnsTTL,
+					ResourceRecords: []awsapi.ResourceRecord{{Value: ip}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	return ip, nil
+}
+
+// deregisterDNS deletes the A record name from zone if it exists. Route 53
+// only deletes exact matches, so the current record is looked up first.
+func deregisterDNS(c context.Context, api Route53API, zone string, name string) error {
+	zoneID, err := findHostedZone(c, api, zone)
+	if err != nil {
+		return err
+	}
+
+	result, err := api.ListResourceRecordSets(c, zoneID, name, "A")
+	if err != nil {
+		return err
+	}
+	for _, record := range result.ResourceRecordSets {
+		if !strings.EqualFold(record.Name, name) || record.Type != "A" {
+			continue
+		}
+		_, err = ChangeRecords(c, api, zoneID, &awsapi.ChangeBatch{
+			Changes: []awsapi.Change{{Action: "DELETE", ResourceRecordSet: record}},
+		})
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestInstanceDNSName(t *testing.T) {
+	for _, tc := range []struct {
+		template, want string
+	}{
+		{"{{name}}", "web-1.dev.example.com."},
+		{"{{id}}", "i-0abc.dev.example.com."},
+		{"{{name}}.dev.example.com", "web-1.dev.example.com."},
+		{"API.{{name}}.dev.example.com.", "api.web-1.dev.example.com."},
+	} {
+		if got := instanceDNSName(tc.template, "dev.example.com", "web-1", "i-0abc"); got != tc.want {
+			t.Errorf("instanceDNSName(%q) = %q, want %q", tc.template, got, tc.want)
+		}
+	}
+}
+
+func TestRegisterDNS(t *testing.T) {
+	api := &fakeRoute53{zone: "dev.example.com", records: map[string]string{}}
+	instance := &types.Instance{InstanceId: aws.String("i-0abc"), PrivateIpAddress: aws.String("10.0.0.5"), PublicIpAddress: aws.String("203.0.113.7")}
+
+	ip, err := registerDNS(context.Background(), api, instance, "dev.example.com", "web-1.dev.example.com.", false)
+	if err != nil || ip != "10.0.0.5" || api.records["web-1.dev.example.com."] != "10.0.0.5" {
+		t.Fatalf("got %s, %v, records %v", ip, err, api.records)
+	}
+	// Registering again moves the record, here to the public IP.
+	ip, err = registerDNS(context.Background(), api, instance, "dev.example.com", "web-1.dev.example.com.", true)
+	if err != nil || ip != "203.0.113.7" || len(api.records) != 1 || api.records["web-1.dev.example.com."] != "203.0.113.7" {
+		t.Fatalf("got %s, %v, records %v", ip, err, api.records)
+	}
+
+	if _, err := registerDNS(context.Background(), api, instance, "prod.example.com", "web-1.prod.example.com.", false); err == nil || !strings.Contains(err.Error(), "hosted zone prod.example.com not found") {
+		t.Errorf("got %v", err)
+	}
+	private := &types.Instance{InstanceId: aws.String("i-0def"), PrivateIpAddress: aws.String("10.0.0.6")}
+	if _, err := registerDNS(context.Background(), api, private, "dev.example.com", "web-2.dev.example.com.", true); err == nil || !strings.Contains(err.Error(), "has no IP address") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestDeregisterDNS(t *testing.T) {
+	api := &fakeRoute53{zone: "dev.example.com", records: map[string]string{
+		"web-1.dev.example.com.": "10.0.0.5",
+		"web-2.dev.example.com.": "10.0.0.6",
+	}}
+
+	if err := deregisterDNS(context.Background(), api, "dev.example.com", "web-1.dev.example.com."); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := api.records["web-1.dev.example.com."]; ok || len(api.records) != 1 {
+		t.Errorf("records %v", api.records)
+	}
+
+	// A record that is already gone is not an error.
+	if err := deregisterDNS(context.Background(), api, "dev.example.com", "web-1.dev.example.com."); err != nil || len(api.records) != 1 {
+		t.Errorf("got %v, records %v", err, api.records)
+	}
+}
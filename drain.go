@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// Drain is what delete and scale do on each instance before terminating it,
+// so that the work it holds finishes first.
+type Drain struct {
+	// Actions run in order, each once the one before is done.
+	Actions []DrainAction `json:"actions"`
+	// Timeout is how long the actions of an instance may take together, 10m
+	// by default. The instance is terminated once it passes.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// DrainAction is one step of a drain, exactly one of its fields set.
+type DrainAction struct {
+	// SSMCommand is shell commands run on the instance with
+	// AWS-RunShellScript, such as stopping a worker's service.
+	SSMCommand []string `json:"ssm_command,omitempty"`
+	// HTTP is a URL posted to, a template of {{id}} and {{private_ip}} such
+	// as http://{{private_ip}}:8080/drain, which must answer 2xx.
+	HTTP string `json:"http,omitempty"`
+	// TargetGroupArn is a target group the instance is deregistered from,
+	// waiting for its connections to drain.
+	TargetGroupArn string `json:"target_group_arn,omitempty"`
+	// QueueURL is an SQS queue waited on until it holds no messages, either
+	// waiting or in flight.
+	QueueURL string `json:"queue_url,omitempty"`
+}
+
+// QueueAttributesAPI defines the interface for the GetQueueAttributes function.
+// We use this interface to test the functions using a mocked service.
+type QueueAttributesAPI interface {
+	GetQueueAttributes(ctx context.Context, params *awsapi.GetQueueAttributesInput) (*awsapi.GetQueueAttributesOutput, error)
+}
+
+// sqsClientFor returns a client for the region of the queue URL, which is
+// https://sqs.REGION.amazonaws.com/ACCOUNT/NAME.
+var sqsClientFor = func(queueURL string) QueueAttributesAPI {
+	cfg := awsConfig.Copy()
+	host := strings.TrimPrefix(strings.TrimPrefix(queueURL, "https://"), "http://")
+	if parts := strings.Split(host, "."); len(parts) > 2 && parts[0] == "sqs" {
+		cfg.Region = parts[1]
+	}
+	return awsapi.NewSQS(cfg)
+}
+
+// drainPollInterval is how often a drain checks on its queues.
+var drainPollInterval = 10 * time.Second
+
+// defaultDrainTimeout is the timeout of drains that do not set one.
+const defaultDrainTimeout = 10 * time.Minute
+
+func (a DrainAction) validate() error {
+	set := 0
+	for _, field := range []bool{len(a.SSMCommand) > 0, a.HTTP != "", a.TargetGroupArn != "", a.QueueURL != ""} {
+		if field {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("set exactly one of ssm_command, http, target_group_arn and queue_url")
+	}
+	return nil
+}
+
+// describe returns what the action does, for the progress output.
+func (a DrainAction) describe() string {
+	switch {
+	case len(a.SSMCommand) > 0:
+		return "running " + strings.Join(a.SSMCommand, "; ")
+	case a.HTTP != "":
+		return "calling " + a.HTTP
+	case a.TargetGroupArn != "":
+		return "deregistering from " + a.TargetGroupArn
+	default:
+		return "waiting for " + a.QueueURL + " to empty"
+	}
+}
+
+// drainInstance runs the actions of the drain on the instance, stopping at
+// the first that fails or once the drain's timeout passes.
+func drainInstance(c context.Context, d *Drain, ssm SSMCommandAPI, elbv2 ELBv2TargetAPI, i *types.Instance) error {
+	timeout := defaultDrainTimeout
+	if d.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(d.Timeout); err != nil {
+			return fmt.Errorf("drain timeout: %w", err)
+		}
+	}
+	timeout = boundedWait(timeout)
+	c, cancel := context.WithTimeout(c, timeout)
+	defer cancel()
+
+	id := aws.ToString(i.InstanceId)
+	for n, a := range d.Actions {
+		if err := a.validate(); err != nil {
+			return fmt.Errorf("drain action %d: %w", n+1, err)
+		}
+		progressln("Draining " + id + ": " + a.describe())
+		if err := a.run(c, ssm, elbv2, i, timeout); err != nil {
+			if c.Err() != nil {
+				return fmt.Errorf("drain of %s timed out after %s while %s: %w", id, timeout, a.describe(), err)
+			}
+			return fmt.Errorf("drain action %d, %s: %w", n+1, a.describe(), err)
+		}
+	}
+	return nil
+}
+
+func (a DrainAction) run(c context.Context, ssm SSMCommandAPI, elbv2 ELBv2TargetAPI, i *types.Instance, timeout time.Duration) error {
+	id := aws.ToString(i.InstanceId)
+	switch {
+	case len(a.SSMCommand) > 0:
+		_, err := runShellCommands(c, ssm, id, a.SSMCommand, nil)
+		return err
+	case a.HTTP != "":
+		url := strings.NewReplacer("{{id}}", id, "{{private_ip}}", aws.ToString(i.PrivateIpAddress)).Replace(a.HTTP)
+		return callDrainEndpoint(c, url)
+	case a.TargetGroupArn != "":
+		return deregisterTarget(c, elbv2, a.TargetGroupArn, id, timeout)
+	default:
+		return waitForEmptyQueue(c, sqsClientFor(a.QueueURL), a.QueueURL)
+	}
+}
+
+// callDrainEndpoint posts to the URL, which answers once the instance has
+// stopped taking work.
+func callDrainEndpoint(c context.Context, url string) error {
+	req, err := http.NewRequestWithContext(c, http.MethodPost, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := awsConfig.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// waitForEmptyQueue polls the queue until it holds no messages.
+func waitForEmptyQueue(c context.Context, api QueueAttributesAPI, queueURL string) error {
+	input := &awsapi.GetQueueAttributesInput{
+		QueueUrl:       queueURL,
+		AttributeNames: []string{"ApproximateNumberOfMessages", "ApproximateNumberOfMessagesNotVisible"},
+	}
+	for {
+		out, err := api.GetQueueAttributes(c, input)
+		if err != nil {
+			return err
+		}
+		held := 0
+		for _, a := range out.Attributes {
+			n, err := strconv.Atoi(a.Value)
+			if err != nil {
+				return fmt.Errorf("%s of %s is %q", a.Name, queueURL, a.Value)
+			}
+			held += n
+		}
+		if held == 0 {
+			return nil
+		}
+
+		select {
+		case <-c.Done():
+			return fmt.Errorf("%s still holds %d messages: %w", queueURL, held, c.Err())
+		case <-time.After(drainPollInterval):
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+type fakeDrainSSM struct {
+	sent [][]string
+}
+
+func (f *fakeDrainSSM) SendCommand(ctx context.Context, params *awsapi.SendCommandInput) (*awsapi.SendCommandOutput, error) {
+	f.sent = append(f.sent, params.Parameters["commands"])
+	return &awsapi.SendCommandOutput{Command: awsapi.Command{CommandId: "cmd-1"}}, nil
+}
+
+func (f *fakeDrainSSM) GetCommandInvocation(ctx context.Context, params *awsapi.GetCommandInvocationInput) (*awsapi.GetCommandInvocationOutput, error) {
+	return &awsapi.GetCommandInvocationOutput{Status: "Success"}, nil
+}
+
+// fakeQueue holds messages, one fewer each time it is asked, or always
+// when stuck.
+type fakeQueue struct {
+	messages int
+	stuck    bool
+}
+
+func (f *fakeQueue) GetQueueAttributes(ctx context.Context, params *awsapi.GetQueueAttributesInput) (*awsapi.GetQueueAttributesOutput, error) {
+	out := &awsapi.GetQueueAttributesOutput{Attributes: []awsapi.QueueAttribute{
+		{Name: "ApproximateNumberOfMessages", Value: "0"},
+		{Name: "ApproximateNumberOfMessagesNotVisible", Value: strconv.Itoa(f.messages)},
+	}}
+	if f.messages > 0 && !f.stuck {
+		f.messages--
+	}
+	return out, nil
+}
+
+func useFakeQueue(t *testing.T, q *fakeQueue) {
+	interval, clientFor := drainPollInterval, sqsClientFor
+	drainPollInterval = time.Millisecond
+	sqsClientFor = func(string) QueueAttributesAPI { return q }
+	t.Cleanup(func() { drainPollInterval, sqsClientFor = interval, clientFor })
+}
+
+func TestDrainInstance(t *testing.T) {
+	useFakeEC2(t)
+	defer func(interval time.Duration) { commandPollInterval = interval }(commandPollInterval)
+	commandPollInterval = time.Millisecond
+	queue := &fakeQueue{messages: 3}
+	useFakeQueue(t, queue)
+	var called []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = append(called, r.Method+" "+r.URL.Path)
+	}))
+	defer server.Close()
+
+	ssm := &fakeDrainSSM{}
+	i := &types.Instance{InstanceId: aws.String("i-1"), PrivateIpAddress: aws.String("10.0.0.7")}
+	drain := &Drain{Actions: []DrainAction{
+		{SSMCommand: []string{"systemctl stop worker"}},
+		{HTTP: server.URL + "/drain/{{id}}"},
+		{QueueURL: "https://sqs.us-east-1.amazonaws.com/111122223333/jobs"},
+	}}
+	if err := drainInstance(context.Background(), drain, ssm, nil, i); err != nil {
+		t.Fatal(err)
+	}
+	if len(ssm.sent) != 1 || ssm.sent[0][0] != "systemctl stop worker" {
+		t.Errorf("sent %v", ssm.sent)
+	}
+	if len(called) != 1 || called[0] != "POST /drain/i-1" {
+		t.Errorf("the endpoint was called %v", called)
+	}
+	if queue.messages != 0 {
+		t.Errorf("the drain ended with %d messages in flight", queue.messages)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	useFakeEC2(t)
+	useFakeQueue(t, &fakeQueue{messages: 2, stuck: true})
+	i := &types.Instance{InstanceId: aws.String("i-1")}
+
+	drain := &Drain{Timeout: "20ms", Actions: []DrainAction{{QueueURL: "https://sqs.us-east-1.amazonaws.com/111122223333/jobs"}}}
+	err := drainInstance(context.Background(), drain, nil, nil, i)
+	if err == nil || !strings.Contains(err.Error(), "timed out after 20ms while waiting for") || !strings.Contains(err.Error(), "still holds 2 messages") {
+		t.Errorf("err = %v", err)
+	}
+
+	drain = &Drain{Actions: []DrainAction{{HTTP: "http://localhost/drain", QueueURL: "https://sqs.us-east-1.amazonaws.com/111122223333/jobs"}}}
+	if err := drainInstance(context.Background(), drain, nil, nil, i); err == nil || !strings.Contains(err.Error(), "exactly one") {
+		t.Errorf("an action of two steps was run: %v", err)
+	}
+}
+
+func TestDeleteDrains(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{Drain: &Drain{Actions: []DrainAction{{QueueURL: "https://sqs.us-east-1.amazonaws.com/111122223333/jobs"}}}})
+	queue := &fakeQueue{messages: 2}
+	useFakeQueue(t, queue)
+	fake.AddInstance(tagged("app", "worker"))
+
+	out := runCLI(t, "delete", "--tag", "app=worker")
+	if !strings.Contains(out, "to empty") || queue.messages != 0 {
+		t.Errorf("delete did not wait for the queue:\n%s", out)
+	}
+	if n := len(liveInstances(fake)); n != 0 {
+		t.Errorf("%d instances left", n)
+	}
+}
+
+func TestDrainPolicy(t *testing.T) {
+	config := ConfigMap{Drain: &Drain{Actions: []DrainAction{{QueueURL: "https://sqs.eu-west-1.amazonaws.com/111122223333/jobs"}}}}
+	doc, err := iamPolicy([]string{"delete"}, config, iamPolicyFeatures{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range doc.Statement {
+		if s.Sid == "DrainQueues" {
+			if got := strings.Join(s.Resource, " "); got != "arn:aws:sqs:eu-west-1:111122223333:jobs" {
+				t.Errorf("the queue statement is on %s", got)
+			}
+			return
+		}
+	}
+	t.Errorf("no queue statement in %+v", doc.Statement)
+}
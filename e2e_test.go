@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"aws-vmcreate/pkg/vmcreate"
+	"aws-vmcreate/pkg/vmcreate/vmcreatetest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func tagged(key, value string) types.Instance {
+	return types.Instance{Tags: []types.Tag{{Key: aws.String(key), Value: aws.String(value)}}}
+}
+
+func liveInstances(fake *vmcreatetest.FakeEC2) []types.Instance {
+	var live []types.Instance
+	for _, i := range fake.Instances() {
+		if i.State.Name != types.InstanceStateNameTerminated {
+			live = append(live, i)
+		}
+	}
+	return live
+}
+
+func TestCreateCommand(t *testing.T) {
+	fake := useFakeEC2(t)
+
+	out := runCLI(t, "create", "--tag", "Name=web-1")
+
+	instances := fake.Instances()
+	if len(instances) != 1 {
+		t.Fatalf("launched %d instances, want 1\n%s", len(instances), out)
+	}
+	i := instances[0]
+	if got := vmcreate.TagValue(&i, "Name"); got != "web-1" {
+		t.Errorf("Name tag = %q, want web-1", got)
+	}
+	if i.InstanceType != "t2.micro" || aws.ToString(i.ImageId) != "ami-0d0ca2066b861631c" {
+		t.Errorf("launched %s %s, want the data/config.json values", i.InstanceType, aws.ToString(i.ImageId))
+	}
+	if !strings.Contains(out, "Created tagged instance with ID "+aws.ToString(i.InstanceId)) {
+		t.Errorf("output does not report the instance:\n%s", out)
+	}
+}
+
+func TestCreateWithoutSourceDestCheck(t *testing.T) {
+	fake := useFakeEC2(t)
+
+	out := runCLI(t, "create", "--tag", "Name=nat-1", "--no-source-dest-check")
+
+	instances := fake.Instances()
+	if len(instances) != 1 {
+		t.Fatalf("launched %d instances, want 1\n%s", len(instances), out)
+	}
+	if check := instances[0].SourceDestCheck; check == nil || *check {
+		t.Errorf("source/destination check = %v, want it disabled\n%s", check, out)
+	}
+}
+
+func TestCreateCommandErrors(t *testing.T) {
+	t.Run("missing tag", func(t *testing.T) {
+		fake := useFakeEC2(t)
+		out := runCLI(t, "-c", "create", "-n", "Name")
+		if !strings.Contains(out, "You must supply a name and value for the tag") {
+			t.Errorf("output:\n%s", out)
+		}
+		if calls := fake.Calls(); len(calls) != 0 {
+			t.Errorf("made calls %v", calls)
+		}
+	})
+
+	t.Run("launch fails", func(t *testing.T) {
+		fake := useFakeEC2(t)
+		fake.Fail("RunInstances", errors.New("InsufficientInstanceCapacity"))
+		stdout, stderr, code := runCLIExit(t, false, "create", "--tag", "Name=web-1")
+		if !strings.Contains(stderr, "Got an error creating an instance:") || !strings.Contains(stderr, "InsufficientInstanceCapacity") {
+			t.Errorf("stderr:\n%s", stderr)
+		}
+		if strings.Contains(stdout, "error") || strings.Contains(stdout, "Created") {
+			t.Errorf("stdout has more than the results:\n%s", stdout)
+		}
+		if code != 1 {
+			t.Errorf("exit code %d, want 1", code)
+		}
+		if n := len(fake.Instances()); n != 0 {
+			t.Errorf("launched %d instances", n)
+		}
+	})
+}
+
+func TestDeleteCommand(t *testing.T) {
+	fake := useFakeEC2(t)
+	web1 := fake.AddInstance(tagged("Name", "web-1"))
+	web2 := fake.AddInstance(tagged("Name", "web-2"))
+	db := fake.AddInstance(tagged("Name", "db"))
+
+	out := runCLI(t, "delete", "-n", "Name", "-v", "web-1,web-2")
+
+	for _, id := range []string{web1, web2} {
+		if state := fake.Instance(id).State.Name; state != types.InstanceStateNameTerminated {
+			t.Errorf("%s is %s, want terminated\n%s", id, state, out)
+		}
+	}
+	if state := fake.Instance(db).State.Name; state != types.InstanceStateNameRunning {
+		t.Errorf("untagged instance %s is %s", db, state)
+	}
+	if !strings.Contains(out, "Terminated instance with id: "+web1) {
+		t.Errorf("output does not report the termination:\n%s", out)
+	}
+}
+
+func TestDeleteCommandErrors(t *testing.T) {
+	t.Run("no match", func(t *testing.T) {
+		fake := useFakeEC2(t)
+		fake.AddInstance(tagged("Name", "db"))
+		out := runCLI(t, "delete", "--tag", "Name=web-1")
+		if !strings.Contains(out, "No instances found with tag Name=web-1") {
+			t.Errorf("output:\n%s", out)
+		}
+		if len(liveInstances(fake)) != 1 {
+			t.Error("an unrelated instance was terminated")
+		}
+	})
+
+	t.Run("describe fails", func(t *testing.T) {
+		fake := useFakeEC2(t)
+		fake.Fail("DescribeInstances", errors.New("RequestLimitExceeded"))
+		out := runCLI(t, "delete", "--tag", "Name=web-1")
+		if !strings.Contains(out, "Got an error fetching the status of the instance") {
+			t.Errorf("output:\n%s", out)
+		}
+	})
+
+	t.Run("terminate fails", func(t *testing.T) {
+		fake := useFakeEC2(t)
+		id := fake.AddInstance(tagged("Name", "web-1"))
+		fake.Fail("TerminateInstances", errors.New("UnauthorizedOperation"))
+		out := runCLI(t, "delete", "--tag", "Name=web-1")
+		if !strings.Contains(out, "Got an error terminating the instance:") || !strings.Contains(out, "UnauthorizedOperation") {
+			t.Errorf("output:\n%s", out)
+		}
+		if state := fake.Instance(id).State.Name; state != types.InstanceStateNameRunning {
+			t.Errorf("%s is %s", id, state)
+		}
+	})
+}
+
+func TestCreateThenDelete(t *testing.T) {
+	fake := useFakeEC2(t)
+
+	runCLI(t, "create", "--tag", "env=e2e")
+	runCLI(t, "create", "--tag", "env=e2e")
+	if n := len(liveInstances(fake)); n != 2 {
+		t.Fatalf("%d live instances after two creates, want 2", n)
+	}
+
+	runCLI(t, "delete", "--tag", "env=e2e")
+	if n := len(liveInstances(fake)); n != 0 {
+		t.Errorf("%d live instances after delete, want 0", n)
+	}
+}
+
+func TestResizeCommand(t *testing.T) {
+	fake := useFakeEC2(t)
+	id := fake.AddInstance(types.Instance{InstanceType: "t2.micro"})
+
+	out := runCLI(t, "resize", id)
+	if !strings.Contains(out, "You must supply the new instance type") {
+		t.Errorf("output:\n%s", out)
+	}
+
+	out = runCLI(t, "resize", id, "-t", "t3.small")
+	if got := fake.Instance(id).InstanceType; got != "t3.small" {
+		t.Errorf("instance type = %s, want t3.small\n%s", got, out)
+	}
+
+	fake.Fail("StopInstances", errors.New("IncorrectInstanceState"))
+	out = runCLI(t, "resize", id, "-t", "t3.large")
+	if !strings.Contains(out, "Got an error resizing the instance:") {
+		t.Errorf("output:\n%s", out)
+	}
+}
+
+func TestResizeNotifications(t *testing.T) {
+	fake := useFakeEC2(t)
+	id := fake.AddInstance(types.Instance{InstanceType: "t2.micro"})
+	var events []Event
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e Event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		events = append(events, e)
+	}))
+	defer hook.Close()
+	useConfig(t, ConfigMap{InstanceType: "t2.micro", ImageId: "ami-0d0ca2066b861631c", Notifications: &Notifications{Webhooks: []string{hook.URL}}})
+
+	runCLI(t, "resize", id, "-t", "t3.small")
+	fake.Fail("StopInstances", errors.New("IncorrectInstanceState"))
+	runCLI(t, "resize", id, "-t", "t3.large")
+
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2: %+v", len(events), events)
+	}
+	for n, want := range []string{"success", "failure"} {
+		e := events[n]
+		if e.Command != "resize" || e.Status != want || len(e.InstanceIDs) != 1 || e.InstanceIDs[0] != id {
+			t.Errorf("event %d = %+v, want a resize %s of %s", n, e, want, id)
+		}
+	}
+	if !strings.Contains(events[1].Error, "IncorrectInstanceState") {
+		t.Errorf("failure event has error %q", events[1].Error)
+	}
+}
+
+func TestServeListenFailure(t *testing.T) {
+	useFakeEC2(t)
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	t.Setenv("AWS_VMCREATE_API_TOKEN", "secret")
+
+	_, stderr, code := runCLIExit(t, false, "serve", "--listen", taken.Addr().String())
+	if !strings.Contains(stderr, "Got an error serving the API:") || code != 1 {
+		t.Errorf("exit code %d, stderr:\n%s", code, stderr)
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	useFakeEC2(t)
+	stdout, stderr, code := runCLIExit(t, false, "frobnicate")
+	if !strings.Contains(stderr, "Unknown command frobnicate") || stdout != "" {
+		t.Errorf("stdout:\n%s\nstderr:\n%s", stdout, stderr)
+	}
+	if code != 1 {
+		t.Errorf("exit code %d, want 1", code)
+	}
+}
+
+func TestDaemonReconcile(t *testing.T) {
+	fake := useFakeEC2(t)
+	ctx := context.Background()
+	state := &DesiredState{Groups: []DesiredGroup{
+		{Name: "web", Count: 2, InstanceType: "t3.micro", ImageId: "ami-web", Tags: map[string]string{"app": "web"}},
+	}}
+
+	if err := reconcile(ctx, state, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(fake.Instances()); n != 0 {
+		t.Fatalf("dry run launched %d instances", n)
+	}
+
+	if err := reconcile(ctx, state, false, false); err != nil {
+		t.Fatal(err)
+	}
+	live := liveInstances(fake)
+	if len(live) != 2 {
+		t.Fatalf("%d live instances, want 2", len(live))
+	}
+	oldest := aws.ToString(live[0].InstanceId)
+
+	// Drifted tags are restored and extra instances are terminated newest first.
+	if err := provisioner.Tag(ctx, []string{oldest}, map[string]string{"app": "changed"}); err != nil {
+		t.Fatal(err)
+	}
+	state.Groups[0].Count = 1
+	if err := reconcile(ctx, state, false, false); err != nil {
+		t.Fatal(err)
+	}
+	live = liveInstances(fake)
+	if len(live) != 1 || aws.ToString(live[0].InstanceId) != oldest {
+		t.Fatalf("live instances %v, want only %s", live, oldest)
+	}
+	if got := vmcreate.TagValue(&live[0], "app"); got != "web" {
+		t.Errorf("app tag = %q, want it restored to web", got)
+	}
+
+	// Groups removed from the file are only terminated with prune.
+	state.Groups = nil
+	if err := reconcile(ctx, state, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(liveInstances(fake)); n != 1 {
+		t.Errorf("%d live instances without prune, want 1", n)
+	}
+	if err := reconcile(ctx, state, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(liveInstances(fake)); n != 0 {
+		t.Errorf("%d live instances after prune, want 0", n)
+	}
+}
+
+func TestAPIServer(t *testing.T) {
+	fake := useFakeEC2(t)
+	server := httptest.NewServer(&apiServer{
+		token:  "secret",
+		config: ConfigMap{InstanceType: "t2.micro", ImageId: "ami-api"},
+	})
+	defer server.Close()
+
+	do := func(method, path, token, body string) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var data json.RawMessage
+		json.NewDecoder(resp.Body).Decode(&data)
+		return resp, data
+	}
+
+	if resp, _ := do(http.MethodGet, "/v1/instances", "wrong", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong token got %s", resp.Status)
+	}
+	bare, err := http.NewRequest(http.MethodGet, server.URL+"/v1/instances", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bare.Header.Set("Authorization", "secret")
+	if resp, err := http.DefaultClient.Do(bare); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("token without Bearer got %v %v", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+
+	resp, body := do(http.MethodPost, "/v1/instances", "secret", `{"tag_key": "Name", "tag_value": "api-1"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create got %s: %s", resp.Status, body)
+	}
+	var created InstanceView
+	if err := json.Unmarshal(body, &created); err != nil {
+		t.Fatal(err)
+	}
+	if i := fake.Instance(created.InstanceID); i == nil || aws.ToString(i.ImageId) != "ami-api" {
+		t.Fatalf("created %+v", created)
+	}
+
+	if resp, body := do(http.MethodPost, "/v1/instances", "secret", `{"tag_key": "Name"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("create without a tag value got %s: %s", resp.Status, body)
+	}
+
+	resp, body = do(http.MethodGet, "/v1/instances?tag=Name=api-1", "secret", "")
+	var listed []InstanceView
+	if err := json.Unmarshal(body, &listed); err != nil || resp.StatusCode != http.StatusOK || len(listed) != 1 {
+		t.Errorf("list got %s: %s", resp.Status, body)
+	}
+
+	if resp, body := do(http.MethodGet, "/v1/instances/"+created.InstanceID, "secret", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("describe got %s: %s", resp.Status, body)
+	}
+	if resp, _ := do(http.MethodGet, "/v1/instances/i-missing", "secret", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("describe of a missing instance got %s", resp.Status)
+	}
+
+	// Instances the tool did not create cannot be terminated.
+	foreign := fake.AddInstance(tagged("Name", "not-ours"))
+	if resp, _ := do(http.MethodDelete, "/v1/instances/"+foreign, "secret", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("delete of an instance the tool did not create got %s", resp.Status)
+	}
+	if state := fake.Instance(foreign).State.Name; state == types.InstanceStateNameTerminated {
+		t.Error("the instance the tool did not create was terminated")
+	}
+	terraform := fake.AddInstance(tagged(managedByTag, "terraform"))
+	if resp, _ := do(http.MethodDelete, "/v1/instances/"+terraform, "secret", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("delete of an instance managed by terraform got %s", resp.Status)
+	}
+	if resp, _ := do(http.MethodDelete, "/v1/instances/i-missing", "secret", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("delete of a missing instance got %s", resp.Status)
+	}
+
+	if resp, body := do(http.MethodDelete, "/v1/instances/"+created.InstanceID, "secret", ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("delete got %s: %s", resp.Status, body)
+	}
+	if state := fake.Instance(created.InstanceID).State.Name; state != types.InstanceStateNameTerminated {
+		t.Errorf("instance is %s after delete", state)
+	}
+
+	fake.Fail("RunInstances", errors.New("InsufficientInstanceCapacity"))
+	if resp, _ := do(http.MethodPost, "/v1/instances", "secret", `{"tag_key": "Name", "tag_value": "api-2"}`); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("failed create got %s", resp.Status)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+var efsClient EFSMountTargetAPI
+
+// EFSMountTargetAPI defines the interface for the DescribeMountTargets function.
+// We use this interface to test the functions using a mocked service.
+type EFSMountTargetAPI interface {
+	DescribeMountTargets(ctx context.Context, fileSystemID string) (*awsapi.DescribeMountTargetsOutput, error)
+}
+
+// EFSMount is a file system to mount on the instance at boot.
+type EFSMount struct {
+	FileSystemID string
+	MountPoint   string
+}
+
+// parseEFSMount parses an "fs-12345:/mnt/shared" mount specification.
+func parseEFSMount(spec string) (*EFSMount, error) {
+	fileSystemID, mountPoint, ok := strings.Cut(spec, ":")
+	if !ok || !strings.HasPrefix(fileSystemID, "fs-") || !strings.HasPrefix(mountPoint, "/") {
+		return nil, fmt.Errorf("invalid EFS mount %q, expected FILE_SYSTEM_ID:/MOUNT/POINT", spec)
+	}
+	return &EFSMount{FileSystemID: fileSystemID, MountPoint: mountPoint}, nil
+}
+
+// checkMountTarget returns an error unless the file system has an available
+// mount target in the availability zone.
+func checkMountTarget(c context.Context, api EFSMountTargetAPI, mount *EFSMount, availabilityZone string) error {
+	result, err := api.DescribeMountTargets(c, mount.FileSystemID)
+	if err != nil {
+		return err
+	}
+	for _, mt := range result.MountTargets {
+		if mt.AvailabilityZoneName == availabilityZone && mt.LifeCycleState == "available" {
+			return nil
+		}
+	}
+	return fmt.Errorf("file system %s has no available mount target in %s", mount.FileSystemID, availabilityZone)
+}
+
+// subnetAvailabilityZone returns the availability zone of a subnet.
+func subnetAvailabilityZone(c context.Context, subnetID string) (string, error) {
+	result, err := client.DescribeSubnets(c, &ec2.DescribeSubnetsInput{SubnetIds: []string{subnetID}})
+	if err != nil {
+		return "", err
+	}
+	if len(result.Subnets) == 0 {
+		return "", fmt.Errorf("subnet %s not found", subnetID)
+	}
+	return aws.ToString(result.Subnets[0].AvailabilityZone), nil
+}
+
+// efsUserData returns the boot script that installs the EFS mount helper and
+// mounts the file system, falling back to plain NFS where amazon-efs-utils
+// is not packaged.
+func efsUserData(mount *EFSMount, region string) string {
+	nfsHost := mount.FileSystemID + ".efs." + region + ".amazonaws.com"
+	return fmt.Sprintf(`mkdir -p %[2]s
+if yum install -y amazon-efs-utils; then
+  echo "%[1]s:/ %[2]s efs _netdev,tls 0 0" >> /etc/fstab
+else
+  apt-get update && apt-get install -y nfs-common
+  echo "%[3]s:/ %[2]s nfs4 nfsvers=4.1,rsize=1048576,wsize=1048576,hard,timeo=600,retrans=2,noresvport,_netdev 0 0" >> /etc/fstab
+fi
+mount -a
+`, mount.FileSystemID, mount.MountPoint, nfsHost)
+}
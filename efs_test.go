@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"aws-vmcreate/internal/awsapi"
+)
+
+type fakeMountTargets struct {
+	targets []awsapi.MountTarget
+}
+
+func (f *fakeMountTargets) DescribeMountTargets(ctx context.Context, fileSystemID string) (*awsapi.DescribeMountTargetsOutput, error) {
+	out := &awsapi.DescribeMountTargetsOutput{}
+	for _, mt := range f.targets {
+		if mt.FileSystemId == fileSystemID {
+			out.MountTargets = append(out.MountTargets, mt)
+		}
+	}
+	return out, nil
+}
+
+func TestParseEFSMount(t *testing.T) {
+	mount, err := parseEFSMount("fs-12345:/mnt/shared")
+	if err != nil || mount.FileSystemID != "fs-12345" || mount.MountPoint != "/mnt/shared" {
+		t.Errorf("got %+v, %v", mount, err)
+	}
+	for _, bad := range []string{"fs-12345", "fs-12345:mnt", "12345:/mnt/shared", ""} {
+		if _, err := parseEFSMount(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestCheckMountTarget(t *testing.T) {
+	api := &fakeMountTargets{targets: []awsapi.MountTarget{
+		{FileSystemId: "fs-12345", AvailabilityZoneName: "us-east-1a", LifeCycleState: "available"},
+		{FileSystemId: "fs-12345", AvailabilityZoneName: "us-east-1b", LifeCycleState: "creating"},
+	}}
+	mount := &EFSMount{FileSystemID: "fs-12345", MountPoint: "/mnt/shared"}
+	if err := checkMountTarget(context.Background(), api, mount, "us-east-1a"); err != nil {
+		t.Error(err)
+	}
+	for _, az := range []string{"us-east-1b", "us-east-1c"} {
+		if err := checkMountTarget(context.Background(), api, mount, az); err == nil || !strings.Contains(err.Error(), "no available mount target in "+az) {
+			t.Errorf("%s: got %v", az, err)
+		}
+	}
+}
+
+func TestEFSUserData(t *testing.T) {
+	script := efsUserData(&EFSMount{FileSystemID: "fs-12345", MountPoint: "/mnt/shared"}, "eu-west-1")
+	for _, want := range []string{
+		"mkdir -p /mnt/shared\n",
+		`echo "fs-12345:/ /mnt/shared efs _netdev,tls 0 0" >> /etc/fstab`,
+		`echo "fs-12345.efs.eu-west-1.amazonaws.com:/ /mnt/shared nfs4 nfsvers=4.1,`,
+		"\nmount -a\n",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("the boot script is missing %q:\n%s", want, script)
+		}
+	}
+}
+
+func useFakeMountTargets(t *testing.T, targets ...awsapi.MountTarget) {
+	previous := efsClient
+	efsClient = &fakeMountTargets{targets: targets}
+	t.Cleanup(func() { efsClient = previous })
+}
+
+func TestCreateWithEFS(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1"})
+	available := awsapi.MountTarget{FileSystemId: "fs-12345", AvailabilityZoneName: "us-east-1a", LifeCycleState: "available"}
+	useFakeMountTargets(t, available)
+
+	if _, stderr, code := runCLIExit(t, false, "create", "--tag", "Name=web-1", "--efs", "fs-12345:/mnt/shared"); code != 0 {
+		t.Fatalf("exit code %d:\n%s", code, stderr)
+	}
+	instances := fake.Instances()
+	if len(instances) != 1 {
+		t.Fatalf("launched %d instances", len(instances))
+	}
+	userData := fake.UserData(*instances[0].InstanceId)
+	if !strings.HasPrefix(userData, "#!/bin/bash\n") || !strings.Contains(userData, "fs-12345:/ /mnt/shared efs") {
+		t.Errorf("user data:\n%s", userData)
+	}
+
+	// Without a mount target in the zone the instance launched into, the
+	// create fails.
+	available.AvailabilityZoneName = "us-east-1b"
+	useFakeMountTargets(t, available)
+	if _, stderr, code := runCLIExit(t, false, "create", "--tag", "Name=web-2", "--efs", "fs-12345:/mnt/shared"); code != 1 || !strings.Contains(stderr, "no available mount target in us-east-1a") {
+		t.Errorf("exit code %d:\n%s", code, stderr)
+	}
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"aws-vmcreate/internal/yaml"
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// envTag names the environment env up created a resource for.
+const envTag = "aws-vmcreate:env"
+
+// envExpiresTag is when the environment's --ttl runs out, in RFC 3339.
+const envExpiresTag = "aws-vmcreate:expires"
+
+// envPollInterval is how often env down and cleanup --run-id check that the
+// instances are gone before deleting the network, which waits at most
+// envTerminateTimeout, and how often env up checks the status checks of the
+// instances others depend on, for at most envReadyTimeout.
+var (
+	envPollInterval     = 5 * time.Second
+	envTerminateTimeout = 10 * time.Minute
+	envReadyTimeout     = 15 * time.Minute
+)
+
+// EnvAPI defines the interface for the functions env up creates the network
+// of an environment and waits for its instances with.
+// We use this interface to test the functions using a mocked service.
+type EnvAPI interface {
+	NetworkAPI
+	ec2.DescribeInstanceStatusAPIClient
+}
+
+// EnvManifest is what env up creates for an environment, read from a YAML
+// or JSON file.
+type EnvManifest struct {
+	// Network is made for the environment when set, and the instances
+	// without a subnet_id are launched into its first public subnet.
+	Network *EnvNetwork `json:"network,omitempty"`
+	// Instances are launched like the groups of the daemon, one of each
+	// without a count, and registered in their dns_zone.
+	Instances []EnvInstances `json:"instances"`
+}
+
+// EnvInstances are instances of an environment, which may depend on
+// others: they are launched once the instances they depend on run, and
+// terminated before them.
+type EnvInstances struct {
+	DesiredGroup
+	// DependsOn names the instances of the manifest these need first.
+	DependsOn []string `json:"depends_on,omitempty"`
+	// PrivateIPAddress is the private address of the instance, for an entry
+	// of one, which must be free in its subnet.
+	PrivateIPAddress string `json:"private_ip_address,omitempty"`
+}
+
+// EnvNetwork is the network of an environment, as network create makes it.
+type EnvNetwork struct {
+	CIDR string `json:"cidr,omitempty"`
+	AZs  int    `json:"azs,omitempty"`
+	NAT  bool   `json:"nat,omitempty"`
+}
+
+// EnvState is what env up made for an environment, which env down
+// removes. It is kept in envStateDir from the first resource on, so that a
+// failed env up can be torn down too.
+type EnvState struct {
+	Name     string    `json:"name"`
+	Region   string    `json:"region"`
+	Manifest string    `json:"manifest"`
+	Created  time.Time `json:"created"`
+	// Expires is when the --ttl runs out, zero without one.
+	Expires    time.Time   `json:"expires,omitempty"`
+	Network    bool        `json:"network,omitempty"`
+	VpcID      string      `json:"vpc_id,omitempty"`
+	Instances  []string    `json:"instances,omitempty"`
+	DNSRecords []envRecord `json:"dns_records,omitempty"`
+	// Order is the instances of the manifest in the order they were
+	// launched, when some depend on others, for env down to terminate them
+	// in reverse.
+	Order []string `json:"order,omitempty"`
+}
+
+// envRecord is a DNS record env up registered.
+type envRecord struct {
+	Zone string `json:"zone"`
+	Name string `json:"name"`
+}
+
+// expired reports whether the environment's TTL ran out by now.
+func (s *EnvState) expired(now time.Time) bool {
+	return !s.Expires.IsZero() && now.After(s.Expires)
+}
+
+// envStateDir keeps the state of each environment, by default in
+// ~/.aws/aws-vmcreate/envs.
+func envStateDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join("aws-vmcreate", "envs")
+	}
+	return filepath.Join(home, ".aws", "aws-vmcreate", "envs")
+}
+
+// saveEnvState writes the state of the environment.
+func saveEnvState(s *EnvState) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(envStateDir(), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(envStateDir(), s.Name+".json"), append(data, '\n'), 0o600)
+}
+
+// loadEnvState returns the state of the environment, or nil when there is
+// none.
+func loadEnvState(name string) (*EnvState, error) {
+	data, err := os.ReadFile(filepath.Join(envStateDir(), filepath.Base(name)+".json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &EnvState{}
+	return s, json.Unmarshal(data, s)
+}
+
+// listEnvStates returns the state of every environment, by name.
+func listEnvStates() ([]*EnvState, error) {
+	files, err := filepath.Glob(filepath.Join(envStateDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	var states []*EnvState
+	for _, f := range files {
+		s, err := loadEnvState(strings.TrimSuffix(filepath.Base(f), ".json"))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		states = append(states, s)
+	}
+	return states, nil
+}
+
+// loadEnvManifest reads and validates an environment manifest.
+func loadEnvManifest(path string) (*EnvManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &EnvManifest{}
+	if filepath.Ext(path) == ".json" {
+		err = json.Unmarshal(data, m)
+	} else {
+		err = yaml.Unmarshal(data, m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	seen := map[string]bool{}
+	for i, g := range m.Instances {
+		switch {
+		case g.Name == "":
+			return nil, fmt.Errorf("%s: entry %d of instances has no name", path, i+1)
+		case seen[g.Name]:
+			return nil, fmt.Errorf("%s: instances %s are defined twice", path, g.Name)
+		case g.Count < 0:
+			return nil, fmt.Errorf("%s: instances %s have a negative count", path, g.Name)
+		case g.InstanceType == "" || g.ImageId == "":
+			return nil, fmt.Errorf("%s: instances %s need instance_type and image_id", path, g.Name)
+		case g.DNSZone != "" && g.Count > 1 && !strings.Contains(g.DNSName, "{{id}}"):
+			return nil, fmt.Errorf("%s: instances %s need {{id}} in dns_name so that each gets its own record", path, g.Name)
+		case g.PrivateIPAddress != "" && g.Count > 1:
+			return nil, fmt.Errorf("%s: instances %s have one private_ip_address for %d instances", path, g.Name, g.Count)
+		}
+		seen[g.Name] = true
+	}
+	if len(m.Instances) == 0 {
+		return nil, fmt.Errorf("%s: no instances", path)
+	}
+	for _, g := range m.Instances {
+		for _, d := range g.DependsOn {
+			if !seen[d] {
+				return nil, fmt.Errorf("%s: instances %s depend on %s, which are not in the manifest", path, g.Name, d)
+			}
+		}
+	}
+	if _, err := envLaunchOrder(m.Instances); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
+
+// envLaunchOrder orders the instances of a manifest after those they
+// depend on, and otherwise as the manifest lists them.
+func envLaunchOrder(instances []EnvInstances) ([]EnvInstances, error) {
+	var order []EnvInstances
+	done := map[string]bool{}
+	for len(order) < len(instances) {
+		progressed := false
+		for _, g := range instances {
+			if done[g.Name] {
+				continue
+			}
+			ready := true
+			for _, d := range g.DependsOn {
+				ready = ready && done[d]
+			}
+			if ready {
+				order = append(order, g)
+				done[g.Name] = true
+				progressed = true
+			}
+		}
+		if !progressed {
+			var cycle []string
+			for _, g := range instances {
+				if !done[g.Name] {
+					cycle = append(cycle, g.Name)
+				}
+			}
+			return nil, fmt.Errorf("instances %s depend on each other", strings.Join(cycle, ", "))
+		}
+	}
+	return order, nil
+}
+
+// hasDependencies reports whether some instances of the manifest depend on
+// others.
+func hasDependencies(instances []EnvInstances) bool {
+	for _, g := range instances {
+		if len(g.DependsOn) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// envUp creates the environment of the manifest, each entry's launch going
+// through the checks of config first. What was created is in the returned
+// state even when it fails.
+func envUp(c context.Context, api EnvAPI, dns Route53API, config ConfigMap, name string, manifestPath string, ttl time.Duration) (*EnvState, error) {
+	existing, err := loadEnvState(name)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("environment %s already exists, env down it first", name)
+	}
+	m, err := loadEnvManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	// The whole environment must fit the instance limits before any of it
+	// is created.
+	total := 0
+	for _, g := range m.Instances {
+		if g.Count == 0 {
+			total++
+		}
+		total += g.Count
+	}
+	if err := checkInstanceLimits(c, config.InstanceLimits, envTag, name, total); err != nil {
+		return nil, err
+	}
+
+	state := &EnvState{Name: name, Region: awsConfig.Region, Manifest: manifestPath, Created: time.Now().UTC()}
+	tags := map[string]string{envTag: name}
+	if ttl > 0 {
+		state.Expires = state.Created.Add(ttl)
+		tags[envExpiresTag] = state.Expires.Format(time.RFC3339)
+	}
+	if err := saveEnvState(state); err != nil {
+		return state, err
+	}
+
+	var subnetID string
+	if n := m.Network; n != nil {
+		state.Network = true
+		azs := n.AZs
+		if azs < 1 {
+			azs = 1
+		}
+		created, err := createNetwork(c, api, networkOptions{
+			Name: name,
+			CIDR: firstNonEmpty(n.CIDR, "10.0.0.0/16"),
+			AZs:  azs,
+			NAT:  n.NAT,
+			Tags: withProvenance(c, tags, ""),
+		})
+		if created != nil {
+			state.VpcID = created.VpcID
+		}
+		if err := saveEnvState(state); err != nil {
+			return state, err
+		}
+		if err != nil {
+			return state, fmt.Errorf("creating the network: %w", err)
+		}
+		subnetID = created.PublicSubnets[0]
+		progressln("Created network " + name + " (" + created.VpcID + ")")
+	}
+
+	order, _ := envLaunchOrder(m.Instances)
+	if hasDependencies(m.Instances) {
+		for _, g := range order {
+			state.Order = append(state.Order, g.Name)
+		}
+	}
+	// launchedIDs are the instances of each entry, and ready the entries
+	// whose instances run and pass their status checks.
+	launchedIDs := map[string][]string{}
+	ready := map[string]bool{}
+	for _, g := range order {
+		for _, d := range g.DependsOn {
+			if ready[d] {
+				continue
+			}
+			progressln("Waiting for " + name + "-" + d + " to pass its status checks before launching " + name + "-" + g.Name)
+			for _, id := range launchedIDs[d] {
+				if _, err := provisioner.WaitForRunning(c, id, 0); err != nil {
+					return state, fmt.Errorf("waiting for %s, which %s depend on: %w", d, g.Name, err)
+				}
+				err := waitForStatusChecks(c, api, id, boundedWait(envReadyTimeout), func(o *ec2.InstanceStatusOkWaiterOptions) {
+					o.MinDelay = envPollInterval
+				})
+				if err != nil {
+					return state, fmt.Errorf("waiting for %s, which %s depend on: %w", d, g.Name, err)
+				}
+			}
+			ready[d] = true
+		}
+
+		value := name + "-" + g.Name
+		want := map[string]string{"Name": value}
+		for k, v := range g.Tags {
+			want[k] = v
+		}
+		for k, v := range tags {
+			want[k] = v
+		}
+		count := g.Count
+		if count == 0 {
+			count = 1
+		}
+		launch := &launchPlan{
+			Command:      "env",
+			TagKey:       envTag,
+			TagValue:     name,
+			InstanceType: g.InstanceType,
+			ImageID:      g.ImageId,
+			Count:        count,
+			Tags:         want,
+		}
+		if err := beforeLaunch(c, config, launch); err != nil {
+			return state, fmt.Errorf("launching %s: %w", g.Name, err)
+		}
+		in := &vmcreate.CreateInput{
+			Tags:         withProvenance(c, want, hashConfig(g.DesiredGroup)),
+			Count:        count,
+			InstanceType: g.InstanceType,
+			ImageID:      g.ImageId,
+			SubnetID:     firstNonEmpty(g.SubnetId, subnetID),
+		}
+		if ip := g.PrivateIPAddress; ip != "" {
+			if _, err := choosePrivateIPs(c, networkInterfacesClient, in.SubnetID, []string{ip}, nil, 1); err != nil {
+				return state, fmt.Errorf("launching %s: %w", g.Name, err)
+			}
+			in.Customize = func(run *ec2.RunInstancesInput) { run.PrivateIpAddress = aws.String(ip) }
+		}
+		launched, err := provisioner.Create(c, in)
+		recordLifecycle(c, "env", launched, awsConfig.Region, phaseLaunching, "env "+name)
+		for _, i := range launched {
+			state.Instances = append(state.Instances, aws.ToString(i.InstanceId))
+			launchedIDs[g.Name] = append(launchedIDs[g.Name], aws.ToString(i.InstanceId))
+		}
+		if err := saveEnvState(state); err != nil {
+			return state, err
+		}
+		if err != nil {
+			return state, fmt.Errorf("launching %s: %w", g.Name, err)
+		}
+		for _, i := range launched {
+			printResult("Launched "+value+" "+aws.ToString(i.InstanceId), aws.ToString(i.InstanceId))
+		}
+		postCreateHooks(c, config, envTag, name, launched)
+
+		if g.DNSZone == "" {
+			continue
+		}
+		for _, i := range launched {
+			running, err := provisioner.WaitForRunning(c, aws.ToString(i.InstanceId), 0)
+			if err != nil {
+				return state, err
+			}
+			record := instanceDNSName(firstNonEmpty(g.DNSName, "{{name}}"), g.DNSZone, value, aws.ToString(i.InstanceId))
+			ip, err := registerDNS(c, dns, running, g.DNSZone, record, g.DNSPublicIP)
+			if err != nil {
+				return state, fmt.Errorf("registering %s: %w", record, err)
+			}
+			state.DNSRecords = append(state.DNSRecords, envRecord{Zone: g.DNSZone, Name: record})
+			if err := saveEnvState(state); err != nil {
+				return state, err
+			}
+			progressln("Registered " + record + " -> " + ip)
+		}
+	}
+	return state, nil
+}
+
+// envDown removes the environment: its DNS records, its instances, which
+// are found by envTag as well, and then its network. The state is kept
+// until everything is gone, so that env down can be run again after a
+// failure.
+func envDown(c context.Context, api NetworkAPI, dns Route53API, name string) error {
+	state, err := loadEnvState(name)
+	if err != nil {
+		return err
+	}
+	instances, err := provisioner.List(c, vmcreate.TagFilter(envTag, name), vmcreate.StateFilter(vmcreate.LiveStates...))
+	if err != nil {
+		return err
+	}
+	if state == nil && len(instances) == 0 {
+		return fmt.Errorf("there is no environment named %s", name)
+	}
+
+	if state != nil {
+		for _, r := range state.DNSRecords {
+			if err := deregisterDNS(c, dns, r.Zone, r.Name); err != nil {
+				return fmt.Errorf("deregistering %s: %w", r.Name, err)
+			}
+			progressln("Deregistered " + r.Name)
+		}
+	}
+
+	// Instances that others depended on go once those are gone, in the
+	// reverse of the order they were launched in. The rest go together.
+	tiers := [][]types.Instance{instances}
+	if state != nil && len(state.Order) > 0 {
+		byName := map[string][]types.Instance{}
+		for _, i := range instances {
+			byName[vmcreate.TagValue(&i, "Name")] = append(byName[vmcreate.TagValue(&i, "Name")], i)
+		}
+		tiers = nil
+		for n := len(state.Order) - 1; n >= 0; n-- {
+			value := name + "-" + state.Order[n]
+			if len(byName[value]) > 0 {
+				tiers = append(tiers, byName[value])
+			}
+			delete(byName, value)
+		}
+		for _, rest := range byName {
+			tiers = append(tiers, rest)
+		}
+	}
+	for n, tier := range tiers {
+		var ids []string
+		for _, i := range tier {
+			ids = append(ids, aws.ToString(i.InstanceId))
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		if _, err := provisioner.Delete(c, ids); err != nil {
+			return err
+		}
+		recordLifecycle(c, "env", tier, "", phaseTerminated, "env "+name)
+		progressln("Terminated instances " + strings.Join(ids, ", "))
+		if n < len(tiers)-1 {
+			if err := waitTerminated(c, vmcreate.InstanceIDFilter(ids...)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if state != nil && state.Network {
+		// The network can only go once the instances in it are gone.
+		if err := waitTerminated(c, vmcreate.TagFilter(envTag, name)); err != nil {
+			return err
+		}
+		if err := deleteNetwork(c, api, name); err != nil && !strings.Contains(err.Error(), "there is no network named") {
+			return fmt.Errorf("deleting the network: %w", err)
+		}
+		progressln("Deleted network " + name)
+	}
+
+	err = os.Remove(filepath.Join(envStateDir(), filepath.Base(name)+".json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// waitTerminated waits for the instances of the filter to be gone.
+func waitTerminated(c context.Context, filter types.Filter) error {
+	deadline := time.Now().Add(envTerminateTimeout)
+	for {
+		left, err := provisioner.List(c, filter, vmcreate.StateFilter(append(append([]string(nil), vmcreate.LiveStates...), "shutting-down")...))
+		if err != nil {
+			return err
+		}
+		if len(left) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("instance %s is still terminating after %s", aws.ToString(left[0].InstanceId), envTerminateTimeout)
+		}
+		time.Sleep(envPollInterval)
+	}
+}
+
+func EnvCmd(action string, name *string, manifest *string, ttl *time.Duration, expired *bool) {
+	switch action {
+	case "up":
+		// The config is optional for env, it only adds the checks before
+		// each launch.
+		config, err := loadConfig()
+		if err != nil && !os.IsNotExist(err) {
+			commandErr = err
+			fmt.Fprintln(os.Stderr, "Error loading config:", err)
+			return
+		}
+		state, err := envUp(context.TODO(), client, route53Client, config, *name, *manifest, *ttl)
+		if err != nil {
+			commandErr = err
+			fmt.Fprintln(os.Stderr, "Got an error bringing up the environment:")
+			fmt.Fprintln(os.Stderr, err)
+			if state != nil && (state.VpcID != "" || len(state.Instances) > 0) {
+				fmt.Fprintln(os.Stderr, "Remove what was created with: aws-vmcreate env down --name "+*name)
+			}
+			return
+		}
+		progressln("Environment " + *name + " is up")
+		if !state.Expires.IsZero() {
+			progressln("It expires at " + state.Expires.Format(time.RFC3339) + ", env down --expired removes it after that")
+		}
+
+	case "down":
+		names := []string{*name}
+		if *expired {
+			states, err := listEnvStates()
+			if err != nil {
+				commandErr = err
+				fmt.Fprintln(os.Stderr, "Got an error listing the environments:")
+				fmt.Fprintln(os.Stderr, err)
+				return
+			}
+			names = nil
+			for _, s := range states {
+				if s.expired(time.Now()) {
+					names = append(names, s.Name)
+				}
+			}
+			if len(names) == 0 {
+				progressln("No environment has expired")
+				return
+			}
+		}
+		for _, n := range names {
+			if err := envDown(context.TODO(), client, route53Client, n); err != nil {
+				commandErr = err
+				fmt.Fprintln(os.Stderr, "Got an error tearing down environment "+n+":")
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+			printResult("Environment "+n+" is down", n)
+		}
+
+	case "list":
+		states, err := listEnvStates()
+		if err != nil {
+			commandErr = err
+			fmt.Fprintln(os.Stderr, "Got an error listing the environments:")
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		if len(states) == 0 {
+			progressln("No environments")
+			return
+		}
+		now := time.Now()
+		for _, s := range states {
+			expires := "no ttl"
+			switch {
+			case s.expired(now):
+				expires = "expired " + s.Expires.Format(time.RFC3339)
+			case !s.Expires.IsZero():
+				expires = "expires " + s.Expires.Format(time.RFC3339)
+			}
+			printResult(fmt.Sprintf("%s\t%s\t%d instances\t%s", s.Name, s.Region, len(s.Instances), expires), s.Name)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeRoute53 keeps the A records of one hosted zone.
+type fakeRoute53 struct {
+	zone    string
+	records map[string]string
+}
+
+func (f *fakeRoute53) ListHostedZonesByName(ctx context.Context, dnsName string) (*awsapi.ListHostedZonesByNameOutput, error) {
+	return &awsapi.ListHostedZonesByNameOutput{HostedZones: []awsapi.HostedZone{{Id: "/hostedzone/Z1", Name: fqdn(f.zone)}}}, nil
+}
+
+func (f *fakeRoute53) ListResourceRecordSets(ctx context.Context, zoneID, name, recordType string) (*awsapi.ListResourceRecordSetsOutput, error) {
+	out := &awsapi.ListResourceRecordSetsOutput{}
+	if ip, ok := f.records[name]; ok {
+		out.ResourceRecordSets = append(out.ResourceRecordSets, awsapi.ResourceRecordSet{Name: name, Type: "A", ResourceRecords: []awsapi.ResourceRecord{{Value: ip}}})
+	}
+	return out, nil
+}
+
+func (f *fakeRoute53) ChangeResourceRecordSets(ctx context.Context, zoneID string, batch *awsapi.ChangeBatch) (*awsapi.ChangeResourceRecordSetsOutput, error) {
+	for _, change := range batch.Changes {
+		if change.Action == "DELETE" {
+			delete(f.records, change.ResourceRecordSet.Name)
+		} else {
+			f.records[change.ResourceRecordSet.Name] = change.ResourceRecordSet.ResourceRecords[0].Value
+		}
+	}
+	return &awsapi.ChangeResourceRecordSetsOutput{}, nil
+}
+
+func writeManifest(t *testing.T, manifest string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "env.yaml")
+	if err := os.WriteFile(path, []byte(manifest), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEnvUpAndDown(t *testing.T) {
+	fake := useFakeEC2(t)
+	envPollInterval = time.Millisecond
+	t.Cleanup(func() { envPollInterval = 5 * time.Second })
+	c := context.Background()
+	network := &fakeNetwork{FakeEC2: fake}
+	dns := &fakeRoute53{zone: "dev.example.com", records: map[string]string{}}
+	manifest := writeManifest(t, `network:
+  cidr: 10.42.0.0/16
+instances:
+  - name: web
+    count: 2
+    instance_type: t3.small
+    image_id: ami-1
+    dns_zone: dev.example.com
+    dns_name: "{{name}}-{{id}}"
+  - name: db
+    instance_type: t3.medium
+    image_id: ami-2
+    tags:
+      role: db
+`)
+
+	state, err := envUp(c, network, dns, ConfigMap{}, "pr-1234", manifest, 6*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Instances) != 3 || len(state.DNSRecords) != 2 || state.VpcID == "" {
+		t.Fatalf("state = %+v", state)
+	}
+	if len(dns.records) != 2 {
+		t.Errorf("records = %v", dns.records)
+	}
+	instances, _ := provisioner.List(c, vmcreate.TagFilter(envTag, "pr-1234"))
+	for _, i := range instances {
+		if vmcreate.TagValue(&i, envExpiresTag) == "" || !strings.HasPrefix(vmcreate.TagValue(&i, "Name"), "pr-1234-") {
+			t.Errorf("tags of %s = %v", *i.InstanceId, i.Tags)
+		}
+	}
+	if loaded, _ := loadEnvState("pr-1234"); loaded == nil || loaded.expired(time.Now()) || !loaded.expired(time.Now().Add(7*time.Hour)) {
+		t.Errorf("saved state = %+v", loaded)
+	}
+
+	if _, err := envUp(c, network, dns, ConfigMap{}, "pr-1234", manifest, 0); err == nil {
+		t.Error("second env up of the same name succeeded")
+	}
+
+	if err := envDown(c, network, dns, "pr-1234"); err != nil {
+		t.Fatal(err)
+	}
+	if live := liveInstances(fake); len(live) != 0 {
+		t.Errorf("%d instances left", len(live))
+	}
+	if len(dns.records) != 0 {
+		t.Errorf("records %v left", dns.records)
+	}
+	if calls := network.calls; calls[len(calls)-1] != "delete "+state.VpcID {
+		t.Errorf("the VPC was not deleted last: %v", calls)
+	}
+	if loaded, _ := loadEnvState("pr-1234"); loaded != nil {
+		t.Error("state was kept after env down")
+	}
+	if err := envDown(c, network, dns, "pr-1234"); err == nil {
+		t.Error("env down of a removed environment succeeded")
+	}
+}
+
+func TestLoadEnvManifest(t *testing.T) {
+	for manifest, want := range map[string]string{
+		"instances:\n  - instance_type: t3.micro\n    image_id: ami-1\n":                                                 "no name",
+		"instances:\n  - name: web\n    image_id: ami-1\n":                                                               "need instance_type",
+		"instances:\n  - name: web\n    count: 2\n    instance_type: t3.micro\n    image_id: ami-1\n    dns_zone: a.b\n": "{{id}}",
+		"network:\n  nat: true\n": "no instances",
+		"instances:\n  - name: web\n    count: 2\n    instance_type: t3.micro\n    image_id: ami-1\n    private_ip_address: 10.0.1.5\n":                                                                      "one private_ip_address",
+		"instances:\n  - name: web\n    instance_type: t3.micro\n    image_id: ami-1\n    depends_on:\n      - db\n":                                                                                         "not in the manifest",
+		"instances:\n  - name: a\n    instance_type: t3.micro\n    image_id: ami-1\n    depends_on:\n      - b\n  - name: b\n    instance_type: t3.micro\n    image_id: ami-1\n    depends_on:\n      - a\n": "depend on each other",
+	} {
+		if _, err := loadEnvManifest(writeManifest(t, manifest)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got %v, want an error with %q", manifest, err, want)
+		}
+	}
+}
+
+// DescribeInstanceStatus reports the checks of the instances as passing once
+// f.initializing runs out, recording how many instances were launched then.
+func (f *fakeNetwork) DescribeInstanceStatus(ctx context.Context, params *ec2.DescribeInstanceStatusInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceStatusOutput, error) {
+	check := types.SummaryStatusOk
+	if f.initializing > 0 {
+		f.initializing--
+		check = types.SummaryStatusInitializing
+	}
+	out := &ec2.DescribeInstanceStatusOutput{}
+	for _, id := range params.InstanceIds {
+		f.record("DescribeInstanceStatus %s %s with %d launched", id, check, len(f.Instances()))
+		status := types.InstanceStatus{InstanceId: aws.String(id)}
+		status.SystemStatus, status.InstanceStatus = checks(check, check)
+		out.InstanceStatuses = append(out.InstanceStatuses, status)
+	}
+	return out, nil
+}
+
+func TestEnvDependsOn(t *testing.T) {
+	fake := useFakeEC2(t)
+	c := context.Background()
+	manifest := writeManifest(t, `instances:
+  - name: app
+    count: 2
+    instance_type: t3.small
+    image_id: ami-1
+    depends_on:
+      - db
+  - name: db
+    instance_type: t3.medium
+    image_id: ami-2
+`)
+
+	envPollInterval = time.Millisecond
+	t.Cleanup(func() { envPollInterval = 5 * time.Second })
+	network := &fakeNetwork{FakeEC2: fake, initializing: 1}
+	state, err := envUp(c, network, nil, ConfigMap{}, "pr-7", manifest, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(state.Order, ",") != "db,app" {
+		t.Errorf("order = %v", state.Order)
+	}
+	// The instances are numbered as they launch.
+	instances := fake.Instances()
+	if len(instances) != 3 || vmcreate.TagValue(&instances[0], "Name") != "pr-7-db" {
+		t.Fatalf("launched %v first", instances[0].Tags)
+	}
+	// app waits for the status checks of db to pass, not only for it to run.
+	db := aws.ToString(instances[0].InstanceId)
+	want := "DescribeInstanceStatus " + db + " initializing with 1 launched,DescribeInstanceStatus " + db + " ok with 1 launched"
+	if got := strings.Join(network.calls, ","); got != want {
+		t.Errorf("calls = %s, want %s", got, want)
+	}
+
+	if err := envDown(c, &fakeNetwork{FakeEC2: fake}, nil, "pr-7"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countCalls(fake.Calls(), "TerminateInstances"); n != 2 {
+		t.Errorf("%d terminations, want app and then db", n)
+	}
+	if live := liveInstances(fake); len(live) != 0 {
+		t.Errorf("%d instances left", len(live))
+	}
+}
+
+func TestEnvPrivateIPAddress(t *testing.T) {
+	fake := useFakeEC2(t)
+	c := context.Background()
+	manifest := writeManifest(t, `instances:
+  - name: db
+    instance_type: t3.medium
+    image_id: ami-1
+    subnet_id: subnet-1
+    private_ip_address: 10.0.1.5
+`)
+
+	if _, err := envUp(c, &fakeNetwork{FakeEC2: fake}, nil, ConfigMap{}, "pr-8", manifest, 0); err != nil {
+		t.Fatal(err)
+	}
+	if ip := aws.ToString(fake.Instances()[0].PrivateIpAddress); ip != "10.0.1.5" {
+		t.Errorf("launched at %s", ip)
+	}
+
+	// Another environment cannot take the address.
+	_, err := envUp(c, &fakeNetwork{FakeEC2: fake}, nil, ConfigMap{}, "pr-9", manifest, 0)
+	if err == nil || !strings.Contains(err.Error(), "10.0.1.5 is used by") {
+		t.Errorf("err = %v, want the conflict", err)
+	}
+	if n := len(fake.Instances()); n != 1 {
+		t.Errorf("%d instances, want the second launch refused", n)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// migratableEvents are the scheduled events a stop and start avoids, by
+// moving the instance to a new host. Reboots happen on the same host.
+var migratableEvents = []types.EventCode{types.EventCodeSystemMaintenance, types.EventCodeInstanceRetirement, types.EventCodeInstanceStop}
+
+// scheduledEvent is an upcoming event of an instance.
+type scheduledEvent struct {
+	InstanceID string
+	Name       string
+	Event      types.InstanceStatusEvent
+}
+
+// upcomingEvents returns the pending events of the instances, soonest first.
+func upcomingEvents(health []instanceHealth) []scheduledEvent {
+	var events []scheduledEvent
+	for _, h := range health {
+		for _, e := range h.Events {
+			events = append(events, scheduledEvent{InstanceID: h.InstanceID, Name: h.Name, Event: e})
+		}
+	}
+	sort.SliceStable(events, func(a, b int) bool {
+		return aws.ToTime(events[a].Event.NotBefore).Before(aws.ToTime(events[b].Event.NotBefore))
+	})
+	return events
+}
+
+// migrationPlan returns the instances events migrate stops and starts ahead
+// of their events, and why each of the other instances with events is left
+// alone: only running EBS-backed instances move hosts, and only for the
+// events that are not reboots.
+func migrationPlan(health []instanceHealth) ([]string, map[string]string) {
+	var migrate []string
+	skipped := map[string]string{}
+	for _, h := range health {
+		var codes []string
+		movable := false
+		for _, e := range h.Events {
+			codes = append(codes, string(e.Code))
+			for _, code := range migratableEvents {
+				movable = movable || e.Code == code
+			}
+		}
+		switch {
+		case len(h.Events) == 0:
+		case !movable:
+			skipped[h.InstanceID] = strings.Join(codes, ", ") + " is not avoided by moving hosts, reboot the instance before it instead"
+		case h.State != "running":
+			skipped[h.InstanceID] = "the instance is " + h.State + ", it moves hosts when started"
+		case h.RootDeviceType != string(types.DeviceTypeEbs):
+			skipped[h.InstanceID] = "instance store backed instances cannot be stopped, replace the instance instead"
+		default:
+			migrate = append(migrate, h.InstanceID)
+		}
+	}
+	return migrate, skipped
+}
+
+func EventsCmd(action string, name *string, value *string, dryRun *bool, yes *bool) {
+	// Without a tag, the instances created by aws-vmcreate are checked.
+	filters := []types.Filter{vmcreate.TagKeyFilter(createdByTag)}
+	if *name != "" && *value != "" {
+		filters[0] = vmcreate.TagFilter(*name, strings.Split(*value, ",")...)
+	} else if *name != "" {
+		filters[0] = vmcreate.TagKeyFilter(*name)
+	}
+	health, err := fleetHealth(context.TODO(), client, filters)
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error listing the scheduled events:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	events := upcomingEvents(health)
+	if len(events) == 0 {
+		fmt.Println("No scheduled events")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tNAME\tEVENT\tNOT BEFORE\tDEADLINE\tDESCRIPTION")
+	for _, e := range events {
+		deadline := "-"
+		if e.Event.NotBeforeDeadline != nil {
+			deadline = e.Event.NotBeforeDeadline.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", e.InstanceID, e.Name, e.Event.Code,
+			aws.ToTime(e.Event.NotBefore).Local().Format("2006-01-02 15:04"), deadline, aws.ToString(e.Event.Description))
+	}
+	w.Flush()
+	if action != "migrate" {
+		return
+	}
+
+	migrate, skipped := migrationPlan(health)
+	for _, h := range health {
+		if reason, ok := skipped[h.InstanceID]; ok {
+			fmt.Println("Skipping " + h.InstanceID + ": " + reason)
+		}
+	}
+	if len(migrate) == 0 {
+		fmt.Println("No instance can be moved ahead of its event")
+		return
+	}
+	if *dryRun {
+		fmt.Println("Would stop and start " + strings.Join(migrate, ", "))
+		return
+	}
+	if !*yes {
+		if !stdinIsTerminal() {
+			failCommand("Pass --yes to stop and start the instances without a terminal to confirm on")
+			return
+		}
+		if !confirm(fmt.Sprintf("Stop and start these %d instances to move them to new hosts?", len(migrate))) {
+			return
+		}
+	}
+	var ops []operation
+	for _, id := range migrate {
+		id := id
+		ops = append(ops, operation{
+			Name:  "moving " + id,
+			Done:  "Moved instance with ID " + id + " to a new host",
+			Calls: 2,
+			Run: func(c context.Context) error {
+				return provisioner.Migrate(c, id)
+			},
+		})
+	}
+	for _, err := range newOperationQueue("migrate").Run(context.TODO(), ops) {
+		if err != nil {
+			commandErr = err
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestMigrationPlan(t *testing.T) {
+	now := time.Now()
+	event := func(code types.EventCode, in time.Duration) []types.InstanceStatusEvent {
+		return []types.InstanceStatusEvent{{Code: code, NotBefore: aws.Time(now.Add(in))}}
+	}
+	health := []instanceHealth{
+		{InstanceID: "i-maintenance", State: "running", RootDeviceType: "ebs", Events: event(types.EventCodeSystemMaintenance, 48*time.Hour)},
+		{InstanceID: "i-retiring", State: "running", RootDeviceType: "ebs", Events: event(types.EventCodeInstanceRetirement, 24*time.Hour)},
+		{InstanceID: "i-reboot", State: "running", RootDeviceType: "ebs", Events: event(types.EventCodeSystemReboot, time.Hour)},
+		{InstanceID: "i-stopped", State: "stopped", RootDeviceType: "ebs", Events: event(types.EventCodeInstanceStop, 72*time.Hour)},
+		{InstanceID: "i-store", State: "running", RootDeviceType: "instance-store", Events: event(types.EventCodeInstanceRetirement, 96*time.Hour)},
+		{InstanceID: "i-quiet", State: "running", RootDeviceType: "ebs"},
+	}
+
+	migrate, skipped := migrationPlan(health)
+	if strings.Join(migrate, ",") != "i-maintenance,i-retiring" {
+		t.Errorf("migrates %v", migrate)
+	}
+	for _, id := range []string{"i-reboot", "i-stopped", "i-store"} {
+		if skipped[id] == "" {
+			t.Errorf("%s is not skipped with a reason", id)
+		}
+	}
+	if _, ok := skipped["i-quiet"]; ok {
+		t.Error("an instance without events is not skipped")
+	}
+
+	var order []string
+	for _, e := range upcomingEvents(health) {
+		order = append(order, e.InstanceID)
+	}
+	if strings.Join(order, ",") != "i-reboot,i-retiring,i-maintenance,i-stopped,i-store" {
+		t.Errorf("events in the order %v, want the soonest first", order)
+	}
+}
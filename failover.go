@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// FailoverRegion is a region create falls back to when the default region
+// has no capacity. AMI and subnet ids are regional, so each region names its
+// own; an empty subnet means the region's default VPC, and no security
+// groups its default security group.
+type FailoverRegion struct {
+	Region           string   `json:"region"`
+	ImageId          string   `json:"image_id"`
+	SubnetId         string   `json:"subnet_id,omitempty"`
+	SecurityGroupIds []string `json:"security_group_ids,omitempty"`
+}
+
+// createWithFailover launches the instance in the default region and then in
+// each failover region in turn while the launch fails for lack of capacity
+// or quota. It returns the instances and the region they were launched in;
+// the service clients are switched to that region for the rest of create.
+func createWithFailover(c context.Context, in *vmcreate.CreateInput, failover []FailoverRegion) ([]types.Instance, string, error) {
+	region := awsConfig.Region
+	instances, err := provisioner.Create(c, in)
+	for _, next := range failover {
+		if err == nil || !vmcreate.IsCapacityError(err) {
+			break
+		}
+		progressln("No capacity in " + region + ", trying " + next.Region + ":")
+		progressln(err)
+
+		cfg := awsConfig.Copy()
+		cfg.Region = next.Region
+		p := provisionerFor(cfg)
+		retry := *in
+		retry.ImageID = next.ImageId
+		retry.SubnetID = next.SubnetId
+		retry.Customize = func(run *ec2.RunInstancesInput) {
+			if in.Customize != nil {
+				in.Customize(run)
+			}
+			run.SecurityGroupIds = next.SecurityGroupIds
+		}
+
+		region = next.Region
+		instances, err = p.Create(c, &retry)
+		if err == nil {
+			newClients(cfg)
+			provisioner = p
+		}
+	}
+	return instances, region, err
+}
+
+// validateFailover checks the failover regions in the config.
+func validateFailover(failover []FailoverRegion) error {
+	for i, r := range failover {
+		if r.Region == "" || r.ImageId == "" {
+			return fmt.Errorf("region_failover entry %d needs region and image_id", i+1)
+		}
+	}
+	return nil
+}
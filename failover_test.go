@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"aws-vmcreate/pkg/vmcreate"
+	"aws-vmcreate/pkg/vmcreate/vmcreatetest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestCreateRegionFailover(t *testing.T) {
+	fakes := useRegionFakes(t, "us-west-2", "eu-west-1")
+	primary := vmcreatetest.NewFakeEC2()
+	primary.Fail("RunInstances", vmcreatetest.APIError("InsufficientInstanceCapacity", "no t2.micro capacity"))
+	provisioner = vmcreate.New(primary)
+	fakes["us-west-2"].Fail("RunInstances", vmcreatetest.APIError("VcpuLimitExceeded", "vCPU limit reached"))
+	useConfig(t, ConfigMap{
+		InstanceType: "t2.micro",
+		ImageId:      "ami-primary",
+		RegionFailover: []FailoverRegion{
+			{Region: "us-west-2", ImageId: "ami-west"},
+			{Region: "eu-west-1", ImageId: "ami-eu", SubnetId: "subnet-eu"},
+		},
+	})
+
+	out := runCLI(t, "create", "--tag", "Name=web-1")
+
+	instances := fakes["eu-west-1"].Instances()
+	if len(instances) != 1 {
+		t.Fatalf("launched %d instances in eu-west-1, want 1\n%s", len(instances), out)
+	}
+	i := instances[0]
+	if aws.ToString(i.ImageId) != "ami-eu" || aws.ToString(i.SubnetId) != "subnet-eu" {
+		t.Errorf("launched %s in %s, want the eu-west-1 image and subnet", aws.ToString(i.ImageId), aws.ToString(i.SubnetId))
+	}
+	if !strings.Contains(out, "trying us-west-2") || !strings.Contains(out, "No capacity in us-west-2, trying eu-west-1") {
+		t.Errorf("output does not report the failover:\n%s", out)
+	}
+	if !strings.Contains(out, "Created tagged instance with ID "+aws.ToString(i.InstanceId)+" in eu-west-1") {
+		t.Errorf("output does not report the region:\n%s", out)
+	}
+}
+
+func TestCreateRegionFailoverStopsOnOtherErrors(t *testing.T) {
+	fakes := useRegionFakes(t, "us-west-2")
+	fake := useFakeEC2(t)
+	fake.Fail("RunInstances", vmcreatetest.APIError("InvalidAMIID.NotFound", "no such image"))
+	useConfig(t, ConfigMap{
+		InstanceType:   "t2.micro",
+		ImageId:        "ami-missing",
+		RegionFailover: []FailoverRegion{{Region: "us-west-2", ImageId: "ami-west"}},
+	})
+
+	out := runCLI(t, "create", "--tag", "Name=web-1")
+
+	if n := len(fakes["us-west-2"].Instances()); n != 0 {
+		t.Errorf("failed over on a non-capacity error, launched %d instances\n%s", n, out)
+	}
+	if !strings.Contains(out, "Got an error creating an instance:") {
+		t.Errorf("output:\n%s", out)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// ForensicsConfig is where quarantine --capture sends what it collects
+// from an instance before isolating it.
+type ForensicsConfig struct {
+	// Bucket and Prefix are where the output of the capture documents is
+	// written. The instance's own role writes it, so the bucket, which may
+	// be in the forensics account, must let it.
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix,omitempty"`
+	// Account is the forensics account the volume snapshots are shared with.
+	Account string `json:"account,omitempty"`
+	// Documents are the SSM documents run on the instance, such as one that
+	// captures its memory. By default the volatile data commands are run
+	// with AWS-RunShellScript.
+	Documents []string `json:"documents,omitempty"`
+	// Timeout is how long each document may run, 30m by default.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// volatileDataCommands collect the state of a Linux instance that is lost
+// once it is isolated or stopped.
+var volatileDataCommands = []string{
+	"date -u",
+	"uptime",
+	"who -a",
+	"last -n 50",
+	"ps auxwwf",
+	"ss -tanup",
+	"ip addr",
+	"ip route",
+	"ip neigh",
+	"lsmod",
+	"mount",
+	"ls -la /proc/*/exe 2>/dev/null",
+	"cat /proc/*/cmdline 2>/dev/null | tr '\\0' ' '",
+	"find /tmp /var/tmp /dev/shm -xdev -type f -mtime -7 -ls 2>/dev/null",
+}
+
+// SnapshotSharingAPI defines the interface for the shareSnapshots function.
+// We use this interface to test the function using a mocked service.
+type SnapshotSharingAPI interface {
+	ec2.DescribeSnapshotsAPIClient
+
+	ModifySnapshotAttribute(ctx context.Context,
+		params *ec2.ModifySnapshotAttributeInput,
+		optFns ...func(*ec2.Options)) (*ec2.ModifySnapshotAttributeOutput, error)
+}
+
+// snapshotShareTimeout is how long quarantine --capture waits for the
+// snapshots to complete before sharing them.
+var snapshotShareTimeout = 2 * time.Hour
+
+// captureVolatileData runs the capture documents of config on the instance,
+// one after the other, with their output written to the forensics bucket
+// under PREFIX/INSTANCE_ID/TIME. It returns the S3 location.
+func captureVolatileData(c context.Context, api SSMCommandAPI, instanceID string, config *ForensicsConfig, now time.Time) (string, error) {
+	timeout := 30 * time.Minute
+	if config.Timeout != "" {
+		d, err := time.ParseDuration(config.Timeout)
+		if err != nil {
+			return "", fmt.Errorf("forensics timeout: %w", err)
+		}
+		timeout = d
+	}
+	prefix := strings.TrimSuffix(config.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	prefix += instanceID + "/" + now.Format("20060102-150405")
+
+	inputs := []*awsapi.SendCommandInput{}
+	for _, document := range config.Documents {
+		inputs = append(inputs, &awsapi.SendCommandInput{DocumentName: document})
+	}
+	if len(inputs) == 0 {
+		inputs = append(inputs, &awsapi.SendCommandInput{
+			DocumentName: "AWS-RunShellScript",
+			Parameters:   map[string][]string{"commands": volatileDataCommands},
+		})
+	}
+
+	c, cancel := context.WithTimeout(c, timeout*time.Duration(len(inputs)))
+	defer cancel()
+	for _, input := range inputs {
+		input.InstanceIds = []string{instanceID}
+		input.Comment = "aws-vmcreate quarantine capture"
+		input.TimeoutSeconds = int(timeout.Seconds())
+		input.OutputS3BucketName = config.Bucket
+		input.OutputS3KeyPrefix = prefix
+		sent, err := RunCommand(c, api, input)
+		if err != nil {
+			return "", fmt.Errorf("running %s: %w", input.DocumentName, err)
+		}
+		if _, err := waitForCommand(c, api, sent.Command.CommandId, instanceID, nil); err != nil {
+			return "", fmt.Errorf("running %s: %w", input.DocumentName, err)
+		}
+	}
+	return "s3://" + config.Bucket + "/" + prefix, nil
+}
+
+// shareSnapshots waits for the snapshots to complete and lets the account
+// create volumes from them. Snapshots encrypted with the default aws/ebs
+// key cannot be shared; those need a customer managed key the account may
+// use.
+func shareSnapshots(c context.Context, api SnapshotSharingAPI, snapshotIDs []string, account string) error {
+	if len(snapshotIDs) == 0 {
+		return nil
+	}
+	if err := ec2.NewSnapshotCompletedWaiter(api).Wait(c, &ec2.DescribeSnapshotsInput{SnapshotIds: snapshotIDs}, boundedWait(snapshotShareTimeout)); err != nil {
+		return fmt.Errorf("waiting for the snapshots: %w", err)
+	}
+	for _, id := range snapshotIDs {
+		_, err := api.ModifySnapshotAttribute(c, &ec2.ModifySnapshotAttributeInput{
+			SnapshotId: aws.String(id),
+			Attribute:  types.SnapshotAttributeNameCreateVolumePermission,
+			CreateVolumePermission: &types.CreateVolumePermissionModifications{
+				Add: []types.CreateVolumePermission{{UserId: aws.String(account)}},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("sharing %s with %s: %w", id, account, err)
+		}
+	}
+	return nil
+}
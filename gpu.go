@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// GPUAPI defines the interface for the functions checking GPU and accelerator launches.
+// We use this interface to test the functions using a mocked service.
+type GPUAPI interface {
+	DescribeInstanceTypeOfferings(ctx context.Context,
+		params *ec2.DescribeInstanceTypeOfferingsInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceTypeOfferingsOutput, error)
+
+	DescribeImages(ctx context.Context,
+		params *ec2.DescribeImagesInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeImagesOutput, error)
+}
+
+// The accelerators whose launches are checked.
+const (
+	acceleratorNVIDIA = "nvidia"
+	acceleratorNeuron = "neuron"
+)
+
+// dlamiNames are the name patterns of the Deep Learning AMIs suggested for
+// each accelerator and architecture.
+var dlamiNames = map[string]string{
+	acceleratorNVIDIA + "/x86_64": "Deep Learning Base OSS Nvidia Driver GPU AMI (Ubuntu 22.04) *",
+	acceleratorNVIDIA + "/arm64":  "Deep Learning ARM64 Base OSS Nvidia Driver GPU AMI (Ubuntu 22.04) *",
+	acceleratorNeuron + "/x86_64": "Deep Learning AMI Neuron (Ubuntu 22.04) *",
+}
+
+// acceleratorKind returns the accelerator of the instance type: nvidia for
+// the P and G families with NVIDIA GPUs, neuron for Inferentia and
+// Trainium, or "" for the others.
+func acceleratorKind(t *instanceType) string {
+	switch class := quotaClass(t.Name); {
+	case class == "inf" || class == "trn":
+		return acceleratorNeuron
+	case (class == "p" || class == "g") && !strings.HasPrefix(t.GPUName, "AMD"):
+		return acceleratorNVIDIA
+	}
+	return ""
+}
+
+// acceleratorZones returns the availability zones of the region offering
+// the instance type. Accelerated types are offered in few of them.
+func acceleratorZones(c context.Context, api GPUAPI, instanceType string) ([]string, error) {
+	offerings, err := api.DescribeInstanceTypeOfferings(c, &ec2.DescribeInstanceTypeOfferingsInput{
+		LocationType: types.LocationTypeAvailabilityZone,
+		Filters:      []types.Filter{{Name: aws.String("instance-type"), Values: []string{instanceType}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var zones []string
+	for _, o := range offerings.InstanceTypeOfferings {
+		zones = append(zones, aws.ToString(o.Location))
+	}
+	sort.Strings(zones)
+	return zones, nil
+}
+
+// latestDLAMI returns the newest Deep Learning AMI for the accelerator and
+// architecture, or nil when there is none.
+func latestDLAMI(c context.Context, api GPUAPI, kind string, architecture string) (*types.Image, error) {
+	name, ok := dlamiNames[kind+"/"+architecture]
+	if !ok {
+		return nil, nil
+	}
+	images, err := api.DescribeImages(c, &ec2.DescribeImagesInput{
+		Owners: []string{"amazon"},
+		Filters: []types.Filter{
+			{Name: aws.String("name"), Values: []string{name}},
+			{Name: aws.String("state"), Values: []string{"available"}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var latest *types.Image
+	for n, i := range images.Images {
+		if latest == nil || aws.ToString(i.CreationDate) > aws.ToString(latest.CreationDate) {
+			latest = &images.Images[n]
+		}
+	}
+	return latest, nil
+}
+
+// acceleratorChecks checks a launch of an accelerated instance type, which
+// otherwise fails in confusing ways: that a zone of the region offers it,
+// and that the image has its drivers, suggesting the Deep Learning AMI when
+// it may not. It returns nothing for other types. Without gpuDrivers, an
+// image that is not a Deep Learning AMI is a warning.
+func acceleratorChecks(c context.Context, api GPUAPI, s launchSettings, t *instanceType, gpuDrivers bool) []validationCheck {
+	kind := acceleratorKind(t)
+	if kind == "" {
+		return nil
+	}
+
+	zones := validationCheck{Name: "accelerator zones"}
+	offered, err := acceleratorZones(c, api, t.Name)
+	switch {
+	case err != nil:
+		zones.Warning, zones.Err = true, err
+	case len(offered) == 0:
+		zones.Err = fmt.Errorf("no availability zone of %s offers %s", s.Region, t.Name)
+	default:
+		zones.Detail = t.Name + " is offered in " + strings.Join(offered, ", ")
+	}
+	checks := []validationCheck{zones}
+
+	image := validationCheck{Name: "accelerator image"}
+	images, err := api.DescribeImages(c, &ec2.DescribeImagesInput{ImageIds: []string{s.ImageID}})
+	if err != nil || len(images.Images) == 0 {
+		// The image check reports why.
+		return checks
+	}
+	name := aws.ToString(images.Images[0].Name)
+	switch {
+	case strings.Contains(name, "Deep Learning"):
+		image.Detail = s.ImageID + " is a Deep Learning AMI"
+	case gpuDrivers:
+		image.Detail = "the NVIDIA drivers are installed at boot"
+	default:
+		image.Warning = true
+		architecture := string(images.Images[0].Architecture)
+		dlami, err := latestDLAMI(c, api, kind, architecture)
+		switch {
+		case err != nil:
+			image.Err = fmt.Errorf("%s is not a Deep Learning AMI and may lack the %s drivers, and looking up one failed: %w", s.ImageID, kind, err)
+		case dlami == nil:
+			image.Err = fmt.Errorf("%s is not a Deep Learning AMI and may lack the %s drivers", s.ImageID, kind)
+		case kind == acceleratorNVIDIA:
+			image.Err = fmt.Errorf("%s is not a Deep Learning AMI and may lack the NVIDIA drivers, use --image-id %s (%s) or --gpu-drivers",
+				s.ImageID, aws.ToString(dlami.ImageId), aws.ToString(dlami.Name))
+		default:
+			image.Err = fmt.Errorf("%s is not a Deep Learning AMI and may lack the Neuron drivers, use --image-id %s (%s)",
+				s.ImageID, aws.ToString(dlami.ImageId), aws.ToString(dlami.Name))
+		}
+	}
+	return append(checks, image)
+}
+
+// nvidiaDriverUserData installs the NVIDIA datacenter drivers at boot, on
+// Amazon Linux 2023 from NVIDIA's repository and on Ubuntu with
+// ubuntu-drivers.
+func nvidiaDriverUserData() string {
+	return `# NVIDIA drivers (--gpu-drivers)
+if command -v dnf >/dev/null; then
+  dnf install -y kernel-devel-$(uname -r) kernel-modules-extra dkms
+  dnf config-manager --add-repo "https://developer.download.nvidia.com/compute/cuda/repos/amzn2023/$(uname -m | sed s/aarch64/sbsa/)/cuda-amzn2023.repo"
+  dnf module install -y nvidia-driver:latest-dkms
+elif command -v apt-get >/dev/null; then
+  apt-get update
+  DEBIAN_FRONTEND=noninteractive apt-get install -y ubuntu-drivers-common
+  ubuntu-drivers install --gpgpu
+fi
+nvidia-smi || echo "nvidia-smi failed, the drivers may need a reboot"
+`
+}
+
+// checkAcceleratedLaunch runs the accelerator checks of a create, with the
+// subnet's zone when one is set, printing what they found. It returns the
+// first failed check.
+func checkAcceleratedLaunch(c context.Context, api ValidateEC2API, config ConfigMap, t *instanceType, gpuDrivers bool) error {
+	kind := acceleratorKind(t)
+	if gpuDrivers && kind != acceleratorNVIDIA {
+		return fmt.Errorf("--gpu-drivers installs the NVIDIA drivers, which %s does not use", t.Name)
+	}
+	if kind == "" {
+		return nil
+	}
+
+	s := launchSettings{Region: awsConfig.Region, InstanceType: t.Name, ImageID: config.ImageId, SubnetID: config.SubnetId}
+	checks := acceleratorChecks(c, api, s, t, gpuDrivers)
+	if s.SubnetID != "" {
+		_, check := validateSubnet(c, api, s.SubnetID, t.Name)
+		checks = append(checks, check)
+	}
+	for _, check := range checks {
+		switch {
+		case check.Err == nil:
+			progressln(check.Name + ": " + check.Detail)
+		case check.Warning:
+			fmt.Fprintln(os.Stderr, "Warning: "+check.Err.Error())
+		default:
+			return check.Err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestAcceleratorKind(t *testing.T) {
+	for name, want := range map[string]string{
+		"p4d.24xlarge": acceleratorNVIDIA,
+		"g5.xlarge":    acceleratorNVIDIA,
+		"g5g.xlarge":   acceleratorNVIDIA,
+		"inf2.xlarge":  acceleratorNeuron,
+		"trn1.2xlarge": acceleratorNeuron,
+		"m6i.large":    "",
+	} {
+		if got := acceleratorKind(&instanceType{Name: name}); got != want {
+			t.Errorf("%s: %q, want %q", name, got, want)
+		}
+	}
+	if got := acceleratorKind(&instanceType{Name: "g4ad.xlarge", GPUName: "AMD Radeon Pro V520"}); got != "" {
+		t.Errorf("g4ad.xlarge: %q, want no checks for AMD GPUs", got)
+	}
+}
+
+func TestAcceleratorChecks(t *testing.T) {
+	api := newFakeValidateEC2(t)
+	api.zones = []string{"us-east-1d", "us-east-1a"}
+	api.images = append(api.images,
+		types.Image{ImageId: aws.String("ami-dlami-old"), Name: aws.String("Deep Learning Base OSS Nvidia Driver GPU AMI (Ubuntu 22.04) 20240101"), CreationDate: aws.String("2024-01-01T00:00:00.000Z")},
+		types.Image{ImageId: aws.String("ami-dlami"), Name: aws.String("Deep Learning Base OSS Nvidia Driver GPU AMI (Ubuntu 22.04) 20241001"), CreationDate: aws.String("2024-10-01T00:00:00.000Z")},
+	)
+	c := context.Background()
+	s := launchSettings{Region: "us-east-1", InstanceType: "g5.xlarge", ImageID: "ami-ok"}
+	g5 := &instanceType{Name: "g5.xlarge", Architectures: []string{"x86_64"}, GPUs: 1, GPUName: "NVIDIA A10G"}
+
+	results := checkResults(acceleratorChecks(c, api, s, g5, false))
+	if results["accelerator zones"] != "ok" {
+		t.Errorf("zones: %s", results["accelerator zones"])
+	}
+	if image := results["accelerator image"]; !strings.HasPrefix(image, "warning: ") || !strings.Contains(image, "--image-id ami-dlami (") {
+		t.Errorf("image: %q, want a warning suggesting the newest DLAMI", image)
+	}
+	checks := acceleratorChecks(c, api, s, g5, false)
+	if detail := checks[0].Detail; detail != "g5.xlarge is offered in us-east-1a, us-east-1d" {
+		t.Errorf("zones detail = %q", detail)
+	}
+
+	if results := checkResults(acceleratorChecks(c, api, s, g5, true)); results["accelerator image"] != "ok" {
+		t.Errorf("with --gpu-drivers the image is %q, want ok", results["accelerator image"])
+	}
+	s.ImageID = "ami-dlami"
+	if results := checkResults(acceleratorChecks(c, api, s, g5, false)); results["accelerator image"] != "ok" {
+		t.Errorf("a DLAMI is %q, want ok", results["accelerator image"])
+	}
+
+	api.zones = nil
+	if results := checkResults(acceleratorChecks(c, api, s, g5, false)); !strings.Contains(results["accelerator zones"], "no availability zone of us-east-1 offers g5.xlarge") {
+		t.Errorf("zones: %q", results["accelerator zones"])
+	}
+	if checks := acceleratorChecks(c, api, s, &instanceType{Name: "t3.micro"}, false); len(checks) != 0 {
+		t.Errorf("t3.micro got checks %v", checks)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// A group is a saved tag filter, KEY=VALUE or KEY=VALUE1,VALUE2 like --tag,
+// that --group NAME selects the instances of a command by. Groups are
+// defined in the groups of data/config.json, or made with group create and
+// kept in the state store, where the team shares them.
+
+// parseGroupFilter splits the tag filter of a group into its key and values.
+func parseGroupFilter(filter string) (string, string, error) {
+	key, value, ok := strings.Cut(filter, "=")
+	if !ok || key == "" || value == "" {
+		return "", "", fmt.Errorf("the filter of a group is KEY=VALUE[,VALUE], not %q", filter)
+	}
+	return key, value, nil
+}
+
+// lookupGroup returns the tag key and values of the group, from the config
+// or else the state store.
+func lookupGroup(c context.Context, config ConfigMap, store StateStore, name string) (string, string, error) {
+	filter, ok := config.Groups[name]
+	if !ok {
+		state, err := store.Load(c)
+		if err != nil {
+			return "", "", fmt.Errorf("loading the groups: %w", err)
+		}
+		if filter, ok = state.Groups[name]; !ok {
+			return "", "", fmt.Errorf("no group %s is defined in the config or with group create", name)
+		}
+	}
+	return parseGroupFilter(filter)
+}
+
+// createGroup saves the group in the state store. The groups of the config
+// cannot be replaced this way, since they would still win.
+func createGroup(c context.Context, config ConfigMap, store StateStore, name, filter string) error {
+	if _, _, err := parseGroupFilter(filter); err != nil {
+		return err
+	}
+	if _, ok := config.Groups[name]; ok {
+		return fmt.Errorf("the group %s is defined in the config", name)
+	}
+	return updateState(c, store, func(state *State) error {
+		if state.Groups == nil {
+			state.Groups = map[string]string{}
+		}
+		state.Groups[name] = filter
+		return nil
+	})
+}
+
+// deleteGroup removes the group from the state store.
+func deleteGroup(c context.Context, store StateStore, name string) error {
+	return updateState(c, store, func(state *State) error {
+		if _, ok := state.Groups[name]; !ok {
+			return fmt.Errorf("no group %s was made with group create", name)
+		}
+		delete(state.Groups, name)
+		return nil
+	})
+}
+
+func GroupCmd(action string, args []string, tag *string) {
+	c := context.TODO()
+	config, _ := loadConfig()
+	switch action {
+	case "create":
+		if err := createGroup(c, config, stateStore, args[0], *tag); err != nil {
+			commandErr = err
+			fmt.Fprintln(os.Stderr, "Got an error creating the group:")
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		fmt.Println("Created group " + args[0] + " of " + *tag)
+	case "delete":
+		if err := deleteGroup(c, stateStore, args[0]); err != nil {
+			commandErr = err
+			fmt.Fprintln(os.Stderr, "Got an error deleting the group:")
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		fmt.Println("Deleted group " + args[0])
+	case "list":
+		state, err := stateStore.Load(c)
+		if err != nil {
+			commandErr = err
+			fmt.Fprintln(os.Stderr, "Got an error loading the groups:")
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		groups := map[string][2]string{}
+		for name, filter := range state.Groups {
+			groups[name] = [2]string{filter, "state"}
+		}
+		for name, filter := range config.Groups {
+			groups[name] = [2]string{filter, "config"}
+		}
+		if len(groups) == 0 {
+			fmt.Fprintln(os.Stderr, "No groups are defined")
+			return
+		}
+		var names []string
+		for name := range groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "GROUP\tFILTER\tDEFINED IN")
+		for _, name := range names {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", name, groups[name][0], groups[name][1])
+		}
+		w.Flush()
+	}
+}
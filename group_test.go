@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDeleteGroupFromConfig(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{Groups: map[string]string{"perf-test": "env=perf,perf-2"}})
+	perf := fake.AddInstance(tagged("env", "perf"))
+	perf2 := fake.AddInstance(tagged("env", "perf-2"))
+	prod := fake.AddInstance(tagged("env", "prod"))
+
+	runCLI(t, "delete", "--group", "perf-test")
+	live := map[string]bool{}
+	for _, i := range liveInstances(fake) {
+		live[*i.InstanceId] = true
+	}
+	if live[perf] || live[perf2] || !live[prod] {
+		t.Errorf("live after delete: %v", live)
+	}
+}
+
+func TestGroupCreate(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{Groups: map[string]string{"perf-test": "env=perf"}})
+	web := fake.AddInstance(tagged("role", "staging-web"))
+	fake.AddInstance(tagged("role", "staging-db"))
+
+	runCLI(t, "group", "create", "staging-web", "--tag", "role=staging-web")
+	if g := loadState(t).Groups["staging-web"]; g != "role=staging-web" {
+		t.Fatalf("saved group = %q", g)
+	}
+	if out, _ := runCLIStreams(t, false, "list", "--group", "staging-web", "--quiet"); out != web+"\n" {
+		t.Errorf("list --group printed %q", out)
+	}
+	out := runCLI(t, "group", "list")
+	for _, want := range []string{"perf-test    env=perf          config", "staging-web", "state"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("group list is missing %q:\n%s", want, out)
+		}
+	}
+	if out := runCLI(t, "group", "create", "perf-test", "--tag", "env=other"); !strings.Contains(out, "defined in the config") {
+		t.Errorf("replacing a config group printed:\n%s", out)
+	}
+
+	runCLI(t, "group", "delete", "staging-web")
+	if out := runCLI(t, "list", "--group", "staging-web"); !strings.Contains(out, "no group staging-web") {
+		t.Errorf("list of a deleted group printed:\n%s", out)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	vmcreatev1 "aws-vmcreate/api/vmcreate/v1"
+	"aws-vmcreate/internal/metrics"
+	"aws-vmcreate/internal/telemetry"
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcServer serves the provisioning operations of the REST API as the
+// vmcreate.v1.ProvisioningService.
+type grpcServer struct {
+	vmcreatev1.UnimplementedProvisioningServiceServer
+	api *apiServer
+}
+
+// newGRPCServer returns a gRPC server of the operations, authenticating each
+// call with the bearer token of its authorization metadata.
+func newGRPCServer(api *apiServer) *grpc.Server {
+	server := grpc.NewServer(grpc.UnaryInterceptor(api.interceptGRPC))
+	vmcreatev1.RegisterProvisioningServiceServer(server, &grpcServer{api: api})
+	return server
+}
+
+// interceptGRPC authenticates a call, traces it and counts it in
+// vmcreate_api_requests_total by its method and gRPC code.
+func (s *apiServer) interceptGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, span := telemetry.Start(ctx, "gRPC "+info.FullMethod, telemetry.KindServer,
+		telemetry.String("rpc.system", "grpc"),
+		telemetry.String("rpc.method", info.FullMethod),
+	)
+
+	var resp interface{}
+	err := s.authenticateGRPC(ctx)
+	if err == nil {
+		resp, err = handler(ctx, req)
+	}
+	code := status.Code(err)
+	metricsRegistry.Add("vmcreate_api_requests_total", metrics.Labels{"method": info.FullMethod, "code": code.String()}, 1)
+
+	span.SetAttributes(telemetry.Int("rpc.grpc.status_code", int(code)))
+	var spanErr error
+	if code == codes.Internal || code == codes.Unavailable {
+		spanErr = err
+	}
+	span.End(spanErr)
+	return resp, err
+}
+
+func (s *apiServer) authenticateGRPC(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, header := range md.Get("authorization") {
+		token := strings.TrimPrefix(header, "Bearer ")
+		if token != header && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or invalid bearer token")
+}
+
+func (g *grpcServer) ListInstances(ctx context.Context, req *vmcreatev1.ListInstancesRequest) (*vmcreatev1.ListInstancesResponse, error) {
+	var filters []types.Filter
+	if tag := req.GetTag(); tag != nil {
+		if tag.GetKey() == "" {
+			return nil, status.Error(codes.InvalidArgument, "the tag must have a key")
+		}
+		filters = append(filters, vmcreate.TagFilter(tag.GetKey(), tag.GetValue()))
+	}
+	instances, err := g.api.listInstances(ctx, filters...)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := &vmcreatev1.ListInstancesResponse{}
+	for _, i := range instances {
+		resp.Instances = append(resp.Instances, newInstanceMessage(&i))
+	}
+	return resp, nil
+}
+
+func (g *grpcServer) DescribeInstance(ctx context.Context, req *vmcreatev1.DescribeInstanceRequest) (*vmcreatev1.Instance, error) {
+	instance, err := g.api.describeInstance(ctx, req.GetInstanceId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return newInstanceMessage(instance), nil
+}
+
+func (g *grpcServer) CreateInstance(ctx context.Context, req *vmcreatev1.CreateInstanceRequest) (*vmcreatev1.Instance, error) {
+	instance, err := g.api.createInstance(ctx, CreateRequest{
+		TagKey:       req.GetTag().GetKey(),
+		TagValue:     req.GetTag().GetValue(),
+		InstanceType: req.GetInstanceType(),
+		ImageId:      req.GetImageId(),
+		SubnetId:     req.GetSubnetId(),
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return newInstanceMessage(instance), nil
+}
+
+func (g *grpcServer) DeleteInstance(ctx context.Context, req *vmcreatev1.DeleteInstanceRequest) (*vmcreatev1.DeleteInstanceResponse, error) {
+	if err := g.api.deleteInstance(ctx, req.GetInstanceId()); err != nil {
+		return nil, grpcError(err)
+	}
+	return &vmcreatev1.DeleteInstanceResponse{}, nil
+}
+
+// grpcError gives an operation error the gRPC code of its HTTP status.
+func grpcError(err error) error {
+	code := codes.Internal
+	switch errorStatus(err) {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.FailedPrecondition
+	case http.StatusBadGateway:
+		code = codes.Unavailable
+	}
+	return status.Error(code, err.Error())
+}
+
+func newInstanceMessage(i *types.Instance) *vmcreatev1.Instance {
+	view := newInstanceView(i)
+	message := &vmcreatev1.Instance{
+		InstanceId:       view.InstanceID,
+		State:            view.State,
+		InstanceType:     view.InstanceType,
+		ImageId:          view.ImageID,
+		AvailabilityZone: view.AvailabilityZone,
+		PrivateIp:        view.PrivateIP,
+		PublicIp:         view.PublicIP,
+		Tags:             view.Tags,
+	}
+	if i.LaunchTime != nil {
+		message.LaunchTime = timestamppb.New(aws.ToTime(i.LaunchTime))
+	}
+	return message
+}
+
+func GRPCServeCmd(listen *string, tokenFile *string) {
+	api := newAPIServer(*tokenFile)
+	if api == nil {
+		return
+	}
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error serving the gRPC API:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+	server := newGRPCServer(api)
+
+	c, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-c.Done()
+		// Calls in flight get as long to finish as the REST API gives them.
+		timer := time.AfterFunc(30*time.Second, server.Stop)
+		defer timer.Stop()
+		server.GracefulStop()
+	}()
+
+	go flushTelemetryEvery(c, 10*time.Second)
+
+	progressln("Serving the provisioning gRPC API on " + listener.Addr().String())
+	if err := server.Serve(listener); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		fmt.Fprintln(os.Stderr, "Got an error serving the gRPC API:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+	}
+}
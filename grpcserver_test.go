@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	vmcreatev1 "aws-vmcreate/api/vmcreate/v1"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// serveGRPC serves the gRPC API on a local port for the test and returns its
+// address.
+func serveGRPC(t *testing.T, api *apiServer) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newGRPCServer(api)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+func dialGRPC(t *testing.T, target, token string) vmcreatev1.ProvisioningServiceClient {
+	t.Helper()
+	client, conn, err := vmcreatev1.Dial(target, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return client
+}
+
+func TestGRPCServer(t *testing.T) {
+	fake := useFakeEC2(t)
+	target := serveGRPC(t, &apiServer{
+		token:  "secret",
+		config: ConfigMap{InstanceType: "t2.micro", ImageId: "ami-api"},
+	})
+	client := dialGRPC(t, target, "secret")
+	ctx := context.Background()
+
+	for _, token := range []string{"", "wrong"} {
+		_, err := dialGRPC(t, target, token).ListInstances(ctx, &vmcreatev1.ListInstancesRequest{})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("token %q got %v", token, err)
+		}
+	}
+
+	created, err := client.CreateInstance(ctx, &vmcreatev1.CreateInstanceRequest{Tag: &vmcreatev1.Tag{Key: "Name", Value: "api-1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := fake.Instance(created.InstanceId); i == nil || aws.ToString(i.ImageId) != "ami-api" {
+		t.Fatalf("created %v", created)
+	}
+	if created.Tags["Name"] != "api-1" || created.InstanceType != "t2.micro" || created.LaunchTime == nil {
+		t.Errorf("created %v", created)
+	}
+
+	_, err = client.CreateInstance(ctx, &vmcreatev1.CreateInstanceRequest{Tag: &vmcreatev1.Tag{Key: "Name"}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("create without a tag value got %v", err)
+	}
+
+	fake.AddInstance(tagged("Name", "api-2"))
+	listed, err := client.ListInstances(ctx, &vmcreatev1.ListInstancesRequest{Tag: &vmcreatev1.Tag{Key: "Name", Value: "api-1"}})
+	if err != nil || len(listed.Instances) != 1 || listed.Instances[0].InstanceId != created.InstanceId {
+		t.Errorf("list got %v %v", listed, err)
+	}
+	if all, err := client.ListInstances(ctx, &vmcreatev1.ListInstancesRequest{}); err != nil || len(all.Instances) != 2 {
+		t.Errorf("list without a tag got %v %v", all, err)
+	}
+
+	described, err := client.DescribeInstance(ctx, &vmcreatev1.DescribeInstanceRequest{InstanceId: created.InstanceId})
+	if err != nil || described.State != string(types.InstanceStateNameRunning) {
+		t.Errorf("describe got %v %v", described, err)
+	}
+	_, err = client.DescribeInstance(ctx, &vmcreatev1.DescribeInstanceRequest{InstanceId: "i-missing"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("describe of a missing instance got %v", err)
+	}
+
+	// Instances the tool did not create cannot be terminated.
+	foreign := fake.AddInstance(tagged("Name", "not-ours"))
+	_, err = client.DeleteInstance(ctx, &vmcreatev1.DeleteInstanceRequest{InstanceId: foreign})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("delete of an instance the tool did not create got %v", err)
+	}
+	if state := fake.Instance(foreign).State.Name; state == types.InstanceStateNameTerminated {
+		t.Error("the instance the tool did not create was terminated")
+	}
+
+	if _, err := client.DeleteInstance(ctx, &vmcreatev1.DeleteInstanceRequest{InstanceId: created.InstanceId}); err != nil {
+		t.Errorf("delete got %v", err)
+	}
+	if state := fake.Instance(created.InstanceId).State.Name; state != types.InstanceStateNameTerminated {
+		t.Errorf("instance is %s after delete", state)
+	}
+
+	fake.Fail("RunInstances", errors.New("InsufficientInstanceCapacity"))
+	_, err = client.CreateInstance(ctx, &vmcreatev1.CreateInstanceRequest{Tag: &vmcreatev1.Tag{Key: "Name", Value: "api-3"}})
+	if status.Code(err) != codes.Unavailable || !strings.Contains(err.Error(), "InsufficientInstanceCapacity") {
+		t.Errorf("failed create got %v", err)
+	}
+}
+
+func TestGRPCServeNeedsToken(t *testing.T) {
+	useFakeEC2(t)
+	t.Setenv("AWS_VMCREATE_API_TOKEN", "")
+
+	_, stderr, code := runCLIExit(t, false, "grpc-serve", "--listen", "127.0.0.1:0")
+	if !strings.Contains(stderr, "You must supply an API token") || code != 1 {
+		t.Errorf("exit code %d, stderr:\n%s", code, stderr)
+	}
+}
+
+func TestGRPCServeListenFailure(t *testing.T) {
+	useFakeEC2(t)
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	t.Setenv("AWS_VMCREATE_API_TOKEN", "secret")
+
+	_, stderr, code := runCLIExit(t, false, "grpc-serve", "--listen", taken.Addr().String())
+	if !strings.Contains(stderr, "Got an error serving the gRPC API:") || code != 1 {
+		t.Errorf("exit code %d, stderr:\n%s", code, stderr)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"aws-vmcreate/pkg/vmcreate"
+	"aws-vmcreate/pkg/vmcreate/vmcreatetest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// useFakeEC2 points the commands at an in-memory EC2 for the rest of the test.
+func useFakeEC2(t *testing.T) *vmcreatetest.FakeEC2 {
+	t.Helper()
+	t.Setenv("AWS_ENDPOINT_URL", "")
+	// The audit log goes to the home directory.
+	t.Setenv("HOME", t.TempDir())
+
+	fake := vmcreatetest.NewFakeEC2()
+	previous, previousConfig, previousLookup := provisioner, awsConfig, lookupPrincipal
+	lookupPrincipal = func(context.Context) (string, error) {
+		return "arn:aws:iam::123456789012:user/tester", nil
+	}
+	provisioner = vmcreate.New(fake, vmcreate.WithWaitTimeout(5*time.Second))
+	previousTypes, previousInterfaces := instanceTypesClient, networkInterfacesClient
+	instanceTypesClient, networkInterfacesClient = fake, fake
+	t.Cleanup(func() {
+		// Commands such as create with region failover switch the clients.
+		if awsConfig.Region != previousConfig.Region {
+			newClients(previousConfig)
+		}
+		provisioner, lookupPrincipal, instanceTypesClient, networkInterfacesClient = previous, previousLookup, previousTypes, previousInterfaces
+		// Each test is an invocation of its own, with a run of its own.
+		invocationRunID = ""
+	})
+	return fake
+}
+
+// useConfig runs the test in a directory whose data/config.json is config.
+func useConfig(t *testing.T, config ConfigMap) {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "data"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "data", "config.json"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(previous) })
+}
+
+// runCLI runs the command line as the binary would, with fresh flags, and
+// returns what it printed to stdout and stderr, as a terminal shows them.
+func runCLI(t *testing.T, args ...string) string {
+	t.Helper()
+	out, _ := runCLIStreams(t, true, args...)
+	return out
+}
+
+// runCLIStreams runs the command line like runCLI, and returns what it
+// printed to stdout and to stderr apart, unless combined.
+func runCLIStreams(t *testing.T, combined bool, args ...string) (string, string) {
+	t.Helper()
+	stdout, stderr, _ := runCLIExit(t, combined, args...)
+	return stdout, stderr
+}
+
+// cliExit is what the replaced os.Exit panics with, to end main.
+type cliExit int
+
+// runCLIExit is runCLIStreams that also returns the exit code.
+func runCLIExit(t *testing.T, combined bool, args ...string) (string, string, int) {
+	t.Helper()
+
+	previousArgs, previousFlags, previousStdout, previousStderr, previousExit := os.Args, flag.CommandLine, os.Stdout, os.Stderr, osExit
+	defer func() {
+		os.Args, flag.CommandLine, os.Stdout, os.Stderr, osExit = previousArgs, previousFlags, previousStdout, previousStderr, previousExit
+	}()
+	osExit = func(code int) { panic(cliExit(code)) }
+
+	capture := func() (*os.File, chan string) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		output := make(chan string)
+		go func() {
+			data, _ := io.ReadAll(r)
+			output <- string(data)
+		}()
+		return w, output
+	}
+	stdout, stdoutOutput := capture()
+	stderr, stderrOutput := stdout, stdoutOutput
+	if !combined {
+		stderr, stderrOutput = capture()
+	}
+
+	os.Args = append([]string{"aws-vmcreate"}, args...)
+	flag.CommandLine = flag.NewFlagSet("aws-vmcreate", flag.PanicOnError)
+	os.Stdout, os.Stderr = stdout, stderr
+	code := 0
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				status, ok := r.(cliExit)
+				if !ok {
+					panic(r)
+				}
+				code = int(status)
+			}
+		}()
+		defer stdout.Close()
+		if !combined {
+			defer stderr.Close()
+		}
+		main()
+	}()
+	if combined {
+		return <-stdoutOutput, "", code
+	}
+	return <-stdoutOutput, <-stderrOutput, code
+}
+
+// useRegionFakes gives every region its own in-memory EC2 for the commands
+// that fan out across regions. A region missing from the map fails.
+func useRegionFakes(t *testing.T, regions ...string) map[string]*vmcreatetest.FakeEC2 {
+	t.Helper()
+	useFakeEC2(t)
+
+	fakes := map[string]*vmcreatetest.FakeEC2{}
+	for _, region := range regions {
+		fakes[region] = vmcreatetest.NewFakeEC2()
+	}
+	previous := provisionerFor
+	provisionerFor = func(cfg aws.Config) *vmcreate.Provisioner {
+		fake, ok := fakes[cfg.Region]
+		if !ok {
+			fake = vmcreatetest.NewFakeEC2()
+			fake.Fail("DescribeInstances", errors.New("UnauthorizedOperation: region "+cfg.Region+" is not enabled"))
+		}
+		return vmcreate.New(fake)
+	}
+	t.Cleanup(func() { provisionerFor = previous })
+	return fakes
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// resolveHealthCheck parses a health check such as "http://:8080/healthz" or
+// "tcp://:22", filling in host when the check leaves the host empty.
+func resolveHealthCheck(check string, host string) (*url.URL, error) {
+	u, err := url.Parse(check)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "tcp":
+	default:
+		return nil, fmt.Errorf("unsupported health check scheme %q, must be http, https or tcp", u.Scheme)
+	}
+	if u.Port() == "" && u.Scheme == "tcp" {
+		return nil, fmt.Errorf("tcp health check %q needs a port", check)
+	}
+	if u.Hostname() == "" {
+		if u.Port() != "" {
+			u.Host = net.JoinHostPort(host, u.Port())
+		} else {
+			u.Host = host
+		}
+	}
+	return u, nil
+}
+
+// checkHealth makes a single health check attempt.
+func checkHealth(c context.Context, u *url.URL) error {
+	if u.Scheme == "tcp" {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(c, "tcp", u.Host)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequestWithContext(c, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 399 {
+		return fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	return nil
+}
+
+// waitForHealthy polls the health check against the instance until it passes
+// or timeout elapses. Checks go to the public IP, or the private IP when the
+// instance has none.
+func waitForHealthy(c context.Context, instanceID string, check string, timeout time.Duration) error {
+	c, cancel := context.WithTimeout(c, timeout)
+	defer cancel()
+
+	instance, err := provisioner.WaitForRunning(c, instanceID, timeout)
+	if err != nil {
+		return err
+	}
+	host := aws.ToString(instance.PublicIpAddress)
+	if host == "" {
+		host = aws.ToString(instance.PrivateIpAddress)
+	}
+
+	u, err := resolveHealthCheck(check, host)
+	if err != nil {
+		return err
+	}
+
+	progressln("Waiting for " + u.String() + " to become healthy")
+	for {
+		attempt, cancelAttempt := context.WithTimeout(c, 5*time.Second)
+		err := checkHealth(attempt, u)
+		cancelAttempt()
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-c.Done():
+			return fmt.Errorf("health check %s did not pass: %w", u, err)
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestResolveHealthCheck(t *testing.T) {
+	for _, tc := range []struct {
+		check, want, err string
+	}{
+		{check: "http://:8080/healthz", want: "http://203.0.113.7:8080/healthz"},
+		{check: "https:///ready", want: "https://203.0.113.7/ready"},
+		{check: "http://app.internal/healthz", want: "http://app.internal/healthz"},
+		{check: "tcp://:22", want: "tcp://203.0.113.7:22"},
+		{check: "tcp://:", err: "needs a port"},
+		{check: "tcp://db.internal", err: "needs a port"},
+		{check: "ftp://:21", err: `unsupported health check scheme "ftp"`},
+		{check: ":8080", err: "missing protocol scheme"},
+	} {
+		u, err := resolveHealthCheck(tc.check, "203.0.113.7")
+		switch {
+		case tc.err != "":
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("resolveHealthCheck(%q) = %v, %v, want an error with %q", tc.check, u, err, tc.err)
+			}
+		case err != nil || u.String() != tc.want:
+			t.Errorf("resolveHealthCheck(%q) = %v, %v, want %s", tc.check, u, err, tc.want)
+		}
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL + "/healthz")
+
+	if err := checkHealth(context.Background(), u); err != nil {
+		t.Errorf("healthy server: %v", err)
+	}
+	status = http.StatusServiceUnavailable
+	if err := checkHealth(context.Background(), u); err == nil || !strings.Contains(err.Error(), "returned 503") {
+		t.Errorf("unhealthy server: %v", err)
+	}
+
+	// A TCP check passes once the port accepts connections.
+	if err := checkHealth(context.Background(), &url.URL{Scheme: "tcp", Host: u.Host}); err != nil {
+		t.Errorf("open port: %v", err)
+	}
+	server.Close()
+	if err := checkHealth(context.Background(), &url.URL{Scheme: "tcp", Host: u.Host}); err == nil {
+		t.Error("closed port passed")
+	}
+}
+
+func TestWaitForHealthy(t *testing.T) {
+	fake := useFakeEC2(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	// Without a public IP the check goes to the private one.
+	id := fake.AddInstance(types.Instance{
+		State:            &types.InstanceState{Name: types.InstanceStateNameRunning},
+		PrivateIpAddress: aws.String("127.0.0.1"),
+	})
+	if err := waitForHealthy(context.Background(), id, "tcp://:"+port, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	listener.Close()
+	if err := waitForHealthy(context.Background(), id, "tcp://:"+port, 100*time.Millisecond); err == nil || !strings.Contains(err.Error(), "health check tcp://127.0.0.1:"+port+" did not pass") {
+		t.Errorf("got %v", err)
+	}
+}
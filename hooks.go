@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// Hooks are the organization's own steps around creates and deletes, such
+// as registering instances in a CMDB or opening tickets. Each hook is an
+// http:// or https:// webhook the payload is posted to, or an executable,
+// with its arguments, that reads the payload on stdin.
+type Hooks struct {
+	// PreCreate runs before the launch, and a failing hook stops it.
+	PreCreate []string `json:"pre_create,omitempty"`
+	// PostCreate runs once the instances are created and set up.
+	PostCreate []string `json:"post_create,omitempty"`
+	// PreDelete runs before the instances are terminated, and a failing
+	// hook stops the delete.
+	PreDelete []string `json:"pre_delete,omitempty"`
+	// PostDelete runs once the instances are terminated.
+	PostDelete []string `json:"post_delete,omitempty"`
+	// Timeout is how long each hook may run, 2m by default.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// HookPayload is the JSON hooks are given.
+type HookPayload struct {
+	Hook        string `json:"hook"`
+	TagKey      string `json:"tag_key,omitempty"`
+	TagValue    string `json:"tag_value,omitempty"`
+	Region      string `json:"region"`
+	RequestedBy string `json:"requested_by,omitempty"`
+	// InstanceType, ImageID, Count and Tags describe the launch of a
+	// pre-create hook, when there are no instances yet.
+	InstanceType string            `json:"instance_type,omitempty"`
+	ImageID      string            `json:"image_id,omitempty"`
+	Count        int               `json:"count,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+	Instances    []HookInstance    `json:"instances,omitempty"`
+	Time         time.Time         `json:"time"`
+}
+
+// HookInstance describes one of the instances of a hook.
+type HookInstance struct {
+	ID               string            `json:"id"`
+	InstanceType     string            `json:"instance_type,omitempty"`
+	ImageID          string            `json:"image_id,omitempty"`
+	AvailabilityZone string            `json:"availability_zone,omitempty"`
+	PrivateIP        string            `json:"private_ip,omitempty"`
+	PublicIP         string            `json:"public_ip,omitempty"`
+	State            string            `json:"state,omitempty"`
+	Tags             map[string]string `json:"tags,omitempty"`
+}
+
+// hookInstances returns the instances as hooks see them.
+func hookInstances(instances []types.Instance) []HookInstance {
+	var out []HookInstance
+	for _, i := range instances {
+		h := HookInstance{
+			ID:           aws.ToString(i.InstanceId),
+			InstanceType: string(i.InstanceType),
+			ImageID:      aws.ToString(i.ImageId),
+			PrivateIP:    aws.ToString(i.PrivateIpAddress),
+			PublicIP:     aws.ToString(i.PublicIpAddress),
+		}
+		if i.Placement != nil {
+			h.AvailabilityZone = aws.ToString(i.Placement.AvailabilityZone)
+		}
+		if i.State != nil {
+			h.State = string(i.State.Name)
+		}
+		if len(i.Tags) > 0 {
+			h.Tags = map[string]string{}
+			for _, t := range i.Tags {
+				h.Tags[aws.ToString(t.Key)] = aws.ToString(t.Value)
+			}
+		}
+		out = append(out, h)
+	}
+	return out
+}
+
+// runHooks runs the hooks of payload.Hook in order, stopping at the first
+// that fails.
+func runHooks(c context.Context, h *Hooks, hooks []string, payload *HookPayload) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+	timeout := 2 * time.Minute
+	if h.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(h.Timeout); err != nil {
+			return fmt.Errorf("hook timeout: %w", err)
+		}
+	}
+	payload.Region = awsConfig.Region
+	payload.Time = time.Now().UTC()
+	if principal, err := lookupPrincipal(c); err == nil {
+		payload.RequestedBy = principal
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+		if err := runHook(c, hook, payload, data, timeout); err != nil {
+			return fmt.Errorf("%s hook %s: %w", payload.Hook, hook, err)
+		}
+	}
+	return nil
+}
+
+// runHook posts data to the webhook, or runs the executable with data on
+// stdin and the hook's name in AWS_VMCREATE_HOOK.
+func runHook(c context.Context, hook string, payload *HookPayload, data []byte, timeout time.Duration) error {
+	c, cancel := context.WithTimeout(c, timeout)
+	defer cancel()
+	if strings.HasPrefix(hook, "https://") || strings.HasPrefix(hook, "http://") {
+		return postJSON(c, hook, payload)
+	}
+	args := strings.Fields(hook)
+	if len(args) == 0 {
+		return fmt.Errorf("empty hook")
+	}
+	cmd := exec.CommandContext(c, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	// The output of a hook would mix with the results of the command.
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	cmd.Env = append(os.Environ(), "AWS_VMCREATE_HOOK="+payload.Hook)
+	return cmd.Run()
+}
+
+// runPostHooks runs hooks after the command's work is done, when their
+// failures are reported but no longer change the outcome.
+func runPostHooks(c context.Context, h *Hooks, hooks []string, payload *HookPayload) {
+	if err := runHooks(c, h, hooks, payload); err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error running the "+payload.Hook+" hooks:")
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// hookScript writes an executable hook that saves its payload, and exits
+// with code, to dir and returns its path.
+func hookScript(t *testing.T, dir string, code int) string {
+	t.Helper()
+	script := filepath.Join(dir, "hook.sh")
+	body := "#!/bin/sh\ncat > \"$1/$AWS_VMCREATE_HOOK.json\"\nexit " + strconv.Itoa(code) + "\n"
+	if err := os.WriteFile(script, []byte(body), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return script
+}
+
+func readHookPayload(t *testing.T, file string) HookPayload {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload HookPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestCreateDeleteHooks(t *testing.T) {
+	fake := useFakeEC2(t)
+	dir := t.TempDir()
+	hook := hookScript(t, dir, 0) + " " + dir
+
+	var mu sync.Mutex
+	var posted []HookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload HookPayload
+		json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		posted = append(posted, payload)
+		mu.Unlock()
+	}))
+	defer server.Close()
+	previous := awsConfig.HTTPClient
+	awsConfig.HTTPClient = server.Client()
+	t.Cleanup(func() { awsConfig.HTTPClient = previous })
+
+	useConfig(t, ConfigMap{
+		InstanceType: "t3.micro",
+		ImageId:      "ami-1",
+		Hooks: &Hooks{
+			PreCreate:  []string{hook},
+			PostCreate: []string{hook, server.URL},
+			PreDelete:  []string{hook},
+			PostDelete: []string{hook},
+		},
+	})
+	runCLI(t, "create", "--tag", "Name=web-1")
+
+	pre := readHookPayload(t, filepath.Join(dir, "pre-create.json"))
+	if pre.TagValue != "web-1" || pre.InstanceType != "t3.micro" || pre.Count != 1 || len(pre.Instances) != 0 {
+		t.Errorf("pre-create payload = %+v", pre)
+	}
+	id := *fake.Instances()[0].InstanceId
+	post := readHookPayload(t, filepath.Join(dir, "post-create.json"))
+	if len(post.Instances) != 1 || post.Instances[0].ID != id || post.RequestedBy == "" {
+		t.Errorf("post-create payload = %+v", post)
+	}
+	if len(posted) != 1 || posted[0].Hook != "post-create" {
+		t.Errorf("posted = %+v", posted)
+	}
+
+	runCLI(t, "delete", "--tag", "Name=web-1")
+	for _, hook := range []string{"pre-delete", "post-delete"} {
+		payload := readHookPayload(t, filepath.Join(dir, hook+".json"))
+		if len(payload.Instances) != 1 || payload.Instances[0].ID != id {
+			t.Errorf("%s payload = %+v", hook, payload)
+		}
+	}
+	if live := liveInstances(fake); len(live) != 0 {
+		t.Errorf("%d instances left", len(live))
+	}
+}
+
+func TestPreDeleteHookFailure(t *testing.T) {
+	fake := useFakeEC2(t)
+	dir := t.TempDir()
+	useConfig(t, ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1", Hooks: &Hooks{
+		PreDelete: []string{hookScript(t, dir, 1) + " " + dir},
+	}})
+	runCLI(t, "create", "--tag", "Name=web-1")
+
+	runCLI(t, "delete", "--tag", "Name=web-1")
+	if live := liveInstances(fake); len(live) != 1 {
+		t.Errorf("%d instances left, the failing pre-delete hook should keep the instance", len(live))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "pre-delete.json")); err != nil {
+		t.Error("pre-delete hook did not run")
+	}
+}
+
+func TestLaunchHooksOutsideCreate(t *testing.T) {
+	fake := useFakeEC2(t)
+	dir := t.TempDir()
+	hook := hookScript(t, dir, 0) + " " + dir
+	config := ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1", Hooks: &Hooks{
+		PreCreate:  []string{hook},
+		PostCreate: []string{hook},
+	}}
+
+	state := &DesiredState{Groups: []DesiredGroup{{Name: "web", Count: 2, InstanceType: "t3.micro", ImageId: "ami-web"}}, Config: config}
+	if err := reconcile(context.Background(), state, false, false); err != nil {
+		t.Fatal(err)
+	}
+	pre := readHookPayload(t, filepath.Join(dir, "pre-create.json"))
+	if pre.TagKey != groupTag || pre.TagValue != "web" || pre.Count != 2 {
+		t.Errorf("daemon pre-create payload = %+v", pre)
+	}
+	if post := readHookPayload(t, filepath.Join(dir, "post-create.json")); len(post.Instances) != 2 {
+		t.Errorf("daemon post-create payload = %+v", post)
+	}
+
+	// A failing pre-create hook stops the launch of the API too.
+	config.Hooks.PreCreate = []string{hookScript(t, t.TempDir(), 1) + " " + dir}
+	server := httptest.NewServer(&apiServer{token: "secret", config: config})
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/v1/instances", strings.NewReader(`{"tag_key": "Name", "tag_value": "api-1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("serve create with a failing pre-create hook got %s", resp.Status)
+	}
+	if n := len(liveInstances(fake)); n != 2 {
+		t.Errorf("%d live instances, want the 2 of the daemon", n)
+	}
+}
+
+func TestServeDeleteHooks(t *testing.T) {
+	fake := useFakeEC2(t)
+	dir := t.TempDir()
+	hook := hookScript(t, dir, 0) + " " + dir
+	config := ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1", Hooks: &Hooks{
+		PreDelete:  []string{hook},
+		PostDelete: []string{hook},
+	}}
+	id := fake.AddInstance(tagged(managedByTag, managedByValue))
+
+	server := httptest.NewServer(&apiServer{token: "secret", config: config})
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodDelete, server.URL+"/v1/instances/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete got %s", resp.Status)
+	}
+	for _, hook := range []string{"pre-delete", "post-delete"} {
+		payload := readHookPayload(t, filepath.Join(dir, hook+".json"))
+		if len(payload.Instances) != 1 || payload.Instances[0].ID != id {
+			t.Errorf("%s payload = %+v", hook, payload)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// iamStatement is one statement of an IAM policy document.
+type iamStatement struct {
+	Sid      string   `json:"Sid"`
+	Effect   string   `json:"Effect"`
+	Action   []string `json:"Action"`
+	Resource []string `json:"Resource"`
+}
+
+// iamPolicyDocument is an IAM policy document.
+type iamPolicyDocument struct {
+	Version   string         `json:"Version"`
+	Statement []iamStatement `json:"Statement"`
+}
+
+// commandActions are the actions each command calls on any resource. Every
+// command also looks up the caller with sts:GetCallerIdentity.
+var commandActions = map[string][]string{
+	"create":  {"ec2:RunInstances", "ec2:CreateTags", "ec2:DescribeInstances", "ec2:DescribeInstanceTypes", "ec2:TerminateInstances"},
+	"delete":  {"ec2:DescribeInstances", "ec2:TerminateInstances"},
+	"scale":   {"ec2:RunInstances", "ec2:CreateTags", "ec2:DescribeInstances", "ec2:DescribeInstanceTypes", "ec2:TerminateInstances"},
+	"list":    {"ec2:DescribeInstances"},
+	"connect": {"ec2:DescribeInstances", "ec2-instance-connect:SendSSHPublicKey"},
+	"tunnel":  {"ec2:DescribeInstances", "ssm:StartSession"},
+	"resize":  {"ec2:DescribeInstances", "ec2:DescribeInstanceTypes", "ec2:StopInstances", "ec2:ModifyInstanceAttribute", "ec2:StartInstances"},
+	"cp":      {"ec2:DescribeInstances", "ssm:SendCommand", "ssm:GetCommandInvocation"},
+	"daemon": {"ec2:RunInstances", "ec2:CreateTags", "ec2:DescribeInstances", "ec2:TerminateInstances",
+		"ec2:DescribeInstanceStatus", "ec2:DescribeAddresses", "ec2:AssociateAddress",
+		"ec2:DescribeSecurityGroups", "ec2:AuthorizeSecurityGroupIngress", "ec2:RevokeSecurityGroupIngress"},
+	"serve":       {"ec2:RunInstances", "ec2:CreateTags", "ec2:DescribeInstances", "ec2:TerminateInstances"},
+	"grpc-serve":  {"ec2:RunInstances", "ec2:CreateTags", "ec2:DescribeInstances", "ec2:TerminateInstances"},
+	"who-created": {"ec2:DescribeInstances", "cloudtrail:LookupEvents"},
+	"approve":     {"ssm:PutParameter"},
+	"env":         {"ec2:RunInstances", "ec2:CreateTags", "ec2:DescribeInstances", "ec2:DescribeInstanceStatus", "ec2:TerminateInstances"},
+	"diff":        {"ec2:DescribeInstances"},
+	"quarantine": {"ec2:DescribeInstances", "ec2:CreateTags", "ec2:CreateSecurityGroup", "ec2:RevokeSecurityGroupEgress",
+		"ec2:ModifyNetworkInterfaceAttribute", "ec2:DescribeIamInstanceProfileAssociations", "ec2:DisassociateIamInstanceProfile",
+		"ec2:ModifyInstanceAttribute", "ec2:CreateSnapshots"},
+	"debug-clone": {"ec2:DescribeInstances", "ec2:CreateImage", "ec2:DescribeImages", "ec2:CreateTags", "ec2:CreateSecurityGroup",
+		"ec2:RevokeSecurityGroupEgress", "ec2:AuthorizeSecurityGroupIngress", "ec2:RunInstances"},
+	"history": {},
+	"state":   {"ec2:DescribeInstances"},
+	"group":   {},
+	"init":    {"ec2:DescribeImages", "ec2:DescribeSubnets", "ec2:DescribeInstanceTypeOfferings", "ec2:DescribeRegions"},
+	"validate": {"ec2:DescribeImages", "ec2:DescribeSubnets", "ec2:DescribeVpcs", "ec2:DescribeSecurityGroups", "ec2:DescribeKeyPairs",
+		"ec2:DescribeInstanceTypes", "ec2:DescribeInstanceTypeOfferings", "ec2:DescribeRegions", "servicequotas:GetServiceQuota"},
+	"types":  {"ec2:DescribeInstanceTypes"},
+	"tui":    {"ec2:DescribeInstances", "ec2:StopInstances", "ec2:StartInstances", "ec2:TerminateInstances", "cloudwatch:GetMetricData", "ec2-instance-connect:SendSSHPublicKey"},
+	"alerts": {"ec2:DescribeInstances", "events:PutRule", "events:PutTargets", "events:RemoveTargets", "events:DeleteRule"},
+	"sg": {"ec2:DescribeSecurityGroups", "ec2:AuthorizeSecurityGroupIngress", "ec2:AuthorizeSecurityGroupEgress",
+		"ec2:RevokeSecurityGroupIngress", "ec2:RevokeSecurityGroupEgress", "ec2:DescribeInstances", "ec2:DescribeNetworkInterfaces", "ec2:DeleteSecurityGroup"},
+	"iam": {"iam:CreateRole", "iam:TagRole", "iam:AttachRolePolicy", "iam:CreateInstanceProfile", "iam:TagInstanceProfile",
+		"iam:GetInstanceProfile", "iam:AddRoleToInstanceProfile"},
+	"network": {"ec2:DescribeAvailabilityZones", "ec2:CreateVpc", "ec2:ModifyVpcAttribute", "ec2:CreateSubnet", "ec2:ModifySubnetAttribute",
+		"ec2:CreateInternetGateway", "ec2:AttachInternetGateway", "ec2:CreateRouteTable", "ec2:CreateRoute", "ec2:AssociateRouteTable",
+		"ec2:AllocateAddress", "ec2:CreateNatGateway", "ec2:CreateTags", "ec2:DescribeVpcs", "ec2:DescribeInstances", "ec2:DescribeNatGateways",
+		"ec2:DeleteNatGateway", "ec2:DescribeAddresses", "ec2:ReleaseAddress", "ec2:DescribeRouteTables", "ec2:DisassociateRouteTable",
+		"ec2:DeleteRouteTable", "ec2:DescribeInternetGateways", "ec2:DetachInternetGateway", "ec2:DeleteInternetGateway",
+		"ec2:DescribeSubnets", "ec2:DeleteSubnet", "ec2:DescribeSecurityGroups", "ec2:DeleteSecurityGroup", "ec2:DeleteVpc"},
+	"coverage":   {"ec2:DescribeInstances", "ec2:DescribeReservedInstances", "savingsplans:DescribeSavingsPlans"},
+	"age-report": {"ec2:DescribeInstances"},
+	"idle-check": {"ec2:DescribeInstances", "cloudwatch:GetMetricData", "ec2:CreateTags", "ec2:StopInstances"},
+	"events":     {"ec2:DescribeInstances", "ec2:DescribeInstanceStatus", "ec2:StopInstances", "ec2:StartInstances"},
+	"status":     {"ec2:DescribeInstances", "ec2:DescribeInstanceStatus"},
+	"standby":    {"ec2:DescribeInstances", "ec2:StopInstances"},
+	"activate":   {"ec2:DescribeInstances", "ec2:StartInstances"},
+	"rotate-key": {"ec2:DescribeInstances", "ec2:ImportKeyPair", "ec2:CreateTags", "ec2:DescribeKeyPairs", "ec2:DeleteKeyPair",
+		"ssm:SendCommand", "ssm:GetCommandInvocation"},
+	"patch": {"ec2:DescribeInstances", "ssm:DescribeInstanceInformation", "ssm:SendCommand", "ssm:GetCommandInvocation",
+		"ssm:DescribeInstancePatchStates"},
+	"rightsize": {"ec2:DescribeInstances", "ec2:DescribeInstanceTypes", "cloudwatch:GetMetricData",
+		"ec2:StopInstances", "ec2:ModifyInstanceAttribute", "ec2:StartInstances"},
+	"cleanup": {"ec2:DescribeInstances", "ec2:DescribeAddresses", "ec2:DescribeNetworkInterfaces", "ec2:DescribeVolumes", "ec2:DescribeSecurityGroups",
+		"ec2:DescribeKeyPairs", "ec2:ReleaseAddress", "ec2:DeleteNetworkInterface", "ec2:DeleteVolume", "ec2:DeleteSecurityGroup", "ec2:DeleteKeyPair"},
+}
+
+// iamPolicyFeatures are the optional features, enabled with the same flags
+// as on the commands themselves, whose actions iam-policy adds.
+type iamPolicyFeatures struct {
+	Provision      bool
+	ProvisionVia   string
+	DNSZone        string
+	TargetGroupArn string
+	EFS            bool
+	CITokenSecret  string
+	Bucket         string
+	Interactive    bool
+	Regions        bool
+	AllAccounts    bool
+	AllResources   bool
+	CleanupRunID   bool
+	AccountRole    string
+	// SubnetStrategy is the strategy create chooses a subnet with.
+	SubnetStrategy    string
+	NoSourceDestCheck bool
+	WaitStatusChecks  bool
+	NitroTPM          bool
+	CloudWatchLogs    bool
+	// InstanceType is the type create launches, whose launch is checked
+	// further when it has GPUs or accelerators.
+	InstanceType string
+	// InstanceProfile is the profile create launches with, whose role, named
+	// like the profile as iam profile create makes it, must be passed.
+	InstanceProfile string
+	// ConfigSource is the --config the commands read, whose object or
+	// parameter must be readable.
+	ConfigSource string
+	// Capture is quarantine --capture.
+	Capture bool
+	// PrivateIPs is create --private-ips.
+	PrivateIPs bool
+	// FromWarmPool is create --from-warm-pool.
+	FromWarmPool bool
+	// TerminationPolicy is the --termination-policy of scale and delete.
+	TerminationPolicy string
+}
+
+// policyBuilder collects the actions of each statement.
+type policyBuilder struct {
+	statements []iamStatement
+}
+
+// allow adds the actions on the resources to the statement named sid.
+func (b *policyBuilder) allow(sid string, resources []string, actions ...string) {
+	for i := range b.statements {
+		if b.statements[i].Sid == sid {
+			b.statements[i].Action = append(b.statements[i].Action, actions...)
+			b.statements[i].Resource = append(b.statements[i].Resource, resources...)
+			return
+		}
+	}
+	b.statements = append(b.statements, iamStatement{Sid: sid, Effect: "Allow", Action: actions, Resource: resources})
+}
+
+// document returns the policy with the actions and resources of each
+// statement sorted and made unique.
+func (b *policyBuilder) document() iamPolicyDocument {
+	doc := iamPolicyDocument{Version: "2012-10-17"}
+	for _, s := range b.statements {
+		s.Action, s.Resource = sortedUnique(s.Action), sortedUnique(s.Resource)
+		if len(s.Action) > 0 {
+			doc.Statement = append(doc.Statement, s)
+		}
+	}
+	return doc
+}
+
+func sortedUnique(values []string) []string {
+	seen := map[string]bool{}
+	var unique []string
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+// s3ObjectsARN returns the ARN of the objects under prefix in bucket.
+func s3ObjectsARN(bucket, prefix string) string {
+	return "arn:aws:s3:::" + bucket + "/" + prefix + "*"
+}
+
+// secretARN returns the ARN pattern of a secret given by ARN or name;
+// Secrets Manager appends six random characters to the name.
+func secretARN(secret string) string {
+	if strings.HasPrefix(secret, "arn:") {
+		return secret
+	}
+	return "arn:aws:secretsmanager:*:*:secret:" + secret + "-??????"
+}
+
+// queueARN returns the ARN of the queue of an SQS queue URL,
+// https://sqs.REGION.amazonaws.com/ACCOUNT/NAME.
+func queueARN(queueURL string) string {
+	parts := strings.Split(strings.TrimPrefix(strings.TrimPrefix(queueURL, "https://"), "http://"), "/")
+	host := strings.Split(parts[0], ".")
+	if len(parts) != 3 || len(host) < 3 || host[0] != "sqs" {
+		return "arn:aws:sqs:*:*:*"
+	}
+	return "arn:aws:sqs:" + host[1] + ":" + parts[1] + ":" + parts[2]
+}
+
+// iamPolicy returns the least-privilege policy for the commands, with the
+// features of config and features they use. Resources are narrowed to
+// the topics, buckets, tables and target groups named where they are known.
+func iamPolicy(commands []string, config ConfigMap, features iamPolicyFeatures) (iamPolicyDocument, error) {
+	b := &policyBuilder{}
+	everything := []string{"*"}
+	b.allow("Commands", everything, "sts:GetCallerIdentity")
+
+	uses := map[string]bool{}
+	for _, command := range commands {
+		actions, ok := commandActions[command]
+		if !ok {
+			return iamPolicyDocument{}, fmt.Errorf("unknown command %s", command)
+		}
+		uses[command] = true
+		b.allow("Commands", everything, actions...)
+	}
+	// scale launches like create and terminates like delete, with their
+	// options.
+	if uses["scale"] {
+		uses["create"], uses["delete"] = true, true
+	}
+	creates := uses["create"] || uses["daemon"] || uses["serve"] || uses["grpc-serve"]
+	changes := creates || uses["delete"]
+
+	if creates && len(config.RegionFailover) > 0 {
+		b.allow("Commands", everything, "ec2:DescribeRegions")
+	}
+	if features.Regions {
+		b.allow("Commands", everything, "ec2:DescribeRegions")
+	}
+	if uses["create"] && features.Interactive {
+		b.allow("Commands", everything, "ec2:DescribeRegions", "ec2:DescribeImages", "ec2:DescribeKeyPairs", "ec2:DescribeSubnets")
+	}
+	if strategy := firstNonEmpty(features.SubnetStrategy, config.SubnetStrategy); uses["create"] && strategy != "" {
+		b.allow("Commands", everything, "ec2:DescribeSubnets")
+		if strings.HasPrefix(strategy, strategyCheapestAZSpot) {
+			b.allow("Commands", everything, "ec2:DescribeSpotPriceHistory")
+		}
+	}
+	if launchType := firstNonEmpty(features.InstanceType, config.InstanceType); uses["create"] && contains([]string{"p", "g", "inf", "trn"}, quotaClass(launchType)) {
+		b.allow("Commands", everything, "ec2:DescribeInstanceTypeOfferings", "ec2:DescribeImages", "ec2:DescribeSubnets")
+	}
+	if uses["create"] && (features.NitroTPM || config.RootVolume != nil) {
+		b.allow("Commands", everything, "ec2:DescribeImages")
+	}
+	if budget := config.Budget; uses["create"] && budget != nil {
+		if budget.Name != "" {
+			b.allow("Commands", everything, "budgets:ViewBudget")
+		} else {
+			b.allow("Commands", everything, "ce:GetCostAndUsage")
+		}
+	}
+	if k := config.CMDB; (uses["create"] || uses["delete"]) && k != nil && k.CredentialsSecret != "" {
+		b.allow("CMDBCredentials", []string{secretARN(k.CredentialsSecret)}, "secretsmanager:GetSecretValue")
+	}
+	if d := config.Drain; uses["delete"] && d != nil {
+		for _, a := range d.Actions {
+			switch {
+			case len(a.SSMCommand) > 0:
+				b.allow("Commands", everything, "ssm:SendCommand", "ssm:GetCommandInvocation")
+			case a.TargetGroupArn != "":
+				b.allow("Commands", everything, "elasticloadbalancing:DescribeTargetHealth")
+				b.allow("DrainTargetGroups", []string{a.TargetGroupArn}, "elasticloadbalancing:DeregisterTargets")
+			case a.QueueURL != "":
+				b.allow("DrainQueues", []string{queueARN(a.QueueURL)}, "sqs:GetQueueAttributes")
+			}
+		}
+	}
+	if uses["quarantine"] && features.Capture {
+		b.allow("Commands", everything, "ssm:SendCommand", "ssm:GetCommandInvocation")
+		if f := config.Forensics; f != nil && f.Account != "" {
+			b.allow("Commands", everything, "ec2:DescribeSnapshots", "ec2:ModifySnapshotAttribute")
+		}
+	}
+	if a := config.Approval; uses["create"] && a != nil && a.SNSTopic != "" {
+		b.allow("ApprovalRequests", []string{a.SNSTopic}, "sns:Publish")
+		b.allow("ApprovalDecisions", []string{"arn:aws:ssm:*:*:parameter" + approvalParameterPrefix + "*"}, "ssm:GetParameter")
+	}
+	if uses["create"] && features.NoSourceDestCheck {
+		b.allow("Commands", everything, "ec2:ModifyInstanceAttribute")
+	}
+	if uses["create"] && features.WaitStatusChecks {
+		b.allow("Commands", everything, "ec2:DescribeInstanceStatus")
+	}
+	if uses["create"] && features.FromWarmPool {
+		b.allow("Commands", everything, "ec2:StartInstances", "ec2:StopInstances")
+	}
+	if uses["delete"] && features.TerminationPolicy == "unhealthy-first" {
+		b.allow("Commands", everything, "ec2:DescribeInstanceStatus")
+	}
+	if uses["delete"] && features.TerminationPolicy == "cheapest-az-first" {
+		b.allow("Commands", everything, "ec2:DescribeSpotPriceHistory")
+	}
+	if uses["create"] && (features.PrivateIPs || len(config.PrivateIPPool) > 0) {
+		b.allow("Commands", everything, "ec2:DescribeNetworkInterfaces")
+	}
+	if uses["list"] && features.AllAccounts {
+		b.allow("Commands", everything, "organizations:ListAccounts")
+		b.allow("AssumeAccountRole", []string{"arn:aws:iam::*:role/" + features.AccountRole}, "sts:AssumeRole")
+	}
+
+	if uses["list"] && features.AllResources {
+		b.allow("Commands", everything, "tag:GetResources")
+	}
+
+	if uses["cleanup"] && features.CleanupRunID {
+		// A run is cleaned up whole: its instances, images, snapshots and
+		// networks, and the DNS records and targets a create recorded.
+		b.allow("Commands", everything, "ec2:TerminateInstances", "ec2:DescribeImages", "ec2:DeregisterImage", "ec2:DescribeSnapshots", "ec2:DeleteSnapshot")
+		b.allow("Commands", everything, commandActions["network"]...)
+		b.allow("Commands", everything, "elasticloadbalancing:DeregisterTargets", "elasticloadbalancing:DescribeTargetHealth")
+		b.allow("DNSRecords", []string{"arn:aws:route53:::hostedzone/*"}, "route53:ListResourceRecordSets", "route53:ChangeResourceRecordSets")
+		b.allow("Commands", everything, "route53:ListHostedZonesByName")
+	}
+
+	if uses["create"] && features.Provision && features.ProvisionVia == "ssm" {
+		b.allow("Commands", everything, "ssm:DescribeInstanceInformation", "ssm:SendCommand", "ssm:GetCommandInvocation")
+	}
+	if uses["env"] {
+		// Environments make networks and DNS records, as their manifest says.
+		b.allow("Commands", everything, commandActions["network"]...)
+		b.allow("Commands", everything, "route53:ListHostedZonesByName", "ec2:DescribeNetworkInterfaces")
+		b.allow("DNSRecords", []string{"arn:aws:route53:::hostedzone/*"}, "route53:ListResourceRecordSets", "route53:ChangeResourceRecordSets")
+	}
+	if (uses["create"] || uses["delete"]) && features.DNSZone != "" {
+		b.allow("Commands", everything, "route53:ListHostedZonesByName")
+		b.allow("DNSRecords", []string{"arn:aws:route53:::hostedzone/*"}, "route53:ListResourceRecordSets", "route53:ChangeResourceRecordSets")
+	}
+	if (uses["create"] || uses["delete"]) && features.TargetGroupArn != "" {
+		b.allow("Commands", everything, "elasticloadbalancing:DescribeTargetHealth")
+		b.allow("TargetGroup", []string{features.TargetGroupArn}, "elasticloadbalancing:RegisterTargets", "elasticloadbalancing:DeregisterTargets")
+	}
+	if profile := firstNonEmpty(features.InstanceProfile, config.IamInstanceProfile); creates && profile != "" {
+		b.allow("PassInstanceRole", []string{"arn:aws:iam::*:role/" + profile}, "iam:PassRole")
+	}
+	if uses["create"] && features.CloudWatchLogs {
+		role := "arn:aws:iam::*:role/*"
+		if profile := firstNonEmpty(features.InstanceProfile, config.IamInstanceProfile); profile != "" {
+			role = "arn:aws:iam::*:role/" + profile
+		}
+		b.allow("Commands", everything, "iam:GetInstanceProfile")
+		b.allow("CloudWatchAgentRole", []string{role}, "iam:AttachRolePolicy")
+	}
+	if uses["create"] && features.EFS {
+		b.allow("Commands", everything, "elasticfilesystem:DescribeMountTargets", "ec2:DescribeSubnets")
+	}
+	if features.CITokenSecret != "" {
+		if uses["create"] {
+			b.allow("CIRunnerSecret", []string{secretARN(features.CITokenSecret)}, "secretsmanager:DescribeSecret")
+		}
+		// Runners are deregistered over SSM before their instance is deleted.
+		if uses["delete"] {
+			b.allow("Commands", everything, "ssm:SendCommand", "ssm:GetCommandInvocation")
+		}
+	}
+	if uses["cp"] && features.Bucket != "" {
+		b.allow("CopyBucket", []string{s3ObjectsARN(features.Bucket, "")}, "s3:PutObject", "s3:GetObject", "s3:DeleteObject")
+	}
+
+	if n := config.Notifications; changes && n != nil && len(n.SNSTopics) > 0 {
+		b.allow("Notifications", n.SNSTopics, "sns:Publish")
+	}
+	if a := config.Audit; a != nil && !a.Disabled && a.S3Bucket != "" && len(commands) > 0 {
+		b.allow("AuditLog", []string{s3ObjectsARN(a.S3Bucket, a.S3Prefix)}, "s3:PutObject")
+	}
+	if scheme, location, _ := strings.Cut(features.ConfigSource, "://"); len(commands) > 0 {
+		switch scheme {
+		case "s3":
+			b.allow("SharedConfig", []string{"arn:aws:s3:::" + location}, "s3:GetObject")
+		case "ssm":
+			b.allow("SharedConfig", []string{"arn:aws:ssm:*:*:parameter/" + strings.TrimPrefix(location, "/")}, "ssm:GetParameter")
+		}
+	}
+	// state unlock breaks the locks the commands that change a fleet take.
+	if config.Lock != "" && (changes || uses["state"]) {
+		scheme, location, _ := strings.Cut(config.Lock, "://")
+		switch scheme {
+		case "dynamodb":
+			b.allow("FleetLock", []string{"arn:aws:dynamodb:*:*:table/" + location}, "dynamodb:GetItem", "dynamodb:PutItem", "dynamodb:DeleteItem")
+		case "s3":
+			bucket, prefix, _ := strings.Cut(location, "/")
+			if prefix != "" && !strings.HasSuffix(prefix, "/") {
+				prefix += "/"
+			}
+			b.allow("FleetLock", []string{s3ObjectsARN(bucket, prefix)}, "s3:PutObject", "s3:GetObject", "s3:DeleteObject")
+		}
+	}
+	usesState := false
+	for command := range uses {
+		usesState = usesState || stateCommands[command]
+	}
+	if scheme, location, _ := strings.Cut(config.State, "://"); usesState {
+		switch scheme {
+		case "dynamodb":
+			table, _, _ := strings.Cut(location, "/")
+			b.allow("StateStore", []string{"arn:aws:dynamodb:*:*:table/" + table}, "dynamodb:GetItem", "dynamodb:PutItem")
+		case "s3":
+			store, _ := newStateStore(config.State)
+			if s3Store, ok := store.(*s3StateStore); ok {
+				b.allow("StateStore", []string{"arn:aws:s3:::" + s3Store.bucket + "/" + s3Store.key}, "s3:GetObject", "s3:PutObject")
+			}
+		}
+	}
+	return b.document(), nil
+}
+
+func IAMPolicyCmd(commands []string, lock *string, features iamPolicyFeatures) {
+	// The config is optional, it only adds the features it enables.
+	config, err := loadConfig()
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "Got an error loading the config:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+	if *lock != "" {
+		config.Lock = *lock
+	}
+	if len(commands) == 0 {
+		for command := range commandActions {
+			commands = append(commands, command)
+		}
+		sort.Strings(commands)
+	}
+
+	doc, err := iamPolicy(commands, config, features)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+	out, _ := json.MarshalIndent(doc, "", "  ")
+	fmt.Println(string(out))
+}
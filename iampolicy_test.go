@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIAMPolicy(t *testing.T) {
+	config := ConfigMap{
+		Notifications: &Notifications{SNSTopics: []string{"arn:aws:sns:us-east-1:111122223333:vm-events"}},
+		Audit:         &AuditConfig{S3Bucket: "audit-logs", S3Prefix: "vmcreate/"},
+		Lock:          "dynamodb://aws-vmcreate-locks",
+	}
+	doc, err := iamPolicy([]string{"create", "list"}, config, iamPolicyFeatures{
+		TargetGroupArn: "arn:aws:elasticloadbalancing:us-east-1:111122223333:targetgroup/web/abc",
+		ConfigSource:   "s3://shared-configs/web.json",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]string{}
+	for _, s := range doc.Statement {
+		got[s.Sid] = strings.Join(s.Action, " ") + " on " + strings.Join(s.Resource, " ")
+	}
+	want := map[string]string{
+		"Commands":      "ec2:CreateTags ec2:DescribeInstanceTypes ec2:DescribeInstances ec2:RunInstances ec2:TerminateInstances elasticloadbalancing:DescribeTargetHealth sts:GetCallerIdentity on *",
+		"TargetGroup":   "elasticloadbalancing:DeregisterTargets elasticloadbalancing:RegisterTargets on arn:aws:elasticloadbalancing:us-east-1:111122223333:targetgroup/web/abc",
+		"Notifications": "sns:Publish on arn:aws:sns:us-east-1:111122223333:vm-events",
+		"AuditLog":      "s3:PutObject on arn:aws:s3:::audit-logs/vmcreate/*",
+		"FleetLock":     "dynamodb:DeleteItem dynamodb:GetItem dynamodb:PutItem on arn:aws:dynamodb:*:*:table/aws-vmcreate-locks",
+		"SharedConfig":  "s3:GetObject on arn:aws:s3:::shared-configs/web.json",
+	}
+	for sid, statement := range want {
+		if got[sid] != statement {
+			t.Errorf("%s = %q, want %q", sid, got[sid], statement)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("got statements %v", got)
+	}
+
+	// Listing alone changes nothing, so needs neither notifications nor the lock.
+	doc, _ = iamPolicy([]string{"list"}, config, iamPolicyFeatures{})
+	for _, s := range doc.Statement {
+		if s.Sid == "Notifications" || s.Sid == "FleetLock" {
+			t.Errorf("list got the %s statement", s.Sid)
+		}
+	}
+
+	if _, err := iamPolicy([]string{"launch"}, config, iamPolicyFeatures{}); err == nil {
+		t.Error("expected an error for an unknown command")
+	}
+}
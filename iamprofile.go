@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"aws-vmcreate/internal/awsapi"
+)
+
+// IAMProfileAPI defines the interface for the IAM functions of iam profile create.
+// We use this interface to test the functions using a mocked service.
+type IAMProfileAPI interface {
+	CreateRole(ctx context.Context, params *awsapi.CreateRoleInput) (*awsapi.CreateRoleOutput, error)
+	AttachRolePolicy(ctx context.Context, roleName, policyArn string) error
+	CreateInstanceProfile(ctx context.Context, params *awsapi.CreateInstanceProfileInput) (*awsapi.CreateInstanceProfileOutput, error)
+	GetInstanceProfile(ctx context.Context, profileName string) (*awsapi.GetInstanceProfileOutput, error)
+	AddRoleToInstanceProfile(ctx context.Context, profileName, roleName string) error
+}
+
+var iamClient *awsapi.IAM
+
+// partition returns the AWS partition of the region.
+func partition(region string) string {
+	switch {
+	case strings.HasPrefix(region, "cn-"):
+		return "aws-cn"
+	case strings.HasPrefix(region, "us-gov-"):
+		return "aws-us-gov"
+	}
+	return "aws"
+}
+
+// ec2TrustPolicy lets EC2 instances assume the role.
+func ec2TrustPolicy(partition string) string {
+	service := "ec2.amazonaws.com"
+	if partition == "aws-cn" {
+		service = "ec2.amazonaws.com.cn"
+	}
+	return `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":{"Service":"` + service + `"},"Action":"sts:AssumeRole"}]}`
+}
+
+// managedPolicyARN returns the ARN of an AWS managed policy given by name,
+// e.g. AmazonSSMManagedInstanceCore or service-role/AmazonEC2RoleforSSM, or
+// the ARN itself.
+func managedPolicyARN(partition, policy string) string {
+	if strings.HasPrefix(policy, "arn:") {
+		return policy
+	}
+	return "arn:" + partition + ":iam::aws:policy/" + policy
+}
+
+func isIAMError(err error, code string) bool {
+	var apiErr *awsapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
+
+// createInstanceProfile creates the role, attaches the policies to it and
+// puts it in an instance profile of the same name. Each step is skipped when
+// it is already done, so it can be re-run to add policies.
+func createInstanceProfile(c context.Context, api IAMProfileAPI, name string, policyARNs []string, partition string, tags map[string]string) (*awsapi.InstanceProfile, error) {
+	var iamTags []awsapi.IAMTag
+	for k, v := range tags {
+		iamTags = append(iamTags, awsapi.IAMTag{Key: k, Value: v})
+	}
+	sort.Slice(iamTags, func(a, b int) bool { return iamTags[a].Key < iamTags[b].Key })
+
+	_, err := api.CreateRole(c, &awsapi.CreateRoleInput{
+		RoleName:                 name,
+		AssumeRolePolicyDocument: ec2TrustPolicy(partition),
+		Description:              "Instance role created by aws-vmcreate",
+		Tags:                     iamTags,
+	})
+	switch {
+	case isIAMError(err, "EntityAlreadyExists"):
+		progressln("Role " + name + " already exists")
+	case err != nil:
+		return nil, fmt.Errorf("creating the role %s: %w", name, err)
+	default:
+		progressln("Created role " + name)
+	}
+
+	for _, arn := range policyARNs {
+		if err := api.AttachRolePolicy(c, name, arn); err != nil {
+			return nil, fmt.Errorf("attaching %s to the role %s: %w", arn, name, err)
+		}
+		progressln("Attached " + arn)
+	}
+
+	var profile awsapi.InstanceProfile
+	created, err := api.CreateInstanceProfile(c, &awsapi.CreateInstanceProfileInput{InstanceProfileName: name, Tags: iamTags})
+	switch {
+	case isIAMError(err, "EntityAlreadyExists"):
+		existing, err := api.GetInstanceProfile(c, name)
+		if err != nil {
+			return nil, fmt.Errorf("reading the instance profile %s: %w", name, err)
+		}
+		profile = existing.InstanceProfile
+		progressln("Instance profile " + name + " already exists")
+	case err != nil:
+		return nil, fmt.Errorf("creating the instance profile %s: %w", name, err)
+	default:
+		profile = created.InstanceProfile
+		progressln("Created instance profile " + name)
+	}
+
+	// An instance profile holds a single role.
+	if len(profile.Roles) > 0 {
+		if held := profile.Roles[0].RoleName; held != name {
+			return nil, fmt.Errorf("the instance profile %s already holds the role %s", name, held)
+		}
+		return &profile, nil
+	}
+	if err := api.AddRoleToInstanceProfile(c, name, name); err != nil {
+		return nil, fmt.Errorf("adding the role %s to the instance profile: %w", name, err)
+	}
+	progressln("Added role " + name + " to instance profile " + name)
+	return &profile, nil
+}
+
+func IAMProfileCreateCmd(name *string, policies []string) {
+	p := partition(awsConfig.Region)
+	var arns []string
+	for _, policy := range policies {
+		if policy = strings.TrimSpace(policy); policy != "" {
+			arns = append(arns, managedPolicyARN(p, policy))
+		}
+	}
+
+	profile, err := createInstanceProfile(context.TODO(), iamClient, *name, arns, p, withProvenance(context.TODO(), nil, ""))
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error creating the instance profile:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	printResult("Instance profile "+profile.Arn+" is ready, create instances with it using --instance-profile "+*name, profile.Arn)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"aws-vmcreate/internal/awsapi"
+)
+
+// fakeIAM keeps roles and instance profiles in memory.
+type fakeIAM struct {
+	roles    map[string][]string
+	profiles map[string]*awsapi.InstanceProfile
+	calls    []string
+}
+
+func (f *fakeIAM) CreateRole(ctx context.Context, params *awsapi.CreateRoleInput) (*awsapi.CreateRoleOutput, error) {
+	f.calls = append(f.calls, "CreateRole")
+	if _, ok := f.roles[params.RoleName]; ok {
+		return nil, &awsapi.Error{StatusCode: 409, Code: "EntityAlreadyExists"}
+	}
+	f.roles[params.RoleName] = nil
+	return &awsapi.CreateRoleOutput{Role: awsapi.Role{RoleName: params.RoleName}}, nil
+}
+
+func (f *fakeIAM) AttachRolePolicy(ctx context.Context, roleName, policyArn string) error {
+	f.calls = append(f.calls, "AttachRolePolicy")
+	f.roles[roleName] = append(f.roles[roleName], policyArn)
+	return nil
+}
+
+func (f *fakeIAM) CreateInstanceProfile(ctx context.Context, params *awsapi.CreateInstanceProfileInput) (*awsapi.CreateInstanceProfileOutput, error) {
+	f.calls = append(f.calls, "CreateInstanceProfile")
+	if _, ok := f.profiles[params.InstanceProfileName]; ok {
+		return nil, &awsapi.Error{StatusCode: 409, Code: "EntityAlreadyExists"}
+	}
+	profile := &awsapi.InstanceProfile{InstanceProfileName: params.InstanceProfileName, Arn: "arn:aws:iam::111122223333:instance-profile/" + params.InstanceProfileName}
+	f.profiles[params.InstanceProfileName] = profile
+	return &awsapi.CreateInstanceProfileOutput{InstanceProfile: *profile}, nil
+}
+
+func (f *fakeIAM) GetInstanceProfile(ctx context.Context, profileName string) (*awsapi.GetInstanceProfileOutput, error) {
+	f.calls = append(f.calls, "GetInstanceProfile")
+	return &awsapi.GetInstanceProfileOutput{InstanceProfile: *f.profiles[profileName]}, nil
+}
+
+func (f *fakeIAM) AddRoleToInstanceProfile(ctx context.Context, profileName, roleName string) error {
+	f.calls = append(f.calls, "AddRoleToInstanceProfile")
+	f.profiles[profileName].Roles = append(f.profiles[profileName].Roles, awsapi.Role{RoleName: roleName})
+	return nil
+}
+
+func TestCreateInstanceProfile(t *testing.T) {
+	fake := &fakeIAM{roles: map[string][]string{}, profiles: map[string]*awsapi.InstanceProfile{}}
+	policy := managedPolicyARN("aws", "AmazonSSMManagedInstanceCore")
+	if policy != "arn:aws:iam::aws:policy/AmazonSSMManagedInstanceCore" {
+		t.Errorf("policy ARN = %s", policy)
+	}
+
+	profile, err := createInstanceProfile(context.Background(), fake, "vm-ssm", []string{policy}, "aws", map[string]string{createdByTag: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Arn != "arn:aws:iam::111122223333:instance-profile/vm-ssm" {
+		t.Errorf("profile ARN = %s", profile.Arn)
+	}
+	if got := fake.profiles["vm-ssm"].Roles; len(got) != 1 || got[0].RoleName != "vm-ssm" {
+		t.Errorf("profile roles = %v", got)
+	}
+
+	// Running it again only attaches the policies.
+	fake.calls = nil
+	if _, err := createInstanceProfile(context.Background(), fake, "vm-ssm", []string{policy}, "aws", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(fake.calls, " "); got != "CreateRole AttachRolePolicy CreateInstanceProfile GetInstanceProfile" {
+		t.Errorf("second run calls = %s", got)
+	}
+
+	fake.profiles["web"] = &awsapi.InstanceProfile{InstanceProfileName: "web", Roles: []awsapi.Role{{RoleName: "legacy"}}}
+	if _, err := createInstanceProfile(context.Background(), fake, "web", nil, "aws", nil); err == nil || !strings.Contains(err.Error(), "legacy") {
+		t.Errorf("got %v, want an error naming the role the profile holds", err)
+	}
+}
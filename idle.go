@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// idleStoppedTag records when idle-check --stop stopped an instance.
+const idleStoppedTag = "aws-vmcreate:idle-stopped"
+
+// idleThresholds are the peaks below which an instance is idle.
+type idleThresholds struct {
+	// CPU is the peak average CPU utilization, in percent.
+	CPU float64
+	// NetworkMB is the peak network traffic in and out, in MB per hour.
+	NetworkMB float64
+}
+
+// idleUsage is how busy an instance was over the window: the peak of its
+// average CPU utilization and of its network traffic, per period.
+type idleUsage struct {
+	InstanceID    string
+	Name          string
+	InstanceType  string
+	PeakCPU       float64
+	PeakNetworkMB float64
+	// Verdict is idle, busy, or why the instance was not judged.
+	Verdict string
+}
+
+// idlePeriod returns the period of the datapoints over the window: hours,
+// or five minutes for windows shorter than a few hours.
+func idlePeriod(window time.Duration) time.Duration {
+	if window < 3*time.Hour {
+		return 5 * time.Minute
+	}
+	return time.Hour
+}
+
+// fetchIdleUsage returns how busy each running instance was over the window
+// before now. Instances launched within the window, or without datapoints,
+// are not judged, so a fresh instance is never idle.
+func fetchIdleUsage(c context.Context, api CloudWatchAPI, instances []types.Instance, window time.Duration, thresholds idleThresholds, now time.Time) ([]idleUsage, error) {
+	period := idlePeriod(window)
+	usage := make([]idleUsage, len(instances))
+	var queries []awsapi.MetricDataQuery
+	type queried struct {
+		instance int
+		metric   string
+	}
+	ids := map[string]queried{}
+	for n, i := range instances {
+		id := aws.ToString(i.InstanceId)
+		usage[n] = idleUsage{InstanceID: id, Name: tagName(i.Tags), InstanceType: string(i.InstanceType)}
+		if i.LaunchTime != nil && i.LaunchTime.After(now.Add(-window)) {
+			usage[n].Verdict = "launched within the window"
+			continue
+		}
+		for _, m := range []struct{ metric, stat string }{{"CPUUtilization", "Average"}, {"NetworkIn", "Sum"}, {"NetworkOut", "Sum"}} {
+			queryID := fmt.Sprintf("m%d", len(queries))
+			ids[queryID] = queried{n, m.metric}
+			queries = append(queries, awsapi.MetricDataQuery{
+				Id:         queryID,
+				Namespace:  "AWS/EC2",
+				MetricName: m.metric,
+				Dimensions: []awsapi.Dimension{{Name: "InstanceId", Value: id}},
+				Period:     period,
+				Stat:       m.stat,
+			})
+		}
+	}
+
+	cpu := map[int][]float64{}
+	network := map[int]map[time.Time]float64{}
+	// GetMetricData takes at most 500 queries, the three of an instance are kept together.
+	for len(queries) > 0 {
+		batch := queries
+		if len(batch) > 498 {
+			batch = batch[:498]
+		}
+		queries = queries[len(batch):]
+
+		input := &awsapi.GetMetricDataInput{Queries: batch, StartTime: now.Add(-window), EndTime: now}
+		for {
+			result, err := api.GetMetricData(c, input)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range result.MetricDataResults {
+				q, ok := ids[r.Id]
+				if !ok {
+					continue
+				}
+				n := q.instance
+				if q.metric == "CPUUtilization" {
+					cpu[n] = append(cpu[n], r.Values...)
+					continue
+				}
+				if network[n] == nil {
+					network[n] = map[time.Time]float64{}
+				}
+				for v, value := range r.Values {
+					if v < len(r.Timestamps) {
+						network[n][r.Timestamps[v]] += value
+					}
+				}
+			}
+			if result.NextToken == "" {
+				break
+			}
+			input.NextToken = result.NextToken
+		}
+	}
+
+	perHour := float64(time.Hour / period)
+	for n := range usage {
+		if usage[n].Verdict != "" {
+			continue
+		}
+		if len(cpu[n]) == 0 {
+			usage[n].Verdict = "no datapoints"
+			continue
+		}
+		for _, v := range cpu[n] {
+			if v > usage[n].PeakCPU {
+				usage[n].PeakCPU = v
+			}
+		}
+		for _, bytes := range network[n] {
+			if mb := bytes * perHour / 1e6; mb > usage[n].PeakNetworkMB {
+				usage[n].PeakNetworkMB = mb
+			}
+		}
+		usage[n].Verdict = "busy"
+		if usage[n].PeakCPU < thresholds.CPU && usage[n].PeakNetworkMB < thresholds.NetworkMB {
+			usage[n].Verdict = "idle"
+		}
+	}
+	return usage, nil
+}
+
+func IdleCheckCmd(name *string, value *string, window *time.Duration, thresholds idleThresholds, stop *bool, dryRun *bool) {
+	// Without a tag, the instances created by aws-vmcreate are checked.
+	filters := []types.Filter{vmcreate.StateFilter("running"), vmcreate.TagKeyFilter(createdByTag)}
+	if *name != "" && *value != "" {
+		filters[1] = vmcreate.TagFilter(*name, strings.Split(*value, ",")...)
+	} else if *name != "" {
+		filters[1] = vmcreate.TagKeyFilter(*name)
+	}
+	instances, err := provisioner.List(context.TODO(), filters...)
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error listing the instances:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	if len(instances) == 0 {
+		fmt.Println("No running instances to check")
+		return
+	}
+
+	now := time.Now()
+	usage, err := fetchIdleUsage(context.TODO(), cloudWatchClient, instances, *window, thresholds, now)
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error fetching the metrics:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tNAME\tTYPE\tPEAK CPU\tPEAK NETWORK\tVERDICT")
+	var idle []string
+	hourly := 0.0
+	for _, u := range usage {
+		peaks := "-\t-"
+		if u.Verdict == "idle" || u.Verdict == "busy" {
+			peaks = fmt.Sprintf("%.1f%%\t%.1f MB/h", u.PeakCPU, u.PeakNetworkMB)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", u.InstanceID, u.Name, u.InstanceType, peaks, u.Verdict)
+		if u.Verdict == "idle" {
+			idle = append(idle, u.InstanceID)
+			price, _ := hourlyPrice(u.InstanceType)
+			hourly += price
+		}
+	}
+	w.Flush()
+
+	if len(idle) == 0 {
+		fmt.Printf("No instance was idle over the last %s\n", *window)
+		return
+	}
+	fmt.Printf("%d instances were idle over the last %s (below %g%% CPU and %g MB/h), about $%.4f/hour\n",
+		len(idle), *window, thresholds.CPU, thresholds.NetworkMB, hourly)
+	switch {
+	case !*stop:
+		fmt.Println("Run again with --stop to stop them")
+		return
+	case *dryRun:
+		fmt.Println("Would stop " + strings.Join(idle, ", "))
+		return
+	}
+
+	// The tag says why the instances stopped to whoever finds them.
+	if err := provisioner.Tag(context.TODO(), idle, map[string]string{idleStoppedTag: now.UTC().Format(time.RFC3339)}); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: could not tag the idle instances: "+err.Error())
+	}
+	if err := provisioner.Stop(context.TODO(), idle); err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error stopping the idle instances:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	fmt.Println("Stopped " + strings.Join(idle, ", "))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeIdleMetrics answers GetMetricData with the datapoints of each
+// instance's metrics, keyed by "INSTANCE/METRIC".
+type fakeIdleMetrics struct {
+	values map[string][]float64
+	now    time.Time
+}
+
+func (f *fakeIdleMetrics) GetMetricData(ctx context.Context, params *awsapi.GetMetricDataInput) (*awsapi.GetMetricDataOutput, error) {
+	out := &awsapi.GetMetricDataOutput{}
+	for _, q := range params.Queries {
+		r := awsapi.MetricDataResult{Id: q.Id, Values: f.values[q.Dimensions[0].Value+"/"+q.MetricName]}
+		for n := range r.Values {
+			r.Timestamps = append(r.Timestamps, f.now.Add(-time.Duration(n)*q.Period))
+		}
+		out.MetricDataResults = append(out.MetricDataResults, r)
+	}
+	return out, nil
+}
+
+func TestFetchIdleUsage(t *testing.T) {
+	now := time.Now()
+	old := aws.Time(now.Add(-48 * time.Hour))
+	instances := []types.Instance{
+		{InstanceId: aws.String("i-idle"), LaunchTime: old},
+		{InstanceId: aws.String("i-cpu"), LaunchTime: old},
+		{InstanceId: aws.String("i-network"), LaunchTime: old},
+		{InstanceId: aws.String("i-new"), LaunchTime: aws.Time(now.Add(-time.Hour))},
+		{InstanceId: aws.String("i-silent"), LaunchTime: old},
+	}
+	api := &fakeIdleMetrics{now: now, values: map[string][]float64{
+		"i-idle/CPUUtilization": {1, 2.5, 0.5}, "i-idle/NetworkIn": {1e6, 2e5}, "i-idle/NetworkOut": {1e6},
+		"i-cpu/CPUUtilization": {1, 60}, "i-cpu/NetworkIn": {1e5}, "i-cpu/NetworkOut": {1e5},
+		// 3 MB in and 3 MB out in the same hour are 6 MB/h.
+		"i-network/CPUUtilization": {1}, "i-network/NetworkIn": {3e6}, "i-network/NetworkOut": {3e6},
+		"i-new/CPUUtilization": {0},
+	}}
+	usage, err := fetchIdleUsage(context.Background(), api, instances, 24*time.Hour, idleThresholds{CPU: 5, NetworkMB: 5}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, u := range usage {
+		got = append(got, u.InstanceID+"="+u.Verdict)
+	}
+	want := "i-idle=idle,i-cpu=busy,i-network=busy,i-new=launched within the window,i-silent=no datapoints"
+	if strings.Join(got, ",") != want {
+		t.Errorf("got %s, want %s", strings.Join(got, ","), want)
+	}
+	if usage[0].PeakCPU != 2.5 || usage[0].PeakNetworkMB != 2 {
+		t.Errorf("i-idle peaks = %g%% and %g MB/h, want 2.5%% and 2 MB/h", usage[0].PeakCPU, usage[0].PeakNetworkMB)
+	}
+}
+
+func TestIdlePeriod(t *testing.T) {
+	if p := idlePeriod(time.Hour); p != 5*time.Minute {
+		t.Errorf("a 1h window has %s periods, want 5m", p)
+	}
+	if p := idlePeriod(24 * time.Hour); p != time.Hour {
+		t.Errorf("a 24h window has %s periods, want 1h", p)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// checkMetadataTagKeys returns an error for the first tag key the instance
+// metadata cannot serve. EC2 refuses to launch with metadata tags on when
+// a key has a space or a slash, or is . or ..
+func checkMetadataTagKeys(tags map[string]string) error {
+	var keys []string
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		valid := k != "." && k != ".."
+		for _, r := range k {
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("+-=._:@,", r) {
+				valid = false
+			}
+		}
+		if !valid {
+			return fmt.Errorf("the tag key %q cannot be read from the instance metadata, which allows letters, digits and + - = . , _ : @ only", k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestCheckMetadataTagKeys(t *testing.T) {
+	if err := checkMetadataTagKeys(map[string]string{"Name": "web-1", createdByTag: "alice", "team@example.com": "x"}); err != nil {
+		t.Error(err)
+	}
+	for _, key := range []string{"cost center", "app/role", ".."} {
+		if err := checkMetadataTagKeys(map[string]string{"Name": "web-1", key: "x"}); err == nil || !strings.Contains(err.Error(), key) {
+			t.Errorf("%q: got %v, want it refused", key, err)
+		}
+	}
+}
+
+func TestLaunchCustomizationMetadataTags(t *testing.T) {
+	in := &ec2.RunInstancesInput{}
+	launchCustomization(launchOptions{MetadataTags: true})(in)
+	if in.MetadataOptions == nil || in.MetadataOptions.InstanceMetadataTags != types.InstanceMetadataTagsStateEnabled {
+		t.Errorf("MetadataOptions = %+v, want the tags enabled", in.MetadataOptions)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// placeholderTag is the value of the starter tags nobody has filled in yet.
+const placeholderTag = "CHANGE-ME"
+
+// initAPIFor returns the EC2 client init looks up images and subnets with in
+// region.
+var initAPIFor = func(region string) ValidateEC2API {
+	cfg := awsConfig.Copy()
+	cfg.Region = region
+	return ec2.NewFromConfig(cfg)
+}
+
+// placeholderTags are the tags of the starter config, for the owner and the
+// project of the instances.
+func placeholderTags() map[string]string {
+	owner := placeholderTag
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		owner = filepath.Base(u.Username)
+	}
+	return map[string]string{"owner": owner, "project": placeholderTag}
+}
+
+// defaultSubnets returns the default subnets of the region, those with the
+// most free addresses first.
+func defaultSubnets(c context.Context, api ValidateEC2API) ([]types.Subnet, error) {
+	result, err := api.DescribeSubnets(c, &ec2.DescribeSubnetsInput{
+		Filters: []types.Filter{{Name: aws.String("default-for-az"), Values: []string{"true"}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	subnets := result.Subnets
+	sort.SliceStable(subnets, func(a, b int) bool {
+		return aws.ToInt32(subnets[a].AvailableIpAddressCount) > aws.ToInt32(subnets[b].AvailableIpAddressCount)
+	})
+	return subnets, nil
+}
+
+// starterConfig returns a config for region: the newest Amazon Linux 2023
+// image, the first default subnet validate accepts for instanceType, and
+// placeholder tags. The notes say what could not be filled in.
+func starterConfig(c context.Context, api ValidateEC2API, region string, instanceType string) (*ConfigMap, []string, error) {
+	config := &ConfigMap{Region: region, InstanceType: instanceType, Tags: placeholderTags()}
+	var notes []string
+
+	image, err := latestImage(c, api, wizardOSes[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("looking up the %s image: %w", wizardOSes[0].Label, err)
+	}
+	if image == nil {
+		return nil, nil, fmt.Errorf("%s has no %s image, set image_id yourself", region, wizardOSes[0].Label)
+	}
+	config.ImageId = aws.ToString(image.ImageId)
+
+	subnets, err := defaultSubnets(c, api)
+	if err != nil {
+		return nil, nil, fmt.Errorf("listing the default subnets: %w", err)
+	}
+	for _, s := range subnets {
+		if _, check := validateSubnet(c, api, aws.ToString(s.SubnetId), instanceType); check.Err == nil {
+			config.SubnetId = aws.ToString(s.SubnetId)
+			break
+		}
+	}
+	if config.SubnetId == "" {
+		notes = append(notes, fmt.Sprintf("No default subnet of %s can launch %s, set subnet_id to one of your subnets", region, instanceType))
+	}
+	return config, notes, nil
+}
+
+// runInitWizard asks for the settings of the starter config, suggesting
+// those starterConfig found for the region chosen.
+func runInitWizard(c context.Context, in io.Reader, out io.Writer, regionsAPI EC2RegionsAPI, region string) (*ConfigMap, error) {
+	w := &wizard{in: bufio.NewReader(in), out: out}
+
+	regions, err := resolveRegions(c, regionsAPI, "", true)
+	if err != nil {
+		return nil, fmt.Errorf("listing the regions: %w", err)
+	}
+	var regionOptions []option
+	for _, r := range regions {
+		regionOptions = append(regionOptions, option{r, r})
+	}
+	if region, err = w.choose("Region:", regionOptions, region, true); err != nil {
+		return nil, err
+	}
+	api := initAPIFor(region)
+
+	var typeOptions []option
+	for _, t := range wizardInstanceTypes {
+		typeOptions = append(typeOptions, option{t, t})
+	}
+	instanceType, err := w.choose("Instance size (or another instance type):", typeOptions, "t3.micro", true)
+	if err != nil {
+		return nil, err
+	}
+	config, _, err := starterConfig(c, api, region, instanceType)
+	if err != nil {
+		return nil, err
+	}
+
+	var imageOptions []option
+	for _, system := range wizardOSes {
+		image, err := latestImage(c, api, system)
+		if err != nil {
+			return nil, fmt.Errorf("looking up %s images: %w", system.Label, err)
+		}
+		if image != nil {
+			imageOptions = append(imageOptions, option{aws.ToString(image.ImageId), system.Label + " (" + aws.ToString(image.ImageId) + ")"})
+		}
+	}
+	if config.ImageId, err = w.choose("Operating system (or an AMI id):", imageOptions, config.ImageId, true); err != nil {
+		return nil, err
+	}
+
+	subnets, err := defaultSubnets(c, api)
+	if err != nil {
+		return nil, fmt.Errorf("listing the default subnets: %w", err)
+	}
+	subnetOptions := []option{{"", "Any default subnet, chosen by EC2"}}
+	for _, s := range subnets {
+		label := fmt.Sprintf("%s  %s  %d free addresses", aws.ToString(s.SubnetId), aws.ToString(s.AvailabilityZone), aws.ToInt32(s.AvailableIpAddressCount))
+		subnetOptions = append(subnetOptions, option{aws.ToString(s.SubnetId), label})
+	}
+	for {
+		if config.SubnetId, err = w.choose("Network (or a subnet id):", subnetOptions, config.SubnetId, true); err != nil {
+			return nil, err
+		}
+		if config.SubnetId == "" {
+			break
+		}
+		_, check := validateSubnet(c, api, config.SubnetId, config.InstanceType)
+		if check.Err == nil {
+			break
+		}
+		fmt.Fprintln(w.out, "That subnet cannot be used: "+check.Err.Error())
+	}
+
+	for _, key := range []string{"owner", "project"} {
+		value, err := w.ask("The "+key+" tag of the instances", config.Tags[key])
+		if err != nil {
+			return nil, err
+		}
+		config.Tags[key] = value
+	}
+	return config, nil
+}
+
+func InitCmd(interactive *bool, force *bool) {
+	if _, err := os.Stat(configPath); err == nil && !*force {
+		failCommand(configPath + " already exists, pass --force to replace it")
+		return
+	}
+
+	var config *ConfigMap
+	var notes []string
+	var err error
+	if *interactive {
+		if !stdinIsTerminal() {
+			failCommand("The --interactive init needs a terminal")
+			return
+		}
+		config, err = runInitWizard(context.TODO(), os.Stdin, os.Stdout, client, awsConfig.Region)
+	} else {
+		if awsConfig.Region == "" {
+			failCommand("No region is configured, set AWS_REGION or the region of your profile, or run init --interactive")
+			return
+		}
+		progressln("Looking up the image and subnet to start with in " + awsConfig.Region)
+		config, notes, err = starterConfig(context.TODO(), initAPIFor(awsConfig.Region), awsConfig.Region, "t3.micro")
+	}
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error preparing the config:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	data, err := json.MarshalIndent(config, "", "    ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(configPath), 0o755)
+	}
+	if err == nil {
+		err = os.WriteFile(configPath, append(data, '\n'), 0o644)
+	}
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error writing the config:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	fmt.Println("Wrote " + configPath + ":")
+	fmt.Println(string(data))
+	for _, note := range notes {
+		progressln(note)
+	}
+	var keys []string
+	for k := range config.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if config.Tags[k] == placeholderTag {
+			progressln("Replace the " + placeholderTag + " value of the " + k + " tag before creating instances")
+		}
+	}
+	progressln("Check it with aws-vmcreate validate")
+}
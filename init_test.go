@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestStarterConfig(t *testing.T) {
+	fake := newFakeValidateEC2(t)
+	fake.images = append(fake.images,
+		types.Image{ImageId: aws.String("ami-old"), Name: aws.String("al2023-ami-2023.1-x86_64"), CreationDate: aws.String("2023-03-01T00:00:00Z")},
+		types.Image{ImageId: aws.String("ami-new"), Name: aws.String("al2023-ami-2023.6-x86_64"), CreationDate: aws.String("2024-11-01T00:00:00Z")},
+	)
+	fake.subnets = []types.Subnet{
+		// The subnet with the most free addresses is in a zone without the type.
+		{SubnetId: aws.String("subnet-b"), AvailabilityZone: aws.String("us-east-1b"), DefaultForAz: aws.Bool(true), AvailableIpAddressCount: aws.Int32(4000)},
+		{SubnetId: aws.String("subnet-a"), AvailabilityZone: aws.String("us-east-1a"), DefaultForAz: aws.Bool(true), AvailableIpAddressCount: aws.Int32(3000)},
+		{SubnetId: aws.String("subnet-private"), AvailabilityZone: aws.String("us-east-1a"), AvailableIpAddressCount: aws.Int32(5000)},
+	}
+
+	config, notes, err := starterConfig(context.Background(), fake, "us-east-1", "t3.micro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Region != "us-east-1" || config.ImageId != "ami-new" || config.SubnetId != "subnet-a" || config.InstanceType != "t3.micro" {
+		t.Errorf("config = %+v", config)
+	}
+	if config.Tags["project"] != placeholderTag || config.Tags["owner"] == "" || len(notes) != 0 {
+		t.Errorf("tags = %v, notes = %v", config.Tags, notes)
+	}
+
+	fake.zones = nil
+	config, notes, err = starterConfig(context.Background(), fake, "us-east-1", "t3.micro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.SubnetId != "" || len(notes) != 1 || !strings.Contains(notes[0], "set subnet_id") {
+		t.Errorf("subnet %q, notes %v, want none and a note", config.SubnetId, notes)
+	}
+}
+
+func TestInitCommand(t *testing.T) {
+	fake := newFakeValidateEC2(t)
+	fake.images = append(fake.images, types.Image{ImageId: aws.String("ami-al2023"), Name: aws.String("al2023-ami-2023.6-x86_64")})
+	previous := initAPIFor
+	initAPIFor = func(string) ValidateEC2API { return fake }
+	t.Cleanup(func() { initAPIFor = previous })
+	awsConfig.Region = "us-east-1"
+	useConfig(t, ConfigMap{})
+
+	if out := runCLI(t, "init"); !strings.Contains(out, "already exists, pass --force") {
+		t.Fatalf("output:\n%s", out)
+	}
+	out := runCLI(t, "init", "--force")
+	if !strings.Contains(out, "Replace the CHANGE-ME value of the project tag") {
+		t.Errorf("output:\n%s", out)
+	}
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatalf("the written config does not load: %v", err)
+	}
+	if config.ImageId != "ami-al2023" || config.Tags["project"] != placeholderTag {
+		t.Errorf("config = %+v", config)
+	}
+}
+
+func TestInitReplacesBrokenConfig(t *testing.T) {
+	fake := newFakeValidateEC2(t)
+	fake.images = append(fake.images, types.Image{ImageId: aws.String("ami-al2023"), Name: aws.String("al2023-ami-2023.6-x86_64")})
+	previous, previousRegion := initAPIFor, awsConfig.Region
+	initAPIFor = func(string) ValidateEC2API { return fake }
+	t.Cleanup(func() { initAPIFor, awsConfig.Region = previous, previousRegion })
+	awsConfig.Region = "us-east-1"
+	useConfig(t, ConfigMap{})
+	if err := os.WriteFile(configPath, []byte(`{"instance_type": 5}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, _, code := runCLIExit(t, true, "init", "--force")
+	if code != 0 {
+		t.Fatalf("init exited %d:\n%s", code, out)
+	}
+	if _, err := loadConfig(); err != nil {
+		t.Errorf("the broken config was not replaced: %v\n%s", err, out)
+	}
+}
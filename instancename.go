@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// instanceCommands are the commands that take an instance with -i.
+var instanceCommands = map[string]bool{
+	"connect":     true,
+	"tunnel":      true,
+	"resize":      true,
+	"who-created": true,
+	"diff":        true,
+	"debug-clone": true,
+	"quarantine":  true,
+	"history":     true,
+}
+
+// resolveInstanceName returns the ID of the live instance whose Name tag is
+// name, for the commands that take -i INSTANCE_ID to take --name NAME too.
+// A name several instances share is an error listing them, rather than a
+// guess at which one was meant.
+func resolveInstanceName(c context.Context, p *vmcreate.Provisioner, name string) (string, error) {
+	instances, err := p.List(c, vmcreate.TagFilter("Name", name), vmcreate.StateFilter(vmcreate.LiveStates...))
+	if err != nil {
+		return "", fmt.Errorf("looking up the instance named %s: %w", name, err)
+	}
+	switch len(instances) {
+	case 0:
+		return "", fmt.Errorf("no instance is named %s", name)
+	case 1:
+		return aws.ToString(instances[0].InstanceId), nil
+	}
+	sort.Slice(instances, func(a, b int) bool {
+		return aws.ToTime(instances[a].LaunchTime).Before(aws.ToTime(instances[b].LaunchTime))
+	})
+	var candidates []string
+	for _, i := range instances {
+		candidates = append(candidates, fmt.Sprintf("%s (%s, launched %s)",
+			aws.ToString(i.InstanceId), instanceState(&i), aws.ToTime(i.LaunchTime).UTC().Format(time.RFC3339)))
+	}
+	return "", fmt.Errorf("%d instances are named %s, choose one with -i: %s", len(instances), name, strings.Join(candidates, ", "))
+}
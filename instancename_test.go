@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func namedInstance(name string, launched time.Time) types.Instance {
+	return types.Instance{LaunchTime: aws.Time(launched), Tags: []types.Tag{{Key: aws.String("Name"), Value: aws.String(name)}}}
+}
+
+func TestResolveInstanceName(t *testing.T) {
+	fake := useFakeEC2(t)
+	launched := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	web := fake.AddInstance(namedInstance("web-1", launched))
+	first := fake.AddInstance(namedInstance("db", launched))
+	second := fake.AddInstance(namedInstance("db", launched.Add(time.Hour)))
+
+	if id, err := resolveInstanceName(context.Background(), provisioner, "web-1"); err != nil || id != web {
+		t.Errorf("web-1 = %q, %v", id, err)
+	}
+	if _, err := resolveInstanceName(context.Background(), provisioner, "nope"); err == nil || !strings.Contains(err.Error(), "no instance is named nope") {
+		t.Errorf("missing name: %v", err)
+	}
+	_, err := resolveInstanceName(context.Background(), provisioner, "db")
+	if err == nil || !strings.Contains(err.Error(), "2 instances are named db") || strings.Index(err.Error(), first) > strings.Index(err.Error(), second) {
+		t.Errorf("ambiguous name: %v", err)
+	}
+}
+
+func TestInstanceCommandByName(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{})
+	id := fake.AddInstance(namedInstance("web-1", time.Now()))
+
+	out := runCLI(t, "resize", "--name", "web-1", "-t", "t3.small")
+	if got := fake.Instance(id).InstanceType; got != "t3.small" {
+		t.Errorf("the instance is a %s:\n%s", got, out)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// EC2InstanceTypesAPI defines the interface for the DescribeInstanceTypes function.
+// We use this interface to test the functions using a mocked service.
+type EC2InstanceTypesAPI interface {
+	DescribeInstanceTypes(ctx context.Context,
+		params *ec2.DescribeInstanceTypesInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceTypesOutput, error)
+}
+
+// instanceTypesClient lists the instance types of the default region.
+var instanceTypesClient EC2InstanceTypesAPI
+
+// instanceTypeCacheTTL is how long the cached instance types of a region are
+// used before they are listed again.
+var instanceTypeCacheTTL = 24 * time.Hour
+
+// instanceType is what aws-vmcreate needs to know about an instance type.
+type instanceType struct {
+	Name              string   `json:"name"`
+	VCPUs             int32    `json:"vcpus"`
+	MemoryMiB         int64    `json:"memory_mib"`
+	Architectures     []string `json:"architectures"`
+	GPUs              int32    `json:"gpus,omitempty"`
+	GPUName           string   `json:"gpu_name,omitempty"`
+	GPUMemoryMiB      int32    `json:"gpu_memory_mib,omitempty"`
+	Nitro             bool     `json:"nitro,omitempty"`
+	BootModes         []string `json:"boot_modes,omitempty"`
+	CurrentGeneration bool     `json:"current_generation,omitempty"`
+}
+
+// Family returns the part of the name before the size, e.g. c6i.
+func (t instanceType) Family() string {
+	family, _, _ := strings.Cut(t.Name, ".")
+	return family
+}
+
+// instanceTypeCache is the file the instance types of a region are kept in.
+type instanceTypeCache struct {
+	Fetched time.Time      `json:"fetched"`
+	Types   []instanceType `json:"types"`
+}
+
+func newInstanceType(info types.InstanceTypeInfo) instanceType {
+	t := instanceType{
+		Name:              string(info.InstanceType),
+		Nitro:             info.Hypervisor == types.InstanceTypeHypervisorNitro,
+		CurrentGeneration: aws.ToBool(info.CurrentGeneration),
+	}
+	if info.VCpuInfo != nil {
+		t.VCPUs = aws.ToInt32(info.VCpuInfo.DefaultVCpus)
+	}
+	if info.MemoryInfo != nil {
+		t.MemoryMiB = aws.ToInt64(info.MemoryInfo.SizeInMiB)
+	}
+	if info.ProcessorInfo != nil {
+		for _, a := range info.ProcessorInfo.SupportedArchitectures {
+			t.Architectures = append(t.Architectures, string(a))
+		}
+	}
+	for _, m := range info.SupportedBootModes {
+		t.BootModes = append(t.BootModes, string(m))
+	}
+	if info.GpuInfo != nil {
+		for _, g := range info.GpuInfo.Gpus {
+			t.GPUs += aws.ToInt32(g.Count)
+			t.GPUName = strings.TrimSpace(aws.ToString(g.Manufacturer) + " " + aws.ToString(g.Name))
+			if g.MemoryInfo != nil {
+				t.GPUMemoryMiB = aws.ToInt32(g.MemoryInfo.SizeInMiB)
+			}
+		}
+	}
+	return t
+}
+
+// instanceTypeCachePath returns where the instance types of the region are
+// cached, in ~/.aws/aws-vmcreate/cache.
+func instanceTypeCachePath(region string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".aws", "aws-vmcreate", "cache", "instance-types-"+region+".json"), nil
+}
+
+// loadInstanceTypes returns the instance types offered in the region, from
+// the cache while it is younger than ttl and from DescribeInstanceTypes
+// otherwise. A cache that cannot be written only costs the next run a call.
+func loadInstanceTypes(c context.Context, api EC2InstanceTypesAPI, region string, ttl time.Duration) ([]instanceType, error) {
+	path, pathErr := instanceTypeCachePath(region)
+	if pathErr == nil && ttl > 0 {
+		if data, err := os.ReadFile(path); err == nil {
+			var cache instanceTypeCache
+			if json.Unmarshal(data, &cache) == nil && time.Since(cache.Fetched) < ttl && len(cache.Types) > 0 {
+				return cache.Types, nil
+			}
+		}
+	}
+
+	cache := instanceTypeCache{Fetched: time.Now().UTC()}
+	paginator := ec2.NewDescribeInstanceTypesPaginator(api, &ec2.DescribeInstanceTypesInput{})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(c)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range page.InstanceTypes {
+			cache.Types = append(cache.Types, newInstanceType(info))
+		}
+	}
+	sort.Slice(cache.Types, func(a, b int) bool { return cache.Types[a].Name < cache.Types[b].Name })
+
+	if pathErr == nil {
+		if data, err := json.Marshal(cache); err == nil && os.MkdirAll(filepath.Dir(path), 0700) == nil {
+			os.WriteFile(path, data, 0600)
+		}
+	}
+	return cache.Types, nil
+}
+
+// errInstanceTypeNotOffered is wrapped by findInstanceType when the region
+// does not offer the type, as opposed to when it cannot be listed.
+var errInstanceTypeNotOffered = errors.New("instance type not offered")
+
+// findInstanceType returns the named instance type of the region, and an
+// error naming a few similar ones when the region does not offer it.
+func findInstanceType(c context.Context, api EC2InstanceTypesAPI, region string, name string) (*instanceType, error) {
+	all, err := loadInstanceTypes(c, api, region, instanceTypeCacheTTL)
+	if err != nil {
+		return nil, fmt.Errorf("listing the instance types of %s: %w", region, err)
+	}
+	var similar []string
+	family, _, _ := strings.Cut(name, ".")
+	for i := range all {
+		if all[i].Name == name {
+			return &all[i], nil
+		}
+		if all[i].Family() == family && len(similar) < 5 {
+			similar = append(similar, all[i].Name)
+		}
+	}
+	if len(similar) > 0 {
+		return nil, fmt.Errorf("%w: %s is not offered in %s, the %s family has %s", errInstanceTypeNotOffered, name, region, family, strings.Join(similar, ", "))
+	}
+	return nil, fmt.Errorf("%w: %s is not offered in %s", errInstanceTypeNotOffered, name, region)
+}
+
+// instanceTypeFilter selects instance types for types list.
+type instanceTypeFilter struct {
+	Family       string
+	MinVCPUs     int
+	MinMemoryGiB float64
+	Architecture string
+}
+
+func (f instanceTypeFilter) matches(t instanceType) bool {
+	if f.Family != "" && t.Family() != f.Family {
+		return false
+	}
+	if int(t.VCPUs) < f.MinVCPUs || float64(t.MemoryMiB)/1024 < f.MinMemoryGiB {
+		return false
+	}
+	return f.Architecture == "" || contains(t.Architectures, f.Architecture)
+}
+
+func TypesCmd(filter instanceTypeFilter) {
+	all, err := loadInstanceTypes(context.TODO(), instanceTypesClient, awsConfig.Region, instanceTypeCacheTTL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error listing the instance types:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+
+	var matched []instanceType
+	for _, t := range all {
+		if filter.matches(t) {
+			matched = append(matched, t)
+		}
+	}
+	sort.SliceStable(matched, func(a, b int) bool {
+		if matched[a].Family() != matched[b].Family() {
+			return matched[a].Family() < matched[b].Family()
+		}
+		if matched[a].VCPUs != matched[b].VCPUs {
+			return matched[a].VCPUs < matched[b].VCPUs
+		}
+		return matched[a].MemoryMiB < matched[b].MemoryMiB
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tVCPUS\tMEMORY (GIB)\tARCHITECTURE\tGPUS\t$/HOUR")
+	for _, t := range matched {
+		gpus, hourly := "-", "-"
+		if t.GPUs > 0 {
+			gpus = fmt.Sprintf("%d x %s", t.GPUs, t.GPUName)
+		}
+		if price, ok := hourlyPrice(t.Name); ok {
+			hourly = fmt.Sprintf("$%.4f", price)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%g\t%s\t%s\t%s\n", t.Name, t.VCPUs, float64(t.MemoryMiB)/1024, strings.Join(t.Architectures, ","), gpus, hourly)
+	}
+	w.Flush()
+	fmt.Printf("%d instance types in %s\n", len(matched), awsConfig.Region)
+}
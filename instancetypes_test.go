@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func countCalls(calls []string, operation string) int {
+	n := 0
+	for _, c := range calls {
+		if c == operation {
+			n++
+		}
+	}
+	return n
+}
+
+func TestTypesList(t *testing.T) {
+	fake := useFakeEC2(t)
+
+	out := runCLI(t, "types", "list", "--family", "c6i", "--min-vcpus", "8")
+	if !strings.Contains(out, "c6i.2xlarge") || !strings.Contains(out, "c6i.4xlarge") || strings.Contains(out, "c6i.large ") {
+		t.Errorf("output:\n%s", out)
+	}
+	if !strings.Contains(out, "2 instance types in") {
+		t.Errorf("output does not count the types:\n%s", out)
+	}
+	pages := countCalls(fake.Calls(), "DescribeInstanceTypes")
+	if pages < 2 {
+		t.Errorf("listed %d pages, want every page", pages)
+	}
+
+	// The second run is answered from the cache, until the TTL is zero.
+	runCLI(t, "types", "list", "--min-memory", "16")
+	if n := countCalls(fake.Calls(), "DescribeInstanceTypes"); n != pages {
+		t.Errorf("%d DescribeInstanceTypes calls after a cached run, want %d", n, pages)
+	}
+	out = runCLI(t, "types", "list", "--cache-ttl", "0", "--min-memory", "16")
+	if n := countCalls(fake.Calls(), "DescribeInstanceTypes"); n != 2*pages {
+		t.Errorf("%d DescribeInstanceTypes calls with --cache-ttl 0, want %d", n, 2*pages)
+	}
+	if !strings.Contains(out, "1 x NVIDIA A10G") || strings.Contains(out, "t3.large") {
+		t.Errorf("output:\n%s", out)
+	}
+}
+
+func TestUnknownInstanceTypeIsRejected(t *testing.T) {
+	fake := useFakeEC2(t)
+	id := fake.AddInstance(types.Instance{InstanceType: "t3.micro"})
+
+	out := runCLI(t, "resize", id, "-t", "t3.mega")
+	if !strings.Contains(out, "t3.mega is not offered") || !strings.Contains(out, "t3.large") {
+		t.Errorf("output:\n%s", out)
+	}
+	if n := countCalls(fake.Calls(), "StopInstances"); n != 0 {
+		t.Errorf("stopped the instance for an unknown type")
+	}
+
+	// create exits before launching, so only the check itself is run here.
+	if _, err := findInstanceType(context.Background(), fake, "us-east-1", "q9.huge"); !errors.Is(err, errInstanceTypeNotOffered) {
+		t.Errorf("err = %v, want errInstanceTypeNotOffered", err)
+	}
+	fake.Fail("DescribeInstanceTypes", errors.New("UnauthorizedOperation"))
+	if _, err := findInstanceType(context.Background(), fake, "eu-west-1", "t3.micro"); err == nil || errors.Is(err, errInstanceTypeNotOffered) {
+		t.Errorf("err = %v, want the listing error", err)
+	}
+}
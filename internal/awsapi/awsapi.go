@@ -0,0 +1,425 @@
+// Package awsapi is a small SigV4-signed client for the AWS services the tool
+// talks to beyond EC2. It covers the JSON protocol used by most of those
+// services so that every one of them doesn't drag in its own SDK module.
+//
+// Requests go through a smithy middleware stack like the SDK clients', so
+// the APIOptions of the config apply to them and the retryer of the config
+// retries them.
+package awsapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// Client signs and sends requests to a single AWS service.
+type Client struct {
+	cfg     aws.Config
+	retryer aws.Retryer
+
+	// ServiceID names the service in logs and traces, as the SDK clients
+	// do, e.g. "SSM".
+	ServiceID string
+	// SigningName is the service name used in the SigV4 credential scope.
+	SigningName string
+	// EndpointPrefix is the host prefix of the regional endpoint.
+	EndpointPrefix string
+	// TargetPrefix is prepended to the operation name in the X-Amz-Target header.
+	TargetPrefix string
+	// JSONVersion is the x-amz-json content type version, "1.0" or "1.1".
+	JSONVersion string
+	// GlobalEndpoint and SigningRegion are set for global services, which
+	// have a single endpoint signed for a fixed region.
+	GlobalEndpoint string
+	SigningRegion  string
+}
+
+// New returns a Client for the service using the region, credentials and
+// HTTP client of cfg.
+func New(cfg aws.Config, signingName, endpointPrefix, targetPrefix, jsonVersion string) *Client {
+	serviceID, ok := serviceIDs[signingName]
+	if !ok {
+		serviceID = signingName
+	}
+	retryer := aws.Retryer(retry.NewStandard())
+	if cfg.Retryer != nil {
+		retryer = cfg.Retryer()
+	}
+	return &Client{
+		cfg:            cfg,
+		retryer:        retryer,
+		ServiceID:      serviceID,
+		SigningName:    signingName,
+		EndpointPrefix: endpointPrefix,
+		TargetPrefix:   targetPrefix,
+		JSONVersion:    jsonVersion,
+	}
+}
+
+// serviceIDs are the SDK service IDs of the services, by signing name.
+var serviceIDs = map[string]string{
+	"budgets":              "Budgets",
+	"ce":                   "Cost Explorer",
+	"cloudtrail":           "CloudTrail",
+	"dynamodb":             "DynamoDB",
+	"ec2-instance-connect": "EC2 Instance Connect",
+	"elasticfilesystem":    "EFS",
+	"elasticloadbalancing": "Elastic Load Balancing v2",
+	"events":               "EventBridge",
+	"iam":                  "IAM",
+	"monitoring":           "CloudWatch",
+	"organizations":        "Organizations",
+	"route53":              "Route 53",
+	"s3":                   "S3",
+	"savingsplans":         "savingsplans",
+	"secretsmanager":       "Secrets Manager",
+	"servicequotas":        "Service Quotas",
+	"sns":                  "SNS",
+	"sqs":                  "SQS",
+	"ssm":                  "SSM",
+	"tagging":              "Resource Groups Tagging API",
+}
+
+// Error is returned when the service responds with a non-2xx status code.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RequestID  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("api error %s: %s (status %d, request id %s)", e.Code, e.Message, e.StatusCode, e.RequestID)
+}
+
+// ErrorCode, ErrorMessage and ErrorFault make Error a smithy.APIError, so
+// that the retryer and error checks treat it like an SDK error.
+func (e *Error) ErrorCode() string    { return e.Code }
+func (e *Error) ErrorMessage() string { return e.Message }
+func (e *Error) ErrorFault() smithy.ErrorFault {
+	if e.StatusCode >= 500 {
+		return smithy.FaultServer
+	}
+	return smithy.FaultClient
+}
+
+// HTTPStatusCode lets the retryer retry the 5xx status codes.
+func (e *Error) HTTPStatusCode() int { return e.StatusCode }
+
+// Endpoint returns the base URL of the service in the configured region. An
+// endpoint resolver on the config, such as one pointing at LocalStack, takes
+// precedence; it is asked for the service by its signing name.
+func (c *Client) Endpoint() string {
+	if r := c.cfg.EndpointResolverWithOptions; r != nil {
+		endpoint, err := r.ResolveEndpoint(c.SigningName, c.cfg.Region)
+		if err == nil && endpoint.URL != "" {
+			return strings.TrimRight(endpoint.URL, "/")
+		}
+	}
+	if c.GlobalEndpoint != "" {
+		return c.GlobalEndpoint
+	}
+	china := strings.HasPrefix(c.cfg.Region, "cn-")
+	suffix := "amazonaws.com"
+	if china {
+		suffix = "amazonaws.com.cn"
+	}
+	host := c.EndpointPrefix
+	if c.useFIPS() {
+		host += "-fips"
+	}
+	if c.useDualStack() {
+		// S3 kept its older dual-stack hostnames; the other services are
+		// dual-stack under api.aws.
+		if c.EndpointPrefix == "s3" {
+			return fmt.Sprintf("https://%s.dualstack.%s.%s", host, c.cfg.Region, suffix)
+		}
+		suffix = "api.aws"
+		if china {
+			suffix = "api.amazonwebservices.com.cn"
+		}
+	}
+	return fmt.Sprintf("https://%s.%s.%s", host, c.cfg.Region, suffix)
+}
+
+// useFIPS reports whether the config sources, in order, ask for FIPS
+// endpoints, as the SDK clients do with use_fips_endpoint.
+func (c *Client) useFIPS() bool {
+	for _, source := range c.cfg.ConfigSources {
+		p, ok := source.(interface {
+			GetUseFIPSEndpoint(context.Context) (aws.FIPSEndpointState, bool, error)
+		})
+		if !ok {
+			continue
+		}
+		if state, found, err := p.GetUseFIPSEndpoint(context.TODO()); err == nil && found {
+			return state == aws.FIPSEndpointStateEnabled
+		}
+	}
+	return false
+}
+
+// useDualStack reports whether the config sources ask for dual-stack
+// endpoints, as the SDK clients do with use_dualstack_endpoint.
+func (c *Client) useDualStack() bool {
+	for _, source := range c.cfg.ConfigSources {
+		p, ok := source.(interface {
+			GetUseDualStackEndpoint(context.Context) (aws.DualStackEndpointState, bool, error)
+		})
+		if !ok {
+			continue
+		}
+		if state, found, err := p.GetUseDualStackEndpoint(context.TODO()); err == nil && found {
+			return state == aws.DualStackEndpointStateEnabled
+		}
+	}
+	return false
+}
+
+// Call invokes a JSON protocol operation, marshalling in as the request body
+// and unmarshalling the response body into out when out is not nil.
+func (c *Client) Call(ctx context.Context, operation string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Endpoint()+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-"+c.JSONVersion)
+	req.Header.Set("X-Amz-Target", c.TargetPrefix+"."+operation)
+
+	respBody, err := c.Do(ctx, operation, in, req, body)
+	if err != nil {
+		return err
+	}
+	if out == nil || len(respBody) == 0 {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+// Do signs req, whose body must be payload, sends it as operation with the
+// input params and returns the response body. Non-2xx responses are turned
+// into an *Error.
+func (c *Client) Do(ctx context.Context, operation string, params interface{}, req *http.Request, payload []byte) ([]byte, error) {
+	sum := sha256.Sum256(payload)
+	resp, err := c.Send(ctx, operation, params, req, hex.EncodeToString(sum[:]))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// Send signs req with the given payload hash and sends it, leaving the
+// response body for the caller to consume and close. Non-2xx responses are
+// turned into an *Error.
+//
+// The request goes through a middleware stack like an SDK client's: the
+// APIOptions of the config, such as the --debug-aws log, the traces and the
+// audit request ids, see it as operation of the service with the input
+// params, and the retryer of the config retries throttling, 5xx and
+// connection errors with backoff. A request whose body cannot be read
+// again is sent once.
+func (c *Client) Send(ctx context.Context, operation string, params interface{}, req *http.Request, payloadHash string) (*http.Response, error) {
+	stack := middleware.NewStack(operation, func() interface{} { return &attempt{req} })
+	err := stack.Initialize.Add(&awsmiddleware.RegisterServiceMetadata{
+		ServiceID:     c.ServiceID,
+		SigningName:   c.SigningName,
+		Region:        c.signingRegion(),
+		OperationName: operation,
+	}, middleware.Before)
+	if err != nil {
+		return nil, err
+	}
+	retryer := c.retryer
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		retryer = aws.NopRetryer{}
+	}
+	if err := stack.Finalize.Add(retry.NewAttemptMiddleware(retryer, cloneAttempt), middleware.After); err != nil {
+		return nil, err
+	}
+	for _, fn := range c.cfg.APIOptions {
+		if err := fn(stack); err != nil {
+			return nil, err
+		}
+	}
+
+	var resp *http.Response
+	send := middleware.HandlerFunc(func(ctx context.Context, in interface{}) (interface{}, middleware.Metadata, error) {
+		var metadata middleware.Metadata
+		r, err := c.sign(ctx, in.(*attempt).Request, payloadHash)
+		requestID := ""
+		var apiErr *Error
+		if errors.As(err, &apiErr) {
+			requestID = apiErr.RequestID
+		} else if r != nil {
+			requestID = firstHeader(r.Header, "X-Amzn-RequestId", "X-Amz-Request-Id")
+		}
+		if requestID != "" {
+			awsmiddleware.SetRequestIDMetadata(&metadata, requestID)
+		}
+		resp = r
+		return r, metadata, err
+	})
+	if _, _, err := middleware.DecorateHandler(send, stack).Handle(ctx, params); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// sign signs one attempt of a request and sends it.
+func (c *Client) sign(ctx context.Context, req *http.Request, payloadHash string) (*http.Response, error) {
+	creds, err := c.cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, payloadHash, c.SigningName, c.signingRegion(), time.Now()); err != nil {
+		return nil, err
+	}
+
+	httpClient := c.cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return nil, decodeError(resp, body)
+	}
+	return resp, nil
+}
+
+func (c *Client) signingRegion() string {
+	if c.SigningRegion != "" {
+		return c.SigningRegion
+	}
+	return c.cfg.Region
+}
+
+// attempt is the request of one attempt of Send. Each attempt is a clone of
+// the unsigned request, signed afresh.
+type attempt struct {
+	*http.Request
+}
+
+func cloneAttempt(v interface{}) interface{} {
+	req := v.(*attempt).Request
+	return &attempt{req.Clone(req.Context())}
+}
+
+// RewindStream gives a retried attempt a fresh copy of the body.
+func (a *attempt) RewindStream() error {
+	if a.GetBody == nil {
+		return nil
+	}
+	body, err := a.GetBody()
+	if err != nil {
+		return err
+	}
+	a.Body = body
+	return nil
+}
+
+func firstHeader(header http.Header, names ...string) string {
+	for _, name := range names {
+		if v := header.Get(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func decodeError(resp *http.Response, body []byte) error {
+	apiErr := &Error{
+		StatusCode: resp.StatusCode,
+		Code:       resp.Header.Get("X-Amzn-ErrorType"),
+		RequestID:  resp.Header.Get("X-Amzn-RequestId"),
+	}
+
+	var payload struct {
+		Type         string `json:"__type"`
+		Code         string `json:"code"`
+		Message      string `json:"message"`
+		MessageUpper string `json:"Message"`
+	}
+	// Query and REST-XML services report errors as XML instead.
+	var xmlPayload struct {
+		Code      string `xml:"Code"`
+		Message   string `xml:"Message"`
+		RequestID string `xml:"RequestId"`
+		Error     struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		} `xml:"Error"`
+	}
+	if json.Unmarshal(body, &payload) == nil {
+		if payload.Type != "" {
+			apiErr.Code = payload.Type
+		} else if payload.Code != "" {
+			apiErr.Code = payload.Code
+		}
+		apiErr.Message = payload.Message
+		if apiErr.Message == "" {
+			apiErr.Message = payload.MessageUpper
+		}
+	} else if xml.Unmarshal(body, &xmlPayload) == nil {
+		apiErr.Code, apiErr.Message = xmlPayload.Code, xmlPayload.Message
+		if xmlPayload.Error.Code != "" {
+			apiErr.Code, apiErr.Message = xmlPayload.Error.Code, xmlPayload.Error.Message
+		}
+		if apiErr.RequestID == "" {
+			apiErr.RequestID = xmlPayload.RequestID
+		}
+	}
+	if apiErr.RequestID == "" {
+		apiErr.RequestID = resp.Header.Get("X-Amz-Request-Id")
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+
+	// Error types may be qualified, e.g. "com.amazon.coral#ThrottlingException:http://...".
+	if i := strings.LastIndex(apiErr.Code, "#"); i >= 0 {
+		apiErr.Code = apiErr.Code[i+1:]
+	}
+	if i := strings.Index(apiErr.Code, ":"); i >= 0 {
+		apiErr.Code = apiErr.Code[:i]
+	}
+	return apiErr
+}
+
+// Region returns the region requests are sent to.
+func (c *Client) Region() string {
+	return c.cfg.Region
+}
@@ -0,0 +1,343 @@
+package awsapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// testConfig sends every service to server with static credentials and
+// retries without backoff.
+func testConfig(server *httptest.Server) aws.Config {
+	return aws.Config{
+		Region:      "eu-west-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKIDEXAMPLE", "secret", "session"),
+		EndpointResolverWithOptions: aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+			return aws.Endpoint{URL: server.URL}, nil
+		}),
+		Retryer: func() aws.Retryer {
+			return retry.NewStandard(func(o *retry.StandardOptions) {
+				o.Backoff = retry.BackoffDelayerFunc(func(int, error) (time.Duration, error) { return 0, nil })
+			})
+		},
+	}
+}
+
+// received is a request as the server saw it.
+type received struct {
+	method, path string
+	header       http.Header
+	body         []byte
+}
+
+// recordingServer answers each request with the next of responses, the last
+// one repeating, and records the requests.
+func recordingServer(t *testing.T, responses ...func(w http.ResponseWriter)) (*httptest.Server, func() []received) {
+	t.Helper()
+	var mu sync.Mutex
+	var requests []received
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, received{method: r.Method, path: r.URL.RequestURI(), header: r.Header.Clone(), body: body})
+		respond := responses[len(responses)-1]
+		if len(requests) <= len(responses) {
+			respond = responses[len(requests)-1]
+		}
+		mu.Unlock()
+		respond(w)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []received {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]received(nil), requests...)
+	}
+}
+
+func ok(body string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.Header().Set("X-Amzn-RequestId", "req-ok")
+		fmt.Fprint(w, body)
+	}
+}
+
+func fail(status int, code string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.Header().Set("X-Amzn-RequestId", "req-"+code)
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"__type": "%s", "message": "%s failed"}`, code, code)
+	}
+}
+
+func TestSigning(t *testing.T) {
+	server, requests := recordingServer(t, ok(`{}`))
+	cfg := testConfig(server)
+
+	in := map[string]string{"Name": "/app/config"}
+	if err := NewSSM(cfg).Call(context.Background(), "GetParameter", in, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewIAM(cfg).Query(context.Background(), "GetRole", "2010-05-08", url.Values{"RoleName": {"ops"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	got := requests()
+	if len(got) != 2 {
+		t.Fatalf("got %d requests, want 2", len(got))
+	}
+	for i, want := range []struct{ service, region, contentType string }{
+		{"ssm", "eu-west-1", "application/x-amz-json-1.1"},
+		// IAM is global and signed for us-east-1 whatever the region.
+		{"iam", "us-east-1", "application/x-www-form-urlencoded; charset=utf-8"},
+	} {
+		r := got[i]
+		auth := r.header.Get("Authorization")
+		date := r.header.Get("X-Amz-Date")
+		scope := fmt.Sprintf("Credential=AKIDEXAMPLE/%s/%s/%s/aws4_request", date[:8], want.region, want.service)
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 "+scope) {
+			t.Errorf("%s request has Authorization %q, want the scope %s", want.service, auth, scope)
+		}
+		sum := sha256.Sum256(r.body)
+		if r.header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s request has payload hash %s", want.service, r.header.Get("X-Amz-Content-Sha256"))
+		}
+		if r.header.Get("X-Amz-Security-Token") != "session" || r.header.Get("Content-Type") != want.contentType {
+			t.Errorf("%s request has headers %v", want.service, r.header)
+		}
+
+		// Signing the same request again must give the same signature.
+		signingTime, err := time.Parse("20060102T150405Z", date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, _ := http.NewRequest(r.method, server.URL+r.path, bytes.NewReader(r.body))
+		for k, v := range r.header {
+			if k != "Authorization" && k != "Accept-Encoding" && k != "User-Agent" && k != "Content-Length" {
+				again.Header[k] = v
+			}
+		}
+		creds := aws.Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret", SessionToken: "session"}
+		if err := v4.NewSigner().SignHTTP(context.Background(), creds, again, hex.EncodeToString(sum[:]), want.service, want.region, signingTime); err != nil {
+			t.Fatal(err)
+		}
+		if again.Header.Get("Authorization") != auth {
+			t.Errorf("%s request signature\n%s\nwant\n%s", want.service, auth, again.Header.Get("Authorization"))
+		}
+	}
+	if got[0].header.Get("X-Amz-Target") != "AmazonSSM.GetParameter" || string(got[0].body) != `{"Name":"/app/config"}` {
+		t.Errorf("JSON request has target %q and body %s", got[0].header.Get("X-Amz-Target"), got[0].body)
+	}
+	if form, _ := url.ParseQuery(string(got[1].body)); form.Get("Action") != "GetRole" || form.Get("Version") != "2010-05-08" || form.Get("RoleName") != "ops" {
+		t.Errorf("query request has body %s", got[1].body)
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		status    int
+		header    map[string]string
+		body      string
+		code      string
+		message   string
+		requestID string
+	}{
+		{
+			name:   "json with a qualified type",
+			status: 400,
+			header: map[string]string{"X-Amzn-RequestId": "req-1"},
+			body:   `{"__type": "com.amazon.coral.service#ThrottlingException:http://internal.amazon.com/coral/", "message": "Rate exceeded"}`,
+			code:   "ThrottlingException", message: "Rate exceeded", requestID: "req-1",
+		},
+		{
+			name:   "json with code and Message",
+			status: 404,
+			body:   `{"code": "ResourceNotFoundException", "Message": "Secret not found"}`,
+			code:   "ResourceNotFoundException", message: "Secret not found",
+		},
+		{
+			name:   "rest-json with the type in a header",
+			status: 404,
+			header: map[string]string{"X-Amzn-ErrorType": "FileSystemNotFound:http://internal.amazon.com/", "X-Amzn-RequestId": "req-2"},
+			body:   `{"message": "File system 'fs-1' does not exist."}`,
+			code:   "FileSystemNotFound", message: "File system 'fs-1' does not exist.", requestID: "req-2",
+		},
+		{
+			name:   "query",
+			status: 404,
+			body:   `<ErrorResponse><Error><Type>Sender</Type><Code>NoSuchEntity</Code><Message>The role ops cannot be found.</Message></Error><RequestId>req-3</RequestId></ErrorResponse>`,
+			code:   "NoSuchEntity", message: "The role ops cannot be found.", requestID: "req-3",
+		},
+		{
+			name:   "s3",
+			status: 404,
+			header: map[string]string{"X-Amz-Request-Id": "req-4"},
+			body:   `<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`,
+			code:   "NoSuchKey", message: "The specified key does not exist.", requestID: "req-4",
+		},
+		{
+			name:   "no body",
+			status: 503,
+			body:   "Service Unavailable",
+			code:   "", message: "Service Unavailable",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tc.status, Header: http.Header{}}
+			for k, v := range tc.header {
+				resp.Header.Set(k, v)
+			}
+			err := decodeError(resp, []byte(tc.body))
+
+			var apiErr *Error
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("got %T", err)
+			}
+			if apiErr.Code != tc.code || apiErr.Message != tc.message || apiErr.RequestID != tc.requestID || apiErr.StatusCode != tc.status {
+				t.Errorf("got %+v", apiErr)
+			}
+			var smithyErr smithy.APIError
+			if !errors.As(err, &smithyErr) || smithyErr.ErrorCode() != tc.code {
+				t.Errorf("the error is not a smithy.APIError with code %s", tc.code)
+			}
+			if fault := smithyErr.ErrorFault(); (tc.status >= 500) != (fault == smithy.FaultServer) {
+				t.Errorf("status %d has fault %v", tc.status, fault)
+			}
+		})
+	}
+}
+
+func TestRetries(t *testing.T) {
+	t.Run("throttling and 5xx", func(t *testing.T) {
+		server, requests := recordingServer(t, fail(400, "ThrottlingException"), fail(503, "ServiceUnavailable"), ok(`{"Parameter": {"Value": "v"}}`))
+		var out struct{ Parameter struct{ Value string } }
+		if err := NewSSM(testConfig(server)).Call(context.Background(), "GetParameter", map[string]string{"Name": "p"}, &out); err != nil {
+			t.Fatal(err)
+		}
+		got := requests()
+		if len(got) != 3 || out.Parameter.Value != "v" {
+			t.Fatalf("made %d attempts and got %+v, want 3 and the value", len(got), out)
+		}
+		for _, r := range got {
+			if string(r.body) != `{"Name":"p"}` {
+				t.Errorf("attempt sent body %q", r.body)
+			}
+		}
+	})
+
+	t.Run("client errors", func(t *testing.T) {
+		server, requests := recordingServer(t, fail(400, "ValidationException"))
+		err := NewSSM(testConfig(server)).Call(context.Background(), "GetParameter", map[string]string{}, nil)
+		var apiErr *Error
+		if !errors.As(err, &apiErr) || apiErr.Code != "ValidationException" {
+			t.Errorf("err = %v", err)
+		}
+		if n := len(requests()); n != 1 {
+			t.Errorf("made %d attempts, want 1", n)
+		}
+	})
+
+	t.Run("out of attempts", func(t *testing.T) {
+		server, requests := recordingServer(t, fail(500, "InternalFailure"))
+		err := NewSSM(testConfig(server)).Call(context.Background(), "GetParameter", map[string]string{}, nil)
+		var apiErr *Error
+		if !errors.As(err, &apiErr) || apiErr.Code != "InternalFailure" {
+			t.Errorf("err = %v, want the last error", err)
+		}
+		if n := len(requests()); n != retry.DefaultMaxAttempts {
+			t.Errorf("made %d attempts, want %d", n, retry.DefaultMaxAttempts)
+		}
+	})
+
+	t.Run("streamed bodies", func(t *testing.T) {
+		server, requests := recordingServer(t, fail(503, "SlowDown"), ok(""))
+		s3 := NewS3(testConfig(server))
+		s3.UsePathStyle = true
+		// A reader without GetBody cannot be sent again.
+		body := io.MultiReader(strings.NewReader("data"))
+		if err := s3.PutObject(context.Background(), "bucket", "key", body, 4); err == nil {
+			t.Error("want the error of the only attempt")
+		}
+		if n := len(requests()); n != 1 {
+			t.Errorf("made %d attempts, want 1", n)
+		}
+	})
+}
+
+func TestMiddlewares(t *testing.T) {
+	server, _ := recordingServer(t, fail(503, "ServiceUnavailable"), ok(`{}`))
+	cfg := testConfig(server)
+
+	type call struct {
+		service, operation, region, requestID string
+		params                                interface{}
+		attempts                              int
+		err                                   error
+	}
+	var calls []call
+	cfg.APIOptions = []func(*middleware.Stack) error{func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("Record", func(
+			c context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+		) (middleware.InitializeOutput, middleware.Metadata, error) {
+			out, metadata, err := next.HandleInitialize(c, in)
+			id, _ := awsmiddleware.GetRequestIDMetadata(metadata)
+			attempts, _ := retry.GetAttemptResults(metadata)
+			calls = append(calls, call{
+				service:   awsmiddleware.GetServiceID(c),
+				operation: awsmiddleware.GetOperationName(c),
+				region:    awsmiddleware.GetRegion(c),
+				requestID: id,
+				params:    in.Parameters,
+				attempts:  len(attempts.Results),
+				err:       err,
+			})
+			return out, metadata, err
+		}), middleware.After)
+	}}
+
+	in := map[string]string{"Name": "p"}
+	if err := NewSSM(cfg).Call(context.Background(), "GetParameter", in, nil); err != nil {
+		t.Fatal(err)
+	}
+	s3 := NewS3(cfg)
+	s3.UsePathStyle = true
+	if err := s3.DeleteObject(context.Background(), "bucket", "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(calls) != 2 {
+		t.Fatalf("the middleware saw %d calls, want 2", len(calls))
+	}
+	if c := calls[0]; c.service != "SSM" || c.operation != "GetParameter" || c.region != "eu-west-1" || c.requestID != "req-ok" || c.attempts != 2 || c.err != nil {
+		t.Errorf("first call %+v", c)
+	}
+	if params, ok := calls[0].params.(map[string]string); !ok || params["Name"] != "p" {
+		t.Errorf("first call had params %v", calls[0].params)
+	}
+	if c := calls[1]; c.service != "S3" || c.operation != "DeleteObject" || c.attempts != 1 {
+		t.Errorf("second call %+v", c)
+	}
+	if params, ok := calls[1].params.(map[string]string); !ok || params["Bucket"] != "bucket" || params["Key"] != "key" {
+		t.Errorf("second call had params %v", calls[1].params)
+	}
+}
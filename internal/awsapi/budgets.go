@@ -0,0 +1,60 @@
+package awsapi
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Budgets is a client for AWS Budgets.
+type Budgets struct {
+	*Client
+}
+
+// NewBudgets returns an AWS Budgets client for cfg. Budgets is a global
+// service served from us-east-1.
+func NewBudgets(cfg aws.Config) *Budgets {
+	c := New(cfg, "budgets", "budgets", "AWSBudgetServiceGateway", "1.1")
+	c.GlobalEndpoint = "https://budgets.amazonaws.com"
+	c.SigningRegion = "us-east-1"
+	return &Budgets{c}
+}
+
+// Spend is an amount of money, as a decimal string, in Unit, e.g. USD.
+type Spend struct {
+	Amount string `json:"Amount"`
+	Unit   string `json:"Unit"`
+}
+
+type CalculatedSpend struct {
+	ActualSpend Spend `json:"ActualSpend"`
+	// ForecastedSpend is nil until the account has enough history.
+	ForecastedSpend *Spend `json:"ForecastedSpend"`
+}
+
+type Budget struct {
+	BudgetName      string          `json:"BudgetName"`
+	BudgetType      string          `json:"BudgetType"`
+	TimeUnit        string          `json:"TimeUnit"`
+	BudgetLimit     *Spend          `json:"BudgetLimit"`
+	CalculatedSpend CalculatedSpend `json:"CalculatedSpend"`
+}
+
+type DescribeBudgetInput struct {
+	AccountId  string `json:"AccountId"`
+	BudgetName string `json:"BudgetName"`
+}
+
+type DescribeBudgetOutput struct {
+	Budget Budget `json:"Budget"`
+}
+
+// DescribeBudget returns a budget with its limit and the spend of its
+// current period.
+func (c *Budgets) DescribeBudget(ctx context.Context, params *DescribeBudgetInput) (*DescribeBudgetOutput, error) {
+	out := &DescribeBudgetOutput{}
+	if err := c.Call(ctx, "DescribeBudget", params, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,52 @@
+package awsapi
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// CloudTrail is a client for the AWS CloudTrail event history.
+type CloudTrail struct {
+	*Client
+}
+
+// NewCloudTrail returns an AWS CloudTrail client for cfg.
+func NewCloudTrail(cfg aws.Config) *CloudTrail {
+	return &CloudTrail{New(cfg, "cloudtrail", "cloudtrail", "com.amazonaws.cloudtrail.v20131101.CloudTrail_20131101", "1.1")}
+}
+
+type LookupAttribute struct {
+	AttributeKey   string `json:"AttributeKey"`
+	AttributeValue string `json:"AttributeValue"`
+}
+
+type LookupEventsInput struct {
+	LookupAttributes []LookupAttribute `json:"LookupAttributes,omitempty"`
+	NextToken        string            `json:"NextToken,omitempty"`
+}
+
+type TrailEvent struct {
+	EventId   string `json:"EventId"`
+	EventName string `json:"EventName"`
+	// EventTime is in seconds since the epoch.
+	EventTime float64 `json:"EventTime"`
+	Username  string  `json:"Username"`
+	// CloudTrailEvent is the full event record as a JSON document.
+	CloudTrailEvent string `json:"CloudTrailEvent"`
+}
+
+type LookupEventsOutput struct {
+	Events    []TrailEvent `json:"Events"`
+	NextToken string       `json:"NextToken"`
+}
+
+// LookupEvents returns a page of the management events of the last 90 days
+// that match the lookup attributes, newest first.
+func (c *CloudTrail) LookupEvents(ctx context.Context, params *LookupEventsInput) (*LookupEventsOutput, error) {
+	out := &LookupEventsOutput{}
+	if err := c.Call(ctx, "LookupEvents", params, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,91 @@
+package awsapi
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+const cloudWatchVersion = "2010-08-01"
+
+// CloudWatch is a client for Amazon CloudWatch metrics.
+type CloudWatch struct {
+	*Client
+}
+
+// NewCloudWatch returns an Amazon CloudWatch client for cfg.
+func NewCloudWatch(cfg aws.Config) *CloudWatch {
+	return &CloudWatch{New(cfg, "monitoring", "monitoring", "", "")}
+}
+
+type Dimension struct {
+	Name  string
+	Value string
+}
+
+// MetricDataQuery is a statistic of one metric. Id must start with a lower
+// case letter and is how its result is matched.
+type MetricDataQuery struct {
+	Id         string
+	Namespace  string
+	MetricName string
+	Dimensions []Dimension
+	Period     time.Duration
+	Stat       string
+}
+
+type GetMetricDataInput struct {
+	Queries   []MetricDataQuery
+	StartTime time.Time
+	EndTime   time.Time
+	NextToken string
+}
+
+// MetricDataResult holds the datapoints of a query, newest first.
+type MetricDataResult struct {
+	Id         string      `xml:"Id"`
+	Label      string      `xml:"Label"`
+	StatusCode string      `xml:"StatusCode"`
+	Timestamps []time.Time `xml:"Timestamps>member"`
+	Values     []float64   `xml:"Values>member"`
+}
+
+type GetMetricDataOutput struct {
+	MetricDataResults []MetricDataResult `xml:"GetMetricDataResult>MetricDataResults>member"`
+	NextToken         string             `xml:"GetMetricDataResult>NextToken"`
+}
+
+// GetMetricData returns the datapoints of up to 500 queries between the
+// start and end times.
+func (c *CloudWatch) GetMetricData(ctx context.Context, params *GetMetricDataInput) (*GetMetricDataOutput, error) {
+	values := url.Values{
+		"StartTime": {params.StartTime.UTC().Format(time.RFC3339)},
+		"EndTime":   {params.EndTime.UTC().Format(time.RFC3339)},
+		"ScanBy":    {"TimestampDescending"},
+	}
+	if params.NextToken != "" {
+		values.Set("NextToken", params.NextToken)
+	}
+	for i, q := range params.Queries {
+		prefix := "MetricDataQueries.member." + strconv.Itoa(i+1)
+		values.Set(prefix+".Id", q.Id)
+		values.Set(prefix+".MetricStat.Metric.Namespace", q.Namespace)
+		values.Set(prefix+".MetricStat.Metric.MetricName", q.MetricName)
+		for j, d := range q.Dimensions {
+			dimension := prefix + ".MetricStat.Metric.Dimensions.member." + strconv.Itoa(j+1)
+			values.Set(dimension+".Name", d.Name)
+			values.Set(dimension+".Value", d.Value)
+		}
+		values.Set(prefix+".MetricStat.Period", strconv.Itoa(int(q.Period/time.Second)))
+		values.Set(prefix+".MetricStat.Stat", q.Stat)
+	}
+
+	out := &GetMetricDataOutput{}
+	if err := c.Query(ctx, "GetMetricData", cloudWatchVersion, values, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
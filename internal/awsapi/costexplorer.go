@@ -0,0 +1,73 @@
+package awsapi
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// CostExplorer is a client for AWS Cost Explorer.
+type CostExplorer struct {
+	*Client
+}
+
+// NewCostExplorer returns an AWS Cost Explorer client for cfg. Cost Explorer
+// is a global service served from us-east-1.
+func NewCostExplorer(cfg aws.Config) *CostExplorer {
+	c := New(cfg, "ce", "ce", "AWSInsightsIndexService", "1.1")
+	c.GlobalEndpoint = "https://ce.us-east-1.amazonaws.com"
+	c.SigningRegion = "us-east-1"
+	return &CostExplorer{c}
+}
+
+// DateInterval is from Start, inclusive, to End, exclusive, as YYYY-MM-DD.
+type DateInterval struct {
+	Start string `json:"Start"`
+	End   string `json:"End"`
+}
+
+type TagValues struct {
+	Key          string   `json:"Key,omitempty"`
+	Values       []string `json:"Values,omitempty"`
+	MatchOptions []string `json:"MatchOptions,omitempty"`
+}
+
+// Expression filters costs. Only one of its fields is set.
+type Expression struct {
+	Tags *TagValues  `json:"Tags,omitempty"`
+	Not  *Expression `json:"Not,omitempty"`
+}
+
+type MetricValue struct {
+	Amount string `json:"Amount"`
+	Unit   string `json:"Unit"`
+}
+
+type ResultByTime struct {
+	TimePeriod DateInterval           `json:"TimePeriod"`
+	Total      map[string]MetricValue `json:"Total"`
+	Estimated  bool                   `json:"Estimated"`
+}
+
+type GetCostAndUsageInput struct {
+	TimePeriod    DateInterval `json:"TimePeriod"`
+	Granularity   string       `json:"Granularity"`
+	Metrics       []string     `json:"Metrics"`
+	Filter        *Expression  `json:"Filter,omitempty"`
+	NextPageToken string       `json:"NextPageToken,omitempty"`
+}
+
+type GetCostAndUsageOutput struct {
+	ResultsByTime []ResultByTime `json:"ResultsByTime"`
+	NextPageToken string         `json:"NextPageToken"`
+}
+
+// GetCostAndUsage returns a page of the costs of the time period that
+// match the filter.
+func (c *CostExplorer) GetCostAndUsage(ctx context.Context, params *GetCostAndUsageInput) (*GetCostAndUsageOutput, error) {
+	out := &GetCostAndUsageOutput{}
+	if err := c.Call(ctx, "GetCostAndUsage", params, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
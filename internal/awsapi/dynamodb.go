@@ -0,0 +1,71 @@
+package awsapi
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// DynamoDB is a client for Amazon DynamoDB.
+type DynamoDB struct {
+	*Client
+}
+
+// NewDynamoDB returns an Amazon DynamoDB client for cfg.
+func NewDynamoDB(cfg aws.Config) *DynamoDB {
+	return &DynamoDB{New(cfg, "dynamodb", "dynamodb", "DynamoDB_20120810", "1.0")}
+}
+
+// AttributeValue is a string or number attribute; numbers are sent as
+// strings, as DynamoDB expects.
+type AttributeValue struct {
+	S string `json:"S,omitempty"`
+	N string `json:"N,omitempty"`
+}
+
+type GetItemInput struct {
+	TableName      string                    `json:"TableName"`
+	Key            map[string]AttributeValue `json:"Key"`
+	ConsistentRead bool                      `json:"ConsistentRead,omitempty"`
+}
+
+type GetItemOutput struct {
+	Item map[string]AttributeValue `json:"Item"`
+}
+
+type PutItemInput struct {
+	TableName                 string                    `json:"TableName"`
+	Item                      map[string]AttributeValue `json:"Item"`
+	ConditionExpression       string                    `json:"ConditionExpression,omitempty"`
+	ExpressionAttributeNames  map[string]string         `json:"ExpressionAttributeNames,omitempty"`
+	ExpressionAttributeValues map[string]AttributeValue `json:"ExpressionAttributeValues,omitempty"`
+}
+
+type DeleteItemInput struct {
+	TableName                 string                    `json:"TableName"`
+	Key                       map[string]AttributeValue `json:"Key"`
+	ConditionExpression       string                    `json:"ConditionExpression,omitempty"`
+	ExpressionAttributeNames  map[string]string         `json:"ExpressionAttributeNames,omitempty"`
+	ExpressionAttributeValues map[string]AttributeValue `json:"ExpressionAttributeValues,omitempty"`
+}
+
+// GetItem returns the item with the key, or an empty Item when there is none.
+func (c *DynamoDB) GetItem(ctx context.Context, params *GetItemInput) (*GetItemOutput, error) {
+	out := &GetItemOutput{}
+	if err := c.Call(ctx, "GetItem", params, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PutItem writes the item. It fails with ConditionalCheckFailedException when
+// the condition expression does not hold.
+func (c *DynamoDB) PutItem(ctx context.Context, params *PutItemInput) error {
+	return c.Call(ctx, "PutItem", params, nil)
+}
+
+// DeleteItem deletes the item with the key. It fails with
+// ConditionalCheckFailedException when the condition expression does not hold.
+func (c *DynamoDB) DeleteItem(ctx context.Context, params *DeleteItemInput) error {
+	return c.Call(ctx, "DeleteItem", params, nil)
+}
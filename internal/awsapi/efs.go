@@ -0,0 +1,44 @@
+package awsapi
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// EFS is a client for Amazon Elastic File System.
+type EFS struct {
+	*Client
+}
+
+// NewEFS returns an Amazon EFS client for cfg.
+func NewEFS(cfg aws.Config) *EFS {
+	return &EFS{New(cfg, "elasticfilesystem", "elasticfilesystem", "", "")}
+}
+
+type MountTarget struct {
+	MountTargetId        string `json:"MountTargetId"`
+	FileSystemId         string `json:"FileSystemId"`
+	SubnetId             string `json:"SubnetId"`
+	LifeCycleState       string `json:"LifeCycleState"`
+	IpAddress            string `json:"IpAddress"`
+	AvailabilityZoneName string `json:"AvailabilityZoneName"`
+	VpcId                string `json:"VpcId"`
+}
+
+type DescribeMountTargetsOutput struct {
+	MountTargets []MountTarget `json:"MountTargets"`
+	NextMarker   string        `json:"NextMarker"`
+}
+
+// DescribeMountTargets lists the mount targets of a file system.
+func (c *EFS) DescribeMountTargets(ctx context.Context, fileSystemID string) (*DescribeMountTargetsOutput, error) {
+	out := &DescribeMountTargetsOutput{}
+	path := "/2015-02-01/mount-targets?FileSystemId=" + url.QueryEscape(fileSystemID)
+	if err := c.REST(ctx, "DescribeMountTargets", http.MethodGet, path, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,73 @@
+package awsapi
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+const elbv2Version = "2015-12-01"
+
+// ELBv2 is a client for Elastic Load Balancing target groups.
+type ELBv2 struct {
+	*Client
+}
+
+// NewELBv2 returns an Elastic Load Balancing v2 client for cfg.
+func NewELBv2(cfg aws.Config) *ELBv2 {
+	return &ELBv2{New(cfg, "elasticloadbalancing", "elasticloadbalancing", "", "")}
+}
+
+type TargetDescription struct {
+	Id   string `xml:"Id"`
+	Port int    `xml:"Port"`
+}
+
+type TargetHealth struct {
+	State       string `xml:"State"`
+	Reason      string `xml:"Reason"`
+	Description string `xml:"Description"`
+}
+
+type TargetHealthDescription struct {
+	Target       TargetDescription `xml:"Target"`
+	TargetHealth TargetHealth      `xml:"TargetHealth"`
+}
+
+type DescribeTargetHealthOutput struct {
+	TargetHealthDescriptions []TargetHealthDescription `xml:"DescribeTargetHealthResult>TargetHealthDescriptions>member"`
+}
+
+func targetParams(targetGroupArn string, targets []TargetDescription) url.Values {
+	params := url.Values{"TargetGroupArn": {targetGroupArn}}
+	for i, t := range targets {
+		prefix := "Targets.member." + strconv.Itoa(i+1)
+		params.Set(prefix+".Id", t.Id)
+		if t.Port != 0 {
+			params.Set(prefix+".Port", strconv.Itoa(t.Port))
+		}
+	}
+	return params
+}
+
+// RegisterTargets adds targets to a target group.
+func (c *ELBv2) RegisterTargets(ctx context.Context, targetGroupArn string, targets []TargetDescription) error {
+	return c.Query(ctx, "RegisterTargets", elbv2Version, targetParams(targetGroupArn, targets), nil)
+}
+
+// DeregisterTargets removes targets from a target group, starting connection draining.
+func (c *ELBv2) DeregisterTargets(ctx context.Context, targetGroupArn string, targets []TargetDescription) error {
+	return c.Query(ctx, "DeregisterTargets", elbv2Version, targetParams(targetGroupArn, targets), nil)
+}
+
+// DescribeTargetHealth returns the health of targets in a target group, or of
+// all of them when targets is empty.
+func (c *ELBv2) DescribeTargetHealth(ctx context.Context, targetGroupArn string, targets []TargetDescription) (*DescribeTargetHealthOutput, error) {
+	out := &DescribeTargetHealthOutput{}
+	if err := c.Query(ctx, "DescribeTargetHealth", elbv2Version, targetParams(targetGroupArn, targets), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,92 @@
+package awsapi
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// EventBridge is a client for Amazon EventBridge rules and targets.
+type EventBridge struct {
+	*Client
+}
+
+// NewEventBridge returns an Amazon EventBridge client for cfg.
+func NewEventBridge(cfg aws.Config) *EventBridge {
+	return &EventBridge{New(cfg, "events", "events", "AWSEvents", "1.1")}
+}
+
+type Tag struct {
+	Key   string `json:"Key"`
+	Value string `json:"Value"`
+}
+
+type PutRuleInput struct {
+	Name         string `json:"Name"`
+	EventPattern string `json:"EventPattern,omitempty"`
+	State        string `json:"State,omitempty"`
+	Description  string `json:"Description,omitempty"`
+	Tags         []Tag  `json:"Tags,omitempty"`
+}
+
+type PutRuleOutput struct {
+	RuleArn string `json:"RuleArn"`
+}
+
+// PutRule creates or updates a rule.
+func (c *EventBridge) PutRule(ctx context.Context, params *PutRuleInput) (*PutRuleOutput, error) {
+	out := &PutRuleOutput{}
+	if err := c.Call(ctx, "PutRule", params, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type Target struct {
+	Id  string `json:"Id"`
+	Arn string `json:"Arn"`
+}
+
+type PutTargetsInput struct {
+	Rule    string   `json:"Rule"`
+	Targets []Target `json:"Targets"`
+}
+
+type FailedEntry struct {
+	TargetId     string `json:"TargetId"`
+	ErrorCode    string `json:"ErrorCode"`
+	ErrorMessage string `json:"ErrorMessage"`
+}
+
+type PutTargetsOutput struct {
+	FailedEntryCount int           `json:"FailedEntryCount"`
+	FailedEntries    []FailedEntry `json:"FailedEntries"`
+}
+
+// PutTargets adds or updates the targets of a rule.
+func (c *EventBridge) PutTargets(ctx context.Context, params *PutTargetsInput) (*PutTargetsOutput, error) {
+	out := &PutTargetsOutput{}
+	if err := c.Call(ctx, "PutTargets", params, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type RemoveTargetsInput struct {
+	Rule string   `json:"Rule"`
+	Ids  []string `json:"Ids"`
+}
+
+// RemoveTargets removes targets from a rule.
+func (c *EventBridge) RemoveTargets(ctx context.Context, params *RemoveTargetsInput) error {
+	return c.Call(ctx, "RemoveTargets", params, nil)
+}
+
+type DeleteRuleInput struct {
+	Name string `json:"Name"`
+}
+
+// DeleteRule deletes a rule, which must have no targets.
+func (c *EventBridge) DeleteRule(ctx context.Context, params *DeleteRuleInput) error {
+	return c.Call(ctx, "DeleteRule", params, nil)
+}
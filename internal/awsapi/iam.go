@@ -0,0 +1,148 @@
+package awsapi
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+const iamVersion = "2010-05-08"
+
+// IAM is a client for the roles and instance profiles of AWS Identity and
+// Access Management.
+type IAM struct {
+	*Client
+}
+
+// NewIAM returns an IAM client for cfg. IAM has a single endpoint per
+// partition, signed for its first region.
+func NewIAM(cfg aws.Config) *IAM {
+	c := New(cfg, "iam", "iam", "", "")
+	switch {
+	case strings.HasPrefix(cfg.Region, "cn-"):
+		c.GlobalEndpoint, c.SigningRegion = "https://iam.cn-north-1.amazonaws.com.cn", "cn-north-1"
+	case strings.HasPrefix(cfg.Region, "us-gov-"):
+		c.GlobalEndpoint, c.SigningRegion = "https://iam.us-gov.amazonaws.com", "us-gov-west-1"
+	default:
+		c.GlobalEndpoint, c.SigningRegion = "https://iam.amazonaws.com", "us-east-1"
+	}
+	return &IAM{c}
+}
+
+type IAMTag struct {
+	Key   string
+	Value string
+}
+
+type CreateRoleInput struct {
+	RoleName                 string
+	AssumeRolePolicyDocument string
+	Description              string
+	Tags                     []IAMTag
+}
+
+type Role struct {
+	RoleName string `xml:"RoleName"`
+	Arn      string `xml:"Arn"`
+}
+
+type CreateRoleOutput struct {
+	Role Role `xml:"CreateRoleResult>Role"`
+}
+
+type CreateInstanceProfileInput struct {
+	InstanceProfileName string
+	Tags                []IAMTag
+}
+
+type InstanceProfile struct {
+	InstanceProfileName string `xml:"InstanceProfileName"`
+	Arn                 string `xml:"Arn"`
+	Roles               []Role `xml:"Roles>member"`
+}
+
+type CreateInstanceProfileOutput struct {
+	InstanceProfile InstanceProfile `xml:"CreateInstanceProfileResult>InstanceProfile"`
+}
+
+type GetInstanceProfileOutput struct {
+	InstanceProfile InstanceProfile `xml:"GetInstanceProfileResult>InstanceProfile"`
+}
+
+type GetRoleOutput struct {
+	Role Role `xml:"GetRoleResult>Role"`
+}
+
+func addIAMTags(params url.Values, tags []IAMTag) {
+	for n, t := range tags {
+		prefix := "Tags.member." + strconv.Itoa(n+1) + "."
+		params.Set(prefix+"Key", t.Key)
+		params.Set(prefix+"Value", t.Value)
+	}
+}
+
+// CreateRole creates a role that may be assumed as the trust policy allows.
+// It fails with EntityAlreadyExists when the role exists.
+func (c *IAM) CreateRole(ctx context.Context, params *CreateRoleInput) (*CreateRoleOutput, error) {
+	form := url.Values{}
+	form.Set("RoleName", params.RoleName)
+	form.Set("AssumeRolePolicyDocument", params.AssumeRolePolicyDocument)
+	if params.Description != "" {
+		form.Set("Description", params.Description)
+	}
+	addIAMTags(form, params.Tags)
+
+	out := &CreateRoleOutput{}
+	if err := c.Query(ctx, "CreateRole", iamVersion, form, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetRole returns the role, or a NoSuchEntity error.
+func (c *IAM) GetRole(ctx context.Context, roleName string) (*GetRoleOutput, error) {
+	out := &GetRoleOutput{}
+	if err := c.Query(ctx, "GetRole", iamVersion, url.Values{"RoleName": {roleName}}, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AttachRolePolicy attaches a managed policy to the role. Attaching a policy
+// that is already attached does nothing.
+func (c *IAM) AttachRolePolicy(ctx context.Context, roleName, policyArn string) error {
+	return c.Query(ctx, "AttachRolePolicy", iamVersion, url.Values{"RoleName": {roleName}, "PolicyArn": {policyArn}}, nil)
+}
+
+// CreateInstanceProfile creates an empty instance profile. It fails with
+// EntityAlreadyExists when the profile exists.
+func (c *IAM) CreateInstanceProfile(ctx context.Context, params *CreateInstanceProfileInput) (*CreateInstanceProfileOutput, error) {
+	form := url.Values{}
+	form.Set("InstanceProfileName", params.InstanceProfileName)
+	addIAMTags(form, params.Tags)
+
+	out := &CreateInstanceProfileOutput{}
+	if err := c.Query(ctx, "CreateInstanceProfile", iamVersion, form, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetInstanceProfile returns the instance profile and its role, or a
+// NoSuchEntity error.
+func (c *IAM) GetInstanceProfile(ctx context.Context, profileName string) (*GetInstanceProfileOutput, error) {
+	out := &GetInstanceProfileOutput{}
+	if err := c.Query(ctx, "GetInstanceProfile", iamVersion, url.Values{"InstanceProfileName": {profileName}}, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AddRoleToInstanceProfile puts the role in the instance profile, which can
+// hold a single role.
+func (c *IAM) AddRoleToInstanceProfile(ctx context.Context, profileName, roleName string) error {
+	return c.Query(ctx, "AddRoleToInstanceProfile", iamVersion, url.Values{"InstanceProfileName": {profileName}, "RoleName": {roleName}}, nil)
+}
@@ -0,0 +1,39 @@
+package awsapi
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// InstanceConnect is a client for the EC2 Instance Connect service.
+type InstanceConnect struct {
+	*Client
+}
+
+// NewInstanceConnect returns an EC2 Instance Connect client for cfg.
+func NewInstanceConnect(cfg aws.Config) *InstanceConnect {
+	return &InstanceConnect{New(cfg, "ec2-instance-connect", "ec2-instance-connect", "AWSEC2InstanceConnectService", "1.1")}
+}
+
+type SendSSHPublicKeyInput struct {
+	InstanceId       string `json:"InstanceId"`
+	InstanceOSUser   string `json:"InstanceOSUser"`
+	SSHPublicKey     string `json:"SSHPublicKey"`
+	AvailabilityZone string `json:"AvailabilityZone,omitempty"`
+}
+
+type SendSSHPublicKeyOutput struct {
+	RequestId string `json:"RequestId"`
+	Success   bool   `json:"Success"`
+}
+
+// SendSSHPublicKey pushes a public key to the instance metadata, where it is
+// accepted by sshd for the next 60 seconds.
+func (c *InstanceConnect) SendSSHPublicKey(ctx context.Context, params *SendSSHPublicKeyInput) (*SendSSHPublicKeyOutput, error) {
+	out := &SendSSHPublicKeyOutput{}
+	if err := c.Call(ctx, "SendSSHPublicKey", params, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,47 @@
+package awsapi
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Organizations is a client for AWS Organizations.
+type Organizations struct {
+	*Client
+}
+
+// NewOrganizations returns an AWS Organizations client for cfg. Organizations
+// is a global service served from us-east-1.
+func NewOrganizations(cfg aws.Config) *Organizations {
+	c := New(cfg, "organizations", "organizations", "AWSOrganizationsV20161128", "1.1")
+	c.GlobalEndpoint = "https://organizations.us-east-1.amazonaws.com"
+	c.SigningRegion = "us-east-1"
+	return &Organizations{c}
+}
+
+type Account struct {
+	Id     string `json:"Id"`
+	Arn    string `json:"Arn"`
+	Name   string `json:"Name"`
+	Email  string `json:"Email"`
+	Status string `json:"Status"`
+}
+
+type ListAccountsInput struct {
+	NextToken string `json:"NextToken,omitempty"`
+}
+
+type ListAccountsOutput struct {
+	Accounts  []Account `json:"Accounts"`
+	NextToken string    `json:"NextToken"`
+}
+
+// ListAccounts returns a page of the accounts in the organization.
+func (c *Organizations) ListAccounts(ctx context.Context, params *ListAccountsInput) (*ListAccountsOutput, error) {
+	out := &ListAccountsOutput{}
+	if err := c.Call(ctx, "ListAccounts", params, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
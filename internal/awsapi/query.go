@@ -0,0 +1,36 @@
+package awsapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+)
+
+// Query invokes a Query protocol operation with the form encoded params and
+// unmarshals the XML response into out when out is not nil.
+func (c *Client) Query(ctx context.Context, action, version string, params url.Values, out interface{}) error {
+	form := url.Values{}
+	for k, v := range params {
+		form[k] = v
+	}
+	form.Set("Action", action)
+	form.Set("Version", version)
+	body := []byte(form.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Endpoint()+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	respBody, err := c.Do(ctx, action, params, req, body)
+	if err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return xml.Unmarshal(respBody, out)
+}
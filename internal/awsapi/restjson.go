@@ -0,0 +1,42 @@
+package awsapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// REST invokes a REST-JSON operation at path, marshalling in as the request
+// body when it is not nil and unmarshalling the response into out when out
+// is not nil. The input of the operation is in, or the query of path.
+func (c *Client) REST(ctx context.Context, operation, method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.Endpoint()+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	params := in
+	if in == nil {
+		params = req.URL.Query()
+	}
+	respBody, err := c.Do(ctx, operation, params, req, body)
+	if err != nil {
+		return err
+	}
+	if out == nil || len(respBody) == 0 {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
@@ -0,0 +1,143 @@
+package awsapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+const route53Namespace = "https://route53.amazonaws.com/doc/2013-04-01/"
+
+// Route53 is a client for Amazon Route 53 hosted zones and record sets.
+type Route53 struct {
+	*Client
+}
+
+// NewRoute53 returns an Amazon Route 53 client for cfg.
+func NewRoute53(cfg aws.Config) *Route53 {
+	c := New(cfg, "route53", "route53", "", "")
+	c.GlobalEndpoint = "https://route53.amazonaws.com"
+	c.SigningRegion = "us-east-1"
+	return &Route53{c}
+}
+
+type HostedZone struct {
+	Id     string `xml:"Id"`
+	Name   string `xml:"Name"`
+	Config struct {
+		PrivateZone bool `xml:"PrivateZone"`
+	} `xml:"Config"`
+}
+
+type ListHostedZonesByNameOutput struct {
+	HostedZones []HostedZone `xml:"HostedZones>HostedZone"`
+}
+
+// ListHostedZonesByName lists hosted zones in order of name, starting at dnsName.
+func (c *Route53) ListHostedZonesByName(ctx context.Context, dnsName string) (*ListHostedZonesByNameOutput, error) {
+	out := &ListHostedZonesByNameOutput{}
+	err := c.rest(ctx, "ListHostedZonesByName", http.MethodGet, "/2013-04-01/hostedzonesbyname?dnsname="+url.QueryEscape(dnsName), nil, out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type ResourceRecord struct {
+	Value string `xml:"Value"`
+}
+
+type ResourceRecordSet struct {
+	Name            string           `xml:"Name"`
+	Type            string           `xml:"Type"`
+	TTL             int64            `xml:"TTL,omitempty"`
+	ResourceRecords []ResourceRecord `xml:"ResourceRecords>ResourceRecord"`
+}
+
+type ListResourceRecordSetsOutput struct {
+	ResourceRecordSets []ResourceRecordSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+}
+
+// ListResourceRecordSets lists the record sets of a zone, starting at name and recordType.
+func (c *Route53) ListResourceRecordSets(ctx context.Context, zoneID, name, recordType string) (*ListResourceRecordSetsOutput, error) {
+	path := "/2013-04-01/hostedzone/" + trimZoneID(zoneID) + "/rrset?name=" + url.QueryEscape(name) + "&type=" + url.QueryEscape(recordType)
+	out := &ListResourceRecordSetsOutput{}
+	if err := c.rest(ctx, "ListResourceRecordSets", http.MethodGet, path, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type Change struct {
+	Action            string            `xml:"Action"`
+	ResourceRecordSet ResourceRecordSet `xml:"ResourceRecordSet"`
+}
+
+type ChangeBatch struct {
+	Comment string   `xml:"Comment,omitempty"`
+	Changes []Change `xml:"Changes>Change"`
+}
+
+type ChangeInfo struct {
+	Id     string `xml:"Id"`
+	Status string `xml:"Status"`
+}
+
+type ChangeResourceRecordSetsOutput struct {
+	ChangeInfo ChangeInfo `xml:"ChangeInfo"`
+}
+
+// ChangeResourceRecordSets applies a batch of record changes to a zone.
+func (c *Route53) ChangeResourceRecordSets(ctx context.Context, zoneID string, batch *ChangeBatch) (*ChangeResourceRecordSetsOutput, error) {
+	in := struct {
+		XMLName     xml.Name     `xml:"ChangeResourceRecordSetsRequest" json:"-"`
+		Namespace   string       `xml:"xmlns,attr" json:"-"`
+		ChangeBatch *ChangeBatch `xml:"ChangeBatch"`
+	}{Namespace: route53Namespace, ChangeBatch: batch}
+
+	out := &ChangeResourceRecordSetsOutput{}
+	if err := c.rest(ctx, "ChangeResourceRecordSets", http.MethodPost, "/2013-04-01/hostedzone/"+trimZoneID(zoneID)+"/rrset", in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// rest sends a REST-XML request, marshalling in as the body when it is not
+// nil. The input of the operation is in, or the query of path.
+func (c *Route53) rest(ctx context.Context, operation, method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = xml.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.Endpoint()+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+
+	params := in
+	if in == nil {
+		params = req.URL.Query()
+	}
+	respBody, err := c.Do(ctx, operation, params, req, body)
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(respBody, out)
+}
+
+// trimZoneID turns "/hostedzone/Z123" into "Z123".
+func trimZoneID(id string) string {
+	return strings.TrimPrefix(id, "/hostedzone/")
+}
@@ -0,0 +1,166 @@
+package awsapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// unsignedPayload lets object bodies be streamed instead of hashed up front.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// objectInput is the input of an object operation, for the middlewares.
+func objectInput(bucket, key string) map[string]string {
+	return map[string]string{"Bucket": bucket, "Key": key}
+}
+
+// S3 is a client for the object operations of Amazon S3.
+type S3 struct {
+	*Client
+
+	// UsePathStyle addresses objects as endpoint/bucket/key instead of
+	// bucket.endpoint/key, as LocalStack and moto usually require.
+	UsePathStyle bool
+}
+
+// NewS3 returns an Amazon S3 client for cfg.
+func NewS3(cfg aws.Config) *S3 {
+	return &S3{Client: New(cfg, "s3", "s3", "", "")}
+}
+
+// ObjectURL returns the virtual-hosted or path style URL of an object.
+func (c *S3) ObjectURL(bucket, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	if c.UsePathStyle {
+		return c.Endpoint() + "/" + url.PathEscape(bucket) + "/" + strings.Join(segments, "/")
+	}
+	endpoint := strings.Replace(c.Endpoint(), "://", "://"+bucket+".", 1)
+	return endpoint + "/" + strings.Join(segments, "/")
+}
+
+// PutObject uploads size bytes read from body to bucket/key.
+func (c *S3) PutObject(ctx context.Context, bucket, key string, body io.Reader, size int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.ObjectURL(bucket, key), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+
+	resp, err := c.Send(ctx, "PutObject", objectInput(bucket, key), req, unsignedPayload)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// PutObjectIfAbsent uploads body to bucket/key only when the object does not
+// exist yet. S3 answers 412 PreconditionFailed when it does.
+func (c *S3) PutObjectIfAbsent(ctx context.Context, bucket, key string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.ObjectURL(bucket, key), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("If-None-Match", "*")
+	_, err = c.Do(ctx, "PutObject", objectInput(bucket, key), req, body)
+	return err
+}
+
+// GetObject returns the body of bucket/key and its size. The caller must
+// close the body.
+func (c *S3) GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.ObjectURL(bucket, key), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := c.Send(ctx, "GetObject", objectInput(bucket, key), req, unsignedPayload)
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// GetObjectETag returns the body of bucket/key and its ETag, for a
+// conditional write of the object to compare.
+func (c *S3) GetObjectETag(ctx context.Context, bucket, key string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.ObjectURL(bucket, key), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := c.Send(ctx, "GetObject", objectInput(bucket, key), req, unsignedPayload)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return body, resp.Header.Get("ETag"), err
+}
+
+// PutObjectIfMatch uploads body to bucket/key only when the object still has
+// the ETag, or does not exist yet when etag is empty. S3 answers 412
+// PreconditionFailed, or 409 ConditionalRequestConflict during a concurrent
+// write, when it does not. It returns the ETag and, in a versioned bucket,
+// the version of the new object.
+func (c *S3) PutObjectIfMatch(ctx context.Context, bucket, key string, body []byte, etag string) (string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.ObjectURL(bucket, key), bytes.NewReader(body))
+	if err != nil {
+		return "", "", err
+	}
+	if etag == "" {
+		req.Header.Set("If-None-Match", "*")
+	} else {
+		req.Header.Set("If-Match", etag)
+	}
+	sum := sha256.Sum256(body)
+	resp, err := c.Send(ctx, "PutObject", objectInput(bucket, key), req, hex.EncodeToString(sum[:]))
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	return resp.Header.Get("ETag"), resp.Header.Get("X-Amz-Version-Id"), nil
+}
+
+// DeleteObject removes bucket/key.
+func (c *S3) DeleteObject(ctx context.Context, bucket, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.ObjectURL(bucket, key), nil)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do(ctx, "DeleteObject", objectInput(bucket, key), req, nil)
+	return err
+}
+
+// PresignObject returns a URL that allows method on bucket/key without
+// credentials until expires has passed.
+func (c *S3) PresignObject(ctx context.Context, method, bucket, key string, expires time.Duration) (string, error) {
+	creds, err := c.cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	objectURL := c.ObjectURL(bucket, key) + "?X-Amz-Expires=" + strconv.Itoa(int(expires.Seconds()))
+	req, err := http.NewRequestWithContext(ctx, method, objectURL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	signed, _, err := v4.NewSigner().PresignHTTP(ctx, creds, req, unsignedPayload, c.SigningName, c.cfg.Region, time.Now())
+	if err != nil {
+		return "", fmt.Errorf("presigning %s %s: %w", method, key, err)
+	}
+	return signed, nil
+}
@@ -0,0 +1,54 @@
+package awsapi
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// SavingsPlans is a client for Savings Plans.
+type SavingsPlans struct {
+	*Client
+}
+
+// NewSavingsPlans returns a Savings Plans client for cfg. Savings Plans is a
+// global service served from us-east-1.
+func NewSavingsPlans(cfg aws.Config) *SavingsPlans {
+	c := New(cfg, "savingsplans", "savingsplans", "", "")
+	c.GlobalEndpoint = "https://savingsplans.amazonaws.com"
+	c.SigningRegion = "us-east-1"
+	return &SavingsPlans{c}
+}
+
+type SavingsPlan struct {
+	SavingsPlanId   string `json:"savingsPlanId"`
+	SavingsPlanType string `json:"savingsPlanType"`
+	State           string `json:"state"`
+	// Commitment is the hourly commitment in Currency, as a decimal string.
+	Commitment string `json:"commitment"`
+	Currency   string `json:"currency"`
+	// Region and Ec2InstanceFamily limit EC2 Instance Savings Plans.
+	Region            string `json:"region"`
+	Ec2InstanceFamily string `json:"ec2InstanceFamily"`
+	End               string `json:"end"`
+}
+
+type DescribeSavingsPlansInput struct {
+	States    []string `json:"states,omitempty"`
+	NextToken string   `json:"nextToken,omitempty"`
+}
+
+type DescribeSavingsPlansOutput struct {
+	SavingsPlans []SavingsPlan `json:"savingsPlans"`
+	NextToken    string        `json:"nextToken"`
+}
+
+// DescribeSavingsPlans returns a page of the account's Savings Plans.
+func (c *SavingsPlans) DescribeSavingsPlans(ctx context.Context, params *DescribeSavingsPlansInput) (*DescribeSavingsPlansOutput, error) {
+	out := &DescribeSavingsPlansOutput{}
+	if err := c.REST(ctx, "DescribeSavingsPlans", http.MethodPost, "/DescribeSavingsPlans", params, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
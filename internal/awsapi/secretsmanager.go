@@ -0,0 +1,54 @@
+package awsapi
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// SecretsManager is a client for AWS Secrets Manager.
+type SecretsManager struct {
+	*Client
+}
+
+// NewSecretsManager returns an AWS Secrets Manager client for cfg.
+func NewSecretsManager(cfg aws.Config) *SecretsManager {
+	return &SecretsManager{New(cfg, "secretsmanager", "secretsmanager", "secretsmanager", "1.1")}
+}
+
+type DescribeSecretInput struct {
+	SecretId string `json:"SecretId"`
+}
+
+type DescribeSecretOutput struct {
+	ARN  string `json:"ARN"`
+	Name string `json:"Name"`
+}
+
+// DescribeSecret returns the metadata of a secret, without its value.
+func (c *SecretsManager) DescribeSecret(ctx context.Context, params *DescribeSecretInput) (*DescribeSecretOutput, error) {
+	out := &DescribeSecretOutput{}
+	if err := c.Call(ctx, "DescribeSecret", params, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type GetSecretValueInput struct {
+	SecretId string `json:"SecretId"`
+}
+
+type GetSecretValueOutput struct {
+	ARN          string `json:"ARN"`
+	Name         string `json:"Name"`
+	SecretString string `json:"SecretString"`
+}
+
+// GetSecretValue returns the current value of a secret.
+func (c *SecretsManager) GetSecretValue(ctx context.Context, params *GetSecretValueInput) (*GetSecretValueOutput, error) {
+	out := &GetSecretValueOutput{}
+	if err := c.Call(ctx, "GetSecretValue", params, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
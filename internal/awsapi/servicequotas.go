@@ -0,0 +1,41 @@
+package awsapi
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// ServiceQuotas is a client for Service Quotas.
+type ServiceQuotas struct {
+	*Client
+}
+
+// NewServiceQuotas returns a Service Quotas client for cfg.
+func NewServiceQuotas(cfg aws.Config) *ServiceQuotas {
+	return &ServiceQuotas{New(cfg, "servicequotas", "servicequotas", "ServiceQuotasV20190624", "1.1")}
+}
+
+type GetServiceQuotaInput struct {
+	ServiceCode string `json:"ServiceCode"`
+	QuotaCode   string `json:"QuotaCode"`
+}
+
+type ServiceQuota struct {
+	QuotaCode string  `json:"QuotaCode"`
+	QuotaName string  `json:"QuotaName"`
+	Value     float64 `json:"Value"`
+}
+
+type GetServiceQuotaOutput struct {
+	Quota ServiceQuota `json:"Quota"`
+}
+
+// GetServiceQuota returns the applied value of a quota in the region.
+func (c *ServiceQuotas) GetServiceQuota(ctx context.Context, params *GetServiceQuotaInput) (*GetServiceQuotaOutput, error) {
+	out := &GetServiceQuotaOutput{}
+	if err := c.Call(ctx, "GetServiceQuota", params, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,47 @@
+package awsapi
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+const snsVersion = "2010-03-31"
+
+// SNS is a client for Amazon Simple Notification Service.
+type SNS struct {
+	*Client
+}
+
+// NewSNS returns an Amazon SNS client for cfg.
+func NewSNS(cfg aws.Config) *SNS {
+	return &SNS{New(cfg, "sns", "sns", "", "")}
+}
+
+type PublishInput struct {
+	TopicArn string
+	Subject  string
+	Message  string
+}
+
+type PublishOutput struct {
+	MessageId string `xml:"PublishResult>MessageId"`
+}
+
+// Publish sends a message to every subscriber of a topic.
+func (c *SNS) Publish(ctx context.Context, params *PublishInput) (*PublishOutput, error) {
+	values := url.Values{
+		"TopicArn": {params.TopicArn},
+		"Message":  {params.Message},
+	}
+	if params.Subject != "" {
+		values.Set("Subject", params.Subject)
+	}
+
+	out := &PublishOutput{}
+	if err := c.Query(ctx, "Publish", snsVersion, values, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
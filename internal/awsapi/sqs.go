@@ -0,0 +1,50 @@
+package awsapi
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+const sqsVersion = "2012-11-05"
+
+// SQS is a client for Amazon Simple Queue Service.
+type SQS struct {
+	*Client
+}
+
+// NewSQS returns an Amazon SQS client for cfg.
+func NewSQS(cfg aws.Config) *SQS {
+	return &SQS{New(cfg, "sqs", "sqs", "", "")}
+}
+
+type GetQueueAttributesInput struct {
+	QueueUrl       string
+	AttributeNames []string
+}
+
+type GetQueueAttributesOutput struct {
+	Attributes []QueueAttribute `xml:"GetQueueAttributesResult>Attribute"`
+}
+
+type QueueAttribute struct {
+	Name  string `xml:"Name"`
+	Value string `xml:"Value"`
+}
+
+// GetQueueAttributes returns the attributes of a queue, such as the
+// approximate number of messages it holds.
+func (c *SQS) GetQueueAttributes(ctx context.Context, params *GetQueueAttributesInput) (*GetQueueAttributesOutput, error) {
+	values := url.Values{"QueueUrl": {params.QueueUrl}}
+	for n, name := range params.AttributeNames {
+		values.Set("AttributeName."+strconv.Itoa(n+1), name)
+	}
+
+	out := &GetQueueAttributesOutput{}
+	if err := c.Query(ctx, "GetQueueAttributes", sqsVersion, values, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,209 @@
+package awsapi
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// SSM is a client for AWS Systems Manager.
+type SSM struct {
+	*Client
+}
+
+// NewSSM returns a Systems Manager client for cfg.
+func NewSSM(cfg aws.Config) *SSM {
+	return &SSM{New(cfg, "ssm", "ssm", "AmazonSSM", "1.1")}
+}
+
+type StartSessionInput struct {
+	Target       string              `json:"Target"`
+	DocumentName string              `json:"DocumentName,omitempty"`
+	Parameters   map[string][]string `json:"Parameters,omitempty"`
+	Reason       string              `json:"Reason,omitempty"`
+}
+
+type StartSessionOutput struct {
+	SessionId  string `json:"SessionId"`
+	StreamUrl  string `json:"StreamUrl"`
+	TokenValue string `json:"TokenValue"`
+}
+
+// StartSession opens a Session Manager session to the target. The returned
+// stream URL and token are handed to the session-manager-plugin.
+func (c *SSM) StartSession(ctx context.Context, params *StartSessionInput) (*StartSessionOutput, error) {
+	out := &StartSessionOutput{}
+	if err := c.Call(ctx, "StartSession", params, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type SendCommandInput struct {
+	InstanceIds    []string            `json:"InstanceIds"`
+	DocumentName   string              `json:"DocumentName"`
+	Parameters     map[string][]string `json:"Parameters,omitempty"`
+	Comment        string              `json:"Comment,omitempty"`
+	TimeoutSeconds int                 `json:"TimeoutSeconds,omitempty"`
+	// OutputS3BucketName and OutputS3KeyPrefix, when set, have the output
+	// of the command written to S3 as well.
+	OutputS3BucketName string `json:"OutputS3BucketName,omitempty"`
+	OutputS3KeyPrefix  string `json:"OutputS3KeyPrefix,omitempty"`
+}
+
+type Command struct {
+	CommandId string `json:"CommandId"`
+	Status    string `json:"Status"`
+}
+
+type SendCommandOutput struct {
+	Command Command `json:"Command"`
+}
+
+// SendCommand runs an SSM document on the given instances.
+func (c *SSM) SendCommand(ctx context.Context, params *SendCommandInput) (*SendCommandOutput, error) {
+	out := &SendCommandOutput{}
+	if err := c.Call(ctx, "SendCommand", params, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type GetCommandInvocationInput struct {
+	CommandId  string `json:"CommandId"`
+	InstanceId string `json:"InstanceId"`
+}
+
+type GetCommandInvocationOutput struct {
+	CommandId             string `json:"CommandId"`
+	InstanceId            string `json:"InstanceId"`
+	Status                string `json:"Status"`
+	StatusDetails         string `json:"StatusDetails"`
+	ResponseCode          int    `json:"ResponseCode"`
+	StandardOutputContent string `json:"StandardOutputContent"`
+	StandardErrorContent  string `json:"StandardErrorContent"`
+}
+
+// GetCommandInvocation returns the status and output of a command on one instance.
+func (c *SSM) GetCommandInvocation(ctx context.Context, params *GetCommandInvocationInput) (*GetCommandInvocationOutput, error) {
+	out := &GetCommandInvocationOutput{}
+	if err := c.Call(ctx, "GetCommandInvocation", params, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type InstanceInformationFilter struct {
+	Key    string   `json:"Key"`
+	Values []string `json:"Values"`
+}
+
+type DescribeInstanceInformationInput struct {
+	Filters    []InstanceInformationFilter `json:"Filters,omitempty"`
+	MaxResults int                         `json:"MaxResults,omitempty"`
+	NextToken  string                      `json:"NextToken,omitempty"`
+}
+
+type InstanceInformation struct {
+	InstanceId      string `json:"InstanceId"`
+	PingStatus      string `json:"PingStatus"`
+	PlatformType    string `json:"PlatformType"`
+	PlatformName    string `json:"PlatformName"`
+	AgentVersion    string `json:"AgentVersion"`
+	ComputerName    string `json:"ComputerName"`
+	IPAddress       string `json:"IPAddress"`
+	IsLatestVersion bool   `json:"IsLatestVersion"`
+}
+
+type DescribeInstanceInformationOutput struct {
+	InstanceInformationList []InstanceInformation `json:"InstanceInformationList"`
+	NextToken               string                `json:"NextToken"`
+}
+
+// DescribeInstanceInformation lists the instances registered with Systems Manager.
+func (c *SSM) DescribeInstanceInformation(ctx context.Context, params *DescribeInstanceInformationInput) (*DescribeInstanceInformationOutput, error) {
+	out := &DescribeInstanceInformationOutput{}
+	if err := c.Call(ctx, "DescribeInstanceInformation", params, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type DescribeInstancePatchStatesInput struct {
+	InstanceIds []string `json:"InstanceIds"`
+	NextToken   string   `json:"NextToken,omitempty"`
+}
+
+// InstancePatchState is the patch compliance of an instance after its last
+// AWS-RunPatchBaseline run.
+type InstancePatchState struct {
+	InstanceId                  string  `json:"InstanceId"`
+	BaselineId                  string  `json:"BaselineId"`
+	Operation                   string  `json:"Operation"`
+	OperationEndTime            float64 `json:"OperationEndTime"`
+	InstalledCount              int     `json:"InstalledCount"`
+	InstalledPendingRebootCount int     `json:"InstalledPendingRebootCount"`
+	MissingCount                int     `json:"MissingCount"`
+	FailedCount                 int     `json:"FailedCount"`
+}
+
+type DescribeInstancePatchStatesOutput struct {
+	InstancePatchStates []InstancePatchState `json:"InstancePatchStates"`
+	NextToken           string               `json:"NextToken"`
+}
+
+// DescribeInstancePatchStates returns the patch compliance of up to 50 instances.
+func (c *SSM) DescribeInstancePatchStates(ctx context.Context, params *DescribeInstancePatchStatesInput) (*DescribeInstancePatchStatesOutput, error) {
+	out := &DescribeInstancePatchStatesOutput{}
+	if err := c.Call(ctx, "DescribeInstancePatchStates", params, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type GetParameterInput struct {
+	Name           string `json:"Name"`
+	WithDecryption bool   `json:"WithDecryption,omitempty"`
+}
+
+type Parameter struct {
+	Name    string `json:"Name"`
+	Type    string `json:"Type"`
+	Value   string `json:"Value"`
+	Version int64  `json:"Version"`
+}
+
+type GetParameterOutput struct {
+	Parameter Parameter `json:"Parameter"`
+}
+
+// GetParameter returns a Parameter Store parameter, decrypting SecureString
+// values with WithDecryption.
+func (c *SSM) GetParameter(ctx context.Context, params *GetParameterInput) (*GetParameterOutput, error) {
+	out := &GetParameterOutput{}
+	if err := c.Call(ctx, "GetParameter", params, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type PutParameterInput struct {
+	Name      string `json:"Name"`
+	Value     string `json:"Value"`
+	Type      string `json:"Type,omitempty"`
+	Overwrite bool   `json:"Overwrite,omitempty"`
+}
+
+type PutParameterOutput struct {
+	Version int64 `json:"Version"`
+}
+
+// PutParameter creates a Parameter Store parameter, or with Overwrite a new
+// version of it. Creating one that exists fails with ParameterAlreadyExists.
+func (c *SSM) PutParameter(ctx context.Context, params *PutParameterInput) (*PutParameterOutput, error) {
+	out := &PutParameterOutput{}
+	if err := c.Call(ctx, "PutParameter", params, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
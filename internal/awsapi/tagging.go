@@ -0,0 +1,53 @@
+package awsapi
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Tagging is a client for the AWS Resource Groups Tagging API.
+type Tagging struct {
+	*Client
+}
+
+// NewTagging returns a Resource Groups Tagging API client for cfg.
+func NewTagging(cfg aws.Config) *Tagging {
+	return &Tagging{New(cfg, "tagging", "tagging", "ResourceGroupsTaggingAPI_20170126", "1.1")}
+}
+
+type TagFilter struct {
+	Key    string   `json:"Key"`
+	Values []string `json:"Values,omitempty"`
+}
+
+type GetResourcesInput struct {
+	TagFilters          []TagFilter `json:"TagFilters,omitempty"`
+	ResourceTypeFilters []string    `json:"ResourceTypeFilters,omitempty"`
+	PaginationToken     string      `json:"PaginationToken,omitempty"`
+}
+
+type ResourceTag struct {
+	Key   string `json:"Key"`
+	Value string `json:"Value"`
+}
+
+type ResourceTagMapping struct {
+	ResourceARN string        `json:"ResourceARN"`
+	Tags        []ResourceTag `json:"Tags"`
+}
+
+type GetResourcesOutput struct {
+	PaginationToken        string               `json:"PaginationToken"`
+	ResourceTagMappingList []ResourceTagMapping `json:"ResourceTagMappingList"`
+}
+
+// GetResources returns a page of the resources of the region with the tags
+// of the filters.
+func (c *Tagging) GetResources(ctx context.Context, params *GetResourcesInput) (*GetResourcesOutput, error) {
+	out := &GetResourcesOutput{}
+	if err := c.Call(ctx, "GetResources", params, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,601 @@
+// Package jsonschema validates JSON documents against the subset of JSON
+// Schema used by the tool's config schema: type, properties, required,
+// additionalProperties, items, enum, pattern, minLength, minItems, minimum
+// and maximum. The title, description and default annotations are read, and
+// defaults can be filled in for omitted properties. References, composition
+// keywords and formats are not supported.
+//
+// Validation errors point at the line and column of the offending value.
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is a parsed JSON Schema.
+type Schema struct {
+	Title                string             `json:"title,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Type                 Types              `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Additional        `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	Default              json.RawMessage    `json:"default,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// Types are the JSON types a value may have, written as a single string or
+// an array of them.
+type Types []string
+
+func (t *Types) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*t = Types{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return errors.New("type must be a string or an array of strings")
+	}
+	*t = many
+	return nil
+}
+
+// Additional is the additionalProperties keyword: false forbids properties
+// that are not listed, and a schema validates them.
+type Additional struct {
+	Forbidden bool
+	Schema    *Schema
+}
+
+func (a *Additional) UnmarshalJSON(data []byte) error {
+	var allowed bool
+	if err := json.Unmarshal(data, &allowed); err == nil {
+		a.Forbidden = !allowed
+		return nil
+	}
+	a.Schema = &Schema{}
+	return json.Unmarshal(data, a.Schema)
+}
+
+// Compile parses a schema and its patterns.
+func Compile(data []byte) (*Schema, error) {
+	s := &Schema{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("parsing the schema: %w", err)
+	}
+	if err := s.compile(""); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// MustCompile is like Compile but panics if the schema cannot be parsed. It
+// is meant for schemas built into the program.
+func MustCompile(data []byte) *Schema {
+	s, err := Compile(data)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func (s *Schema) compile(path string) error {
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("schema %s: %w", firstNonEmpty(path, "/"), err)
+		}
+		s.pattern = re
+	}
+	for name, p := range s.Properties {
+		if err := p.compile(path + "/properties/" + name); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		if err := s.Items.compile(path + "/items"); err != nil {
+			return err
+		}
+	}
+	if s.AdditionalProperties != nil && s.AdditionalProperties.Schema != nil {
+		return s.AdditionalProperties.Schema.compile(path + "/additionalProperties")
+	}
+	return nil
+}
+
+// Error is a problem with a document, at the line and column of the value
+// it is about.
+type Error struct {
+	File   string
+	Line   int
+	Column int
+	// Path is the JSON pointer of the value, empty for syntax errors.
+	Path    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	location := fmt.Sprintf("%d:%d", e.Line, e.Column)
+	if e.File != "" {
+		location = e.File + ":" + location
+	}
+	if e.Path == "" {
+		return location + ": " + e.Message
+	}
+	return location + ": " + e.Path + ": " + e.Message
+}
+
+// Errors are the problems found in a document, in the order they appear.
+type Errors []*Error
+
+func (e Errors) Error() string {
+	lines := make([]string, len(e))
+	for n, err := range e {
+		lines[n] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// node is a decoded JSON value with where it starts in the document.
+type node struct {
+	kind   string
+	offset int64
+	value  interface{}
+	keys   []string
+	fields map[string]*node
+	// keyOffsets are where the keys of an object start.
+	keyOffsets map[string]int64
+	items      []*node
+}
+
+// Validate checks the document in data against the schema. It returns
+// Errors locating every problem, naming file in each, or nil.
+func (s *Schema) Validate(file string, data []byte) error {
+	v := &validator{file: file, data: data}
+	root, err := v.parse()
+	if err != nil {
+		return Errors{err}
+	}
+	v.check(s, root, "")
+	if len(v.errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(v.errs, func(a, b int) bool {
+		if v.errs[a].Line != v.errs[b].Line {
+			return v.errs[a].Line < v.errs[b].Line
+		}
+		return v.errs[a].Column < v.errs[b].Column
+	})
+	return v.errs
+}
+
+type validator struct {
+	file string
+	data []byte
+	dec  *json.Decoder
+	errs Errors
+}
+
+// errorAt returns an error at offset in the document.
+func (v *validator) errorAt(offset int64, path string, format string, args ...interface{}) *Error {
+	if offset > int64(len(v.data)) {
+		offset = int64(len(v.data))
+	}
+	before := v.data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := utf8.RuneCount(before[bytes.LastIndexByte(before, '\n')+1:]) + 1
+	return &Error{File: v.file, Line: line, Column: column, Path: path, Message: fmt.Sprintf(format, args...)}
+}
+
+// start returns where the token after offset starts, past the white space
+// and separators the decoder has not consumed yet.
+func (v *validator) start(offset int64) int64 {
+	for offset < int64(len(v.data)) && strings.IndexByte(" \t\r\n,:", v.data[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+func (v *validator) parse() (*node, *Error) {
+	v.dec = json.NewDecoder(bytes.NewReader(v.data))
+	v.dec.UseNumber()
+	root, err := v.value()
+	if err != nil {
+		return nil, err
+	}
+	trailing := v.start(v.dec.InputOffset())
+	if _, err := v.dec.Token(); err != io.EOF {
+		return nil, v.errorAt(trailing, "", "unexpected data after the document")
+	}
+	return root, nil
+}
+
+func (v *validator) syntaxError(err error) *Error {
+	var syntax *json.SyntaxError
+	if errors.As(err, &syntax) {
+		return v.errorAt(syntax.Offset, "", "%s", syntax.Error())
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return v.errorAt(int64(len(v.data)), "", "unexpected end of the document")
+	}
+	return v.errorAt(v.dec.InputOffset(), "", "%s", err.Error())
+}
+
+func (v *validator) value() (*node, *Error) {
+	n := &node{offset: v.start(v.dec.InputOffset())}
+	token, err := v.dec.Token()
+	if err != nil {
+		return nil, v.syntaxError(err)
+	}
+	switch t := token.(type) {
+	case json.Delim:
+		if t == '{' {
+			n.kind, n.fields, n.keyOffsets = "object", map[string]*node{}, map[string]int64{}
+			for v.dec.More() {
+				keyOffset := v.start(v.dec.InputOffset())
+				token, err := v.dec.Token()
+				if err != nil {
+					return nil, v.syntaxError(err)
+				}
+				key := token.(string)
+				child, serr := v.value()
+				if serr != nil {
+					return nil, serr
+				}
+				if _, ok := n.fields[key]; ok {
+					return nil, v.errorAt(keyOffset, "", "%q is set twice", key)
+				}
+				n.keys = append(n.keys, key)
+				n.fields[key], n.keyOffsets[key] = child, keyOffset
+			}
+		} else {
+			n.kind = "array"
+			for v.dec.More() {
+				child, serr := v.value()
+				if serr != nil {
+					return nil, serr
+				}
+				n.items = append(n.items, child)
+			}
+		}
+		// The closing delimiter.
+		if _, err := v.dec.Token(); err != nil {
+			return nil, v.syntaxError(err)
+		}
+	case string:
+		n.kind, n.value = "string", t
+	case json.Number:
+		n.kind, n.value = "number", t
+	case bool:
+		n.kind, n.value = "boolean", t
+	case nil:
+		n.kind = "null"
+	}
+	return n, nil
+}
+
+// hasType reports whether the value is of one of the types.
+func hasType(n *node, types Types) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, t := range types {
+		switch {
+		case t == n.kind:
+			return true
+		case t == "integer" && n.kind == "number":
+			if _, err := strconv.ParseInt(string(n.value.(json.Number)), 10, 64); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// article returns the type with its indefinite article.
+func article(t string) string {
+	switch t {
+	case "object", "array", "integer":
+		return "an " + t
+	case "null":
+		return "null"
+	}
+	return "a " + t
+}
+
+func (v *validator) check(s *Schema, n *node, path string) {
+	if !hasType(n, s.Type) {
+		var want []string
+		for _, t := range s.Type {
+			want = append(want, article(t))
+		}
+		v.errs = append(v.errs, v.errorAt(n.offset, pointer(path), "must be %s, not %s", strings.Join(want, " or "), article(n.kind)))
+		return
+	}
+
+	if len(s.Enum) > 0 {
+		value, _ := json.Marshal(n.plain())
+		found := false
+		var allowed []string
+		for _, e := range s.Enum {
+			encoded, _ := json.Marshal(e)
+			found = found || bytes.Equal(encoded, value)
+			allowed = append(allowed, string(encoded))
+		}
+		if !found {
+			v.errs = append(v.errs, v.errorAt(n.offset, pointer(path), "must be one of %s", strings.Join(allowed, ", ")))
+		}
+	}
+
+	switch n.kind {
+	case "string":
+		text := n.value.(string)
+		if s.MinLength != nil && utf8.RuneCountInString(text) < *s.MinLength {
+			v.errs = append(v.errs, v.errorAt(n.offset, pointer(path), "must be at least %d characters long", *s.MinLength))
+		}
+		if s.pattern != nil && !s.pattern.MatchString(text) {
+			v.errs = append(v.errs, v.errorAt(n.offset, pointer(path), "%q does not match %s", text, s.Pattern))
+		}
+	case "number":
+		f, _ := n.value.(json.Number).Float64()
+		if s.Minimum != nil && f < *s.Minimum {
+			v.errs = append(v.errs, v.errorAt(n.offset, pointer(path), "must be at least %g", *s.Minimum))
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			v.errs = append(v.errs, v.errorAt(n.offset, pointer(path), "must be at most %g", *s.Maximum))
+		}
+	case "array":
+		if s.MinItems != nil && len(n.items) < *s.MinItems {
+			v.errs = append(v.errs, v.errorAt(n.offset, pointer(path), "must have at least %d items", *s.MinItems))
+		}
+		if s.Items != nil {
+			for i, item := range n.items {
+				v.check(s.Items, item, path+"/"+strconv.Itoa(i))
+			}
+		}
+	case "object":
+		for _, name := range s.Required {
+			if _, ok := n.fields[name]; !ok {
+				v.errs = append(v.errs, v.errorAt(n.offset, pointer(path), "%q is required", name))
+			}
+		}
+		for _, key := range n.keys {
+			child := path + "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+			if p, ok := s.Properties[key]; ok {
+				v.check(p, n.fields[key], child)
+				continue
+			}
+			switch a := s.AdditionalProperties; {
+			case a == nil:
+			case a.Schema != nil:
+				v.check(a.Schema, n.fields[key], child)
+			case a.Forbidden:
+				message := fmt.Sprintf("unknown property %q", key)
+				if near := nearest(key, s.Properties); near != "" {
+					message += fmt.Sprintf(", did you mean %q?", near)
+				}
+				v.errs = append(v.errs, v.errorAt(n.keyOffsets[key], pointer(path), "%s", message))
+			}
+		}
+	}
+}
+
+// plain returns the value of a scalar node as encoding/json decodes it.
+func (n *node) plain() interface{} {
+	if number, ok := n.value.(json.Number); ok {
+		f, _ := number.Float64()
+		return f
+	}
+	return n.value
+}
+
+// pointer returns the JSON pointer path, or / for the document itself.
+func pointer(path string) string {
+	return firstNonEmpty(path, "/")
+}
+
+// nearest returns the property whose name is closest to key, when it is
+// close enough to be a typo.
+func nearest(key string, properties map[string]*Schema) string {
+	best, bestDistance := "", 3
+	for name := range properties {
+		if d := distance(key, name); d < bestDistance || d == bestDistance && best != "" && name < best {
+			best, bestDistance = name, d
+		}
+	}
+	return best
+}
+
+// distance is the Levenshtein distance between a and b.
+func distance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+func min(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// ApplyDefaults returns the document with the default of every property the
+// schema has one for filled in where the document omits it, in the objects
+// the document has.
+func (s *Schema) ApplyDefaults(data []byte) ([]byte, error) {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if err := s.fill(doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+func (s *Schema) fill(doc interface{}) error {
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		for name, p := range s.Properties {
+			value, ok := d[name]
+			if !ok && len(p.Default) > 0 {
+				if err := json.Unmarshal(p.Default, &value); err != nil {
+					return fmt.Errorf("the default of %s: %w", name, err)
+				}
+				d[name] = value
+			}
+			if err := p.fill(value); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for _, item := range d {
+				if err := s.Items.fill(item); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Set parses value as the type the schema gives the property at path, checks
+// it against the property's schema and stores it in doc, making the objects
+// on the way. Arrays are written as comma separated items.
+func (s *Schema) Set(doc map[string]interface{}, path []string, value string) error {
+	schema := s
+	for n, name := range path {
+		switch {
+		case schema.Properties[name] != nil:
+			schema = schema.Properties[name]
+		case schema.AdditionalProperties != nil && schema.AdditionalProperties.Schema != nil:
+			schema = schema.AdditionalProperties.Schema
+		default:
+			return fmt.Errorf("unknown setting %s", strings.Join(path[:n+1], "."))
+		}
+	}
+
+	parsed, err := schema.parse(value)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(parsed)
+	if err != nil {
+		return err
+	}
+	if err := schema.Validate("", encoded); err != nil {
+		var messages []string
+		for _, e := range err.(Errors) {
+			messages = append(messages, e.Message)
+		}
+		return errors.New(strings.Join(messages, ", "))
+	}
+	for _, name := range path[:len(path)-1] {
+		child, ok := doc[name].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			doc[name] = child
+		}
+		doc = child
+	}
+	doc[path[len(path)-1]] = parsed
+	return nil
+}
+
+// parse converts value to the first type of the schema other than null.
+func (s *Schema) parse(value string) (interface{}, error) {
+	t := "string"
+	for _, candidate := range s.Type {
+		if candidate != "null" {
+			t = candidate
+			break
+		}
+	}
+	switch t {
+	case "boolean":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not true or false", value)
+		}
+		return b, nil
+	case "integer":
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integer", value)
+		}
+		return i, nil
+	case "number":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", value)
+		}
+		return f, nil
+	case "array":
+		items := []interface{}{}
+		item := s.Items
+		if item == nil {
+			item = &Schema{}
+		}
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v == "" {
+				continue
+			}
+			parsed, err := item.parse(v)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, parsed)
+		}
+		return items, nil
+	case "object":
+		return nil, errors.New("an object cannot be set whole, set its fields as KEY.FIELD=VALUE")
+	}
+	return value, nil
+}
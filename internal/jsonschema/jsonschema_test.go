@@ -0,0 +1,107 @@
+package jsonschema
+
+import (
+	"strings"
+	"testing"
+)
+
+const schema = `{
+  "type": "object",
+  "additionalProperties": false,
+  "properties": {
+    "name": {"type": "string", "minLength": 1},
+    "size": {"type": "integer", "minimum": 1, "default": 2},
+    "mode": {"enum": ["fast", "safe"]},
+    "servers": {
+      "type": "array",
+      "items": {"type": "object", "required": ["host"], "properties": {"host": {"type": "string", "pattern": "^[a-z.]+$"}, "port": {"type": "integer", "default": 443}}}
+    }
+  }
+}`
+
+func TestValidate(t *testing.T) {
+	s := MustCompile([]byte(schema))
+	if err := s.Validate("ok.json", []byte(`{"name": "web", "servers": [{"host": "a.example"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	doc := `{
+  "name": "",
+  "size": 1.5,
+  "mode": "slow",
+  "severs": [],
+  "servers": [{"host": "A!"}, {"port": 80}]
+}`
+	err := s.Validate("bad.json", []byte(doc))
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("got %v, want Errors", err)
+	}
+	want := []string{
+		`bad.json:2:11: /name: must be at least 1 characters long`,
+		`bad.json:3:11: /size: must be an integer, not a number`,
+		`bad.json:4:11: /mode: must be one of "fast", "safe"`,
+		`bad.json:5:3: /: unknown property "severs", did you mean "servers"?`,
+		`bad.json:6:24: /servers/0/host: "A!" does not match ^[a-z.]+$`,
+		`bad.json:6:31: /servers/1: "host" is required`,
+	}
+	var got []string
+	for _, e := range errs {
+		got = append(got, e.Error())
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestValidateSyntax(t *testing.T) {
+	s := MustCompile([]byte(schema))
+	for doc, want := range map[string]string{
+		"{\n  \"name\": \"web\",\n}": "f.json:2:17: invalid character ',' looking for beginning of value",
+		`{"name": "web"`:             "f.json:1:15: unexpected end of JSON input",
+		`{"name": "a", "name": "b"}`: `f.json:1:15: "name" is set twice`,
+		`{} {}`:                      "f.json:1:4: unexpected data after the document",
+	} {
+		if err := s.Validate("f.json", []byte(doc)); err == nil || err.Error() != want {
+			t.Errorf("%q: got %v, want %s", doc, err, want)
+		}
+	}
+}
+
+func TestApplyDefaults(t *testing.T) {
+	s := MustCompile([]byte(schema))
+	out, err := s.ApplyDefaults([]byte(`{"name": "web", "servers": [{"host": "a"}, {"host": "b", "port": 80}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"name":"web","servers":[{"host":"a","port":443},{"host":"b","port":80}],"size":2}`; string(out) != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+}
+
+func TestSet(t *testing.T) {
+	s := MustCompile([]byte(schema))
+	doc := map[string]interface{}{"name": "web"}
+	for path, value := range map[string]string{"size": "3", "mode": "safe", "name": "api"} {
+		if err := s.Set(doc, strings.Split(path, "."), value); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+	if doc["size"] != int64(3) || doc["mode"] != "safe" || doc["name"] != "api" {
+		t.Errorf("doc = %v", doc)
+	}
+
+	for path, want := range map[string]string{
+		"size=big":      `"big" is not an integer`,
+		"size=0":        "must be at least 1",
+		"mode=slow":     `must be one of "fast", "safe"`,
+		"servers=x":     "an object cannot be set whole, set its fields as KEY.FIELD=VALUE",
+		"nmae=web":      "unknown setting nmae",
+		"name.first=ok": "unknown setting name.first",
+	} {
+		key, value, _ := strings.Cut(path, "=")
+		if err := s.Set(doc, strings.Split(key, "."), value); err == nil || err.Error() != want {
+			t.Errorf("%s: got %v, want %s", path, err, want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Package metrics exposes counters and gauges in the Prometheus text
+// exposition format, without depending on the Prometheus client library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Labels are the label names and values of a sample.
+type Labels map[string]string
+
+// Sample is one value of a gauge.
+type Sample struct {
+	Labels Labels
+	Value  float64
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    string
+	samples map[string]*Sample
+	collect func() ([]Sample, error)
+}
+
+// Registry holds the metrics served on /metrics.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+	byName   map[string]*family
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{byName: map[string]*family{}}
+}
+
+func (r *Registry) add(f *family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.byName[f.name]; ok {
+		panic("metrics: " + f.name + " is registered twice")
+	}
+	r.families = append(r.families, f)
+	r.byName[f.name] = f
+}
+
+// Counter registers a counter, which Add increases.
+func (r *Registry) Counter(name, help string) {
+	r.add(&family{name: name, help: help, kind: "counter", samples: map[string]*Sample{}})
+}
+
+// GaugeFunc registers a gauge whose samples are collected by fn on every
+// scrape.
+func (r *Registry) GaugeFunc(name, help string, fn func() ([]Sample, error)) {
+	r.add(&family{name: name, help: help, kind: "gauge", collect: fn})
+}
+
+// Add increases the counter with the labels by v.
+func (r *Registry) Add(name string, labels Labels, v float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok := r.byName[name]
+	if !ok || f.kind != "counter" {
+		panic("metrics: " + name + " is not a registered counter")
+	}
+	key := formatLabels(labels)
+	s, ok := f.samples[key]
+	if !ok {
+		s = &Sample{Labels: labels}
+		f.samples[key] = s
+	}
+	s.Value += v
+}
+
+// Write writes every metric in the text exposition format. Gauges that fail
+// to collect are reported in the error and left out.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mu.Unlock()
+
+	var errs []string
+	for _, f := range families {
+		var samples []Sample
+		if f.collect != nil {
+			collected, err := f.collect()
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", f.name, err))
+				continue
+			}
+			samples = collected
+		} else {
+			r.mu.Lock()
+			for _, s := range f.samples {
+				samples = append(samples, *s)
+			}
+			r.mu.Unlock()
+		}
+
+		lines := make([]string, 0, len(samples))
+		for _, s := range samples {
+			lines = append(lines, f.name+formatLabels(s.Labels)+" "+strconv.FormatFloat(s.Value, 'g', -1, 64))
+		}
+		sort.Strings(lines)
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, l := range lines {
+			fmt.Fprintln(w, l)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("collecting %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// ServeHTTP serves the metrics, failing the scrape when a gauge cannot be
+// collected so that stale values are not mistaken for current ones.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var b strings.Builder
+	if err := r.Write(&b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	io.WriteString(w, b.String())
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + `="` + labelEscaper.Replace(labels[name]) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
@@ -0,0 +1,221 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The OTLP JSON encoding represents 64-bit integers as strings and ids as
+// hex, see https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding.
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	TimeUnixNano      string     `json:"timeUnixNano"`
+	AsInt             string     `json:"asInt,omitempty"`
+	Count             string     `json:"count,omitempty"`
+	Sum               *float64   `json:"sum,omitempty"`
+	BucketCounts      []string   `json:"bucketCounts,omitempty"`
+	ExplicitBounds    []float64  `json:"explicitBounds,omitempty"`
+}
+
+type otlpData struct {
+	// AggregationTemporality 2 is cumulative.
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic,omitempty"`
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpMetric struct {
+	Name      string    `json:"name"`
+	Unit      string    `json:"unit"`
+	Sum       *otlpData `json:"sum,omitempty"`
+	Histogram *otlpData `json:"histogram,omitempty"`
+}
+
+func attrs(in []Attr) []otlpAttr {
+	var out []otlpAttr
+	for _, a := range in {
+		var v otlpValue
+		switch value := a.Value.(type) {
+		case string:
+			v.StringValue = &value
+		case int:
+			s := strconv.Itoa(value)
+			v.IntValue = &s
+		case bool:
+			v.BoolValue = &value
+		default:
+			s := fmt.Sprint(value)
+			v.StringValue = &s
+		}
+		out = append(out, otlpAttr{Key: a.Key, Value: v})
+	}
+	return out
+}
+
+func nanos(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// Flush exports the finished spans and the current value of every metric.
+// Metrics are cumulative, so long-running commands can flush periodically.
+func Flush(c context.Context, client Doer) error {
+	r := global
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	spans := r.spans
+	r.spans = nil
+	now := time.Now()
+	var metrics []otlpMetric
+	for _, m := range r.sums {
+		metrics = append(metrics, otlpMetric{Name: m.name, Unit: "1", Sum: &otlpData{
+			AggregationTemporality: 2,
+			IsMonotonic:            true,
+			DataPoints: []otlpDataPoint{{
+				Attributes:        attrs(m.attrs),
+				StartTimeUnixNano: nanos(r.start),
+				TimeUnixNano:      nanos(now),
+				AsInt:             strconv.FormatInt(m.value, 10),
+			}},
+		}})
+	}
+	for _, h := range r.histograms {
+		sum := h.sum
+		point := otlpDataPoint{
+			Attributes:        attrs(h.attrs),
+			StartTimeUnixNano: nanos(r.start),
+			TimeUnixNano:      nanos(now),
+			Count:             strconv.FormatUint(h.count, 10),
+			Sum:               &sum,
+			ExplicitBounds:    LatencyBounds,
+		}
+		for _, b := range h.buckets {
+			point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(b, 10))
+		}
+		metrics = append(metrics, otlpMetric{Name: h.name, Unit: "ms", Histogram: &otlpData{
+			AggregationTemporality: 2,
+			DataPoints:             []otlpDataPoint{point},
+		}})
+	}
+	r.mu.Unlock()
+
+	resource := otlpResource{Attributes: attrs([]Attr{String("service.name", r.service)})}
+	scope := otlpScope{Name: "aws-vmcreate"}
+
+	if len(spans) > 0 {
+		var out []otlpSpan
+		for _, s := range spans {
+			span := otlpSpan{
+				TraceID:           hex.EncodeToString(s.traceID[:]),
+				SpanID:            hex.EncodeToString(s.spanID[:]),
+				Name:              s.name,
+				Kind:              s.kind,
+				StartTimeUnixNano: nanos(s.start),
+				EndTimeUnixNano:   nanos(s.end),
+				Attributes:        attrs(s.attrs),
+				Status:            otlpStatus{Code: 1},
+			}
+			if s.parentID != [8]byte{} {
+				span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+			}
+			if s.err != nil {
+				span.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+			}
+			out = append(out, span)
+		}
+		payload := map[string]interface{}{"resourceSpans": []interface{}{map[string]interface{}{
+			"resource":   resource,
+			"scopeSpans": []interface{}{map[string]interface{}{"scope": scope, "spans": out}},
+		}}}
+		if err := r.post(c, client, "/v1/traces", payload); err != nil {
+			return err
+		}
+	}
+
+	if len(metrics) > 0 {
+		payload := map[string]interface{}{"resourceMetrics": []interface{}{map[string]interface{}{
+			"resource":     resource,
+			"scopeMetrics": []interface{}{map[string]interface{}{"scope": scope, "metrics": metrics}},
+		}}}
+		if err := r.post(c, client, "/v1/metrics", payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *recorder) post(c context.Context, client Doer, path string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(c, http.MethodPost, r.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range r.headers {
+		req.Header.Set(k, v)
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %s: %s", r.endpoint+path, resp.Status, bytes.TrimSpace(data))
+	}
+	return nil
+}
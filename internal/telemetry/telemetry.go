@@ -0,0 +1,254 @@
+// Package telemetry records spans and metrics and exports them to an
+// OpenTelemetry collector with the OTLP/HTTP JSON encoding. It covers what
+// the tool needs without depending on the OpenTelemetry SDK modules.
+package telemetry
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Doer sends HTTP requests, like *http.Client and the AWS SDK HTTP client.
+type Doer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// Attr is a span or metric attribute. Values are strings, ints or bools.
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns a string attribute.
+func String(key, value string) Attr { return Attr{key, value} }
+
+// Int returns an integer attribute.
+func Int(key string, value int) Attr { return Attr{key, value} }
+
+// Bool returns a boolean attribute.
+func Bool(key string, value bool) Attr { return Attr{key, value} }
+
+// SpanKind values, as defined by OTLP.
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// LatencyBounds are the histogram bucket bounds, in milliseconds.
+var LatencyBounds = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+type recorder struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+	start    time.Time
+
+	mu         sync.Mutex
+	root       *Span
+	spans      []*Span
+	sums       map[string]*sum
+	histograms map[string]*histogram
+}
+
+type sum struct {
+	name  string
+	attrs []Attr
+	value int64
+}
+
+type histogram struct {
+	name    string
+	attrs   []Attr
+	count   uint64
+	sum     float64
+	buckets []uint64
+}
+
+// global is nil while telemetry is disabled, which makes every call a no-op.
+var global *recorder
+
+// Configure enables telemetry, exporting to the OTLP/HTTP base endpoint, e.g.
+// http://localhost:4318, with the headers on every request.
+func Configure(endpoint string, headers map[string]string, service string) {
+	global = &recorder{
+		endpoint:   strings.TrimRight(endpoint, "/"),
+		headers:    headers,
+		service:    service,
+		start:      time.Now(),
+		sums:       map[string]*sum{},
+		histograms: map[string]*histogram{},
+	}
+}
+
+// ConfigureFromEnv enables telemetry when OTEL_EXPORTER_OTLP_ENDPOINT is set,
+// honouring OTEL_EXPORTER_OTLP_HEADERS, OTEL_SERVICE_NAME and
+// OTEL_SDK_DISABLED like the OpenTelemetry SDKs. Only the http/json protocol
+// is supported.
+func ConfigureFromEnv() error {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if endpoint == "" || os.Getenv("OTEL_SDK_DISABLED") == "true" {
+		global = nil
+		return nil
+	}
+	if p := os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"); p != "" && p != "http/json" {
+		return fmt.Errorf("OTEL_EXPORTER_OTLP_PROTOCOL %s is not supported, use http/json", p)
+	}
+
+	headers := map[string]string{}
+	for _, h := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if strings.TrimSpace(h) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(h, "=")
+		if !ok {
+			return fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS entry %q is not KEY=VALUE", h)
+		}
+		headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "aws-vmcreate"
+	}
+	Configure(endpoint, headers, service)
+	return nil
+}
+
+// Enabled reports whether telemetry is being recorded.
+func Enabled() bool {
+	return global != nil
+}
+
+// Span is an operation being traced. A nil Span, returned while telemetry is
+// disabled, ignores every call.
+type Span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []Attr
+	err      error
+}
+
+type spanKey struct{}
+
+// Start begins a span as a child of the span in c or, when there is none, of
+// the command span.
+func Start(c context.Context, name string, kind int, attrs ...Attr) (context.Context, *Span) {
+	r := global
+	if r == nil {
+		return c, nil
+	}
+
+	s := &Span{name: name, kind: kind, start: time.Now(), attrs: attrs}
+	parent, _ := c.Value(spanKey{}).(*Span)
+	if parent == nil {
+		r.mu.Lock()
+		parent = r.root
+		r.mu.Unlock()
+	}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(c, spanKey{}, s), s
+}
+
+// StartCommand begins the span of a command run, which spans started without
+// a parent in their context become children of.
+func StartCommand(name string, attrs ...Attr) *Span {
+	_, s := Start(context.Background(), name, KindInternal, attrs...)
+	if s != nil {
+		global.mu.Lock()
+		global.root = s
+		global.mu.Unlock()
+	}
+	return s
+}
+
+// SetAttributes adds attributes to the span.
+func (s *Span) SetAttributes(attrs ...Attr) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, attrs...)
+}
+
+// End finishes the span, marking it as failed when err is not nil, and queues
+// it for export. Ending a span twice has no effect.
+func (s *Span) End(err error) {
+	r := global
+	if s == nil || r == nil || !s.end.IsZero() {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+	if r.root == s {
+		r.root = nil
+	}
+}
+
+// Count adds n to the counter with the attributes.
+func Count(name string, n int64, attrs ...Attr) {
+	r := global
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := metricKey(name, attrs)
+	m, ok := r.sums[key]
+	if !ok {
+		m = &sum{name: name, attrs: attrs}
+		r.sums[key] = m
+	}
+	m.value += n
+}
+
+// Record adds a latency in milliseconds to the histogram with the attributes.
+func Record(name string, ms float64, attrs ...Attr) {
+	r := global
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := metricKey(name, attrs)
+	h, ok := r.histograms[key]
+	if !ok {
+		h = &histogram{name: name, attrs: attrs, buckets: make([]uint64, len(LatencyBounds)+1)}
+		r.histograms[key] = h
+	}
+	h.count++
+	h.sum += ms
+	h.buckets[sort.SearchFloat64s(LatencyBounds, ms)]++
+}
+
+func metricKey(name string, attrs []Attr) string {
+	parts := []string{name}
+	for _, a := range attrs {
+		parts = append(parts, fmt.Sprintf("%s=%v", a.Key, a.Value))
+	}
+	sort.Strings(parts[1:])
+	return strings.Join(parts, "\x00")
+}
@@ -0,0 +1,131 @@
+package telemetry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestFlush(t *testing.T) {
+	var mu sync.Mutex
+	posted := map[string]map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer abc" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s has headers %v", r.URL.Path, r.Header)
+		}
+		data, _ := io.ReadAll(r.Body)
+		var payload map[string]interface{}
+		if err := json.Unmarshal(data, &payload); err != nil {
+			t.Errorf("%s: %v", r.URL.Path, err)
+		}
+		mu.Lock()
+		posted[r.URL.Path] = payload
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", server.URL+"/")
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "Authorization=Bearer abc")
+	if err := ConfigureFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { global = nil }()
+
+	root := StartCommand("aws-vmcreate create")
+	_, call := Start(context.Background(), "EC2.RunInstances", KindClient, String("rpc.method", "RunInstances"))
+	call.End(errors.New("InsufficientInstanceCapacity"))
+	root.End(nil)
+	Count("vmcreate.instances.created", 1)
+	Count("vmcreate.instances.created", 2)
+	Record("aws.api.latency", 30, String("rpc.method", "RunInstances"))
+	Record("aws.api.latency", 3000, String("rpc.method", "RunInstances"))
+
+	if err := Flush(context.TODO(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var traces struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	remarshal(t, posted["/v1/traces"], &traces)
+	spans := traces.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(spans))
+	}
+	child, parent := spans[0], spans[1]
+	if child.TraceID != parent.TraceID || child.ParentSpanID != parent.SpanID || parent.ParentSpanID != "" {
+		t.Errorf("the call is not a child of the command: %+v %+v", child, parent)
+	}
+	if child.Status.Code != 2 || child.Status.Message != "InsufficientInstanceCapacity" || parent.Status.Code != 1 {
+		t.Errorf("statuses %+v %+v", child.Status, parent.Status)
+	}
+
+	var metrics struct {
+		ResourceMetrics []struct {
+			ScopeMetrics []struct {
+				Metrics []otlpMetric `json:"metrics"`
+			} `json:"scopeMetrics"`
+		} `json:"resourceMetrics"`
+	}
+	remarshal(t, posted["/v1/metrics"], &metrics)
+	byName := map[string]otlpMetric{}
+	for _, m := range metrics.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		byName[m.Name] = m
+	}
+	if p := byName["vmcreate.instances.created"].Sum.DataPoints[0]; p.AsInt != "3" {
+		t.Errorf("instances created = %s, want 3", p.AsInt)
+	}
+	p := byName["aws.api.latency"].Histogram.DataPoints[0]
+	if p.Count != "2" || *p.Sum != 3030 || p.BucketCounts[3] != "1" || p.BucketCounts[9] != "1" {
+		t.Errorf("latency histogram %+v", p)
+	}
+
+	// Spans are only exported once, metrics every time.
+	posted = map[string]map[string]interface{}{}
+	if err := Flush(context.TODO(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := posted["/v1/traces"]; ok || posted["/v1/metrics"] == nil {
+		t.Errorf("second flush posted %v", posted)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	if err := ConfigureFromEnv(); err != nil || Enabled() {
+		t.Fatalf("enabled without an endpoint: %v", err)
+	}
+	c, span := Start(context.Background(), "noop", KindInternal)
+	span.SetAttributes(String("k", "v"))
+	span.End(nil)
+	Count("noop", 1)
+	if span != nil || c != context.Background() {
+		t.Error("recorded a span while disabled")
+	}
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4317")
+	t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", "grpc")
+	if err := ConfigureFromEnv(); err == nil {
+		t.Error("accepted the grpc protocol")
+	}
+}
+
+func remarshal(t *testing.T, in interface{}, out interface{}) {
+	t.Helper()
+	data, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,274 @@
+// Package yaml decodes the subset of YAML used by the tool's desired-state
+// and manifest files: block mappings and sequences, flow sequences of
+// scalars, quoted and plain scalars, and comments. Anchors, multi-line
+// scalars and multiple documents are not supported.
+//
+// Documents are converted to their JSON equivalent and decoded with
+// encoding/json, so destination types use json struct tags.
+package yaml
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Unmarshal decodes the YAML document in data into v.
+func Unmarshal(data []byte, v interface{}) error {
+	tree, err := Parse(data)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, v)
+}
+
+type line struct {
+	number int
+	indent int
+	text   string
+}
+
+type parser struct {
+	lines []line
+	pos   int
+}
+
+// Parse decodes data into maps, slices and scalars.
+func Parse(data []byte) (interface{}, error) {
+	p := &parser{}
+	for i, raw := range strings.Split(string(data), "\n") {
+		raw = strings.TrimRight(stripComment(raw), " \t\r")
+		if strings.TrimSpace(raw) == "" || raw == "---" {
+			continue
+		}
+		if strings.HasPrefix(strings.TrimLeft(raw, " "), "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		text := strings.TrimLeft(raw, " ")
+		p.lines = append(p.lines, line{number: i + 1, indent: len(raw) - len(text), text: text})
+	}
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+
+	value, err := p.parseBlock(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].number)
+	}
+	return value, nil
+}
+
+// stripComment removes a trailing "# comment" that is outside quotes.
+func stripComment(s string) string {
+	var quote rune
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+func (p *parser) parseBlock(indent int) (interface{}, error) {
+	if strings.HasPrefix(p.lines[p.pos].text, "- ") || p.lines[p.pos].text == "-" {
+		return p.parseSequence(indent)
+	}
+	return p.parseMapping(indent)
+}
+
+func (p *parser) parseSequence(indent int) (interface{}, error) {
+	items := []interface{}{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.number)
+		}
+		if !strings.HasPrefix(l.text, "- ") && l.text != "-" {
+			// A sequence at the same indentation as its key ends at the next key.
+			break
+		}
+
+		rest := strings.TrimSpace(strings.TrimPrefix(l.text, "-"))
+		switch {
+		case rest == "":
+			p.pos++
+			item, err := p.parseNested(indent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		case isMappingEntry(rest):
+			// "- key: value" starts a mapping indented to where the key begins.
+			itemIndent := indent + len(l.text) - len(rest)
+			p.lines[p.pos] = line{number: l.number, indent: itemIndent, text: rest}
+			item, err := p.parseMapping(itemIndent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		default:
+			p.pos++
+			item, err := parseScalar(rest, l.number)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func (p *parser) parseMapping(indent int) (interface{}, error) {
+	m := map[string]interface{}{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.number)
+		}
+		if !isMappingEntry(l.text) {
+			return nil, fmt.Errorf("line %d: expected KEY: VALUE", l.number)
+		}
+
+		key, rest := splitEntry(l.text)
+		key, err := unquote(key, l.number)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := m[key]; exists {
+			return nil, fmt.Errorf("line %d: duplicate key %q", l.number, key)
+		}
+		p.pos++
+
+		if rest == "" {
+			if m[key], err = p.parseNested(indent); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if m[key], err = parseScalar(rest, l.number); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// parseNested parses the block that follows a key or "-" with nothing after
+// it. Sequences may sit at the same indentation as their parent key.
+func (p *parser) parseNested(parentIndent int) (interface{}, error) {
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	next := p.lines[p.pos]
+	isItem := strings.HasPrefix(next.text, "- ") || next.text == "-"
+	if next.indent > parentIndent || (next.indent == parentIndent && isItem) {
+		return p.parseBlock(next.indent)
+	}
+	return nil, nil
+}
+
+// isMappingEntry reports whether s is "key:" or "key: value" outside quotes.
+func isMappingEntry(s string) bool {
+	key, _ := splitEntry(s)
+	return key != ""
+}
+
+func splitEntry(s string) (string, string) {
+	var quote rune
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			if i == 0 {
+				quote = r
+			}
+		case r == '[' || r == '{':
+			if i == 0 {
+				return "", ""
+			}
+		case r == ':' && (i == len(s)-1 || s[i+1] == ' '):
+			return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+		}
+	}
+	return "", ""
+}
+
+func unquote(s string, number int) (string, error) {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("line %d: %v", number, err)
+		}
+		return v, nil
+	}
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+	return s, nil
+}
+
+func parseScalar(s string, number int) (interface{}, error) {
+	if strings.HasPrefix(s, "[") {
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("line %d: unterminated flow sequence", number)
+		}
+		items := []interface{}{}
+		inner := strings.TrimSpace(s[1 : len(s)-1])
+		if inner == "" {
+			return items, nil
+		}
+		for _, part := range strings.Split(inner, ",") {
+			item, err := parseScalar(strings.TrimSpace(part), number)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	if s == "{}" {
+		return map[string]interface{}{}, nil
+	}
+	if s[0] == '"' || s[0] == '\'' {
+		return unquote(s, number)
+	}
+
+	switch s {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+	return s, nil
+}
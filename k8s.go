@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// K8sJoin holds what a new node needs to join a Kubernetes cluster at boot.
+type K8sJoin struct {
+	// Mode is "kubeadm" or "eks".
+	Mode     string
+	Endpoint string
+	// Token and CAHash are the kubeadm bootstrap token and discovery CA
+	// certificate hash.
+	Token  string
+	CAHash string
+	// ClusterName and CAData are the EKS cluster name and base64 encoded
+	// cluster CA certificate.
+	ClusterName string
+	CAData      string
+}
+
+func (j *K8sJoin) validate() error {
+	switch j.Mode {
+	case "kubeadm":
+		if j.Endpoint == "" || j.Token == "" || j.CAHash == "" {
+			return fmt.Errorf("kubeadm join needs -k8s-endpoint, -k8s-token and -k8s-ca-hash")
+		}
+	case "eks":
+		if j.ClusterName == "" {
+			return fmt.Errorf("eks join needs -k8s-cluster")
+		}
+	default:
+		return fmt.Errorf("unknown Kubernetes join mode %q, must be kubeadm or eks", j.Mode)
+	}
+	return nil
+}
+
+// k8sJoinUserData returns the boot script that joins the node to the cluster.
+func k8sJoinUserData(j *K8sJoin) string {
+	if j.Mode == "eks" {
+		// The EKS optimized AMIs ship the bootstrap script; the endpoint and
+		// CA are looked up from the cluster when they are not given.
+		args := []string{shellQuote(j.ClusterName)}
+		if j.Endpoint != "" {
+			args = append(args, "--apiserver-endpoint", shellQuote(j.Endpoint))
+		}
+		if j.CAData != "" {
+			args = append(args, "--b64-cluster-ca", shellQuote(j.CAData))
+		}
+		return "/etc/eks/bootstrap.sh " + strings.Join(args, " ") + "\n"
+	}
+
+	caHash := j.CAHash
+	if !strings.HasPrefix(caHash, "sha256:") {
+		caHash = "sha256:" + caHash
+	}
+	endpoint := strings.TrimPrefix(j.Endpoint, "https://")
+	return fmt.Sprintf("kubeadm join %s --token %s --discovery-token-ca-cert-hash %s\n",
+		shellQuote(endpoint), shellQuote(j.Token), shellQuote(caHash))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestK8sJoinValidate(t *testing.T) {
+	for _, tc := range []struct {
+		join K8sJoin
+		err  string
+	}{
+		{join: K8sJoin{Mode: "kubeadm", Endpoint: "10.0.0.10:6443", Token: "abcdef.0123456789abcdef", CAHash: "sha256:00"}},
+		{join: K8sJoin{Mode: "kubeadm", Endpoint: "10.0.0.10:6443"}, err: "kubeadm join needs"},
+		{join: K8sJoin{Mode: "eks", ClusterName: "prod"}},
+		{join: K8sJoin{Mode: "eks"}, err: "eks join needs -k8s-cluster"},
+		{join: K8sJoin{Mode: "k3s"}, err: `unknown Kubernetes join mode "k3s"`},
+	} {
+		err := tc.join.validate()
+		if (tc.err == "") != (err == nil) || err != nil && !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%+v: got %v, want %q", tc.join, err, tc.err)
+		}
+	}
+}
+
+func TestK8sJoinUserData(t *testing.T) {
+	for _, tc := range []struct {
+		join K8sJoin
+		want string
+	}{
+		{
+			join: K8sJoin{Mode: "kubeadm", Endpoint: "https://10.0.0.10:6443", Token: "abcdef.0123456789abcdef", CAHash: "1234"},
+			want: "kubeadm join '10.0.0.10:6443' --token 'abcdef.0123456789abcdef' --discovery-token-ca-cert-hash 'sha256:1234'\n",
+		},
+		{
+			join: K8sJoin{Mode: "kubeadm", Endpoint: "10.0.0.10:6443", Token: "t", CAHash: "sha256:1234"},
+			want: "kubeadm join '10.0.0.10:6443' --token 't' --discovery-token-ca-cert-hash 'sha256:1234'\n",
+		},
+		{
+			join: K8sJoin{Mode: "eks", ClusterName: "prod"},
+			want: "/etc/eks/bootstrap.sh 'prod'\n",
+		},
+		{
+			join: K8sJoin{Mode: "eks", ClusterName: "prod", Endpoint: "https://ABC.eks.amazonaws.com", CAData: "LS0t"},
+			want: "/etc/eks/bootstrap.sh 'prod' --apiserver-endpoint 'https://ABC.eks.amazonaws.com' --b64-cluster-ca 'LS0t'\n",
+		},
+	} {
+		if got := k8sJoinUserData(&tc.join); got != tc.want {
+			t.Errorf("%+v:\ngot  %q\nwant %q", tc.join, got, tc.want)
+		}
+	}
+}
+
+func TestCreateWithK8sJoin(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1"})
+
+	runCLI(t, "create", "--tag", "Name=node-1", "--k8s-join", "eks", "--k8s-cluster", "prod")
+
+	instances := fake.Instances()
+	if len(instances) != 1 {
+		t.Fatalf("launched %d instances", len(instances))
+	}
+	if userData := fake.UserData(*instances[0].InstanceId); !strings.Contains(userData, "/etc/eks/bootstrap.sh 'prod'\n") {
+		t.Errorf("user data:\n%s", userData)
+	}
+
+	// A join that is missing its settings launches nothing.
+	if _, stderr, code := runCLIExit(t, false, "create", "--tag", "Name=node-2", "--k8s-join", "kubeadm"); code != 1 || !strings.Contains(stderr, "kubeadm join needs") {
+		t.Errorf("exit code %d:\n%s", code, stderr)
+	}
+	if n := len(fake.Instances()); n != 1 {
+		t.Errorf("launched %d instances", n)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"aws-vmcreate/pkg/vmcreate"
+)
+
+// errInstanceLimit is returned when a launch would pass a configured cap.
+var errInstanceLimit = errors.New("instance limit reached")
+
+// InstanceLimits cap the live instances of the region, so that runaway
+// automation cannot launch hundreds of them. Zero is no cap.
+type InstanceLimits struct {
+	// MaxInstances caps the instances created by aws-vmcreate.
+	MaxInstances int `json:"max_instances,omitempty"`
+	// MaxInstancesPerTag caps the instances with the tag a create selects,
+	// or of one daemon group.
+	MaxInstancesPerTag int `json:"max_instances_per_tag,omitempty"`
+}
+
+// checkInstanceLimits returns an errInstanceLimit error when launching
+// adding more instances tagged tagKey=tagValue would pass a cap.
+func checkInstanceLimits(c context.Context, limits InstanceLimits, tagKey string, tagValue string, adding int) error {
+	live := vmcreate.StateFilter(vmcreate.LiveStates...)
+	if limits.MaxInstancesPerTag > 0 && tagKey != "" {
+		instances, err := provisioner.List(c, live, vmcreate.TagFilter(tagKey, tagValue))
+		if err != nil {
+			return err
+		}
+		if n := len(instances); n+adding > limits.MaxInstancesPerTag {
+			return fmt.Errorf("%w: %s=%s has %d live instances, %d more would pass max_instances_per_tag of %d",
+				errInstanceLimit, tagKey, tagValue, n, adding, limits.MaxInstancesPerTag)
+		}
+	}
+	if limits.MaxInstances > 0 {
+		instances, err := provisioner.List(c, live, vmcreate.TagKeyFilter(createdByTag))
+		if err != nil {
+			return err
+		}
+		if n := len(instances); n+adding > limits.MaxInstances {
+			return fmt.Errorf("%w: aws-vmcreate has %d live instances, %d more would pass max_instances of %d",
+				errInstanceLimit, n, adding, limits.MaxInstances)
+		}
+	}
+	return nil
+}
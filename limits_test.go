@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestCheckInstanceLimits(t *testing.T) {
+	fake := useFakeEC2(t)
+	tagged := func(key, value string) types.Instance {
+		return types.Instance{Tags: []types.Tag{
+			{Key: aws.String(createdByTag), Value: aws.String("arn:aws:iam::123456789012:user/tester")},
+			{Key: aws.String(key), Value: aws.String(value)},
+		}}
+	}
+	fake.AddInstance(tagged("env", "ci"))
+	fake.AddInstance(tagged("env", "ci"))
+	fake.AddInstance(tagged("env", "prod"))
+	c := context.Background()
+
+	for _, test := range []struct {
+		limits InstanceLimits
+		value  string
+		adding int
+		refuse bool
+	}{
+		{InstanceLimits{}, "ci", 100, false},
+		{InstanceLimits{MaxInstancesPerTag: 3}, "ci", 1, false},
+		{InstanceLimits{MaxInstancesPerTag: 3}, "ci", 2, true},
+		{InstanceLimits{MaxInstancesPerTag: 3}, "prod", 2, false},
+		{InstanceLimits{MaxInstances: 4}, "prod", 1, false},
+		{InstanceLimits{MaxInstances: 4}, "prod", 2, true},
+	} {
+		err := checkInstanceLimits(c, test.limits, "env", test.value, test.adding)
+		if refused := errors.Is(err, errInstanceLimit); refused != test.refuse || (err != nil && !refused) {
+			t.Errorf("%+v adding %d to env=%s: got %v", test.limits, test.adding, test.value, err)
+		}
+	}
+}
+
+func TestReconcileRespectsLimits(t *testing.T) {
+	fake := useFakeEC2(t)
+	state := &DesiredState{
+		Groups: []DesiredGroup{{Name: "web", Count: 5, InstanceType: "t3.micro", ImageId: "ami-web"}},
+		Config: ConfigMap{InstanceLimits: InstanceLimits{MaxInstancesPerTag: 3}},
+	}
+	if err := reconcile(context.Background(), state, false, false); !errors.Is(err, errInstanceLimit) {
+		t.Errorf("got %v, want the limit to refuse the launch", err)
+	}
+	if n := len(liveInstances(fake)); n != 0 {
+		t.Errorf("launched %d instances past the limit", n)
+	}
+}
+
+func TestEnvUpRespectsLimits(t *testing.T) {
+	fake := useFakeEC2(t)
+	manifest := writeManifest(t, `network:
+  cidr: 10.0.0.0/16
+instances:
+  - name: app
+    count: 2
+    instance_type: t3.small
+    image_id: ami-1
+  - name: db
+    instance_type: t3.medium
+    image_id: ami-2
+`)
+	config := ConfigMap{InstanceLimits: InstanceLimits{MaxInstances: 2}}
+	if _, err := envUp(context.Background(), &fakeNetwork{FakeEC2: fake}, nil, config, "pr-10", manifest, 0); !errors.Is(err, errInstanceLimit) {
+		t.Errorf("got %v, want the limit to refuse the environment", err)
+	}
+	if n := len(fake.Instances()); n != 0 {
+		t.Errorf("launched %d instances past the limit", n)
+	}
+	if state, err := loadEnvState("pr-10"); err != nil || state != nil {
+		t.Errorf("state = %+v, %v, want nothing created", state, err)
+	}
+}
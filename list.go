@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+var organizationsClient *awsapi.Organizations
+
+// OrganizationsAPI defines the interface for the ListAccounts function.
+// We use this interface to test the functions using a mocked service.
+type OrganizationsAPI interface {
+	ListAccounts(ctx context.Context, params *awsapi.ListAccountsInput) (*awsapi.ListAccountsOutput, error)
+}
+
+// provisionerFor returns a Provisioner using cfg, for listing other accounts
+// and regions.
+var provisionerFor = func(cfg aws.Config) *vmcreate.Provisioner {
+	return vmcreate.NewFromConfig(cfg)
+}
+
+// inventoryRow is an instance together with where it runs.
+type inventoryRow struct {
+	Account  string
+	Region   string
+	Instance types.Instance
+}
+
+// listAccounts returns the active accounts of the organization.
+func listAccounts(c context.Context, api OrganizationsAPI) ([]awsapi.Account, error) {
+	var accounts []awsapi.Account
+	input := &awsapi.ListAccountsInput{}
+	for {
+		page, err := api.ListAccounts(c, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range page.Accounts {
+			if a.Status == "ACTIVE" {
+				accounts = append(accounts, a)
+			}
+		}
+		if page.NextToken == "" {
+			return accounts, nil
+		}
+		input.NextToken = page.NextToken
+	}
+}
+
+// accountConfig returns the config for working in the account. The caller's
+// own account uses the current credentials; others assume roleName in them.
+func accountConfig(account awsapi.Account, callerAccount string, roleName string) aws.Config {
+	cfg := awsConfig.Copy()
+	if account.Id == "" || account.Id == callerAccount {
+		return cfg
+	}
+
+	partition := "aws"
+	if parts := strings.Split(account.Arn, ":"); len(parts) > 1 && parts[1] != "" {
+		partition = parts[1]
+	}
+	roleArn := "arn:" + partition + ":iam::" + account.Id + ":role/" + roleName
+	cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(awsConfig), roleArn, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = "aws-vmcreate-inventory"
+	}))
+	return cfg
+}
+
+// inventoryTarget is an account and region to list instances in. An empty
+// account ID is the caller's own account.
+type inventoryTarget struct {
+	Account awsapi.Account
+	Region  string
+}
+
+// accountTargets returns a target for every active account of the
+// organization in every region.
+func accountTargets(c context.Context, api OrganizationsAPI, regions []string) ([]inventoryTarget, error) {
+	accounts, err := listAccounts(c, api)
+	if err != nil {
+		return nil, fmt.Errorf("listing the organization's accounts: %w", err)
+	}
+
+	var targets []inventoryTarget
+	for _, account := range accounts {
+		for _, region := range regions {
+			targets = append(targets, inventoryTarget{Account: account, Region: region})
+		}
+	}
+	return targets, nil
+}
+
+// collectInventory lists the instances matching filters in every target, a
+// few at a time. A target that cannot be listed is reported in the errors
+// without affecting the others.
+func collectInventory(c context.Context, targets []inventoryTarget, callerAccount string, roleName string, filters []types.Filter) ([]inventoryRow, []error) {
+	var (
+		mu   sync.Mutex
+		rows []inventoryRow
+		errs []error
+	)
+	forEachConcurrently(len(targets), func(n int) {
+		target := targets[n]
+		cfg := accountConfig(target.Account, callerAccount, roleName)
+		cfg.Region = target.Region
+		instances, err := provisionerFor(cfg).List(c, filters...)
+
+		account := target.Account.Id
+		if account == "" {
+			account = callerAccount
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			where := target.Region
+			if target.Account.Id != "" {
+				where = "account " + target.Account.Id + " (" + target.Account.Name + ") in " + target.Region
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", where, err))
+		}
+		for _, i := range instances {
+			rows = append(rows, inventoryRow{Account: account, Region: target.Region, Instance: i})
+		}
+	})
+
+	sortInventory(rows)
+	return rows, errs
+}
+
+// forEachConcurrently calls fn for 0..n-1, at most eight calls at a time.
+func forEachConcurrently(n int, fn func(int)) {
+	var wg sync.WaitGroup
+	work := make(chan int)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+}
+
+// sortInventory orders rows by account, region and launch time.
+func sortInventory(rows []inventoryRow) {
+	sort.SliceStable(rows, func(a, b int) bool {
+		if rows[a].Account != rows[b].Account {
+			return rows[a].Account < rows[b].Account
+		}
+		if rows[a].Region != rows[b].Region {
+			return rows[a].Region < rows[b].Region
+		}
+		return aws.ToTime(rows[a].Instance.LaunchTime).Before(aws.ToTime(rows[b].Instance.LaunchTime))
+	})
+}
+
+// printInventory writes the rows as a table, with an account column when
+// they span accounts, or only their instance ids with --quiet.
+func printInventory(rows []inventoryRow, withAccount bool) {
+	if quiet {
+		for _, r := range rows {
+			fmt.Println(aws.ToString(r.Instance.InstanceId))
+		}
+		return
+	}
+	writeInventory(os.Stdout, rows, withAccount, nil)
+}
+
+// writeInventory writes the rows as a table. When previous, the states of
+// the last refresh keyed by instance id, is set, instances that changed state
+// or appeared since are highlighted with their old state.
+func writeInventory(out io.Writer, rows []inventoryRow, withAccount bool, previous map[string]string) {
+	var table bytes.Buffer
+	w := tabwriter.NewWriter(&table, 0, 0, 2, ' ', 0)
+	header := "REGION\tINSTANCE\tNAME\tSTATE\tTYPE\tPRIVATE IP\tLAUNCHED"
+	if withAccount {
+		header = "ACCOUNT\t" + header
+	}
+	fmt.Fprintln(w, header)
+
+	changed := map[int]bool{}
+	for n, r := range rows {
+		i := r.Instance
+		state := instanceState(&i)
+		if previous != nil {
+			if was, seen := previous[aws.ToString(i.InstanceId)]; !seen {
+				state, changed[n+1] = "new → "+state, true
+			} else if was != state {
+				state, changed[n+1] = was+" → "+state, true
+			}
+		}
+		line := strings.Join([]string{
+			r.Region,
+			aws.ToString(i.InstanceId),
+			vmcreate.TagValue(&i, "Name"),
+			state,
+			string(i.InstanceType),
+			aws.ToString(i.PrivateIpAddress),
+			aws.ToTime(i.LaunchTime).UTC().Format(time.RFC3339),
+		}, "\t")
+		if withAccount {
+			line = r.Account + "\t" + line
+		}
+		fmt.Fprintln(w, line)
+	}
+	w.Flush()
+
+	if len(changed) == 0 {
+		out.Write(table.Bytes())
+		return
+	}
+	for n, line := range strings.SplitAfter(table.String(), "\n") {
+		if changed[n] {
+			line = "\x1b[1;33m" + strings.TrimSuffix(line, "\n") + "\x1b[0m\n"
+		}
+		io.WriteString(out, line)
+	}
+}
+
+func instanceState(i *types.Instance) string {
+	if i.State == nil {
+		return ""
+	}
+	return string(i.State.Name)
+}
+
+// inventoryLister returns the rows to show, the errors of the targets that
+// could not be listed, and the totals printed after the table.
+type inventoryLister func() ([]inventoryRow, []error, string)
+
+// watchInventory prints the inventory every interval in place, until
+// interrupted.
+func watchInventory(list inventoryLister, withAccount bool, interval time.Duration) {
+	var previous map[string]string
+	for {
+		rows, errs, summary := list()
+		var screen bytes.Buffer
+		fmt.Fprintf(&screen, "\x1b[H\x1b[2JEvery %s, updated %s\n\n", interval, time.Now().Format("15:04:05"))
+		for _, err := range errs {
+			fmt.Fprintln(&screen, "Got an error listing instances:")
+			fmt.Fprintln(&screen, err)
+		}
+		writeInventory(&screen, rows, withAccount, previous)
+		screen.WriteString(summary)
+		os.Stdout.Write(screen.Bytes())
+
+		previous = map[string]string{}
+		for _, r := range rows {
+			previous[aws.ToString(r.Instance.InstanceId)] = instanceState(&r.Instance)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func ListInstancesCmd(name *string, value *string, regions []string, allAccounts *bool, accountRole *string, watch *bool, interval *time.Duration) {
+	states := vmcreate.LiveStates
+	if *watch {
+		// Instances being drained stay in the table until they are gone.
+		states = append(append([]string(nil), states...), "shutting-down")
+	}
+	filters := []types.Filter{vmcreate.StateFilter(states...)}
+	if *name != "" && *value != "" {
+		filters = append(filters, vmcreate.TagFilter(*name, strings.Split(*value, ",")...))
+	} else if *name != "" {
+		filters = append(filters, vmcreate.TagKeyFilter(*name))
+	}
+
+	// show prints the rows once, or keeps refreshing them with --watch.
+	show := func(list inventoryLister, withAccount bool) {
+		if *watch {
+			watchInventory(list, withAccount, *interval)
+			return
+		}
+		rows, errs, summary := list()
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, "Got an error listing instances:")
+			fmt.Fprintln(os.Stderr, err)
+		}
+		printInventory(rows, withAccount)
+		fmt.Fprint(diagnostics, summary)
+	}
+
+	if !*allAccounts && len(regions) == 0 {
+		if !*watch {
+			instances, err := provisioner.List(context.TODO(), filters...)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Got an error listing the instances:")
+				fmt.Fprintln(os.Stderr, err)
+				commandErr = err
+				return
+			}
+			printInventory(regionRows(instances), false)
+			return
+		}
+		show(func() ([]inventoryRow, []error, string) {
+			instances, err := provisioner.List(context.TODO(), filters...)
+			if err != nil {
+				return nil, []error{err}, ""
+			}
+			return regionRows(instances), nil, ""
+		}, false)
+		return
+	}
+
+	if len(regions) == 0 {
+		regions = []string{awsConfig.Region}
+	}
+	var targets []inventoryTarget
+	callerAccount := ""
+	if *allAccounts {
+		identity, err := sts.NewFromConfig(awsConfig).GetCallerIdentity(context.TODO(), &sts.GetCallerIdentityInput{})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error identifying the current account:")
+			fmt.Fprintln(os.Stderr, err)
+			commandErr = err
+			return
+		}
+		callerAccount = aws.ToString(identity.Account)
+
+		if targets, err = accountTargets(context.TODO(), organizationsClient, regions); err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error listing instances:")
+			fmt.Fprintln(os.Stderr, err)
+			commandErr = err
+			return
+		}
+	} else {
+		for _, region := range regions {
+			targets = append(targets, inventoryTarget{Region: region})
+		}
+	}
+
+	show(func() ([]inventoryRow, []error, string) {
+		rows, errs := collectInventory(context.TODO(), targets, callerAccount, *accountRole, filters)
+		if *allAccounts {
+			return rows, errs, fmt.Sprintf("%d instances in %d accounts\n", len(rows), countAccounts(rows))
+		}
+		return rows, errs, fmt.Sprintf("%d instances in %d regions\n", len(rows), len(regions))
+	}, *allAccounts)
+}
+
+// regionRows returns the instances of the default region as inventory rows.
+func regionRows(instances []types.Instance) []inventoryRow {
+	var rows []inventoryRow
+	for _, i := range instances {
+		rows = append(rows, inventoryRow{Region: awsConfig.Region, Instance: i})
+	}
+	return rows
+}
+
+func countAccounts(rows []inventoryRow) int {
+	seen := map[string]bool{}
+	for _, r := range rows {
+		seen[r.Account] = true
+	}
+	return len(seen)
+}
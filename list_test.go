@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"aws-vmcreate/internal/awsapi"
+	"aws-vmcreate/pkg/vmcreate"
+	"aws-vmcreate/pkg/vmcreate/vmcreatetest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+type fakeOrganizations struct {
+	pages []awsapi.ListAccountsOutput
+}
+
+func (f *fakeOrganizations) ListAccounts(ctx context.Context, params *awsapi.ListAccountsInput) (*awsapi.ListAccountsOutput, error) {
+	page := 0
+	if params.NextToken != "" {
+		page = len(params.NextToken)
+	}
+	return &f.pages[page], nil
+}
+
+func TestListCommand(t *testing.T) {
+	fake := useFakeEC2(t)
+	web := fake.AddInstance(tagged("Name", "web-1"))
+	fake.AddInstance(tagged("Name", "db"))
+	gone := fake.AddInstance(tagged("Name", "web-2"))
+	fake.TerminateInstances(context.Background(), &ec2.TerminateInstancesInput{InstanceIds: []string{gone}})
+
+	out := runCLI(t, "list", "--tag", "Name=web-1,web-2")
+	if !strings.Contains(out, web) || strings.Contains(out, gone) || strings.Contains(out, "db") {
+		t.Errorf("output:\n%s", out)
+	}
+	if strings.Contains(out, "ACCOUNT") {
+		t.Errorf("single account listing has an account column:\n%s", out)
+	}
+}
+
+func TestAccountInventory(t *testing.T) {
+	self := vmcreatetest.NewFakeEC2()
+	self.AddInstance(tagged("Name", "tooling"))
+
+	previous := provisionerFor
+	defer func() { provisionerFor = previous }()
+	provisionerFor = func(cfg aws.Config) *vmcreate.Provisioner {
+		if cfg.Credentials == awsConfig.Credentials {
+			return vmcreate.New(self)
+		}
+		denied := vmcreatetest.NewFakeEC2()
+		denied.Fail("DescribeInstances", errors.New("AccessDenied"))
+		return vmcreate.New(denied)
+	}
+
+	orgs := &fakeOrganizations{pages: []awsapi.ListAccountsOutput{
+		{Accounts: []awsapi.Account{{Id: "111111111111", Name: "tooling", Status: "ACTIVE"}}, NextToken: "x"},
+		{Accounts: []awsapi.Account{
+			{Id: "222222222222", Name: "member", Arn: "arn:aws:organizations::111111111111:account/o-1/222222222222", Status: "ACTIVE"},
+			{Id: "333333333333", Name: "closed", Status: "SUSPENDED"},
+		}},
+	}}
+
+	targets, err := accountTargets(context.Background(), orgs, []string{"us-east-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, errs := collectInventory(context.Background(), targets, "111111111111", "OrganizationAccountAccessRole", nil)
+	if len(rows) != 1 || rows[0].Account != "111111111111" {
+		t.Errorf("rows = %+v", rows)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "222222222222") {
+		t.Errorf("errs = %v, want only the member account to fail", errs)
+	}
+}
+
+func TestSortInventory(t *testing.T) {
+	rows := []inventoryRow{
+		{Account: "2", Region: "us-east-1", Instance: types.Instance{InstanceId: aws.String("c")}},
+		{Account: "1", Region: "us-west-2", Instance: types.Instance{InstanceId: aws.String("b")}},
+		{Account: "1", Region: "eu-west-1", Instance: types.Instance{InstanceId: aws.String("a")}},
+	}
+	sortInventory(rows)
+	var got []string
+	for _, r := range rows {
+		got = append(got, aws.ToString(r.Instance.InstanceId))
+	}
+	if strings.Join(got, "") != "abc" {
+		t.Errorf("order = %v", got)
+	}
+}
+
+func TestWriteInventoryHighlightsTransitions(t *testing.T) {
+	state := func(id string, name types.InstanceStateName) inventoryRow {
+		return inventoryRow{Region: "us-east-1", Instance: types.Instance{InstanceId: aws.String(id), State: &types.InstanceState{Name: name}}}
+	}
+	rows := []inventoryRow{
+		state("i-same", types.InstanceStateNameRunning),
+		state("i-up", types.InstanceStateNameRunning),
+		state("i-new", types.InstanceStateNamePending),
+	}
+
+	var plain strings.Builder
+	writeInventory(&plain, rows, false, nil)
+	if strings.Contains(plain.String(), "\x1b[") {
+		t.Errorf("the first refresh is highlighted:\n%s", plain.String())
+	}
+
+	var out strings.Builder
+	writeInventory(&out, rows, false, map[string]string{"i-same": "running", "i-up": "pending"})
+	lines := strings.Split(out.String(), "\n")
+	if strings.Contains(lines[1], "\x1b[") {
+		t.Errorf("an unchanged instance is highlighted: %q", lines[1])
+	}
+	if !strings.HasPrefix(lines[2], "\x1b[1;33m") || !strings.Contains(lines[2], "pending → running") {
+		t.Errorf("the transition is not highlighted: %q", lines[2])
+	}
+	if !strings.Contains(lines[3], "new → pending") {
+		t.Errorf("the new instance is not highlighted: %q", lines[3])
+	}
+}
+
+func TestListAcrossRegions(t *testing.T) {
+	fakes := useRegionFakes(t, "us-east-1", "eu-west-1")
+	east := fakes["us-east-1"].AddInstance(tagged("env", "prod"))
+	west := fakes["eu-west-1"].AddInstance(tagged("env", "prod"))
+
+	out := runCLI(t, "list", "--tag", "env=prod", "--regions", "us-east-1,eu-west-1,ap-south-1")
+	if !strings.Contains(out, east) || !strings.Contains(out, west) {
+		t.Errorf("output is missing instances:\n%s", out)
+	}
+	if !strings.Contains(out, "ap-south-1") || !strings.Contains(out, "2 instances in 3 regions") {
+		t.Errorf("output does not report the failed region:\n%s", out)
+	}
+	if strings.Index(out, west) > strings.Index(out, east) {
+		t.Errorf("regions are not sorted:\n%s", out)
+	}
+}
+
+func TestDeleteAcrossRegions(t *testing.T) {
+	fakes := useRegionFakes(t, "us-east-1", "eu-west-1")
+	east := fakes["us-east-1"].AddInstance(tagged("env", "ci"))
+	west := fakes["eu-west-1"].AddInstance(tagged("env", "ci"))
+	kept := fakes["eu-west-1"].AddInstance(tagged("env", "prod"))
+
+	out := runCLI(t, "delete", "--tag", "env=ci", "--regions", "us-east-1,eu-west-1,ap-south-1")
+
+	for region, id := range map[string]string{"us-east-1": east, "eu-west-1": west} {
+		if state := fakes[region].Instance(id).State.Name; state != types.InstanceStateNameTerminated {
+			t.Errorf("%s in %s is %s\n%s", id, region, state, out)
+		}
+	}
+	if state := fakes["eu-west-1"].Instance(kept).State.Name; state != types.InstanceStateNameRunning {
+		t.Errorf("untagged %s is %s", kept, state)
+	}
+	if !strings.Contains(out, "[ap-south-1] Got an error terminating the instances:") {
+		t.Errorf("output does not isolate the failed region:\n%s", out)
+	}
+}
+
+func TestARNRegion(t *testing.T) {
+	arn := "arn:aws:elasticloadbalancing:eu-west-1:111122223333:targetgroup/web/abc"
+	if got := arnRegion(arn); got != "eu-west-1" {
+		t.Errorf("arnRegion = %q", got)
+	}
+	if got := arnRegion("not-an-arn"); got != "" {
+		t.Errorf("arnRegion of garbage = %q", got)
+	}
+}
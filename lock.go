@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+)
+
+// DynamoDBLockAPI defines the interface for the DynamoDB functions of the fleet lock.
+// We use this interface to test the functions using a mocked service.
+type DynamoDBLockAPI interface {
+	GetItem(ctx context.Context, params *awsapi.GetItemInput) (*awsapi.GetItemOutput, error)
+	PutItem(ctx context.Context, params *awsapi.PutItemInput) error
+	DeleteItem(ctx context.Context, params *awsapi.DeleteItemInput) error
+}
+
+// S3LockAPI defines the interface for the S3 functions of the fleet lock.
+// We use this interface to test the functions using a mocked service.
+type S3LockAPI interface {
+	PutObjectIfAbsent(ctx context.Context, bucket, key string, body []byte) error
+	GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, int64, error)
+	DeleteObject(ctx context.Context, bucket, key string) error
+}
+
+var dynamoDBClient *awsapi.DynamoDB
+
+// fleetLock keeps two machines, e.g. two CI pipelines, from changing the same
+// fleet at once. Locks are keyed by the tag group they cover, e.g. env=ci, and
+// expire after their ttl so that a crashed holder does not block the fleet.
+type fleetLock interface {
+	Acquire(c context.Context, key string, owner string, ttl time.Duration) error
+	Release(c context.Context, key string, owner string) error
+	// Break releases the lock whoever holds it, for state unlock to free a
+	// fleet whose holder died.
+	Break(c context.Context, key string) error
+}
+
+// errLockHeld is wrapped by Acquire when another owner holds the lock.
+var errLockHeld = errors.New("the fleet is locked")
+
+// lockRecord is what a lock holds: who took it and until when.
+type lockRecord struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// dynamoDBLock keeps locks as items of a table whose partition key is the
+// string LockKey, taken with a conditional PutItem.
+type dynamoDBLock struct {
+	api   DynamoDBLockAPI
+	table string
+}
+
+func (l *dynamoDBLock) Acquire(c context.Context, key string, owner string, ttl time.Duration) error {
+	now := time.Now()
+	err := l.api.PutItem(c, &awsapi.PutItemInput{
+		TableName: l.table,
+		Item: map[string]awsapi.AttributeValue{
+			"LockKey": {S: key},
+			"Owner":   {S: owner},
+			"Expires": {N: strconv.FormatInt(now.Add(ttl).Unix(), 10)},
+		},
+		ConditionExpression:      "attribute_not_exists(LockKey) OR Expires < :now OR #owner = :owner",
+		ExpressionAttributeNames: map[string]string{"#owner": "Owner"},
+		ExpressionAttributeValues: map[string]awsapi.AttributeValue{
+			":now":   {N: strconv.FormatInt(now.Unix(), 10)},
+			":owner": {S: owner},
+		},
+	})
+	var apiErr *awsapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != "ConditionalCheckFailedException" {
+		return err
+	}
+
+	held, err := l.api.GetItem(c, &awsapi.GetItemInput{
+		TableName:      l.table,
+		Key:            map[string]awsapi.AttributeValue{"LockKey": {S: key}},
+		ConsistentRead: true,
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %s", errLockHeld, key)
+	}
+	expires, _ := strconv.ParseInt(held.Item["Expires"].N, 10, 64)
+	return fmt.Errorf("%w: %s is held by %s until %s", errLockHeld, key, held.Item["Owner"].S, time.Unix(expires, 0).UTC().Format(time.RFC3339))
+}
+
+func (l *dynamoDBLock) Release(c context.Context, key string, owner string) error {
+	err := l.api.DeleteItem(c, &awsapi.DeleteItemInput{
+		TableName:                 l.table,
+		Key:                       map[string]awsapi.AttributeValue{"LockKey": {S: key}},
+		ConditionExpression:       "#owner = :owner",
+		ExpressionAttributeNames:  map[string]string{"#owner": "Owner"},
+		ExpressionAttributeValues: map[string]awsapi.AttributeValue{":owner": {S: owner}},
+	})
+	// The lock expired and was taken by someone else, who will release it.
+	var apiErr *awsapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == "ConditionalCheckFailedException" {
+		return nil
+	}
+	return err
+}
+
+func (l *dynamoDBLock) Break(c context.Context, key string) error {
+	return l.api.DeleteItem(c, &awsapi.DeleteItemInput{
+		TableName: l.table,
+		Key:       map[string]awsapi.AttributeValue{"LockKey": {S: key}},
+	})
+}
+
+// s3Lock keeps locks as objects under a prefix, taken with a conditional
+// PutObject that fails when the object exists.
+type s3Lock struct {
+	api    S3LockAPI
+	bucket string
+	prefix string
+}
+
+func (l *s3Lock) objectKey(key string) string {
+	return l.prefix + key + ".lock"
+}
+
+// read returns the record of the lock, or nil when the lock is not held.
+func (l *s3Lock) read(c context.Context, key string) (*lockRecord, error) {
+	body, _, err := l.api.GetObject(c, l.bucket, l.objectKey(key))
+	var apiErr *awsapi.Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode == 404 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	record := &lockRecord{}
+	if err := json.NewDecoder(body).Decode(record); err != nil {
+		return nil, fmt.Errorf("reading the lock %s: %w", key, err)
+	}
+	return record, nil
+}
+
+func (l *s3Lock) Acquire(c context.Context, key string, owner string, ttl time.Duration) error {
+	body, err := json.Marshal(lockRecord{Owner: owner, Expires: time.Now().Add(ttl).UTC()})
+	if err != nil {
+		return err
+	}
+	// An expired lock, or one this process left behind, is deleted and taken
+	// once; losing that race to another owner leaves the lock held by them.
+	for attempt := 0; attempt < 2; attempt++ {
+		err := l.api.PutObjectIfAbsent(c, l.bucket, l.objectKey(key), body)
+		var apiErr *awsapi.Error
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != 412 {
+			return err
+		}
+
+		held, err := l.read(c, key)
+		if err != nil {
+			return err
+		}
+		if held == nil {
+			continue
+		}
+		if held.Owner != owner && time.Now().Before(held.Expires) {
+			return fmt.Errorf("%w: %s is held by %s until %s", errLockHeld, key, held.Owner, held.Expires.Format(time.RFC3339))
+		}
+		if err := l.api.DeleteObject(c, l.bucket, l.objectKey(key)); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: %s", errLockHeld, key)
+}
+
+func (l *s3Lock) Release(c context.Context, key string, owner string) error {
+	held, err := l.read(c, key)
+	if err != nil || held == nil || held.Owner != owner {
+		return err
+	}
+	return l.api.DeleteObject(c, l.bucket, l.objectKey(key))
+}
+
+func (l *s3Lock) Break(c context.Context, key string) error {
+	return l.api.DeleteObject(c, l.bucket, l.objectKey(key))
+}
+
+// newFleetLock returns the lock described by spec, dynamodb://TABLE or
+// s3://BUCKET/PREFIX, or nil when spec is empty.
+func newFleetLock(spec string) (fleetLock, error) {
+	scheme, location, ok := strings.Cut(spec, "://")
+	switch {
+	case spec == "":
+		return nil, nil
+	case ok && scheme == "dynamodb" && location != "":
+		return &dynamoDBLock{api: dynamoDBClient, table: location}, nil
+	case ok && scheme == "s3" && location != "":
+		bucket, prefix, _ := strings.Cut(location, "/")
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		return &s3Lock{api: s3Client, bucket: bucket, prefix: prefix}, nil
+	}
+	return nil, fmt.Errorf("the lock must be dynamodb://TABLE or s3://BUCKET/PREFIX, not %q", spec)
+}
+
+// The fleet lock of the command, set up by main from --lock or the lock of
+// data/config.json. fleetLocker is nil when no lock is configured.
+var (
+	fleetLocker  fleetLock
+	lockTTL      = 30 * time.Minute
+	lockWait     time.Duration
+	lockInterval = 5 * time.Second
+	heldLocks    []string
+)
+
+// lockOwner identifies this process in the locks it holds.
+func lockOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// acquireFleetLock takes the lock of the tag group KEY=VALUE, waiting up to
+// lockWait for another holder to release it. Held locks are released by
+// releaseFleetLocks when the command ends.
+func acquireFleetLock(c context.Context, key string) error {
+	if fleetLocker == nil {
+		return nil
+	}
+	deadline := time.Now().Add(lockWait)
+	for {
+		err := fleetLocker.Acquire(c, key, lockOwner(), lockTTL)
+		if err == nil {
+			heldLocks = append(heldLocks, key)
+			return nil
+		}
+		if !errors.Is(err, errLockHeld) || !time.Now().Add(lockInterval).Before(deadline) {
+			return err
+		}
+		select {
+		case <-c.Done():
+			return err
+		case <-time.After(lockInterval):
+		}
+	}
+}
+
+// releaseFleetLock releases the lock of the tag group if this process holds it.
+func releaseFleetLock(c context.Context, key string) {
+	for i, held := range heldLocks {
+		if held != key {
+			continue
+		}
+		heldLocks = append(heldLocks[:i], heldLocks[i+1:]...)
+		if err := fleetLocker.Release(c, key, lockOwner()); err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error releasing the lock of "+key+":")
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return
+	}
+}
+
+// releaseFleetLocks releases every lock this process still holds.
+func releaseFleetLocks() {
+	for len(heldLocks) > 0 {
+		releaseFleetLock(context.TODO(), heldLocks[0])
+	}
+}
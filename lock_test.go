@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+)
+
+// fakeDynamoDB keeps items in memory and evaluates the lock's condition
+// expressions by hand.
+type fakeDynamoDB struct {
+	items map[string]map[string]awsapi.AttributeValue
+}
+
+var errConditionalCheck = &awsapi.Error{StatusCode: 400, Code: "ConditionalCheckFailedException"}
+
+func (f *fakeDynamoDB) GetItem(ctx context.Context, params *awsapi.GetItemInput) (*awsapi.GetItemOutput, error) {
+	return &awsapi.GetItemOutput{Item: f.items[params.Key["LockKey"].S]}, nil
+}
+
+func (f *fakeDynamoDB) PutItem(ctx context.Context, params *awsapi.PutItemInput) error {
+	key := params.Item["LockKey"].S
+	if held, ok := f.items[key]; ok {
+		expires, _ := strconv.ParseInt(held["Expires"].N, 10, 64)
+		now, _ := strconv.ParseInt(params.ExpressionAttributeValues[":now"].N, 10, 64)
+		if expires >= now && held["Owner"].S != params.ExpressionAttributeValues[":owner"].S {
+			return errConditionalCheck
+		}
+	}
+	f.items[key] = params.Item
+	return nil
+}
+
+func (f *fakeDynamoDB) DeleteItem(ctx context.Context, params *awsapi.DeleteItemInput) error {
+	key := params.Key["LockKey"].S
+	if f.items[key]["Owner"].S != params.ExpressionAttributeValues[":owner"].S {
+		return errConditionalCheck
+	}
+	delete(f.items, key)
+	return nil
+}
+
+// fakeS3Lock keeps objects in memory and honours If-None-Match.
+type fakeS3Lock struct {
+	objects map[string][]byte
+}
+
+func (f *fakeS3Lock) PutObjectIfAbsent(ctx context.Context, bucket, key string, body []byte) error {
+	if _, ok := f.objects[key]; ok {
+		return &awsapi.Error{StatusCode: 412, Code: "PreconditionFailed"}
+	}
+	f.objects[key] = body
+	return nil
+}
+
+func (f *fakeS3Lock) GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, int64, error) {
+	body, ok := f.objects[key]
+	if !ok {
+		return nil, 0, &awsapi.Error{StatusCode: 404, Code: "NoSuchKey"}
+	}
+	return io.NopCloser(bytes.NewReader(body)), int64(len(body)), nil
+}
+
+func (f *fakeS3Lock) DeleteObject(ctx context.Context, bucket, key string) error {
+	delete(f.objects, key)
+	return nil
+}
+
+func TestFleetLocks(t *testing.T) {
+	for name, lock := range map[string]fleetLock{
+		"dynamodb": &dynamoDBLock{api: &fakeDynamoDB{items: map[string]map[string]awsapi.AttributeValue{}}, table: "locks"},
+		"s3":       &s3Lock{api: &fakeS3Lock{objects: map[string][]byte{}}, bucket: "locks", prefix: "fleet/"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := context.Background()
+			if err := lock.Acquire(c, "env=ci", "pipeline-1", time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			if err := lock.Acquire(c, "env=ci", "pipeline-2", time.Hour); !errors.Is(err, errLockHeld) {
+				t.Fatalf("second owner got %v, want the lock held", err)
+			}
+			if err := lock.Acquire(c, "env=prod", "pipeline-2", time.Hour); err != nil {
+				t.Fatalf("another group: %v", err)
+			}
+			if err := lock.Acquire(c, "env=ci", "pipeline-1", time.Hour); err != nil {
+				t.Fatalf("the holder taking it again: %v", err)
+			}
+
+			// Someone else's release leaves the lock alone.
+			if err := lock.Release(c, "env=ci", "pipeline-2"); err != nil {
+				t.Fatal(err)
+			}
+			if err := lock.Acquire(c, "env=ci", "pipeline-2", time.Hour); !errors.Is(err, errLockHeld) {
+				t.Fatalf("after a foreign release got %v, want the lock held", err)
+			}
+			if err := lock.Release(c, "env=ci", "pipeline-1"); err != nil {
+				t.Fatal(err)
+			}
+			// An expired lock is taken over.
+			if err := lock.Acquire(c, "env=ci", "pipeline-2", -time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			if err := lock.Acquire(c, "env=ci", "pipeline-3", time.Hour); err != nil {
+				t.Fatalf("taking over an expired lock: %v", err)
+			}
+		})
+	}
+}
+
+func TestNewFleetLock(t *testing.T) {
+	lock, err := newFleetLock("s3://locks-bucket/aws-vmcreate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := lock.(*s3Lock); l.bucket != "locks-bucket" || l.objectKey("env=ci") != "aws-vmcreate/env=ci.lock" {
+		t.Errorf("got bucket %s, key %s", l.bucket, l.objectKey("env=ci"))
+	}
+	if _, err := newFleetLock("redis://localhost"); err == nil {
+		t.Error("expected an error for an unknown lock")
+	}
+}
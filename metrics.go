@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"aws-vmcreate/internal/metrics"
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// metricsRegistry holds the metrics the daemon and the API server expose on
+// /metrics.
+var metricsRegistry = newMetricsRegistry()
+
+// metricsTagKey is the tag that selects the managed instances counted by the
+// vmcreate_instances gauge and labels them with its value.
+var metricsTagKey = groupTag
+
+func newMetricsRegistry() *metrics.Registry {
+	r := metrics.NewRegistry()
+	r.GaugeFunc("vmcreate_instances", "Managed instances by state, instance type and tag value.", collectInstances)
+	r.Counter("vmcreate_reconcile_runs_total", "Daemon reconcile runs.")
+	r.Counter("vmcreate_reconcile_actions_total", "Instances launched, terminated and retagged by the daemon, by group and action.")
+	r.Counter("vmcreate_reconcile_errors_total", "Groups that failed to reconcile.")
+	r.Counter("vmcreate_api_requests_total", "API server requests by method and status code.")
+	return r
+}
+
+// collectInstances counts the managed instances when /metrics is scraped.
+func collectInstances() ([]metrics.Sample, error) {
+	c, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	instances, err := provisioner.List(c, vmcreate.TagKeyFilter(metricsTagKey))
+	if err != nil {
+		return nil, err
+	}
+
+	type key struct{ state, instanceType, tag string }
+	counts := map[key]int{}
+	for _, i := range instances {
+		if i.State == nil || i.State.Name == types.InstanceStateNameTerminated {
+			continue
+		}
+		counts[key{string(i.State.Name), string(i.InstanceType), vmcreate.TagValue(&i, metricsTagKey)}]++
+	}
+
+	var samples []metrics.Sample
+	for k, n := range counts {
+		samples = append(samples, metrics.Sample{
+			Labels: metrics.Labels{"state": k.state, "instance_type": k.instanceType, "tag": k.tag},
+			Value:  float64(n),
+		})
+	}
+	return samples, nil
+}
+
+// countRequests counts the requests served by h.
+func countRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		metricsRegistry.Add("vmcreate_api_requests_total", metrics.Labels{"method": r.Method, "code": strconv.Itoa(rec.status)}, 1)
+	})
+}
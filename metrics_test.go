@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDaemonMetrics(t *testing.T) {
+	fake := useFakeEC2(t)
+	previous := metricsRegistry
+	metricsRegistry = newMetricsRegistry()
+	t.Cleanup(func() { metricsRegistry = previous })
+
+	state := &DesiredState{Groups: []DesiredGroup{
+		{Name: "web", Count: 2, InstanceType: "t3.micro", ImageId: "ami-web"},
+		{Name: "db", Count: 1, InstanceType: "r5.large", ImageId: "ami-db"},
+	}}
+	if err := reconcile(context.Background(), state, false, false); err != nil {
+		t.Fatal(err)
+	}
+	state.Groups[0].Count = 1
+	fake.Fail("RunInstances", errors.New("InsufficientInstanceCapacity"))
+	state.Groups = append(state.Groups, DesiredGroup{Name: "cache", Count: 1, InstanceType: "t3.micro", ImageId: "ami-cache"})
+	reconcile(context.Background(), state, false, false)
+
+	var out strings.Builder
+	if err := metricsRegistry.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# TYPE vmcreate_instances gauge",
+		`vmcreate_instances{instance_type="t3.micro",state="running",tag="web"} 1`,
+		`vmcreate_instances{instance_type="r5.large",state="running",tag="db"} 1`,
+		`vmcreate_reconcile_actions_total{action="launch",group="web"} 2`,
+		`vmcreate_reconcile_actions_total{action="terminate",group="web"} 1`,
+		`vmcreate_reconcile_errors_total{group="cache"} 1`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics are missing %s:\n%s", want, out.String())
+		}
+	}
+
+	fake.Fail("DescribeInstances", errors.New("RequestLimitExceeded"))
+	if err := metricsRegistry.Write(&strings.Builder{}); err == nil {
+		t.Error("a failed collection was not reported")
+	}
+}
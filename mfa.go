@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+)
+
+// mfaToken is the code given with --mfa-token. The prompt is used when it is
+// empty.
+var mfaToken string
+
+// mfaTokenProvider returns the MFA code for the device, from --mfa-token or
+// by prompting on the terminal.
+func mfaTokenProvider(serial string) func() (string, error) {
+	return func() (string, error) {
+		if mfaToken != "" {
+			return mfaToken, nil
+		}
+		if !stdinIsTerminal() {
+			return "", fmt.Errorf("the profile requires an MFA code from %s, pass --mfa-token", serial)
+		}
+
+		fmt.Fprint(os.Stderr, "MFA code for "+serial+": ")
+		code, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(code), nil
+	}
+}
+
+// mfaLoadOptions returns the options that let the profile assume its role
+// with MFA, and where its session credentials are cached. Both are empty when
+// the profile does not use MFA.
+func mfaLoadOptions(c context.Context) ([]func(*config.LoadOptions) error, string) {
+	profile := profileName()
+	shared, err := loadSharedProfile(c, profile)
+	if err != nil || shared == nil || shared.MFASerial == "" {
+		return nil, ""
+	}
+
+	options := []func(*config.LoadOptions) error{
+		config.WithAssumeRoleCredentialOptions(func(o *stscreds.AssumeRoleOptions) {
+			o.TokenProvider = mfaTokenProvider(shared.MFASerial)
+		}),
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return options, ""
+	}
+	key := sha1.Sum([]byte(profile + "\n" + shared.RoleARN + "\n" + shared.MFASerial))
+	return options, filepath.Join(home, ".aws", "aws-vmcreate", "cache", hex.EncodeToString(key[:])+".json")
+}
+
+// fileCredentialsCache keeps credentials on disk until they expire, so that
+// the MFA code is only asked for once per session rather than per command.
+type fileCredentialsCache struct {
+	path     string
+	provider aws.CredentialsProvider
+}
+
+// Retrieve returns the cached credentials while they are valid for at least
+// another five minutes, and fetches and caches new ones otherwise.
+func (f *fileCredentialsCache) Retrieve(c context.Context) (aws.Credentials, error) {
+	if data, err := os.ReadFile(f.path); err == nil {
+		var cached aws.Credentials
+		if json.Unmarshal(data, &cached) == nil && cached.HasKeys() && cached.CanExpire &&
+			time.Now().Add(5*time.Minute).Before(cached.Expires) {
+			return cached, nil
+		}
+	}
+
+	creds, err := f.provider.Retrieve(c)
+	if err != nil || !creds.CanExpire {
+		return creds, err
+	}
+
+	if data, err := json.Marshal(creds); err == nil {
+		if err := os.MkdirAll(filepath.Dir(f.path), 0700); err == nil {
+			if err := os.WriteFile(f.path, data, 0600); err != nil {
+				fmt.Fprintln(os.Stderr, "Got an error caching the session credentials:")
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+	}
+	return creds, nil
+}
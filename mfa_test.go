@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+type countingProvider struct {
+	calls   int
+	expires time.Time
+}
+
+func (p *countingProvider) Retrieve(context.Context) (aws.Credentials, error) {
+	p.calls++
+	return aws.Credentials{
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "SECRET",
+		SessionToken:    "TOKEN",
+		CanExpire:       true,
+		Expires:         p.expires,
+	}, nil
+}
+
+func TestFileCredentialsCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache", "creds.json")
+	provider := &countingProvider{expires: time.Now().Add(time.Hour)}
+
+	for i := 0; i < 2; i++ {
+		cache := &fileCredentialsCache{path: path, provider: provider}
+		creds, err := cache.Retrieve(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if creds.SessionToken != "TOKEN" {
+			t.Errorf("credentials = %+v", creds)
+		}
+	}
+	if provider.calls != 1 {
+		t.Errorf("provider called %d times, want the second command to use the cache", provider.calls)
+	}
+
+	// Credentials close to expiry are replaced.
+	expiring := &countingProvider{expires: time.Now().Add(time.Minute)}
+	for i := 0; i < 2; i++ {
+		cache := &fileCredentialsCache{path: path + ".expiring", provider: expiring}
+		if _, err := cache.Retrieve(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expiring.calls != 2 {
+		t.Errorf("provider called %d times for expiring credentials, want 2", expiring.calls)
+	}
+}
+
+func TestMFATokenFromFlag(t *testing.T) {
+	defer func(previous string) { mfaToken = previous }(mfaToken)
+	mfaToken = "123456"
+
+	code, err := mfaTokenProvider("arn:aws:iam::111122223333:mfa/ops")()
+	if err != nil || code != "123456" {
+		t.Errorf("code = %q, %v", code, err)
+	}
+}
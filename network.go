@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// NetworkAPI defines the interface for the functions network create and delete use.
+// We use this interface to test the functions using a mocked service.
+type NetworkAPI interface {
+	ec2.DescribeVpcsAPIClient
+	ec2.DescribeSubnetsAPIClient
+	ec2.DescribeRouteTablesAPIClient
+	ec2.DescribeInternetGatewaysAPIClient
+	ec2.DescribeNatGatewaysAPIClient
+	ec2.DescribeInstancesAPIClient
+	ec2.DescribeSecurityGroupsAPIClient
+
+	DescribeAvailabilityZones(ctx context.Context,
+		params *ec2.DescribeAvailabilityZonesInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeAvailabilityZonesOutput, error)
+
+	DescribeAddresses(ctx context.Context,
+		params *ec2.DescribeAddressesInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeAddressesOutput, error)
+
+	CreateVpc(ctx context.Context,
+		params *ec2.CreateVpcInput,
+		optFns ...func(*ec2.Options)) (*ec2.CreateVpcOutput, error)
+
+	ModifyVpcAttribute(ctx context.Context,
+		params *ec2.ModifyVpcAttributeInput,
+		optFns ...func(*ec2.Options)) (*ec2.ModifyVpcAttributeOutput, error)
+
+	CreateSubnet(ctx context.Context,
+		params *ec2.CreateSubnetInput,
+		optFns ...func(*ec2.Options)) (*ec2.CreateSubnetOutput, error)
+
+	ModifySubnetAttribute(ctx context.Context,
+		params *ec2.ModifySubnetAttributeInput,
+		optFns ...func(*ec2.Options)) (*ec2.ModifySubnetAttributeOutput, error)
+
+	CreateInternetGateway(ctx context.Context,
+		params *ec2.CreateInternetGatewayInput,
+		optFns ...func(*ec2.Options)) (*ec2.CreateInternetGatewayOutput, error)
+
+	AttachInternetGateway(ctx context.Context,
+		params *ec2.AttachInternetGatewayInput,
+		optFns ...func(*ec2.Options)) (*ec2.AttachInternetGatewayOutput, error)
+
+	CreateRouteTable(ctx context.Context,
+		params *ec2.CreateRouteTableInput,
+		optFns ...func(*ec2.Options)) (*ec2.CreateRouteTableOutput, error)
+
+	CreateRoute(ctx context.Context,
+		params *ec2.CreateRouteInput,
+		optFns ...func(*ec2.Options)) (*ec2.CreateRouteOutput, error)
+
+	AssociateRouteTable(ctx context.Context,
+		params *ec2.AssociateRouteTableInput,
+		optFns ...func(*ec2.Options)) (*ec2.AssociateRouteTableOutput, error)
+
+	AllocateAddress(ctx context.Context,
+		params *ec2.AllocateAddressInput,
+		optFns ...func(*ec2.Options)) (*ec2.AllocateAddressOutput, error)
+
+	CreateNatGateway(ctx context.Context,
+		params *ec2.CreateNatGatewayInput,
+		optFns ...func(*ec2.Options)) (*ec2.CreateNatGatewayOutput, error)
+
+	DeleteNatGateway(ctx context.Context,
+		params *ec2.DeleteNatGatewayInput,
+		optFns ...func(*ec2.Options)) (*ec2.DeleteNatGatewayOutput, error)
+
+	ReleaseAddress(ctx context.Context,
+		params *ec2.ReleaseAddressInput,
+		optFns ...func(*ec2.Options)) (*ec2.ReleaseAddressOutput, error)
+
+	DisassociateRouteTable(ctx context.Context,
+		params *ec2.DisassociateRouteTableInput,
+		optFns ...func(*ec2.Options)) (*ec2.DisassociateRouteTableOutput, error)
+
+	DeleteRouteTable(ctx context.Context,
+		params *ec2.DeleteRouteTableInput,
+		optFns ...func(*ec2.Options)) (*ec2.DeleteRouteTableOutput, error)
+
+	DetachInternetGateway(ctx context.Context,
+		params *ec2.DetachInternetGatewayInput,
+		optFns ...func(*ec2.Options)) (*ec2.DetachInternetGatewayOutput, error)
+
+	DeleteInternetGateway(ctx context.Context,
+		params *ec2.DeleteInternetGatewayInput,
+		optFns ...func(*ec2.Options)) (*ec2.DeleteInternetGatewayOutput, error)
+
+	DeleteSubnet(ctx context.Context,
+		params *ec2.DeleteSubnetInput,
+		optFns ...func(*ec2.Options)) (*ec2.DeleteSubnetOutput, error)
+
+	DeleteSecurityGroup(ctx context.Context,
+		params *ec2.DeleteSecurityGroupInput,
+		optFns ...func(*ec2.Options)) (*ec2.DeleteSecurityGroupOutput, error)
+
+	DeleteVpc(ctx context.Context,
+		params *ec2.DeleteVpcInput,
+		optFns ...func(*ec2.Options)) (*ec2.DeleteVpcOutput, error)
+}
+
+// networkTag names the network made by network create that a resource
+// belongs to, which is how network delete finds them.
+const networkTag = "aws-vmcreate:network"
+
+// natGatewayTimeout is how long network create and delete wait for a NAT
+// gateway to become available or deleted.
+var natGatewayTimeout = 10 * time.Minute
+
+// networkOptions describes the network create makes.
+type networkOptions struct {
+	Name string
+	CIDR string
+	AZs  int
+	NAT  bool
+	// Tags are added to every resource, besides Name and networkTag.
+	Tags map[string]string
+}
+
+// createdNetwork holds the ids of the resources network create made.
+type createdNetwork struct {
+	VpcID          string
+	PublicSubnets  []string
+	PrivateSubnets []string
+	NatGatewayID   string
+}
+
+// subnetCIDRs splits the VPC CIDR into count subnets, each a sixteenth of it.
+func subnetCIDRs(vpcCIDR string, count int) ([]string, error) {
+	ip, network, err := net.ParseCIDR(vpcCIDR)
+	if err != nil || ip.To4() == nil {
+		return nil, fmt.Errorf("the network CIDR must be an IPv4 CIDR such as 10.0.0.0/16, not %q", vpcCIDR)
+	}
+	prefix, _ := network.Mask.Size()
+	if prefix < 16 || prefix > 24 {
+		return nil, fmt.Errorf("the network CIDR must be between a /16 and a /24, not a /%d", prefix)
+	}
+	if count > 16 {
+		return nil, fmt.Errorf("a network holds at most 16 subnets, not %d", count)
+	}
+
+	base := binary.BigEndian.Uint32(network.IP.To4())
+	size := uint32(1) << (32 - prefix - 4)
+	cidrs := make([]string, count)
+	for n := range cidrs {
+		subnet := make(net.IP, 4)
+		binary.BigEndian.PutUint32(subnet, base+uint32(n)*size)
+		cidrs[n] = fmt.Sprintf("%s/%d", subnet, prefix+4)
+	}
+	return cidrs, nil
+}
+
+func tagSpecification(resource types.ResourceType, tags map[string]string, name string) []types.TagSpecification {
+	return []types.TagSpecification{{ResourceType: resource, Tags: vmcreate.Tags(tags, map[string]string{"Name": name})}}
+}
+
+// createNetwork makes a VPC with a public and a private subnet in each of the
+// first opts.AZs availability zones, an internet gateway the public subnets
+// route through and, with opts.NAT, a NAT gateway the private subnets route
+// through. The resources made so far are returned with an error, for
+// network delete to remove.
+func createNetwork(c context.Context, api NetworkAPI, opts networkOptions) (*createdNetwork, error) {
+	tags := withProvenance(c, opts.Tags, "")
+	tags[networkTag] = opts.Name
+	created := &createdNetwork{}
+
+	zones, err := api.DescribeAvailabilityZones(c, &ec2.DescribeAvailabilityZonesInput{Filters: []types.Filter{
+		{Name: aws.String("state"), Values: []string{"available"}},
+		{Name: aws.String("zone-type"), Values: []string{"availability-zone"}},
+	}})
+	if err != nil {
+		return created, fmt.Errorf("listing the availability zones: %w", err)
+	}
+	if len(zones.AvailabilityZones) < opts.AZs {
+		return created, fmt.Errorf("the region has %d availability zones, not %d", len(zones.AvailabilityZones), opts.AZs)
+	}
+	cidrs, err := subnetCIDRs(opts.CIDR, 2*opts.AZs)
+	if err != nil {
+		return created, err
+	}
+
+	vpc, err := api.CreateVpc(c, &ec2.CreateVpcInput{CidrBlock: aws.String(opts.CIDR), TagSpecifications: tagSpecification(types.ResourceTypeVpc, tags, opts.Name)})
+	if err != nil {
+		return created, fmt.Errorf("creating the VPC: %w", err)
+	}
+	created.VpcID = aws.ToString(vpc.Vpc.VpcId)
+	progressln("Created VPC " + created.VpcID + " (" + opts.CIDR + ")")
+	// Instances get public DNS names, which SSM and the connect command use.
+	if _, err := api.ModifyVpcAttribute(c, &ec2.ModifyVpcAttributeInput{VpcId: vpc.Vpc.VpcId, EnableDnsHostnames: &types.AttributeBooleanValue{Value: aws.Bool(true)}}); err != nil {
+		return created, fmt.Errorf("enabling DNS hostnames: %w", err)
+	}
+
+	igw, err := api.CreateInternetGateway(c, &ec2.CreateInternetGatewayInput{TagSpecifications: tagSpecification(types.ResourceTypeInternetGateway, tags, opts.Name)})
+	if err != nil {
+		return created, fmt.Errorf("creating the internet gateway: %w", err)
+	}
+	if _, err := api.AttachInternetGateway(c, &ec2.AttachInternetGatewayInput{InternetGatewayId: igw.InternetGateway.InternetGatewayId, VpcId: vpc.Vpc.VpcId}); err != nil {
+		return created, fmt.Errorf("attaching the internet gateway: %w", err)
+	}
+	progressln("Created internet gateway " + aws.ToString(igw.InternetGateway.InternetGatewayId))
+
+	for n := 0; n < 2*opts.AZs; n++ {
+		zone := aws.ToString(zones.AvailabilityZones[n%opts.AZs].ZoneName)
+		public := n < opts.AZs
+		name := opts.Name + "-private-" + zone
+		if public {
+			name = opts.Name + "-public-" + zone
+		}
+		subnet, err := api.CreateSubnet(c, &ec2.CreateSubnetInput{
+			VpcId:             vpc.Vpc.VpcId,
+			CidrBlock:         aws.String(cidrs[n]),
+			AvailabilityZone:  aws.String(zone),
+			TagSpecifications: tagSpecification(types.ResourceTypeSubnet, tags, name),
+		})
+		if err != nil {
+			return created, fmt.Errorf("creating the subnet %s: %w", name, err)
+		}
+		id := aws.ToString(subnet.Subnet.SubnetId)
+		if public {
+			created.PublicSubnets = append(created.PublicSubnets, id)
+			if _, err := api.ModifySubnetAttribute(c, &ec2.ModifySubnetAttributeInput{SubnetId: subnet.Subnet.SubnetId, MapPublicIpOnLaunch: &types.AttributeBooleanValue{Value: aws.Bool(true)}}); err != nil {
+				return created, fmt.Errorf("giving the subnet %s public IPs: %w", name, err)
+			}
+		} else {
+			created.PrivateSubnets = append(created.PrivateSubnets, id)
+		}
+		progressln("Created subnet " + id + " " + name + " (" + cidrs[n] + ")")
+	}
+
+	if err := routeSubnets(c, api, created.VpcID, opts.Name+"-public", tags, created.PublicSubnets, &ec2.CreateRouteInput{GatewayId: igw.InternetGateway.InternetGatewayId}); err != nil {
+		return created, err
+	}
+
+	var natRoute *ec2.CreateRouteInput
+	if opts.NAT {
+		eip, err := api.AllocateAddress(c, &ec2.AllocateAddressInput{Domain: types.DomainTypeVpc, TagSpecifications: tagSpecification(types.ResourceTypeElasticIp, tags, opts.Name+"-nat")})
+		if err != nil {
+			return created, fmt.Errorf("allocating the NAT gateway's Elastic IP: %w", err)
+		}
+		nat, err := api.CreateNatGateway(c, &ec2.CreateNatGatewayInput{
+			SubnetId:          aws.String(created.PublicSubnets[0]),
+			AllocationId:      eip.AllocationId,
+			TagSpecifications: tagSpecification(types.ResourceTypeNatgateway, tags, opts.Name),
+		})
+		if err != nil {
+			return created, fmt.Errorf("creating the NAT gateway: %w", err)
+		}
+		created.NatGatewayID = aws.ToString(nat.NatGateway.NatGatewayId)
+		progressln("Waiting for NAT gateway " + created.NatGatewayID + " to be available")
+		if err := ec2.NewNatGatewayAvailableWaiter(api).Wait(c, &ec2.DescribeNatGatewaysInput{NatGatewayIds: []string{created.NatGatewayID}}, boundedWait(natGatewayTimeout)); err != nil {
+			return created, fmt.Errorf("waiting for the NAT gateway: %w", err)
+		}
+		natRoute = &ec2.CreateRouteInput{NatGatewayId: nat.NatGateway.NatGatewayId}
+	}
+	if err := routeSubnets(c, api, created.VpcID, opts.Name+"-private", tags, created.PrivateSubnets, natRoute); err != nil {
+		return created, err
+	}
+	return created, nil
+}
+
+// routeSubnets creates a route table for the subnets, with a default route
+// as given by route, or only the local route when route is nil.
+func routeSubnets(c context.Context, api NetworkAPI, vpcID string, name string, tags map[string]string, subnetIDs []string, route *ec2.CreateRouteInput) error {
+	table, err := api.CreateRouteTable(c, &ec2.CreateRouteTableInput{VpcId: aws.String(vpcID), TagSpecifications: tagSpecification(types.ResourceTypeRouteTable, tags, name)})
+	if err != nil {
+		return fmt.Errorf("creating the route table %s: %w", name, err)
+	}
+	if route != nil {
+		route.RouteTableId = table.RouteTable.RouteTableId
+		route.DestinationCidrBlock = aws.String("0.0.0.0/0")
+		if _, err := api.CreateRoute(c, route); err != nil {
+			return fmt.Errorf("creating the default route of %s: %w", name, err)
+		}
+	}
+	for _, id := range subnetIDs {
+		if _, err := api.AssociateRouteTable(c, &ec2.AssociateRouteTableInput{RouteTableId: table.RouteTable.RouteTableId, SubnetId: aws.String(id)}); err != nil {
+			return fmt.Errorf("associating the route table %s: %w", name, err)
+		}
+	}
+	progressln("Created route table " + aws.ToString(table.RouteTable.RouteTableId) + " " + name)
+	return nil
+}
+
+// deleteNetwork removes the network named name and everything in it that
+// network create made, in dependency order. It refuses while instances
+// still run in the VPC.
+func deleteNetwork(c context.Context, api NetworkAPI, name string) error {
+	tagged := []types.Filter{{Name: aws.String("tag:" + networkTag), Values: []string{name}}}
+	vpcs, err := api.DescribeVpcs(c, &ec2.DescribeVpcsInput{Filters: tagged})
+	if err != nil {
+		return fmt.Errorf("finding the VPC: %w", err)
+	}
+	if len(vpcs.Vpcs) == 0 {
+		return fmt.Errorf("there is no network named %s", name)
+	}
+	vpcID := vpcs.Vpcs[0].VpcId
+	inVpc := []types.Filter{{Name: aws.String("vpc-id"), Values: []string{aws.ToString(vpcID)}}}
+
+	instances, err := api.DescribeInstances(c, &ec2.DescribeInstancesInput{Filters: append([]types.Filter{
+		{Name: aws.String("instance-state-name"), Values: []string{"pending", "running", "stopping", "stopped", "shutting-down"}},
+	}, inVpc...)})
+	if err != nil {
+		return fmt.Errorf("listing the instances of the VPC: %w", err)
+	}
+	for _, r := range instances.Reservations {
+		if len(r.Instances) > 0 {
+			return fmt.Errorf("instance %s still runs in VPC %s, delete the instances first", aws.ToString(r.Instances[0].InstanceId), aws.ToString(vpcID))
+		}
+	}
+
+	nats, err := api.DescribeNatGateways(c, &ec2.DescribeNatGatewaysInput{Filter: inVpc})
+	if err != nil {
+		return fmt.Errorf("listing the NAT gateways: %w", err)
+	}
+	var deleting []string
+	for _, n := range nats.NatGateways {
+		if n.State == types.NatGatewayStateDeleted || n.State == types.NatGatewayStateDeleting {
+			continue
+		}
+		if _, err := api.DeleteNatGateway(c, &ec2.DeleteNatGatewayInput{NatGatewayId: n.NatGatewayId}); err != nil {
+			return fmt.Errorf("deleting the NAT gateway: %w", err)
+		}
+		deleting = append(deleting, aws.ToString(n.NatGatewayId))
+		progressln("Deleting NAT gateway " + aws.ToString(n.NatGatewayId))
+	}
+	// The Elastic IPs and subnets are only free once the NAT gateways are gone.
+	if len(deleting) > 0 {
+		if err := ec2.NewNatGatewayDeletedWaiter(api).Wait(c, &ec2.DescribeNatGatewaysInput{NatGatewayIds: deleting}, boundedWait(natGatewayTimeout)); err != nil {
+			return fmt.Errorf("waiting for the NAT gateways to be deleted: %w", err)
+		}
+	}
+	addresses, err := api.DescribeAddresses(c, &ec2.DescribeAddressesInput{Filters: tagged})
+	if err != nil {
+		return fmt.Errorf("listing the Elastic IPs: %w", err)
+	}
+	for _, a := range addresses.Addresses {
+		if _, err := api.ReleaseAddress(c, &ec2.ReleaseAddressInput{AllocationId: a.AllocationId}); err != nil {
+			return fmt.Errorf("releasing the Elastic IP %s: %w", aws.ToString(a.PublicIp), err)
+		}
+		progressln("Released Elastic IP " + aws.ToString(a.PublicIp))
+	}
+
+	tables, err := api.DescribeRouteTables(c, &ec2.DescribeRouteTablesInput{Filters: inVpc})
+	if err != nil {
+		return fmt.Errorf("listing the route tables: %w", err)
+	}
+	for _, t := range tables.RouteTables {
+		isMain := false
+		for _, a := range t.Associations {
+			if aws.ToBool(a.Main) {
+				isMain = true
+				continue
+			}
+			if _, err := api.DisassociateRouteTable(c, &ec2.DisassociateRouteTableInput{AssociationId: a.RouteTableAssociationId}); err != nil {
+				return fmt.Errorf("disassociating the route table: %w", err)
+			}
+		}
+		// The main route table goes with the VPC.
+		if isMain {
+			continue
+		}
+		if _, err := api.DeleteRouteTable(c, &ec2.DeleteRouteTableInput{RouteTableId: t.RouteTableId}); err != nil {
+			return fmt.Errorf("deleting the route table: %w", err)
+		}
+		progressln("Deleted route table " + aws.ToString(t.RouteTableId))
+	}
+
+	gateways, err := api.DescribeInternetGateways(c, &ec2.DescribeInternetGatewaysInput{Filters: []types.Filter{
+		{Name: aws.String("attachment.vpc-id"), Values: []string{aws.ToString(vpcID)}},
+	}})
+	if err != nil {
+		return fmt.Errorf("listing the internet gateways: %w", err)
+	}
+	for _, g := range gateways.InternetGateways {
+		if _, err := api.DetachInternetGateway(c, &ec2.DetachInternetGatewayInput{InternetGatewayId: g.InternetGatewayId, VpcId: vpcID}); err != nil {
+			return fmt.Errorf("detaching the internet gateway: %w", err)
+		}
+		if _, err := api.DeleteInternetGateway(c, &ec2.DeleteInternetGatewayInput{InternetGatewayId: g.InternetGatewayId}); err != nil {
+			return fmt.Errorf("deleting the internet gateway: %w", err)
+		}
+		progressln("Deleted internet gateway " + aws.ToString(g.InternetGatewayId))
+	}
+
+	subnets, err := api.DescribeSubnets(c, &ec2.DescribeSubnetsInput{Filters: inVpc})
+	if err != nil {
+		return fmt.Errorf("listing the subnets: %w", err)
+	}
+	for _, s := range subnets.Subnets {
+		if _, err := api.DeleteSubnet(c, &ec2.DeleteSubnetInput{SubnetId: s.SubnetId}); err != nil {
+			return fmt.Errorf("deleting the subnet %s: %w", aws.ToString(s.SubnetId), err)
+		}
+		progressln("Deleted subnet " + aws.ToString(s.SubnetId))
+	}
+
+	groups, err := api.DescribeSecurityGroups(c, &ec2.DescribeSecurityGroupsInput{Filters: inVpc})
+	if err != nil {
+		return fmt.Errorf("listing the security groups: %w", err)
+	}
+	for _, g := range groups.SecurityGroups {
+		if aws.ToString(g.GroupName) == "default" {
+			continue
+		}
+		if _, err := api.DeleteSecurityGroup(c, &ec2.DeleteSecurityGroupInput{GroupId: g.GroupId}); err != nil {
+			return fmt.Errorf("deleting the security group %s: %w", aws.ToString(g.GroupId), err)
+		}
+		progressln("Deleted security group " + aws.ToString(g.GroupId))
+	}
+
+	if _, err := api.DeleteVpc(c, &ec2.DeleteVpcInput{VpcId: vpcID}); err != nil {
+		return fmt.Errorf("deleting the VPC: %w", err)
+	}
+	progressln("Deleted VPC " + aws.ToString(vpcID))
+	return nil
+}
+
+func NetworkCreateCmd(opts networkOptions) {
+	opts.Tags = withProvenance(context.TODO(), nil, "")
+	created, err := createNetwork(context.TODO(), client, opts)
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error creating the network:")
+		fmt.Fprintln(os.Stderr, err)
+		if created.VpcID != "" {
+			fmt.Fprintln(os.Stderr, "Remove what was created with: aws-vmcreate network delete --name "+opts.Name)
+		}
+		return
+	}
+	printResult("Created network "+opts.Name+" ("+created.VpcID+"), launch into it with --subnet-id "+created.PublicSubnets[0]+" or \"subnet_id\" in data/config.json", created.VpcID)
+}
+
+func NetworkDeleteCmd(name *string) {
+	if err := deleteNetwork(context.TODO(), client, *name); err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error deleting the network:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	printResult("Deleted network "+*name, *name)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"aws-vmcreate/pkg/vmcreate/vmcreatetest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeNetwork keeps the networking resources of a single VPC in memory and
+// records the calls that change them.
+type fakeNetwork struct {
+	*vmcreatetest.FakeEC2
+	next      int
+	calls     []string
+	vpcs      []types.Vpc
+	subnets   []types.Subnet
+	tables    []types.RouteTable
+	gateways  []types.InternetGateway
+	nats      []types.NatGateway
+	addresses []types.Address
+	groups    []types.SecurityGroup
+	// initializing is how many more times the status checks of the
+	// instances are reported as initializing before they pass.
+	initializing int
+}
+
+func (f *fakeNetwork) id(prefix string) *string {
+	f.next++
+	return aws.String(fmt.Sprintf("%s-%d", prefix, f.next))
+}
+
+func (f *fakeNetwork) record(format string, args ...interface{}) {
+	f.calls = append(f.calls, fmt.Sprintf(format, args...))
+}
+
+func specTags(specs []types.TagSpecification) []types.Tag {
+	return specs[0].Tags
+}
+
+func (f *fakeNetwork) DescribeAvailabilityZones(ctx context.Context, params *ec2.DescribeAvailabilityZonesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeAvailabilityZonesOutput, error) {
+	return &ec2.DescribeAvailabilityZonesOutput{AvailabilityZones: []types.AvailabilityZone{
+		{ZoneName: aws.String("us-east-1a")}, {ZoneName: aws.String("us-east-1b")}, {ZoneName: aws.String("us-east-1c")},
+	}}, nil
+}
+
+func (f *fakeNetwork) DescribeVpcs(ctx context.Context, params *ec2.DescribeVpcsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeVpcsOutput, error) {
+	out := &ec2.DescribeVpcsOutput{}
+	for _, v := range f.vpcs {
+		for _, t := range v.Tags {
+			if "tag:"+aws.ToString(t.Key) == aws.ToString(params.Filters[0].Name) && aws.ToString(t.Value) == params.Filters[0].Values[0] {
+				out.Vpcs = append(out.Vpcs, v)
+			}
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeNetwork) DescribeSubnets(ctx context.Context, params *ec2.DescribeSubnetsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSubnetsOutput, error) {
+	return &ec2.DescribeSubnetsOutput{Subnets: f.subnets}, nil
+}
+
+func (f *fakeNetwork) DescribeRouteTables(ctx context.Context, params *ec2.DescribeRouteTablesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRouteTablesOutput, error) {
+	return &ec2.DescribeRouteTablesOutput{RouteTables: f.tables}, nil
+}
+
+func (f *fakeNetwork) DescribeInternetGateways(ctx context.Context, params *ec2.DescribeInternetGatewaysInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInternetGatewaysOutput, error) {
+	return &ec2.DescribeInternetGatewaysOutput{InternetGateways: f.gateways}, nil
+}
+
+func (f *fakeNetwork) DescribeNatGateways(ctx context.Context, params *ec2.DescribeNatGatewaysInput, optFns ...func(*ec2.Options)) (*ec2.DescribeNatGatewaysOutput, error) {
+	return &ec2.DescribeNatGatewaysOutput{NatGateways: f.nats}, nil
+}
+
+func (f *fakeNetwork) DescribeAddresses(ctx context.Context, params *ec2.DescribeAddressesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeAddressesOutput, error) {
+	return &ec2.DescribeAddressesOutput{Addresses: f.addresses}, nil
+}
+
+func (f *fakeNetwork) DescribeSecurityGroups(ctx context.Context, params *ec2.DescribeSecurityGroupsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSecurityGroupsOutput, error) {
+	return &ec2.DescribeSecurityGroupsOutput{SecurityGroups: f.groups}, nil
+}
+
+func (f *fakeNetwork) CreateVpc(ctx context.Context, params *ec2.CreateVpcInput, optFns ...func(*ec2.Options)) (*ec2.CreateVpcOutput, error) {
+	vpc := types.Vpc{VpcId: f.id("vpc"), CidrBlock: params.CidrBlock, Tags: specTags(params.TagSpecifications)}
+	f.vpcs = append(f.vpcs, vpc)
+	// Every VPC comes with a main route table and a default security group.
+	f.tables = append(f.tables, types.RouteTable{RouteTableId: f.id("rtb"), Associations: []types.RouteTableAssociation{{Main: aws.Bool(true)}}})
+	f.groups = append(f.groups, types.SecurityGroup{GroupId: f.id("sg"), GroupName: aws.String("default")})
+	f.record("create-vpc %s", aws.ToString(params.CidrBlock))
+	return &ec2.CreateVpcOutput{Vpc: &vpc}, nil
+}
+
+func (f *fakeNetwork) ModifyVpcAttribute(ctx context.Context, params *ec2.ModifyVpcAttributeInput, optFns ...func(*ec2.Options)) (*ec2.ModifyVpcAttributeOutput, error) {
+	return &ec2.ModifyVpcAttributeOutput{}, nil
+}
+
+func (f *fakeNetwork) CreateSubnet(ctx context.Context, params *ec2.CreateSubnetInput, optFns ...func(*ec2.Options)) (*ec2.CreateSubnetOutput, error) {
+	subnet := types.Subnet{SubnetId: f.id("subnet"), CidrBlock: params.CidrBlock, AvailabilityZone: params.AvailabilityZone, Tags: specTags(params.TagSpecifications)}
+	f.subnets = append(f.subnets, subnet)
+	f.record("create-subnet %s %s %s", tagName(subnet.Tags), aws.ToString(params.AvailabilityZone), aws.ToString(params.CidrBlock))
+	return &ec2.CreateSubnetOutput{Subnet: &subnet}, nil
+}
+
+func (f *fakeNetwork) ModifySubnetAttribute(ctx context.Context, params *ec2.ModifySubnetAttributeInput, optFns ...func(*ec2.Options)) (*ec2.ModifySubnetAttributeOutput, error) {
+	f.record("map-public-ip %s", aws.ToString(params.SubnetId))
+	return &ec2.ModifySubnetAttributeOutput{}, nil
+}
+
+func (f *fakeNetwork) CreateInternetGateway(ctx context.Context, params *ec2.CreateInternetGatewayInput, optFns ...func(*ec2.Options)) (*ec2.CreateInternetGatewayOutput, error) {
+	igw := types.InternetGateway{InternetGatewayId: f.id("igw")}
+	f.gateways = append(f.gateways, igw)
+	return &ec2.CreateInternetGatewayOutput{InternetGateway: &igw}, nil
+}
+
+func (f *fakeNetwork) AttachInternetGateway(ctx context.Context, params *ec2.AttachInternetGatewayInput, optFns ...func(*ec2.Options)) (*ec2.AttachInternetGatewayOutput, error) {
+	f.record("attach-igw %s %s", aws.ToString(params.InternetGatewayId), aws.ToString(params.VpcId))
+	return &ec2.AttachInternetGatewayOutput{}, nil
+}
+
+func (f *fakeNetwork) CreateRouteTable(ctx context.Context, params *ec2.CreateRouteTableInput, optFns ...func(*ec2.Options)) (*ec2.CreateRouteTableOutput, error) {
+	table := types.RouteTable{RouteTableId: f.id("rtb"), Tags: specTags(params.TagSpecifications)}
+	f.tables = append(f.tables, table)
+	return &ec2.CreateRouteTableOutput{RouteTable: &table}, nil
+}
+
+func (f *fakeNetwork) CreateRoute(ctx context.Context, params *ec2.CreateRouteInput, optFns ...func(*ec2.Options)) (*ec2.CreateRouteOutput, error) {
+	f.record("route %s %s %s", aws.ToString(params.RouteTableId), aws.ToString(params.DestinationCidrBlock), firstNonEmpty(aws.ToString(params.GatewayId), aws.ToString(params.NatGatewayId)))
+	return &ec2.CreateRouteOutput{}, nil
+}
+
+func (f *fakeNetwork) AssociateRouteTable(ctx context.Context, params *ec2.AssociateRouteTableInput, optFns ...func(*ec2.Options)) (*ec2.AssociateRouteTableOutput, error) {
+	for n := range f.tables {
+		if aws.ToString(f.tables[n].RouteTableId) == aws.ToString(params.RouteTableId) {
+			f.tables[n].Associations = append(f.tables[n].Associations, types.RouteTableAssociation{RouteTableAssociationId: f.id("rtbassoc"), SubnetId: params.SubnetId})
+		}
+	}
+	f.record("associate %s %s", aws.ToString(params.RouteTableId), aws.ToString(params.SubnetId))
+	return &ec2.AssociateRouteTableOutput{}, nil
+}
+
+func (f *fakeNetwork) AllocateAddress(ctx context.Context, params *ec2.AllocateAddressInput, optFns ...func(*ec2.Options)) (*ec2.AllocateAddressOutput, error) {
+	address := types.Address{AllocationId: f.id("eipalloc"), PublicIp: aws.String("203.0.113.10")}
+	f.addresses = append(f.addresses, address)
+	return &ec2.AllocateAddressOutput{AllocationId: address.AllocationId, PublicIp: address.PublicIp}, nil
+}
+
+func (f *fakeNetwork) CreateNatGateway(ctx context.Context, params *ec2.CreateNatGatewayInput, optFns ...func(*ec2.Options)) (*ec2.CreateNatGatewayOutput, error) {
+	nat := types.NatGateway{NatGatewayId: f.id("nat"), SubnetId: params.SubnetId, State: types.NatGatewayStateAvailable}
+	f.nats = append(f.nats, nat)
+	f.record("create-nat %s %s", aws.ToString(params.SubnetId), aws.ToString(params.AllocationId))
+	return &ec2.CreateNatGatewayOutput{NatGateway: &nat}, nil
+}
+
+func (f *fakeNetwork) DeleteNatGateway(ctx context.Context, params *ec2.DeleteNatGatewayInput, optFns ...func(*ec2.Options)) (*ec2.DeleteNatGatewayOutput, error) {
+	for n := range f.nats {
+		if aws.ToString(f.nats[n].NatGatewayId) == aws.ToString(params.NatGatewayId) {
+			f.nats[n].State = types.NatGatewayStateDeleted
+		}
+	}
+	f.record("delete %s", aws.ToString(params.NatGatewayId))
+	return &ec2.DeleteNatGatewayOutput{}, nil
+}
+
+func (f *fakeNetwork) ReleaseAddress(ctx context.Context, params *ec2.ReleaseAddressInput, optFns ...func(*ec2.Options)) (*ec2.ReleaseAddressOutput, error) {
+	f.addresses = nil
+	f.record("delete %s", aws.ToString(params.AllocationId))
+	return &ec2.ReleaseAddressOutput{}, nil
+}
+
+func (f *fakeNetwork) DisassociateRouteTable(ctx context.Context, params *ec2.DisassociateRouteTableInput, optFns ...func(*ec2.Options)) (*ec2.DisassociateRouteTableOutput, error) {
+	return &ec2.DisassociateRouteTableOutput{}, nil
+}
+
+func (f *fakeNetwork) DeleteRouteTable(ctx context.Context, params *ec2.DeleteRouteTableInput, optFns ...func(*ec2.Options)) (*ec2.DeleteRouteTableOutput, error) {
+	f.record("delete %s", aws.ToString(params.RouteTableId))
+	return &ec2.DeleteRouteTableOutput{}, nil
+}
+
+func (f *fakeNetwork) DetachInternetGateway(ctx context.Context, params *ec2.DetachInternetGatewayInput, optFns ...func(*ec2.Options)) (*ec2.DetachInternetGatewayOutput, error) {
+	f.record("detach %s", aws.ToString(params.InternetGatewayId))
+	return &ec2.DetachInternetGatewayOutput{}, nil
+}
+
+func (f *fakeNetwork) DeleteInternetGateway(ctx context.Context, params *ec2.DeleteInternetGatewayInput, optFns ...func(*ec2.Options)) (*ec2.DeleteInternetGatewayOutput, error) {
+	f.record("delete %s", aws.ToString(params.InternetGatewayId))
+	return &ec2.DeleteInternetGatewayOutput{}, nil
+}
+
+func (f *fakeNetwork) DeleteSubnet(ctx context.Context, params *ec2.DeleteSubnetInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSubnetOutput, error) {
+	f.record("delete %s", aws.ToString(params.SubnetId))
+	return &ec2.DeleteSubnetOutput{}, nil
+}
+
+func (f *fakeNetwork) DeleteSecurityGroup(ctx context.Context, params *ec2.DeleteSecurityGroupInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSecurityGroupOutput, error) {
+	f.record("delete %s", aws.ToString(params.GroupId))
+	return &ec2.DeleteSecurityGroupOutput{}, nil
+}
+
+func (f *fakeNetwork) DeleteVpc(ctx context.Context, params *ec2.DeleteVpcInput, optFns ...func(*ec2.Options)) (*ec2.DeleteVpcOutput, error) {
+	f.record("delete %s", aws.ToString(params.VpcId))
+	return &ec2.DeleteVpcOutput{}, nil
+}
+
+func TestSubnetCIDRs(t *testing.T) {
+	cidrs, err := subnetCIDRs("10.1.0.0/16", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(cidrs, " "); got != "10.1.0.0/20 10.1.16.0/20 10.1.32.0/20 10.1.48.0/20" {
+		t.Errorf("subnets = %s", got)
+	}
+	for _, bad := range []string{"10.0.0.0", "10.0.0.0/8", "10.0.0.0/28", "fd00::/56"} {
+		if _, err := subnetCIDRs(bad, 2); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
+
+func TestNetworkCreateAndDelete(t *testing.T) {
+	fake := &fakeNetwork{FakeEC2: vmcreatetest.NewFakeEC2()}
+	c := context.Background()
+	created, err := createNetwork(c, fake, networkOptions{Name: "dev", CIDR: "10.0.0.0/16", AZs: 2, NAT: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"create-vpc 10.0.0.0/16",
+		"attach-igw igw-4 vpc-1",
+		"create-subnet dev-public-us-east-1a us-east-1a 10.0.0.0/20",
+		"map-public-ip subnet-5",
+		"create-subnet dev-public-us-east-1b us-east-1b 10.0.16.0/20",
+		"map-public-ip subnet-6",
+		"create-subnet dev-private-us-east-1a us-east-1a 10.0.32.0/20",
+		"create-subnet dev-private-us-east-1b us-east-1b 10.0.48.0/20",
+		"route rtb-9 0.0.0.0/0 igw-4",
+		"associate rtb-9 subnet-5",
+		"associate rtb-9 subnet-6",
+		"create-nat subnet-5 eipalloc-12",
+		"route rtb-14 0.0.0.0/0 nat-13",
+		"associate rtb-14 subnet-7",
+		"associate rtb-14 subnet-8",
+	}
+	if strings.Join(fake.calls, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("calls:\n%s\nwant:\n%s", strings.Join(fake.calls, "\n"), strings.Join(want, "\n"))
+	}
+	if created.NatGatewayID != "nat-13" || strings.Join(created.PublicSubnets, " ") != "subnet-5 subnet-6" {
+		t.Errorf("created = %+v", created)
+	}
+	if tags := fake.vpcs[0].Tags; !hasTag(tags, networkTag) || tagName(tags) != "dev" {
+		t.Errorf("VPC tags = %v", tags)
+	}
+
+	instanceID := fake.AddInstance(types.Instance{VpcId: aws.String("vpc-1")})
+	if err := deleteNetwork(c, fake, "dev"); err == nil || !strings.Contains(err.Error(), "still runs") {
+		t.Fatalf("got %v, want the delete refused while an instance runs", err)
+	}
+	if _, err := fake.TerminateInstances(c, &ec2.TerminateInstancesInput{InstanceIds: []string{instanceID}}); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.calls = nil
+	if err := deleteNetwork(c, fake, "dev"); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"delete nat-13",
+		"delete eipalloc-12",
+		"delete rtb-9",
+		"delete rtb-14",
+		"detach igw-4",
+		"delete igw-4",
+		"delete subnet-5",
+		"delete subnet-6",
+		"delete subnet-7",
+		"delete subnet-8",
+		"delete vpc-1",
+	}
+	if strings.Join(fake.calls, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("calls:\n%s\nwant:\n%s", strings.Join(fake.calls, "\n"), strings.Join(want, "\n"))
+	}
+
+	if err := deleteNetwork(c, fake, "prod"); err == nil {
+		t.Error("expected an error for a network that does not exist")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+)
+
+// Notifications configures where lifecycle events are sent.
+type Notifications struct {
+	SNSTopics     []string `json:"sns_topics,omitempty"`
+	SlackWebhooks []string `json:"slack_webhooks,omitempty"`
+	Webhooks      []string `json:"webhooks,omitempty"`
+}
+
+// Event describes the outcome of a lifecycle command. It is the JSON payload
+// sent to SNS topics and generic webhooks.
+type Event struct {
+	Command     string    `json:"command"`
+	Status      string    `json:"status"`
+	TagKey      string    `json:"tag_key,omitempty"`
+	TagValue    string    `json:"tag_value,omitempty"`
+	InstanceIDs []string  `json:"instance_ids,omitempty"`
+	Region      string    `json:"region"`
+	Error       string    `json:"error,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// SNSPublishAPI defines the interface for the Publish function.
+// We use this interface to test the functions using a mocked service.
+type SNSPublishAPI interface {
+	Publish(ctx context.Context,
+		params *awsapi.PublishInput) (*awsapi.PublishOutput, error)
+}
+
+// PublishMessage publishes a message to an Amazon Simple Notification Service (Amazon SNS) topic.
+// Inputs:
+//
+//	c is the context of the method call, which includes the AWS Region.
+//	api is the interface that defines the method call.
+//	input defines the input arguments to the service call.
+//
+// Output:
+//
+//	If success, a PublishOutput object containing the result of the service call and nil.
+//	Otherwise, nil and an error from the call to Publish.
+func PublishMessage(c context.Context, api SNSPublishAPI, input *awsapi.PublishInput) (*awsapi.PublishOutput, error) {
+	return api.Publish(c, input)
+}
+
+// summary returns a one line, human readable description of the event.
+func (e *Event) summary() string {
+	s := fmt.Sprintf("aws-vmcreate %s %s", e.Command, e.Status)
+	if e.TagKey != "" {
+		s += fmt.Sprintf(" for %s=%s", e.TagKey, e.TagValue)
+	}
+	if len(e.InstanceIDs) > 0 {
+		s += " (" + strings.Join(e.InstanceIDs, ", ") + ")"
+	}
+	if e.Error != "" {
+		s += ": " + e.Error
+	}
+	return s
+}
+
+// snsClientFor returns an SNS client in the region of the topic ARN.
+func snsClientFor(topicArn string) *awsapi.SNS {
+	cfg := awsConfig.Copy()
+	if parts := strings.Split(topicArn, ":"); len(parts) > 3 && parts[3] != "" {
+		cfg.Region = parts[3]
+	}
+	return awsapi.NewSNS(cfg)
+}
+
+// postJSON posts payload to url as JSON.
+func postJSON(c context.Context, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(c, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// The AWS HTTP client carries the proxy and CA bundle settings.
+	resp, err := awsConfig.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// notify sends the event to every configured destination. Delivery errors
+// are reported but never fail the command that raised the event.
+func notify(c context.Context, n *Notifications, event *Event) {
+	recordEvent(event)
+	if n == nil {
+		return
+	}
+	event.Region = awsConfig.Region
+	event.Time = time.Now().UTC()
+
+	message, err := json.MarshalIndent(event, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error encoding the notification:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	for _, topic := range n.SNSTopics {
+		_, err := PublishMessage(c, snsClientFor(topic), &awsapi.PublishInput{
+			TopicArn: topic,
+			Subject:  "aws-vmcreate " + event.Command + " " + event.Status,
+			Message:  string(message),
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error notifying "+topic+":")
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+
+	for _, hook := range n.SlackWebhooks {
+		if err := postJSON(c, hook, map[string]string{"text": event.summary()}); err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error notifying Slack:")
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+
+	for _, hook := range n.Webhooks {
+		if err := postJSON(c, hook, event); err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error notifying "+hook+":")
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEventSummary(t *testing.T) {
+	e := &Event{Command: "create", Status: "succeeded", TagKey: "Name", TagValue: "web", InstanceIDs: []string{"i-1", "i-2"}}
+	if got := e.summary(); got != "aws-vmcreate create succeeded for Name=web (i-1, i-2)" {
+		t.Errorf("got %q", got)
+	}
+	e = &Event{Command: "delete", Status: "failed", Error: "UnauthorizedOperation"}
+	if got := e.summary(); got != "aws-vmcreate delete failed: UnauthorizedOperation" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestSNSClientFor(t *testing.T) {
+	if got := snsClientFor("arn:aws:sns:ap-southeast-2:123456789012:alerts").Region(); got != "ap-southeast-2" {
+		t.Errorf("region %s", got)
+	}
+}
+
+func TestNotifyWebhooks(t *testing.T) {
+	var slack map[string]string
+	var event Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slack":
+			json.NewDecoder(r.Body).Decode(&slack)
+		case "/hook":
+			json.NewDecoder(r.Body).Decode(&event)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	n := &Notifications{SlackWebhooks: []string{server.URL + "/slack"}, Webhooks: []string{server.URL + "/hook"}}
+	notify(context.Background(), n, &Event{Command: "create", Status: "succeeded", TagKey: "Name", TagValue: "web", InstanceIDs: []string{"i-1"}})
+
+	if slack["text"] != "aws-vmcreate create succeeded for Name=web (i-1)" {
+		t.Errorf("Slack got %v", slack)
+	}
+	if event.Command != "create" || event.Status != "succeeded" || len(event.InstanceIDs) != 1 || event.Time.IsZero() {
+		t.Errorf("the webhook got %+v", event)
+	}
+
+	// A webhook that fails is reported, not returned.
+	if err := postJSON(context.Background(), server.URL+"/missing", event); err == nil {
+		t.Error("a 404 webhook succeeded")
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Only the results of a command, such as the instances it created or
+// listed, go to stdout, so that a script can read them. What the command
+// is doing and what went wrong go to stderr.
+
+// quiet is --quiet: the results are only their identifiers, one a line,
+// and the progress is not shown. Errors are still printed.
+var quiet bool
+
+// diagnostics is where the progress of a command goes: stderr, or nowhere
+// with --quiet.
+var diagnostics io.Writer = os.Stderr
+
+// progressln prints what the command is doing.
+func progressln(a ...interface{}) {
+	fmt.Fprintln(diagnostics, a...)
+}
+
+// printResult prints a result of the command, or only its identifier with
+// --quiet.
+func printResult(line string, id string) {
+	if quiet {
+		fmt.Println(id)
+		return
+	}
+	fmt.Println(line)
+}
+
+// failCommand prints what went wrong to stderr and fails the command with
+// it.
+func failCommand(a ...interface{}) {
+	fmt.Fprintln(os.Stderr, a...)
+	commandErr = errors.New(strings.TrimSuffix(fmt.Sprintln(a...), "\n"))
+}
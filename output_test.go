@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"aws-vmcreate/internal/awsapi"
+	"aws-vmcreate/pkg/vmcreate/vmcreatetest"
+)
+
+func TestDiagnosticsGoToStderr(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1"})
+
+	stdout, stderr := runCLIStreams(t, false, "create", "--tag", "Name=web-1", "--no-source-dest-check")
+	id := *fake.Instances()[0].InstanceId
+	if want := "Created tagged instance with ID " + id; !strings.Contains(stdout, want) {
+		t.Errorf("stdout is missing %q:\n%s", want, stdout)
+	}
+	for _, diagnostic := range []string{"Provisioning/De-provisioning EC2 in progress", "Starting create run", "==> "} {
+		if strings.Contains(stdout, diagnostic) || !strings.Contains(stderr, diagnostic) {
+			t.Errorf("%q is not on stderr only:\nstdout:\n%s\nstderr:\n%s", diagnostic, stdout, stderr)
+		}
+	}
+
+	_, stderr = runCLIStreams(t, false, "diff", "i-missing")
+	if !strings.Contains(stderr, "Got an error") {
+		t.Errorf("the error is not on stderr:\n%s", stderr)
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1"})
+
+	stdout, stderr := runCLIStreams(t, false, "create", "--tag", "Name=web", "--count", "2", "--quiet")
+	instances := fake.Instances()
+	ids := *instances[0].InstanceId + "\n" + *instances[1].InstanceId + "\n"
+	if stdout != ids || stderr != "" {
+		t.Errorf("create --quiet printed\nstdout:\n%s\nstderr:\n%s", stdout, stderr)
+	}
+	if stdout, _ := runCLIStreams(t, false, "list", "--tag", "Name=web", "--quiet"); stdout != ids {
+		t.Errorf("list --quiet printed %q, want %q", stdout, ids)
+	}
+	if stdout, _ := runCLIStreams(t, false, "delete", "--tag", "Name=web", "--quiet"); stdout != ids {
+		t.Errorf("delete --quiet printed %q, want %q", stdout, ids)
+	}
+}
+
+func TestProgressGoesToDiagnostics(t *testing.T) {
+	var progress bytes.Buffer
+	defer func(w io.Writer) { diagnostics = w }(diagnostics)
+	diagnostics = &progress
+
+	network := &fakeNetwork{FakeEC2: vmcreatetest.NewFakeEC2()}
+	if _, err := createNetwork(context.Background(), network, networkOptions{Name: "dev", CIDR: "10.0.0.0/16", AZs: 1}); err != nil {
+		t.Fatal(err)
+	}
+	iam := &fakeIAM{roles: map[string][]string{}, profiles: map[string]*awsapi.InstanceProfile{}}
+	if _, err := createInstanceProfile(context.Background(), iam, "vm-ssm", nil, "aws", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Created VPC vpc-1", "Created subnet ", "Created route table ", "Created role vm-ssm", "Created instance profile vm-ssm"} {
+		if !strings.Contains(progress.String(), want) {
+			t.Errorf("the progress is missing %q:\n%s", want, progress.String())
+		}
+	}
+}
+
+func TestUsageErrorsFail(t *testing.T) {
+	useFakeEC2(t)
+	if _, stderr, code := runCLIExit(t, false, "alerts", "--tag", "team=web"); code != 1 || !strings.Contains(stderr, "You must supply enable or disable") {
+		t.Errorf("alerts without an action exited %d:\n%s", code, stderr)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// patchTimeout is how long AWS-RunPatchBaseline may run on an instance.
+const patchTimeout = time.Hour
+
+// patchPollInterval is how often the patch runs are checked on.
+var patchPollInterval = 10 * time.Second
+
+// PatchAPI defines the interface for the Systems Manager functions patch runs the baseline and reads compliance with.
+// We use this interface to test the functions using a mocked service.
+type PatchAPI interface {
+	SSMCommandAPI
+	SSMInstanceAPI
+
+	DescribeInstancePatchStates(ctx context.Context,
+		params *awsapi.DescribeInstancePatchStatesInput) (*awsapi.DescribeInstancePatchStatesOutput, error)
+}
+
+// patchResult is the outcome of patching one instance.
+type patchResult struct {
+	InstanceID string
+	// Status is the status of the AWS-RunPatchBaseline invocation, or why
+	// the instance was not patched.
+	Status string
+	State  *awsapi.InstancePatchState
+}
+
+// Compliant reports whether the instance has no missing or failed patches.
+func (r patchResult) Compliant() bool {
+	return r.State != nil && r.State.MissingCount == 0 && r.State.FailedCount == 0
+}
+
+// onlineInstances returns those of the instances whose SSM agent is online.
+func onlineInstances(c context.Context, api SSMInstanceAPI, instanceIDs []string) (map[string]bool, error) {
+	online := map[string]bool{}
+	input := &awsapi.DescribeInstanceInformationInput{Filters: []awsapi.InstanceInformationFilter{{Key: "InstanceIds", Values: instanceIDs}}}
+	for {
+		result, err := GetManagedInstances(c, api, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range result.InstanceInformationList {
+			if info.PingStatus == "Online" {
+				online[info.InstanceId] = true
+			}
+		}
+		if result.NextToken == "" {
+			return online, nil
+		}
+		input.NextToken = result.NextToken
+	}
+}
+
+// patchInstances runs AWS-RunPatchBaseline on the instances, installing the
+// missing patches or, with scan, only looking for them, and waits for it to
+// finish everywhere. Instances whose SSM agent is offline are skipped. The
+// results are in the order of instanceIDs, with the compliance each run
+// reported.
+func patchInstances(c context.Context, api PatchAPI, instanceIDs []string, scan bool, reboot bool) ([]patchResult, error) {
+	online, err := onlineInstances(c, api, instanceIDs)
+	if err != nil {
+		return nil, fmt.Errorf("listing the instances managed by Systems Manager: %w", err)
+	}
+	results := make([]patchResult, len(instanceIDs))
+	var targets []string
+	for n, id := range instanceIDs {
+		results[n] = patchResult{InstanceID: id, Status: "not managed by Systems Manager"}
+		if online[id] {
+			targets = append(targets, id)
+		}
+	}
+	if len(targets) == 0 {
+		return results, nil
+	}
+
+	parameters := map[string][]string{"Operation": {"Install"}, "RebootOption": {"RebootIfNeeded"}}
+	if scan {
+		parameters["Operation"] = []string{"Scan"}
+	}
+	if !reboot {
+		parameters["RebootOption"] = []string{"NoReboot"}
+	}
+	// SendCommand takes at most 50 instances.
+	commands := map[string]string{}
+	for start := 0; start < len(targets); start += 50 {
+		batch := targets[start:]
+		if len(batch) > 50 {
+			batch = batch[:50]
+		}
+		sent, err := RunCommand(c, api, &awsapi.SendCommandInput{
+			InstanceIds:    batch,
+			DocumentName:   "AWS-RunPatchBaseline",
+			Parameters:     parameters,
+			Comment:        "aws-vmcreate patch",
+			TimeoutSeconds: int(patchTimeout / time.Second),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("running AWS-RunPatchBaseline: %w", err)
+		}
+		for _, id := range batch {
+			commands[id] = sent.Command.CommandId
+		}
+	}
+
+	status := map[string]string{}
+	for len(status) < len(targets) {
+		select {
+		case <-c.Done():
+			return nil, c.Err()
+		case <-time.After(patchPollInterval):
+		}
+		for _, id := range targets {
+			if _, done := status[id]; done {
+				continue
+			}
+			invocation, err := GetCommandResult(c, api, &awsapi.GetCommandInvocationInput{CommandId: commands[id], InstanceId: id})
+			var apiErr *awsapi.Error
+			if errors.As(err, &apiErr) && apiErr.Code == "InvocationDoesNotExist" {
+				// The invocation is not visible until shortly after SendCommand returns.
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("checking on the patching of %s: %w", id, err)
+			}
+			switch invocation.Status {
+			case "Pending", "InProgress", "Delayed":
+			default:
+				status[id] = invocation.Status
+			}
+		}
+	}
+
+	states := map[string]*awsapi.InstancePatchState{}
+	for start := 0; start < len(targets); start += 50 {
+		input := &awsapi.DescribeInstancePatchStatesInput{InstanceIds: targets[start:]}
+		if len(input.InstanceIds) > 50 {
+			input.InstanceIds = input.InstanceIds[:50]
+		}
+		for {
+			page, err := api.DescribeInstancePatchStates(c, input)
+			if err != nil {
+				return nil, fmt.Errorf("reading the patch compliance: %w", err)
+			}
+			for n := range page.InstancePatchStates {
+				states[page.InstancePatchStates[n].InstanceId] = &page.InstancePatchStates[n]
+			}
+			if page.NextToken == "" {
+				break
+			}
+			input.NextToken = page.NextToken
+		}
+	}
+	for n := range results {
+		if s, ok := status[results[n].InstanceID]; ok {
+			results[n].Status, results[n].State = s, states[results[n].InstanceID]
+		}
+	}
+	return results, nil
+}
+
+func PatchCmd(name *string, value *string, scan *bool, noReboot *bool) {
+	// Without a tag, the instances created by aws-vmcreate are patched.
+	filters := []types.Filter{vmcreate.StateFilter("running"), vmcreate.TagKeyFilter(createdByTag)}
+	if *name != "" && *value != "" {
+		filters[1] = vmcreate.TagFilter(*name, strings.Split(*value, ",")...)
+	} else if *name != "" {
+		filters[1] = vmcreate.TagKeyFilter(*name)
+	}
+	instances, err := provisioner.List(context.TODO(), filters...)
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error listing the instances:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	if len(instances) == 0 {
+		fmt.Println("No running instances to patch")
+		return
+	}
+	var ids []string
+	names := map[string]string{}
+	for _, i := range instances {
+		ids = append(ids, aws.ToString(i.InstanceId))
+		names[aws.ToString(i.InstanceId)] = tagName(i.Tags)
+	}
+
+	operation := "Patching"
+	if *scan {
+		operation = "Scanning"
+	}
+	fmt.Printf("%s %d instances with AWS-RunPatchBaseline\n", operation, len(ids))
+	c, cancel := context.WithTimeout(context.TODO(), patchTimeout+5*time.Minute)
+	defer cancel()
+	results, err := patchInstances(c, ssmClient, ids, *scan, !*noReboot)
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error patching the instances:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tNAME\tSTATUS\tINSTALLED\tPENDING REBOOT\tMISSING\tFAILED\tCOMPLIANCE")
+	noncompliant := 0
+	for _, r := range results {
+		counts, compliance := "-\t-\t-\t-", "unknown"
+		if r.State != nil {
+			counts = fmt.Sprintf("%d\t%d\t%d\t%d", r.State.InstalledCount, r.State.InstalledPendingRebootCount, r.State.MissingCount, r.State.FailedCount)
+			compliance = "compliant"
+		}
+		if !r.Compliant() {
+			noncompliant++
+			if r.State != nil {
+				compliance = "non-compliant"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.InstanceID, names[r.InstanceID], r.Status, counts, compliance)
+	}
+	w.Flush()
+
+	if noncompliant > 0 {
+		fmt.Printf("%d of %d instances are not compliant\n", noncompliant, len(results))
+		exit(1)
+	}
+	fmt.Printf("All %d instances are compliant\n", len(results))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+)
+
+// fakePatchSSM runs AWS-RunPatchBaseline on its online instances, each
+// taking polls invocations before it resolves to its status.
+type fakePatchSSM struct {
+	online []string
+	status map[string]string
+	states []awsapi.InstancePatchState
+	polls  map[string]int
+	sent   []*awsapi.SendCommandInput
+}
+
+func (f *fakePatchSSM) DescribeInstanceInformation(ctx context.Context, params *awsapi.DescribeInstanceInformationInput) (*awsapi.DescribeInstanceInformationOutput, error) {
+	out := &awsapi.DescribeInstanceInformationOutput{}
+	for _, id := range f.online {
+		out.InstanceInformationList = append(out.InstanceInformationList, awsapi.InstanceInformation{InstanceId: id, PingStatus: "Online"})
+	}
+	return out, nil
+}
+
+func (f *fakePatchSSM) SendCommand(ctx context.Context, params *awsapi.SendCommandInput) (*awsapi.SendCommandOutput, error) {
+	f.sent = append(f.sent, params)
+	return &awsapi.SendCommandOutput{Command: awsapi.Command{CommandId: "cmd-1"}}, nil
+}
+
+func (f *fakePatchSSM) GetCommandInvocation(ctx context.Context, params *awsapi.GetCommandInvocationInput) (*awsapi.GetCommandInvocationOutput, error) {
+	f.polls[params.InstanceId]++
+	if f.polls[params.InstanceId] < 2 {
+		return &awsapi.GetCommandInvocationOutput{Status: "InProgress"}, nil
+	}
+	return &awsapi.GetCommandInvocationOutput{Status: f.status[params.InstanceId]}, nil
+}
+
+func (f *fakePatchSSM) DescribeInstancePatchStates(ctx context.Context, params *awsapi.DescribeInstancePatchStatesInput) (*awsapi.DescribeInstancePatchStatesOutput, error) {
+	return &awsapi.DescribeInstancePatchStatesOutput{InstancePatchStates: f.states}, nil
+}
+
+func TestPatchInstances(t *testing.T) {
+	defer func(interval time.Duration) { patchPollInterval = interval }(patchPollInterval)
+	patchPollInterval = time.Millisecond
+
+	fake := &fakePatchSSM{
+		online: []string{"i-1", "i-2"},
+		status: map[string]string{"i-1": "Success", "i-2": "Failed"},
+		states: []awsapi.InstancePatchState{
+			{InstanceId: "i-1", InstalledCount: 40},
+			{InstanceId: "i-2", InstalledCount: 38, MissingCount: 1, FailedCount: 1},
+		},
+		polls: map[string]int{},
+	}
+	results, err := patchInstances(context.Background(), fake, []string{"i-1", "i-2", "i-offline"}, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.sent) != 1 || strings.Join(fake.sent[0].InstanceIds, ",") != "i-1,i-2" {
+		t.Fatalf("sent %+v, want one command to the online instances", fake.sent)
+	}
+	if p := fake.sent[0].Parameters; p["Operation"][0] != "Install" || p["RebootOption"][0] != "NoReboot" {
+		t.Errorf("parameters = %v", p)
+	}
+	var got []string
+	for _, r := range results {
+		got = append(got, r.InstanceID+"="+r.Status)
+	}
+	if want := "i-1=Success,i-2=Failed,i-offline=not managed by Systems Manager"; strings.Join(got, ",") != want {
+		t.Errorf("got %s, want %s", strings.Join(got, ","), want)
+	}
+	if !results[0].Compliant() || results[1].Compliant() || results[2].Compliant() {
+		t.Errorf("only i-1 is compliant: %+v", results)
+	}
+}
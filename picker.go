@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// pickerRows is how many matches the picker shows at once.
+const pickerRows = 15
+
+// errPickCanceled is returned when the picker is left without a choice.
+var errPickCanceled = errors.New("no instance was picked")
+
+// fuzzyScore matches query against text like fzf: the characters of the
+// query must appear in the text in order, ignoring case. Characters that
+// follow each other or start a word score higher, so that "web1" ranks
+// web-1 over a-web-server-1.
+func fuzzyScore(query, text string) (int, bool) {
+	q, t := []rune(strings.ToLower(query)), []rune(strings.ToLower(text))
+	score, last := 0, -2
+	n := 0
+	for i, r := range t {
+		if n == len(q) {
+			break
+		}
+		if r != q[n] {
+			continue
+		}
+		score++
+		if i == last+1 {
+			score += 2
+		}
+		if i == 0 || !unicode.IsLetter(t[i-1]) && !unicode.IsDigit(t[i-1]) {
+			score++
+		}
+		last = i
+		n++
+	}
+	return score, n == len(q)
+}
+
+// pickerState is the query typed into the picker and the instances it
+// filters.
+type pickerState struct {
+	Title     string
+	Instances []types.Instance
+	Query     string
+	// Selected is the index of the selected match.
+	Selected int
+}
+
+// pickerLine is how an instance is shown and matched in the picker.
+func pickerLine(i *types.Instance) string {
+	return strings.Join([]string{
+		aws.ToString(i.InstanceId),
+		vmcreate.TagValue(i, "Name"),
+		instanceState(i),
+		string(i.InstanceType),
+		aws.ToString(i.PrivateIpAddress),
+	}, "  ")
+}
+
+// matches returns the instances matching the query, best first.
+func (s *pickerState) matches() []types.Instance {
+	type match struct {
+		instance types.Instance
+		score    int
+	}
+	var found []match
+	for _, i := range s.Instances {
+		if score, ok := fuzzyScore(s.Query, pickerLine(&i)); ok {
+			found = append(found, match{i, score})
+		}
+	}
+	sort.SliceStable(found, func(a, b int) bool { return found[a].score > found[b].score })
+	instances := make([]types.Instance, len(found))
+	for n, m := range found {
+		instances[n] = m.instance
+	}
+	return instances
+}
+
+// handleKey applies a key press, and returns the picked instance once
+// Enter is pressed on one, or errPickCanceled on Esc or Ctrl-C.
+func (s *pickerState) handleKey(key string) (*types.Instance, error) {
+	switch key {
+	case "\x1b", "\x03":
+		return nil, errPickCanceled
+	case "\r", "\n":
+		if matches := s.matches(); s.Selected < len(matches) {
+			return &matches[s.Selected], nil
+		}
+	case "\x1b[A", "\x10":
+		if s.Selected > 0 {
+			s.Selected--
+		}
+	case "\x1b[B", "\x0e":
+		if s.Selected < len(s.matches())-1 {
+			s.Selected++
+		}
+	case "\x7f", "\b":
+		if q := []rune(s.Query); len(q) > 0 {
+			s.Query, s.Selected = string(q[:len(q)-1]), 0
+		}
+	default:
+		if r := []rune(key); len(r) == 1 && unicode.IsPrint(r[0]) {
+			s.Query, s.Selected = s.Query+key, 0
+		}
+	}
+	return nil, nil
+}
+
+// renderPicker draws the picker, the selected match in reverse video.
+func renderPicker(w io.Writer, s *pickerState) {
+	var screen strings.Builder
+	screen.WriteString("\x1b[H\x1b[2J")
+	matches := s.matches()
+	fmt.Fprintf(&screen, "%s  %d/%d\r\n> %s\r\n", s.Title, len(matches), len(s.Instances), s.Query)
+	for n, i := range matches {
+		if n == pickerRows {
+			break
+		}
+		line := pickerLine(&i)
+		if n == s.Selected {
+			line = "\x1b[7m" + line + "\x1b[0m"
+		}
+		screen.WriteString(line + "\r\n")
+	}
+	screen.WriteString("\r\ntype to filter  ↑/↓ select  Enter pick  Esc cancel\r\n")
+	io.WriteString(w, screen.String())
+}
+
+// pickInstance lets the instances created by aws-vmcreate be picked in the
+// terminal, for a command run without the instance it acts on.
+func pickInstance(c context.Context, title string) (*types.Instance, error) {
+	instances, err := provisioner.List(c, vmcreate.StateFilter(vmcreate.LiveStates...), vmcreate.TagKeyFilter(createdByTag))
+	if err != nil {
+		return nil, fmt.Errorf("listing the instances to pick from: %w", err)
+	}
+	if len(instances) == 0 {
+		return nil, errors.New("there are no instances to pick from")
+	}
+
+	restore, err := rawTerminal()
+	if err != nil {
+		return nil, err
+	}
+	defer restore()
+	s := &pickerState{Title: title, Instances: instances}
+	buf := make([]byte, 16)
+	for {
+		renderPicker(os.Stdout, s)
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		picked, err := s.handleKey(string(buf[:n]))
+		if picked != nil || err != nil {
+			return picked, err
+		}
+	}
+}
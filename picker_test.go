@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestFuzzyScore(t *testing.T) {
+	if _, ok := fuzzyScore("wb1", "web-1"); !ok {
+		t.Error("wb1 does not match web-1")
+	}
+	if _, ok := fuzzyScore("1bw", "web-1"); ok {
+		t.Error("1bw matches web-1 out of order")
+	}
+	near, _ := fuzzyScore("web1", "web-1")
+	far, _ := fuzzyScore("web1", "a-wide-eb-server-1")
+	if near <= far {
+		t.Errorf("web-1 scores %d, not over %d", near, far)
+	}
+}
+
+func TestPicker(t *testing.T) {
+	instance := func(id, name string) types.Instance {
+		return types.Instance{InstanceId: aws.String(id), Tags: tagged("Name", name).Tags}
+	}
+	s := &pickerState{Title: "Pick the instance to connect", Instances: []types.Instance{
+		instance("i-1", "db-primary"),
+		instance("i-2", "web-1"),
+		instance("i-3", "web-2"),
+	}}
+	for _, key := range []string{"w", "e", "b"} {
+		s.handleKey(key)
+	}
+	if n := len(s.matches()); n != 2 {
+		t.Fatalf("%d matches for web", n)
+	}
+	var screen strings.Builder
+	renderPicker(&screen, s)
+	if !strings.Contains(screen.String(), "2/3") || !strings.Contains(screen.String(), "\x1b[7mi-2") {
+		t.Errorf("screen:\n%q", screen.String())
+	}
+
+	s.handleKey("\x1b[B")
+	picked, err := s.handleKey("\r")
+	if err != nil || picked == nil || *picked.InstanceId != "i-3" {
+		t.Errorf("picked %v, %v", picked, err)
+	}
+
+	s.handleKey("\x7f")
+	s.handleKey("\x7f")
+	s.handleKey("\x7f")
+	if s.Query != "" || len(s.matches()) != 3 {
+		t.Errorf("query %q after erasing it", s.Query)
+	}
+	if _, err := s.handleKey("\x1b"); err != errPickCanceled {
+		t.Errorf("Esc = %v", err)
+	}
+}
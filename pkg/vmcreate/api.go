@@ -0,0 +1,129 @@
+package vmcreate
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// EC2CreateInstanceAPI defines the interface for the EC2 functions used by the Provisioner.
+// We use this interface to test the functions using a mocked service.
+type EC2CreateInstanceAPI interface {
+	RunInstances(ctx context.Context,
+		params *ec2.RunInstancesInput,
+		optFns ...func(*ec2.Options)) (*ec2.RunInstancesOutput, error)
+
+	CreateTags(ctx context.Context,
+		params *ec2.CreateTagsInput,
+		optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error)
+
+	TerminateInstances(ctx context.Context,
+		params *ec2.TerminateInstancesInput,
+		optFns ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error)
+
+	DescribeInstances(ctx context.Context,
+		params *ec2.DescribeInstancesInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
+
+	ModifyInstanceAttribute(ctx context.Context,
+		params *ec2.ModifyInstanceAttributeInput,
+		optFns ...func(*ec2.Options)) (*ec2.ModifyInstanceAttributeOutput, error)
+
+	StopInstances(ctx context.Context,
+		params *ec2.StopInstancesInput,
+		optFns ...func(*ec2.Options)) (*ec2.StopInstancesOutput, error)
+
+	StartInstances(ctx context.Context,
+		params *ec2.StartInstancesInput,
+		optFns ...func(*ec2.Options)) (*ec2.StartInstancesOutput, error)
+}
+
+// MakeInstance creates an Amazon Elastic Compute Cloud (Amazon EC2) instance.
+// Inputs:
+//
+//	c is the context of the method call, which includes the AWS Region.
+//	api is the interface that defines the method call.
+//	input defines the input arguments to the service call.
+//
+// Output:
+//
+//	If success, a RunInstancesOutput object containing the result of the service call and nil.
+//	Otherwise, nil and an error from the call to RunInstances.
+func MakeInstance(c context.Context, api EC2CreateInstanceAPI, input *ec2.RunInstancesInput) (*ec2.RunInstancesOutput, error) {
+	return api.RunInstances(c, input)
+}
+
+// MakeTags creates tags for an Amazon Elastic Compute Cloud (Amazon EC2) instance.
+// Inputs:
+//
+//	c is the context of the method call, which includes the AWS Region.
+//	api is the interface that defines the method call.
+//	input defines the input arguments to the service call.
+//
+// Output:
+//
+//	If success, a CreateTagsOutput object containing the result of the service call and nil.
+//	Otherwise, nil and an error from the call to CreateTags.
+func MakeTags(c context.Context, api EC2CreateInstanceAPI, input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	return api.CreateTags(c, input)
+}
+
+// DeleteInstance deletes an Amazon Elastic Compute Cloud (Amazon EC2) instance.
+// Inputs:
+//
+//	c is the context of the method call, which includes the AWS Region.
+//	api is the interface that defines the method call.
+//	input defines the input arguments to the service call.
+//
+// Output:
+//
+//	If success, a TerminateInstancesInput object containing the result of the service call and nil.
+//	Otherwise, nil and an error from the call to TerminateInstances.
+func DeleteInstance(c context.Context, api EC2CreateInstanceAPI, input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+	return api.TerminateInstances(c, input)
+}
+
+// UpdateInstanceAttribute modifies an attribute of an Amazon Elastic Compute Cloud (Amazon EC2) instance.
+// Inputs:
+//
+//	c is the context of the method call, which includes the AWS Region.
+//	api is the interface that defines the method call.
+//	input defines the input arguments to the service call.
+//
+// Output:
+//
+//	If success, a ModifyInstanceAttributeOutput object containing the result of the service call and nil.
+//	Otherwise, nil and an error from the call to ModifyInstanceAttribute.
+func UpdateInstanceAttribute(c context.Context, api EC2CreateInstanceAPI, input *ec2.ModifyInstanceAttributeInput) (*ec2.ModifyInstanceAttributeOutput, error) {
+	return api.ModifyInstanceAttribute(c, input)
+}
+
+// PauseInstances stops Amazon Elastic Compute Cloud (Amazon EC2) instances.
+// Inputs:
+//
+//	c is the context of the method call, which includes the AWS Region.
+//	api is the interface that defines the method call.
+//	input defines the input arguments to the service call.
+//
+// Output:
+//
+//	If success, a StopInstancesOutput object containing the result of the service call and nil.
+//	Otherwise, nil and an error from the call to StopInstances.
+func PauseInstances(c context.Context, api EC2CreateInstanceAPI, input *ec2.StopInstancesInput) (*ec2.StopInstancesOutput, error) {
+	return api.StopInstances(c, input)
+}
+
+// ResumeInstances starts stopped Amazon Elastic Compute Cloud (Amazon EC2) instances.
+// Inputs:
+//
+//	c is the context of the method call, which includes the AWS Region.
+//	api is the interface that defines the method call.
+//	input defines the input arguments to the service call.
+//
+// Output:
+//
+//	If success, a StartInstancesOutput object containing the result of the service call and nil.
+//	Otherwise, nil and an error from the call to StartInstances.
+func ResumeInstances(c context.Context, api EC2CreateInstanceAPI, input *ec2.StartInstancesInput) (*ec2.StartInstancesOutput, error) {
+	return api.StartInstances(c, input)
+}
@@ -0,0 +1,201 @@
+package vmcreate
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// EC2Provider is the Provider backed by the Amazon EC2 API.
+type EC2Provider struct {
+	api EC2CreateInstanceAPI
+}
+
+// NewEC2Provider returns a Provider making its calls through api.
+func NewEC2Provider(api EC2CreateInstanceAPI) *EC2Provider {
+	return &EC2Provider{api: api}
+}
+
+// CreateInstances launches the instances, tagging them at launch.
+func (e *EC2Provider) CreateInstances(ctx context.Context, in *CreateInput) ([]types.Instance, error) {
+	input := runInstancesInput(in)
+	if in.Customize != nil {
+		in.Customize(input)
+	}
+
+	result, err := MakeInstance(ctx, e.api, input)
+	if err != nil {
+		return nil, err
+	}
+	return result.Instances, nil
+}
+
+// DeleteInstances terminates the instances.
+func (e *EC2Provider) DeleteInstances(ctx context.Context, instanceIDs []string) ([]string, error) {
+	result, err := DeleteInstance(ctx, e.api, &ec2.TerminateInstancesInput{InstanceIds: instanceIDs})
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, i := range result.TerminatingInstances {
+		ids = append(ids, aws.ToString(i.InstanceId))
+	}
+	return ids, nil
+}
+
+// ListInstances pages through DescribeInstances.
+func (e *EC2Provider) ListInstances(ctx context.Context, filters ...types.Filter) ([]types.Instance, error) {
+	var instances []types.Instance
+	paginator := ec2.NewDescribeInstancesPaginator(e.api, &ec2.DescribeInstancesInput{Filters: filters})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range page.Reservations {
+			instances = append(instances, r.Instances...)
+		}
+	}
+	return instances, nil
+}
+
+// TagInstances creates the tags on the instances.
+func (e *EC2Provider) TagInstances(ctx context.Context, instanceIDs []string, tags map[string]string) error {
+	_, err := MakeTags(ctx, e.api, &ec2.CreateTagsInput{
+		Resources: instanceIDs,
+		Tags:      Tags(tags),
+	})
+	return err
+}
+
+// StopInstances stops the instances.
+func (e *EC2Provider) StopInstances(ctx context.Context, instanceIDs []string) error {
+	_, err := PauseInstances(ctx, e.api, &ec2.StopInstancesInput{InstanceIds: instanceIDs})
+	return err
+}
+
+// StartInstances starts the instances.
+func (e *EC2Provider) StartInstances(ctx context.Context, instanceIDs []string) error {
+	_, err := ResumeInstances(ctx, e.api, &ec2.StartInstancesInput{InstanceIds: instanceIDs})
+	return err
+}
+
+// SetSourceDestCheck turns the source/destination check of the instance on or off.
+func (e *EC2Provider) SetSourceDestCheck(ctx context.Context, instanceID string, enabled bool) error {
+	_, err := UpdateInstanceAttribute(ctx, e.api, &ec2.ModifyInstanceAttributeInput{
+		InstanceId:      aws.String(instanceID),
+		SourceDestCheck: &types.AttributeBooleanValue{Value: aws.Bool(enabled)},
+	})
+	return err
+}
+
+// ResizeInstance stops a running instance, changes its type and starts it
+// again. A stopped instance is left stopped.
+func (e *EC2Provider) ResizeInstance(ctx context.Context, instanceID string, instanceType string, timeout time.Duration) error {
+	result, err := e.api.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{instanceID}})
+	if err != nil {
+		return err
+	}
+	var instance *types.Instance
+	for _, r := range result.Reservations {
+		if len(r.Instances) > 0 {
+			instance = &r.Instances[0]
+		}
+	}
+	if instance == nil {
+		return fmt.Errorf("instance %s not found", instanceID)
+	}
+	if string(instance.InstanceType) == instanceType {
+		return nil
+	}
+
+	ids := &ec2.DescribeInstancesInput{InstanceIds: []string{instanceID}}
+	wasRunning := false
+	switch instance.State.Name {
+	case types.InstanceStateNameRunning, types.InstanceStateNamePending:
+		wasRunning = true
+		_, err = PauseInstances(ctx, e.api, &ec2.StopInstancesInput{
+			InstanceIds: []string{instanceID},
+			Force:       aws.Bool(false),
+		})
+		if err != nil {
+			return fmt.Errorf("stopping %s: %w", instanceID, err)
+		}
+		if err := ec2.NewInstanceStoppedWaiter(e.api).Wait(ctx, ids, timeout); err != nil {
+			return err
+		}
+	case types.InstanceStateNameStopping:
+		if err := ec2.NewInstanceStoppedWaiter(e.api).Wait(ctx, ids, timeout); err != nil {
+			return err
+		}
+	case types.InstanceStateNameStopped:
+	default:
+		return fmt.Errorf("instance %s is %s", instanceID, instance.State.Name)
+	}
+
+	_, err = UpdateInstanceAttribute(ctx, e.api, &ec2.ModifyInstanceAttributeInput{
+		InstanceId:   aws.String(instanceID),
+		InstanceType: &types.AttributeValue{Value: aws.String(instanceType)},
+	})
+	if err != nil {
+		return fmt.Errorf("changing the type of %s: %w", instanceID, err)
+	}
+
+	if wasRunning {
+		if _, err := ResumeInstances(ctx, e.api, &ec2.StartInstancesInput{InstanceIds: []string{instanceID}}); err != nil {
+			return fmt.Errorf("starting %s: %w", instanceID, err)
+		}
+		return ec2.NewInstanceRunningWaiter(e.api).Wait(ctx, ids, timeout)
+	}
+	return nil
+}
+
+// MigrateInstance stops the instance and starts it again, which moves it
+// off the host a scheduled event would take down.
+func (e *EC2Provider) MigrateInstance(ctx context.Context, instanceID string, timeout time.Duration) error {
+	ids := &ec2.DescribeInstancesInput{InstanceIds: []string{instanceID}}
+	_, err := PauseInstances(ctx, e.api, &ec2.StopInstancesInput{
+		InstanceIds: []string{instanceID},
+		Force:       aws.Bool(false),
+	})
+	if err != nil {
+		return fmt.Errorf("stopping %s: %w", instanceID, err)
+	}
+	if err := ec2.NewInstanceStoppedWaiter(e.api).Wait(ctx, ids, timeout); err != nil {
+		return err
+	}
+	if _, err := ResumeInstances(ctx, e.api, &ec2.StartInstancesInput{InstanceIds: []string{instanceID}}); err != nil {
+		return fmt.Errorf("starting %s: %w", instanceID, err)
+	}
+	return ec2.NewInstanceRunningWaiter(e.api).Wait(ctx, ids, timeout)
+}
+
+// runInstancesInput is the RunInstances request for in, before Customize.
+func runInstancesInput(in *CreateInput) *ec2.RunInstancesInput {
+	count := int32(in.Count)
+	input := &ec2.RunInstancesInput{
+		ImageId:      aws.String(in.ImageID),
+		InstanceType: types.InstanceType(in.InstanceType),
+		MinCount:     &count,
+		MaxCount:     &count,
+		UserData:     in.UserData,
+	}
+	if in.SubnetID != "" {
+		input.SubnetId = aws.String(in.SubnetID)
+	}
+	if len(in.Tags) > 0 {
+		// The volumes and network interfaces launched with the instance carry
+		// the same tags, so they can be attributed too.
+		input.TagSpecifications = []types.TagSpecification{
+			{ResourceType: types.ResourceTypeInstance, Tags: Tags(in.Tags)},
+			{ResourceType: types.ResourceTypeVolume, Tags: Tags(in.Tags)},
+			{ResourceType: types.ResourceTypeNetworkInterface, Tags: Tags(in.Tags)},
+		}
+	}
+	return input
+}
@@ -0,0 +1,29 @@
+package vmcreate
+
+import (
+	"errors"
+
+	"github.com/aws/smithy-go"
+)
+
+// capacityErrorCodes are the RunInstances errors that mean the region cannot
+// run the instance right now, as opposed to a problem with the request.
+var capacityErrorCodes = map[string]bool{
+	"InsufficientInstanceCapacity":         true,
+	"InsufficientCapacity":                 true,
+	"InsufficientHostCapacity":             true,
+	"InsufficientReservedInstanceCapacity": true,
+	"InstanceLimitExceeded":                true,
+	"VcpuLimitExceeded":                    true,
+	"MaxSpotInstanceCountExceeded":         true,
+	"Unsupported":                          true,
+	"InsufficientFreeAddressesInSubnet":    true,
+	"ReservationCapacityExceeded":          true,
+}
+
+// IsCapacityError reports whether err is EC2 running out of capacity or
+// quota for the launch, which another region or zone may still satisfy.
+func IsCapacityError(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && capacityErrorCodes[apiErr.ErrorCode()]
+}
@@ -0,0 +1,314 @@
+package vmcreate
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+)
+
+// MemoryProvider is a Provider that keeps its instances in memory instead
+// of launching them, for trying the tool and for tests that run without
+// AWS. Launched instances are running at once, and terminated ones are kept
+// in the terminated state, as EC2 lists them for a while. It is safe for
+// concurrent use.
+type MemoryProvider struct {
+	// Zone is the availability zone instances are placed in when the
+	// launch does not choose one.
+	Zone string
+
+	mu        sync.Mutex
+	instances map[string]*types.Instance
+	order     []string
+	next      int
+}
+
+// NewMemoryProvider returns an empty MemoryProvider placing instances in
+// us-east-1a.
+func NewMemoryProvider() *MemoryProvider {
+	return &MemoryProvider{Zone: "us-east-1a", instances: map[string]*types.Instance{}}
+}
+
+// CreateInstances stores in.Count running instances. Customize is applied
+// to the RunInstancesInput EC2Provider would send, and the instances take
+// their image, type, subnet, key pair, security groups, placement, private
+// address and tags from it.
+func (m *MemoryProvider) CreateInstances(ctx context.Context, in *CreateInput) ([]types.Instance, error) {
+	input := runInstancesInput(in)
+	if in.Customize != nil {
+		in.Customize(input)
+	}
+	count := int(aws.ToInt32(input.MaxCount))
+	if count < 1 {
+		return nil, memoryError("InvalidParameterValue", "MaxCount must be at least 1")
+	}
+	if count > 1 && input.PrivateIpAddress != nil {
+		return nil, memoryError("InvalidParameterCombination", "PrivateIpAddress can only be used with a single instance")
+	}
+
+	var tags []types.Tag
+	for _, spec := range input.TagSpecifications {
+		if spec.ResourceType == types.ResourceTypeInstance {
+			tags = append(tags, spec.Tags...)
+		}
+	}
+	var groups []types.GroupIdentifier
+	for _, id := range input.SecurityGroupIds {
+		groups = append(groups, types.GroupIdentifier{GroupId: aws.String(id)})
+	}
+	zone := m.Zone
+	if input.Placement != nil && input.Placement.AvailabilityZone != nil {
+		zone = aws.ToString(input.Placement.AvailabilityZone)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var instances []types.Instance
+	for n := 0; n < count; n++ {
+		m.next++
+		id := fmt.Sprintf("i-%017x", m.next)
+		privateIP := input.PrivateIpAddress
+		if privateIP == nil {
+			privateIP = aws.String(fmt.Sprintf("10.0.%d.%d", m.next/250, m.next%250+4))
+		}
+		instance := &types.Instance{
+			InstanceId:       aws.String(id),
+			ImageId:          input.ImageId,
+			InstanceType:     input.InstanceType,
+			SubnetId:         input.SubnetId,
+			KeyName:          input.KeyName,
+			SecurityGroups:   groups,
+			Tags:             append([]types.Tag(nil), tags...),
+			LaunchTime:       aws.Time(time.Now().UTC()),
+			State:            &types.InstanceState{Name: types.InstanceStateNameRunning, Code: aws.Int32(16)},
+			PrivateIpAddress: privateIP,
+			Placement:        &types.Placement{AvailabilityZone: aws.String(zone)},
+			SourceDestCheck:  aws.Bool(true),
+		}
+		m.instances[id] = instance
+		m.order = append(m.order, id)
+		instances = append(instances, copyMemoryInstance(instance))
+	}
+	return instances, nil
+}
+
+// DeleteInstances moves the instances to the terminated state.
+func (m *MemoryProvider) DeleteInstances(ctx context.Context, instanceIDs []string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	instances, err := m.lookup(instanceIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range instances {
+		i.State = &types.InstanceState{Name: types.InstanceStateNameTerminated, Code: aws.Int32(48)}
+	}
+	return instanceIDs, nil
+}
+
+// ListInstances returns the instances matching all filters, in the order
+// they were launched. It understands the tag:KEY, tag-key,
+// instance-state-name, instance-id, instance-type, image-id, subnet-id,
+// availability-zone and private-ip-address filters; others are an error.
+func (m *MemoryProvider) ListInstances(ctx context.Context, filters ...types.Filter) ([]types.Instance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var instances []types.Instance
+	for _, id := range m.order {
+		i := m.instances[id]
+		ok, err := memoryMatches(i, filters)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			instances = append(instances, copyMemoryInstance(i))
+		}
+	}
+	return instances, nil
+}
+
+// TagInstances adds or overwrites tags on the instances.
+func (m *MemoryProvider) TagInstances(ctx context.Context, instanceIDs []string, tags map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	instances, err := m.lookup(instanceIDs)
+	if err != nil {
+		return err
+	}
+	for _, i := range instances {
+		for _, tag := range Tags(tags) {
+			replaced := false
+			for n, existing := range i.Tags {
+				if aws.ToString(existing.Key) == aws.ToString(tag.Key) {
+					i.Tags[n] = tag
+					replaced = true
+				}
+			}
+			if !replaced {
+				i.Tags = append(i.Tags, tag)
+			}
+		}
+	}
+	return nil
+}
+
+// StopInstances stops the instances.
+func (m *MemoryProvider) StopInstances(ctx context.Context, instanceIDs []string) error {
+	return m.setState(instanceIDs, types.InstanceStateNameStopped, 80)
+}
+
+// StartInstances starts the instances.
+func (m *MemoryProvider) StartInstances(ctx context.Context, instanceIDs []string) error {
+	return m.setState(instanceIDs, types.InstanceStateNameRunning, 16)
+}
+
+// SetSourceDestCheck turns the source/destination check of the instance on or off.
+func (m *MemoryProvider) SetSourceDestCheck(ctx context.Context, instanceID string, enabled bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	instances, err := m.lookup([]string{instanceID})
+	if err != nil {
+		return err
+	}
+	instances[0].SourceDestCheck = aws.Bool(enabled)
+	return nil
+}
+
+// ResizeInstance changes the type of a running or stopped instance, which
+// keeps its state.
+func (m *MemoryProvider) ResizeInstance(ctx context.Context, instanceID string, instanceType string, timeout time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	instances, err := m.lookup([]string{instanceID})
+	if err != nil {
+		return err
+	}
+	i := instances[0]
+	if i.State.Name != types.InstanceStateNameRunning && i.State.Name != types.InstanceStateNameStopped {
+		return fmt.Errorf("instance %s is %s", instanceID, i.State.Name)
+	}
+	i.InstanceType = types.InstanceType(instanceType)
+	return nil
+}
+
+// MigrateInstance succeeds for a running instance; there is no hardware to
+// move it off.
+func (m *MemoryProvider) MigrateInstance(ctx context.Context, instanceID string, timeout time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	instances, err := m.lookup([]string{instanceID})
+	if err != nil {
+		return err
+	}
+	if state := instances[0].State.Name; state != types.InstanceStateNameRunning {
+		return fmt.Errorf("instance %s is %s", instanceID, state)
+	}
+	return nil
+}
+
+func (m *MemoryProvider) setState(instanceIDs []string, state types.InstanceStateName, code int32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	instances, err := m.lookup(instanceIDs)
+	if err != nil {
+		return err
+	}
+	for _, i := range instances {
+		if i.State.Name == types.InstanceStateNameTerminated {
+			return memoryError("IncorrectInstanceState", "The instance '"+aws.ToString(i.InstanceId)+"' is terminated")
+		}
+	}
+	for _, i := range instances {
+		i.State = &types.InstanceState{Name: state, Code: aws.Int32(code)}
+	}
+	return nil
+}
+
+// lookup returns the instances with the IDs, failing like EC2 does when one
+// does not exist. The caller holds m.mu.
+func (m *MemoryProvider) lookup(instanceIDs []string) ([]*types.Instance, error) {
+	if len(instanceIDs) == 0 {
+		return nil, memoryError("MissingParameter", "The request must contain the parameter InstanceId")
+	}
+	var instances []*types.Instance
+	for _, id := range instanceIDs {
+		i, ok := m.instances[id]
+		if !ok {
+			return nil, memoryError("InvalidInstanceID.NotFound", "The instance ID '"+id+"' does not exist")
+		}
+		instances = append(instances, i)
+	}
+	return instances, nil
+}
+
+func memoryMatches(i *types.Instance, filters []types.Filter) (bool, error) {
+	for _, filter := range filters {
+		name := aws.ToString(filter.Name)
+		var values []string
+		switch {
+		case strings.HasPrefix(name, "tag:"):
+			key := strings.TrimPrefix(name, "tag:")
+			for _, t := range i.Tags {
+				if aws.ToString(t.Key) == key {
+					values = append(values, aws.ToString(t.Value))
+				}
+			}
+		case name == "tag-key":
+			for _, t := range i.Tags {
+				values = append(values, aws.ToString(t.Key))
+			}
+		case name == "instance-state-name":
+			values = []string{string(i.State.Name)}
+		case name == "instance-id":
+			values = []string{aws.ToString(i.InstanceId)}
+		case name == "instance-type":
+			values = []string{string(i.InstanceType)}
+		case name == "image-id":
+			values = []string{aws.ToString(i.ImageId)}
+		case name == "subnet-id":
+			values = []string{aws.ToString(i.SubnetId)}
+		case name == "availability-zone":
+			values = []string{aws.ToString(i.Placement.AvailabilityZone)}
+		case name == "private-ip-address":
+			values = []string{aws.ToString(i.PrivateIpAddress)}
+		default:
+			return false, memoryError("InvalidParameterValue", "The filter '"+name+"' is not supported by the memory provider")
+		}
+		matched := false
+		for _, v := range values {
+			for _, w := range filter.Values {
+				matched = matched || v == w
+			}
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// copyMemoryInstance copies the instance deeply enough that callers cannot
+// change the provider's instances through the tags or state.
+func copyMemoryInstance(i *types.Instance) types.Instance {
+	instance := *i
+	instance.Tags = append([]types.Tag(nil), i.Tags...)
+	sort.SliceStable(instance.Tags, func(a, b int) bool {
+		return aws.ToString(instance.Tags[a].Key) < aws.ToString(instance.Tags[b].Key)
+	})
+	instance.SecurityGroups = append([]types.GroupIdentifier(nil), i.SecurityGroups...)
+	state := *i.State
+	instance.State = &state
+	return instance
+}
+
+// memoryError is an error with an EC2 error code, so that the checks of
+// the callers treat it like one from the EC2 API.
+func memoryError(code string, message string) error {
+	return &smithy.GenericAPIError{Code: code, Message: message, Fault: smithy.FaultClient}
+}
@@ -0,0 +1,184 @@
+package vmcreate_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+)
+
+func newMemoryProvisioner() (*vmcreate.MemoryProvider, *vmcreate.Provisioner) {
+	memory := vmcreate.NewMemoryProvider()
+	return memory, vmcreate.NewWithProvider(memory,
+		vmcreate.WithInstanceType("t2.micro"),
+		vmcreate.WithImageID("ami-test"),
+		vmcreate.WithWaitTimeout(time.Second),
+	)
+}
+
+func TestMemoryCreateAndList(t *testing.T) {
+	_, p := newMemoryProvisioner()
+	ctx := context.Background()
+
+	launched, err := p.Create(ctx, &vmcreate.CreateInput{
+		Tags:     map[string]string{"Name": "web-1", "app": "web"},
+		Count:    2,
+		SubnetID: "subnet-1",
+		Customize: func(in *ec2.RunInstancesInput) {
+			in.KeyName = aws.String("ops")
+			in.SecurityGroupIds = []string{"sg-1"}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(launched) != 2 || aws.ToString(launched[0].InstanceId) == aws.ToString(launched[1].InstanceId) {
+		t.Fatalf("launched %v, want two distinct instances", ids(launched))
+	}
+	i := launched[0]
+	if i.InstanceType != "t2.micro" || aws.ToString(i.ImageId) != "ami-test" || aws.ToString(i.SubnetId) != "subnet-1" ||
+		aws.ToString(i.KeyName) != "ops" || len(i.SecurityGroups) != 1 || aws.ToString(i.SecurityGroups[0].GroupId) != "sg-1" {
+		t.Errorf("instance launched with %s %s %s %s %v", i.InstanceType, aws.ToString(i.ImageId), aws.ToString(i.SubnetId), aws.ToString(i.KeyName), i.SecurityGroups)
+	}
+	if i.State.Name != types.InstanceStateNameRunning || i.PrivateIpAddress == nil || aws.ToString(i.Placement.AvailabilityZone) != "us-east-1a" {
+		t.Errorf("instance is %s at %s in %s", i.State.Name, aws.ToString(i.PrivateIpAddress), aws.ToString(i.Placement.AvailabilityZone))
+	}
+	if _, err := p.Create(ctx, &vmcreate.CreateInput{Tags: map[string]string{"app": "api"}, InstanceType: "t3.large"}); err != nil {
+		t.Fatal(err)
+	}
+
+	web, err := p.List(ctx, vmcreate.TagFilter("app", "web"), vmcreate.StateFilter(vmcreate.LiveStates...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(ids(web), ","), strings.Join(ids(launched), ","); got != want {
+		t.Errorf("List(app=web) = %s, want %s", got, want)
+	}
+	large, err := p.List(ctx, types.Filter{Name: aws.String("instance-type"), Values: []string{"t3.large"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(large) != 1 || vmcreate.TagValue(&large[0], "app") != "api" {
+		t.Errorf("List(instance-type=t3.large) = %v", ids(large))
+	}
+	if _, err := p.List(ctx, types.Filter{Name: aws.String("network-interface.addresses.association.public-ip"), Values: []string{"1.2.3.4"}}); err == nil {
+		t.Error("want an error for a filter the memory provider does not understand")
+	}
+
+	running, err := p.WaitForRunning(ctx, aws.ToString(i.InstanceId), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vmcreate.TagValue(running, "Name") != "web-1" {
+		t.Errorf("Describe returned tags %v", running.Tags)
+	}
+}
+
+func TestMemoryLifecycle(t *testing.T) {
+	memory, p := newMemoryProvisioner()
+	ctx := context.Background()
+	launched, err := p.Create(ctx, &vmcreate.CreateInput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := aws.ToString(launched[0].InstanceId)
+	state := func() types.InstanceStateName {
+		t.Helper()
+		i, err := p.Describe(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return i.State.Name
+	}
+
+	if err := p.Tag(ctx, []string{id}, map[string]string{"owner": "ops"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Tag(ctx, []string{id}, map[string]string{"owner": "dev"}); err != nil {
+		t.Fatal(err)
+	}
+	if i, _ := p.Describe(ctx, id); vmcreate.TagValue(i, "owner") != "dev" || len(i.Tags) != 1 {
+		t.Errorf("tags after retagging = %v, want owner=dev only", i.Tags)
+	}
+
+	if err := p.Stop(ctx, []string{id}); err != nil {
+		t.Fatal(err)
+	}
+	if got := state(); got != types.InstanceStateNameStopped {
+		t.Errorf("%s is %s after stop", id, got)
+	}
+	if err := p.Resize(ctx, id, "t3.small"); err != nil {
+		t.Fatal(err)
+	}
+	if i, _ := p.Describe(ctx, id); i.InstanceType != "t3.small" || i.State.Name != types.InstanceStateNameStopped {
+		t.Errorf("resized instance is a %s and %s, want a stopped t3.small", i.InstanceType, i.State.Name)
+	}
+	if err := p.Start(ctx, []string{id}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Migrate(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if err := memory.SetSourceDestCheck(ctx, id, false); err != nil {
+		t.Fatal(err)
+	}
+	if i, _ := p.Describe(ctx, id); aws.ToBool(i.SourceDestCheck) {
+		t.Error("the source/destination check is still on")
+	}
+
+	terminated, err := p.Delete(ctx, []string{id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(terminated) != 1 || terminated[0] != id {
+		t.Errorf("Delete = %v", terminated)
+	}
+	if got := state(); got != types.InstanceStateNameTerminated {
+		t.Errorf("%s is %s after delete", id, got)
+	}
+	if err := p.Start(ctx, []string{id}); err == nil {
+		t.Error("want an error starting a terminated instance")
+	}
+
+	var apiErr smithy.APIError
+	if _, err := p.Delete(ctx, []string{"i-missing"}); !errors.As(err, &apiErr) || apiErr.ErrorCode() != "InvalidInstanceID.NotFound" {
+		t.Errorf("deleting a missing instance: %v", err)
+	}
+}
+
+func TestMemoryIsSafeForConcurrentUse(t *testing.T) {
+	_, p := newMemoryProvisioner()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for n := 0; n < 20; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.Create(ctx, &vmcreate.CreateInput{Tags: map[string]string{"app": "web"}}); err != nil {
+				t.Error(err)
+			}
+			if _, err := p.List(ctx, vmcreate.TagFilter("app", "web")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	instances, err := p.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 20 {
+		t.Errorf("got %d instances, want 20", len(instances))
+	}
+}
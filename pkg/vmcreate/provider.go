@@ -0,0 +1,53 @@
+package vmcreate
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// Provider is a backend the Provisioner creates and manages instances with.
+// Instances and filters use the EC2 shapes so the CLI can treat every
+// backend alike; EC2Provider is the implementation for AWS and for
+// EC2-compatible endpoints such as LocalStack.
+type Provider interface {
+	// CreateInstances launches in.Count instances tagged with in.Tags. The
+	// Provisioner has already filled in its defaults.
+	CreateInstances(ctx context.Context, in *CreateInput) ([]types.Instance, error)
+	// DeleteInstances terminates the instances and returns the IDs being terminated.
+	DeleteInstances(ctx context.Context, instanceIDs []string) ([]string, error)
+	// ListInstances returns the instances matching all filters.
+	ListInstances(ctx context.Context, filters ...types.Filter) ([]types.Instance, error)
+	// TagInstances adds or overwrites tags on the instances.
+	TagInstances(ctx context.Context, instanceIDs []string, tags map[string]string) error
+}
+
+// PowerController is implemented by providers that can stop and start
+// instances, keeping their volumes.
+type PowerController interface {
+	StopInstances(ctx context.Context, instanceIDs []string) error
+	StartInstances(ctx context.Context, instanceIDs []string) error
+}
+
+// Resizer is implemented by providers that can change an instance's type.
+type Resizer interface {
+	// ResizeInstance changes the type of the instance, stopping and
+	// restarting it if needed, and waits up to timeout for each step.
+	ResizeInstance(ctx context.Context, instanceID string, instanceType string, timeout time.Duration) error
+}
+
+// SourceDestChecker is implemented by providers whose instances can forward
+// traffic they are neither the source nor the destination of, as NAT and
+// routing appliances do.
+type SourceDestChecker interface {
+	SetSourceDestCheck(ctx context.Context, instanceID string, enabled bool) error
+}
+
+// Migrator is implemented by providers that can move an instance to new
+// hardware, as EC2 does when an EBS-backed instance is stopped and started.
+type Migrator interface {
+	// MigrateInstance stops the running instance and starts it again,
+	// waiting up to timeout for each step.
+	MigrateInstance(ctx context.Context, instanceID string, timeout time.Duration) error
+}
@@ -0,0 +1,315 @@
+// Package vmcreate provisions and de-provisions Amazon EC2 instances. It is
+// the library behind the aws-vmcreate command and can be embedded by other
+// Go programs.
+//
+//	cfg, _ := config.LoadDefaultConfig(ctx)
+//	p := vmcreate.NewFromConfig(cfg, vmcreate.WithInstanceType("t3.micro"), vmcreate.WithImageID("ami-..."))
+//	instances, err := p.Create(ctx, &vmcreate.CreateInput{Tags: map[string]string{"Name": "web-1"}})
+package vmcreate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// LiveStates are the instance states other than shutting-down and terminated.
+var LiveStates = []string{"pending", "running", "stopping", "stopped"}
+
+// Provisioner creates, lists, resizes and deletes instances through a Provider.
+type Provisioner struct {
+	provider     Provider
+	instanceType string
+	imageID      string
+	subnetID     string
+	defaultTags  map[string]string
+	waitTimeout  time.Duration
+	pollDelay    time.Duration
+}
+
+// Option configures a Provisioner.
+type Option func(*Provisioner)
+
+// WithInstanceType sets the instance type used when CreateInput has none.
+func WithInstanceType(instanceType string) Option {
+	return func(p *Provisioner) { p.instanceType = instanceType }
+}
+
+// WithImageID sets the AMI used when CreateInput has none.
+func WithImageID(imageID string) Option {
+	return func(p *Provisioner) { p.imageID = imageID }
+}
+
+// WithSubnetID sets the subnet used when CreateInput has none.
+func WithSubnetID(subnetID string) Option {
+	return func(p *Provisioner) { p.subnetID = subnetID }
+}
+
+// WithDefaultTags adds tags to every instance the Provisioner creates.
+func WithDefaultTags(tags map[string]string) Option {
+	return func(p *Provisioner) {
+		for k, v := range tags {
+			p.defaultTags[k] = v
+		}
+	}
+}
+
+// WithWaitTimeout bounds how long Resize and WaitForRunning wait for state
+// changes by default. It defaults to ten minutes.
+func WithWaitTimeout(timeout time.Duration) Option {
+	return func(p *Provisioner) { p.waitTimeout = timeout }
+}
+
+// New returns a Provisioner making its calls through the EC2 api.
+func New(api EC2CreateInstanceAPI, opts ...Option) *Provisioner {
+	return NewWithProvider(NewEC2Provider(api), opts...)
+}
+
+// NewFromConfig returns a Provisioner using an EC2 client created from cfg.
+func NewFromConfig(cfg aws.Config, opts ...Option) *Provisioner {
+	return New(ec2.NewFromConfig(cfg), opts...)
+}
+
+// NewWithProvider returns a Provisioner backed by provider.
+func NewWithProvider(provider Provider, opts ...Option) *Provisioner {
+	p := &Provisioner{
+		provider:    provider,
+		defaultTags: map[string]string{},
+		waitTimeout: 10 * time.Minute,
+		pollDelay:   5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Provider returns the backend the Provisioner makes its calls through.
+func (p *Provisioner) Provider() Provider {
+	return p.provider
+}
+
+// CreateInput describes the instances to launch. Empty fields fall back to
+// the Provisioner's options.
+type CreateInput struct {
+	Tags         map[string]string
+	Count        int
+	InstanceType string
+	ImageID      string
+	SubnetID     string
+	// UserData is the base64 encoded user data.
+	UserData *string
+	// Customize, when set, can adjust the RunInstances call before it is
+	// made. It is ignored by providers other than EC2Provider.
+	Customize func(*ec2.RunInstancesInput)
+}
+
+// Create launches the instances described by in, tagged at launch.
+func (p *Provisioner) Create(ctx context.Context, in *CreateInput) ([]types.Instance, error) {
+	resolved := *in
+	if resolved.Count == 0 {
+		resolved.Count = 1
+	}
+	resolved.InstanceType = firstNonEmpty(in.InstanceType, p.instanceType)
+	resolved.ImageID = firstNonEmpty(in.ImageID, p.imageID)
+	resolved.SubnetID = firstNonEmpty(in.SubnetID, p.subnetID)
+	if resolved.ImageID == "" || resolved.InstanceType == "" {
+		return nil, errors.New("an image id and instance type are required")
+	}
+
+	resolved.Tags = map[string]string{}
+	for _, m := range []map[string]string{p.defaultTags, in.Tags} {
+		for k, v := range m {
+			resolved.Tags[k] = v
+		}
+	}
+	return p.provider.CreateInstances(ctx, &resolved)
+}
+
+// Delete terminates the instances and returns the IDs being terminated.
+func (p *Provisioner) Delete(ctx context.Context, instanceIDs []string) ([]string, error) {
+	if len(instanceIDs) == 0 {
+		return nil, nil
+	}
+	return p.provider.DeleteInstances(ctx, instanceIDs)
+}
+
+// Tag adds or overwrites tags on the instances.
+func (p *Provisioner) Tag(ctx context.Context, instanceIDs []string, tags map[string]string) error {
+	if len(instanceIDs) == 0 || len(tags) == 0 {
+		return nil
+	}
+	return p.provider.TagInstances(ctx, instanceIDs, tags)
+}
+
+// TagFilter matches instances whose tag key has one of values.
+func TagFilter(key string, values ...string) types.Filter {
+	return types.Filter{Name: aws.String("tag:" + key), Values: values}
+}
+
+// TagKeyFilter matches instances carrying the tag key with any value.
+func TagKeyFilter(key string) types.Filter {
+	return types.Filter{Name: aws.String("tag-key"), Values: []string{key}}
+}
+
+// InstanceIDFilter matches the instances with the given IDs.
+func InstanceIDFilter(instanceIDs ...string) types.Filter {
+	return types.Filter{Name: aws.String("instance-id"), Values: instanceIDs}
+}
+
+// StateFilter matches instances in one of the states.
+func StateFilter(states ...string) types.Filter {
+	return types.Filter{Name: aws.String("instance-state-name"), Values: states}
+}
+
+// List returns the instances matching all filters, oldest first.
+func (p *Provisioner) List(ctx context.Context, filters ...types.Filter) ([]types.Instance, error) {
+	instances, err := p.provider.ListInstances(ctx, filters...)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(instances, func(a, b int) bool {
+		return aws.ToTime(instances[a].LaunchTime).Before(aws.ToTime(instances[b].LaunchTime))
+	})
+	return instances, nil
+}
+
+// Describe returns the instance with the given ID.
+func (p *Provisioner) Describe(ctx context.Context, instanceID string) (*types.Instance, error) {
+	instances, err := p.provider.ListInstances(ctx, InstanceIDFilter(instanceID))
+	if err != nil {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("instance %s not found", instanceID)
+	}
+	return &instances[0], nil
+}
+
+// WaitForRunning waits for the instance to enter the running state and
+// returns it, with its network addresses assigned. A zero timeout uses the
+// Provisioner's wait timeout. A newly launched instance that is not visible
+// yet is waited for too.
+func (p *Provisioner) WaitForRunning(ctx context.Context, instanceID string, timeout time.Duration) (*types.Instance, error) {
+	if timeout == 0 {
+		timeout = p.waitTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		instances, err := p.provider.ListInstances(ctx, InstanceIDFilter(instanceID))
+		if err != nil {
+			return nil, err
+		}
+		if len(instances) > 0 && instances[0].State != nil {
+			switch instances[0].State.Name {
+			case types.InstanceStateNameRunning:
+				return &instances[0], nil
+			case types.InstanceStateNameShuttingDown, types.InstanceStateNameTerminated, types.InstanceStateNameStopping:
+				return nil, fmt.Errorf("instance %s is %s", instanceID, instances[0].State.Name)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for %s to run: %w", instanceID, ctx.Err())
+		case <-time.After(p.pollDelay):
+		}
+	}
+}
+
+// Resize changes the instance type. A running instance is stopped for the
+// change and started again afterwards; a stopped one is left stopped.
+func (p *Provisioner) Resize(ctx context.Context, instanceID string, instanceType string) error {
+	resizer, ok := p.provider.(Resizer)
+	if !ok {
+		return fmt.Errorf("the %T provider cannot resize instances", p.provider)
+	}
+	return resizer.ResizeInstance(ctx, instanceID, instanceType, p.waitTimeout)
+}
+
+// SetSourceDestCheck turns the source/destination check of the instance on
+// or off. It must be off for instances routing traffic for others.
+func (p *Provisioner) SetSourceDestCheck(ctx context.Context, instanceID string, enabled bool) error {
+	checker, ok := p.provider.(SourceDestChecker)
+	if !ok {
+		return fmt.Errorf("the %T provider cannot change the source/destination check", p.provider)
+	}
+	return checker.SetSourceDestCheck(ctx, instanceID, enabled)
+}
+
+// Migrate stops the instance and starts it again on new hardware, waiting
+// for each step.
+func (p *Provisioner) Migrate(ctx context.Context, instanceID string) error {
+	migrator, ok := p.provider.(Migrator)
+	if !ok {
+		return fmt.Errorf("the %T provider cannot migrate instances", p.provider)
+	}
+	return migrator.MigrateInstance(ctx, instanceID, p.waitTimeout)
+}
+
+// Stop stops the instances without waiting for them to be stopped.
+func (p *Provisioner) Stop(ctx context.Context, instanceIDs []string) error {
+	power, ok := p.provider.(PowerController)
+	if !ok {
+		return fmt.Errorf("the %T provider cannot stop instances", p.provider)
+	}
+	return power.StopInstances(ctx, instanceIDs)
+}
+
+// Start starts stopped instances without waiting for them to be running.
+func (p *Provisioner) Start(ctx context.Context, instanceIDs []string) error {
+	power, ok := p.provider.(PowerController)
+	if !ok {
+		return fmt.Errorf("the %T provider cannot start instances", p.provider)
+	}
+	return power.StartInstances(ctx, instanceIDs)
+}
+
+// Tags merges the maps, later ones winning, into tags sorted by key.
+func Tags(maps ...map[string]string) []types.Tag {
+	merged := map[string]string{}
+	for _, m := range maps {
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
+
+	keys := make([]string, 0, len(merged))
+	for k := range merged {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	tags := make([]types.Tag, 0, len(keys))
+	for _, k := range keys {
+		tags = append(tags, types.Tag{Key: aws.String(k), Value: aws.String(merged[k])})
+	}
+	return tags
+}
+
+// TagValue returns the value of the tag with the given key on the instance.
+func TagValue(instance *types.Instance, key string) string {
+	for _, t := range instance.Tags {
+		if aws.ToString(t.Key) == key {
+			return aws.ToString(t.Value)
+		}
+	}
+	return ""
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,381 @@
+package vmcreate_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"aws-vmcreate/pkg/vmcreate"
+	"aws-vmcreate/pkg/vmcreate/vmcreatetest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func newProvisioner(fake *vmcreatetest.FakeEC2, opts ...vmcreate.Option) *vmcreate.Provisioner {
+	opts = append([]vmcreate.Option{
+		vmcreate.WithInstanceType("t2.micro"),
+		vmcreate.WithImageID("ami-test"),
+		vmcreate.WithWaitTimeout(5 * time.Second),
+	}, opts...)
+	return vmcreate.New(fake, opts...)
+}
+
+func TestCreateAppliesDefaultsAndTags(t *testing.T) {
+	fake := vmcreatetest.NewFakeEC2()
+	p := newProvisioner(fake, vmcreate.WithSubnetID("subnet-1"), vmcreate.WithDefaultTags(map[string]string{"team": "web", "Name": "default"}))
+
+	instances, err := p.Create(context.Background(), &vmcreate.CreateInput{
+		Tags:  map[string]string{"Name": "web-1"},
+		Count: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 2 {
+		t.Fatalf("got %d instances, want 2", len(instances))
+	}
+
+	for _, i := range fake.Instances() {
+		if i.InstanceType != "t2.micro" || aws.ToString(i.ImageId) != "ami-test" || aws.ToString(i.SubnetId) != "subnet-1" {
+			t.Errorf("instance %s launched with %s %s %s", aws.ToString(i.InstanceId), i.InstanceType, aws.ToString(i.ImageId), aws.ToString(i.SubnetId))
+		}
+		if got := vmcreate.TagValue(&i, "Name"); got != "web-1" {
+			t.Errorf("Name tag = %q, want the input to override the default", got)
+		}
+		if got := vmcreate.TagValue(&i, "team"); got != "web" {
+			t.Errorf("team tag = %q, want web", got)
+		}
+	}
+}
+
+func TestCreateOverridesAndCustomize(t *testing.T) {
+	fake := vmcreatetest.NewFakeEC2()
+	p := newProvisioner(fake)
+
+	_, err := p.Create(context.Background(), &vmcreate.CreateInput{
+		InstanceType: "t3.large",
+		ImageID:      "ami-other",
+		Customize: func(in *ec2.RunInstancesInput) {
+			in.SubnetId = aws.String("subnet-custom")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := fake.Instances()[0]
+	if i.InstanceType != "t3.large" || aws.ToString(i.ImageId) != "ami-other" || aws.ToString(i.SubnetId) != "subnet-custom" {
+		t.Errorf("instance launched with %s %s %s", i.InstanceType, aws.ToString(i.ImageId), aws.ToString(i.SubnetId))
+	}
+}
+
+func TestCreateRequiresImageAndType(t *testing.T) {
+	fake := vmcreatetest.NewFakeEC2()
+	p := vmcreate.New(fake)
+
+	if _, err := p.Create(context.Background(), &vmcreate.CreateInput{}); err == nil {
+		t.Fatal("want an error without an image and instance type")
+	}
+	if calls := fake.Calls(); len(calls) != 0 {
+		t.Errorf("made calls %v", calls)
+	}
+}
+
+func TestCreateReturnsAPIErrors(t *testing.T) {
+	fake := vmcreatetest.NewFakeEC2()
+	fake.Fail("RunInstances", errors.New("insufficient capacity"))
+	p := newProvisioner(fake)
+
+	_, err := p.Create(context.Background(), &vmcreate.CreateInput{})
+	if err == nil || !strings.Contains(err.Error(), "insufficient capacity") {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestListFiltersAndOrders(t *testing.T) {
+	fake := vmcreatetest.NewFakeEC2()
+	p := newProvisioner(fake)
+	ctx := context.Background()
+
+	older := fake.AddInstance(types.Instance{
+		LaunchTime: aws.Time(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)),
+		Tags:       []types.Tag{{Key: aws.String("app"), Value: aws.String("api")}},
+	})
+	stopped := fake.AddInstance(types.Instance{
+		State: &types.InstanceState{Name: types.InstanceStateNameStopped},
+		Tags:  []types.Tag{{Key: aws.String("app"), Value: aws.String("api")}},
+	})
+	fake.AddInstance(types.Instance{
+		State: &types.InstanceState{Name: types.InstanceStateNameTerminated},
+		Tags:  []types.Tag{{Key: aws.String("app"), Value: aws.String("api")}},
+	})
+	fake.AddInstance(types.Instance{
+		Tags: []types.Tag{{Key: aws.String("app"), Value: aws.String("web")}},
+	})
+	newest, err := p.Create(ctx, &vmcreate.CreateInput{Tags: map[string]string{"app": "api"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instances, err := p.List(ctx, vmcreate.TagFilter("app", "api"), vmcreate.StateFilter(vmcreate.LiveStates...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{older, stopped, aws.ToString(newest[0].InstanceId)}
+	if got := ids(instances); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("List = %v, want %v", got, want)
+	}
+
+	instances, err = p.List(ctx, vmcreate.TagKeyFilter("app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 5 {
+		t.Errorf("List by tag key returned %d instances, want 5", len(instances))
+	}
+}
+
+func TestDescribeAndWaitForRunning(t *testing.T) {
+	fake := vmcreatetest.NewFakeEC2()
+	p := newProvisioner(fake)
+	ctx := context.Background()
+
+	if _, err := p.Describe(ctx, "i-missing"); err == nil {
+		t.Error("want an error describing a missing instance")
+	}
+
+	instances, err := p.Create(ctx, &vmcreate.CreateInput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := aws.ToString(instances[0].InstanceId)
+	if instances[0].State.Name != types.InstanceStateNamePending {
+		t.Errorf("launched instance is %s, want pending", instances[0].State.Name)
+	}
+
+	running, err := p.WaitForRunning(ctx, id, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if running.PrivateIpAddress == nil {
+		t.Error("running instance has no private IP")
+	}
+
+	if _, err := p.Delete(ctx, []string{id}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.WaitForRunning(ctx, id, 0); err == nil {
+		t.Error("want an error waiting for a terminated instance")
+	}
+}
+
+func TestDeleteAndTag(t *testing.T) {
+	fake := vmcreatetest.NewFakeEC2()
+	p := newProvisioner(fake)
+	ctx := context.Background()
+
+	if ids, err := p.Delete(ctx, nil); err != nil || ids != nil {
+		t.Errorf("Delete(nil) = %v, %v", ids, err)
+	}
+
+	a := fake.AddInstance(types.Instance{})
+	b := fake.AddInstance(types.Instance{})
+	if err := p.Tag(ctx, []string{a, b}, map[string]string{"owner": "ops"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{a, b} {
+		if got := vmcreate.TagValue(fake.Instance(id), "owner"); got != "ops" {
+			t.Errorf("%s owner tag = %q", id, got)
+		}
+	}
+
+	terminated, err := p.Delete(ctx, []string{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(terminated) != 2 {
+		t.Errorf("Delete returned %v", terminated)
+	}
+	if state := fake.Instance(a).State.Name; state != types.InstanceStateNameTerminated {
+		t.Errorf("%s is %s after delete", a, state)
+	}
+
+	if _, err := p.Delete(ctx, []string{"i-missing"}); err == nil {
+		t.Error("want an error deleting a missing instance")
+	}
+}
+
+func TestStopAndStart(t *testing.T) {
+	fake := vmcreatetest.NewFakeEC2()
+	p := newProvisioner(fake)
+	ctx := context.Background()
+	id := fake.AddInstance(types.Instance{})
+
+	if err := p.Stop(ctx, []string{id}); err != nil {
+		t.Fatal(err)
+	}
+	if state := fake.Instance(id).State.Name; state != types.InstanceStateNameStopped {
+		t.Errorf("%s is %s after stop", id, state)
+	}
+	if err := p.Start(ctx, []string{id}); err != nil {
+		t.Fatal(err)
+	}
+	if state := fake.Instance(id).State.Name; state != types.InstanceStateNameRunning {
+		t.Errorf("%s is %s after start", id, state)
+	}
+	if err := p.Stop(ctx, []string{"i-missing"}); err == nil {
+		t.Error("want an error stopping a missing instance")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	fake := vmcreatetest.NewFakeEC2()
+	p := newProvisioner(fake)
+	ctx := context.Background()
+	id := fake.AddInstance(types.Instance{})
+
+	if err := p.Migrate(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if state := fake.Instance(id).State.Name; state != types.InstanceStateNameRunning {
+		t.Errorf("%s is %s after the migration", id, state)
+	}
+	var calls []string
+	for _, call := range fake.Calls() {
+		if call == "StopInstances" || call == "StartInstances" {
+			calls = append(calls, call)
+		}
+	}
+	if strings.Join(calls, ",") != "StopInstances,StartInstances" {
+		t.Errorf("made calls %v, want a stop then a start", calls)
+	}
+	if err := vmcreate.NewWithProvider(listOnlyProvider{}).Migrate(ctx, "i-1"); err == nil {
+		t.Error("want an error from a provider that cannot migrate")
+	}
+}
+
+func TestResize(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("running", func(t *testing.T) {
+		fake := vmcreatetest.NewFakeEC2()
+		p := newProvisioner(fake)
+		id := fake.AddInstance(types.Instance{InstanceType: "t2.micro"})
+
+		if err := p.Resize(ctx, id, "t3.small"); err != nil {
+			t.Fatal(err)
+		}
+		i := fake.Instance(id)
+		if i.InstanceType != "t3.small" || i.State.Name != types.InstanceStateNameRunning {
+			t.Errorf("instance is %s and %s, want t3.small and running", i.InstanceType, i.State.Name)
+		}
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		fake := vmcreatetest.NewFakeEC2()
+		p := newProvisioner(fake)
+		id := fake.AddInstance(types.Instance{
+			InstanceType: "t2.micro",
+			State:        &types.InstanceState{Name: types.InstanceStateNameStopped},
+		})
+
+		if err := p.Resize(ctx, id, "t3.small"); err != nil {
+			t.Fatal(err)
+		}
+		i := fake.Instance(id)
+		if i.InstanceType != "t3.small" || i.State.Name != types.InstanceStateNameStopped {
+			t.Errorf("instance is %s and %s, want t3.small and stopped", i.InstanceType, i.State.Name)
+		}
+		for _, call := range fake.Calls() {
+			if call == "StartInstances" || call == "StopInstances" {
+				t.Errorf("resizing a stopped instance called %s", call)
+			}
+		}
+	})
+
+	t.Run("same type", func(t *testing.T) {
+		fake := vmcreatetest.NewFakeEC2()
+		p := newProvisioner(fake)
+		id := fake.AddInstance(types.Instance{InstanceType: "t2.micro"})
+
+		if err := p.Resize(ctx, id, "t2.micro"); err != nil {
+			t.Fatal(err)
+		}
+		if calls := fake.Calls(); len(calls) != 1 {
+			t.Errorf("made calls %v, want only the describe", calls)
+		}
+	})
+
+	t.Run("modify fails", func(t *testing.T) {
+		fake := vmcreatetest.NewFakeEC2()
+		fake.Fail("ModifyInstanceAttribute", errors.New("unsupported type"))
+		p := newProvisioner(fake)
+		id := fake.AddInstance(types.Instance{InstanceType: "t2.micro"})
+
+		if err := p.Resize(ctx, id, "t3.small"); err == nil || !strings.Contains(err.Error(), "unsupported type") {
+			t.Fatalf("err = %v", err)
+		}
+	})
+
+	t.Run("provider without resize", func(t *testing.T) {
+		p := vmcreate.NewWithProvider(listOnlyProvider{})
+		if err := p.Resize(ctx, "i-1", "t3.small"); err == nil {
+			t.Fatal("want an error from a provider that cannot resize")
+		}
+	})
+}
+
+func TestTagsAreSortedAndMerged(t *testing.T) {
+	tags := vmcreate.Tags(map[string]string{"b": "1", "a": "1"}, map[string]string{"b": "2"})
+	var got []string
+	for _, tag := range tags {
+		got = append(got, aws.ToString(tag.Key)+"="+aws.ToString(tag.Value))
+	}
+	if strings.Join(got, ",") != "a=1,b=2" {
+		t.Errorf("Tags = %v", got)
+	}
+}
+
+// listOnlyProvider is a Provider that does not implement Resizer.
+type listOnlyProvider struct{}
+
+func (listOnlyProvider) CreateInstances(context.Context, *vmcreate.CreateInput) ([]types.Instance, error) {
+	return nil, nil
+}
+
+func (listOnlyProvider) DeleteInstances(context.Context, []string) ([]string, error) {
+	return nil, nil
+}
+
+func (listOnlyProvider) ListInstances(context.Context, ...types.Filter) ([]types.Instance, error) {
+	return nil, nil
+}
+
+func (listOnlyProvider) TagInstances(context.Context, []string, map[string]string) error {
+	return nil
+}
+
+func ids(instances []types.Instance) []string {
+	var ids []string
+	for _, i := range instances {
+		ids = append(ids, aws.ToString(i.InstanceId))
+	}
+	return ids
+}
+
+func TestIsCapacityError(t *testing.T) {
+	if !vmcreate.IsCapacityError(fmt.Errorf("launch: %w", vmcreatetest.APIError("InsufficientInstanceCapacity", "no capacity"))) {
+		t.Error("InsufficientInstanceCapacity is not a capacity error")
+	}
+	if vmcreate.IsCapacityError(vmcreatetest.APIError("InvalidAMIID.NotFound", "no such image")) {
+		t.Error("InvalidAMIID.NotFound is a capacity error")
+	}
+	if vmcreate.IsCapacityError(errors.New("InsufficientInstanceCapacity")) {
+		t.Error("a plain error is a capacity error")
+	}
+}
@@ -0,0 +1,474 @@
+// Package vmcreatetest provides an in-memory EC2 for testing code built on
+// package vmcreate, and the aws-vmcreate commands themselves, without an AWS
+// account.
+//
+//	fake := vmcreatetest.NewFakeEC2()
+//	p := vmcreate.New(fake, vmcreate.WithInstanceType("t2.micro"), vmcreate.WithImageID("ami-test"))
+package vmcreatetest
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+)
+
+// FakeEC2 is an in-memory implementation of vmcreate.EC2CreateInstanceAPI.
+// Launched instances report pending and are running from the next describe
+// on; stops, starts and terminations complete immediately. It is safe for
+// concurrent use.
+type FakeEC2 struct {
+	mu        sync.Mutex
+	instances map[string]*types.Instance
+	order     []string
+	errors    map[string]error
+	calls     []string
+	next      int
+	now       time.Time
+	// instanceTypes are the types DescribeInstanceTypes reports.
+	instanceTypes []types.InstanceTypeInfo
+	// interfaces are the network interfaces of other than instances.
+	interfaces []types.NetworkInterface
+	// userData is the decoded user data the instances were launched with.
+	userData map[string]string
+}
+
+var (
+	_ vmcreate.EC2CreateInstanceAPI = (*FakeEC2)(nil)
+	_ smithy.APIError               = (*apiError)(nil)
+)
+
+// NewFakeEC2 returns an empty FakeEC2.
+func NewFakeEC2() *FakeEC2 {
+	return &FakeEC2{
+		instances: map[string]*types.Instance{},
+		errors:    map[string]error{},
+		userData:  map[string]string{},
+		now:       time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+
+		instanceTypes: defaultInstanceTypes(),
+	}
+}
+
+// Fail makes every later call to the operation, e.g. "RunInstances", return
+// err. A nil err clears the failure.
+func (f *FakeEC2) Fail(operation string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		delete(f.errors, operation)
+		return
+	}
+	f.errors[operation] = err
+}
+
+// Calls returns the operations called so far, in order.
+func (f *FakeEC2) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// Instances returns a copy of every instance, terminated ones included, in
+// launch order.
+func (f *FakeEC2) Instances() []types.Instance {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var instances []types.Instance
+	for _, id := range f.order {
+		instances = append(instances, copyInstance(f.instances[id]))
+	}
+	return instances
+}
+
+// UserData returns the decoded user data the instance was launched with, or
+// "" without any.
+func (f *FakeEC2) UserData(instanceID string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.userData[instanceID]
+}
+
+// Instance returns a copy of the instance with the ID, or nil.
+func (f *FakeEC2) Instance(instanceID string) *types.Instance {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i, ok := f.instances[instanceID]
+	if !ok {
+		return nil
+	}
+	instance := copyInstance(i)
+	return &instance
+}
+
+// AddInstance stores an instance as if it had been launched, filling in an
+// ID, launch time and running state when they are missing, and returns its ID.
+func (f *FakeEC2) AddInstance(instance types.Instance) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.add(instance)
+}
+
+func (f *FakeEC2) add(instance types.Instance) string {
+	f.next++
+	if instance.InstanceId == nil {
+		instance.InstanceId = aws.String(fmt.Sprintf("i-%017x", f.next))
+	}
+	if instance.LaunchTime == nil {
+		f.now = f.now.Add(time.Second)
+		instance.LaunchTime = aws.Time(f.now)
+	}
+	if instance.State == nil {
+		instance.State = &types.InstanceState{Name: types.InstanceStateNameRunning}
+	}
+	if instance.PrivateIpAddress == nil {
+		instance.PrivateIpAddress = aws.String(fmt.Sprintf("10.0.%d.%d", f.next/250, f.next%250+4))
+	}
+	if instance.Placement == nil {
+		instance.Placement = &types.Placement{AvailabilityZone: aws.String("us-east-1a")}
+	}
+
+	id := aws.ToString(instance.InstanceId)
+	f.instances[id] = &instance
+	f.order = append(f.order, id)
+	return id
+}
+
+// call records the operation and returns the failure set for it, if any.
+func (f *FakeEC2) call(operation string) error {
+	f.calls = append(f.calls, operation)
+	return f.errors[operation]
+}
+
+// lookup returns the instances with the IDs, failing like EC2 does when one
+// does not exist.
+func (f *FakeEC2) lookup(instanceIDs []string) ([]*types.Instance, error) {
+	if len(instanceIDs) == 0 {
+		return nil, &apiError{code: "MissingParameter", message: "The request must contain the parameter InstanceId"}
+	}
+	var instances []*types.Instance
+	for _, id := range instanceIDs {
+		i, ok := f.instances[id]
+		if !ok {
+			return nil, &apiError{code: "InvalidInstanceID.NotFound", message: fmt.Sprintf("The instance ID '%s' does not exist", id)}
+		}
+		instances = append(instances, i)
+	}
+	return instances, nil
+}
+
+func (f *FakeEC2) RunInstances(ctx context.Context, params *ec2.RunInstancesInput, optFns ...func(*ec2.Options)) (*ec2.RunInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("RunInstances"); err != nil {
+		return nil, err
+	}
+	if aws.ToString(params.ImageId) == "" {
+		return nil, &apiError{code: "MissingParameter", message: "The request must contain the parameter ImageId"}
+	}
+	if aws.ToInt32(params.MinCount) < 1 || aws.ToInt32(params.MaxCount) < aws.ToInt32(params.MinCount) {
+		return nil, &apiError{code: "InvalidParameterValue", message: "MinCount and MaxCount are invalid"}
+	}
+	if ip := aws.ToString(params.PrivateIpAddress); ip != "" {
+		if aws.ToInt32(params.MaxCount) > 1 {
+			return nil, &apiError{code: "InvalidParameterCombination", message: "Cannot specify a private IP address when launching more than one instance"}
+		}
+		if f.privateIPInUse(aws.ToString(params.SubnetId), ip) {
+			return nil, &apiError{code: "InvalidIPAddress.InUse", message: fmt.Sprintf("Address %s is in use.", ip)}
+		}
+	}
+
+	var tags []types.Tag
+	for _, spec := range params.TagSpecifications {
+		if spec.ResourceType == types.ResourceTypeInstance {
+			tags = append(tags, spec.Tags...)
+		}
+	}
+
+	var userData []byte
+	if params.UserData != nil {
+		var err error
+		if userData, err = base64.StdEncoding.DecodeString(*params.UserData); err != nil {
+			return nil, &apiError{code: "InvalidUserData.Malformed", message: "Invalid BASE64 encoding of user data."}
+		}
+	}
+
+	output := &ec2.RunInstancesOutput{}
+	for n := int32(0); n < aws.ToInt32(params.MaxCount); n++ {
+		id := f.add(types.Instance{
+			ImageId:          params.ImageId,
+			InstanceType:     params.InstanceType,
+			SubnetId:         params.SubnetId,
+			Placement:        params.Placement,
+			KeyName:          params.KeyName,
+			PrivateIpAddress: params.PrivateIpAddress,
+			Tags:             append([]types.Tag(nil), tags...),
+		})
+		if userData != nil {
+			f.userData[id] = string(userData)
+		}
+		launched := copyInstance(f.instances[id])
+		launched.State = &types.InstanceState{Name: types.InstanceStateNamePending}
+		output.Instances = append(output.Instances, launched)
+	}
+	return output, nil
+}
+
+func (f *FakeEC2) CreateTags(ctx context.Context, params *ec2.CreateTagsInput, optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateTags"); err != nil {
+		return nil, err
+	}
+	instances, err := f.lookup(params.Resources)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range instances {
+		for _, tag := range params.Tags {
+			replaced := false
+			for n, existing := range i.Tags {
+				if aws.ToString(existing.Key) == aws.ToString(tag.Key) {
+					i.Tags[n].Value, replaced = tag.Value, true
+				}
+			}
+			if !replaced {
+				i.Tags = append(i.Tags, tag)
+			}
+		}
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (f *FakeEC2) TerminateInstances(ctx context.Context, params *ec2.TerminateInstancesInput, optFns ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("TerminateInstances"); err != nil {
+		return nil, err
+	}
+	instances, err := f.lookup(params.InstanceIds)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &ec2.TerminateInstancesOutput{}
+	for _, i := range instances {
+		previous := i.State.Name
+		i.State = &types.InstanceState{Name: types.InstanceStateNameTerminated}
+		output.TerminatingInstances = append(output.TerminatingInstances, types.InstanceStateChange{
+			InstanceId:    i.InstanceId,
+			PreviousState: &types.InstanceState{Name: previous},
+			CurrentState:  &types.InstanceState{Name: types.InstanceStateNameShuttingDown},
+		})
+	}
+	return output, nil
+}
+
+func (f *FakeEC2) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeInstances"); err != nil {
+		return nil, err
+	}
+
+	candidates := f.order
+	if len(params.InstanceIds) > 0 {
+		if _, err := f.lookup(params.InstanceIds); err != nil {
+			return nil, err
+		}
+		candidates = params.InstanceIds
+	}
+
+	reservation := types.Reservation{ReservationId: aws.String("r-fake")}
+	for _, id := range candidates {
+		i := f.instances[id]
+		ok, err := matches(i, params.Filters)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			reservation.Instances = append(reservation.Instances, copyInstance(i))
+		}
+	}
+
+	output := &ec2.DescribeInstancesOutput{}
+	if len(reservation.Instances) > 0 {
+		output.Reservations = []types.Reservation{reservation}
+	}
+	return output, nil
+}
+
+func (f *FakeEC2) ModifyInstanceAttribute(ctx context.Context, params *ec2.ModifyInstanceAttributeInput, optFns ...func(*ec2.Options)) (*ec2.ModifyInstanceAttributeOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ModifyInstanceAttribute"); err != nil {
+		return nil, err
+	}
+	instances, err := f.lookup([]string{aws.ToString(params.InstanceId)})
+	if err != nil {
+		return nil, err
+	}
+
+	i := instances[0]
+	if params.InstanceType != nil {
+		if i.State.Name != types.InstanceStateNameStopped {
+			return nil, &apiError{code: "IncorrectInstanceState", message: "The instance '" + aws.ToString(i.InstanceId) + "' is not in the 'stopped' state."}
+		}
+		i.InstanceType = types.InstanceType(aws.ToString(params.InstanceType.Value))
+	}
+	if params.SourceDestCheck != nil {
+		i.SourceDestCheck = params.SourceDestCheck.Value
+	}
+	return &ec2.ModifyInstanceAttributeOutput{}, nil
+}
+
+func (f *FakeEC2) StopInstances(ctx context.Context, params *ec2.StopInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StopInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("StopInstances"); err != nil {
+		return nil, err
+	}
+	changes, err := f.transition(params.InstanceIds, types.InstanceStateNameStopped)
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.StopInstancesOutput{StoppingInstances: changes}, nil
+}
+
+func (f *FakeEC2) StartInstances(ctx context.Context, params *ec2.StartInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StartInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("StartInstances"); err != nil {
+		return nil, err
+	}
+	changes, err := f.transition(params.InstanceIds, types.InstanceStateNameRunning)
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.StartInstancesOutput{StartingInstances: changes}, nil
+}
+
+// transition moves live instances to state, refusing terminated ones.
+func (f *FakeEC2) transition(instanceIDs []string, state types.InstanceStateName) ([]types.InstanceStateChange, error) {
+	instances, err := f.lookup(instanceIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []types.InstanceStateChange
+	for _, i := range instances {
+		if i.State.Name == types.InstanceStateNameTerminated {
+			return nil, &apiError{code: "IncorrectInstanceState", message: "The instance '" + aws.ToString(i.InstanceId) + "' is terminated."}
+		}
+		changes = append(changes, types.InstanceStateChange{
+			InstanceId:    i.InstanceId,
+			PreviousState: &types.InstanceState{Name: i.State.Name},
+			CurrentState:  &types.InstanceState{Name: state},
+		})
+		i.State = &types.InstanceState{Name: state}
+	}
+	return changes, nil
+}
+
+// matches reports whether the instance passes every filter. Only the filters
+// used by aws-vmcreate are understood; others are an error so that tests
+// notice.
+func matches(i *types.Instance, filters []types.Filter) (bool, error) {
+	for _, filter := range filters {
+		name := aws.ToString(filter.Name)
+		var values []string
+		switch {
+		case strings.HasPrefix(name, "tag:"):
+			key := strings.TrimPrefix(name, "tag:")
+			for _, t := range i.Tags {
+				if aws.ToString(t.Key) == key {
+					values = append(values, aws.ToString(t.Value))
+				}
+			}
+		case name == "tag-key":
+			for _, t := range i.Tags {
+				values = append(values, aws.ToString(t.Key))
+			}
+		case name == "instance-state-name":
+			values = []string{string(i.State.Name)}
+		case name == "instance-id":
+			values = []string{aws.ToString(i.InstanceId)}
+		case name == "instance-type":
+			values = []string{string(i.InstanceType)}
+		case name == "image-id":
+			values = []string{aws.ToString(i.ImageId)}
+		case name == "vpc-id":
+			values = []string{aws.ToString(i.VpcId)}
+		default:
+			return false, &apiError{code: "InvalidParameterValue", message: "The filter '" + name + "' is not supported by the fake"}
+		}
+		if !anyMatch(values, filter.Values) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func anyMatch(values []string, wanted []string) bool {
+	for _, v := range values {
+		for _, w := range wanted {
+			if v == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// copyInstance copies the instance deeply enough that callers cannot change
+// the fake's state through the tags or state.
+func copyInstance(i *types.Instance) types.Instance {
+	instance := *i
+	instance.Tags = append([]types.Tag(nil), i.Tags...)
+	sort.SliceStable(instance.Tags, func(a, b int) bool {
+		return aws.ToString(instance.Tags[a].Key) < aws.ToString(instance.Tags[b].Key)
+	})
+	state := *i.State
+	instance.State = &state
+	return instance
+}
+
+// APIError returns an error with the code and message, like the ones the
+// EC2 API returns, for use with Fail.
+func APIError(code string, message string) error {
+	return &apiError{code: code, message: message}
+}
+
+// apiError mimics the errors returned by the EC2 API. It implements
+// smithy.APIError, so waiters and error checks treat it like the real thing.
+type apiError struct {
+	code    string
+	message string
+}
+
+func (e *apiError) Error() string {
+	return "api error " + e.code + ": " + e.message
+}
+
+func (e *apiError) ErrorCode() string {
+	return e.code
+}
+
+func (e *apiError) ErrorMessage() string {
+	return e.message
+}
+
+func (e *apiError) ErrorFault() smithy.ErrorFault {
+	return smithy.FaultClient
+}
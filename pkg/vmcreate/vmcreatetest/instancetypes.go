@@ -0,0 +1,89 @@
+package vmcreatetest
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// InstanceType describes an instance type offered by the fake.
+func InstanceType(name string, vcpus int32, memoryMiB int64, gpus int32) types.InstanceTypeInfo {
+	info := types.InstanceTypeInfo{
+		InstanceType:      types.InstanceType(name),
+		CurrentGeneration: aws.Bool(true),
+		Hypervisor:        types.InstanceTypeHypervisorNitro,
+		VCpuInfo:          &types.VCpuInfo{DefaultVCpus: aws.Int32(vcpus)},
+		MemoryInfo:        &types.MemoryInfo{SizeInMiB: aws.Int64(memoryMiB)},
+		ProcessorInfo:     &types.ProcessorInfo{SupportedArchitectures: []types.ArchitectureType{types.ArchitectureTypeX8664}},
+	}
+	if gpus > 0 {
+		info.GpuInfo = &types.GpuInfo{Gpus: []types.GpuDeviceInfo{{
+			Count:        aws.Int32(gpus),
+			Manufacturer: aws.String("NVIDIA"),
+			Name:         aws.String("A10G"),
+			MemoryInfo:   &types.GpuDeviceMemoryInfo{SizeInMiB: aws.Int32(24576)},
+		}}}
+	}
+	return info
+}
+
+func defaultInstanceTypes() []types.InstanceTypeInfo {
+	return []types.InstanceTypeInfo{
+		InstanceType("t2.micro", 1, 1024, 0),
+		InstanceType("t3.micro", 2, 1024, 0),
+		InstanceType("t3.small", 2, 2048, 0),
+		InstanceType("t3.medium", 2, 4096, 0),
+		InstanceType("t3.large", 2, 8192, 0),
+		InstanceType("m7i.large", 2, 8192, 0),
+		InstanceType("r5.large", 2, 16384, 0),
+		InstanceType("c6i.large", 2, 4096, 0),
+		InstanceType("c6i.2xlarge", 8, 16384, 0),
+		InstanceType("c6i.4xlarge", 16, 32768, 0),
+		InstanceType("g5.xlarge", 4, 16384, 1),
+	}
+}
+
+// SetInstanceTypes replaces the instance types the fake offers.
+func (f *FakeEC2) SetInstanceTypes(infos ...types.InstanceTypeInfo) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.instanceTypes = infos
+}
+
+// DescribeInstanceTypes returns the offered types, or those of
+// params.InstanceTypes, two per page.
+func (f *FakeEC2) DescribeInstanceTypes(ctx context.Context, params *ec2.DescribeInstanceTypesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceTypesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeInstanceTypes"); err != nil {
+		return nil, err
+	}
+
+	var infos []types.InstanceTypeInfo
+	for _, info := range f.instanceTypes {
+		wanted := len(params.InstanceTypes) == 0
+		for _, t := range params.InstanceTypes {
+			wanted = wanted || t == info.InstanceType
+		}
+		if wanted {
+			infos = append(infos, info)
+		}
+	}
+	if len(params.InstanceTypes) > len(infos) {
+		return nil, &apiError{code: "InvalidInstanceType", message: "The following supplied instance types do not exist"}
+	}
+
+	start, _ := strconv.Atoi(aws.ToString(params.NextToken))
+	end := start + 2
+	output := &ec2.DescribeInstanceTypesOutput{}
+	if end < len(infos) {
+		output.NextToken = aws.String(strconv.Itoa(end))
+	} else {
+		end = len(infos)
+	}
+	output.InstanceTypes = append(output.InstanceTypes, infos[start:end]...)
+	return output, nil
+}
@@ -0,0 +1,89 @@
+package vmcreatetest
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// AddNetworkInterface adds a network interface that no instance has, such
+// as one of a load balancer or database, with the private IP address in
+// the subnet, and returns its ID.
+func (f *FakeEC2) AddNetworkInterface(subnetID, privateIP string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := fmt.Sprintf("eni-%017x", len(f.interfaces)+1)
+	f.interfaces = append(f.interfaces, types.NetworkInterface{
+		NetworkInterfaceId: aws.String(id),
+		SubnetId:           aws.String(subnetID),
+		PrivateIpAddress:   aws.String(privateIP),
+		Status:             types.NetworkInterfaceStatusInUse,
+	})
+	return id
+}
+
+// networkInterfaces returns the interfaces added with AddNetworkInterface
+// and one for each instance that is not terminated. The caller holds f.mu.
+func (f *FakeEC2) networkInterfaces() []types.NetworkInterface {
+	interfaces := append([]types.NetworkInterface(nil), f.interfaces...)
+	for _, id := range f.order {
+		i := f.instances[id]
+		if i.State != nil && i.State.Name == types.InstanceStateNameTerminated {
+			continue
+		}
+		interfaces = append(interfaces, types.NetworkInterface{
+			NetworkInterfaceId: aws.String("eni-" + id[2:]),
+			SubnetId:           i.SubnetId,
+			PrivateIpAddress:   i.PrivateIpAddress,
+			Status:             types.NetworkInterfaceStatusInUse,
+			Attachment:         &types.NetworkInterfaceAttachment{InstanceId: i.InstanceId},
+		})
+	}
+	return interfaces
+}
+
+// privateIPInUse reports whether an interface in the subnet has the
+// address. The caller holds f.mu.
+func (f *FakeEC2) privateIPInUse(subnetID, ip string) bool {
+	for _, eni := range f.networkInterfaces() {
+		if aws.ToString(eni.SubnetId) == subnetID && aws.ToString(eni.PrivateIpAddress) == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// DescribeNetworkInterfaces returns the interfaces added with
+// AddNetworkInterface and one for each instance that is not terminated,
+// filtered by subnet-id and addresses.private-ip-address.
+func (f *FakeEC2) DescribeNetworkInterfaces(ctx context.Context, params *ec2.DescribeNetworkInterfacesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeNetworkInterfacesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeNetworkInterfaces"); err != nil {
+		return nil, err
+	}
+
+	output := &ec2.DescribeNetworkInterfacesOutput{}
+	for _, eni := range f.networkInterfaces() {
+		ok := true
+		for _, filter := range params.Filters {
+			var value string
+			switch aws.ToString(filter.Name) {
+			case "subnet-id":
+				value = aws.ToString(eni.SubnetId)
+			case "addresses.private-ip-address":
+				value = aws.ToString(eni.PrivateIpAddress)
+			default:
+				return nil, &apiError{code: "InvalidParameterValue", message: "The filter '" + aws.ToString(filter.Name) + "' is not supported by the fake"}
+			}
+			ok = ok && anyMatch([]string{value}, filter.Values)
+		}
+		if ok {
+			output.NetworkInterfaces = append(output.NetworkInterfaces, eni)
+		}
+	}
+	return output, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// launchPlan is a launch as the checks before it see it.
+type launchPlan struct {
+	// Command is the command launching, such as create or serve.
+	Command string
+	// TagKey and TagValue select the instances the launch adds to, which
+	// max_instances_per_tag caps.
+	TagKey       string
+	TagValue     string
+	InstanceType string
+	ImageID      string
+	Count        int
+	// Replacing is how many of the live instances the launch replaces,
+	// which the instance limits do not count twice.
+	Replacing int
+	// Tags are those of the new instances, and get who approved them.
+	Tags map[string]string
+	// OverrideBudget launches even when the projected spend passes the
+	// budget, as create --override-budget does.
+	OverrideBudget bool
+}
+
+// beforeLaunch runs the checks of config every command goes through before
+// it launches instances: the instance limits, the budget, the approval the
+// launch requires, which it waits for, and then the pre-create hooks. The
+// launch must not go ahead when it returns an error. The post-create hooks
+// run once it is done, through postCreateHooks.
+func beforeLaunch(c context.Context, config ConfigMap, p *launchPlan) error {
+	if err := checkInstanceLimits(c, config.InstanceLimits, p.TagKey, p.TagValue, p.Count-p.Replacing); err != nil {
+		return fmt.Errorf("checking the instance limits: %w", err)
+	}
+	if b := config.Budget; b != nil {
+		if err := checkBudget(c, b, p); err != nil {
+			return fmt.Errorf("checking the budget: %w", err)
+		}
+	}
+	if a := config.Approval; a != nil && a.required(p.Tags) {
+		if err := getApproved(c, a, p); err != nil {
+			return fmt.Errorf("getting the %s approved: %w", p.Command, err)
+		}
+	}
+	if h := config.Hooks; h != nil {
+		err := runHooks(c, h, h.PreCreate, &HookPayload{
+			Hook:         "pre-create",
+			TagKey:       p.TagKey,
+			TagValue:     p.TagValue,
+			InstanceType: p.InstanceType,
+			ImageID:      p.ImageID,
+			Count:        p.Count,
+			Tags:         p.Tags,
+		})
+		if err != nil {
+			return fmt.Errorf("running the pre-create hooks: %w", err)
+		}
+	}
+	return nil
+}
+
+// postCreateHooks runs the post-create hooks of config on the instances a
+// launch made, which their failures no longer undo.
+func postCreateHooks(c context.Context, config ConfigMap, tagKey string, tagValue string, instances []types.Instance) {
+	if h := config.Hooks; h != nil && len(instances) > 0 {
+		runPostHooks(c, h, h.PostCreate, &HookPayload{Hook: "post-create", TagKey: tagKey, TagValue: tagValue, Instances: hookInstances(instances)})
+	}
+}
+
+// checkBudget returns an errOverBudget error when the launch would push the
+// projected spend of the month over the budget, unless it is overridden.
+func checkBudget(c context.Context, b *BudgetConfig, p *launchPlan) error {
+	projection, err := projectBudget(c, budgetsClient, costExplorerClient, b, p.InstanceType, p.Count, time.Now())
+	if err != nil {
+		return err
+	}
+	if projection.Projected() <= projection.Limit {
+		return nil
+	}
+	if !p.OverrideBudget {
+		return fmt.Errorf("%w: %s", errOverBudget, projection)
+	}
+	progressln(projection.String() + ", launching anyway with --override-budget")
+	return nil
+}
+
+// getApproved asks for the approval of the launch and waits for it, adding
+// the approver to its tags.
+func getApproved(c context.Context, a *ApprovalConfig, p *launchPlan) error {
+	requester, err := lookupPrincipal(c)
+	if err != nil {
+		return err
+	}
+	req := &ApprovalRequest{
+		ID:           newApprovalID(),
+		Command:      p.Command,
+		RequestedBy:  requester,
+		Region:       awsConfig.Region,
+		InstanceType: p.InstanceType,
+		ImageID:      p.ImageID,
+		Count:        p.Count,
+		Tags:         p.Tags,
+		Time:         time.Now().UTC(),
+	}
+	progressln("Waiting for the approval of request " + req.ID)
+	var topics SNSPublishAPI
+	if a.SNSTopic != "" {
+		topics = snsClientFor(a.SNSTopic)
+	}
+	decision, err := awaitApproval(c, a, req, awsConfig.HTTPClient, topics, ssmClient)
+	if err != nil {
+		return err
+	}
+	p.Tags[approvedByTag] = firstNonEmpty(decision.Approver, "approved")
+	progressln("Approved by " + p.Tags[approvedByTag] + " with token " + decision.Token)
+	return nil
+}
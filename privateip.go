@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// networkInterfacesClient finds the network interfaces holding private
+// addresses.
+var networkInterfacesClient ec2.DescribeNetworkInterfacesAPIClient
+
+// maxPoolAddresses caps the addresses a CIDR block of private_ip_pool
+// expands to, a /20.
+const maxPoolAddresses = 4096
+
+// expandIPPool returns the addresses of a private_ip_pool, whose entries
+// are IPv4 addresses or CIDR blocks, in order and without repeats.
+func expandIPPool(pool []string) ([]string, error) {
+	var ips []string
+	seen := map[string]bool{}
+	add := func(ip string) {
+		if !seen[ip] {
+			seen[ip] = true
+			ips = append(ips, ip)
+		}
+	}
+	for _, entry := range pool {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry).To4()
+			if ip == nil {
+				return nil, fmt.Errorf("%q of private_ip_pool is not an IPv4 address or CIDR block", entry)
+			}
+			add(ip.String())
+			continue
+		}
+		_, block, err := net.ParseCIDR(entry)
+		if err != nil || block.IP.To4() == nil {
+			return nil, fmt.Errorf("%q of private_ip_pool is not an IPv4 address or CIDR block", entry)
+		}
+		ones, bits := block.Mask.Size()
+		if 1<<(bits-ones) > maxPoolAddresses {
+			return nil, fmt.Errorf("%s of private_ip_pool has more than %d addresses", entry, maxPoolAddresses)
+		}
+		first := binary.BigEndian.Uint32(block.IP.To4())
+		for n := uint32(0); n < 1<<(bits-ones); n++ {
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, first+n)
+			add(ip.String())
+		}
+	}
+	return ips, nil
+}
+
+// privateIPsInUse returns which of the addresses a network interface in the
+// subnet already holds, with the interface or the instance it belongs to.
+func privateIPsInUse(c context.Context, api ec2.DescribeNetworkInterfacesAPIClient, subnetID string, ips []string) (map[string]string, error) {
+	used := map[string]string{}
+	// A filter takes at most 200 values.
+	for start := 0; start < len(ips); start += 200 {
+		batch := ips[start:]
+		if len(batch) > 200 {
+			batch = batch[:200]
+		}
+		pages := ec2.NewDescribeNetworkInterfacesPaginator(api, &ec2.DescribeNetworkInterfacesInput{Filters: []types.Filter{
+			{Name: aws.String("subnet-id"), Values: []string{subnetID}},
+			{Name: aws.String("addresses.private-ip-address"), Values: batch},
+		}})
+		for pages.HasMorePages() {
+			page, err := pages.NextPage(c)
+			if err != nil {
+				return nil, fmt.Errorf("listing the network interfaces of %s: %w", subnetID, err)
+			}
+			for _, eni := range page.NetworkInterfaces {
+				holder := aws.ToString(eni.NetworkInterfaceId)
+				if eni.Attachment != nil && eni.Attachment.InstanceId != nil {
+					holder = aws.ToString(eni.Attachment.InstanceId)
+				}
+				for _, a := range eni.PrivateIpAddresses {
+					used[aws.ToString(a.PrivateIpAddress)] = holder
+				}
+				if ip := aws.ToString(eni.PrivateIpAddress); ip != "" {
+					used[ip] = holder
+				}
+			}
+		}
+	}
+	return used, nil
+}
+
+// choosePrivateIPs returns the private addresses of the count instances of
+// a create in the subnet: those asked for, which must be free, or else the
+// first free addresses of the pool.
+func choosePrivateIPs(c context.Context, api ec2.DescribeNetworkInterfacesAPIClient, subnetID string, wanted []string, pool []string, count int) ([]string, error) {
+	if subnetID == "" {
+		return nil, fmt.Errorf("private addresses need subnet_id or --subnet-id, since they belong to a subnet")
+	}
+	if len(wanted) > 0 {
+		if len(wanted) != count {
+			return nil, fmt.Errorf("%d private addresses are given for %d instances", len(wanted), count)
+		}
+		for _, ip := range wanted {
+			if net.ParseIP(ip).To4() == nil {
+				return nil, fmt.Errorf("%q is not an IPv4 address", ip)
+			}
+		}
+		used, err := privateIPsInUse(c, api, subnetID, wanted)
+		if err != nil {
+			return nil, err
+		}
+		var conflicts []string
+		for _, ip := range wanted {
+			if holder, ok := used[ip]; ok {
+				conflicts = append(conflicts, ip+" is used by "+holder)
+			}
+		}
+		if len(conflicts) > 0 {
+			return nil, fmt.Errorf("the private addresses are taken in %s: %s", subnetID, strings.Join(conflicts, ", "))
+		}
+		return wanted, nil
+	}
+
+	candidates, err := expandIPPool(pool)
+	if err != nil {
+		return nil, err
+	}
+	used, err := privateIPsInUse(c, api, subnetID, candidates)
+	if err != nil {
+		return nil, err
+	}
+	var free []string
+	for _, ip := range candidates {
+		if _, ok := used[ip]; !ok {
+			free = append(free, ip)
+		}
+		if len(free) == count {
+			return free, nil
+		}
+	}
+	var taken []string
+	for ip := range used {
+		taken = append(taken, ip)
+	}
+	sort.Strings(taken)
+	return nil, fmt.Errorf("only %d of the %d addresses of private_ip_pool are free in %s for %d instances, %s are taken",
+		len(free), len(candidates), subnetID, count, strings.Join(taken, ", "))
+}
+
+// launchAtPrivateIPs launches an instance at each of the private addresses,
+// since RunInstances only takes one address a launch. The instances already
+// launched are terminated when a later launch fails, so that a conflict
+// does not leave part of the create behind.
+func launchAtPrivateIPs(c context.Context, in *vmcreate.CreateInput, ips []string) ([]types.Instance, error) {
+	var instances []types.Instance
+	for _, ip := range ips {
+		ip := ip
+		launch := *in
+		launch.Count = 1
+		launch.Customize = func(run *ec2.RunInstancesInput) {
+			if in.Customize != nil {
+				in.Customize(run)
+			}
+			run.PrivateIpAddress = aws.String(ip)
+		}
+		launched, err := provisioner.Create(c, &launch)
+		if err != nil {
+			if len(instances) > 0 {
+				ids := instanceIDs(instances)
+				if _, terr := provisioner.Delete(c, ids); terr != nil {
+					fmt.Fprintln(os.Stderr, "Got an error terminating the instances launched before, "+strings.Join(ids, ", ")+" are left:")
+					fmt.Fprintln(os.Stderr, terr)
+				}
+			}
+			return nil, fmt.Errorf("launching at %s: %w", ip, err)
+		}
+		instances = append(instances, launched...)
+	}
+	return instances, nil
+}
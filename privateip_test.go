@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestExpandIPPool(t *testing.T) {
+	ips, err := expandIPPool([]string{"10.0.1.9", "10.0.1.8/30", "10.0.1.10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(ips, ","); got != "10.0.1.9,10.0.1.8,10.0.1.10,10.0.1.11" {
+		t.Errorf("expanded to %s", got)
+	}
+
+	for _, pool := range [][]string{{"10.0.1"}, {"10.0.0.0/33"}, {"fd00::1"}, {"10.0.0.0/8"}} {
+		if _, err := expandIPPool(pool); err == nil {
+			t.Errorf("%v was accepted", pool)
+		}
+	}
+}
+
+func TestChoosePrivateIPs(t *testing.T) {
+	fake := useFakeEC2(t)
+	c := context.Background()
+	eni := fake.AddNetworkInterface("subnet-1", "10.0.1.8")
+	// The same address in another subnet is no conflict.
+	fake.AddNetworkInterface("subnet-2", "10.0.1.9")
+
+	ips, err := choosePrivateIPs(c, fake, "subnet-1", nil, []string{"10.0.1.8/30"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(ips, ","); got != "10.0.1.9,10.0.1.10" {
+		t.Errorf("chose %s, want the first free addresses", got)
+	}
+
+	if _, err := choosePrivateIPs(c, fake, "subnet-1", nil, []string{"10.0.1.8/30"}, 4); err == nil || !strings.Contains(err.Error(), "only 3 of the 4") {
+		t.Errorf("err = %v, want too few free addresses", err)
+	}
+	_, err = choosePrivateIPs(c, fake, "subnet-1", []string{"10.0.1.7", "10.0.1.8"}, nil, 2)
+	if err == nil || !strings.Contains(err.Error(), "10.0.1.8 is used by "+eni) {
+		t.Errorf("err = %v, want the conflict with %s", err, eni)
+	}
+	if _, err := choosePrivateIPs(c, fake, "subnet-1", []string{"10.0.1.7"}, nil, 2); err == nil {
+		t.Error("one address was accepted for two instances")
+	}
+	if _, err := choosePrivateIPs(c, fake, "", []string{"10.0.1.7"}, nil, 1); err == nil {
+		t.Error("addresses were accepted without a subnet")
+	}
+}
+
+func TestCreatePrivateIPPool(t *testing.T) {
+	fake := useFakeEC2(t)
+	fake.AddNetworkInterface("subnet-1", "10.0.1.20")
+	useConfig(t, ConfigMap{
+		InstanceType:  "t2.micro",
+		ImageId:       "ami-1",
+		SubnetId:      "subnet-1",
+		PrivateIPPool: []string{"10.0.1.20", "10.0.1.21", "10.0.1.22"},
+	})
+
+	out := runCLI(t, "create", "--tag", "Name=web", "--count", "2")
+
+	var ips []string
+	for _, i := range fake.Instances() {
+		ips = append(ips, aws.ToString(i.PrivateIpAddress))
+	}
+	if got := strings.Join(ips, ","); got != "10.0.1.21,10.0.1.22" {
+		t.Fatalf("launched at %s\n%s", got, out)
+	}
+	if n := countCalls(fake.Calls(), "RunInstances"); n != 2 {
+		t.Errorf("%d launches, want one an address", n)
+	}
+}
+
+func TestLaunchAtPrivateIPsTerminatesOnConflict(t *testing.T) {
+	fake := useFakeEC2(t)
+	fake.AddNetworkInterface("subnet-1", "10.0.1.31")
+
+	_, err := launchAtPrivateIPs(context.Background(), &vmcreate.CreateInput{
+		Tags:         map[string]string{"Name": "web"},
+		InstanceType: "t2.micro",
+		ImageID:      "ami-1",
+		SubnetID:     "subnet-1",
+	}, []string{"10.0.1.30", "10.0.1.31"})
+
+	if err == nil || !strings.Contains(err.Error(), "launching at 10.0.1.31") {
+		t.Fatalf("err = %v, want the conflict", err)
+	}
+	if live := liveInstances(fake); len(live) != 0 {
+		t.Errorf("%d instances left after the failed launch", len(live))
+	}
+}
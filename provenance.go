@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// The provenance tags attribute every instance, and the volumes and network
+// interfaces launched with it, to whoever created it and how.
+const (
+	createdByTag  = "aws-vmcreate:created-by"
+	createdAtTag  = "aws-vmcreate:created-at"
+	versionTag    = "aws-vmcreate:version"
+	configHashTag = "aws-vmcreate:config-hash"
+	// presetTag names the preset of the config the instance was created with.
+	presetTag = "aws-vmcreate:preset"
+)
+
+// managedByTag marks everything aws-vmcreate makes, instances and the
+// snapshots, images, security groups, addresses and roles made for them
+// alike, for list --all-resources to find it.
+const (
+	managedByTag   = "managed-by"
+	managedByValue = "aws-vmcreate"
+)
+
+// invocationRunID is the run of this invocation, which everything it makes
+// is tagged with as runIDTag: that of the create, or one made the first time
+// something is tagged.
+var invocationRunID string
+
+// currentRunID returns the run of the invocation, starting one if there is
+// none yet.
+func currentRunID() string {
+	if invocationRunID == "" {
+		invocationRunID = newRunID(time.Now().UTC())
+		progressln("Tagging what is created with run " + invocationRunID + ", remove it with cleanup --run-id " + invocationRunID)
+	}
+	return invocationRunID
+}
+
+// managedByTool reports whether the tags mark a resource aws-vmcreate made:
+// managed-by=aws-vmcreate, or the provenance tags of those made before it.
+// managed-by is a common key, which other tools set to their own name.
+func managedByTool(tags []types.Tag) bool {
+	return tagValue(tags, managedByTag) == managedByValue || hasTag(tags, createdByTag)
+}
+
+// version is set at build time with -ldflags "-X main.version=1.2.0".
+var version string
+
+// toolVersion returns the version of the binary, falling back to the module
+// version for go install builds.
+func toolVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "dev"
+}
+
+// hashConfig returns a short hash of the settings an instance is created
+// from, so instances created from different configs can be told apart.
+func hashConfig(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// withProvenance returns tags plus the provenance tags, which take precedence.
+func withProvenance(c context.Context, tags map[string]string, configHash string) map[string]string {
+	out := map[string]string{}
+	for k, v := range tags {
+		out[k] = v
+	}
+	out[managedByTag] = managedByValue
+	if out[runIDTag] == "" {
+		out[runIDTag] = currentRunID()
+	}
+	out[versionTag] = toolVersion()
+	out[createdAtTag] = time.Now().UTC().Format(time.RFC3339)
+	if configHash != "" {
+		out[configHashTag] = configHash
+	}
+
+	principal, err := lookupPrincipal(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error looking up the caller identity, the instance will not be tagged with its creator:")
+		fmt.Fprintln(os.Stderr, err)
+		return out
+	}
+	out[createdByTag] = principal
+	return out
+}
+
+// resourceTags returns tags plus the provenance tags for a resource made for
+// the instance, such as its snapshots, with the group and environment of the
+// instance so the resource is attributed to them too. Its run is the one
+// that made it, not that of the instance.
+func resourceTags(c context.Context, i *types.Instance, tags map[string]string) map[string]string {
+	out := withProvenance(c, tags, "")
+	for _, key := range []string{groupTag, envTag} {
+		if v := vmcreate.TagValue(i, key); v != "" {
+			out[key] = v
+		}
+	}
+	return out
+}
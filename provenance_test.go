@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"aws-vmcreate/pkg/vmcreate"
+)
+
+func TestCreateTagsProvenance(t *testing.T) {
+	fake := useFakeEC2(t)
+	runCLI(t, "create", "--tag", "Name=web-1")
+
+	i := fake.Instances()[0]
+	if got := vmcreate.TagValue(&i, createdByTag); got != "arn:aws:iam::123456789012:user/tester" {
+		t.Errorf("%s = %q", createdByTag, got)
+	}
+	if got := vmcreate.TagValue(&i, versionTag); got != "dev" {
+		t.Errorf("%s = %q", versionTag, got)
+	}
+	if _, err := time.Parse(time.RFC3339, vmcreate.TagValue(&i, createdAtTag)); err != nil {
+		t.Errorf("%s: %v", createdAtTag, err)
+	}
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := vmcreate.TagValue(&i, configHashTag); got == "" || got != hashConfig(config) {
+		t.Errorf("%s = %q, want %q", configHashTag, got, hashConfig(config))
+	}
+}
+
+func TestDaemonProvenanceIsNotDrift(t *testing.T) {
+	fake := useFakeEC2(t)
+	state := &DesiredState{Groups: []DesiredGroup{{Name: "web", Count: 1, InstanceType: "t3.micro", ImageId: "ami-web"}}}
+	for n := 0; n < 2; n++ {
+		if err := reconcile(context.Background(), state, false, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	i := fake.Instances()[0]
+	if got := vmcreate.TagValue(&i, configHashTag); got != hashConfig(state.Groups[0]) {
+		t.Errorf("%s = %q", configHashTag, got)
+	}
+	for _, call := range fake.Calls() {
+		if call == "CreateTags" {
+			t.Errorf("the provenance tags were treated as drift: %v", fake.Calls())
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// useMemoryProvider gives the test a memory provider of its own.
+func useMemoryProvider(t *testing.T) *vmcreate.MemoryProvider {
+	t.Helper()
+	previous, previousName := memoryProvider, instanceProvider
+	memoryProvider = vmcreate.NewMemoryProvider()
+	t.Cleanup(func() { memoryProvider, instanceProvider = previous, previousName })
+	return memoryProvider
+}
+
+func TestMemoryProviderCommands(t *testing.T) {
+	fake := useFakeEC2(t)
+	memory := useMemoryProvider(t)
+	ctx := context.Background()
+
+	out := runCLI(t, "create", "--provider", "memory", "--tag", "Name=web-1")
+	instances, err := memory.ListInstances(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 {
+		t.Fatalf("the memory provider has %d instances, want 1\n%s", len(instances), out)
+	}
+	i := instances[0]
+	id := aws.ToString(i.InstanceId)
+	if vmcreate.TagValue(&i, "Name") != "web-1" || vmcreate.TagValue(&i, "aws-vmcreate:created-by") == "" {
+		t.Errorf("instance tagged %v", i.Tags)
+	}
+	if i.InstanceType != "t2.micro" || aws.ToString(i.ImageId) != "ami-0d0ca2066b861631c" {
+		t.Errorf("launched %s %s, want the data/config.json values", i.InstanceType, aws.ToString(i.ImageId))
+	}
+	if !strings.Contains(out, "Created tagged instance with ID "+id) {
+		t.Errorf("output does not report the instance:\n%s", out)
+	}
+
+	out = runCLI(t, "list", "--provider", "memory")
+	if !strings.Contains(out, id) {
+		t.Errorf("list does not show %s:\n%s", id, out)
+	}
+
+	runCLI(t, "resize", "--provider", "memory", "-i", id, "-t", "t3.small")
+	if i, _ := memory.ListInstances(ctx, vmcreate.InstanceIDFilter(id)); i[0].InstanceType != "t3.small" || i[0].State.Name != types.InstanceStateNameRunning {
+		t.Errorf("%s is a %s %s after resize", id, i[0].State.Name, i[0].InstanceType)
+	}
+
+	out = runCLI(t, "delete", "--provider", "memory", "--tag", "Name=web-1")
+	if i, _ := memory.ListInstances(ctx, vmcreate.InstanceIDFilter(id)); i[0].State.Name != types.InstanceStateNameTerminated {
+		t.Errorf("%s is %s after delete\n%s", id, i[0].State.Name, out)
+	}
+	if !strings.Contains(out, "Terminated instance with id: "+id) {
+		t.Errorf("output does not report the termination:\n%s", out)
+	}
+
+	if n := len(fake.Instances()); n != 0 {
+		t.Errorf("launched %d EC2 instances", n)
+	}
+	for _, call := range fake.Calls() {
+		if call == "RunInstances" || call == "TerminateInstances" || call == "ModifyInstanceAttribute" {
+			t.Errorf("called EC2 %s", call)
+		}
+	}
+}
+
+func TestProviderFromConfig(t *testing.T) {
+	fake := useFakeEC2(t)
+	memory := useMemoryProvider(t)
+	useConfig(t, ConfigMap{InstanceType: "t3.micro", ImageId: "ami-0123456789abcdef0", Provider: "memory"})
+
+	out := runCLI(t, "create", "--tag", "Name=web-1")
+	if instances, _ := memory.ListInstances(context.Background()); len(instances) != 1 {
+		t.Errorf("the memory provider has %d instances, want 1\n%s", len(instances), out)
+	}
+	if n := len(fake.Instances()); n != 0 {
+		t.Errorf("launched %d EC2 instances", n)
+	}
+
+	// The flag wins over the config.
+	fake = useFakeEC2(t)
+	runCLI(t, "create", "--provider", "ec2", "--tag", "Name=web-2")
+	if n := len(fake.Instances()); n != 1 {
+		t.Errorf("launched %d EC2 instances with --provider ec2, want 1", n)
+	}
+}
+
+func TestUnknownProvider(t *testing.T) {
+	fake := useFakeEC2(t)
+	useMemoryProvider(t)
+
+	_, stderr, code := runCLIExit(t, false, "create", "--provider", "gce", "--tag", "Name=web-1")
+	if code != 1 || !strings.Contains(stderr, `"gce" is not a provider`) {
+		t.Errorf("exit %d, stderr:\n%s", code, stderr)
+	}
+	if calls := fake.Calls(); len(calls) != 0 {
+		t.Errorf("made calls %v", calls)
+	}
+}
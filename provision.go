@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// provisionScriptPath is where provisioning scripts are written on the instance.
+const provisionScriptPath = "/tmp/aws-vmcreate-provision.sh"
+
+// SSMInstanceAPI defines the interface for the DescribeInstanceInformation function.
+// We use this interface to test the functions using a mocked service.
+type SSMInstanceAPI interface {
+	DescribeInstanceInformation(ctx context.Context,
+		params *awsapi.DescribeInstanceInformationInput) (*awsapi.DescribeInstanceInformationOutput, error)
+}
+
+// SSMProvisionAPI defines the interface for the functions used to run a provisioning script over SSM.
+// We use this interface to test the functions using a mocked service.
+type SSMProvisionAPI interface {
+	SSMInstanceAPI
+	SSMCommandAPI
+}
+
+// GetManagedInstances lists the Amazon Elastic Compute Cloud (Amazon EC2) instances registered with AWS Systems Manager.
+// Inputs:
+//
+//	c is the context of the method call, which includes the AWS Region.
+//	api is the interface that defines the method call.
+//	input defines the input arguments to the service call.
+//
+// Output:
+//
+//	If success, a DescribeInstanceInformationOutput object containing the result of the service call and nil.
+//	Otherwise, nil and an error from the call to DescribeInstanceInformation.
+func GetManagedInstances(c context.Context, api SSMInstanceAPI, input *awsapi.DescribeInstanceInformationInput) (*awsapi.DescribeInstanceInformationOutput, error) {
+	return api.DescribeInstanceInformation(c, input)
+}
+
+// waitForSSM waits until the SSM agent on the instance reports that it is online.
+func waitForSSM(c context.Context, api SSMInstanceAPI, instanceID string, timeout time.Duration) error {
+	c, cancel := context.WithTimeout(c, timeout)
+	defer cancel()
+
+	input := &awsapi.DescribeInstanceInformationInput{
+		Filters: []awsapi.InstanceInformationFilter{
+			{Key: "InstanceIds", Values: []string{instanceID}},
+		},
+	}
+	for {
+		result, err := GetManagedInstances(c, api, input)
+		if err != nil {
+			return err
+		}
+		for _, info := range result.InstanceInformationList {
+			if info.InstanceId == instanceID && info.PingStatus == "Online" {
+				return nil
+			}
+		}
+
+		select {
+		case <-c.Done():
+			return fmt.Errorf("instance %s did not register with SSM: %w", instanceID, c.Err())
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// provisionInstance waits for the instance to be reachable, then uploads and
+// runs script on it with SSM (through api) or SSH, streaming its output to
+// the diagnostics. It returns an error if the script exits non-zero.
+func provisionInstance(c context.Context, api SSMProvisionAPI, instanceID string, script string, via string, osUser string, timeout time.Duration) error {
+	content, err := os.ReadFile(script)
+	if err != nil {
+		return err
+	}
+
+	progressln("Waiting for instance " + instanceID + " to be running")
+	instance, err := provisioner.WaitForRunning(c, instanceID, timeout)
+	if err != nil {
+		return err
+	}
+
+	switch via {
+	case "ssm":
+		progressln("Waiting for instance " + instanceID + " to register with SSM")
+		if err := waitForSSM(c, api, instanceID, timeout); err != nil {
+			return err
+		}
+
+		progressln("Running " + script + " on " + instanceID)
+		// The script is written out with a quoted heredoc so it reaches the
+		// instance byte for byte.
+		_, err = runShellCommands(c, api, instanceID, []string{
+			"cat > " + provisionScriptPath + " <<'AWS_VMCREATE_EOF'\n" + strings.TrimSuffix(string(content), "\n") + "\nAWS_VMCREATE_EOF",
+			"chmod +x " + provisionScriptPath,
+			provisionScriptPath,
+		}, diagnostics)
+		return err
+
+	case "ssh":
+		host := aws.ToString(instance.PublicIpAddress)
+		if host == "" {
+			return fmt.Errorf("instance %s has no public IP to provision over SSH", instanceID)
+		}
+
+		dir, err := os.MkdirTemp("", "aws-vmcreate-provision")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		// sshd may take a little longer than the instance state to come up.
+		deadline := time.Now().Add(timeout)
+		for {
+			keyPath, err := pushEphemeralKey(c, instance, osUser, dir)
+			if err != nil {
+				return err
+			}
+
+			progressln("Running " + script + " on " + instanceID)
+			cmd := exec.CommandContext(c, "ssh", append(sshArgs(keyPath),
+				"-o", "ConnectTimeout=10",
+				osUser+"@"+host,
+				"sudo bash -s")...)
+			cmd.Stdin = strings.NewReader(string(content))
+			// The output of the script is the progress of the create.
+			cmd.Stdout = diagnostics
+			cmd.Stderr = os.Stderr
+			err = cmd.Run()
+
+			// ssh exits with 255 when it could not connect at all.
+			if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 255 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Second)
+				continue
+			}
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unknown provisioning method %q, must be ssm or ssh", via)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeProvisionSSM reports every instance online and runs commands like
+// fakeDrainSSM.
+type fakeProvisionSSM struct {
+	fakeDrainSSM
+}
+
+func (f *fakeProvisionSSM) DescribeInstanceInformation(ctx context.Context, params *awsapi.DescribeInstanceInformationInput) (*awsapi.DescribeInstanceInformationOutput, error) {
+	return &awsapi.DescribeInstanceInformationOutput{InstanceInformationList: []awsapi.InstanceInformation{
+		{InstanceId: params.Filters[0].Values[0], PingStatus: "Online"},
+	}}, nil
+}
+
+func writeScript(t *testing.T, content string) string {
+	t.Helper()
+	script := filepath.Join(t.TempDir(), "setup.sh")
+	if err := os.WriteFile(script, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return script
+}
+
+func TestProvisionOverSSM(t *testing.T) {
+	fake := useFakeEC2(t)
+	defer func(interval time.Duration) { commandPollInterval = interval }(commandPollInterval)
+	commandPollInterval = time.Millisecond
+	id := fake.AddInstance(types.Instance{State: &types.InstanceState{Name: types.InstanceStateNameRunning}})
+	script := writeScript(t, "#!/bin/bash\necho 'ready'\n")
+
+	ssm := &fakeProvisionSSM{}
+	if err := provisionInstance(context.Background(), ssm, id, script, "ssm", "ec2-user", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"cat > /tmp/aws-vmcreate-provision.sh <<'AWS_VMCREATE_EOF'\n#!/bin/bash\necho 'ready'\nAWS_VMCREATE_EOF",
+		"chmod +x /tmp/aws-vmcreate-provision.sh",
+		"/tmp/aws-vmcreate-provision.sh",
+	}
+	if len(ssm.sent) != 1 || !reflect.DeepEqual(ssm.sent[0], want) {
+		t.Errorf("sent %q, want %q", ssm.sent, want)
+	}
+}
+
+func TestProvisionOverSSH(t *testing.T) {
+	fake := useFakeEC2(t)
+	pushed := useFakeInstanceConnect(t)
+	id := fake.AddInstance(types.Instance{
+		State:           &types.InstanceState{Name: types.InstanceStateNameRunning},
+		PublicIpAddress: aws.String("203.0.113.7"),
+		Placement:       &types.Placement{AvailabilityZone: aws.String("us-east-1a")},
+	})
+	script := writeScript(t, "echo ready\n")
+	args := fakeCommand(t, "ssh", 0)
+
+	if err := provisionInstance(context.Background(), nil, id, script, "ssh", "ubuntu", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if len(pushed.pushed) != 1 || pushed.pushed[0].InstanceOSUser != "ubuntu" {
+		t.Errorf("pushed %+v", pushed.pushed)
+	}
+	got := readArgs(t, args)
+	want := append(sshArgs(got[1]), "-o", "ConnectTimeout=10", "ubuntu@203.0.113.7", "sudo bash -s")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ssh %q, want %q", got, want)
+	}
+
+	// A script that fails fails the provisioning, without another try.
+	fakeCommand(t, "ssh", 3)
+	if err := provisionInstance(context.Background(), nil, id, script, "ssh", "ubuntu", time.Minute); err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Errorf("got %v", err)
+	}
+
+	// An instance without a public IP can't be provisioned over SSH.
+	private := fake.AddInstance(types.Instance{State: &types.InstanceState{Name: types.InstanceStateNameRunning}})
+	if err := provisionInstance(context.Background(), nil, private, script, "ssh", "ubuntu", time.Minute); err == nil || !strings.Contains(err.Error(), "has no public IP") {
+		t.Errorf("got %v", err)
+	}
+	if err := provisionInstance(context.Background(), nil, id, script, "scp", "ubuntu", time.Minute); err == nil || !strings.Contains(err.Error(), `unknown provisioning method "scp"`) {
+		t.Errorf("got %v", err)
+	}
+}
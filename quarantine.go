@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// quarantinedTag records when an instance was quarantined, and the other
+// quarantine tags why, by whom and what it had before, so that it can be
+// restored once the incident is over.
+const (
+	quarantinedTag         = "aws-vmcreate:quarantined"
+	quarantineReasonTag    = "aws-vmcreate:quarantine-reason"
+	quarantinedByTag       = "aws-vmcreate:quarantined-by"
+	quarantinedGroupsTag   = "aws-vmcreate:quarantined-groups"
+	quarantinedProfileTag  = "aws-vmcreate:quarantined-profile"
+	quarantineSnapshotsTag = "aws-vmcreate:quarantine-snapshots"
+	quarantineCaptureTag   = "aws-vmcreate:quarantine-capture"
+	quarantineOfTag        = "aws-vmcreate:quarantine-of"
+)
+
+// QuarantineInstanceAPI defines the interface for the quarantineInstance function.
+// We use this interface to test the function using a mocked service.
+type QuarantineInstanceAPI interface {
+	QuarantineAPI
+	SnapshotSharingAPI
+
+	CreateTags(ctx context.Context,
+		params *ec2.CreateTagsInput,
+		optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error)
+
+	ModifyNetworkInterfaceAttribute(ctx context.Context,
+		params *ec2.ModifyNetworkInterfaceAttributeInput,
+		optFns ...func(*ec2.Options)) (*ec2.ModifyNetworkInterfaceAttributeOutput, error)
+
+	ModifyInstanceAttribute(ctx context.Context,
+		params *ec2.ModifyInstanceAttributeInput,
+		optFns ...func(*ec2.Options)) (*ec2.ModifyInstanceAttributeOutput, error)
+
+	DescribeIamInstanceProfileAssociations(ctx context.Context,
+		params *ec2.DescribeIamInstanceProfileAssociationsInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeIamInstanceProfileAssociationsOutput, error)
+
+	DisassociateIamInstanceProfile(ctx context.Context,
+		params *ec2.DisassociateIamInstanceProfileInput,
+		optFns ...func(*ec2.Options)) (*ec2.DisassociateIamInstanceProfileOutput, error)
+
+	CreateSnapshots(ctx context.Context,
+		params *ec2.CreateSnapshotsInput,
+		optFns ...func(*ec2.Options)) (*ec2.CreateSnapshotsOutput, error)
+}
+
+// quarantineInstance cuts the instance off: its network interfaces are
+// moved to a security group that allows no traffic, its instance profile is
+// detached, termination protection is turned on and its volumes are
+// snapshotted for forensics. The instance is tagged with what it had first,
+// so that is known even when a later step fails. Every step is tried, and
+// the ones that failed are returned in the error.
+//
+// With capture set, the capture documents are run and the volumes
+// snapshotted before the instance is isolated, while it can still reach
+// SSM and S3, and the snapshots are then shared with the forensics account.
+func quarantineInstance(c context.Context, api QuarantineInstanceAPI, commands SSMCommandAPI, instanceID string, reason string, capture *ForensicsConfig) (*quarantined, error) {
+	instance, err := provisioner.Describe(c, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if aws.ToString(instance.VpcId) == "" {
+		return nil, fmt.Errorf("instance %s is not in a VPC", instanceID)
+	}
+	result := &quarantined{}
+
+	var groups []string
+	for _, g := range instance.SecurityGroups {
+		groups = append(groups, aws.ToString(g.GroupId))
+	}
+	now := time.Now().UTC()
+	name := "quarantine-" + instanceID + "-" + now.Format("20060102-150405")
+	tags := map[string]string{
+		quarantinedTag:       now.Format(time.RFC3339),
+		quarantinedGroupsTag: strings.Join(groups, ","),
+	}
+	if reason != "" {
+		tags[quarantineReasonTag] = reason
+	}
+	if instance.IamInstanceProfile != nil {
+		tags[quarantinedProfileTag] = aws.ToString(instance.IamInstanceProfile.Arn)
+	}
+	if principal, err := lookupPrincipal(c); err == nil {
+		tags[quarantinedByTag] = principal
+	}
+	if _, err := api.CreateTags(c, &ec2.CreateTagsInput{Resources: []string{instanceID}, Tags: vmcreate.Tags(tags)}); err != nil {
+		return nil, fmt.Errorf("tagging %s: %w", instanceID, err)
+	}
+
+	var failed []string
+	step := func(description string, err error) {
+		if err != nil {
+			failed = append(failed, description+": "+err.Error())
+			fmt.Fprintln(os.Stderr, "Failed "+description+": "+err.Error())
+			return
+		}
+		result.Done = append(result.Done, description)
+		progressln("Done " + description)
+	}
+	snapshot := func() {
+		snapshots, err := api.CreateSnapshots(c, &ec2.CreateSnapshotsInput{
+			InstanceSpecification: &types.InstanceSpecification{InstanceId: aws.String(instanceID)},
+			Description:           aws.String("aws-vmcreate quarantine of " + instanceID),
+			CopyTagsFromSource:    types.CopyTagsFromSourceVolume,
+			TagSpecifications:     tagSpecification(types.ResourceTypeSnapshot, resourceTags(c, instance, map[string]string{quarantineOfTag: instanceID}), name),
+		})
+		if err == nil {
+			for _, s := range snapshots.Snapshots {
+				result.SnapshotIDs = append(result.SnapshotIDs, aws.ToString(s.SnapshotId))
+			}
+			_, err = api.CreateTags(c, &ec2.CreateTagsInput{
+				Resources: []string{instanceID},
+				Tags:      vmcreate.Tags(map[string]string{quarantineSnapshotsTag: strings.Join(result.SnapshotIDs, ",")}),
+			})
+		}
+		step("snapshotting the volumes "+strings.Join(result.SnapshotIDs, ", "), err)
+	}
+
+	if capture != nil {
+		result.CaptureLocation, err = captureVolatileData(c, commands, instanceID, capture, now)
+		if err == nil {
+			_, err = api.CreateTags(c, &ec2.CreateTagsInput{
+				Resources: []string{instanceID},
+				Tags:      vmcreate.Tags(map[string]string{quarantineCaptureTag: result.CaptureLocation}),
+			})
+		}
+		step("capturing the volatile data to "+result.CaptureLocation, err)
+		snapshot()
+	}
+
+	result.SecurityGroupID, err = createQuarantineGroup(c, api, aws.ToString(instance.VpcId), name,
+		resourceTags(c, instance, map[string]string{quarantineOfTag: instanceID}), "")
+	step("creating the deny-all security group "+result.SecurityGroupID, err)
+	if err == nil {
+		// Changing the groups of the instance only changes its primary
+		// interface, so every interface is moved.
+		for _, nic := range instance.NetworkInterfaces {
+			_, err := api.ModifyNetworkInterfaceAttribute(c, &ec2.ModifyNetworkInterfaceAttributeInput{
+				NetworkInterfaceId: nic.NetworkInterfaceId,
+				Groups:             []string{result.SecurityGroupID},
+			})
+			step("moving "+aws.ToString(nic.NetworkInterfaceId)+" to the deny-all security group", err)
+		}
+	}
+
+	if instance.IamInstanceProfile != nil {
+		step("detaching the instance profile "+aws.ToString(instance.IamInstanceProfile.Arn), detachInstanceProfile(c, api, instanceID))
+	}
+
+	_, err = api.ModifyInstanceAttribute(c, &ec2.ModifyInstanceAttributeInput{
+		InstanceId:            aws.String(instanceID),
+		DisableApiTermination: &types.AttributeBooleanValue{Value: aws.Bool(true)},
+	})
+	step("turning on termination protection", err)
+
+	if capture == nil {
+		snapshot()
+	} else if capture.Account != "" {
+		step("sharing the snapshots with "+capture.Account, shareSnapshots(c, api, result.SnapshotIDs, capture.Account))
+	}
+
+	if len(failed) > 0 {
+		return result, fmt.Errorf("%d quarantine steps failed: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return result, nil
+}
+
+// quarantined is what quarantine made.
+type quarantined struct {
+	SecurityGroupID string
+	SnapshotIDs     []string
+	// CaptureLocation is the S3 location of the captured data.
+	CaptureLocation string
+	// Done are the steps that succeeded, in order.
+	Done []string
+}
+
+// detachInstanceProfile removes the instance profile of the instance. The
+// credentials already handed out stay valid until they expire.
+func detachInstanceProfile(c context.Context, api QuarantineInstanceAPI, instanceID string) error {
+	associations, err := api.DescribeIamInstanceProfileAssociations(c, &ec2.DescribeIamInstanceProfileAssociationsInput{
+		Filters: []types.Filter{
+			{Name: aws.String("instance-id"), Values: []string{instanceID}},
+			{Name: aws.String("state"), Values: []string{"associated"}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	for _, a := range associations.IamInstanceProfileAssociations {
+		if _, err := api.DisassociateIamInstanceProfile(c, &ec2.DisassociateIamInstanceProfileInput{AssociationId: a.AssociationId}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func QuarantineCmd(instanceID *string, reason *string, capture *bool) {
+	var forensics *ForensicsConfig
+	if *capture {
+		config, err := loadConfig()
+		if err != nil {
+			commandErr = err
+			fmt.Fprintln(os.Stderr, "Got an error loading the config:")
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		if config.Forensics == nil {
+			commandErr = errors.New("--capture needs the forensics bucket of the config")
+			fmt.Fprintln(os.Stderr, "Got an error quarantining the instance:")
+			fmt.Fprintln(os.Stderr, commandErr)
+			return
+		}
+		forensics = config.Forensics
+	}
+
+	result, err := quarantineInstance(context.TODO(), client, ssmClient, *instanceID, *reason, forensics)
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error quarantining the instance:")
+		fmt.Fprintln(os.Stderr, err)
+		// Only what was done is reported, which need not isolate it.
+		if result != nil && len(result.Done) > 0 {
+			progressln("Partly quarantined " + *instanceID + ", done: " + strings.Join(result.Done, "; "))
+		}
+		return
+	}
+	printResult("Quarantined "+*instanceID+" in security group "+result.SecurityGroupID, *instanceID)
+	progressln("The original security groups and instance profile are in its " + quarantinedGroupsTag + " and " + quarantinedProfileTag + " tags")
+	progressln("Connections already open stay open until they close; credentials already issued to the instance stay valid until they expire")
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeQuarantine records the interfaces, profiles, volumes and commands
+// quarantine changes and runs.
+type fakeQuarantine struct {
+	*fakeDebugClone
+	snapshotErr error
+	groupErr    error
+	sent        []*awsapi.SendCommandInput
+}
+
+func (f *fakeQuarantine) CreateSecurityGroup(ctx context.Context, params *ec2.CreateSecurityGroupInput, optFns ...func(*ec2.Options)) (*ec2.CreateSecurityGroupOutput, error) {
+	if f.groupErr != nil {
+		return nil, f.groupErr
+	}
+	return f.fakeDebugClone.CreateSecurityGroup(ctx, params, optFns...)
+}
+
+func (f *fakeQuarantine) SendCommand(ctx context.Context, params *awsapi.SendCommandInput) (*awsapi.SendCommandOutput, error) {
+	f.sent = append(f.sent, params)
+	f.changes = append(f.changes, "run "+params.DocumentName)
+	return &awsapi.SendCommandOutput{Command: awsapi.Command{CommandId: "cmd-1"}}, nil
+}
+
+func (f *fakeQuarantine) GetCommandInvocation(ctx context.Context, params *awsapi.GetCommandInvocationInput) (*awsapi.GetCommandInvocationOutput, error) {
+	return &awsapi.GetCommandInvocationOutput{Status: "Success"}, nil
+}
+
+func (f *fakeQuarantine) DescribeSnapshots(ctx context.Context, params *ec2.DescribeSnapshotsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSnapshotsOutput, error) {
+	out := &ec2.DescribeSnapshotsOutput{}
+	for _, id := range params.SnapshotIds {
+		out.Snapshots = append(out.Snapshots, types.Snapshot{SnapshotId: aws.String(id), State: types.SnapshotStateCompleted})
+	}
+	return out, nil
+}
+
+func (f *fakeQuarantine) ModifySnapshotAttribute(ctx context.Context, params *ec2.ModifySnapshotAttributeInput, optFns ...func(*ec2.Options)) (*ec2.ModifySnapshotAttributeOutput, error) {
+	f.changes = append(f.changes, "share "+aws.ToString(params.SnapshotId)+" "+aws.ToString(params.CreateVolumePermission.Add[0].UserId))
+	return &ec2.ModifySnapshotAttributeOutput{}, nil
+}
+
+func (f *fakeQuarantine) ModifyNetworkInterfaceAttribute(ctx context.Context, params *ec2.ModifyNetworkInterfaceAttributeInput, optFns ...func(*ec2.Options)) (*ec2.ModifyNetworkInterfaceAttributeOutput, error) {
+	f.changes = append(f.changes, "move "+aws.ToString(params.NetworkInterfaceId)+" "+strings.Join(params.Groups, ","))
+	return &ec2.ModifyNetworkInterfaceAttributeOutput{}, nil
+}
+
+func (f *fakeQuarantine) DescribeIamInstanceProfileAssociations(ctx context.Context, params *ec2.DescribeIamInstanceProfileAssociationsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeIamInstanceProfileAssociationsOutput, error) {
+	return &ec2.DescribeIamInstanceProfileAssociationsOutput{IamInstanceProfileAssociations: []types.IamInstanceProfileAssociation{{AssociationId: aws.String("iip-assoc-1")}}}, nil
+}
+
+func (f *fakeQuarantine) DisassociateIamInstanceProfile(ctx context.Context, params *ec2.DisassociateIamInstanceProfileInput, optFns ...func(*ec2.Options)) (*ec2.DisassociateIamInstanceProfileOutput, error) {
+	f.changes = append(f.changes, "disassociate "+aws.ToString(params.AssociationId))
+	return &ec2.DisassociateIamInstanceProfileOutput{}, nil
+}
+
+func (f *fakeQuarantine) CreateSnapshots(ctx context.Context, params *ec2.CreateSnapshotsInput, optFns ...func(*ec2.Options)) (*ec2.CreateSnapshotsOutput, error) {
+	if f.snapshotErr != nil {
+		return nil, f.snapshotErr
+	}
+	f.changes = append(f.changes, "snapshot "+aws.ToString(params.InstanceSpecification.InstanceId))
+	return &ec2.CreateSnapshotsOutput{Snapshots: []types.SnapshotInfo{{SnapshotId: aws.String("snap-1")}, {SnapshotId: aws.String("snap-2")}}}, nil
+}
+
+func newFakeQuarantine(t *testing.T) (*fakeQuarantine, string) {
+	fake := useFakeEC2(t)
+	api := &fakeQuarantine{fakeDebugClone: &fakeDebugClone{fakeSecurityGroups: &fakeSecurityGroups{FakeEC2: fake}}}
+	id := fake.AddInstance(types.Instance{
+		VpcId:              aws.String("vpc-1"),
+		SecurityGroups:     []types.GroupIdentifier{{GroupId: aws.String("sg-web")}, {GroupId: aws.String("sg-ssh")}},
+		IamInstanceProfile: &types.IamInstanceProfile{Arn: aws.String("arn:aws:iam::123456789012:instance-profile/web")},
+		NetworkInterfaces: []types.InstanceNetworkInterface{
+			{NetworkInterfaceId: aws.String("eni-1")},
+			{NetworkInterfaceId: aws.String("eni-2")},
+		},
+	})
+	return api, id
+}
+
+func TestQuarantineInstance(t *testing.T) {
+	api, id := newFakeQuarantine(t)
+
+	result, err := quarantineInstance(context.Background(), api, api, id, "IR-42", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"create-group vpc-1",
+		"revoke-egress sg-quarantine -1 0.0.0.0/0",
+		"move eni-1 sg-quarantine",
+		"move eni-2 sg-quarantine",
+		"disassociate iip-assoc-1",
+		"snapshot " + id,
+	}
+	if strings.Join(api.changes, "\n") != strings.Join(want, "\n") {
+		t.Errorf("changes = %q, want %q", api.changes, want)
+	}
+	if !contains(api.Calls(), "ModifyInstanceAttribute") {
+		t.Error("termination protection was not turned on")
+	}
+	if strings.Join(result.SnapshotIDs, ",") != "snap-1,snap-2" {
+		t.Errorf("snapshots = %v", result.SnapshotIDs)
+	}
+
+	instance := api.Instance(id)
+	for tag, want := range map[string]string{
+		quarantineReasonTag:    "IR-42",
+		quarantinedByTag:       "arn:aws:iam::123456789012:user/tester",
+		quarantinedGroupsTag:   "sg-web,sg-ssh",
+		quarantinedProfileTag:  "arn:aws:iam::123456789012:instance-profile/web",
+		quarantineSnapshotsTag: "snap-1,snap-2",
+	} {
+		if got := vmcreate.TagValue(instance, tag); got != want {
+			t.Errorf("%s = %q, want %q", tag, got, want)
+		}
+	}
+	if vmcreate.TagValue(instance, quarantinedTag) == "" {
+		t.Errorf("no %s tag", quarantinedTag)
+	}
+}
+
+func TestQuarantineInstanceKeepsGoing(t *testing.T) {
+	api, id := newFakeQuarantine(t)
+	api.snapshotErr = errors.New("SnapshotLimitExceeded")
+
+	_, err := quarantineInstance(context.Background(), api, api, id, "", nil)
+	if err == nil || !strings.Contains(err.Error(), "SnapshotLimitExceeded") {
+		t.Fatalf("got %v, want the snapshot error", err)
+	}
+	if !contains(api.changes, "disassociate iip-assoc-1") || !contains(api.changes, "move eni-2 sg-quarantine") {
+		t.Errorf("the other steps were not done: %q", api.changes)
+	}
+}
+
+func TestQuarantineWithoutGroup(t *testing.T) {
+	api, id := newFakeQuarantine(t)
+	api.groupErr = errors.New("SecurityGroupLimitExceeded")
+
+	result, err := quarantineInstance(context.Background(), api, api, id, "", nil)
+	if err == nil || !strings.Contains(err.Error(), "SecurityGroupLimitExceeded") {
+		t.Fatalf("got %v, want the security group error", err)
+	}
+	if result.SecurityGroupID != "" || contains(api.changes, "move eni-1 sg-quarantine") {
+		t.Errorf("isolated in %q without a group: %q", result.SecurityGroupID, api.changes)
+	}
+	for _, d := range result.Done {
+		if strings.Contains(d, "security group") {
+			t.Errorf("done = %q, want only the steps that succeeded", result.Done)
+		}
+	}
+	if !contains(result.Done, "turning on termination protection") {
+		t.Errorf("done = %q, want termination protection", result.Done)
+	}
+}
+
+func TestQuarantineCaptureBeforeIsolating(t *testing.T) {
+	api, id := newFakeQuarantine(t)
+	commandPollInterval = time.Millisecond
+	t.Cleanup(func() { commandPollInterval = 2 * time.Second })
+
+	result, err := quarantineInstance(context.Background(), api, api, id, "", &ForensicsConfig{Bucket: "forensics", Prefix: "ir/", Account: "210987654321"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"run AWS-RunShellScript",
+		"snapshot " + id,
+		"create-group vpc-1",
+		"revoke-egress sg-quarantine -1 0.0.0.0/0",
+		"move eni-1 sg-quarantine",
+		"move eni-2 sg-quarantine",
+		"disassociate iip-assoc-1",
+		"share snap-1 210987654321",
+		"share snap-2 210987654321",
+	}
+	if strings.Join(api.changes, "\n") != strings.Join(want, "\n") {
+		t.Errorf("changes = %q, want %q", api.changes, want)
+	}
+	sent := api.sent[0]
+	if sent.OutputS3BucketName != "forensics" || !strings.HasPrefix(sent.OutputS3KeyPrefix, "ir/"+id+"/") {
+		t.Errorf("output goes to %s/%s", sent.OutputS3BucketName, sent.OutputS3KeyPrefix)
+	}
+	if got := vmcreate.TagValue(api.Instance(id), quarantineCaptureTag); got == "" || got != result.CaptureLocation {
+		t.Errorf("%s = %q, want %q", quarantineCaptureTag, got, result.CaptureLocation)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/smithy-go"
+)
+
+// EC2 throttles each account with token buckets. Mutating actions share a
+// bucket of 50 tokens refilled at 5 a second, which is what the changes to
+// many instances are made at unless --rate says otherwise.
+const (
+	ec2MutatingBurst = 50
+	ec2MutatingRate  = 5
+)
+
+var (
+	// operationRate is the mutating EC2 calls a second the operation
+	// queues make, and operationConcurrency how many operations run at once.
+	operationRate        float64 = ec2MutatingRate
+	operationConcurrency         = 8
+	// throttleRetries is how many times a throttled operation is retried.
+	throttleRetries = 5
+)
+
+// throttlingErrorCodes are the errors AWS APIs reject requests over their
+// rate with.
+var throttlingErrorCodes = map[string]bool{
+	"RequestLimitExceeded":     true,
+	"Throttling":               true,
+	"ThrottlingException":      true,
+	"TooManyRequestsException": true,
+	"PriorRequestNotComplete":  true,
+	"SlowDown":                 true,
+}
+
+// isThrottling reports whether err is an API refusing a call over its rate,
+// from the SDK or the awsapi clients.
+func isThrottling(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return throttlingErrorCodes[apiErr.ErrorCode()]
+	}
+	var awsErr *awsapi.Error
+	return errors.As(err, &awsErr) && (throttlingErrorCodes[awsErr.Code] || awsErr.StatusCode == 429)
+}
+
+// rateLimiter is a token bucket like the one EC2 throttles with.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// wait takes n tokens, waiting for the bucket to refill when it is short.
+func (l *rateLimiter) wait(c context.Context, n float64) error {
+	n = math.Min(n, l.burst)
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+		l.last = now
+		if l.tokens >= n {
+			l.tokens -= n
+			l.mu.Unlock()
+			return nil
+		}
+		delay := time.Duration((n - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+
+		select {
+		case <-c.Done():
+			return c.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// slowDown halves the rate and empties the bucket after a throttled call,
+// down to a call every ten seconds.
+func (l *rateLimiter) slowDown() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = math.Max(l.rate/2, 0.1)
+	l.tokens = 0
+}
+
+// operation is one change an operation queue makes, usually to one
+// instance.
+type operation struct {
+	// Name says what the operation does, e.g. "resizing i-0abc to m5.large",
+	// for its error.
+	Name string
+	// Done is printed once it succeeds.
+	Done string
+	// Calls is how many mutating EC2 calls it makes, and so the tokens it
+	// takes.
+	Calls int
+	Run   func(c context.Context) error
+}
+
+// operationQueue makes changes to many instances through a rate limiter,
+// a few at a time, instead of firing the calls as fast as possible, and
+// shows their progress. A throttled operation slows the queue down and is
+// retried.
+type operationQueue struct {
+	label       string
+	concurrency int
+	limiter     *rateLimiter
+	// out shows the progress and errOut the errors.
+	out    io.Writer
+	errOut io.Writer
+}
+
+func newOperationQueue(label string) *operationQueue {
+	return &operationQueue{
+		label:       label,
+		concurrency: operationConcurrency,
+		limiter:     newRateLimiter(operationRate, ec2MutatingBurst),
+		out:         diagnostics,
+		errOut:      os.Stderr,
+	}
+}
+
+// Run runs the operations and returns their errors, by index. The errors
+// are also printed, and the progress is shown once there are several
+// operations.
+func (q *operationQueue) Run(c context.Context, ops []operation) []error {
+	errs := make([]error, len(ops))
+	p := &progress{out: q.out, errOut: q.errOut, label: q.label, total: len(ops), started: time.Now(), bar: isTerminal(q.out), hidden: len(ops) < 2}
+
+	var wg sync.WaitGroup
+	work := make(chan int)
+	for w := 0; w < q.concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				errs[i] = q.run(c, ops[i])
+				p.done(ops[i], errs[i])
+			}
+		}()
+	}
+	for i := range ops {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	return errs
+}
+
+// run runs the operation once the rate allows, retrying it at a lower rate
+// while it is throttled.
+func (q *operationQueue) run(c context.Context, op operation) error {
+	calls := op.Calls
+	if calls < 1 {
+		calls = 1
+	}
+	for attempt := 0; ; attempt++ {
+		if err := q.limiter.wait(c, float64(calls)); err != nil {
+			return err
+		}
+		err := op.Run(c)
+		if err == nil || !isThrottling(err) || attempt == throttleRetries {
+			return err
+		}
+		q.limiter.slowDown()
+	}
+}
+
+// progress reports the operations of a queue as they complete: a bar
+// redrawn in place on a terminal, and a line every tenth otherwise.
+type progress struct {
+	mu        sync.Mutex
+	out       io.Writer
+	errOut    io.Writer
+	label     string
+	total     int
+	completed int
+	failed    int
+	started   time.Time
+	bar       bool
+	hidden    bool
+	// reported is the last tenth reported without a bar.
+	reported int
+}
+
+// done reports the operation, its message or its error, and the progress.
+func (p *progress) done(op operation, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.completed++
+	if p.bar && !p.hidden {
+		// The messages go above the bar.
+		fmt.Fprint(p.out, "\r\033[K")
+	}
+	if err != nil {
+		p.failed++
+		fmt.Fprintln(p.errOut, "Got an error "+op.Name+":")
+		fmt.Fprintln(p.errOut, err)
+		resultError(op.Name + ": " + err.Error())
+	} else if op.Done != "" {
+		fmt.Fprintln(p.out, op.Done)
+	}
+
+	switch {
+	case p.hidden:
+	case p.bar:
+		fmt.Fprint(p.out, p.line(time.Now()))
+		if p.completed == p.total {
+			fmt.Fprintln(p.out)
+		}
+	case p.completed*10/p.total > p.reported:
+		p.reported = p.completed * 10 / p.total
+		fmt.Fprintln(p.out, p.line(time.Now()))
+	}
+}
+
+// line is the progress at now, e.g.
+// "[resize] [=========>          ] 42/100 42%, 1 failed, ETA 3m10s".
+func (p *progress) line(now time.Time) string {
+	const width = 20
+	filled := width * p.completed / p.total
+	bar := strings.Repeat("=", filled)
+	if filled < width {
+		bar += ">" + strings.Repeat(" ", width-filled-1)
+	}
+	line := fmt.Sprintf("[%s] [%s] %d/%d %d%%", p.label, bar, p.completed, p.total, p.completed*100/p.total)
+	if p.failed > 0 {
+		line += fmt.Sprintf(", %d failed", p.failed)
+	}
+	if remaining := p.total - p.completed; remaining > 0 {
+		eta := now.Sub(p.started) / time.Duration(p.completed) * time.Duration(remaining)
+		line += ", ETA " + eta.Round(time.Second).String()
+	}
+	return line
+}
+
+// isTerminal reports whether out is a terminal a bar can be redrawn on.
+func isTerminal(out io.Writer) bool {
+	f, ok := out.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+)
+
+func TestOperationQueueRetriesThrottled(t *testing.T) {
+	var out bytes.Buffer
+	q := &operationQueue{label: "test", concurrency: 2, limiter: newRateLimiter(1000, 10), out: &out, errOut: &out}
+	var attempts int32
+	errs := q.Run(context.Background(), []operation{
+		{Name: "throttled", Run: func(context.Context) error {
+			if atomic.AddInt32(&attempts, 1) < 3 {
+				return &awsapi.Error{StatusCode: 400, Code: "ThrottlingException"}
+			}
+			return nil
+		}},
+		{Name: "failing i-2", Run: func(context.Context) error { return errors.New("boom") }},
+	})
+	if errs[0] != nil || attempts != 3 {
+		t.Errorf("throttled operation: %v after %d attempts", errs[0], attempts)
+	}
+	if errs[1] == nil || !strings.Contains(out.String(), "Got an error failing i-2:\nboom") {
+		t.Errorf("failing operation: %v, printed %q", errs[1], out.String())
+	}
+	if q.limiter.rate >= 1000 {
+		t.Errorf("rate %g, the queue did not slow down", q.limiter.rate)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(100, 2)
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		if err := l.wait(context.Background(), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Two calls are in the bucket, the other four wait for it to refill.
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Errorf("6 calls at 100/s with a burst of 2 took %s", elapsed)
+	}
+
+	c, cancel := context.WithCancel(context.Background())
+	cancel()
+	slow := newRateLimiter(0.1, 1)
+	slow.wait(context.Background(), 1)
+	if err := slow.wait(c, 1); err == nil {
+		t.Error("a cancelled wait succeeded")
+	}
+}
+
+func TestProgressLine(t *testing.T) {
+	start := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	p := &progress{label: "resize", total: 100, completed: 25, failed: 1, started: start}
+	got := p.line(start.Add(time.Minute))
+	want := "[resize] [=====>              ] 25/100 25%, 1 failed, ETA 3m0s"
+	if got != want {
+		t.Errorf("line = %q, want %q", got, want)
+	}
+}
+
+func TestProgressReportsEveryTenth(t *testing.T) {
+	var out bytes.Buffer
+	q := &operationQueue{label: "test", concurrency: 4, limiter: newRateLimiter(1000, 50), out: &out, errOut: &out}
+	ops := make([]operation, 40)
+	for i := range ops {
+		ops[i] = operation{Run: func(context.Context) error { return nil }}
+	}
+	q.Run(context.Background(), ops)
+	if n := strings.Count(out.String(), "[test] ["); n != 10 {
+		t.Errorf("%d progress lines:\n%s", n, out.String())
+	}
+}
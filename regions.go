@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// EC2RegionsAPI defines the interface for the DescribeRegions function.
+// We use this interface to test the functions using a mocked service.
+type EC2RegionsAPI interface {
+	DescribeRegions(ctx context.Context,
+		params *ec2.DescribeRegionsInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error)
+}
+
+// resolveRegions returns the regions of --regions, or every region enabled
+// for the account with --all-regions.
+func resolveRegions(c context.Context, api EC2RegionsAPI, regions string, all bool) ([]string, error) {
+	if !all {
+		var list []string
+		for _, r := range strings.Split(regions, ",") {
+			if r = strings.TrimSpace(r); r != "" {
+				list = append(list, r)
+			}
+		}
+		return list, nil
+	}
+
+	result, err := api.DescribeRegions(c, &ec2.DescribeRegionsInput{})
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	for _, r := range result.Regions {
+		list = append(list, aws.ToString(r.RegionName))
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// arnRegion returns the region field of an ARN.
+func arnRegion(arn string) string {
+	parts := strings.SplitN(arn, ":", 5)
+	if len(parts) < 5 {
+		return ""
+	}
+	return parts[3]
+}
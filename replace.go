@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"aws-vmcreate/internal/metrics"
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// ReplaceAPI defines the interface for the functions the daemon finds and replaces unhealthy instances with.
+// We use this interface to test the functions using a mocked service.
+type ReplaceAPI interface {
+	ec2.DescribeInstanceStatusAPIClient
+
+	DescribeAddresses(ctx context.Context,
+		params *ec2.DescribeAddressesInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeAddressesOutput, error)
+
+	AssociateAddress(ctx context.Context,
+		params *ec2.AssociateAddressInput,
+		optFns ...func(*ec2.Options)) (*ec2.AssociateAddressOutput, error)
+}
+
+// impairedSince returns when the earliest failing status check of the
+// instance started failing, or the zero time when none is failing.
+func impairedSince(s types.InstanceStatus) time.Time {
+	var since time.Time
+	for _, summary := range []*types.InstanceStatusSummary{s.SystemStatus, s.InstanceStatus} {
+		if summary == nil || summary.Status != types.SummaryStatusImpaired {
+			continue
+		}
+		for _, d := range summary.Details {
+			if d.Status != types.StatusTypeFailed || d.ImpairedSince == nil {
+				continue
+			}
+			if since.IsZero() || d.ImpairedSince.Before(since) {
+				since = *d.ImpairedSince
+			}
+		}
+	}
+	return since
+}
+
+// unhealthyInstances returns those of the running instances whose status
+// checks have been failing for at least after at now.
+func unhealthyInstances(c context.Context, api ec2.DescribeInstanceStatusAPIClient, instances []types.Instance, after time.Duration, now time.Time) ([]types.Instance, error) {
+	var ids []string
+	for _, i := range instances {
+		if i.State != nil && i.State.Name == types.InstanceStateNameRunning {
+			ids = append(ids, aws.ToString(i.InstanceId))
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	statuses, err := describeStatuses(c, api, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	var unhealthy []types.Instance
+	for _, i := range instances {
+		since := impairedSince(statuses[aws.ToString(i.InstanceId)])
+		if !since.IsZero() && now.Sub(since) >= after {
+			unhealthy = append(unhealthy, i)
+		}
+	}
+	return unhealthy, nil
+}
+
+// replaceInstance launches an instance like sick, once the checks of config
+// allow it, moves its Elastic IPs and the group's DNS record over to it once
+// it runs, and terminates sick. It returns the replacement.
+func replaceInstance(c context.Context, api ReplaceAPI, dns Route53API, config ConfigMap, g DesiredGroup, sick *types.Instance) (*types.Instance, error) {
+	sickID := aws.ToString(sick.InstanceId)
+	tags := map[string]string{}
+	for _, t := range sick.Tags {
+		// The aws: tags are reserved and set by AWS.
+		if !strings.HasPrefix(aws.ToString(t.Key), "aws:") {
+			tags[aws.ToString(t.Key)] = aws.ToString(t.Value)
+		}
+	}
+	launch := &launchPlan{
+		Command:      "daemon",
+		TagKey:       groupTag,
+		TagValue:     g.Name,
+		InstanceType: string(sick.InstanceType),
+		ImageID:      aws.ToString(sick.ImageId),
+		Count:        1,
+		Replacing:    1,
+		Tags:         tags,
+	}
+	if err := beforeLaunch(c, config, launch); err != nil {
+		return nil, fmt.Errorf("launching the replacement of %s: %w", sickID, err)
+	}
+	launched, err := provisioner.Create(c, &vmcreate.CreateInput{
+		Tags:         withProvenance(c, tags, hashConfig(g)),
+		InstanceType: string(sick.InstanceType),
+		ImageID:      aws.ToString(sick.ImageId),
+		SubnetID:     aws.ToString(sick.SubnetId),
+		Customize: func(input *ec2.RunInstancesInput) {
+			input.KeyName = sick.KeyName
+			for _, sg := range sick.SecurityGroups {
+				input.SecurityGroupIds = append(input.SecurityGroupIds, aws.ToString(sg.GroupId))
+			}
+			if sick.IamInstanceProfile != nil {
+				input.IamInstanceProfile = &types.IamInstanceProfileSpecification{Arn: sick.IamInstanceProfile.Arn}
+			}
+			if sick.Placement != nil && aws.ToString(sick.SubnetId) == "" {
+				input.Placement = &types.Placement{AvailabilityZone: sick.Placement.AvailabilityZone}
+			}
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("launching the replacement of %s: %w", sickID, err)
+	}
+	replacementID := aws.ToString(launched[0].InstanceId)
+	recordLifecycle(c, "daemon", launched, awsConfig.Region, phaseLaunching, "replacing "+sickID)
+	recordLifecycle(c, "daemon", []types.Instance{*sick}, "", phaseDraining, "status checks failing")
+	replacement, err := provisioner.WaitForRunning(c, replacementID, 0)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for the replacement of %s: %w", sickID, err)
+	}
+
+	addresses, err := api.DescribeAddresses(c, &ec2.DescribeAddressesInput{
+		Filters: []types.Filter{{Name: aws.String("instance-id"), Values: []string{sickID}}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing the Elastic IPs of %s: %w", sickID, err)
+	}
+	for _, a := range addresses.Addresses {
+		_, err := api.AssociateAddress(c, &ec2.AssociateAddressInput{
+			AllocationId:       a.AllocationId,
+			InstanceId:         aws.String(replacementID),
+			AllowReassociation: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("moving %s to %s: %w", aws.ToString(a.PublicIp), replacementID, err)
+		}
+		replacement.PublicIpAddress = a.PublicIp
+	}
+
+	if g.DNSZone != "" {
+		name := instanceDNSName(firstNonEmpty(g.DNSName, "{{name}}"), g.DNSZone, tagName(sick.Tags), replacementID)
+		if _, err := registerDNS(c, dns, replacement, g.DNSZone, name, g.DNSPublicIP); err != nil {
+			return nil, fmt.Errorf("registering %s: %w", name, err)
+		}
+		if old := instanceDNSName(firstNonEmpty(g.DNSName, "{{name}}"), g.DNSZone, tagName(sick.Tags), sickID); old != name {
+			if err := deregisterDNS(c, dns, g.DNSZone, old); err != nil {
+				return nil, fmt.Errorf("removing %s: %w", old, err)
+			}
+		}
+	}
+
+	recordLifecycle(c, "daemon", []types.Instance{*replacement}, "", phaseReady, "replaced "+sickID)
+	if _, err := provisioner.Delete(c, []string{sickID}); err != nil {
+		return nil, fmt.Errorf("terminating %s: %w", sickID, err)
+	}
+	recordLifecycle(c, "daemon", []types.Instance{*sick}, "", phaseTerminated, "replaced by "+replacementID)
+	postCreateHooks(c, config, groupTag, g.Name, []types.Instance{*replacement})
+	return replacement, nil
+}
+
+// replaceUnhealthy replaces the instances of each group whose status checks
+// have been failing for at least after, holding the group's fleet lock, and
+// notifies of each replacement. Dry runs only report the instances.
+func replaceUnhealthy(c context.Context, api ReplaceAPI, dns Route53API, state *DesiredState, after time.Duration, dryRun bool, notifications *Notifications) error {
+	live, err := groupInstances(c)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, g := range state.Groups {
+		unhealthy, err := unhealthyInstances(c, api, live[g.Name], after, time.Now())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("group %s: %w", g.Name, err))
+			continue
+		}
+		if len(unhealthy) == 0 {
+			continue
+		}
+		if dryRun {
+			for _, i := range unhealthy {
+				fmt.Printf("[%s] would replace %s, its status checks have failed for %s\n", g.Name, aws.ToString(i.InstanceId), after)
+			}
+			continue
+		}
+
+		key := groupTag + "=" + g.Name
+		if err := acquireFleetLock(c, key); err != nil {
+			errs = append(errs, fmt.Errorf("group %s: %w", g.Name, err))
+			continue
+		}
+		for n := range unhealthy {
+			sickID := aws.ToString(unhealthy[n].InstanceId)
+			fmt.Printf("[%s] replacing %s, its status checks have failed for %s\n", g.Name, sickID, after)
+			event := &Event{Command: "daemon", TagKey: groupTag, TagValue: g.Name, InstanceIDs: []string{sickID}}
+			replacement, err := replaceInstance(c, api, dns, state.Config, g, &unhealthy[n])
+			if err != nil {
+				metricsRegistry.Add("vmcreate_reconcile_errors_total", metrics.Labels{"group": g.Name}, 1)
+				errs = append(errs, fmt.Errorf("group %s: %w", g.Name, err))
+				event.Status, event.Error = "failure", err.Error()
+				notify(c, notifications, event)
+				continue
+			}
+			countAction(g.Name, "replace", 1)
+			fmt.Printf("[%s] replaced %s with %s\n", g.Name, sickID, aws.ToString(replacement.InstanceId))
+			event.Status = "replaced"
+			event.InstanceIDs = append(event.InstanceIDs, aws.ToString(replacement.InstanceId))
+			notify(c, notifications, event)
+		}
+		releaseFleetLock(c, key)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%d groups failed to replace unhealthy instances, first error: %w", len(errs), errs[0])
+	}
+	return nil
+}
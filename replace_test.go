@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeReplaceEC2 answers the status checks and Elastic IPs of the daemon's
+// instances, recording the addresses it moves.
+type fakeReplaceEC2 struct {
+	fakeInstanceStatus
+	addresses map[string]string
+	moved     []string
+}
+
+func (f *fakeReplaceEC2) DescribeAddresses(ctx context.Context, params *ec2.DescribeAddressesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeAddressesOutput, error) {
+	out := &ec2.DescribeAddressesOutput{}
+	for allocation, instance := range f.addresses {
+		if contains(params.Filters[0].Values, instance) {
+			out.Addresses = append(out.Addresses, types.Address{AllocationId: aws.String(allocation), InstanceId: aws.String(instance)})
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeReplaceEC2) AssociateAddress(ctx context.Context, params *ec2.AssociateAddressInput, optFns ...func(*ec2.Options)) (*ec2.AssociateAddressOutput, error) {
+	f.addresses[aws.ToString(params.AllocationId)] = aws.ToString(params.InstanceId)
+	f.moved = append(f.moved, aws.ToString(params.AllocationId)+"->"+aws.ToString(params.InstanceId))
+	return &ec2.AssociateAddressOutput{}, nil
+}
+
+func TestImpairedSince(t *testing.T) {
+	failed := func(since time.Time) *types.InstanceStatusSummary {
+		return &types.InstanceStatusSummary{Status: types.SummaryStatusImpaired, Details: []types.InstanceStatusDetails{
+			{Name: types.StatusNameReachability, Status: types.StatusTypeFailed, ImpairedSince: aws.Time(since)},
+		}}
+	}
+	now := time.Now()
+	if got := impairedSince(types.InstanceStatus{SystemStatus: failed(now.Add(-time.Hour)), InstanceStatus: failed(now.Add(-2 * time.Hour))}); !got.Equal(now.Add(-2 * time.Hour)) {
+		t.Errorf("impaired since %s, want the earliest failure", got)
+	}
+	ok := &types.InstanceStatusSummary{Status: types.SummaryStatusOk}
+	if got := impairedSince(types.InstanceStatus{SystemStatus: ok, InstanceStatus: ok}); !got.IsZero() {
+		t.Errorf("impaired since %s for a healthy instance", got)
+	}
+}
+
+func TestReplaceUnhealthy(t *testing.T) {
+	fake := useFakeEC2(t)
+	api := &fakeReplaceEC2{fakeInstanceStatus: fakeInstanceStatus{FakeEC2: fake}, addresses: map[string]string{}}
+	add := func(name string) string {
+		return fake.AddInstance(types.Instance{
+			ImageId:      aws.String("ami-web"),
+			InstanceType: types.InstanceTypeT3Micro,
+			Tags: []types.Tag{
+				{Key: aws.String(groupTag), Value: aws.String("web")},
+				{Key: aws.String("Name"), Value: aws.String(name)},
+				{Key: aws.String("aws:autoscaling:groupName"), Value: aws.String("reserved")},
+			},
+		})
+	}
+	healthy, sick, recovering := add("web-1"), add("web-2"), add("web-3")
+	api.addresses["eipalloc-1"] = sick
+
+	impaired := func(id string, since time.Duration) types.InstanceStatus {
+		return types.InstanceStatus{
+			InstanceId:   aws.String(id),
+			SystemStatus: &types.InstanceStatusSummary{Status: types.SummaryStatusOk},
+			InstanceStatus: &types.InstanceStatusSummary{Status: types.SummaryStatusImpaired, Details: []types.InstanceStatusDetails{
+				{Name: types.StatusNameReachability, Status: types.StatusTypeFailed, ImpairedSince: aws.Time(time.Now().Add(-since))},
+			}},
+		}
+	}
+	api.statuses = []types.InstanceStatus{impaired(sick, 20*time.Minute), impaired(recovering, 2*time.Minute)}
+	state := &DesiredState{Groups: []DesiredGroup{{Name: "web", Count: 3, InstanceType: "t3.micro", ImageId: "ami-web"}}}
+
+	if err := replaceUnhealthy(context.Background(), api, nil, state, 10*time.Minute, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(liveInstances(fake)); n != 3 {
+		t.Fatalf("dry run left %d live instances", n)
+	}
+
+	if err := replaceUnhealthy(context.Background(), api, nil, state, 10*time.Minute, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	var live []string
+	var replacement *types.Instance
+	for n, i := range liveInstances(fake) {
+		live = append(live, aws.ToString(i.InstanceId))
+		if id := aws.ToString(i.InstanceId); id != healthy && id != recovering {
+			replacement = &liveInstances(fake)[n]
+		}
+	}
+	if len(live) != 3 || contains(live, sick) || replacement == nil {
+		t.Fatalf("live instances %s, want %s replaced", strings.Join(live, ","), sick)
+	}
+	if got := vmcreate.TagValue(replacement, "Name"); got != "web-2" {
+		t.Errorf("the replacement is named %q, want the sick instance's name", got)
+	}
+	if got := vmcreate.TagValue(replacement, "aws:autoscaling:groupName"); got != "" {
+		t.Errorf("the replacement copied the reserved aws: tags")
+	}
+	if want := "eipalloc-1->" + aws.ToString(replacement.InstanceId); strings.Join(api.moved, ",") != want {
+		t.Errorf("moved %v, want %s", api.moved, want)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"aws-vmcreate/internal/awsapi"
+)
+
+var taggingClient *awsapi.Tagging
+
+// ResourceTaggingAPI defines the interface for the GetResources function.
+// We use this interface to test the functions using a mocked service.
+type ResourceTaggingAPI interface {
+	GetResources(ctx context.Context, params *awsapi.GetResourcesInput) (*awsapi.GetResourcesOutput, error)
+}
+
+// managedResource is a resource carrying the managed-by tag.
+type managedResource struct {
+	Type string
+	ID   string
+	Tags map[string]string
+}
+
+// managedResources returns the resources of the region tagged
+// managed-by=aws-vmcreate, and with the tags of the filters as well, sorted
+// by type and id.
+func managedResources(c context.Context, api ResourceTaggingAPI, filters []awsapi.TagFilter) ([]managedResource, error) {
+	input := &awsapi.GetResourcesInput{
+		TagFilters: append([]awsapi.TagFilter{{Key: managedByTag, Values: []string{managedByValue}}}, filters...),
+	}
+	var resources []managedResource
+	for {
+		out, err := api.GetResources(c, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range out.ResourceTagMappingList {
+			r := managedResource{Tags: map[string]string{}}
+			r.Type, r.ID = parseResourceARN(m.ResourceARN)
+			for _, t := range m.Tags {
+				r.Tags[t.Key] = t.Value
+			}
+			resources = append(resources, r)
+		}
+		if out.PaginationToken == "" {
+			break
+		}
+		input.PaginationToken = out.PaginationToken
+	}
+	sort.Slice(resources, func(a, b int) bool {
+		if resources[a].Type != resources[b].Type {
+			return resources[a].Type < resources[b].Type
+		}
+		return resources[a].ID < resources[b].ID
+	})
+	return resources, nil
+}
+
+// parseResourceARN returns the type of the resource of the ARN, as
+// SERVICE:TYPE, and its id. arn:aws:ec2:us-east-1:123:volume/vol-1 is
+// ec2:volume and vol-1, and an ARN it cannot split is returned whole as
+// the id.
+func parseResourceARN(arn string) (string, string) {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 {
+		return "", arn
+	}
+	service, resource := parts[2], parts[5]
+	if n := strings.IndexAny(resource, "/:"); n >= 0 {
+		return service + ":" + resource[:n], resource[n+1:]
+	}
+	return service, resource
+}
+
+func ListResourcesCmd(name *string, value *string) {
+	var filters []awsapi.TagFilter
+	if *name != "" {
+		filter := awsapi.TagFilter{Key: *name}
+		if *value != "" {
+			filter.Values = strings.Split(*value, ",")
+		}
+		filters = append(filters, filter)
+	}
+	resources, err := managedResources(context.TODO(), taggingClient, filters)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error listing the resources:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+
+	if quiet {
+		for _, r := range resources {
+			fmt.Println(r.ID)
+		}
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tID\tGROUP\tRUN\tCREATED BY\tCREATED")
+	for _, r := range resources {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Type, r.ID, r.Tags[groupTag], r.Tags[runIDTag], r.Tags[createdByTag], r.Tags[createdAtTag])
+	}
+	w.Flush()
+	fmt.Fprintf(diagnostics, "%d resources managed by aws-vmcreate in %s\n", len(resources), awsConfig.Region)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"aws-vmcreate/internal/awsapi"
+)
+
+// fakeTagging answers GetResources a page at a time and records the filters.
+type fakeTagging struct {
+	pages   []awsapi.GetResourcesOutput
+	filters []awsapi.TagFilter
+}
+
+func (f *fakeTagging) GetResources(ctx context.Context, params *awsapi.GetResourcesInput) (*awsapi.GetResourcesOutput, error) {
+	f.filters = params.TagFilters
+	page := 0
+	if params.PaginationToken != "" {
+		page = 1
+	}
+	return &f.pages[page], nil
+}
+
+func TestManagedResources(t *testing.T) {
+	api := &fakeTagging{pages: []awsapi.GetResourcesOutput{
+		{PaginationToken: "next", ResourceTagMappingList: []awsapi.ResourceTagMapping{
+			{ResourceARN: "arn:aws:ec2:us-east-1:123456789012:volume/vol-1", Tags: []awsapi.ResourceTag{{Key: groupTag, Value: "web"}}},
+			{ResourceARN: "arn:aws:ec2:us-east-1:123456789012:security-group/sg-1"},
+		}},
+		{ResourceTagMappingList: []awsapi.ResourceTagMapping{
+			{ResourceARN: "arn:aws:ec2:us-east-1::snapshot/snap-1", Tags: []awsapi.ResourceTag{{Key: runIDTag, Value: "run-1"}}},
+		}},
+	}}
+
+	resources, err := managedResources(context.Background(), api, []awsapi.TagFilter{{Key: groupTag, Values: []string{"web"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(api.filters) != 2 || api.filters[0].Key != managedByTag || api.filters[1].Key != groupTag {
+		t.Errorf("filters = %+v", api.filters)
+	}
+	if len(resources) != 3 {
+		t.Fatalf("resources = %+v", resources)
+	}
+	for n, want := range []managedResource{{Type: "ec2:security-group", ID: "sg-1"}, {Type: "ec2:snapshot", ID: "snap-1"}, {Type: "ec2:volume", ID: "vol-1"}} {
+		if resources[n].Type != want.Type || resources[n].ID != want.ID {
+			t.Errorf("resource %d = %s %s, want %s %s", n, resources[n].Type, resources[n].ID, want.Type, want.ID)
+		}
+	}
+	if resources[1].Tags[runIDTag] != "run-1" || resources[2].Tags[groupTag] != "web" {
+		t.Errorf("tags = %v and %v", resources[1].Tags, resources[2].Tags)
+	}
+
+	if kind, id := parseResourceARN("arn:aws:iam::123456789012:role/aws-vmcreate-web"); kind != "iam:role" || id != "aws-vmcreate-web" {
+		t.Errorf("role = %s %s", kind, id)
+	}
+}
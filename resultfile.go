@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// resultFile is the file --result-file writes the summary of the command
+// to, for the next steps of a pipeline to read instead of the output.
+var resultFile string
+
+// CommandResult is the summary --result-file writes.
+type CommandResult struct {
+	Command string `json:"command"`
+	// Status is success or failure.
+	Status string `json:"status"`
+	// InstanceIDs are the instances the command created or deleted.
+	InstanceIDs []string         `json:"instance_ids"`
+	Instances   []ResultInstance `json:"instances"`
+	// DNSNames are the records create registered for the instances.
+	DNSNames []string `json:"dns_names"`
+	KeyName  string   `json:"key_name,omitempty"`
+	KeyPath  string   `json:"key_path,omitempty"`
+	Errors   []string `json:"errors"`
+}
+
+// ResultInstance is an instance create made, with its addresses.
+type ResultInstance struct {
+	InstanceID    string `json:"instance_id"`
+	Region        string `json:"region"`
+	PrivateIP     string `json:"private_ip,omitempty"`
+	PublicIP      string `json:"public_ip,omitempty"`
+	PublicDNSName string `json:"public_dns_name,omitempty"`
+}
+
+// result is the summary of the command being run.
+var result struct {
+	sync.Mutex
+	CommandResult
+}
+
+// startResult begins the summary of a command run.
+func startResult(command, keyName, keyPath string) {
+	result.Lock()
+	defer result.Unlock()
+	result.CommandResult = CommandResult{Command: command, KeyName: keyName, KeyPath: keyPath}
+}
+
+// resultInstanceIDs adds the instances the command created or deleted.
+func resultInstanceIDs(ids []string) {
+	result.Lock()
+	defer result.Unlock()
+	result.InstanceIDs = append(result.InstanceIDs, ids...)
+}
+
+// resultInstances adds the addresses of the created instances, and the
+// records registered for them.
+func resultInstances(instances []types.Instance, region string, dnsNames []string) {
+	result.Lock()
+	defer result.Unlock()
+	for _, i := range instances {
+		result.Instances = append(result.Instances, ResultInstance{
+			InstanceID:    aws.ToString(i.InstanceId),
+			Region:        region,
+			PrivateIP:     aws.ToString(i.PrivateIpAddress),
+			PublicIP:      aws.ToString(i.PublicIpAddress),
+			PublicDNSName: aws.ToString(i.PublicDnsName),
+		})
+	}
+	result.DNSNames = append(result.DNSNames, dnsNames...)
+}
+
+// resultError adds an error the command went on after, such as one of the
+// changes of an operation queue.
+func resultError(message string) {
+	result.Lock()
+	defer result.Unlock()
+	result.Errors = append(result.Errors, message)
+}
+
+// writeResultFile writes the summary of the command for --result-file,
+// with err as its failure. The lists are empty rather than null, so that a
+// pipeline reads them without checking.
+func writeResultFile(err error) {
+	if resultFile == "" {
+		return
+	}
+	result.Lock()
+	r := result.CommandResult
+	result.Unlock()
+
+	r.Status = "success"
+	if err != nil {
+		r.Status = "failure"
+		r.Errors = append(r.Errors, err.Error())
+	}
+	for _, list := range []*[]string{&r.InstanceIDs, &r.DNSNames, &r.Errors} {
+		if *list == nil {
+			*list = []string{}
+		}
+	}
+	if r.Instances == nil {
+		r.Instances = []ResultInstance{}
+	}
+	data, _ := json.MarshalIndent(r, "", "  ")
+	if err := os.WriteFile(resultFile, append(data, '\n'), 0o644); err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error writing "+resultFile+":")
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
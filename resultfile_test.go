@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readResult reads the summary --result-file wrote.
+func readResult(t *testing.T, file string) CommandResult {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r CommandResult
+	if err := json.Unmarshal(data, &r); err != nil {
+		t.Fatalf("%v in:\n%s", err, data)
+	}
+	return r
+}
+
+func TestResultFileCreate(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1"})
+	file := filepath.Join(t.TempDir(), "result.json")
+
+	runCLI(t, "create", "--tag", "Name=pr-42", "--count", "2", "--key-name", "deploy", "--result-file", file)
+
+	r := readResult(t, file)
+	instances := fake.Instances()
+	if r.Command != "create" || r.Status != "success" || len(r.Errors) != 0 || r.KeyName != "deploy" {
+		t.Errorf("result = %+v", r)
+	}
+	if len(r.InstanceIDs) != 2 || len(r.Instances) != 2 {
+		t.Fatalf("result instances = %+v", r)
+	}
+	if got := r.Instances[0]; got.InstanceID != *instances[0].InstanceId || got.PrivateIP != *instances[0].PrivateIpAddress {
+		t.Errorf("instance = %+v", got)
+	}
+}
+
+func TestResultFileFailure(t *testing.T) {
+	useFakeEC2(t)
+	useConfig(t, ConfigMap{})
+	file := filepath.Join(t.TempDir(), "result.json")
+
+	runCLI(t, "diff", "i-missing", "--result-file", file)
+
+	r := readResult(t, file)
+	if r.Status != "failure" || len(r.Errors) != 1 {
+		t.Errorf("result = %+v", r)
+	}
+	if r.Instances == nil || r.InstanceIDs == nil || r.DNSNames == nil {
+		t.Errorf("empty lists are null: %+v", r)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// The utilization rightsize sizes instances for: peaks above the upper
+// bounds need a larger type, peaks below the lower bounds fit a smaller one,
+// and the type recommended runs the peak at about the target.
+const (
+	rightsizeCPUTarget    = 70.0
+	rightsizeCPUUpper     = 90.0
+	rightsizeCPULower     = 40.0
+	rightsizeMemoryTarget = 80.0
+	rightsizeMemoryUpper  = 90.0
+	rightsizeMemoryLower  = 50.0
+)
+
+// hoursPerMonth is the average month AWS bills on-demand hours over.
+const hoursPerMonth = 730
+
+// rightsizeUsage is the peak hourly average utilization of an instance over
+// the window, in percent. Memory is -1 when it is not measured, which needs
+// the CloudWatch agent.
+type rightsizeUsage struct {
+	CPU    float64
+	Memory float64
+}
+
+// fetchRightsizeUsage returns the peak CPU and memory utilization of the
+// instances over the window before now, keyed by instance id. Instances
+// without CPU datapoints are missing.
+func fetchRightsizeUsage(c context.Context, api CloudWatchAPI, instances []types.Instance, window time.Duration, now time.Time) (map[string]rightsizeUsage, error) {
+	usage := map[string]rightsizeUsage{}
+	type queried struct {
+		instanceID string
+		memory     bool
+	}
+	ids := map[string]queried{}
+	var queries []awsapi.MetricDataQuery
+	for _, i := range instances {
+		id := aws.ToString(i.InstanceId)
+		cpu := fmt.Sprintf("m%d", len(queries))
+		memory := fmt.Sprintf("m%d", len(queries)+1)
+		ids[cpu], ids[memory] = queried{id, false}, queried{id, true}
+		dimensions := []awsapi.Dimension{{Name: "InstanceId", Value: id}}
+		queries = append(queries,
+			awsapi.MetricDataQuery{Id: cpu, Namespace: "AWS/EC2", MetricName: "CPUUtilization", Dimensions: dimensions, Period: idlePeriod(window), Stat: "Average"},
+			awsapi.MetricDataQuery{Id: memory, Namespace: "CWAgent", MetricName: "mem_used_percent", Dimensions: dimensions, Period: idlePeriod(window), Stat: "Average"})
+	}
+
+	cpu := map[string]float64{}
+	memory := map[string]float64{}
+	// GetMetricData takes at most 500 queries.
+	for len(queries) > 0 {
+		batch := queries
+		if len(batch) > 500 {
+			batch = batch[:500]
+		}
+		queries = queries[len(batch):]
+
+		input := &awsapi.GetMetricDataInput{Queries: batch, StartTime: now.Add(-window), EndTime: now}
+		for {
+			result, err := api.GetMetricData(c, input)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range result.MetricDataResults {
+				q, ok := ids[r.Id]
+				if !ok || len(r.Values) == 0 {
+					continue
+				}
+				peaks := cpu
+				if q.memory {
+					peaks = memory
+				}
+				for _, v := range r.Values {
+					if p, seen := peaks[q.instanceID]; !seen || v > p {
+						peaks[q.instanceID] = v
+					}
+				}
+			}
+			if result.NextToken == "" {
+				break
+			}
+			input.NextToken = result.NextToken
+		}
+	}
+
+	for id, peak := range cpu {
+		u := rightsizeUsage{CPU: peak, Memory: -1}
+		if m, ok := memory[id]; ok {
+			u.Memory = m
+		}
+		usage[id] = u
+	}
+	return usage, nil
+}
+
+// recommendType returns the type of the same family that runs the peak
+// utilization at about the targets, and why, or nil when the instance is
+// already the right size. Without memory datapoints only the CPU is sized
+// for, which the reason says.
+func recommendType(t *instanceType, family []instanceType, u rightsizeUsage) (*instanceType, string) {
+	neededVCPUs := math.Ceil(float64(t.VCPUs) * u.CPU / rightsizeCPUTarget)
+	neededMiB := 0.0
+	if u.Memory >= 0 {
+		neededMiB = float64(t.MemoryMiB) * u.Memory / rightsizeMemoryTarget
+	}
+	fits := func(c instanceType) bool {
+		return float64(c.VCPUs) >= neededVCPUs && float64(c.MemoryMiB) >= neededMiB && !strings.HasSuffix(c.Name, ".metal")
+	}
+	sorted := append([]instanceType(nil), family...)
+	sort.Slice(sorted, func(a, b int) bool {
+		if sorted[a].VCPUs != sorted[b].VCPUs {
+			return sorted[a].VCPUs < sorted[b].VCPUs
+		}
+		return sorted[a].MemoryMiB < sorted[b].MemoryMiB
+	})
+
+	memoryNote := ""
+	if u.Memory < 0 {
+		memoryNote = ", memory not measured"
+	}
+	switch {
+	case u.CPU > rightsizeCPUUpper || u.Memory > rightsizeMemoryUpper:
+		for n, c := range sorted {
+			if c.VCPUs >= t.VCPUs && c.MemoryMiB >= t.MemoryMiB && c.Name != t.Name && (c.VCPUs > t.VCPUs || c.MemoryMiB > t.MemoryMiB) && fits(c) {
+				return &sorted[n], fmt.Sprintf("peaks at %.0f%% CPU%s", u.CPU, memoryReason(u))
+			}
+		}
+		return nil, fmt.Sprintf("peaks at %.0f%% CPU%s, and is the largest of its family", u.CPU, memoryReason(u))
+	case u.CPU < rightsizeCPULower && (u.Memory < 0 || u.Memory < rightsizeMemoryLower):
+		for n, c := range sorted {
+			if c.VCPUs <= t.VCPUs && c.MemoryMiB <= t.MemoryMiB && c.Name != t.Name && fits(c) {
+				return &sorted[n], fmt.Sprintf("peaks at %.0f%% CPU%s%s", u.CPU, memoryReason(u), memoryNote)
+			}
+		}
+	}
+	return nil, fmt.Sprintf("right-sized, peaks at %.0f%% CPU%s%s", u.CPU, memoryReason(u), memoryNote)
+}
+
+func memoryReason(u rightsizeUsage) string {
+	if u.Memory < 0 {
+		return ""
+	}
+	return fmt.Sprintf(" and %.0f%% memory", u.Memory)
+}
+
+// rightsizeRecommendation is a resize rightsize suggests.
+type rightsizeRecommendation struct {
+	InstanceID  string
+	Name        string
+	Current     string
+	Recommended string
+	Reason      string
+	// MonthlySavings is negative for larger types, and only set when
+	// PriceKnown.
+	MonthlySavings float64
+	PriceKnown     bool
+}
+
+func RightsizeCmd(name *string, value *string, window *time.Duration, apply *bool, dryRun *bool, yes *bool) {
+	// Without a tag, the instances created by aws-vmcreate are sized.
+	filters := []types.Filter{vmcreate.StateFilter("running"), vmcreate.TagKeyFilter(createdByTag)}
+	if *name != "" && *value != "" {
+		filters[1] = vmcreate.TagFilter(*name, strings.Split(*value, ",")...)
+	} else if *name != "" {
+		filters[1] = vmcreate.TagKeyFilter(*name)
+	}
+	instances, err := provisioner.List(context.TODO(), filters...)
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error listing the instances:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	if len(instances) == 0 {
+		fmt.Println("No running instances to rightsize")
+		return
+	}
+	all, err := loadInstanceTypes(context.TODO(), instanceTypesClient, awsConfig.Region, instanceTypeCacheTTL)
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error listing the instance types:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	usage, err := fetchRightsizeUsage(context.TODO(), cloudWatchClient, instances, *window, time.Now())
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error fetching the metrics:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	var recommendations []rightsizeRecommendation
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tNAME\tTYPE\tRECOMMENDED\tSAVINGS/MONTH\tREASON")
+	for _, i := range instances {
+		id, current := aws.ToString(i.InstanceId), string(i.InstanceType)
+		r := rightsizeRecommendation{InstanceID: id, Name: tagName(i.Tags), Current: current, Recommended: "-"}
+		u, measured := usage[id]
+		var t *instanceType
+		for n := range all {
+			if all[n].Name == current {
+				t = &all[n]
+			}
+		}
+		switch {
+		case !measured:
+			r.Reason = "no datapoints"
+		case t == nil:
+			r.Reason = current + " is not offered in " + awsConfig.Region
+		default:
+			var family []instanceType
+			for _, c := range all {
+				if c.Family() == t.Family() {
+					family = append(family, c)
+				}
+			}
+			recommended, reason := recommendType(t, family, u)
+			r.Reason = reason
+			if recommended != nil {
+				r.Recommended = recommended.Name
+				from, fromKnown := hourlyPrice(current)
+				to, toKnown := hourlyPrice(recommended.Name)
+				r.MonthlySavings, r.PriceKnown = (from-to)*hoursPerMonth, fromKnown && toKnown
+				recommendations = append(recommendations, r)
+			}
+		}
+		savings := "-"
+		if r.PriceKnown {
+			savings = fmt.Sprintf("$%.2f", r.MonthlySavings)
+		} else if r.Recommended != "-" {
+			savings = "unknown"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.InstanceID, r.Name, r.Current, r.Recommended, savings, r.Reason)
+	}
+	w.Flush()
+
+	if len(recommendations) == 0 {
+		fmt.Printf("All instances are right-sized for their peaks over the last %s\n", *window)
+		return
+	}
+	total := 0.0
+	for _, r := range recommendations {
+		total += r.MonthlySavings
+	}
+	fmt.Printf("%d resizes recommended, saving about $%.2f/month (estimated us-east-1 Linux prices)\n", len(recommendations), total)
+	switch {
+	case !*apply:
+		fmt.Println("Run again with --apply to resize them, which stops and starts each instance")
+		return
+	case *dryRun:
+		for _, r := range recommendations {
+			fmt.Println("Would resize " + r.InstanceID + " from " + r.Current + " to " + r.Recommended)
+		}
+		return
+	}
+	if !*yes {
+		if !stdinIsTerminal() {
+			failCommand("Pass --yes to resize without a terminal to confirm on")
+			return
+		}
+		if !confirm(fmt.Sprintf("Stop and resize these %d instances?", len(recommendations))) {
+			return
+		}
+	}
+	var ops []operation
+	for _, r := range recommendations {
+		r := r
+		ops = append(ops, operation{
+			Name:  "resizing " + r.InstanceID + " to " + r.Recommended,
+			Done:  "Resized instance with ID " + r.InstanceID + " to " + r.Recommended,
+			Calls: 3,
+			Run: func(c context.Context) error {
+				return provisioner.Resize(c, r.InstanceID, r.Recommended)
+			},
+		})
+	}
+	for _, err := range newOperationQueue("resize").Run(context.TODO(), ops) {
+		if err != nil {
+			commandErr = err
+		}
+	}
+}
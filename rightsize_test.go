@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestRecommendType(t *testing.T) {
+	family := []instanceType{
+		{Name: "m6i.large", VCPUs: 2, MemoryMiB: 8192},
+		{Name: "m6i.xlarge", VCPUs: 4, MemoryMiB: 16384},
+		{Name: "m6i.2xlarge", VCPUs: 8, MemoryMiB: 32768},
+		{Name: "m6i.4xlarge", VCPUs: 16, MemoryMiB: 65536},
+		{Name: "m6i.metal", VCPUs: 128, MemoryMiB: 524288},
+	}
+	xlarge, largest := &family[1], &family[3]
+	for _, test := range []struct {
+		t    *instanceType
+		u    rightsizeUsage
+		want string
+	}{
+		// 4 vCPUs at 30% fit 2 vCPUs at 60%.
+		{xlarge, rightsizeUsage{CPU: 30, Memory: -1}, "m6i.large"},
+		// Memory at 45% of 16 GiB needs 9 GiB, more than the large has.
+		{xlarge, rightsizeUsage{CPU: 30, Memory: 45}, ""},
+		{xlarge, rightsizeUsage{CPU: 60, Memory: -1}, ""},
+		{xlarge, rightsizeUsage{CPU: 95, Memory: -1}, "m6i.2xlarge"},
+		{xlarge, rightsizeUsage{CPU: 50, Memory: 95}, "m6i.2xlarge"},
+		// The metal size is never recommended.
+		{largest, rightsizeUsage{CPU: 99, Memory: -1}, ""},
+	} {
+		got, reason := recommendType(test.t, family, test.u)
+		name := ""
+		if got != nil {
+			name = got.Name
+		}
+		if name != test.want {
+			t.Errorf("%s at %+v: got %q (%s), want %q", test.t.Name, test.u, name, reason, test.want)
+		}
+	}
+}
+
+func TestFetchRightsizeUsage(t *testing.T) {
+	now := time.Now()
+	instances := []types.Instance{{InstanceId: aws.String("i-agent")}, {InstanceId: aws.String("i-plain")}, {InstanceId: aws.String("i-new")}}
+	api := &fakeIdleMetrics{now: now, values: map[string][]float64{
+		"i-agent/CPUUtilization": {20, 35}, "i-agent/mem_used_percent": {61},
+		"i-plain/CPUUtilization": {80},
+	}}
+	usage, err := fetchRightsizeUsage(context.Background(), api, instances, 14*24*time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := usage["i-agent"]; u.CPU != 35 || u.Memory != 61 {
+		t.Errorf("i-agent = %+v, want the peaks 35%% CPU and 61%% memory", u)
+	}
+	if u := usage["i-plain"]; u.CPU != 80 || u.Memory != -1 {
+		t.Errorf("i-plain = %+v, want 80%% CPU and memory not measured", u)
+	}
+	if _, ok := usage["i-new"]; ok {
+		t.Error("an instance without datapoints has no usage")
+	}
+}
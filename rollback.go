@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// createdResources are what a create has made, in the order it made them.
+type createdResources struct {
+	InstanceIDs []string
+	// DNSNames are the A records registered for the instances.
+	DNSNames []string
+	// Targets are the instances registered with the target group.
+	Targets []string
+}
+
+// rollback undoes the create in reverse: the instances are taken out of the
+// target group and DNS before they are terminated, so that nothing routes
+// to them. A step that fails is reported and the others still run, leaving
+// as little behind as possible.
+func (r *createdResources) rollback(c context.Context, opts *CreateOptions) {
+	for _, instanceID := range r.Targets {
+		progressln("Rolling back: deregistering " + instanceID + " from the target group")
+		if err := deregisterTarget(c, elbv2Client, opts.TargetGroupArn, instanceID, opts.HealthTimeout); err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error deregistering the instance:")
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	for _, name := range r.DNSNames {
+		progressln("Rolling back: deleting the DNS record " + name)
+		if err := deregisterDNS(c, route53Client, opts.DNSZone, name); err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error deleting the DNS record:")
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if len(r.InstanceIDs) > 0 {
+		progressln("Rolling back: terminating instances with ids " + strings.Join(r.InstanceIDs, ", "))
+		if _, err := provisioner.Delete(c, r.InstanceIDs); err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error terminating the instances:")
+			fmt.Fprintln(os.Stderr, err)
+		} else {
+			recordLifecycle(c, "create", instancesOf(r.InstanceIDs), "", phaseTerminated, "rolled back")
+		}
+	}
+}
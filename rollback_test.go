@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestCreateCount(t *testing.T) {
+	fake := useFakeEC2(t)
+
+	out := runCLI(t, "create", "--tag", "Name=web", "--count", "3")
+	if n := len(fake.Instances()); n != 3 {
+		t.Fatalf("launched %d instances, want 3\n%s", n, out)
+	}
+	if strings.Count(out, "Created tagged instance with ID") != 3 {
+		t.Errorf("output does not report every instance:\n%s", out)
+	}
+
+	out = runCLI(t, "create", "--tag", "Name=web", "--on-failure", "undo")
+	if !strings.Contains(out, "--on-failure must be rollback or keep") || len(fake.Instances()) != 3 {
+		t.Errorf("output:\n%s", out)
+	}
+}
+
+func TestRollbackTerminatesInstances(t *testing.T) {
+	fake := useFakeEC2(t)
+	a := fake.AddInstance(types.Instance{})
+	b := fake.AddInstance(types.Instance{})
+	other := fake.AddInstance(types.Instance{})
+
+	created := &createdResources{InstanceIDs: []string{a, b}}
+	created.rollback(context.Background(), &CreateOptions{})
+
+	for _, id := range []string{a, b} {
+		if state := fake.Instance(id).State.Name; state != types.InstanceStateNameTerminated {
+			t.Errorf("%s is %s after the rollback", id, state)
+		}
+	}
+	if state := fake.Instance(other).State.Name; state != types.InstanceStateNameRunning {
+		t.Errorf("the rollback terminated %s, which it did not create", other)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// keyNameTag names the key pair an instance accepts since rotate-key, which
+// its KeyName, fixed at launch, no longer does.
+const keyNameTag = "aws-vmcreate:key-name"
+
+// KeyRotationAPI defines the interface for the functions rotate-key replaces key pairs with.
+// We use this interface to test the functions using a mocked service.
+type KeyRotationAPI interface {
+	ImportKeyPair(ctx context.Context,
+		params *ec2.ImportKeyPairInput,
+		optFns ...func(*ec2.Options)) (*ec2.ImportKeyPairOutput, error)
+
+	DescribeKeyPairs(ctx context.Context,
+		params *ec2.DescribeKeyPairsInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeKeyPairsOutput, error)
+
+	DeleteKeyPair(ctx context.Context,
+		params *ec2.DeleteKeyPairInput,
+		optFns ...func(*ec2.Options)) (*ec2.DeleteKeyPairOutput, error)
+}
+
+// rotatedSuffix is the timestamp rotate-key appends to the key pairs it
+// makes, dropped again when one is rotated in turn.
+var rotatedSuffix = regexp.MustCompile(`-\d{8}-\d{6}$`)
+
+// keyDir keeps the private keys of the key pairs rotate-key makes, by
+// default in ~/.aws/aws-vmcreate/keys.
+func keyDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join("aws-vmcreate", "keys")
+	}
+	return filepath.Join(home, ".aws", "aws-vmcreate", "keys")
+}
+
+// currentKeyName returns the key pair the instance accepts.
+func currentKeyName(i *types.Instance) string {
+	return firstNonEmpty(vmcreate.TagValue(i, keyNameTag), aws.ToString(i.KeyName))
+}
+
+// rotatedKeyName returns the name of the key pair replacing those in old:
+// that of the one they share, or fallback, with the time appended.
+func rotatedKeyName(old []string, fallback string, now time.Time) string {
+	base := fallback
+	if len(old) == 1 {
+		base = rotatedSuffix.ReplaceAllString(old[0], "")
+	}
+	return base + "-" + now.UTC().Format("20060102-150405")
+}
+
+// authorizedKeysScript returns the shell commands that run script with
+// $keys set to the authorized_keys file of osUser, creating it if need be.
+func authorizedKeysScript(osUser string, script string) []string {
+	return []string{
+		"set -e",
+		"home=$(getent passwd " + shellQuote(osUser) + " | cut -d: -f6)",
+		`test -n "$home"`,
+		`keys="$home/.ssh/authorized_keys"`,
+		`install -d -m 700 -o ` + shellQuote(osUser) + ` "$home/.ssh"`,
+		`touch "$keys" && chown ` + shellQuote(osUser) + ` "$keys" && chmod 600 "$keys"`,
+		script,
+	}
+}
+
+// keyBlob returns the base64 key of an authorized_keys line, which
+// identifies the key whatever its comment.
+func keyBlob(publicKey string) string {
+	fields := strings.Fields(publicKey)
+	if len(fields) < 2 {
+		return publicKey
+	}
+	return fields[1]
+}
+
+// keyRotation is the outcome of replacing the key pair of instances.
+type keyRotation struct {
+	KeyName string
+	KeyPath string
+	// Failed are the instances the new key could not be added to or
+	// verified on, by ID, with the error. While any failed, no old key
+	// was retired.
+	Failed map[string]error
+	// Retired are the old key pairs deleted, and Kept those still used by
+	// other instances, with the instance.
+	Retired []string
+	Kept    map[string]string
+}
+
+// rotateKey imports a new key pair named keyName, with its private key
+// written to keyPath, and adds its public key to the authorized_keys of
+// osUser on the instances through SSM. Once it is verified on every one of
+// them, the old public keys are removed, the instances are tagged with the
+// new key pair and the old key pairs none of the others accepts are
+// deleted.
+func rotateKey(c context.Context, api KeyRotationAPI, commands SSMCommandAPI, instances []types.Instance, others []types.Instance, osUser string, keyName string, keyPath string) (*keyRotation, error) {
+	privatePEM, publicKey, err := generateSSHKey(keyName)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("writing the private key: %w", err)
+	}
+	_, err = f.Write(privatePEM)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("writing the private key: %w", err)
+	}
+
+	_, err = api.ImportKeyPair(c, &ec2.ImportKeyPairInput{
+		KeyName:           aws.String(keyName),
+		PublicKeyMaterial: []byte(publicKey),
+		TagSpecifications: tagSpecification(types.ResourceTypeKeyPair, withProvenance(c, nil, ""), keyName),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("importing key pair %s: %w", keyName, err)
+	}
+	result := &keyRotation{KeyName: keyName, KeyPath: keyPath, Failed: map[string]error{}, Kept: map[string]string{}}
+
+	add := authorizedKeysScript(osUser, `grep -qxF `+shellQuote(publicKey)+` "$keys" || echo `+shellQuote(publicKey)+` >> "$keys"`)
+	verify := authorizedKeysScript(osUser, `grep -qxF `+shellQuote(publicKey)+` "$keys"`)
+	for _, i := range instances {
+		id := aws.ToString(i.InstanceId)
+		progressln("Adding key pair " + keyName + " to " + id)
+		if _, err := runShellCommands(c, commands, id, add, nil); err != nil {
+			result.Failed[id] = fmt.Errorf("adding the key: %w", err)
+			continue
+		}
+		if _, err := runShellCommands(c, commands, id, verify, nil); err != nil {
+			result.Failed[id] = fmt.Errorf("verifying the key: %w", err)
+		}
+	}
+	if len(result.Failed) > 0 {
+		return result, nil
+	}
+
+	old := map[string][]string{}
+	var ids []string
+	for _, i := range instances {
+		if name := currentKeyName(&i); name != "" {
+			old[name] = append(old[name], aws.ToString(i.InstanceId))
+		}
+		ids = append(ids, aws.ToString(i.InstanceId))
+	}
+	if err := provisioner.Tag(c, ids, map[string]string{keyNameTag: keyName}); err != nil {
+		return result, fmt.Errorf("tagging the instances with the new key pair: %w", err)
+	}
+	var oldNames []string
+	for name := range old {
+		oldNames = append(oldNames, name)
+	}
+	sort.Strings(oldNames)
+	for _, name := range oldNames {
+		pairs, err := api.DescribeKeyPairs(c, &ec2.DescribeKeyPairsInput{KeyNames: []string{name}, IncludePublicKey: aws.Bool(true)})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error looking up key pair "+name+", it is left in authorized_keys:")
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		if len(pairs.KeyPairs) == 0 || aws.ToString(pairs.KeyPairs[0].PublicKey) == "" {
+			fmt.Fprintln(os.Stderr, "The public key of key pair "+name+" is unknown, it is left in authorized_keys")
+			continue
+		}
+		remove := authorizedKeysScript(osUser, `grep -vF `+shellQuote(keyBlob(aws.ToString(pairs.KeyPairs[0].PublicKey)))+` "$keys" > "$keys.new" || true; cat "$keys.new" > "$keys"; rm -f "$keys.new"`)
+		for _, id := range old[name] {
+			progressln("Removing key pair " + name + " from " + id)
+			if _, err := runShellCommands(c, commands, id, remove, nil); err != nil {
+				fmt.Fprintln(os.Stderr, "Got an error removing key pair "+name+" from "+id+":")
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+
+		for _, o := range others {
+			if currentKeyName(&o) == name {
+				result.Kept[name] = aws.ToString(o.InstanceId)
+				break
+			}
+		}
+		if result.Kept[name] != "" {
+			continue
+		}
+		if _, err := api.DeleteKeyPair(c, &ec2.DeleteKeyPairInput{KeyName: aws.String(name)}); err != nil {
+			return result, fmt.Errorf("deleting key pair %s: %w", name, err)
+		}
+		result.Retired = append(result.Retired, name)
+	}
+	return result, nil
+}
+
+func RotateKeyCmd(name *string, value *string, osUser *string, keyPath *string, dryRun *bool) {
+	c := context.TODO()
+	instances, err := provisioner.List(c, vmcreate.TagFilter(*name, strings.Split(*value, ",")...), vmcreate.StateFilter("running"))
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error listing the instances:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	if len(instances) == 0 {
+		fmt.Println("No running instances with tag " + *name + "=" + *value)
+		return
+	}
+
+	seen := map[string]bool{}
+	var old []string
+	selected := map[string]bool{}
+	for _, i := range instances {
+		selected[aws.ToString(i.InstanceId)] = true
+		if k := currentKeyName(&i); k != "" && !seen[k] {
+			seen[k] = true
+			old = append(old, k)
+		}
+	}
+	keyName := rotatedKeyName(old, strings.ReplaceAll(*value, ",", "-"), time.Now())
+	path := firstNonEmpty(*keyPath, filepath.Join(keyDir(), keyName+".pem"))
+	if *dryRun {
+		fmt.Printf("Would replace key pairs %s on %d instances with %s, its private key in %s\n", strings.Join(old, ", "), len(instances), keyName, path)
+		return
+	}
+
+	// The old key pairs are kept while instances outside the tag accept them.
+	live, err := provisioner.List(c, vmcreate.StateFilter(vmcreate.LiveStates...))
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error listing the instances:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	var others []types.Instance
+	for _, i := range live {
+		if !selected[aws.ToString(i.InstanceId)] {
+			others = append(others, i)
+		}
+	}
+
+	result, err := rotateKey(c, client, ssmClient, instances, others, *osUser, keyName, path)
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error rotating the key pair:")
+		fmt.Fprintln(os.Stderr, err)
+		if result == nil {
+			return
+		}
+	}
+	if len(result.Failed) > 0 {
+		for _, i := range instances {
+			id := aws.ToString(i.InstanceId)
+			if err := result.Failed[id]; err != nil {
+				fmt.Fprintln(os.Stderr, "Got an error on "+id+":")
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+		commandErr = fmt.Errorf("key pair %s could not be added to %d of %d instances", keyName, len(result.Failed), len(instances))
+		fmt.Fprintln(os.Stderr, "Kept key pairs "+strings.Join(old, ", ")+": "+commandErr.Error()+", run rotate-key again once they are reachable through SSM")
+		return
+	}
+	for _, k := range result.Retired {
+		fmt.Println("Retired key pair " + k)
+	}
+	for k, id := range result.Kept {
+		fmt.Println("Kept key pair " + k + ", which " + id + " still accepts")
+	}
+	printResult(fmt.Sprintf("Rotated %d instances to key pair %s, its private key is in %s", len(instances), keyName, path), keyName)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeKeyPairs holds the key pairs by name and records the deleted ones.
+type fakeKeyPairs struct {
+	keys    map[string]string
+	deleted []string
+}
+
+func (f *fakeKeyPairs) ImportKeyPair(ctx context.Context, params *ec2.ImportKeyPairInput, optFns ...func(*ec2.Options)) (*ec2.ImportKeyPairOutput, error) {
+	f.keys[aws.ToString(params.KeyName)] = string(params.PublicKeyMaterial)
+	return &ec2.ImportKeyPairOutput{KeyName: params.KeyName}, nil
+}
+
+func (f *fakeKeyPairs) DescribeKeyPairs(ctx context.Context, params *ec2.DescribeKeyPairsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeKeyPairsOutput, error) {
+	out := &ec2.DescribeKeyPairsOutput{}
+	for _, name := range params.KeyNames {
+		if key, ok := f.keys[name]; ok {
+			out.KeyPairs = append(out.KeyPairs, types.KeyPairInfo{KeyName: aws.String(name), PublicKey: aws.String(key)})
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeKeyPairs) DeleteKeyPair(ctx context.Context, params *ec2.DeleteKeyPairInput, optFns ...func(*ec2.Options)) (*ec2.DeleteKeyPairOutput, error) {
+	delete(f.keys, aws.ToString(params.KeyName))
+	f.deleted = append(f.deleted, aws.ToString(params.KeyName))
+	return &ec2.DeleteKeyPairOutput{}, nil
+}
+
+// fakeKeySSM records the scripts run on each instance, which fail on the
+// unreachable ones.
+type fakeKeySSM struct {
+	unreachable map[string]bool
+	scripts     map[string][]string
+}
+
+func (f *fakeKeySSM) SendCommand(ctx context.Context, params *awsapi.SendCommandInput) (*awsapi.SendCommandOutput, error) {
+	id := params.InstanceIds[0]
+	if f.unreachable[id] {
+		return nil, errors.New("InvalidInstanceId: " + id + " is not connected")
+	}
+	f.scripts[id] = append(f.scripts[id], strings.Join(params.Parameters["commands"], "\n"))
+	return &awsapi.SendCommandOutput{Command: awsapi.Command{CommandId: "cmd-1"}}, nil
+}
+
+func (f *fakeKeySSM) GetCommandInvocation(ctx context.Context, params *awsapi.GetCommandInvocationInput) (*awsapi.GetCommandInvocationOutput, error) {
+	return &awsapi.GetCommandInvocationOutput{Status: "Success"}, nil
+}
+
+func TestRotateKey(t *testing.T) {
+	fake := useFakeEC2(t)
+	defer func(interval time.Duration) { commandPollInterval = interval }(commandPollInterval)
+	commandPollInterval = time.Millisecond
+	c := context.Background()
+	var instances []types.Instance
+	for _, key := range []string{"dev", "dev-20240101-090000"} {
+		i := tagged("env", "dev")
+		i.KeyName = aws.String(key)
+		i.InstanceId = aws.String(fake.AddInstance(i))
+		instances = append(instances, i)
+	}
+	other := tagged("env", "prod")
+	other.InstanceId, other.KeyName = aws.String("i-prod"), aws.String("dev")
+	api := &fakeKeyPairs{keys: map[string]string{"dev": "ssh-rsa AAAAold dev", "dev-20240101-090000": "ssh-rsa AAAAolder dev"}}
+	commands := &fakeKeySSM{unreachable: map[string]bool{}, scripts: map[string][]string{}}
+
+	name := rotatedKeyName([]string{"dev-20240101-090000"}, "dev", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	if name != "dev-20240501-120000" {
+		t.Errorf("rotated key name = %s", name)
+	}
+	result, err := rotateKey(c, api, commands, instances, []types.Instance{other}, "ec2-user", name, filepath.Join(t.TempDir(), "keys", name+".pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Failed) != 0 || strings.Join(result.Retired, ",") != "dev-20240101-090000" || result.Kept["dev"] == "" {
+		t.Errorf("failed %v, retired %v, kept %v", result.Failed, result.Retired, result.Kept)
+	}
+	id := aws.ToString(instances[0].InstanceId)
+	if scripts := commands.scripts[id]; len(scripts) != 3 || !strings.Contains(scripts[0], api.keys[name]) || !strings.Contains(scripts[2], "grep -vF 'AAAAold'") {
+		t.Errorf("scripts run on %s:\n%s", id, strings.Join(scripts, "\n---\n"))
+	}
+	if tagged, _ := provisioner.Describe(c, id); currentKeyName(tagged) != name {
+		t.Errorf("%s accepts %s", id, currentKeyName(tagged))
+	}
+
+	// An unreachable instance keeps the old key pairs everywhere.
+	unreachable := instances[1]
+	unreachable.Tags = append(unreachable.Tags, types.Tag{Key: aws.String(keyNameTag), Value: aws.String(name)})
+	commands.unreachable[aws.ToString(unreachable.InstanceId)] = true
+	next := name + "-next"
+	result, err = rotateKey(c, api, commands, []types.Instance{instances[0], unreachable}, nil, "ec2-user", next, filepath.Join(t.TempDir(), next+".pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Failed) != 1 || len(result.Retired) != 0 || api.keys[name] == "" {
+		t.Errorf("failed %v, retired %v", result.Failed, result.Retired)
+	}
+	if i, _ := provisioner.Describe(c, id); vmcreate.TagValue(i, keyNameTag) != name {
+		t.Errorf("%s was tagged with %s before every instance had it", id, vmcreate.TagValue(i, keyNameTag))
+	}
+}
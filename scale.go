@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func ScaleCmd(name *string, value *string, to int, zones []ZoneCount, policy string, createOpts *CreateOptions, deleteOpts *DeleteOptions, dryRun *bool) {
+	c := commandContext
+	instances, err := provisioner.List(c, vmcreate.TagFilter(*name, strings.Split(*value, ",")...), vmcreate.StateFilter("pending", "running"))
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error listing the instances:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	if len(zones) > 0 {
+		scaleZones(c, name, value, instances, zones, policy, createOpts, deleteOpts, *dryRun)
+		return
+	}
+	tag := *name + "=" + *value
+	switch {
+	case len(instances) < to:
+		launch := to - len(instances)
+		progressln(tag + " has " + strconv.Itoa(len(instances)) + " instances, launching " + strconv.Itoa(launch) + " to reach " + strconv.Itoa(to))
+		if *dryRun {
+			fmt.Println("Would launch " + strconv.Itoa(launch) + " instances")
+			return
+		}
+		opts := *createOpts
+		opts.Count = launch
+		CreateInstancesCmd(name, value, &opts, nil)
+	case len(instances) > to:
+		extra, err := chooseTerminations(c, instances, len(instances)-to, policy)
+		if err != nil {
+			commandErr = err
+			fmt.Fprintln(os.Stderr, "Got an error choosing the instances to terminate:")
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		ids := instanceIDs(extra)
+		progressln(tag + " has " + strconv.Itoa(len(instances)) + " instances, terminating " + strconv.Itoa(len(extra)) + " to reach " + strconv.Itoa(to))
+		if *dryRun {
+			fmt.Println("Would terminate " + strings.Join(ids, ", "))
+			return
+		}
+		scaleIn(c, *name, *value, extra, deleteOpts)
+	default:
+		progressln(tag + " already has " + strconv.Itoa(to) + " instances")
+	}
+}
+
+// scaleZones launches the instances each zone is missing into its subnet and
+// terminates those beyond the count of their zone, or in none of the zones,
+// in the order of the policy.
+func scaleZones(c context.Context, name *string, value *string, instances []types.Instance, zones []ZoneCount, policy string, createOpts *CreateOptions, deleteOpts *DeleteOptions, dryRun bool) {
+	keep, err := terminationOrder(c, terminationOrderClient, instances, lifecyclePhases(c), policy)
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error choosing the instances to terminate:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	reverseInstances(keep)
+	missing, extra := planZones(zones, keep)
+	tag := *name + "=" + *value
+	if len(missing) == 0 && len(extra) == 0 {
+		progressln(tag + " already has the instances of each zone")
+		return
+	}
+	for _, z := range missing {
+		progressln(tag + " is missing " + strconv.Itoa(z.Count) + " instances in " + z.String())
+		if dryRun {
+			fmt.Println("Would launch " + strconv.Itoa(z.Count) + " instances in " + z.String())
+			continue
+		}
+		opts := *createOpts
+		opts.Count, opts.SubnetID = z.Count, z.SubnetId
+		CreateInstancesCmd(name, value, &opts, nil)
+	}
+	if len(extra) == 0 {
+		return
+	}
+	ids := instanceIDs(extra)
+	progressln(tag + " has " + strconv.Itoa(len(extra)) + " instances beyond the counts of their zones")
+	if dryRun {
+		fmt.Println("Would terminate " + strings.Join(ids, ", "))
+		return
+	}
+	scaleIn(c, *name, *value, extra, deleteOpts)
+}
+
+// scaleIn takes the instances out of service like delete and terminates
+// them.
+func scaleIn(c context.Context, key, value string, instances []types.Instance, opts *DeleteOptions) {
+	config, _ := loadConfig()
+	event := &Event{Command: "scale", TagKey: key, TagValue: value}
+	if opts.Drain == nil {
+		opts.Drain = config.Drain
+	}
+	recordLifecycle(context.TODO(), "scale", instances, awsConfig.Region, phaseDraining, "scaled in")
+	var ops []operation
+	for n := range instances {
+		i := &instances[n]
+		ops = append(ops, operation{
+			Name: "taking " + *i.InstanceId + " out of service",
+			Run: func(c context.Context) error {
+				beforeTerminate(c, ssmClient, elbv2Client, i, key, opts)
+				return nil
+			},
+		})
+	}
+	newOperationQueue("scale").Run(c, ops)
+
+	terminated, err := provisioner.Delete(c, instanceIDs(instances))
+	event.InstanceIDs = terminated
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error terminating the instances:")
+		fmt.Fprintln(os.Stderr, err)
+		event.Status, event.Error = "failure", err.Error()
+		notify(context.TODO(), config.Notifications, event)
+		return
+	}
+	for _, id := range terminated {
+		printResult("Terminated instance with id: "+id, id)
+	}
+	recordLifecycle(context.TODO(), "scale", instancesOf(terminated), "", phaseTerminated, "scaled in")
+	if config.CMDB != nil {
+		updateCMDB(config.CMDB, hookInstances(instances), true)
+	}
+	event.Status = "success"
+	notify(context.TODO(), config.Notifications, event)
+}
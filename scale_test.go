@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestScaleCommand(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1"})
+	fake.AddInstance(tagged("app", "worker"))
+
+	out := runCLI(t, "scale", "--tag", "app=worker", "--to", "3")
+	if n := len(liveInstances(fake)); n != 3 {
+		t.Fatalf("%d instances after scaling out to 3\n%s", n, out)
+	}
+
+	out = runCLI(t, "scale", "--tag", "app=worker", "--to", "1", "--dry-run")
+	if !strings.Contains(out, "Would terminate") || len(liveInstances(fake)) != 3 {
+		t.Errorf("the dry run changed the group:\n%s", out)
+	}
+
+	oldest := aws.ToString(fake.Instances()[0].InstanceId)
+	out = runCLI(t, "scale", "--tag", "app=worker", "--to", "2")
+	live := liveInstances(fake)
+	if len(live) != 2 || aws.ToString(live[0].InstanceId) == oldest {
+		t.Errorf("scaling in left %v, want the oldest terminated\n%s", instanceIDs(live), out)
+	}
+	if m := loadState(t).Instances[oldest]; m == nil || m.Phase != phaseTerminated {
+		t.Errorf("the state has %+v for the terminated instance", m)
+	}
+
+	if out := runCLI(t, "scale", "--tag", "app=worker", "--to", "2"); !strings.Contains(out, "already has 2 instances") {
+		t.Errorf("output:\n%s", out)
+	}
+}
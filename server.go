@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// InstanceView is the JSON representation of an instance returned by the API.
+type InstanceView struct {
+	InstanceID       string            `json:"instance_id"`
+	State            string            `json:"state"`
+	InstanceType     string            `json:"instance_type"`
+	ImageID          string            `json:"image_id"`
+	AvailabilityZone string            `json:"availability_zone,omitempty"`
+	PrivateIP        string            `json:"private_ip,omitempty"`
+	PublicIP         string            `json:"public_ip,omitempty"`
+	LaunchTime       time.Time         `json:"launch_time"`
+	Tags             map[string]string `json:"tags,omitempty"`
+}
+
+func newInstanceView(i *types.Instance) InstanceView {
+	view := InstanceView{
+		InstanceID:   aws.ToString(i.InstanceId),
+		InstanceType: string(i.InstanceType),
+		ImageID:      aws.ToString(i.ImageId),
+		PrivateIP:    aws.ToString(i.PrivateIpAddress),
+		PublicIP:     aws.ToString(i.PublicIpAddress),
+		LaunchTime:   aws.ToTime(i.LaunchTime),
+		Tags:         map[string]string{},
+	}
+	if i.State != nil {
+		view.State = string(i.State.Name)
+	}
+	if i.Placement != nil {
+		view.AvailabilityZone = aws.ToString(i.Placement.AvailabilityZone)
+	}
+	for _, t := range i.Tags {
+		view.Tags[aws.ToString(t.Key)] = aws.ToString(t.Value)
+	}
+	return view
+}
+
+// CreateRequest is the body of POST /v1/instances. Empty fields fall back to
+// data/config.json.
+type CreateRequest struct {
+	TagKey       string `json:"tag_key"`
+	TagValue     string `json:"tag_value"`
+	InstanceType string `json:"instance_type,omitempty"`
+	ImageId      string `json:"image_id,omitempty"`
+	SubnetId     string `json:"subnet_id,omitempty"`
+}
+
+// apiServer serves the provisioning operations over HTTP.
+type apiServer struct {
+	token  string
+	config ConfigMap
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
+
+// ServeHTTP authenticates the request with its bearer token and routes it.
+func (s *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	header := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(header, "Bearer ")
+	if token == header || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		writeError(w, http.StatusUnauthorized, errors.New("missing or invalid bearer token"))
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/metrics" && r.Method == http.MethodGet:
+		metricsRegistry.ServeHTTP(w, r)
+	case r.URL.Path == "/v1/instances":
+		switch r.Method {
+		case http.MethodGet:
+			s.list(w, r)
+		case http.MethodPost:
+			s.create(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s is not allowed on %s", r.Method, r.URL.Path))
+		}
+	case strings.HasPrefix(r.URL.Path, "/v1/instances/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/instances/")
+		switch r.Method {
+		case http.MethodGet:
+			s.describe(w, r, id)
+		case http.MethodDelete:
+			s.delete(w, r, id)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s is not allowed on %s", r.Method, r.URL.Path))
+		}
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s not found", r.URL.Path))
+	}
+}
+
+// list handles GET /v1/instances, optionally filtered with ?tag=KEY=VALUE.
+func (s *apiServer) list(w http.ResponseWriter, r *http.Request) {
+	var filters []types.Filter
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		key, value, ok := strings.Cut(tag, "=")
+		if !ok {
+			writeError(w, http.StatusBadRequest, errors.New("tag must be KEY=VALUE"))
+			return
+		}
+		filters = append(filters, vmcreate.TagFilter(key, value))
+	}
+
+	instances, err := s.listInstances(r.Context(), filters...)
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	views := []InstanceView{}
+	for _, i := range instances {
+		views = append(views, newInstanceView(&i))
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// describe handles GET /v1/instances/{id}.
+func (s *apiServer) describe(w http.ResponseWriter, r *http.Request, id string) {
+	instance, err := s.describeInstance(r.Context(), id)
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newInstanceView(instance))
+}
+
+// create handles POST /v1/instances.
+func (s *apiServer) create(w http.ResponseWriter, r *http.Request) {
+	var req CreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	instance, err := s.createInstance(r.Context(), req)
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newInstanceView(instance))
+}
+
+// delete handles DELETE /v1/instances/{id}.
+func (s *apiServer) delete(w http.ResponseWriter, r *http.Request, id string) {
+	if err := s.deleteInstance(r.Context(), id); err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// statusError is an error of an API operation with the HTTP status it is
+// answered with. The gRPC server maps the status to a code.
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string { return e.err.Error() }
+func (e *statusError) Unwrap() error { return e.err }
+
+func withStatus(status int, err error) error {
+	return &statusError{status: status, err: err}
+}
+
+// errorStatus is the HTTP status of an operation error; errors without one
+// came from AWS.
+func errorStatus(err error) int {
+	var s *statusError
+	if errors.As(err, &s) {
+		return s.status
+	}
+	return http.StatusBadGateway
+}
+
+func writeStatusError(w http.ResponseWriter, err error) {
+	writeError(w, errorStatus(err), err)
+}
+
+// The operations below are served by both the REST and the gRPC API.
+
+func (s *apiServer) listInstances(ctx context.Context, filters ...types.Filter) ([]types.Instance, error) {
+	return provisioner.List(ctx, filters...)
+}
+
+func (s *apiServer) describeInstance(ctx context.Context, id string) (*types.Instance, error) {
+	instance, err := provisioner.Describe(ctx, id)
+	if err != nil {
+		return nil, withStatus(http.StatusNotFound, err)
+	}
+	return instance, nil
+}
+
+// createInstance launches a single instance like create does, limits,
+// budget, approvals, hooks and notifications included.
+func (s *apiServer) createInstance(ctx context.Context, req CreateRequest) (*types.Instance, error) {
+	if req.TagKey == "" || req.TagValue == "" {
+		return nil, withStatus(http.StatusBadRequest, errors.New("tag_key and tag_value are required"))
+	}
+
+	tags := map[string]string{req.TagKey: req.TagValue}
+	launch := &launchPlan{
+		Command:      "serve",
+		TagKey:       req.TagKey,
+		TagValue:     req.TagValue,
+		InstanceType: firstNonEmpty(req.InstanceType, s.config.InstanceType),
+		ImageID:      firstNonEmpty(req.ImageId, s.config.ImageId),
+		Count:        1,
+		Tags:         tags,
+	}
+	if err := beforeLaunch(ctx, s.config, launch); err != nil {
+		switch {
+		case errors.Is(err, errInstanceLimit), errors.Is(err, errOverBudget):
+			return nil, withStatus(http.StatusConflict, err)
+		case errors.Is(err, errNotApproved):
+			return nil, withStatus(http.StatusForbidden, err)
+		}
+		return nil, err
+	}
+
+	instances, err := provisioner.Create(ctx, &vmcreate.CreateInput{
+		Tags:         withProvenance(ctx, tags, hashConfig(s.config)),
+		InstanceType: launch.InstanceType,
+		ImageID:      launch.ImageID,
+		SubnetID:     firstNonEmpty(req.SubnetId, s.config.SubnetId),
+	})
+	event := &Event{Command: "create", TagKey: req.TagKey, TagValue: req.TagValue}
+	if err != nil {
+		event.Status, event.Error = "failure", err.Error()
+		notify(ctx, s.config.Notifications, event)
+		return nil, err
+	}
+
+	recordLifecycle(ctx, "serve", instances, awsConfig.Region, phaseLaunching, "")
+	instance := instances[0]
+	postCreateHooks(ctx, s.config, req.TagKey, req.TagValue, instances)
+	event.Status, event.InstanceIDs = "success", []string{aws.ToString(instance.InstanceId)}
+	notify(ctx, s.config.Notifications, event)
+	progressln("API created instance " + aws.ToString(instance.InstanceId))
+	return &instance, nil
+}
+
+// deleteInstance terminates an instance like delete does, drain, hooks and
+// CMDB included. Only the instances aws-vmcreate created can be terminated
+// through the API.
+func (s *apiServer) deleteInstance(ctx context.Context, id string) error {
+	instance, err := provisioner.Describe(ctx, id)
+	if err != nil {
+		return withStatus(http.StatusNotFound, err)
+	}
+	if !managedByTool(instance.Tags) {
+		return withStatus(http.StatusForbidden, fmt.Errorf("instance %s was not created by aws-vmcreate", id))
+	}
+
+	_, err = deleteInstances(ctx, s.config, "serve", "", "", []types.Instance{*instance}, &DeleteOptions{Drain: s.config.Drain})
+	event := &Event{Command: "delete", InstanceIDs: []string{id}}
+	if err != nil {
+		event.Status, event.Error = "failure", err.Error()
+		notify(ctx, s.config.Notifications, event)
+		return err
+	}
+
+	event.Status = "success"
+	notify(ctx, s.config.Notifications, event)
+	progressln("API terminated instance " + id)
+	return nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// newAPIServer reads the API token, from AWS_VMCREATE_API_TOKEN or the
+// token file, and the config that serve and grpc-serve answer with. It
+// reports what is wrong and returns nil when the command cannot serve.
+func newAPIServer(tokenFile string) *apiServer {
+	token := os.Getenv("AWS_VMCREATE_API_TOKEN")
+	if tokenFile != "" {
+		data, err := os.ReadFile(tokenFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Got an error reading the API token:")
+			fmt.Fprintln(os.Stderr, err)
+			commandErr = err
+			return nil
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token == "" {
+		failCommand("You must supply an API token (AWS_VMCREATE_API_TOKEN or --api-token-file FILE)")
+		return nil
+	}
+
+	config, err := loadConfig()
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		commandErr = err
+		return nil
+	}
+	return &apiServer{token: token, config: config}
+}
+
+func ServeCmd(listen *string, tokenFile *string) {
+	api := newAPIServer(*tokenFile)
+	if api == nil {
+		return
+	}
+
+	server := &http.Server{
+		Addr:              *listen,
+		Handler:           traceHTTP(countRequests(api)),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	c, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-c.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
+
+	go flushTelemetryEvery(c, 10*time.Second)
+
+	progressln("Serving the provisioning API on " + *listen)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		fmt.Fprintln(os.Stderr, "Got an error serving the API:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+	}
+}
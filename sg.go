@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// SecurityGroupAPI defines the interface for the security group functions of sg.
+// We use this interface to test the functions using a mocked service.
+type SecurityGroupAPI interface {
+	ec2.DescribeSecurityGroupsAPIClient
+
+	AuthorizeSecurityGroupIngress(ctx context.Context,
+		params *ec2.AuthorizeSecurityGroupIngressInput,
+		optFns ...func(*ec2.Options)) (*ec2.AuthorizeSecurityGroupIngressOutput, error)
+
+	AuthorizeSecurityGroupEgress(ctx context.Context,
+		params *ec2.AuthorizeSecurityGroupEgressInput,
+		optFns ...func(*ec2.Options)) (*ec2.AuthorizeSecurityGroupEgressOutput, error)
+
+	RevokeSecurityGroupIngress(ctx context.Context,
+		params *ec2.RevokeSecurityGroupIngressInput,
+		optFns ...func(*ec2.Options)) (*ec2.RevokeSecurityGroupIngressOutput, error)
+
+	RevokeSecurityGroupEgress(ctx context.Context,
+		params *ec2.RevokeSecurityGroupEgressInput,
+		optFns ...func(*ec2.Options)) (*ec2.RevokeSecurityGroupEgressOutput, error)
+}
+
+// sensitivePorts are the ports of remote access and data services that must
+// not be reachable from the whole internet by accident.
+var sensitivePorts = map[int32]string{
+	22:    "SSH",
+	23:    "Telnet",
+	135:   "RPC",
+	445:   "SMB",
+	1433:  "SQL Server",
+	1521:  "Oracle",
+	2375:  "Docker",
+	2379:  "etcd",
+	3306:  "MySQL",
+	3389:  "RDP",
+	5432:  "PostgreSQL",
+	5601:  "Kibana",
+	5900:  "VNC",
+	6379:  "Redis",
+	9200:  "Elasticsearch",
+	11211: "Memcached",
+	27017: "MongoDB",
+}
+
+// sgRule is one rule of a security group.
+type sgRule struct {
+	Egress bool
+	// Protocol is tcp, udp, icmp or -1 for all traffic, which has no ports.
+	Protocol    string
+	FromPort    int32
+	ToPort      int32
+	CIDR        string
+	SourceGroup string
+	Description string
+}
+
+// parseSGRule checks and normalises a rule given on the command line. ports
+// is a port or a range such as 8000-8100.
+func parseSGRule(protocol, ports, cidr, sourceGroup, description string, egress bool) (sgRule, error) {
+	r := sgRule{Egress: egress, Protocol: strings.ToLower(protocol), CIDR: cidr, SourceGroup: sourceGroup, Description: description, FromPort: -1, ToPort: -1}
+	if r.Protocol == "all" {
+		r.Protocol = "-1"
+	}
+	switch r.Protocol {
+	case "tcp", "udp":
+		from, to, isRange := strings.Cut(ports, "-")
+		if !isRange {
+			to = from
+		}
+		fromPort, err := strconv.ParseUint(from, 10, 16)
+		if err != nil {
+			return r, fmt.Errorf("the port must be a number or a range such as 8000-8100, not %q", ports)
+		}
+		toPort, err := strconv.ParseUint(to, 10, 16)
+		if err != nil || toPort < fromPort {
+			return r, fmt.Errorf("the port must be a number or a range such as 8000-8100, not %q", ports)
+		}
+		r.FromPort, r.ToPort = int32(fromPort), int32(toPort)
+	case "icmp", "-1":
+		if ports != "" {
+			return r, fmt.Errorf("%s rules have no ports", protocol)
+		}
+	default:
+		return r, fmt.Errorf("the protocol must be tcp, udp, icmp or all, not %q", protocol)
+	}
+
+	switch {
+	case (cidr == "") == (sourceGroup == ""):
+		return r, fmt.Errorf("you must supply one of --cidr or --source-group")
+	case cidr != "":
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			return r, fmt.Errorf("invalid CIDR %q", cidr)
+		}
+	}
+	return r, nil
+}
+
+// worldOpen reports whether the rule applies to every address: its CIDR has
+// a zero-length prefix, however it is written, e.g. 0::/0 or 1.2.3.4/0.
+func (r sgRule) worldOpen() bool {
+	prefix, err := netip.ParsePrefix(r.CIDR)
+	return err == nil && prefix.Bits() == 0
+}
+
+// exposedServices returns the sensitive services the rule's ports cover, on
+// tcp, udp or all protocols.
+func (r sgRule) exposedServices() []string {
+	var exposed []string
+	for port, service := range sensitivePorts {
+		ported := (r.Protocol == "tcp" || r.Protocol == "udp") && port >= r.FromPort && port <= r.ToPort
+		if r.Protocol == "-1" || ported {
+			exposed = append(exposed, fmt.Sprintf("%s (%d)", service, port))
+		}
+	}
+	sort.Strings(exposed)
+	return exposed
+}
+
+// checkRuleSafety refuses ingress rules that open sensitive ports, or all
+// traffic, to the whole internet.
+func checkRuleSafety(r sgRule) error {
+	if r.Egress || !r.worldOpen() {
+		return nil
+	}
+	if r.Protocol == "-1" {
+		return fmt.Errorf("the rule opens all traffic to %s, pass --i-know-what-im-doing to add it anyway", r.CIDR)
+	}
+	if exposed := r.exposedServices(); len(exposed) > 0 {
+		return fmt.Errorf("the rule opens %s to %s, pass --i-know-what-im-doing to add it anyway", strings.Join(exposed, ", "), r.CIDR)
+	}
+	return nil
+}
+
+func (r sgRule) ipPermission() types.IpPermission {
+	p := types.IpPermission{IpProtocol: aws.String(r.Protocol)}
+	if r.Protocol != "-1" {
+		p.FromPort, p.ToPort = aws.Int32(r.FromPort), aws.Int32(r.ToPort)
+	}
+	var description *string
+	if r.Description != "" {
+		description = aws.String(r.Description)
+	}
+	switch {
+	case r.SourceGroup != "":
+		p.UserIdGroupPairs = []types.UserIdGroupPair{{GroupId: aws.String(r.SourceGroup), Description: description}}
+	case strings.Contains(r.CIDR, ":"):
+		p.Ipv6Ranges = []types.Ipv6Range{{CidrIpv6: aws.String(r.CIDR), Description: description}}
+	default:
+		p.IpRanges = []types.IpRange{{CidrIp: aws.String(r.CIDR), Description: description}}
+	}
+	return p
+}
+
+func (r sgRule) String() string {
+	direction, peer := "ingress from", r.CIDR
+	if r.Egress {
+		direction = "egress to"
+	}
+	if r.SourceGroup != "" {
+		peer = r.SourceGroup
+	}
+	var ports string
+	switch {
+	case r.Protocol == "-1":
+		return "all traffic " + direction + " " + peer
+	case r.Protocol == "icmp":
+		return "icmp " + direction + " " + peer
+	case r.FromPort == r.ToPort:
+		ports = "port " + strconv.Itoa(int(r.FromPort))
+	default:
+		ports = fmt.Sprintf("ports %d-%d", r.FromPort, r.ToPort)
+	}
+	return r.Protocol + " " + ports + " " + direction + " " + peer
+}
+
+// managedGroup returns the security group when aws-vmcreate manages it:
+// it is tagged with createdByTag or listed in the config's
+// security_group_ids.
+func managedGroup(c context.Context, api SecurityGroupAPI, groupID string, configured []string) (*types.SecurityGroup, error) {
+	out, err := api.DescribeSecurityGroups(c, &ec2.DescribeSecurityGroupsInput{GroupIds: []string{groupID}})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.SecurityGroups) == 0 {
+		return nil, fmt.Errorf("security group %s not found", groupID)
+	}
+	group := &out.SecurityGroups[0]
+	if !hasTag(group.Tags, createdByTag) && !contains(configured, groupID) {
+		return nil, fmt.Errorf("security group %s is not managed by aws-vmcreate: it is neither tagged %s nor in security_group_ids", groupID, createdByTag)
+	}
+	return group, nil
+}
+
+// changeRule authorizes or revokes the rule on the group.
+func changeRule(c context.Context, api SecurityGroupAPI, authorize bool, groupID string, r sgRule) error {
+	permissions := []types.IpPermission{r.ipPermission()}
+	var err error
+	switch {
+	case authorize && r.Egress:
+		_, err = api.AuthorizeSecurityGroupEgress(c, &ec2.AuthorizeSecurityGroupEgressInput{GroupId: aws.String(groupID), IpPermissions: permissions})
+	case authorize:
+		_, err = api.AuthorizeSecurityGroupIngress(c, &ec2.AuthorizeSecurityGroupIngressInput{GroupId: aws.String(groupID), IpPermissions: permissions})
+	case r.Egress:
+		_, err = api.RevokeSecurityGroupEgress(c, &ec2.RevokeSecurityGroupEgressInput{GroupId: aws.String(groupID), IpPermissions: permissions})
+	default:
+		_, err = api.RevokeSecurityGroupIngress(c, &ec2.RevokeSecurityGroupIngressInput{GroupId: aws.String(groupID), IpPermissions: permissions})
+	}
+	return err
+}
+
+func SGRuleCmd(action string, groupID string, rule sgRule, force bool) {
+	// The config is optional, it only adds the groups it lists as managed.
+	config, err := loadConfig()
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "Got an error loading the config:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+
+	authorize := action == "authorize"
+	if authorize && !force {
+		if err := checkRuleSafety(rule); err != nil {
+			commandErr = err
+			fmt.Fprintln(os.Stderr, "Refusing to authorize the rule:")
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+	}
+	if _, err := managedGroup(context.TODO(), client, groupID, config.SecurityGroupIds); err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error checking the security group:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	if err := changeRule(context.TODO(), client, authorize, groupID, rule); err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error changing the rules of "+groupID+":")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	if authorize {
+		fmt.Println("Authorized " + rule.String() + " on " + groupID)
+	} else {
+		fmt.Println("Revoked " + rule.String() + " on " + groupID)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"aws-vmcreate/pkg/vmcreate/vmcreatetest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeSecurityGroups answers DescribeSecurityGroups from its groups and
+// records the rules changed on them, applying those of ingress.
+type fakeSecurityGroups struct {
+	*vmcreatetest.FakeEC2
+	groups  []types.SecurityGroup
+	changes []string
+}
+
+func (f *fakeSecurityGroups) DescribeSecurityGroups(ctx context.Context, params *ec2.DescribeSecurityGroupsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSecurityGroupsOutput, error) {
+	out := &ec2.DescribeSecurityGroupsOutput{}
+	for _, g := range f.groups {
+		if len(params.GroupIds) == 0 || contains(params.GroupIds, aws.ToString(g.GroupId)) {
+			out.SecurityGroups = append(out.SecurityGroups, g)
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeSecurityGroups) record(change string, groupID *string, permissions []types.IpPermission) {
+	p := permissions[0]
+	peer := ""
+	if len(p.IpRanges) > 0 {
+		peer = aws.ToString(p.IpRanges[0].CidrIp)
+	} else if len(p.UserIdGroupPairs) > 0 {
+		peer = aws.ToString(p.UserIdGroupPairs[0].GroupId)
+	}
+	f.changes = append(f.changes, change+" "+aws.ToString(groupID)+" "+aws.ToString(p.IpProtocol)+" "+peer)
+}
+
+// applyIngress adds the ingress permissions to the group, or removes the
+// ranges and group pairs they name from it.
+func (f *fakeSecurityGroups) applyIngress(authorize bool, groupID *string, permissions []types.IpPermission) {
+	for n := range f.groups {
+		g := &f.groups[n]
+		if aws.ToString(g.GroupId) != aws.ToString(groupID) {
+			continue
+		}
+		if authorize {
+			g.IpPermissions = append(g.IpPermissions, permissions...)
+			return
+		}
+		for _, p := range permissions {
+			var kept []types.IpPermission
+			for _, have := range g.IpPermissions {
+				if aws.ToString(have.IpProtocol) == aws.ToString(p.IpProtocol) && aws.ToInt32(have.FromPort) == aws.ToInt32(p.FromPort) && aws.ToInt32(have.ToPort) == aws.ToInt32(p.ToPort) {
+					have.IpRanges = removeRanges(have.IpRanges, p.IpRanges)
+					have.UserIdGroupPairs = removePairs(have.UserIdGroupPairs, p.UserIdGroupPairs)
+				}
+				if len(have.IpRanges) > 0 || len(have.Ipv6Ranges) > 0 || len(have.UserIdGroupPairs) > 0 {
+					kept = append(kept, have)
+				}
+			}
+			g.IpPermissions = kept
+		}
+	}
+}
+
+func removeRanges(ranges []types.IpRange, remove []types.IpRange) []types.IpRange {
+	var kept []types.IpRange
+	for _, r := range ranges {
+		found := false
+		for _, x := range remove {
+			found = found || aws.ToString(r.CidrIp) == aws.ToString(x.CidrIp)
+		}
+		if !found {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+func removePairs(pairs []types.UserIdGroupPair, remove []types.UserIdGroupPair) []types.UserIdGroupPair {
+	var kept []types.UserIdGroupPair
+	for _, p := range pairs {
+		found := false
+		for _, x := range remove {
+			found = found || aws.ToString(p.GroupId) == aws.ToString(x.GroupId)
+		}
+		if !found {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+func (f *fakeSecurityGroups) AuthorizeSecurityGroupIngress(ctx context.Context, params *ec2.AuthorizeSecurityGroupIngressInput, optFns ...func(*ec2.Options)) (*ec2.AuthorizeSecurityGroupIngressOutput, error) {
+	f.record("authorize-ingress", params.GroupId, params.IpPermissions)
+	f.applyIngress(true, params.GroupId, params.IpPermissions)
+	return &ec2.AuthorizeSecurityGroupIngressOutput{}, nil
+}
+
+func (f *fakeSecurityGroups) AuthorizeSecurityGroupEgress(ctx context.Context, params *ec2.AuthorizeSecurityGroupEgressInput, optFns ...func(*ec2.Options)) (*ec2.AuthorizeSecurityGroupEgressOutput, error) {
+	f.record("authorize-egress", params.GroupId, params.IpPermissions)
+	return &ec2.AuthorizeSecurityGroupEgressOutput{}, nil
+}
+
+func (f *fakeSecurityGroups) RevokeSecurityGroupIngress(ctx context.Context, params *ec2.RevokeSecurityGroupIngressInput, optFns ...func(*ec2.Options)) (*ec2.RevokeSecurityGroupIngressOutput, error) {
+	f.record("revoke-ingress", params.GroupId, params.IpPermissions)
+	f.applyIngress(false, params.GroupId, params.IpPermissions)
+	return &ec2.RevokeSecurityGroupIngressOutput{}, nil
+}
+
+func (f *fakeSecurityGroups) RevokeSecurityGroupEgress(ctx context.Context, params *ec2.RevokeSecurityGroupEgressInput, optFns ...func(*ec2.Options)) (*ec2.RevokeSecurityGroupEgressOutput, error) {
+	f.record("revoke-egress", params.GroupId, params.IpPermissions)
+	return &ec2.RevokeSecurityGroupEgressOutput{}, nil
+}
+
+func TestSGRuleSafety(t *testing.T) {
+	for _, test := range []struct {
+		protocol, ports, cidr string
+		egress                bool
+		refused               string
+	}{
+		{"tcp", "22", "0.0.0.0/0", false, "SSH (22)"},
+		{"tcp", "3000-3400", "::/0", false, "MySQL (3306), RDP (3389)"},
+		{"all", "", "0.0.0.0/0", false, "all traffic"},
+		{"tcp", "443", "0.0.0.0/0", false, ""},
+		{"tcp", "22", "10.0.0.0/8", false, ""},
+		{"all", "", "0.0.0.0/0", true, ""},
+		// Every zero-length prefix is the whole internet.
+		{"tcp", "22", "0::/0", false, "SSH (22)"},
+		{"tcp", "22", "::0/0", false, "SSH (22)"},
+		{"tcp", "22", "1.2.3.4/0", false, "SSH (22)"},
+		{"all", "", "::0/0", false, "all traffic"},
+		{"udp", "3389", "0.0.0.0/0", false, "RDP (3389)"},
+		{"udp", "53", "0.0.0.0/0", false, ""},
+		{"tcp", "22", "1.2.3.4/1", false, ""},
+	} {
+		rule, err := parseSGRule(test.protocol, test.ports, test.cidr, "", "", test.egress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkRuleSafety(rule)
+		if test.refused == "" && err != nil {
+			t.Errorf("%s: got %v, want it allowed", rule, err)
+		}
+		if test.refused != "" && (err == nil || !strings.Contains(err.Error(), test.refused)) {
+			t.Errorf("%s: got %v, want it refused for %s", rule, err, test.refused)
+		}
+	}
+
+	for _, bad := range [][3]string{{"tcp", "", "10.0.0.0/8"}, {"tcp", "90-80", "10.0.0.0/8"}, {"gre", "", "10.0.0.0/8"}, {"tcp", "22", "10.0.0.0"}, {"icmp", "8", "10.0.0.0/8"}, {"tcp", "22", "0.0.0.0/33"}, {"tcp", "22", "any/0"}} {
+		if _, err := parseSGRule(bad[0], bad[1], bad[2], "", "", false); err == nil {
+			t.Errorf("%v: expected an error", bad)
+		}
+	}
+}
+
+func TestManagedGroupRules(t *testing.T) {
+	fake := &fakeSecurityGroups{FakeEC2: vmcreatetest.NewFakeEC2(), groups: []types.SecurityGroup{
+		{GroupId: aws.String("sg-tagged"), Tags: []types.Tag{{Key: aws.String(createdByTag), Value: aws.String("alice")}}},
+		{GroupId: aws.String("sg-configured")},
+		{GroupId: aws.String("sg-other")},
+	}}
+	c := context.Background()
+	for _, id := range []string{"sg-tagged", "sg-configured"} {
+		if _, err := managedGroup(c, fake, id, []string{"sg-configured"}); err != nil {
+			t.Errorf("%s: %v", id, err)
+		}
+	}
+	if _, err := managedGroup(c, fake, "sg-other", []string{"sg-configured"}); err == nil {
+		t.Error("expected sg-other to be refused as unmanaged")
+	}
+
+	rule, _ := parseSGRule("tcp", "443", "10.0.0.0/8", "", "", false)
+	egress, _ := parseSGRule("udp", "53", "10.0.0.2/32", "", "", true)
+	changeRule(c, fake, true, "sg-tagged", rule)
+	changeRule(c, fake, false, "sg-tagged", egress)
+	if got := strings.Join(fake.changes, ", "); got != "authorize-ingress sg-tagged tcp 10.0.0.0/8, revoke-egress sg-tagged udp 10.0.0.2/32" {
+		t.Errorf("changes = %s", got)
+	}
+}
+
+func TestSGAuthorizeRefusal(t *testing.T) {
+	useFakeEC2(t)
+	stdout, stderr, code := runCLIExit(t, false, "sg", "authorize", "sg-1", "--port", "22", "--cidr", "0.0.0.0/0")
+	if stdout != "" || !strings.Contains(stderr, "pass --i-know-what-im-doing") || code != 1 {
+		t.Errorf("exit code %d, stdout:\n%s\nstderr:\n%s", code, stdout, stderr)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// SGAuditAPI defines the interface for the functions sg audit scans and fixes groups with.
+// We use this interface to test the functions using a mocked service.
+type SGAuditAPI interface {
+	SecurityGroupAPI
+	ec2.DescribeInstancesAPIClient
+	ec2.DescribeNetworkInterfacesAPIClient
+
+	DeleteSecurityGroup(ctx context.Context,
+		params *ec2.DeleteSecurityGroupInput,
+		optFns ...func(*ec2.Options)) (*ec2.DeleteSecurityGroupOutput, error)
+}
+
+// The kinds of sg audit findings.
+const (
+	findingWorldOpen  = "world-open"
+	findingAllTraffic = "all-traffic"
+	findingUnused     = "unused"
+)
+
+// sgFinding is a risky rule, or an unused group, found by sg audit. Rule is
+// nil for unused groups.
+type sgFinding struct {
+	Number   int
+	GroupID  string
+	Kind     string
+	Severity string
+	Detail   string
+	Rule     *sgRule
+}
+
+// ipProtocolNames are the names of the protocol numbers a rule may have been
+// created with, which EC2 returns as given.
+var ipProtocolNames = map[string]string{"6": "tcp", "17": "udp", "1": "icmp"}
+
+// permissionRules splits a permission into one rule per CIDR or group.
+func permissionRules(p types.IpPermission, egress bool) []sgRule {
+	protocol := strings.ToLower(aws.ToString(p.IpProtocol))
+	protocol = firstNonEmpty(ipProtocolNames[protocol], protocol)
+	base := sgRule{Egress: egress, Protocol: protocol, FromPort: -1, ToPort: -1}
+	if base.Protocol != "-1" {
+		base.FromPort, base.ToPort = aws.ToInt32(p.FromPort), aws.ToInt32(p.ToPort)
+	}
+	var rules []sgRule
+	for _, r := range p.IpRanges {
+		rule := base
+		rule.CIDR, rule.Description = aws.ToString(r.CidrIp), aws.ToString(r.Description)
+		rules = append(rules, rule)
+	}
+	for _, r := range p.Ipv6Ranges {
+		rule := base
+		rule.CIDR, rule.Description = aws.ToString(r.CidrIpv6), aws.ToString(r.Description)
+		rules = append(rules, rule)
+	}
+	for _, g := range p.UserIdGroupPairs {
+		rule := base
+		rule.SourceGroup, rule.Description = aws.ToString(g.GroupId), aws.ToString(g.Description)
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// auditRule returns the finding for an ingress rule, or nil when it is not
+// risky. Rules between groups are not flagged: they do not reach outside.
+func auditRule(groupID string, r sgRule) *sgFinding {
+	switch {
+	case r.Egress || r.SourceGroup != "":
+		return nil
+	case r.Protocol == "-1" && r.worldOpen():
+		return &sgFinding{GroupID: groupID, Kind: findingAllTraffic, Severity: "high", Detail: "allows " + r.String(), Rule: &r}
+	case r.Protocol == "-1":
+		return &sgFinding{GroupID: groupID, Kind: findingAllTraffic, Severity: "medium", Detail: "allows " + r.String(), Rule: &r}
+	case r.worldOpen():
+		if exposed := r.exposedServices(); len(exposed) > 0 {
+			return &sgFinding{GroupID: groupID, Kind: findingWorldOpen, Severity: "high", Detail: "opens " + strings.Join(exposed, ", ") + " to " + r.CIDR, Rule: &r}
+		}
+	}
+	return nil
+}
+
+// auditSecurityGroups returns the findings of the groups attached to the
+// instances aws-vmcreate created, and of the groups it manages, which are
+// flagged when no network interface uses them. Findings are numbered from 1
+// so they can be selected for fixing.
+func auditSecurityGroups(c context.Context, api SGAuditAPI, configured []string) ([]sgFinding, error) {
+	attached := map[string]bool{}
+	instances := ec2.NewDescribeInstancesPaginator(api, &ec2.DescribeInstancesInput{Filters: []types.Filter{
+		{Name: aws.String("tag-key"), Values: []string{createdByTag}},
+		{Name: aws.String("instance-state-name"), Values: []string{"pending", "running", "stopping", "stopped"}},
+	}})
+	for instances.HasMorePages() {
+		page, err := instances.NextPage(c)
+		if err != nil {
+			return nil, fmt.Errorf("listing the instances: %w", err)
+		}
+		for _, r := range page.Reservations {
+			for _, i := range r.Instances {
+				for _, g := range i.SecurityGroups {
+					attached[aws.ToString(g.GroupId)] = true
+				}
+			}
+		}
+	}
+
+	groups := map[string]types.SecurityGroup{}
+	managed := map[string]bool{}
+	for _, id := range configured {
+		managed[id] = true
+	}
+	tagged := ec2.NewDescribeSecurityGroupsPaginator(api, &ec2.DescribeSecurityGroupsInput{Filters: []types.Filter{
+		{Name: aws.String("tag-key"), Values: []string{createdByTag}},
+	}})
+	for tagged.HasMorePages() {
+		page, err := tagged.NextPage(c)
+		if err != nil {
+			return nil, fmt.Errorf("listing the security groups: %w", err)
+		}
+		for _, g := range page.SecurityGroups {
+			groups[aws.ToString(g.GroupId)] = g
+			managed[aws.ToString(g.GroupId)] = true
+		}
+	}
+
+	var missing []string
+	for _, ids := range []map[string]bool{attached, managed} {
+		for id := range ids {
+			if _, ok := groups[id]; !ok && !contains(missing, id) {
+				missing = append(missing, id)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		out, err := api.DescribeSecurityGroups(c, &ec2.DescribeSecurityGroupsInput{GroupIds: missing})
+		if err != nil {
+			return nil, fmt.Errorf("describing the security groups: %w", err)
+		}
+		for _, g := range out.SecurityGroups {
+			groups[aws.ToString(g.GroupId)] = g
+		}
+	}
+
+	// Groups may also be used by load balancers, endpoints or instances the
+	// tool did not create, which all have network interfaces.
+	inUse := map[string]bool{}
+	var managedIDs []string
+	for id := range managed {
+		managedIDs = append(managedIDs, id)
+	}
+	if len(managedIDs) > 0 {
+		interfaces := ec2.NewDescribeNetworkInterfacesPaginator(api, &ec2.DescribeNetworkInterfacesInput{Filters: []types.Filter{
+			{Name: aws.String("group-id"), Values: managedIDs},
+		}})
+		for interfaces.HasMorePages() {
+			page, err := interfaces.NextPage(c)
+			if err != nil {
+				return nil, fmt.Errorf("listing the network interfaces: %w", err)
+			}
+			for _, n := range page.NetworkInterfaces {
+				for _, g := range n.Groups {
+					inUse[aws.ToString(g.GroupId)] = true
+				}
+			}
+		}
+	}
+
+	var ids []string
+	for id := range groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var findings []sgFinding
+	for _, id := range ids {
+		g := groups[id]
+		for _, p := range g.IpPermissions {
+			for _, r := range permissionRules(p, false) {
+				if f := auditRule(id, r); f != nil {
+					findings = append(findings, *f)
+				}
+			}
+		}
+		if managed[id] && !inUse[id] && !attached[id] && aws.ToString(g.GroupName) != "default" {
+			findings = append(findings, sgFinding{GroupID: id, Kind: findingUnused, Severity: "low", Detail: "is not used by any network interface"})
+		}
+	}
+	for n := range findings {
+		findings[n].Number = n + 1
+	}
+	return findings, nil
+}
+
+// fixFinding revokes the risky rule, or deletes the unused group.
+func fixFinding(c context.Context, api SGAuditAPI, f sgFinding) error {
+	if f.Rule == nil {
+		_, err := api.DeleteSecurityGroup(c, &ec2.DeleteSecurityGroupInput{GroupId: aws.String(f.GroupID)})
+		return err
+	}
+	// Revoking matches the rule without its description.
+	rule := *f.Rule
+	rule.Description = ""
+	return changeRule(c, api, false, f.GroupID, rule)
+}
+
+// selectFindings returns the findings selected by fix, all or a comma
+// separated list of finding numbers and kinds, e.g. 1,3 or world-open.
+func selectFindings(findings []sgFinding, fix string) ([]sgFinding, error) {
+	if fix == "all" {
+		return findings, nil
+	}
+	chosen := map[int]bool{}
+	for _, s := range strings.Split(fix, ",") {
+		s = strings.TrimSpace(s)
+		if number, err := strconv.Atoi(s); err == nil {
+			if number < 1 || number > len(findings) {
+				return nil, fmt.Errorf("there is no finding %d", number)
+			}
+			chosen[number] = true
+			continue
+		}
+		if s != findingWorldOpen && s != findingAllTraffic && s != findingUnused {
+			return nil, fmt.Errorf("--fix takes all, finding numbers or world-open, all-traffic and unused, not %q", s)
+		}
+		for _, f := range findings {
+			if f.Kind == s {
+				chosen[f.Number] = true
+			}
+		}
+	}
+	var selected []sgFinding
+	for _, f := range findings {
+		if chosen[f.Number] {
+			selected = append(selected, f)
+		}
+	}
+	return selected, nil
+}
+
+func SGAuditCmd(fix *string) {
+	// The config is optional, it only adds the groups it lists as managed.
+	config, err := loadConfig()
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "Got an error loading the config:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+
+	findings, err := auditSecurityGroups(context.TODO(), client, config.SecurityGroupIds)
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error auditing the security groups:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	if len(findings) == 0 {
+		fmt.Println("No risky security group rules found")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tSEVERITY\tGROUP\tFINDING\tDETAIL")
+	for _, f := range findings {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", f.Number, f.Severity, f.GroupID, f.Kind, f.Detail)
+	}
+	w.Flush()
+
+	if *fix == "" {
+		fmt.Printf("%d findings, fix them with --fix all, --fix 1,2 or --fix world-open\n", len(findings))
+		return
+	}
+	selected, err := selectFindings(findings, *fix)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+	for _, f := range selected {
+		if err := fixFinding(context.TODO(), client, f); err != nil {
+			commandErr = err
+			fmt.Fprintf(os.Stderr, "Got an error fixing finding %d:\n", f.Number)
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		if f.Rule == nil {
+			fmt.Println("Deleted security group " + f.GroupID)
+		} else {
+			fmt.Println("Revoked " + f.Rule.String() + " on " + f.GroupID)
+		}
+	}
+}
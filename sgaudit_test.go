@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"aws-vmcreate/pkg/vmcreate/vmcreatetest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeSGAudit adds the network interfaces using the groups, and deleting
+// groups, to fakeSecurityGroups.
+type fakeSGAudit struct {
+	*fakeSecurityGroups
+	interfaces []types.NetworkInterface
+}
+
+func (f *fakeSGAudit) DescribeNetworkInterfaces(ctx context.Context, params *ec2.DescribeNetworkInterfacesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeNetworkInterfacesOutput, error) {
+	return &ec2.DescribeNetworkInterfacesOutput{NetworkInterfaces: f.interfaces}, nil
+}
+
+func (f *fakeSGAudit) DeleteSecurityGroup(ctx context.Context, params *ec2.DeleteSecurityGroupInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSecurityGroupOutput, error) {
+	f.changes = append(f.changes, "delete "+aws.ToString(params.GroupId))
+	return &ec2.DeleteSecurityGroupOutput{}, nil
+}
+
+func worldRule(protocol string, port int32) types.IpPermission {
+	p := types.IpPermission{IpProtocol: aws.String(protocol), IpRanges: []types.IpRange{{CidrIp: aws.String("0.0.0.0/0")}}}
+	if protocol != "-1" {
+		p.FromPort, p.ToPort = aws.Int32(port), aws.Int32(port)
+	}
+	return p
+}
+
+func TestSGAudit(t *testing.T) {
+	provenance := []types.Tag{{Key: aws.String(createdByTag), Value: aws.String("alice")}}
+	fake := &fakeSGAudit{fakeSecurityGroups: &fakeSecurityGroups{FakeEC2: vmcreatetest.NewFakeEC2(), groups: []types.SecurityGroup{
+		{GroupId: aws.String("sg-web"), IpPermissions: []types.IpPermission{worldRule("tcp", 443), worldRule("tcp", 22)}},
+		{GroupId: aws.String("sg-open"), Tags: provenance, IpPermissions: []types.IpPermission{worldRule("-1", 0)}},
+		{GroupId: aws.String("sg-stale"), Tags: provenance},
+	}}}
+	fake.AddInstance(types.Instance{
+		Tags:           provenance,
+		SecurityGroups: []types.GroupIdentifier{{GroupId: aws.String("sg-web")}},
+	})
+	fake.interfaces = []types.NetworkInterface{{Groups: []types.GroupIdentifier{{GroupId: aws.String("sg-open")}}}}
+
+	c := context.Background()
+	findings, err := auditSecurityGroups(c, fake, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range findings {
+		got = append(got, f.GroupID+" "+f.Kind+" "+f.Detail)
+	}
+	want := []string{
+		"sg-open all-traffic allows all traffic ingress from 0.0.0.0/0",
+		"sg-stale unused is not used by any network interface",
+		"sg-web world-open opens SSH (22) to 0.0.0.0/0",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("findings:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	selected, err := selectFindings(findings, "3,unused")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range selected {
+		if err := fixFinding(c, fake, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := strings.Join(fake.changes, ", "); got != "delete sg-stale, revoke-ingress sg-web tcp 0.0.0.0/0" {
+		t.Errorf("fixes = %s", got)
+	}
+	if _, err := selectFindings(findings, "4"); err == nil {
+		t.Error("expected an error for a finding that does not exist")
+	}
+}
+
+func TestAuditRuleForms(t *testing.T) {
+	ipv6 := func(p types.IpPermission, cidr string) types.IpPermission {
+		p.IpRanges, p.Ipv6Ranges = nil, []types.Ipv6Range{{CidrIpv6: aws.String(cidr)}}
+		return p
+	}
+	for _, test := range []struct {
+		permission types.IpPermission
+		want       string
+	}{
+		{ipv6(worldRule("-1", 0), "::/0"), "all-traffic high"},
+		{ipv6(worldRule("-1", 0), "0::/0"), "all-traffic high"},
+		{ipv6(worldRule("tcp", 22), "::0/0"), "world-open high"},
+		{worldRule("udp", 3389), "world-open high"},
+		{worldRule("17", 3389), "world-open high"},
+		{worldRule("6", 5432), "world-open high"},
+		{ipv6(worldRule("tcp", 22), "2001:db8::/32"), ""},
+		{worldRule("udp", 53), ""},
+	} {
+		rules := permissionRules(test.permission, false)
+		var got string
+		if f := auditRule("sg-1", rules[0]); f != nil {
+			got = f.Kind + " " + f.Severity
+		}
+		if got != test.want {
+			t.Errorf("%s: finding %q, want %q", rules[0], got, test.want)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// SGSync keeps the security groups of the instances of one tag group open
+// to the instances of another, by their private IPs or their security
+// groups, as they come and go. sg sync runs it once, and the daemon on
+// every reconcile.
+type SGSync struct {
+	// Tag is the instances whose security groups get the rules, as
+	// KEY=VALUE[,VALUE].
+	Tag string `json:"tag"`
+	// AllowFrom is the instances allowed in and the port or range they
+	// reach, as tag:KEY=VALUE[,VALUE]:PORT.
+	AllowFrom string `json:"allow_from"`
+	// Protocol is tcp or udp, tcp by default.
+	Protocol string `json:"protocol,omitempty"`
+	// By is ip for a rule for the private IP of each instance, the default,
+	// or sg for a rule for each of their security groups.
+	By string `json:"by,omitempty"`
+}
+
+// sgSyncPlan is an SGSync parsed.
+type sgSyncPlan struct {
+	TargetKey    string
+	TargetValues []string
+	SourceKey    string
+	SourceValues []string
+	// Rule is the rule without its peer, which each one fills in.
+	Rule sgRule
+	BySG bool
+}
+
+// parse checks the sync and splits its tags and port.
+func (s SGSync) parse() (sgSyncPlan, error) {
+	var plan sgSyncPlan
+	key, value, ok := strings.Cut(s.Tag, "=")
+	if !ok || key == "" || value == "" {
+		return plan, fmt.Errorf("the instances to sync are --tag KEY=VALUE, not %q", s.Tag)
+	}
+	plan.TargetKey, plan.TargetValues = key, strings.Split(value, ",")
+
+	ok = strings.HasPrefix(s.AllowFrom, "tag:")
+	spec := strings.TrimPrefix(s.AllowFrom, "tag:")
+	at := strings.LastIndex(spec, ":")
+	if ok && at > 0 {
+		key, value, ok = strings.Cut(spec[:at], "=")
+	}
+	if !ok || at <= 0 || key == "" || value == "" {
+		return plan, fmt.Errorf("--allow-from is tag:KEY=VALUE:PORT, e.g. tag:app=lb:8080, not %q", s.AllowFrom)
+	}
+	plan.SourceKey, plan.SourceValues = key, strings.Split(value, ",")
+
+	protocol := firstNonEmpty(s.Protocol, "tcp")
+	if protocol != "tcp" && protocol != "udp" {
+		return plan, fmt.Errorf("synced rules are tcp or udp, not %s", protocol)
+	}
+	// The peer is only a placeholder for the rule to parse.
+	rule, err := parseSGRule(protocol, spec[at+1:], "0.0.0.0/32", "", "aws-vmcreate sync "+s.AllowFrom, false)
+	if err != nil {
+		return plan, err
+	}
+	rule.CIDR = ""
+	plan.Rule = rule
+
+	switch s.By {
+	case "", "ip":
+	case "sg":
+		plan.BySG = true
+	default:
+		return plan, fmt.Errorf("synced rules are by ip or sg, not %s", s.By)
+	}
+	return plan, nil
+}
+
+// peers returns the private IPs, as /32 CIDRs, or the security groups of
+// the instances.
+func (p sgSyncPlan) peers(instances []types.Instance) map[string]bool {
+	peers := map[string]bool{}
+	for _, i := range instances {
+		if p.BySG {
+			for _, g := range i.SecurityGroups {
+				peers[aws.ToString(g.GroupId)] = true
+			}
+		} else if ip := aws.ToString(i.PrivateIpAddress); ip != "" {
+			peers[ip+"/32"] = true
+		}
+	}
+	return peers
+}
+
+// rule returns the rule for the peer.
+func (p sgSyncPlan) rule(peer string) sgRule {
+	r := p.Rule
+	if p.BySG {
+		r.SourceGroup = peer
+	} else {
+		r.CIDR = peer
+	}
+	return r
+}
+
+// existingPeers returns the peers the group's ingress rules on the port
+// already allow, and which of them the sync added, by their description.
+func (p sgSyncPlan) existingPeers(group *types.SecurityGroup) (allowed map[string]bool, synced map[string]bool) {
+	allowed, synced = map[string]bool{}, map[string]bool{}
+	for _, perm := range group.IpPermissions {
+		if aws.ToString(perm.IpProtocol) != p.Rule.Protocol || aws.ToInt32(perm.FromPort) != p.Rule.FromPort || aws.ToInt32(perm.ToPort) != p.Rule.ToPort {
+			continue
+		}
+		add := func(peer string, description *string) {
+			allowed[peer] = true
+			if aws.ToString(description) == p.Rule.Description {
+				synced[peer] = true
+			}
+		}
+		if p.BySG {
+			for _, pair := range perm.UserIdGroupPairs {
+				add(aws.ToString(pair.GroupId), pair.Description)
+			}
+		} else {
+			for _, r := range perm.IpRanges {
+				add(aws.ToString(r.CidrIp), r.Description)
+			}
+		}
+	}
+	return allowed, synced
+}
+
+// syncSecurityGroups authorizes the rules the instances of the sync's
+// source need on the security groups of its targets, and revokes those it
+// added for instances that are gone. Rules made by hand are left alone.
+// It returns the changes, which a dry run only reports.
+func syncSecurityGroups(c context.Context, api SecurityGroupAPI, s SGSync, configured []string, dryRun bool) ([]string, error) {
+	plan, err := s.parse()
+	if err != nil {
+		return nil, err
+	}
+	targets, err := provisioner.List(c, vmcreate.TagFilter(plan.TargetKey, plan.TargetValues...), vmcreate.StateFilter(vmcreate.LiveStates...))
+	if err != nil {
+		return nil, fmt.Errorf("listing the instances of %s: %w", s.Tag, err)
+	}
+	sources, err := provisioner.List(c, vmcreate.TagFilter(plan.SourceKey, plan.SourceValues...), vmcreate.StateFilter(vmcreate.LiveStates...))
+	if err != nil {
+		return nil, fmt.Errorf("listing the instances of %s: %w", s.AllowFrom, err)
+	}
+	want := plan.peers(sources)
+
+	groupIDs := map[string]bool{}
+	for _, i := range targets {
+		for _, g := range i.SecurityGroups {
+			groupIDs[aws.ToString(g.GroupId)] = true
+		}
+	}
+	var sorted []string
+	for id := range groupIDs {
+		sorted = append(sorted, id)
+	}
+	sort.Strings(sorted)
+
+	authorized, revoked := "Authorized ", "Revoked "
+	if dryRun {
+		authorized, revoked = "Would authorize ", "Would revoke "
+	}
+	var changes []string
+	for _, groupID := range sorted {
+		group, err := managedGroup(c, api, groupID, configured)
+		if err != nil {
+			return changes, err
+		}
+		allowed, synced := plan.existingPeers(group)
+		var authorize, revoke []string
+		for peer := range want {
+			if !allowed[peer] {
+				authorize = append(authorize, peer)
+			}
+		}
+		for peer := range synced {
+			if !want[peer] {
+				revoke = append(revoke, peer)
+			}
+		}
+		sort.Strings(authorize)
+		sort.Strings(revoke)
+		for _, peer := range authorize {
+			r := plan.rule(peer)
+			if !dryRun {
+				if err := changeRule(c, api, true, groupID, r); err != nil {
+					return changes, fmt.Errorf("authorizing %s on %s: %w", r, groupID, err)
+				}
+			}
+			changes = append(changes, authorized+r.String()+" on "+groupID)
+		}
+		for _, peer := range revoke {
+			r := plan.rule(peer)
+			if !dryRun {
+				if err := changeRule(c, api, false, groupID, r); err != nil {
+					return changes, fmt.Errorf("revoking %s on %s: %w", r, groupID, err)
+				}
+			}
+			changes = append(changes, revoked+r.String()+" on "+groupID)
+		}
+	}
+	return changes, nil
+}
+
+func SGSyncCmd(s SGSync, dryRun *bool) {
+	// The config is optional, it only adds the groups it lists as managed.
+	config, err := loadConfig()
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "Got an error loading the config:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+
+	changes, err := syncSecurityGroups(context.TODO(), client, s, config.SecurityGroupIds, *dryRun)
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error syncing the security groups:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	if len(changes) == 0 {
+		progressln("The security groups of " + s.Tag + " are in sync with " + s.AllowFrom)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func withGroups(i types.Instance, groupIDs ...string) types.Instance {
+	for _, id := range groupIDs {
+		i.SecurityGroups = append(i.SecurityGroups, types.GroupIdentifier{GroupId: aws.String(id)})
+	}
+	return i
+}
+
+func TestSGSyncByIP(t *testing.T) {
+	fake := useFakeEC2(t)
+	c := context.Background()
+	sync := SGSync{Tag: "app=web", AllowFrom: "tag:app=lb:8080"}
+	description := aws.String("aws-vmcreate sync tag:app=lb:8080")
+	groups := &fakeSecurityGroups{FakeEC2: fake, groups: []types.SecurityGroup{{
+		GroupId: aws.String("sg-web"),
+		Tags:    []types.Tag{{Key: aws.String(createdByTag), Value: aws.String("alice")}},
+		IpPermissions: []types.IpPermission{{
+			IpProtocol: aws.String("tcp"), FromPort: aws.Int32(8080), ToPort: aws.Int32(8080),
+			IpRanges: []types.IpRange{
+				// A rule made by hand, and one synced for an instance since gone.
+				{CidrIp: aws.String("10.9.9.9/32")},
+				{CidrIp: aws.String("10.0.0.99/32"), Description: description},
+			},
+		}},
+	}}}
+	fake.AddInstance(withGroups(tagged("app", "web"), "sg-web"))
+	fake.AddInstance(withGroups(tagged("app", "web"), "sg-web"))
+	lb := tagged("app", "lb")
+	lb.PrivateIpAddress = aws.String("10.0.0.5")
+	first := fake.AddInstance(lb)
+	lb.PrivateIpAddress = aws.String("10.9.9.9")
+	fake.AddInstance(lb)
+
+	changes, err := syncSecurityGroups(c, groups, sync, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Authorized tcp port 8080 ingress from 10.0.0.5/32 on sg-web, Revoked tcp port 8080 ingress from 10.0.0.99/32 on sg-web"
+	if got := strings.Join(changes, ", "); got != want {
+		t.Errorf("changes = %s", got)
+	}
+	if changes, _ := syncSecurityGroups(c, groups, sync, nil, false); len(changes) != 0 {
+		t.Errorf("a second sync changed %v", changes)
+	}
+
+	// The rules follow the instances as they come and go.
+	lb.PrivateIpAddress = aws.String("10.0.0.6")
+	fake.AddInstance(lb)
+	if _, err := provisioner.Delete(c, []string{first}); err != nil {
+		t.Fatal(err)
+	}
+	changes, err = syncSecurityGroups(c, groups, sync, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "Would authorize tcp port 8080 ingress from 10.0.0.6/32 on sg-web, Would revoke tcp port 8080 ingress from 10.0.0.5/32 on sg-web"
+	if got := strings.Join(changes, ", "); got != want {
+		t.Errorf("dry run changes = %s", got)
+	}
+	if n := len(groups.changes); n != 2 {
+		t.Errorf("the dry run changed the rules: %v", groups.changes)
+	}
+}
+
+func TestSGSyncBySG(t *testing.T) {
+	fake := useFakeEC2(t)
+	groups := &fakeSecurityGroups{FakeEC2: fake, groups: []types.SecurityGroup{{GroupId: aws.String("sg-web")}, {GroupId: aws.String("sg-other")}}}
+	fake.AddInstance(withGroups(tagged("app", "web"), "sg-web"))
+	fake.AddInstance(withGroups(tagged("app", "lb"), "sg-lb"))
+
+	sync := SGSync{Tag: "app=web", AllowFrom: "tag:app=lb:8000-8100", By: "sg"}
+	changes, err := syncSecurityGroups(context.Background(), groups, sync, []string{"sg-web"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(changes, ", "); got != "Authorized tcp ports 8000-8100 ingress from sg-lb on sg-web" {
+		t.Errorf("changes = %s", got)
+	}
+
+	// Only the groups aws-vmcreate manages are changed.
+	fake.AddInstance(withGroups(tagged("app", "web"), "sg-other"))
+	if _, err := syncSecurityGroups(context.Background(), groups, sync, []string{"sg-web"}, false); err == nil || !strings.Contains(err.Error(), "sg-other is not managed") {
+		t.Errorf("err = %v, want sg-other refused", err)
+	}
+}
+
+func TestSGSyncParse(t *testing.T) {
+	for _, bad := range []SGSync{
+		{Tag: "app", AllowFrom: "tag:app=lb:8080"},
+		{Tag: "app=web", AllowFrom: "app=lb:8080"},
+		{Tag: "app=web", AllowFrom: "tag:app=lb"},
+		{Tag: "app=web", AllowFrom: "tag:app=lb:http"},
+		{Tag: "app=web", AllowFrom: "tag:app=lb:8080", Protocol: "icmp"},
+		{Tag: "app=web", AllowFrom: "tag:app=lb:8080", By: "name"},
+	} {
+		if _, err := bad.parse(); err == nil {
+			t.Errorf("%+v was accepted", bad)
+		}
+	}
+	plan, err := SGSync{Tag: "app=web,api", AllowFrom: "tag:team=edge:443", Protocol: "udp"}.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.SourceKey != "team" || len(plan.TargetValues) != 2 || plan.Rule.Protocol != "udp" || plan.Rule.FromPort != 443 {
+		t.Errorf("plan = %+v", plan)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/ssocreds"
+	"github.com/aws/aws-sdk-go-v2/service/ssooidc"
+	ssooidctypes "github.com/aws/aws-sdk-go-v2/service/ssooidc/types"
+)
+
+// SSOOIDCAPI defines the interface for the IAM Identity Center OIDC functions.
+// We use this interface to test the functions using a mocked service.
+type SSOOIDCAPI interface {
+	RegisterClient(ctx context.Context,
+		params *ssooidc.RegisterClientInput,
+		optFns ...func(*ssooidc.Options)) (*ssooidc.RegisterClientOutput, error)
+
+	StartDeviceAuthorization(ctx context.Context,
+		params *ssooidc.StartDeviceAuthorizationInput,
+		optFns ...func(*ssooidc.Options)) (*ssooidc.StartDeviceAuthorizationOutput, error)
+
+	CreateToken(ctx context.Context,
+		params *ssooidc.CreateTokenInput,
+		optFns ...func(*ssooidc.Options)) (*ssooidc.CreateTokenOutput, error)
+}
+
+// ssoSettings are the IAM Identity Center settings of a profile.
+type ssoSettings struct {
+	Profile  string
+	StartURL string
+	Region   string
+	// CacheKey names the token cache file, as the AWS CLI derives it: the
+	// sso-session name, or the start URL for legacy profiles.
+	CacheKey string
+	Session  bool
+}
+
+// ssoCachedToken is the token cache file written by `aws sso login`.
+type ssoCachedToken struct {
+	StartURL              string `json:"startUrl"`
+	Region                string `json:"region"`
+	AccessToken           string `json:"accessToken"`
+	ExpiresAt             string `json:"expiresAt"`
+	ClientID              string `json:"clientId,omitempty"`
+	ClientSecret          string `json:"clientSecret,omitempty"`
+	RegistrationExpiresAt string `json:"registrationExpiresAt,omitempty"`
+	RefreshToken          string `json:"refreshToken,omitempty"`
+}
+
+// profileName returns the shared config profile in use.
+func profileName() string {
+	if profile := os.Getenv("AWS_PROFILE"); profile != "" {
+		return profile
+	}
+	return config.DefaultSharedConfigProfile
+}
+
+// loadSharedProfile returns the shared config of the profile, or nil when
+// there is no such profile.
+func loadSharedProfile(c context.Context, profile string) (*config.SharedConfig, error) {
+	// Unlike LoadDefaultConfig, LoadSharedConfigProfile ignores the
+	// environment variables that move the files.
+	shared, err := config.LoadSharedConfigProfile(c, profile, func(o *config.LoadSharedConfigOptions) {
+		if path := os.Getenv("AWS_CONFIG_FILE"); path != "" {
+			o.ConfigFiles = []string{path}
+		}
+		if path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE"); path != "" {
+			o.CredentialsFiles = []string{path}
+		}
+	})
+	if err != nil {
+		var notExist config.SharedConfigProfileNotExistError
+		if errors.As(err, &notExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &shared, nil
+}
+
+// loadSSOSettings returns the SSO settings of the profile, or nil when the
+// profile does not use IAM Identity Center.
+func loadSSOSettings(c context.Context, profile string) (*ssoSettings, error) {
+	shared, err := loadSharedProfile(c, profile)
+	if err != nil || shared == nil {
+		return nil, err
+	}
+
+	switch {
+	case shared.SSOSession != nil:
+		return &ssoSettings{
+			Profile:  profile,
+			StartURL: shared.SSOSession.SSOStartURL,
+			Region:   shared.SSOSession.SSORegion,
+			CacheKey: shared.SSOSession.Name,
+			Session:  true,
+		}, nil
+	case shared.SSOStartURL != "":
+		return &ssoSettings{
+			Profile:  profile,
+			StartURL: shared.SSOStartURL,
+			Region:   shared.SSORegion,
+			CacheKey: shared.SSOStartURL,
+		}, nil
+	}
+	return nil, nil
+}
+
+// ssoTokenValid reports whether the cached token of the settings exists and
+// has not expired. A token that can be refreshed counts as valid, the SDK
+// refreshes it.
+func ssoTokenValid(settings *ssoSettings, now time.Time) bool {
+	path, err := ssocreds.StandardCachedTokenFilepath(settings.CacheKey)
+	if err != nil {
+		return false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+
+	var token ssoCachedToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return false
+	}
+	if token.RefreshToken != "" {
+		return true
+	}
+	expires, err := time.Parse(time.RFC3339, token.ExpiresAt)
+	return err == nil && token.AccessToken != "" && now.Before(expires)
+}
+
+// ssoLogin runs the device authorization flow, printing the URL and code the
+// user confirms in a browser, and caches the token where the SDK and the AWS
+// CLI look for it.
+func ssoLogin(c context.Context, api SSOOIDCAPI, settings *ssoSettings) (time.Time, error) {
+	registerInput := &ssooidc.RegisterClientInput{
+		ClientName: aws.String("aws-vmcreate"),
+		ClientType: aws.String("public"),
+	}
+	if settings.Session {
+		// The scope makes Identity Center issue a refresh token.
+		registerInput.Scopes = []string{"sso:account:access"}
+	}
+	registration, err := api.RegisterClient(c, registerInput)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("registering the client: %w", err)
+	}
+
+	authorization, err := api.StartDeviceAuthorization(c, &ssooidc.StartDeviceAuthorizationInput{
+		ClientId:     registration.ClientId,
+		ClientSecret: registration.ClientSecret,
+		StartUrl:     aws.String(settings.StartURL),
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("starting the device authorization: %w", err)
+	}
+
+	fmt.Fprintln(os.Stderr, "To sign in, open "+aws.ToString(authorization.VerificationUriComplete))
+	fmt.Fprintln(os.Stderr, "and confirm the code "+aws.ToString(authorization.UserCode))
+
+	interval := time.Duration(authorization.Interval) * time.Second
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(authorization.ExpiresIn) * time.Second)
+
+	for {
+		token, err := api.CreateToken(c, &ssooidc.CreateTokenInput{
+			ClientId:     registration.ClientId,
+			ClientSecret: registration.ClientSecret,
+			DeviceCode:   authorization.DeviceCode,
+			GrantType:    aws.String("urn:ietf:params:oauth:grant-type:device_code"),
+		})
+
+		var pending *ssooidctypes.AuthorizationPendingException
+		var slowDown *ssooidctypes.SlowDownException
+		switch {
+		case err == nil:
+			expires := time.Now().Add(time.Duration(token.ExpiresIn) * time.Second).UTC()
+			cached := ssoCachedToken{
+				StartURL:              settings.StartURL,
+				Region:                settings.Region,
+				AccessToken:           aws.ToString(token.AccessToken),
+				ExpiresAt:             expires.Format(time.RFC3339),
+				ClientID:              aws.ToString(registration.ClientId),
+				ClientSecret:          aws.ToString(registration.ClientSecret),
+				RegistrationExpiresAt: time.Unix(registration.ClientSecretExpiresAt, 0).UTC().Format(time.RFC3339),
+				RefreshToken:          aws.ToString(token.RefreshToken),
+			}
+			return expires, writeSSOToken(settings, cached)
+		case errors.As(err, &slowDown):
+			interval += 5 * time.Second
+		case !errors.As(err, &pending):
+			return time.Time{}, fmt.Errorf("creating the token: %w", err)
+		}
+
+		if time.Now().Add(interval).After(deadline) {
+			return time.Time{}, errors.New("the sign-in was not confirmed in time")
+		}
+		select {
+		case <-c.Done():
+			return time.Time{}, c.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// writeSSOToken stores the token in the AWS CLI token cache.
+func writeSSOToken(settings *ssoSettings, token ssoCachedToken) error {
+	path, err := ssocreds.StandardCachedTokenFilepath(settings.CacheKey)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(token, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// newSSOOIDCClient returns an OIDC client for the region of the settings. The
+// operations are unauthenticated.
+func newSSOOIDCClient(settings *ssoSettings) *ssooidc.Client {
+	cfg := awsConfig.Copy()
+	cfg.Region = settings.Region
+	cfg.Credentials = aws.AnonymousCredentials{}
+	return ssooidc.NewFromConfig(cfg)
+}
+
+// ensureSSOSession offers an inline login when the profile uses IAM Identity
+// Center and its session has expired, instead of letting the first API call
+// fail with a credentials error. Without a terminal it only explains what to
+// run.
+func ensureSSOSession(c context.Context) error {
+	settings, err := loadSSOSettings(c, profileName())
+	if err != nil || settings == nil || ssoTokenValid(settings, time.Now()) {
+		return err
+	}
+
+	if !stdinIsTerminal() {
+		return fmt.Errorf("the AWS SSO session of profile %s has expired, run aws-vmcreate login", settings.Profile)
+	}
+
+	fmt.Fprint(os.Stderr, "The AWS SSO session of profile "+settings.Profile+" has expired. Log in now? [Y/n] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "" && answer != "y" && answer != "yes" {
+		return fmt.Errorf("the AWS SSO session of profile %s has expired", settings.Profile)
+	}
+	_, err = ssoLogin(c, newSSOOIDCClient(settings), settings)
+	return err
+}
+
+// stdinIsTerminal reports whether the user can be prompted.
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func LoginCmd() {
+	settings, err := loadSSOSettings(context.TODO(), profileName())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error reading the profile:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+	if settings == nil {
+		failCommand("The profile " + profileName() + " does not use AWS IAM Identity Center (sso_start_url or sso_session)")
+		return
+	}
+
+	expires, err := ssoLogin(context.TODO(), newSSOOIDCClient(settings), settings)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error logging in:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+	fmt.Println("Logged in to " + settings.StartURL + ", the session expires at " + expires.Local().Format(time.RFC1123))
+}
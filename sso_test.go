@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssooidc"
+	ssooidctypes "github.com/aws/aws-sdk-go-v2/service/ssooidc/types"
+)
+
+type fakeSSOOIDC struct {
+	pending int
+	scopes  []string
+}
+
+func (f *fakeSSOOIDC) RegisterClient(ctx context.Context, params *ssooidc.RegisterClientInput, optFns ...func(*ssooidc.Options)) (*ssooidc.RegisterClientOutput, error) {
+	f.scopes = params.Scopes
+	return &ssooidc.RegisterClientOutput{
+		ClientId:              aws.String("client"),
+		ClientSecret:          aws.String("secret"),
+		ClientSecretExpiresAt: time.Now().Add(90 * 24 * time.Hour).Unix(),
+	}, nil
+}
+
+func (f *fakeSSOOIDC) StartDeviceAuthorization(ctx context.Context, params *ssooidc.StartDeviceAuthorizationInput, optFns ...func(*ssooidc.Options)) (*ssooidc.StartDeviceAuthorizationOutput, error) {
+	return &ssooidc.StartDeviceAuthorizationOutput{
+		DeviceCode:              aws.String("device"),
+		UserCode:                aws.String("ABCD-EFGH"),
+		VerificationUriComplete: aws.String("https://device.sso.us-east-1.amazonaws.com/?user_code=ABCD-EFGH"),
+		Interval:                1,
+		ExpiresIn:               60,
+	}, nil
+}
+
+func (f *fakeSSOOIDC) CreateToken(ctx context.Context, params *ssooidc.CreateTokenInput, optFns ...func(*ssooidc.Options)) (*ssooidc.CreateTokenOutput, error) {
+	if f.pending > 0 {
+		f.pending--
+		return nil, &ssooidctypes.AuthorizationPendingException{}
+	}
+	return &ssooidc.CreateTokenOutput{AccessToken: aws.String("token"), ExpiresIn: 3600}, nil
+}
+
+func TestSSOLoginCachesToken(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	settings := &ssoSettings{Profile: "dev", StartURL: "https://example.awsapps.com/start", Region: "us-east-1", CacheKey: "dev-session", Session: true}
+
+	if ssoTokenValid(settings, time.Now()) {
+		t.Fatal("token valid before login")
+	}
+
+	api := &fakeSSOOIDC{pending: 1}
+	expires, err := ssoLogin(context.Background(), api, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(api.scopes) != 1 {
+		t.Errorf("sso-session registration scopes = %v", api.scopes)
+	}
+	if !ssoTokenValid(settings, time.Now()) {
+		t.Error("token not valid after login")
+	}
+	if ssoTokenValid(settings, expires.Add(time.Minute)) {
+		t.Error("token still valid after it expired")
+	}
+}
+
+func TestLoadSSOSettings(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config")
+	err := os.WriteFile(path, []byte(`[profile dev]
+sso_session = corp
+sso_account_id = 111122223333
+sso_role_name = Admin
+
+[sso-session corp]
+sso_start_url = https://corp.awsapps.com/start
+sso_region = eu-west-1
+
+[profile keys]
+region = us-east-1
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_CONFIG_FILE", path)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+
+	settings, err := loadSSOSettings(context.Background(), "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings == nil || settings.CacheKey != "corp" || settings.Region != "eu-west-1" || settings.StartURL != "https://corp.awsapps.com/start" {
+		t.Errorf("settings = %+v", settings)
+	}
+
+	for _, profile := range []string{"keys", "missing"} {
+		if settings, err := loadSSOSettings(context.Background(), profile); err != nil || settings != nil {
+			t.Errorf("profile %s: %+v, %v", profile, settings, err)
+		}
+	}
+}
@@ -0,0 +1,655 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// lifecyclePhase is where a managed instance is in its lifecycle.
+type lifecyclePhase string
+
+const (
+	phaseRequested     lifecyclePhase = "requested"
+	phaseLaunching     lifecyclePhase = "launching"
+	phaseBootstrapping lifecyclePhase = "bootstrapping"
+	phaseReady         lifecyclePhase = "ready"
+	phaseDraining      lifecyclePhase = "draining"
+	phaseWarm          lifecyclePhase = "warm"
+	phaseTerminated    lifecyclePhase = "terminated"
+)
+
+// lifecycleTransitions are the phases each phase may move to. Any phase
+// may be terminated, and an instance the state does not know yet, such as
+// one launched before the state was kept, may start in any phase.
+var lifecycleTransitions = map[lifecyclePhase][]lifecyclePhase{
+	phaseRequested:     {phaseLaunching},
+	phaseLaunching:     {phaseBootstrapping, phaseReady, phaseDraining},
+	phaseBootstrapping: {phaseReady, phaseDraining},
+	phaseReady:         {phaseDraining, phaseWarm},
+	// A drain that is given up on puts the instance back in service.
+	phaseDraining: {phaseReady},
+	// A warm instance is one standby stopped, kept to be activated or
+	// booted again by create --from-warm-pool to go through its steps.
+	phaseWarm: {phaseReady, phaseLaunching},
+}
+
+// Transition is one move of an instance between phases.
+type Transition struct {
+	From    lifecyclePhase `json:"from,omitempty"`
+	To      lifecyclePhase `json:"to"`
+	Time    time.Time      `json:"time"`
+	Command string         `json:"command,omitempty"`
+	Reason  string         `json:"reason,omitempty"`
+}
+
+// ManagedInstance is the lifecycle of an instance the tool manages.
+type ManagedInstance struct {
+	InstanceID  string         `json:"instance_id"`
+	Name        string         `json:"name,omitempty"`
+	Region      string         `json:"region,omitempty"`
+	Phase       lifecyclePhase `json:"phase"`
+	Transitions []Transition   `json:"transitions"`
+}
+
+// transition moves the instance to phase, unless the move is not allowed.
+func (m *ManagedInstance) transition(to lifecyclePhase, at time.Time, command string, reason string) error {
+	if m.Phase != "" && m.Phase != to {
+		allowed := to == phaseTerminated && m.Phase != phaseTerminated
+		for _, p := range lifecycleTransitions[m.Phase] {
+			allowed = allowed || p == to
+		}
+		if !allowed {
+			return fmt.Errorf("instance %s cannot move from %s to %s", m.InstanceID, m.Phase, to)
+		}
+	}
+	if m.Phase == to {
+		return nil
+	}
+	m.Transitions = append(m.Transitions, Transition{From: m.Phase, To: to, Time: at.UTC(), Command: command, Reason: reason})
+	m.Phase = to
+	return nil
+}
+
+// State is what the state store keeps: the managed instances, by ID.
+type State struct {
+	// Serial is incremented by every save, so that a writer can tell
+	// another one saved since it loaded the state.
+	Serial    int64                       `json:"serial"`
+	Instances map[string]*ManagedInstance `json:"instances"`
+	// Runs are the creates in progress, or interrupted, by run ID.
+	Runs map[string]*CreateRun `json:"runs,omitempty"`
+	// Groups are the groups made with group create, by name.
+	Groups map[string]string `json:"groups,omitempty"`
+
+	// etag is the ETag of the S3 object the state was loaded from, which
+	// its save must still match, and version the S3 version it saved.
+	etag    string
+	version string
+}
+
+// errStateConflict is returned by a save when the state was saved by
+// another writer since it was loaded.
+var errStateConflict = errors.New("the state was changed by another writer")
+
+// StateStore keeps the state.
+type StateStore interface {
+	// Load returns the state, empty when none was saved yet.
+	Load(c context.Context) (*State, error)
+	// Save writes the state and increments its serial, failing with
+	// errStateConflict when the stored serial is no longer the one that
+	// was loaded.
+	Save(c context.Context, state *State) error
+}
+
+// fileStateStore keeps the state in a local file, by default
+// defaultStatePath.
+type fileStateStore struct {
+	path string
+}
+
+// defaultStatePath is the local state, ~/.aws/aws-vmcreate/state.json.
+func defaultStatePath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join("aws-vmcreate", "state.json")
+	}
+	return filepath.Join(home, ".aws", "aws-vmcreate", "state.json")
+}
+
+// file returns the path of the state, which is resolved when it is used so
+// that it follows HOME.
+func (s *fileStateStore) file() string {
+	return firstNonEmpty(s.path, defaultStatePath())
+}
+
+func (s *fileStateStore) Load(c context.Context) (*State, error) {
+	state := &State{Instances: map[string]*ManagedInstance{}}
+	data, err := os.ReadFile(s.file())
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.file(), err)
+	}
+	if state.Instances == nil {
+		state.Instances = map[string]*ManagedInstance{}
+	}
+	return state, nil
+}
+
+func (s *fileStateStore) Save(c context.Context, state *State) error {
+	stored, err := s.Load(c)
+	if err != nil {
+		return err
+	}
+	if stored.Serial != state.Serial {
+		return errStateConflict
+	}
+	saved := *state
+	saved.Serial++
+	data, err := json.MarshalIndent(&saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := s.file()
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return err
+	}
+	// The file is replaced whole, so that a reader never sees half of it.
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return err
+	}
+	state.Serial = saved.Serial
+	return nil
+}
+
+// DynamoDBStateAPI defines the interface for the DynamoDB functions of the state store.
+// We use this interface to test the functions using a mocked service.
+type DynamoDBStateAPI interface {
+	GetItem(ctx context.Context, params *awsapi.GetItemInput) (*awsapi.GetItemOutput, error)
+	PutItem(ctx context.Context, params *awsapi.PutItemInput) error
+}
+
+// dynamoDBStateStore keeps the state as an item of a table whose partition
+// key is the string StateKey, so that operators and CI runners share it. A
+// save is a PutItem conditional on the serial that was loaded.
+type dynamoDBStateStore struct {
+	api   DynamoDBStateAPI
+	table string
+	key   string
+}
+
+func (s *dynamoDBStateStore) Load(c context.Context) (*State, error) {
+	out, err := s.api.GetItem(c, &awsapi.GetItemInput{
+		TableName:      s.table,
+		Key:            map[string]awsapi.AttributeValue{"StateKey": {S: s.key}},
+		ConsistentRead: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	state := &State{Instances: map[string]*ManagedInstance{}}
+	if out.Item == nil {
+		return state, nil
+	}
+	if err := json.Unmarshal([]byte(out.Item["State"].S), state); err != nil {
+		return nil, fmt.Errorf("the state %s of %s: %w", s.key, s.table, err)
+	}
+	if state.Instances == nil {
+		state.Instances = map[string]*ManagedInstance{}
+	}
+	return state, nil
+}
+
+func (s *dynamoDBStateStore) Save(c context.Context, state *State) error {
+	saved := *state
+	saved.Serial++
+	data, err := json.Marshal(&saved)
+	if err != nil {
+		return err
+	}
+	err = s.api.PutItem(c, &awsapi.PutItemInput{
+		TableName: s.table,
+		Item: map[string]awsapi.AttributeValue{
+			"StateKey": {S: s.key},
+			"Serial":   {N: strconv.FormatInt(saved.Serial, 10)},
+			"State":    {S: string(data)},
+		},
+		ConditionExpression:       "attribute_not_exists(StateKey) OR Serial = :serial",
+		ExpressionAttributeValues: map[string]awsapi.AttributeValue{":serial": {N: strconv.FormatInt(state.Serial, 10)}},
+	})
+	var apiErr *awsapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == "ConditionalCheckFailedException" {
+		return errStateConflict
+	}
+	if err != nil {
+		return err
+	}
+	state.Serial = saved.Serial
+	return nil
+}
+
+// S3StateAPI defines the interface for the S3 functions of the state store.
+// We use this interface to test the functions using a mocked service.
+type S3StateAPI interface {
+	GetObjectETag(ctx context.Context, bucket, key string) ([]byte, string, error)
+	PutObjectIfMatch(ctx context.Context, bucket, key string, body []byte, etag string) (string, string, error)
+}
+
+// s3StateStore keeps the state as an S3 object. A save is a PutObject
+// conditional on the ETag that was loaded, and in a bucket with versioning
+// every save keeps the state it replaced.
+type s3StateStore struct {
+	api    S3StateAPI
+	bucket string
+	key    string
+}
+
+func (s *s3StateStore) Load(c context.Context) (*State, error) {
+	state := &State{Instances: map[string]*ManagedInstance{}}
+	data, etag, err := s.api.GetObjectETag(c, s.bucket, s.key)
+	var apiErr *awsapi.Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode == 404 {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("s3://%s/%s: %w", s.bucket, s.key, err)
+	}
+	if state.Instances == nil {
+		state.Instances = map[string]*ManagedInstance{}
+	}
+	state.etag = etag
+	return state, nil
+}
+
+func (s *s3StateStore) Save(c context.Context, state *State) error {
+	saved := *state
+	saved.Serial++
+	data, err := json.MarshalIndent(&saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	etag, version, err := s.api.PutObjectIfMatch(c, s.bucket, s.key, append(data, '\n'), state.etag)
+	var apiErr *awsapi.Error
+	if errors.As(err, &apiErr) && (apiErr.StatusCode == 412 || apiErr.StatusCode == 409) {
+		return errStateConflict
+	}
+	if err != nil {
+		return err
+	}
+	state.Serial, state.etag, state.version = saved.Serial, etag, version
+	return nil
+}
+
+// newStateStore returns the state store described by spec,
+// dynamodb://TABLE[/KEY] or s3://BUCKET/KEY, or the local file when spec
+// is empty.
+func newStateStore(spec string) (StateStore, error) {
+	scheme, location, ok := strings.Cut(spec, "://")
+	switch {
+	case spec == "":
+		return &fileStateStore{}, nil
+	case ok && scheme == "dynamodb" && location != "":
+		table, key, _ := strings.Cut(location, "/")
+		return &dynamoDBStateStore{api: dynamoDBClient, table: table, key: firstNonEmpty(key, "aws-vmcreate")}, nil
+	case ok && scheme == "s3" && location != "":
+		bucket, key, _ := strings.Cut(location, "/")
+		if key == "" || strings.HasSuffix(key, "/") {
+			key += "aws-vmcreate.json"
+		}
+		return &s3StateStore{api: s3Client, bucket: bucket, key: key}, nil
+	}
+	return nil, fmt.Errorf("the state must be dynamodb://TABLE[/KEY] or s3://BUCKET/KEY, not %q", spec)
+}
+
+// stateCommands are the commands that record the lifecycle of instances,
+// or read it, and so use the state store.
+var stateCommands = map[string]bool{
+	"create": true, "delete": true, "daemon": true, "serve": true, "grpc-serve": true, "env": true, "tui": true, "history": true,
+	"state": true, "group": true, "standby": true, "activate": true, "scale": true, "cleanup": true,
+}
+
+// stateStore is where the lifecycle of the managed instances is kept, set
+// up by main from --state or the state of data/config.json.
+var stateStore StateStore = &fileStateStore{}
+
+// stateMu serializes the updates of a process, such as those of the API
+// server's requests.
+var stateMu sync.Mutex
+
+// updateState loads the state, changes it with update and saves it,
+// starting over when another writer saved in between.
+func updateState(c context.Context, store StateStore, update func(*State) error) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	for attempt := 1; ; attempt++ {
+		state, err := store.Load(c)
+		if err != nil {
+			return err
+		}
+		if err := update(state); err != nil {
+			return err
+		}
+		err = store.Save(c, state)
+		if !errors.Is(err, errStateConflict) || attempt == 5 {
+			return err
+		}
+	}
+}
+
+// recordLifecycle moves the instances to phase in the state store. The
+// state is a record of what the commands did, so failures are only
+// reported.
+func recordLifecycle(c context.Context, command string, instances []types.Instance, region string, phase lifecyclePhase, reason string) {
+	recordLifecycleAt(c, command, instances, region, phase, reason, time.Now())
+}
+
+// recordLifecycleAt is recordLifecycle for a move made at now, such as the
+// request of a launch that is only recorded once the instances exist.
+func recordLifecycleAt(c context.Context, command string, instances []types.Instance, region string, phase lifecyclePhase, reason string, now time.Time) {
+	if len(instances) == 0 {
+		return
+	}
+	err := updateState(c, stateStore, func(state *State) error {
+		var problems []string
+		for n := range instances {
+			i := &instances[n]
+			id := aws.ToString(i.InstanceId)
+			m := state.Instances[id]
+			if m == nil {
+				m = &ManagedInstance{InstanceID: id}
+				state.Instances[id] = m
+			}
+			if name := vmcreate.TagValue(i, "Name"); name != "" {
+				m.Name = name
+			}
+			m.Region = firstNonEmpty(region, m.Region)
+			if err := m.transition(phase, now, command, reason); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+		if len(problems) > 0 {
+			fmt.Fprintln(os.Stderr, "Not recording the lifecycle of every instance: "+strings.Join(problems, "; "))
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error recording the lifecycle of the instances:")
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// instancesOf returns instances with just the IDs, for recordLifecycle.
+func instancesOf(ids []string) []types.Instance {
+	var instances []types.Instance
+	for _, id := range ids {
+		instances = append(instances, types.Instance{InstanceId: aws.String(id)})
+	}
+	return instances
+}
+
+// managedInstances returns the instances of the state whose ID or Name tag
+// is name, by ID.
+func managedInstances(state *State, name string) []*ManagedInstance {
+	var found []*ManagedInstance
+	for _, m := range state.Instances {
+		if m.InstanceID == name || m.Name == name {
+			found = append(found, m)
+		}
+	}
+	sort.Slice(found, func(a, b int) bool { return found[a].InstanceID < found[b].InstanceID })
+	return found
+}
+
+func LifecycleHistoryCmd(name string) {
+	state, err := stateStore.Load(context.TODO())
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error loading the state:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	found := managedInstances(state, name)
+	if len(found) == 0 {
+		failCommand("No instance named " + name + " is in the state")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tTIME\tFROM\tTO\tCOMMAND\tREASON")
+	for _, m := range found {
+		for _, t := range m.Transitions {
+			fmt.Fprintln(w, strings.Join([]string{
+				m.InstanceID,
+				t.Time.Local().Format(time.RFC3339),
+				firstNonEmpty(string(t.From), "-"),
+				string(t.To),
+				t.Command,
+				t.Reason,
+			}, "\t"))
+		}
+	}
+	w.Flush()
+}
+
+// pushState replaces the stored state with pushed. A pushed state older
+// than the stored one, by serial, is refused unless force is set.
+func pushState(c context.Context, store StateStore, pushed *State, force bool) (*State, error) {
+	stored, err := store.Load(c)
+	if err != nil {
+		return nil, err
+	}
+	if pushed.Serial < stored.Serial && !force {
+		return nil, fmt.Errorf("the pushed state (serial %d) is older than the stored one (serial %d), pass --force to replace it anyway", pushed.Serial, stored.Serial)
+	}
+	if pushed.Instances == nil {
+		pushed.Instances = map[string]*ManagedInstance{}
+	}
+	pushed.Serial, pushed.etag = stored.Serial, stored.etag
+	if err := store.Save(c, pushed); err != nil {
+		return nil, err
+	}
+	return pushed, nil
+}
+
+// stateSyncBatch is how many instance IDs state sync looks up at once, the
+// most values a DescribeInstances filter takes.
+const stateSyncBatch = 200
+
+// stateSync is what syncState changed in the state.
+type stateSync struct {
+	Removed []string
+	Adopted []*ManagedInstance
+}
+
+// syncState reconciles the state with the instances of the region. The
+// entries of instances that are terminated, or long gone, are removed, and
+// the live instances tagged with createdByTag that the state is missing are
+// adopted, as ready or, while they are pending, launching.
+func syncState(c context.Context, p *vmcreate.Provisioner, state *State, region string, now time.Time) (*stateSync, error) {
+	live := map[string]types.Instance{}
+	collect := func(filter types.Filter) error {
+		instances, err := p.List(c, filter)
+		if err != nil {
+			return err
+		}
+		for _, i := range instances {
+			if i.State != nil && (i.State.Name == types.InstanceStateNameShuttingDown || i.State.Name == types.InstanceStateNameTerminated) {
+				continue
+			}
+			live[aws.ToString(i.InstanceId)] = i
+		}
+		return nil
+	}
+	if err := collect(types.Filter{Name: aws.String("tag-key"), Values: []string{createdByTag}}); err != nil {
+		return nil, fmt.Errorf("listing the instances: %w", err)
+	}
+
+	// Instances created before their creator could be looked up are not
+	// tagged, so the rest of the state is looked up by ID.
+	var unknown []string
+	for id, m := range state.Instances {
+		if _, ok := live[id]; !ok && (m.Region == "" || m.Region == region) {
+			unknown = append(unknown, id)
+		}
+	}
+	sort.Strings(unknown)
+	for start := 0; start < len(unknown); start += stateSyncBatch {
+		end := start + stateSyncBatch
+		if end > len(unknown) {
+			end = len(unknown)
+		}
+		if err := collect(types.Filter{Name: aws.String("instance-id"), Values: unknown[start:end]}); err != nil {
+			return nil, fmt.Errorf("looking up the instances of the state: %w", err)
+		}
+	}
+
+	synced := &stateSync{}
+	for _, id := range unknown {
+		if _, ok := live[id]; !ok {
+			delete(state.Instances, id)
+			synced.Removed = append(synced.Removed, id)
+		}
+	}
+	var ids []string
+	for id := range live {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if state.Instances[id] != nil {
+			continue
+		}
+		i := live[id]
+		m := &ManagedInstance{InstanceID: id, Name: vmcreate.TagValue(&i, "Name"), Region: region}
+		phase := phaseReady
+		if i.State != nil && i.State.Name == types.InstanceStateNamePending {
+			phase = phaseLaunching
+		}
+		if err := m.transition(phase, now, "state", "adopted by state sync"); err != nil {
+			return nil, err
+		}
+		state.Instances[id] = m
+		synced.Adopted = append(synced.Adopted, m)
+	}
+	return synced, nil
+}
+
+func StateCmd(action string, args []string, lockSpec *string, force *bool, dryRun *bool) {
+	c := context.TODO()
+	switch action {
+	case "pull":
+		state, err := stateStore.Load(c)
+		if err == nil {
+			var data []byte
+			if data, err = json.MarshalIndent(state, "", "  "); err == nil {
+				fmt.Println(string(data))
+				return
+			}
+		}
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error loading the state:")
+		fmt.Fprintln(os.Stderr, err)
+	case "push":
+		data, err := os.ReadFile(args[0])
+		pushed := &State{}
+		if err == nil {
+			err = json.Unmarshal(data, pushed)
+		}
+		if err == nil {
+			pushed, err = pushState(c, stateStore, pushed, *force)
+		}
+		if err != nil {
+			commandErr = err
+			fmt.Fprintln(os.Stderr, "Got an error pushing the state:")
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		message := fmt.Sprintf("Pushed %s as serial %d", args[0], pushed.Serial)
+		if pushed.version != "" {
+			message += ", version " + pushed.version
+		}
+		fmt.Println(message)
+	case "sync":
+		var synced *stateSync
+		reconcile := func(state *State) error {
+			var err error
+			synced, err = syncState(c, provisioner, state, awsConfig.Region, time.Now())
+			return err
+		}
+		var err error
+		if *dryRun {
+			var state *State
+			if state, err = stateStore.Load(c); err == nil {
+				err = reconcile(state)
+			}
+		} else {
+			err = updateState(c, stateStore, reconcile)
+		}
+		if err != nil {
+			commandErr = err
+			fmt.Fprintln(os.Stderr, "Got an error syncing the state:")
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		removed, adopted := "Removed ", "Adopted "
+		if *dryRun {
+			removed, adopted = "Would remove ", "Would adopt "
+		}
+		for _, id := range synced.Removed {
+			fmt.Println(removed + id + ", which is terminated")
+		}
+		for _, m := range synced.Adopted {
+			fmt.Println(adopted + m.InstanceID + " as " + string(m.Phase))
+		}
+		if len(synced.Removed) == 0 && len(synced.Adopted) == 0 {
+			fmt.Println("The state is in sync with EC2")
+		}
+	case "unlock":
+		spec := *lockSpec
+		if spec == "" {
+			config, _ := loadConfig()
+			spec = config.Lock
+		}
+		lock, err := newFleetLock(spec)
+		if err == nil && lock == nil {
+			err = errors.New("no fleet lock is configured (--lock or the lock of data/config.json)")
+		}
+		if err == nil {
+			err = lock.Break(c, args[0])
+		}
+		if err != nil {
+			commandErr = err
+			fmt.Fprintln(os.Stderr, "Got an error unlocking "+args[0]+":")
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		fmt.Println("Unlocked " + args[0])
+	}
+}
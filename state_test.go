@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestLifecycleTransitions(t *testing.T) {
+	m := &ManagedInstance{InstanceID: "i-1"}
+	now := time.Now()
+	for _, phase := range []lifecyclePhase{phaseRequested, phaseLaunching, phaseBootstrapping, phaseReady, phaseDraining, phaseReady, phaseDraining, phaseTerminated} {
+		if err := m.transition(phase, now, "test", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.Transitions) != 8 || m.Transitions[1].From != phaseRequested {
+		t.Errorf("transitions = %+v", m.Transitions)
+	}
+	for _, phase := range []lifecyclePhase{phaseReady, phaseLaunching, phaseDraining} {
+		if err := m.transition(phase, now, "test", ""); err == nil {
+			t.Errorf("a terminated instance moved to %s", phase)
+		}
+	}
+
+	// Instances the state does not know yet may start anywhere.
+	unknown := &ManagedInstance{InstanceID: "i-2"}
+	if err := unknown.transition(phaseDraining, now, "delete", ""); err != nil {
+		t.Error(err)
+	}
+	ready := &ManagedInstance{InstanceID: "i-3", Phase: phaseReady}
+	if err := ready.transition(phaseBootstrapping, now, "create", ""); err == nil {
+		t.Error("a ready instance moved back to bootstrapping")
+	}
+}
+
+func TestFileStateStoreConflict(t *testing.T) {
+	store := &fileStateStore{path: t.TempDir() + "/state.json"}
+	c := context.Background()
+	first, _ := store.Load(c)
+	second, _ := store.Load(c)
+	if err := store.Save(c, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(c, second); !errors.Is(err, errStateConflict) {
+		t.Errorf("got %v, want a conflict", err)
+	}
+
+	err := updateState(c, store, func(s *State) error {
+		s.Instances["i-1"] = &ManagedInstance{InstanceID: "i-1", Phase: phaseReady}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded, _ := store.Load(c); loaded.Serial != 2 || loaded.Instances["i-1"] == nil {
+		t.Errorf("state = %+v", loaded)
+	}
+}
+
+// fakeDynamoDBState keeps state items and honours the serial condition.
+type fakeDynamoDBState struct {
+	items map[string]map[string]awsapi.AttributeValue
+}
+
+func (f *fakeDynamoDBState) GetItem(ctx context.Context, params *awsapi.GetItemInput) (*awsapi.GetItemOutput, error) {
+	return &awsapi.GetItemOutput{Item: f.items[params.Key["StateKey"].S]}, nil
+}
+
+func (f *fakeDynamoDBState) PutItem(ctx context.Context, params *awsapi.PutItemInput) error {
+	key := params.Item["StateKey"].S
+	if stored, ok := f.items[key]; ok && stored["Serial"].N != params.ExpressionAttributeValues[":serial"].N {
+		return errConditionalCheck
+	}
+	f.items[key] = params.Item
+	return nil
+}
+
+func TestDynamoDBStateStore(t *testing.T) {
+	api := &fakeDynamoDBState{items: map[string]map[string]awsapi.AttributeValue{}}
+	store := &dynamoDBStateStore{api: api, table: "vmcreate-state", key: "prod"}
+	c := context.Background()
+
+	runner, _ := store.Load(c)
+	operator, _ := store.Load(c)
+	runner.Instances["i-1"] = &ManagedInstance{InstanceID: "i-1", Phase: phaseReady}
+	if err := store.Save(c, runner); err != nil {
+		t.Fatal(err)
+	}
+	operator.Instances["i-2"] = &ManagedInstance{InstanceID: "i-2", Phase: phaseReady}
+	if err := store.Save(c, operator); !errors.Is(err, errStateConflict) {
+		t.Fatalf("got %v, want a conflict", err)
+	}
+
+	// The loser of the race starts over from what the winner saved.
+	err := updateState(c, store, func(s *State) error {
+		s.Instances["i-2"] = &ManagedInstance{InstanceID: "i-2", Phase: phaseReady}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := store.Load(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Serial != 2 || loaded.Instances["i-1"] == nil || loaded.Instances["i-2"] == nil {
+		t.Errorf("state = %+v", loaded)
+	}
+	if api.items["prod"]["Serial"].N != "2" {
+		t.Errorf("item = %v", api.items["prod"])
+	}
+}
+
+// fakeS3State keeps objects with a serial number for their ETag and
+// honours If-Match and If-None-Match.
+type fakeS3State struct {
+	objects map[string][]byte
+	etags   map[string]string
+	puts    int
+}
+
+func (f *fakeS3State) GetObjectETag(ctx context.Context, bucket, key string) ([]byte, string, error) {
+	data, ok := f.objects[key]
+	if !ok {
+		return nil, "", &awsapi.Error{StatusCode: 404, Code: "NoSuchKey"}
+	}
+	return data, f.etags[key], nil
+}
+
+func (f *fakeS3State) PutObjectIfMatch(ctx context.Context, bucket, key string, body []byte, etag string) (string, string, error) {
+	if f.etags[key] != etag {
+		return "", "", &awsapi.Error{StatusCode: 412, Code: "PreconditionFailed"}
+	}
+	f.puts++
+	f.objects[key] = body
+	f.etags[key] = fmt.Sprintf(`"%d"`, f.puts)
+	return f.etags[key], fmt.Sprintf("v%d", f.puts), nil
+}
+
+func TestS3StateStore(t *testing.T) {
+	api := &fakeS3State{objects: map[string][]byte{}, etags: map[string]string{}}
+	store := &s3StateStore{api: api, bucket: "vmcreate-state", key: "prod.json"}
+	c := context.Background()
+
+	runner, _ := store.Load(c)
+	operator, _ := store.Load(c)
+	runner.Instances["i-1"] = &ManagedInstance{InstanceID: "i-1", Phase: phaseReady}
+	if err := store.Save(c, runner); err != nil {
+		t.Fatal(err)
+	}
+	if runner.version != "v1" {
+		t.Errorf("version = %q", runner.version)
+	}
+	operator.Instances["i-2"] = &ManagedInstance{InstanceID: "i-2", Phase: phaseReady}
+	if err := store.Save(c, operator); !errors.Is(err, errStateConflict) {
+		t.Fatalf("got %v, want a conflict", err)
+	}
+
+	// A save after a save needs no reload, the new ETag is kept.
+	runner.Instances["i-3"] = &ManagedInstance{InstanceID: "i-3", Phase: phaseReady}
+	if err := store.Save(c, runner); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := store.Load(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Serial != 2 || len(loaded.Instances) != 2 {
+		t.Errorf("state = %+v", loaded)
+	}
+}
+
+func TestPushState(t *testing.T) {
+	api := &fakeS3State{objects: map[string][]byte{}, etags: map[string]string{}}
+	store := &s3StateStore{api: api, bucket: "vmcreate-state", key: "prod.json"}
+	c := context.Background()
+	for i := 0; i < 3; i++ {
+		if err := updateState(c, store, func(*State) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old := &State{Serial: 1, Instances: map[string]*ManagedInstance{"i-1": {InstanceID: "i-1"}}}
+	if _, err := pushState(c, store, old, false); err == nil {
+		t.Fatal("an older state was pushed without --force")
+	}
+	pushed, err := pushState(c, store, old, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, _ := store.Load(c)
+	if pushed.Serial != 4 || loaded.Serial != 4 || loaded.Instances["i-1"] == nil {
+		t.Errorf("pushed %+v, loaded %+v", pushed, loaded)
+	}
+}
+
+func TestStatePullAndPush(t *testing.T) {
+	useFakeEC2(t)
+	useConfig(t, ConfigMap{})
+	file := filepath.Join(t.TempDir(), "state.json")
+	state := `{"serial": 7, "instances": {"i-1": {"instance_id": "i-1", "phase": "ready"}}}`
+	if err := os.WriteFile(file, []byte(state), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stored state counts its saves, the pushed one is the next.
+	if out := runCLI(t, "state", "push", file); !strings.Contains(out, "serial 1") {
+		t.Errorf("push printed %q", out)
+	}
+	out := runCLI(t, "state", "pull")
+	pulled := &State{}
+	if err := json.Unmarshal([]byte(out[strings.Index(out, "{"):]), pulled); err != nil {
+		t.Fatalf("pull printed %q: %v", out, err)
+	}
+	if pulled.Serial != 1 || pulled.Instances["i-1"] == nil {
+		t.Errorf("pulled %+v", pulled)
+	}
+}
+
+func TestStateSync(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{})
+	tagged := func(name string) []types.Tag {
+		return []types.Tag{{Key: aws.String(createdByTag), Value: aws.String("tester")}, {Key: aws.String("Name"), Value: aws.String(name)}}
+	}
+	fake.AddInstance(types.Instance{InstanceId: aws.String("i-adopted"), Tags: tagged("web-1")})
+	fake.AddInstance(types.Instance{InstanceId: aws.String("i-pending"), Tags: tagged("web-2"), State: &types.InstanceState{Name: types.InstanceStateNamePending}})
+	fake.AddInstance(types.Instance{InstanceId: aws.String("i-kept")})
+	fake.AddInstance(types.Instance{InstanceId: aws.String("i-terminated"), State: &types.InstanceState{Name: types.InstanceStateNameTerminated}})
+	recordLifecycle(context.Background(), "create", instancesOf([]string{"i-kept", "i-terminated", "i-gone"}), "", phaseReady, "")
+
+	if out := runCLI(t, "state", "sync", "--dry-run"); !strings.Contains(out, "Would remove i-gone") {
+		t.Errorf("dry run printed %q", out)
+	}
+	if state, _ := stateStore.Load(context.Background()); len(state.Instances) != 3 {
+		t.Fatalf("the dry run changed the state: %+v", state.Instances)
+	}
+
+	runCLI(t, "state", "sync")
+	state, err := stateStore.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for id := range state.Instances {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if strings.Join(ids, " ") != "i-adopted i-kept i-pending" {
+		t.Fatalf("state has %v", ids)
+	}
+	if m := state.Instances["i-adopted"]; m.Phase != phaseReady || m.Name != "web-1" {
+		t.Errorf("adopted %+v", m)
+	}
+	if m := state.Instances["i-pending"]; m.Phase != phaseLaunching {
+		t.Errorf("adopted %+v", m)
+	}
+	if out := runCLI(t, "state", "sync"); !strings.Contains(out, "in sync") {
+		t.Errorf("second sync printed %q", out)
+	}
+}
+
+func TestNewStateStore(t *testing.T) {
+	store, err := newStateStore("dynamodb://vmcreate-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := store.(*dynamoDBStateStore); !ok || d.table != "vmcreate-state" || d.key != "aws-vmcreate" {
+		t.Errorf("store = %#v", store)
+	}
+	store, err = newStateStore("s3://vmcreate-state/fleets/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := store.(*s3StateStore); !ok || s.bucket != "vmcreate-state" || s.key != "fleets/aws-vmcreate.json" {
+		t.Errorf("store = %#v", store)
+	}
+	if _, err := newStateStore("etcd://state"); err == nil {
+		t.Error("an unknown state store was accepted")
+	}
+}
+
+func TestLifecycleOfCreateAndDelete(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1"})
+
+	runCLI(t, "create", "--tag", "Name=web-1")
+	runCLI(t, "delete", "--tag", "Name=web-1")
+
+	state, err := stateStore.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := aws.ToString(fake.Instances()[0].InstanceId)
+	m := state.Instances[id]
+	if m == nil || m.Name != "web-1" {
+		t.Fatalf("state of %s = %+v", id, m)
+	}
+	var phases []string
+	for _, tr := range m.Transitions {
+		phases = append(phases, string(tr.To))
+	}
+	if got := strings.Join(phases, " "); got != "requested launching ready draining terminated" {
+		t.Errorf("phases = %s", got)
+	}
+
+	out := runCLI(t, "history", "web-1")
+	if !strings.Contains(out, id) || !strings.Contains(out, "draining") {
+		t.Errorf("history is missing the transitions of %s:\n%s", id, out)
+	}
+}
+
+func TestKeepFirst(t *testing.T) {
+	instance := func(id string) types.Instance { return types.Instance{InstanceId: aws.String(id)} }
+	instances := []types.Instance{instance("i-draining"), instance("i-old"), instance("i-booting"), instance("i-new")}
+	phases := map[string]lifecyclePhase{"i-draining": phaseDraining, "i-booting": phaseBootstrapping, "i-old": phaseReady}
+
+	var order []string
+	for _, i := range keepFirst(instances, phases) {
+		order = append(order, aws.ToString(i.InstanceId))
+	}
+	if got := strings.Join(order, " "); got != "i-old i-new i-booting i-draining" {
+		t.Errorf("order = %s", got)
+	}
+}
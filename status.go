@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// StatusAPI defines the interface for the functions status describes the health of instances with.
+// We use this interface to test the functions using a mocked service.
+type StatusAPI interface {
+	ec2.DescribeInstancesAPIClient
+	ec2.DescribeInstanceStatusAPIClient
+}
+
+// instanceHealth is the health of one instance: its state, the system and
+// instance status checks, and its upcoming scheduled events.
+type instanceHealth struct {
+	InstanceID     string
+	Name           string
+	State          string
+	RootDeviceType string
+	SystemStatus   string
+	InstanceStatus string
+	Events         []types.InstanceStatusEvent
+	// Problems say why the instance is degraded, and are empty when it is not.
+	Problems []string
+}
+
+// pendingEvents returns the scheduled events that have not completed or
+// been canceled, which EC2 marks in their description.
+func pendingEvents(events []types.InstanceStatusEvent) []types.InstanceStatusEvent {
+	var pending []types.InstanceStatusEvent
+	for _, e := range events {
+		description := aws.ToString(e.Description)
+		if !strings.HasPrefix(description, "[Completed]") && !strings.HasPrefix(description, "[Canceled]") {
+			pending = append(pending, e)
+		}
+	}
+	return pending
+}
+
+// describeStatuses returns the status of the instances, stopped ones
+// included, keyed by instance id.
+func describeStatuses(c context.Context, api ec2.DescribeInstanceStatusAPIClient, instanceIDs []string) (map[string]types.InstanceStatus, error) {
+	statuses := map[string]types.InstanceStatus{}
+	// DescribeInstanceStatus takes at most 100 instance ids.
+	for start := 0; start < len(instanceIDs); start += 100 {
+		batch := instanceIDs[start:]
+		if len(batch) > 100 {
+			batch = batch[:100]
+		}
+		pages := ec2.NewDescribeInstanceStatusPaginator(api, &ec2.DescribeInstanceStatusInput{InstanceIds: batch, IncludeAllInstances: aws.Bool(true)})
+		for pages.HasMorePages() {
+			page, err := pages.NextPage(c)
+			if err != nil {
+				return nil, fmt.Errorf("describing the instance status: %w", err)
+			}
+			for _, s := range page.InstanceStatuses {
+				statuses[aws.ToString(s.InstanceId)] = s
+			}
+		}
+	}
+	return statuses, nil
+}
+
+// waitForStatusChecks waits for the system and instance status checks of
+// the instance to pass.
+func waitForStatusChecks(c context.Context, api ec2.DescribeInstanceStatusAPIClient, instanceID string, timeout time.Duration, optFns ...func(*ec2.InstanceStatusOkWaiterOptions)) error {
+	err := ec2.NewInstanceStatusOkWaiter(api, optFns...).Wait(c, &ec2.DescribeInstanceStatusInput{InstanceIds: []string{instanceID}}, timeout)
+	if err != nil {
+		return fmt.Errorf("waiting for the status checks of %s: %w", instanceID, err)
+	}
+	return nil
+}
+
+// fleetHealth returns the health of the live instances with the filters,
+// sorted by name. An instance is degraded when a status check is impaired
+// or an event is scheduled for it. Stopped instances have neither, and are
+// reported by their state.
+func fleetHealth(c context.Context, api StatusAPI, filters []types.Filter) ([]instanceHealth, error) {
+	var instances []types.Instance
+	pages := ec2.NewDescribeInstancesPaginator(api, &ec2.DescribeInstancesInput{
+		Filters: append([]types.Filter{vmcreate.StateFilter(vmcreate.LiveStates...)}, filters...),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(c)
+		if err != nil {
+			return nil, fmt.Errorf("listing the instances: %w", err)
+		}
+		for _, r := range page.Reservations {
+			instances = append(instances, r.Instances...)
+		}
+	}
+	var ids []string
+	for _, i := range instances {
+		ids = append(ids, aws.ToString(i.InstanceId))
+	}
+	statuses, err := describeStatuses(c, api, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	var health []instanceHealth
+	for _, i := range instances {
+		h := instanceHealth{InstanceID: aws.ToString(i.InstanceId), Name: tagName(i.Tags), SystemStatus: "-", InstanceStatus: "-"}
+		if i.State != nil {
+			h.State = string(i.State.Name)
+		}
+		h.RootDeviceType = string(i.RootDeviceType)
+		s := statuses[h.InstanceID]
+		if s.SystemStatus != nil {
+			h.SystemStatus = string(s.SystemStatus.Status)
+		}
+		if s.InstanceStatus != nil {
+			h.InstanceStatus = string(s.InstanceStatus.Status)
+		}
+		h.Events = pendingEvents(s.Events)
+
+		if h.SystemStatus == string(types.SummaryStatusImpaired) {
+			h.Problems = append(h.Problems, "the system status check failed, AWS needs to fix the host")
+		}
+		if h.InstanceStatus == string(types.SummaryStatusImpaired) {
+			h.Problems = append(h.Problems, "the instance status check failed, it may need a reboot")
+		}
+		for _, e := range h.Events {
+			h.Problems = append(h.Problems, fmt.Sprintf("%s scheduled from %s", e.Code, aws.ToTime(e.NotBefore).Format("2006-01-02 15:04 MST")))
+		}
+		health = append(health, h)
+	}
+	sort.SliceStable(health, func(a, b int) bool {
+		if health[a].Name != health[b].Name {
+			return health[a].Name < health[b].Name
+		}
+		return health[a].InstanceID < health[b].InstanceID
+	})
+	return health, nil
+}
+
+func StatusCmd(name *string, value *string) {
+	// Without a tag, the instances created by aws-vmcreate are checked.
+	filters := []types.Filter{vmcreate.TagKeyFilter(createdByTag)}
+	if *name != "" && *value != "" {
+		filters[0] = vmcreate.TagFilter(*name, strings.Split(*value, ",")...)
+	} else if *name != "" {
+		filters[0] = vmcreate.TagKeyFilter(*name)
+	}
+	health, err := fleetHealth(context.TODO(), client, filters)
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error checking the instances:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	if len(health) == 0 {
+		fmt.Println("No instances found")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tNAME\tSTATE\tSYSTEM\tINSTANCE CHECK\tHEALTH")
+	degraded := 0
+	for _, h := range health {
+		verdict := "healthy"
+		switch {
+		case len(h.Problems) > 0:
+			verdict = "degraded: " + strings.Join(h.Problems, "; ")
+			degraded++
+		case h.State != "pending" && h.State != "running":
+			verdict = h.State
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", h.InstanceID, h.Name, h.State, h.SystemStatus, h.InstanceStatus, verdict)
+	}
+	w.Flush()
+
+	if degraded > 0 {
+		fmt.Printf("%d of %d instances are degraded\n", degraded, len(health))
+		exit(1)
+	}
+	fmt.Printf("None of the %d instances is degraded\n", len(health))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"aws-vmcreate/pkg/vmcreate/vmcreatetest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeInstanceStatus answers DescribeInstanceStatus from its statuses.
+type fakeInstanceStatus struct {
+	*vmcreatetest.FakeEC2
+	statuses []types.InstanceStatus
+}
+
+func (f *fakeInstanceStatus) DescribeInstanceStatus(ctx context.Context, params *ec2.DescribeInstanceStatusInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceStatusOutput, error) {
+	out := &ec2.DescribeInstanceStatusOutput{}
+	for _, s := range f.statuses {
+		if contains(params.InstanceIds, aws.ToString(s.InstanceId)) {
+			out.InstanceStatuses = append(out.InstanceStatuses, s)
+		}
+	}
+	return out, nil
+}
+
+func checks(system, instance types.SummaryStatus) (*types.InstanceStatusSummary, *types.InstanceStatusSummary) {
+	return &types.InstanceStatusSummary{Status: system}, &types.InstanceStatusSummary{Status: instance}
+}
+
+func TestFleetHealth(t *testing.T) {
+	fake := &fakeInstanceStatus{FakeEC2: vmcreatetest.NewFakeEC2()}
+	provenance := types.Tag{Key: aws.String(createdByTag), Value: aws.String("alice")}
+	add := func(name string, state types.InstanceStateName) string {
+		return fake.AddInstance(types.Instance{State: &types.InstanceState{Name: state}, Tags: []types.Tag{provenance, {Key: aws.String("Name"), Value: aws.String(name)}}})
+	}
+	healthy, impaired, retiring, stopped := add("a", "running"), add("b", "running"), add("c", "running"), add("d", "stopped")
+	fake.AddInstance(types.Instance{Tags: []types.Tag{{Key: aws.String("Name"), Value: aws.String("unmanaged")}}})
+
+	s := func(id string, system, instance types.SummaryStatus, events ...types.InstanceStatusEvent) types.InstanceStatus {
+		status := types.InstanceStatus{InstanceId: aws.String(id), Events: events}
+		status.SystemStatus, status.InstanceStatus = checks(system, instance)
+		return status
+	}
+	fake.statuses = []types.InstanceStatus{
+		s(healthy, "ok", "ok", types.InstanceStatusEvent{Code: types.EventCodeSystemReboot, Description: aws.String("[Completed] scheduled reboot")}),
+		s(impaired, "ok", "impaired"),
+		s(retiring, "ok", "ok", types.InstanceStatusEvent{Code: types.EventCodeInstanceRetirement, NotBefore: aws.Time(time.Now().Add(72 * time.Hour))}),
+		s(stopped, "not-applicable", "not-applicable"),
+	}
+
+	health, err := fleetHealth(context.Background(), fake, []types.Filter{{Name: aws.String("tag-key"), Values: []string{createdByTag}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, h := range health {
+		got = append(got, h.Name+"="+strings.Join(h.Problems, ";"))
+	}
+	if len(got) != 4 || got[0] != "a=" || !strings.Contains(got[1], "instance status check failed") ||
+		!strings.HasPrefix(got[2], "c=instance-retirement scheduled") || got[3] != "d=" {
+		t.Errorf("got %v", got)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stepTimer reports the steps of a long operation, such as a create, as
+// they start and end with how long each took, so that the minutes spent
+// waiting on AWS are not silent, and sums them up at the end.
+type stepTimer struct {
+	mu    sync.Mutex
+	out   io.Writer
+	now   func() time.Time
+	steps []timedStep
+}
+
+// timedStep is a step that ended.
+type timedStep struct {
+	Subject string
+	Name    string
+	Took    time.Duration
+	Failed  bool
+}
+
+func newStepTimer() *stepTimer {
+	return &stepTimer{out: diagnostics, now: time.Now}
+}
+
+// run runs the step of subject, an instance ID or empty for the operation
+// as a whole, and reports it.
+func (t *stepTimer) run(subject, name string, step func() error) error {
+	label := name
+	if subject != "" {
+		label = subject + ": " + name
+	}
+	fmt.Fprintln(t.out, "==> "+label)
+	start := t.now()
+	err := step()
+	took := t.now().Sub(start).Round(100 * time.Millisecond)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.steps = append(t.steps, timedStep{Subject: subject, Name: name, Took: took, Failed: err != nil})
+	if err != nil {
+		fmt.Fprintf(t.out, "<== %s failed after %s\n", label, took)
+	} else {
+		fmt.Fprintf(t.out, "<== %s took %s\n", label, took)
+	}
+	return err
+}
+
+// summary prints the time of every step, e.g. "Took 2m4s: launch 3.2s,
+// i-0abc: wait running 28.1s, i-0abc: provision 1m32.7s". It prints
+// nothing when no step ran.
+func (t *stepTimer) summary() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.steps) == 0 {
+		return
+	}
+	var total time.Duration
+	var parts []string
+	for _, s := range t.steps {
+		total += s.Took
+		part := s.Name + " " + s.Took.String()
+		if s.Subject != "" {
+			part = s.Subject + ": " + part
+		}
+		if s.Failed {
+			part += " (failed)"
+		}
+		parts = append(parts, part)
+	}
+	fmt.Fprintf(t.out, "Took %s: %s\n", total, strings.Join(parts, ", "))
+}
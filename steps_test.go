@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStepTimer(t *testing.T) {
+	var out bytes.Buffer
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	steps := &stepTimer{out: &out, now: func() time.Time {
+		now = now.Add(1500 * time.Millisecond)
+		return now
+	}}
+
+	steps.run("", "launch and tag", func() error { return nil })
+	steps.run("i-1", "provision", func() error { return errors.New("exit status 1") })
+	steps.summary()
+
+	want := strings.Join([]string{
+		"==> launch and tag",
+		"<== launch and tag took 1.5s",
+		"==> i-1: provision",
+		"<== i-1: provision failed after 1.5s",
+		"Took 3s: launch and tag 1.5s, i-1: provision 1.5s (failed)",
+		"",
+	}, "\n")
+	if out.String() != want {
+		t.Errorf("printed\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestCreateReportsSteps(t *testing.T) {
+	useFakeEC2(t)
+	useConfig(t, ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1"})
+
+	out := runCLI(t, "create", "--tag", "Name=nat-1", "--no-source-dest-check")
+	for _, step := range []string{"launch and tag", "wait running", "source/destination check"} {
+		if !strings.Contains(out, "<== ") || !strings.Contains(out, step+" took") {
+			t.Errorf("the %s step is not reported:\n%s", step, out)
+		}
+	}
+	if !strings.Contains(out, "Took ") {
+		t.Errorf("no summary:\n%s", out)
+	}
+}
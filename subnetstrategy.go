@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// SubnetStrategyAPI defines the interface for the functions choosing a subnet when none is given.
+// We use this interface to test the functions using a mocked service.
+type SubnetStrategyAPI interface {
+	ec2.DescribeSubnetsAPIClient
+	ec2.DescribeInstancesAPIClient
+
+	DescribeSpotPriceHistory(ctx context.Context,
+		params *ec2.DescribeSpotPriceHistoryInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeSpotPriceHistoryOutput, error)
+}
+
+// The subnet strategies of subnet_strategy and --subnet-strategy.
+const (
+	strategyMostFreeIPs    = "most-free-ips"
+	strategyRoundRobinAZ   = "round-robin-az"
+	strategyCheapestAZSpot = "cheapest-az-spot"
+	strategySameAs         = "same-as"
+)
+
+// subnetStrategy is how create chooses a subnet when none is given.
+type subnetStrategy struct {
+	Kind string
+	// TagKey and TagValue select the instance same-as launches next to.
+	TagKey   string
+	TagValue string
+}
+
+// parseSubnetStrategy parses a strategy such as most-free-ips or
+// "same-as tag:app=web".
+func parseSubnetStrategy(spec string) (subnetStrategy, error) {
+	kind, arg, _ := strings.Cut(strings.TrimSpace(spec), " ")
+	s := subnetStrategy{Kind: kind}
+	switch kind {
+	case strategyMostFreeIPs, strategyRoundRobinAZ, strategyCheapestAZSpot:
+		if arg != "" {
+			return s, fmt.Errorf("the subnet strategy %s takes no argument", kind)
+		}
+	case strategySameAs:
+		arg = strings.TrimSpace(arg)
+		key, value, ok := strings.Cut(strings.TrimPrefix(arg, "tag:"), "=")
+		if !strings.HasPrefix(arg, "tag:") || !ok || key == "" {
+			return s, fmt.Errorf("the subnet strategy same-as takes the tag of the instance to launch next to, e.g. \"same-as tag:app=web\"")
+		}
+		s.TagKey, s.TagValue = key, value
+	default:
+		return s, fmt.Errorf("the subnet strategy must be %s, %s, %s or \"%s tag:KEY=VALUE\", not %q",
+			strategyMostFreeIPs, strategyRoundRobinAZ, strategyCheapestAZSpot, strategySameAs, spec)
+	}
+	return s, nil
+}
+
+// candidateSubnets returns the subnets a strategy chooses from: those of
+// subnetIDs or, without any, the default subnets of the default VPC.
+func candidateSubnets(c context.Context, api SubnetStrategyAPI, subnetIDs []string) ([]types.Subnet, error) {
+	input := &ec2.DescribeSubnetsInput{SubnetIds: subnetIDs}
+	if len(subnetIDs) == 0 {
+		input.Filters = []types.Filter{{Name: aws.String("default-for-az"), Values: []string{"true"}}}
+	}
+	var subnets []types.Subnet
+	pages := ec2.NewDescribeSubnetsPaginator(api, input)
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(c)
+		if err != nil {
+			return nil, fmt.Errorf("listing the subnets: %w", err)
+		}
+		for _, s := range page.Subnets {
+			if s.State == types.SubnetStateAvailable || s.State == "" {
+				subnets = append(subnets, s)
+			}
+		}
+	}
+	if len(subnets) == 0 {
+		if len(subnetIDs) == 0 {
+			return nil, fmt.Errorf("there is no default VPC to choose a subnet from, list the candidates in subnet_ids")
+		}
+		return nil, fmt.Errorf("none of the subnets %s is available", strings.Join(subnetIDs, ", "))
+	}
+	// Ties go to the first subnet, so the choice is stable.
+	sort.Slice(subnets, func(i, j int) bool {
+		return aws.ToString(subnets[i].AvailabilityZone)+aws.ToString(subnets[i].SubnetId) <
+			aws.ToString(subnets[j].AvailabilityZone)+aws.ToString(subnets[j].SubnetId)
+	})
+	return subnets, nil
+}
+
+// mostFreeIPs returns the subnet with the most free addresses.
+func mostFreeIPs(subnets []types.Subnet) types.Subnet {
+	best := subnets[0]
+	for _, s := range subnets[1:] {
+		if aws.ToInt32(s.AvailableIpAddressCount) > aws.ToInt32(best.AvailableIpAddressCount) {
+			best = s
+		}
+	}
+	return best
+}
+
+// runningInstances returns the pending and running instances with the filters.
+func runningInstances(c context.Context, api SubnetStrategyAPI, filters ...types.Filter) ([]types.Instance, error) {
+	var instances []types.Instance
+	pages := ec2.NewDescribeInstancesPaginator(api, &ec2.DescribeInstancesInput{Filters: append(filters,
+		types.Filter{Name: aws.String("instance-state-name"), Values: []string{"pending", "running"}})})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(c)
+		if err != nil {
+			return nil, fmt.Errorf("listing the instances: %w", err)
+		}
+		for _, r := range page.Reservations {
+			instances = append(instances, r.Instances...)
+		}
+	}
+	return instances, nil
+}
+
+// chooseSubnet returns the subnet, and why it was chosen, the strategy picks
+// among the candidates for an instance of the type.
+func chooseSubnet(c context.Context, api SubnetStrategyAPI, s subnetStrategy, subnetIDs []string, instanceType string) (string, string, error) {
+	if s.Kind == strategySameAs {
+		instances, err := runningInstances(c, api, types.Filter{Name: aws.String("tag:" + s.TagKey), Values: []string{s.TagValue}})
+		if err != nil {
+			return "", "", err
+		}
+		for _, i := range instances {
+			if i.SubnetId != nil {
+				return aws.ToString(i.SubnetId), "the subnet of " + aws.ToString(i.InstanceId) + " tagged " + s.TagKey + "=" + s.TagValue, nil
+			}
+		}
+		return "", "", fmt.Errorf("no running instance is tagged %s=%s to launch next to", s.TagKey, s.TagValue)
+	}
+
+	subnets, err := candidateSubnets(c, api, subnetIDs)
+	if err != nil {
+		return "", "", err
+	}
+	switch s.Kind {
+	case strategyRoundRobinAZ:
+		// The instances aws-vmcreate runs are counted per zone, and the next
+		// one goes to the zone with the fewest.
+		instances, err := runningInstances(c, api, types.Filter{Name: aws.String("tag-key"), Values: []string{createdByTag}})
+		if err != nil {
+			return "", "", err
+		}
+		perZone := map[string]int{}
+		for _, i := range instances {
+			if i.Placement != nil {
+				perZone[aws.ToString(i.Placement.AvailabilityZone)]++
+			}
+		}
+		best := subnets[0]
+		for _, sub := range subnets[1:] {
+			if perZone[aws.ToString(sub.AvailabilityZone)] < perZone[aws.ToString(best.AvailabilityZone)] {
+				best = sub
+			}
+		}
+		zone := aws.ToString(best.AvailabilityZone)
+		return aws.ToString(best.SubnetId), fmt.Sprintf("%s runs the fewest instances (%d)", zone, perZone[zone]), nil
+	case strategyCheapestAZSpot:
+		prices, err := api.DescribeSpotPriceHistory(c, &ec2.DescribeSpotPriceHistoryInput{
+			InstanceTypes:       []types.InstanceType{types.InstanceType(instanceType)},
+			ProductDescriptions: []string{"Linux/UNIX"},
+			StartTime:           aws.Time(time.Now()),
+		})
+		if err != nil {
+			return "", "", fmt.Errorf("getting the spot prices of %s: %w", instanceType, err)
+		}
+		// The history is newest first, so the first price of a zone is its current one.
+		price := map[string]float64{}
+		for _, p := range prices.SpotPriceHistory {
+			zone := aws.ToString(p.AvailabilityZone)
+			if _, seen := price[zone]; seen {
+				continue
+			}
+			if v, err := strconv.ParseFloat(aws.ToString(p.SpotPrice), 64); err == nil {
+				price[zone] = v
+			}
+		}
+		lowest := -1.0
+		for _, sub := range subnets {
+			if p, ok := price[aws.ToString(sub.AvailabilityZone)]; ok && (lowest < 0 || p < lowest) {
+				lowest = p
+			}
+		}
+		var cheapest []types.Subnet
+		for _, sub := range subnets {
+			if p, ok := price[aws.ToString(sub.AvailabilityZone)]; ok && p == lowest {
+				cheapest = append(cheapest, sub)
+			}
+		}
+		if len(cheapest) == 0 {
+			return "", "", fmt.Errorf("%s has no spot price in the zones of the subnets", instanceType)
+		}
+		best := mostFreeIPs(cheapest)
+		zone := aws.ToString(best.AvailabilityZone)
+		return aws.ToString(best.SubnetId), fmt.Sprintf("%s has the cheapest %s spot price ($%g/hour)", zone, instanceType, price[zone]), nil
+	default:
+		best := mostFreeIPs(subnets)
+		return aws.ToString(best.SubnetId), fmt.Sprintf("it has the most free addresses (%d)", aws.ToInt32(best.AvailableIpAddressCount)), nil
+	}
+}
+
+// resolveSubnet returns the subnet create launches into when none is given,
+// chosen by the strategy of --subnet-strategy or subnet_strategy. Without a
+// strategy EC2 picks a default subnet, which is said rather than left
+// silent.
+func resolveSubnet(c context.Context, api SubnetStrategyAPI, config ConfigMap, strategy string) (string, error) {
+	strategy = firstNonEmpty(strategy, config.SubnetStrategy)
+	if strategy == "" {
+		progressln("No subnet given, EC2 launches into a default subnet of the default VPC (choose one with --subnet-id or subnet_strategy)")
+		return "", nil
+	}
+	s, err := parseSubnetStrategy(strategy)
+	if err != nil {
+		return "", err
+	}
+	subnetID, reason, err := chooseSubnet(c, api, s, config.SubnetIds, config.InstanceType)
+	if err != nil {
+		return "", err
+	}
+	progressln("Chose subnet " + subnetID + " by " + s.Kind + ": " + reason)
+	return subnetID, nil
+}
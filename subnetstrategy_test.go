@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"aws-vmcreate/pkg/vmcreate/vmcreatetest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeSubnets answers DescribeSubnets and DescribeSpotPriceHistory from its
+// subnets and prices.
+type fakeSubnets struct {
+	*vmcreatetest.FakeEC2
+	subnets []types.Subnet
+	prices  []types.SpotPrice
+}
+
+func (f *fakeSubnets) DescribeSubnets(ctx context.Context, params *ec2.DescribeSubnetsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSubnetsOutput, error) {
+	out := &ec2.DescribeSubnetsOutput{}
+	for _, s := range f.subnets {
+		if len(params.SubnetIds) == 0 || contains(params.SubnetIds, aws.ToString(s.SubnetId)) {
+			out.Subnets = append(out.Subnets, s)
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeSubnets) DescribeSpotPriceHistory(ctx context.Context, params *ec2.DescribeSpotPriceHistoryInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSpotPriceHistoryOutput, error) {
+	return &ec2.DescribeSpotPriceHistoryOutput{SpotPriceHistory: f.prices}, nil
+}
+
+func subnet(id, zone string, free int32) types.Subnet {
+	return types.Subnet{SubnetId: aws.String(id), AvailabilityZone: aws.String(zone), AvailableIpAddressCount: aws.Int32(free), State: types.SubnetStateAvailable}
+}
+
+func TestChooseSubnet(t *testing.T) {
+	fake := &fakeSubnets{FakeEC2: vmcreatetest.NewFakeEC2(), subnets: []types.Subnet{
+		subnet("subnet-a", "us-east-1a", 200),
+		subnet("subnet-b", "us-east-1b", 4000),
+		subnet("subnet-c", "us-east-1c", 100),
+	}, prices: []types.SpotPrice{
+		{AvailabilityZone: aws.String("us-east-1a"), SpotPrice: aws.String("0.0310")},
+		{AvailabilityZone: aws.String("us-east-1b"), SpotPrice: aws.String("0.0420")},
+		{AvailabilityZone: aws.String("us-east-1c"), SpotPrice: aws.String("0.0290")},
+		// An older price, which must not replace the current one.
+		{AvailabilityZone: aws.String("us-east-1c"), SpotPrice: aws.String("0.0500")},
+	}}
+	provenance := []types.Tag{{Key: aws.String(createdByTag), Value: aws.String("alice")}}
+	for _, zone := range []string{"us-east-1a", "us-east-1c", "us-east-1c"} {
+		fake.AddInstance(types.Instance{Tags: provenance, Placement: &types.Placement{AvailabilityZone: aws.String(zone)}})
+	}
+	fake.AddInstance(types.Instance{
+		Tags:     []types.Tag{{Key: aws.String("app"), Value: aws.String("web")}},
+		SubnetId: aws.String("subnet-web"),
+	})
+
+	c := context.Background()
+	for _, test := range []struct {
+		strategy  string
+		subnetIDs []string
+		want      string
+	}{
+		{"most-free-ips", nil, "subnet-b"},
+		{"most-free-ips", []string{"subnet-a", "subnet-c"}, "subnet-a"},
+		{"round-robin-az", nil, "subnet-b"},
+		{"round-robin-az", []string{"subnet-a", "subnet-c"}, "subnet-a"},
+		{"cheapest-az-spot", nil, "subnet-c"},
+		{"same-as tag:app=web", nil, "subnet-web"},
+	} {
+		s, err := parseSubnetStrategy(test.strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _, err := chooseSubnet(c, fake, s, test.subnetIDs, "t3.micro")
+		if err != nil {
+			t.Errorf("%s: %v", test.strategy, err)
+		} else if got != test.want {
+			t.Errorf("%s among %v chose %s, want %s", test.strategy, test.subnetIDs, got, test.want)
+		}
+	}
+
+	s, _ := parseSubnetStrategy("same-as tag:app=api")
+	if _, _, err := chooseSubnet(c, fake, s, nil, "t3.micro"); err == nil {
+		t.Error("expected an error when no instance has the tag")
+	}
+	for _, bad := range []string{"random", "same-as", "same-as app=web", "most-free-ips now"} {
+		if _, err := parseSubnetStrategy(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+)
+
+var elbv2Client *awsapi.ELBv2
+
+// ELBv2TargetAPI defines the interface for the RegisterTargets, DeregisterTargets and DescribeTargetHealth functions.
+// We use this interface to test the functions using a mocked service.
+type ELBv2TargetAPI interface {
+	RegisterTargets(ctx context.Context, targetGroupArn string, targets []awsapi.TargetDescription) error
+
+	DeregisterTargets(ctx context.Context, targetGroupArn string, targets []awsapi.TargetDescription) error
+
+	DescribeTargetHealth(ctx context.Context, targetGroupArn string, targets []awsapi.TargetDescription) (*awsapi.DescribeTargetHealthOutput, error)
+}
+
+// targetPollInterval is how often waitForTargetState checks on the target.
+var targetPollInterval = 10 * time.Second
+
+// waitForTargetState polls the target group until the instance target is in
+// one of states, or is no longer listed when states includes "unused".
+func waitForTargetState(c context.Context, api ELBv2TargetAPI, targetGroupArn string, instanceID string, timeout time.Duration, states ...string) error {
+	c, cancel := context.WithTimeout(c, timeout)
+	defer cancel()
+
+	targets := []awsapi.TargetDescription{{Id: instanceID}}
+	for {
+		result, err := api.DescribeTargetHealth(c, targetGroupArn, targets)
+		if err != nil {
+			return err
+		}
+
+		state := "unused"
+		for _, d := range result.TargetHealthDescriptions {
+			if d.Target.Id == instanceID {
+				state = d.TargetHealth.State
+			}
+		}
+		for _, s := range states {
+			if s == state {
+				return nil
+			}
+		}
+
+		select {
+		case <-c.Done():
+			return fmt.Errorf("target %s is %s in %s: %w", instanceID, state, targetGroupArn, c.Err())
+		case <-time.After(targetPollInterval):
+		}
+	}
+}
+
+// registerTarget adds the instance to the target group and waits for the load
+// balancer to report it healthy.
+func registerTarget(c context.Context, api ELBv2TargetAPI, targetGroupArn string, instanceID string, timeout time.Duration) error {
+	err := api.RegisterTargets(c, targetGroupArn, []awsapi.TargetDescription{{Id: instanceID}})
+	if err != nil {
+		return err
+	}
+	progressln("Registered " + instanceID + " with " + targetGroupArn + ", waiting for it to become healthy")
+	return waitForTargetState(c, api, targetGroupArn, instanceID, timeout, "healthy")
+}
+
+// deregisterTarget removes the instance from the target group and waits for
+// connection draining to finish.
+func deregisterTarget(c context.Context, api ELBv2TargetAPI, targetGroupArn string, instanceID string, timeout time.Duration) error {
+	err := api.DeregisterTargets(c, targetGroupArn, []awsapi.TargetDescription{{Id: instanceID}})
+	if err != nil {
+		return err
+	}
+	progressln("Deregistered " + instanceID + " from " + targetGroupArn + ", waiting for connections to drain")
+	return waitForTargetState(c, api, targetGroupArn, instanceID, timeout, "unused")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+)
+
+// fakeTargetGroup moves each registered target through its states, one a
+// DescribeTargetHealth call; a target past its last state is unused.
+type fakeTargetGroup struct {
+	states     map[string][]string
+	registered []string
+	removed    []string
+	fail       error
+}
+
+func (f *fakeTargetGroup) RegisterTargets(ctx context.Context, targetGroupArn string, targets []awsapi.TargetDescription) error {
+	if f.fail != nil {
+		return f.fail
+	}
+	f.registered = append(f.registered, targets[0].Id)
+	f.states[targets[0].Id] = []string{"initial", "initial", "healthy"}
+	return nil
+}
+
+func (f *fakeTargetGroup) DeregisterTargets(ctx context.Context, targetGroupArn string, targets []awsapi.TargetDescription) error {
+	f.removed = append(f.removed, targets[0].Id)
+	f.states[targets[0].Id] = []string{"draining", "draining"}
+	return nil
+}
+
+func (f *fakeTargetGroup) DescribeTargetHealth(ctx context.Context, targetGroupArn string, targets []awsapi.TargetDescription) (*awsapi.DescribeTargetHealthOutput, error) {
+	out := &awsapi.DescribeTargetHealthOutput{}
+	id := targets[0].Id
+	if states := f.states[id]; len(states) > 0 {
+		out.TargetHealthDescriptions = []awsapi.TargetHealthDescription{{Target: awsapi.TargetDescription{Id: id}, TargetHealth: awsapi.TargetHealth{State: states[0]}}}
+		if len(states) > 1 {
+			f.states[id] = states[1:]
+		} else if states[0] == "draining" {
+			delete(f.states, id)
+		}
+	}
+	return out, nil
+}
+
+func TestRegisterAndDeregisterTarget(t *testing.T) {
+	defer func(interval time.Duration) { targetPollInterval = interval }(targetPollInterval)
+	targetPollInterval = time.Millisecond
+	const arn = "arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/web/abc"
+	tg := &fakeTargetGroup{states: map[string][]string{}}
+
+	if err := registerTarget(context.Background(), tg, arn, "i-0123", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if len(tg.registered) != 1 || tg.states["i-0123"][0] != "healthy" {
+		t.Errorf("registered %v, states %v", tg.registered, tg.states)
+	}
+
+	if err := deregisterTarget(context.Background(), tg, arn, "i-0123", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, listed := tg.states["i-0123"]; len(tg.removed) != 1 || listed {
+		t.Errorf("removed %v, states %v", tg.removed, tg.states)
+	}
+}
+
+func TestRegisterTargetTimeout(t *testing.T) {
+	defer func(interval time.Duration) { targetPollInterval = interval }(targetPollInterval)
+	targetPollInterval = time.Millisecond
+	const arn = "arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/web/abc"
+
+	// A target that stays unhealthy times out with the state it was left in.
+	tg := &fakeTargetGroup{states: map[string][]string{}}
+	tg.RegisterTargets(context.Background(), arn, []awsapi.TargetDescription{{Id: "i-0123"}})
+	tg.states["i-0123"] = []string{"unhealthy"}
+	err := waitForTargetState(context.Background(), tg, arn, "i-0123", 20*time.Millisecond, "healthy")
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "target i-0123 is unhealthy in "+arn) {
+		t.Errorf("got %v", err)
+	}
+
+	tg.fail = errors.New("AccessDenied")
+	if err := registerTarget(context.Background(), tg, arn, "i-0456", time.Minute); err != tg.fail {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// terminationPolicies are how scale and delete --count choose the instances
+// they terminate: oldest-first and newest-first by launch time,
+// cheapest-az-first those of the zone where their type's spot price is
+// lowest, unhealthy-first those whose status checks fail, and drain those
+// already draining, then those not yet ready, then the newest, like the
+// daemon. Ties go oldest first.
+var terminationPolicies = []string{"oldest-first", "newest-first", "cheapest-az-first", "unhealthy-first", "drain"}
+
+// TerminationOrderAPI defines the interface for the functions the termination policies look up instances with.
+// We use this interface to test the functions using a mocked service.
+type TerminationOrderAPI interface {
+	ec2.DescribeInstanceStatusAPIClient
+
+	DescribeSpotPriceHistory(ctx context.Context,
+		params *ec2.DescribeSpotPriceHistoryInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeSpotPriceHistoryOutput, error)
+}
+
+// terminationOrderClient is the client the termination policies look up
+// the health and prices of instances with.
+var terminationOrderClient TerminationOrderAPI
+
+// terminationOrder returns the instances in the order the policy terminates
+// them.
+func terminationOrder(c context.Context, api TerminationOrderAPI, instances []types.Instance, phases map[string]lifecyclePhase, policy string) ([]types.Instance, error) {
+	sorted := append([]types.Instance(nil), instances...)
+	sort.SliceStable(sorted, func(a, b int) bool {
+		return aws.ToTime(sorted[a].LaunchTime).Before(aws.ToTime(sorted[b].LaunchTime))
+	})
+
+	switch policy {
+	case "newest-first":
+		reverseInstances(sorted)
+	case "drain":
+		sorted = keepFirst(sorted, phases)
+		reverseInstances(sorted)
+	case "unhealthy-first":
+		statuses, err := describeStatuses(c, api, instanceIDs(sorted))
+		if err != nil {
+			return nil, err
+		}
+		sort.SliceStable(sorted, func(a, b int) bool {
+			return unhealthy(statuses[aws.ToString(sorted[a].InstanceId)]) && !unhealthy(statuses[aws.ToString(sorted[b].InstanceId)])
+		})
+	case "cheapest-az-first":
+		prices, err := zoneSpotPrices(c, api, sorted)
+		if err != nil {
+			return nil, err
+		}
+		price := func(i types.Instance) (float64, bool) {
+			if i.Placement == nil {
+				return 0, false
+			}
+			p, ok := prices[string(i.InstanceType)+" "+aws.ToString(i.Placement.AvailabilityZone)]
+			return p, ok
+		}
+		// Instances of a zone without a price go last.
+		sort.SliceStable(sorted, func(a, b int) bool {
+			pa, okA := price(sorted[a])
+			pb, okB := price(sorted[b])
+			return okA && (!okB || pa < pb)
+		})
+	}
+	return sorted, nil
+}
+
+// chooseTerminations returns the first count of the instances in the order
+// of the policy, or all of them when there are fewer.
+func chooseTerminations(c context.Context, instances []types.Instance, count int, policy string) ([]types.Instance, error) {
+	ordered, err := terminationOrder(c, terminationOrderClient, instances, lifecyclePhases(c), policy)
+	if err != nil {
+		return nil, err
+	}
+	if len(ordered) > count {
+		ordered = ordered[:count]
+	}
+	return ordered, nil
+}
+
+func reverseInstances(instances []types.Instance) {
+	for a, b := 0, len(instances)-1; a < b; a, b = a+1, b-1 {
+		instances[a], instances[b] = instances[b], instances[a]
+	}
+}
+
+// unhealthy reports whether a status check of the instance is impaired.
+func unhealthy(s types.InstanceStatus) bool {
+	for _, summary := range []*types.InstanceStatusSummary{s.SystemStatus, s.InstanceStatus} {
+		if summary != nil && summary.Status == types.SummaryStatusImpaired {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneSpotPrices returns the current spot price of the types of the
+// instances in each zone, keyed by "TYPE ZONE".
+func zoneSpotPrices(c context.Context, api TerminationOrderAPI, instances []types.Instance) (map[string]float64, error) {
+	var instanceTypes []types.InstanceType
+	seen := map[types.InstanceType]bool{}
+	for _, i := range instances {
+		if !seen[i.InstanceType] {
+			seen[i.InstanceType] = true
+			instanceTypes = append(instanceTypes, i.InstanceType)
+		}
+	}
+	out, err := api.DescribeSpotPriceHistory(c, &ec2.DescribeSpotPriceHistoryInput{
+		InstanceTypes:       instanceTypes,
+		ProductDescriptions: []string{"Linux/UNIX"},
+		StartTime:           aws.Time(time.Now()),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting the spot prices: %w", err)
+	}
+	// The history is newest first, so the first price of a zone is its current one.
+	prices := map[string]float64{}
+	for _, p := range out.SpotPriceHistory {
+		key := string(p.InstanceType) + " " + aws.ToString(p.AvailabilityZone)
+		if _, ok := prices[key]; ok {
+			continue
+		}
+		if v, err := strconv.ParseFloat(aws.ToString(p.SpotPrice), 64); err == nil {
+			prices[key] = v
+		}
+	}
+	return prices, nil
+}
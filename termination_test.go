@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"aws-vmcreate/pkg/vmcreate/vmcreatetest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeTerminationOrder answers the termination policies' lookups from its
+// statuses and spot prices.
+type fakeTerminationOrder struct {
+	fakeInstanceStatus
+	prices []types.SpotPrice
+}
+
+func (f *fakeTerminationOrder) DescribeSpotPriceHistory(ctx context.Context, params *ec2.DescribeSpotPriceHistoryInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSpotPriceHistoryOutput, error) {
+	return &ec2.DescribeSpotPriceHistoryOutput{SpotPriceHistory: f.prices}, nil
+}
+
+func TestTerminationOrder(t *testing.T) {
+	var instances []types.Instance
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	zones := []string{"us-east-1a", "us-east-1b", "us-east-1c", "us-east-1b"}
+	for n, id := range []string{"i-1", "i-2", "i-3", "i-4"} {
+		i := tagged("app", "worker")
+		i.InstanceId, i.InstanceType = aws.String(id), "m5.large"
+		i.Placement = &types.Placement{AvailabilityZone: aws.String(zones[n])}
+		// i-4 was launched first and i-1 last.
+		i.LaunchTime = aws.Time(now.Add(-time.Duration(n) * time.Minute))
+		instances = append(instances, i)
+	}
+	phases := map[string]lifecyclePhase{"i-1": phaseReady, "i-2": phaseDraining, "i-3": phaseLaunching, "i-4": phaseReady}
+	system, instance := checks(types.SummaryStatusOk, types.SummaryStatusImpaired)
+	api := &fakeTerminationOrder{
+		fakeInstanceStatus: fakeInstanceStatus{FakeEC2: vmcreatetest.NewFakeEC2(), statuses: []types.InstanceStatus{
+			{InstanceId: aws.String("i-1"), SystemStatus: system, InstanceStatus: instance},
+		}},
+		prices: []types.SpotPrice{
+			{InstanceType: "m5.large", AvailabilityZone: aws.String("us-east-1a"), SpotPrice: aws.String("0.040")},
+			{InstanceType: "m5.large", AvailabilityZone: aws.String("us-east-1b"), SpotPrice: aws.String("0.031")},
+			// An older price of the zone.
+			{InstanceType: "m5.large", AvailabilityZone: aws.String("us-east-1a"), SpotPrice: aws.String("0.010")},
+		},
+	}
+
+	for policy, want := range map[string]string{
+		"oldest-first":      "i-4,i-3,i-2,i-1",
+		"newest-first":      "i-1,i-2,i-3,i-4",
+		"drain":             "i-2,i-3,i-1,i-4",
+		"unhealthy-first":   "i-1,i-4,i-3,i-2",
+		"cheapest-az-first": "i-4,i-2,i-1,i-3",
+	} {
+		ordered, err := terminationOrder(context.Background(), api, instances, phases, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(instanceIDs(ordered), ","); got != want {
+			t.Errorf("%s order = %s, want %s", policy, got, want)
+		}
+	}
+}
+
+func TestDeleteCount(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{})
+	var ids []string
+	for n := 0; n < 3; n++ {
+		i := tagged("app", "worker")
+		i.LaunchTime = aws.Time(time.Date(2024, 5, 1, n, 0, 0, 0, time.UTC))
+		ids = append(ids, fake.AddInstance(i))
+	}
+
+	out := runCLI(t, "delete", "--tag", "app=worker", "--count", "2", "--termination-policy", "newest-first")
+	live := liveInstances(fake)
+	if len(live) != 1 || aws.ToString(live[0].InstanceId) != ids[0] {
+		t.Errorf("delete --count 2 left %v, want the oldest\n%s", instanceIDs(live), out)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// commandContext is the context of the AWS calls and waits of create and
+// delete, with the deadline of --create-timeout or --delete-timeout. The
+// records they keep, the notifications and a rollback still go out once it
+// has expired.
+var commandContext = context.Background()
+
+// waitTimeout, from --wait-timeout, bounds every wait of a command, such
+// as for an instance to run or a target to drain.
+var waitTimeout time.Duration
+
+// boundedWait returns the timeout of a wait, d cut to --wait-timeout. A
+// zero d, the wait's default, is cut too.
+func boundedWait(d time.Duration) time.Duration {
+	if waitTimeout > 0 && (d == 0 || waitTimeout < d) {
+		return waitTimeout
+	}
+	return d
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBoundedWait(t *testing.T) {
+	defer func(previous time.Duration) { waitTimeout = previous }(waitTimeout)
+	for _, tc := range []struct {
+		limit, wait, want time.Duration
+	}{
+		{0, 10 * time.Minute, 10 * time.Minute},
+		{time.Minute, 10 * time.Minute, time.Minute},
+		{time.Hour, 10 * time.Minute, 10 * time.Minute},
+		{time.Minute, 0, time.Minute},
+	} {
+		waitTimeout = tc.limit
+		if got := boundedWait(tc.wait); got != tc.want {
+			t.Errorf("boundedWait(%s) with --wait-timeout %s = %s, want %s", tc.wait, tc.limit, got, tc.want)
+		}
+	}
+}
+
+func TestCreateTimeoutSetsTheDeadline(t *testing.T) {
+	useFakeEC2(t)
+	useConfig(t, ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1"})
+
+	start := time.Now()
+	runCLI(t, "create", "--tag", "Name=web-1", "--create-timeout", "1h")
+	deadline, ok := commandContext.Deadline()
+	if !ok || deadline.Before(start.Add(59*time.Minute)) {
+		t.Errorf("deadline %s, %v", deadline, ok)
+	}
+
+	// The next command starts without it.
+	runCLI(t, "delete", "--tag", "Name=web-1")
+	if _, ok := commandContext.Deadline(); ok {
+		t.Error("delete kept the deadline of create")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"aws-vmcreate/internal/telemetry"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// commandSpan traces the command being run. Long-running commands have none;
+// the daemon traces each reconcile and the API server each request.
+var commandSpan *telemetry.Span
+
+// commandErr is the failure reported for the command, marking its span.
+// A command that ends with one exits with 1.
+var commandErr error
+
+// commandEnded is set once endCommand has run for the command.
+var commandEnded bool
+
+// longRunning is set for the daemon and the API server, which go on after
+// the failures of what they do.
+var longRunning bool
+
+// osExit is os.Exit, which the tests replace to see the exit code.
+var osExit = os.Exit
+
+// addTelemetry traces every call made by the SDK clients and records the
+// API latency, API errors and the instances launched and terminated.
+func addTelemetry(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("Telemetry", func(
+		c context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+	) (middleware.InitializeOutput, middleware.Metadata, error) {
+		service, operation := awsmiddleware.GetServiceID(c), awsmiddleware.GetOperationName(c)
+		c, span := telemetry.Start(c, service+"."+operation, telemetry.KindClient,
+			telemetry.String("rpc.system", "aws-api"),
+			telemetry.String("rpc.service", service),
+			telemetry.String("rpc.method", operation),
+			telemetry.String("cloud.region", awsmiddleware.GetRegion(c)),
+		)
+		start := time.Now()
+		out, metadata, err := next.HandleInitialize(c, in)
+
+		attrs := []telemetry.Attr{telemetry.String("rpc.service", service), telemetry.String("rpc.method", operation)}
+		telemetry.Record("aws.api.latency", float64(time.Since(start).Microseconds())/1000, attrs...)
+		if id, ok := awsmiddleware.GetRequestIDMetadata(metadata); ok {
+			span.SetAttributes(telemetry.String("aws.request_id", id))
+		}
+		if attempts, ok := retry.GetAttemptResults(metadata); ok {
+			span.SetAttributes(telemetry.Int("aws.attempts", len(attempts.Results)))
+		}
+		if err != nil {
+			code := "unknown"
+			var apiErr smithy.APIError
+			if errors.As(err, &apiErr) {
+				code = apiErr.ErrorCode()
+			}
+			telemetry.Count("aws.api.errors", 1, append(attrs, telemetry.String("error.code", code))...)
+		}
+		switch result := out.Result.(type) {
+		case *ec2.RunInstancesOutput:
+			telemetry.Count("vmcreate.instances.created", int64(len(result.Instances)))
+		case *ec2.TerminateInstancesOutput:
+			telemetry.Count("vmcreate.instances.terminated", int64(len(result.TerminatingInstances)))
+		}
+		span.End(err)
+		return out, metadata, err
+	}), middleware.After)
+}
+
+// recordEvent counts a create or delete outcome, and a failure fails the
+// command, unless it is long-running.
+func recordEvent(event *Event) {
+	auditInstances(event.InstanceIDs)
+	resultInstanceIDs(event.InstanceIDs)
+	telemetry.Count("vmcreate.commands", 1, telemetry.String("command", event.Command), telemetry.String("status", event.Status))
+	if event.Status == "failure" {
+		if !longRunning {
+			commandErr = errors.New(event.Error)
+		}
+		telemetry.Count("vmcreate.failures", 1, telemetry.String("command", event.Command))
+	}
+}
+
+// startCommand begins the span of a command run.
+func startCommand(command string) {
+	commandErr, commandEnded = nil, false
+	if longRunning = command == "daemon" || command == "serve" || command == "grpc-serve"; longRunning {
+		return
+	}
+	commandSpan = telemetry.StartCommand("aws-vmcreate "+command, telemetry.String("command", command))
+}
+
+// endCommand releases the fleet locks, writes the audit record, the CI
+// outputs and the result file, ends the command span and exports the telemetry.
+func endCommand() {
+	if commandEnded {
+		return
+	}
+	commandEnded = true
+	releaseFleetLocks()
+	writeAudit(commandErr)
+	writeCIOutput(commandErr)
+	writeResultFile(commandErr)
+	commandSpan.End(commandErr)
+	flushTelemetry()
+}
+
+// exit ends the command as failed and exits with code.
+func exit(code int) {
+	if commandErr == nil {
+		commandErr = fmt.Errorf("exit status %d", code)
+	}
+	endCommand()
+	osExit(code)
+}
+
+func flushTelemetry() {
+	c, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := telemetry.Flush(c, awsConfig.HTTPClient); err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error exporting telemetry:")
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// flushTelemetryEvery exports the telemetry of a long-running command until c
+// is done.
+func flushTelemetryEvery(c context.Context, interval time.Duration) {
+	if !telemetry.Enabled() {
+		return
+	}
+	for {
+		select {
+		case <-c.Done():
+			return
+		case <-time.After(interval):
+			flushTelemetry()
+		}
+	}
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// traceHTTP traces each request served by h.
+func traceHTTP(h http.Handler) http.Handler {
+	if !telemetry.Enabled() {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, span := telemetry.Start(r.Context(), "HTTP "+r.Method, telemetry.KindServer,
+			telemetry.String("http.method", r.Method),
+			telemetry.String("http.target", r.URL.Path),
+		)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r.WithContext(c))
+
+		span.SetAttributes(telemetry.Int("http.status_code", rec.status))
+		var err error
+		if rec.status >= 500 {
+			err = errors.New(http.StatusText(rec.status))
+		}
+		span.End(err)
+	})
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+var cloudWatchClient *awsapi.CloudWatch
+
+// CloudWatchAPI defines the interface for the GetMetricData function.
+// We use this interface to test the functions using a mocked service.
+type CloudWatchAPI interface {
+	GetMetricData(ctx context.Context, params *awsapi.GetMetricDataInput) (*awsapi.GetMetricDataOutput, error)
+}
+
+// fetchCPU returns the latest average CPU utilization of the running
+// instances, keyed by instance id. Instances without datapoints, such as
+// those launched in the last few minutes, are missing.
+func fetchCPU(c context.Context, api CloudWatchAPI, instances []types.Instance, now time.Time) (map[string]float64, error) {
+	cpu := map[string]float64{}
+	ids := map[string]string{}
+	var queries []awsapi.MetricDataQuery
+	for _, i := range instances {
+		if i.State == nil || i.State.Name != types.InstanceStateNameRunning {
+			continue
+		}
+		id := fmt.Sprintf("cpu%d", len(queries))
+		ids[id] = aws.ToString(i.InstanceId)
+		queries = append(queries, awsapi.MetricDataQuery{
+			Id:         id,
+			Namespace:  "AWS/EC2",
+			MetricName: "CPUUtilization",
+			Dimensions: []awsapi.Dimension{{Name: "InstanceId", Value: aws.ToString(i.InstanceId)}},
+			Period:     5 * time.Minute,
+			Stat:       "Average",
+		})
+	}
+
+	// GetMetricData takes at most 500 queries.
+	for len(queries) > 0 {
+		batch := queries
+		if len(batch) > 500 {
+			batch = batch[:500]
+		}
+		queries = queries[len(batch):]
+
+		input := &awsapi.GetMetricDataInput{Queries: batch, StartTime: now.Add(-15 * time.Minute), EndTime: now}
+		for {
+			result, err := api.GetMetricData(c, input)
+			if err != nil {
+				return cpu, err
+			}
+			for _, r := range result.MetricDataResults {
+				if _, seen := cpu[ids[r.Id]]; !seen && len(r.Values) > 0 {
+					cpu[ids[r.Id]] = r.Values[0]
+				}
+			}
+			if result.NextToken == "" {
+				break
+			}
+			input.NextToken = result.NextToken
+		}
+	}
+	return cpu, nil
+}
+
+// tuiState is what the tui shows and the instance the keys act on.
+type tuiState struct {
+	Instances []types.Instance
+	CPU       map[string]float64
+	Selected  string
+	Updated   time.Time
+	// Status is the outcome of the last action or refresh.
+	Status string
+	// Confirm is the instance waiting for a y to be terminated.
+	Confirm string
+}
+
+// setInstances replaces the instances, keeping the selection on the same
+// instance when it is still there.
+func (s *tuiState) setInstances(instances []types.Instance) {
+	sort.SliceStable(instances, func(a, b int) bool {
+		na, nb := vmcreate.TagValue(&instances[a], "Name"), vmcreate.TagValue(&instances[b], "Name")
+		if na != nb {
+			return na < nb
+		}
+		return aws.ToString(instances[a].InstanceId) < aws.ToString(instances[b].InstanceId)
+	})
+	s.Instances = instances
+	if s.selectedIndex() < 0 {
+		s.Selected = ""
+		if len(instances) > 0 {
+			s.Selected = aws.ToString(instances[0].InstanceId)
+		}
+	}
+}
+
+func (s *tuiState) selectedIndex() int {
+	for n := range s.Instances {
+		if aws.ToString(s.Instances[n].InstanceId) == s.Selected {
+			return n
+		}
+	}
+	return -1
+}
+
+func (s *tuiState) move(delta int) {
+	n := s.selectedIndex() + delta
+	if n >= 0 && n < len(s.Instances) {
+		s.Selected = aws.ToString(s.Instances[n].InstanceId)
+	}
+}
+
+// formatUptime returns d as e.g. 3d4h, 5h12m or 42m.
+func formatUptime(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd%dh", int(d.Hours())/24, int(d.Hours())%24)
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh%dm", int(d.Hours()), int(d.Minutes())%60)
+	default:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	}
+}
+
+// instanceColumns returns the table columns of the instance, with the
+// uptime and cost since it was last started when it is running.
+func instanceColumns(i *types.Instance, cpu map[string]float64, now time.Time) []string {
+	state, uptime, cpuText, cost := "", "-", "-", "-"
+	if i.State != nil {
+		state = string(i.State.Name)
+	}
+	ip := firstNonEmpty(aws.ToString(i.PublicIpAddress), aws.ToString(i.PrivateIpAddress), "-")
+	price, priced := hourlyPrice(string(i.InstanceType))
+	hourly := "-"
+	if priced {
+		hourly = fmt.Sprintf("$%.4f", price)
+	}
+	if state == string(types.InstanceStateNameRunning) {
+		up := now.Sub(aws.ToTime(i.LaunchTime))
+		uptime = formatUptime(up)
+		if priced {
+			cost = fmt.Sprintf("$%.2f", price*up.Hours())
+		}
+		if v, ok := cpu[aws.ToString(i.InstanceId)]; ok {
+			cpuText = fmt.Sprintf("%.1f%%", v)
+		}
+	}
+	return []string{
+		aws.ToString(i.InstanceId),
+		firstNonEmpty(vmcreate.TagValue(i, "Name"), "-"),
+		state,
+		string(i.InstanceType),
+		ip,
+		cpuText,
+		uptime,
+		hourly,
+		cost,
+	}
+}
+
+// renderTUI draws the screen, the selected instance in reverse video.
+func renderTUI(w io.Writer, s *tuiState, region string, now time.Time) {
+	var table bytes.Buffer
+	tw := tabwriter.NewWriter(&table, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "INSTANCE\tNAME\tSTATE\tTYPE\tIP\tCPU\tUPTIME\t$/HOUR\tCOST")
+	for n := range s.Instances {
+		fmt.Fprintln(tw, strings.Join(instanceColumns(&s.Instances[n], s.CPU, now), "\t"))
+	}
+	tw.Flush()
+
+	var screen strings.Builder
+	screen.WriteString("\x1b[H\x1b[2J")
+	fmt.Fprintf(&screen, "aws-vmcreate  %s  %d instances  updated %s\r\n\r\n", region, len(s.Instances), s.Updated.Format("15:04:05"))
+	selected := s.selectedIndex()
+	for n, line := range strings.Split(strings.TrimSuffix(table.String(), "\n"), "\n") {
+		if n == selected+1 {
+			line = "\x1b[7m" + line + "\x1b[0m"
+		}
+		screen.WriteString(line + "\r\n")
+	}
+	screen.WriteString("\r\n↑/↓ select  s stop  r start  t terminate  c ssh  q quit\r\n")
+	if s.Status != "" {
+		screen.WriteString(s.Status + "\r\n")
+	}
+	io.WriteString(w, screen.String())
+}
+
+// tuiAction is what the tui does after a key press.
+type tuiAction int
+
+const (
+	tuiRedraw tuiAction = iota
+	// tuiRefresh lists the instances again, after one changed state.
+	tuiRefresh
+	tuiConnect
+	tuiQuit
+)
+
+// handleKey applies a key press to the selected instance.
+func (s *tuiState) handleKey(c context.Context, key string) tuiAction {
+	if s.Confirm != "" {
+		id := s.Confirm
+		s.Confirm = ""
+		if key != "y" && key != "Y" {
+			s.Status = "Kept " + id
+			return tuiRedraw
+		}
+		if _, err := provisioner.Delete(c, []string{id}); err != nil {
+			s.Status = "Got an error terminating " + id + ": " + err.Error()
+			return tuiRedraw
+		}
+		recordLifecycle(c, "tui", instancesOf([]string{id}), "", phaseTerminated, "")
+		s.Status = "Terminating " + id
+		return tuiRefresh
+	}
+
+	switch key {
+	case "q", "\x03":
+		return tuiQuit
+	case "k", "\x1b[A":
+		s.move(-1)
+	case "j", "\x1b[B":
+		s.move(1)
+	}
+	if s.Selected == "" {
+		return tuiRedraw
+	}
+	switch key {
+	case "s":
+		if err := provisioner.Stop(c, []string{s.Selected}); err != nil {
+			s.Status = "Got an error stopping " + s.Selected + ": " + err.Error()
+		} else {
+			s.Status = "Stopping " + s.Selected
+			return tuiRefresh
+		}
+	case "r":
+		if err := provisioner.Start(c, []string{s.Selected}); err != nil {
+			s.Status = "Got an error starting " + s.Selected + ": " + err.Error()
+		} else {
+			s.Status = "Starting " + s.Selected
+			return tuiRefresh
+		}
+	case "t":
+		s.Confirm = s.Selected
+		s.Status = "Terminate " + s.Selected + "? (y/n)"
+	case "c", "\r", "\n":
+		return tuiConnect
+	}
+	return tuiRedraw
+}
+
+// refresh lists the instances and their CPU utilization.
+func (s *tuiState) refresh(c context.Context, filters []types.Filter) {
+	instances, err := provisioner.List(c, filters...)
+	if err != nil {
+		s.Status = "Got an error listing the instances: " + err.Error()
+		return
+	}
+	s.setInstances(instances)
+	s.Updated = time.Now()
+	s.CPU, err = fetchCPU(c, cloudWatchClient, instances, s.Updated)
+	if err != nil {
+		s.Status = "Got an error fetching the CPU utilization: " + err.Error()
+	}
+}
+
+// stty runs stty on the terminal with args and returns its output.
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// rawTerminal switches the terminal to reading single key presses without
+// echo, on the alternate screen, and returns the function restoring it.
+func rawTerminal() (func(), error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("-icanon", "-echo", "min", "1"); err != nil {
+		return nil, err
+	}
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	return func() {
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		stty(saved)
+	}, nil
+}
+
+func TUICmd(name *string, value *string, refresh *time.Duration, osUser *string, usePrivateIP *bool) {
+	// Without a tag, the instances created by aws-vmcreate are shown.
+	filters := []types.Filter{vmcreate.StateFilter(vmcreate.LiveStates...), vmcreate.TagKeyFilter(createdByTag)}
+	if *name != "" && *value != "" {
+		filters[1] = vmcreate.TagFilter(*name, strings.Split(*value, ",")...)
+	} else if *name != "" {
+		filters[1] = vmcreate.TagKeyFilter(*name)
+	}
+
+	restore, err := rawTerminal()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error setting up the terminal:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+	defer func() { restore() }()
+
+	// The keys are read one press at a time, so that nothing is read from
+	// the terminal while ssh has it.
+	keys := make(chan string)
+	next := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, 16)
+		for range next {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- string(buf[:n])
+		}
+	}()
+	next <- true
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	ticker := time.NewTicker(*refresh)
+	defer ticker.Stop()
+	state := &tuiState{}
+	state.refresh(context.TODO(), filters)
+	for {
+		renderTUI(os.Stdout, state, awsConfig.Region, time.Now())
+		select {
+		case <-interrupt:
+			return
+		case <-ticker.C:
+			state.refresh(context.TODO(), filters)
+		case key, ok := <-keys:
+			if !ok {
+				return
+			}
+			switch state.handleKey(context.TODO(), key) {
+			case tuiQuit:
+				return
+			case tuiRefresh:
+				state.refresh(context.TODO(), filters)
+			case tuiConnect:
+				restore()
+				instanceID := state.Selected
+				ConnectInstanceCmd(&instanceID, osUser, usePrivateIP)
+				fmt.Print("Press Enter to return to the instances")
+				os.Stdin.Read(make([]byte, 64))
+				if restore, err = rawTerminal(); err != nil {
+					restore = func() {}
+					fmt.Fprintln(os.Stderr, "Got an error setting up the terminal:")
+					fmt.Fprintln(os.Stderr, err)
+					commandErr = err
+					return
+				}
+			}
+			next <- true
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+type fakeCloudWatch struct {
+	queries []awsapi.MetricDataQuery
+	err     error
+}
+
+func (f *fakeCloudWatch) GetMetricData(ctx context.Context, params *awsapi.GetMetricDataInput) (*awsapi.GetMetricDataOutput, error) {
+	f.queries = append(f.queries, params.Queries...)
+	if f.err != nil {
+		return nil, f.err
+	}
+	out := &awsapi.GetMetricDataOutput{}
+	for _, q := range params.Queries {
+		out.MetricDataResults = append(out.MetricDataResults, awsapi.MetricDataResult{Id: q.Id, Values: []float64{42.5, 10}})
+	}
+	return out, nil
+}
+
+func TestFetchCPU(t *testing.T) {
+	running := &types.InstanceState{Name: types.InstanceStateNameRunning}
+	instances := []types.Instance{
+		{InstanceId: aws.String("i-run"), State: running},
+		{InstanceId: aws.String("i-stopped"), State: &types.InstanceState{Name: types.InstanceStateNameStopped}},
+	}
+	api := &fakeCloudWatch{}
+	cpu, err := fetchCPU(context.Background(), api, instances, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(api.queries) != 1 || api.queries[0].Dimensions[0].Value != "i-run" {
+		t.Errorf("queried %+v", api.queries)
+	}
+	if v, ok := cpu["i-run"]; !ok || v != 42.5 {
+		t.Errorf("cpu = %v, want the newest datapoint", cpu)
+	}
+
+	if _, err := fetchCPU(context.Background(), &fakeCloudWatch{err: errors.New("AccessDenied")}, instances, time.Now()); err == nil {
+		t.Error("want the CloudWatch error")
+	}
+}
+
+func TestTUI(t *testing.T) {
+	fake := useFakeEC2(t)
+	now := time.Now()
+	web := fake.AddInstance(types.Instance{InstanceType: "t3.micro", LaunchTime: aws.Time(now.Add(-26 * time.Hour)), PublicIpAddress: aws.String("203.0.113.7"), Tags: tagged("Name", "web").Tags})
+	db := fake.AddInstance(types.Instance{InstanceType: "m7i.large", LaunchTime: aws.Time(now.Add(-90 * time.Minute)), Tags: tagged("Name", "db").Tags})
+	ctx := context.Background()
+
+	state := &tuiState{CPU: map[string]float64{web: 12.34}}
+	instances, _ := provisioner.List(ctx)
+	state.setInstances(instances)
+	if state.Selected != db {
+		t.Fatalf("selected %s, want the first by name", state.Selected)
+	}
+
+	var screen strings.Builder
+	renderTUI(&screen, state, "us-east-1", now)
+	out := screen.String()
+	for _, want := range []string{"203.0.113.7", "12.3%", "1d2h", "$0.27", "1h30m", "\x1b[7m" + db} {
+		if !strings.Contains(out, want) {
+			t.Errorf("screen does not show %q:\n%s", want, out)
+		}
+	}
+
+	state.handleKey(ctx, "j")
+	if state.Selected != web {
+		t.Fatalf("selected %s after moving down", state.Selected)
+	}
+	if action := state.handleKey(ctx, "s"); action != tuiRefresh || fake.Instance(web).State.Name != types.InstanceStateNameStopped {
+		t.Errorf("stop: action %v, %s is %s", action, web, fake.Instance(web).State.Name)
+	}
+	if action := state.handleKey(ctx, "t"); action != tuiRedraw || fake.Instance(web).State.Name == types.InstanceStateNameTerminated {
+		t.Error("terminated without a confirmation")
+	}
+	state.handleKey(ctx, "n")
+	if fake.Instance(web).State.Name == types.InstanceStateNameTerminated {
+		t.Error("terminated after the confirmation was declined")
+	}
+	state.handleKey(ctx, "t")
+	if action := state.handleKey(ctx, "y"); action != tuiRefresh || fake.Instance(web).State.Name != types.InstanceStateNameTerminated {
+		t.Errorf("terminate: action %v, %s is %s", action, web, fake.Instance(web).State.Name)
+	}
+	if state.handleKey(ctx, "c") != tuiConnect || state.handleKey(ctx, "q") != tuiQuit {
+		t.Error("c and q are not connect and quit")
+	}
+}
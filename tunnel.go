@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"aws-vmcreate/internal/awsapi"
+)
+
+var ssmClient *awsapi.SSM
+
+// SSMSessionAPI defines the interface for the StartSession function.
+// We use this interface to test the functions using a mocked service.
+type SSMSessionAPI interface {
+	StartSession(ctx context.Context,
+		params *awsapi.StartSessionInput) (*awsapi.StartSessionOutput, error)
+}
+
+// OpenSession starts an AWS Systems Manager session to an Amazon Elastic Compute Cloud (Amazon EC2) instance.
+// Inputs:
+//
+//	c is the context of the method call, which includes the AWS Region.
+//	api is the interface that defines the method call.
+//	input defines the input arguments to the service call.
+//
+// Output:
+//
+//	If success, a StartSessionOutput object containing the result of the service call and nil.
+//	Otherwise, nil and an error from the call to StartSession.
+func OpenSession(c context.Context, api SSMSessionAPI, input *awsapi.StartSessionInput) (*awsapi.StartSessionOutput, error) {
+	return api.StartSession(c, input)
+}
+
+// runSessionPlugin hands an open session over to the session-manager-plugin,
+// the same way the AWS CLI does, and blocks until the plugin exits.
+func runSessionPlugin(session *awsapi.StartSessionOutput, input *awsapi.StartSessionInput) error {
+	sessionJSON, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	inputJSON, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("session-manager-plugin",
+		string(sessionJSON),
+		ssmClient.Region(),
+		"StartSession",
+		"",
+		string(inputJSON),
+		ssmClient.Endpoint())
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func TunnelInstanceCmd(instanceID *string, remotePort *int, localPort *int) {
+	if *localPort == 0 {
+		*localPort = *remotePort
+	}
+
+	input := &awsapi.StartSessionInput{
+		Target:       *instanceID,
+		DocumentName: "AWS-StartPortForwardingSession",
+		Parameters: map[string][]string{
+			"portNumber":      {strconv.Itoa(*remotePort)},
+			"localPortNumber": {strconv.Itoa(*localPort)},
+		},
+	}
+
+	session, err := OpenSession(context.TODO(), ssmClient, input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error starting the session:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+
+	progressln(fmt.Sprintf("Forwarding localhost:%d to %s:%d (session %s)", *localPort, *instanceID, *remotePort, session.SessionId))
+	if err := runSessionPlugin(session, input); err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error from the session-manager-plugin:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+	}
+}
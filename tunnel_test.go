@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+// useFakeSessions points ssmClient at a server that opens a session on every
+// StartSession, and returns the sessions asked for.
+func useFakeSessions(t *testing.T) *[]awsapi.StartSessionInput {
+	t.Helper()
+	var started []awsapi.StartSessionInput
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if target := r.Header.Get("X-Amz-Target"); target != "AmazonSSM.StartSession" {
+			t.Errorf("unexpected call %s", target)
+			http.Error(w, `{"__type": "UnknownOperationException"}`, http.StatusBadRequest)
+			return
+		}
+		var input awsapi.StartSessionInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			t.Error(err)
+		}
+		started = append(started, input)
+		json.NewEncoder(w).Encode(awsapi.StartSessionOutput{SessionId: "sess-1", StreamUrl: "wss://ssm/sess-1", TokenValue: "token"})
+	}))
+	t.Cleanup(server.Close)
+
+	previous := ssmClient
+	t.Cleanup(func() { ssmClient = previous })
+	ssmClient = awsapi.NewSSM(aws.Config{
+		Region:                      "eu-west-1",
+		Credentials:                 credentials.NewStaticCredentialsProvider("AKIDTEST", "secret", ""),
+		EndpointResolverWithOptions: endpointResolver(server.URL, nil),
+	})
+	return &started
+}
+
+func TestTunnelCommand(t *testing.T) {
+	useFakeEC2(t)
+	started := useFakeSessions(t)
+	args := fakeCommand(t, "session-manager-plugin", 0)
+
+	stdout, stderr, code := runCLIExit(t, false, "tunnel", "i-0123", "--remote-port", "5432", "--local-port", "15432")
+	if code != 0 {
+		t.Fatalf("exit code %d:\n%s", code, stderr)
+	}
+	// The forwarding is progress; stdout is the plugin's.
+	if stdout != "" || !strings.Contains(stderr, "Forwarding localhost:15432 to i-0123:5432 (session sess-1)") {
+		t.Errorf("stdout:\n%s\nstderr:\n%s", stdout, stderr)
+	}
+	if len(*started) != 1 {
+		t.Fatalf("started %+v", *started)
+	}
+	s := (*started)[0]
+	if s.Target != "i-0123" || s.DocumentName != "AWS-StartPortForwardingSession" ||
+		s.Parameters["portNumber"][0] != "5432" || s.Parameters["localPortNumber"][0] != "15432" {
+		t.Errorf("started %+v", s)
+	}
+
+	// The plugin is handed the session like the AWS CLI does: the session,
+	// region, operation, profile, request and endpoint.
+	got := readArgs(t, args)
+	if len(got) != 6 || !strings.Contains(got[0], `"SessionId":"sess-1"`) || got[1] != "eu-west-1" ||
+		got[2] != "StartSession" || got[3] != "" || !strings.Contains(got[4], `"Target":"i-0123"`) || got[5] != ssmClient.Endpoint() {
+		t.Errorf("session-manager-plugin %q", got)
+	}
+
+	// A plugin that fails fails the command.
+	fakeCommand(t, "session-manager-plugin", 1)
+	if _, stderr, code := runCLIExit(t, false, "tunnel", "i-0123", "--remote-port", "5432"); code != 1 || !strings.Contains(stderr, "Got an error from the session-manager-plugin:") {
+		t.Errorf("exit code %d:\n%s", code, stderr)
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+// buildUserData joins the boot scripts of the enabled presets into a single
+// shell script and returns it base64 encoded for RunInstances, or nil when
+// no preset needs one.
+func buildUserData(parts []string) *string {
+	if len(parts) == 0 {
+		return nil
+	}
+	script := "#!/bin/bash\nset -x\n\n" + strings.Join(parts, "\n")
+	encoded := base64.StdEncoding.EncodeToString([]byte(script))
+	return &encoded
+}
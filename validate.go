@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+var serviceQuotasClient *awsapi.ServiceQuotas
+
+// ServiceQuotasAPI defines the interface for the GetServiceQuota function.
+// We use this interface to test the functions using a mocked service.
+type ServiceQuotasAPI interface {
+	GetServiceQuota(ctx context.Context, params *awsapi.GetServiceQuotaInput) (*awsapi.GetServiceQuotaOutput, error)
+}
+
+// ValidateEC2API defines the interface for the functions validate checks the
+// launch settings with.
+// We use this interface to test the functions using a mocked service.
+type ValidateEC2API interface {
+	EC2InstanceTypesAPI
+	ec2.DescribeInstancesAPIClient
+
+	DescribeRegions(ctx context.Context,
+		params *ec2.DescribeRegionsInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error)
+
+	DescribeImages(ctx context.Context,
+		params *ec2.DescribeImagesInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeImagesOutput, error)
+
+	DescribeSubnets(ctx context.Context,
+		params *ec2.DescribeSubnetsInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeSubnetsOutput, error)
+
+	DescribeVpcs(ctx context.Context,
+		params *ec2.DescribeVpcsInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeVpcsOutput, error)
+
+	DescribeSecurityGroups(ctx context.Context,
+		params *ec2.DescribeSecurityGroupsInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeSecurityGroupsOutput, error)
+
+	DescribeKeyPairs(ctx context.Context,
+		params *ec2.DescribeKeyPairsInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeKeyPairsOutput, error)
+
+	DescribeInstanceTypeOfferings(ctx context.Context,
+		params *ec2.DescribeInstanceTypeOfferingsInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceTypeOfferingsOutput, error)
+}
+
+// validationCheck is the outcome of one check. A warning is a check that
+// could not be made, which does not fail the validation.
+type validationCheck struct {
+	Name    string
+	Detail  string
+	Err     error
+	Warning bool
+}
+
+// launchSettings are the settings a create would launch with.
+type launchSettings struct {
+	Region           string
+	InstanceType     string
+	ImageID          string
+	SubnetID         string
+	SecurityGroupIDs []string
+	KeyName          string
+	Count            int
+	// GPUDrivers installs the NVIDIA drivers at boot, so the image need not have them.
+	GPUDrivers bool
+}
+
+// vcpuQuotas are the Service Quotas codes of the running On-Demand vCPU
+// limits, keyed by the instance family letters they cover.
+var vcpuQuotas = []struct {
+	Families []string
+	Code     string
+	Name     string
+}{
+	{[]string{"a", "c", "d", "h", "i", "m", "r", "t", "z"}, "L-1216C47A", "Standard (A, C, D, H, I, M, R, T, Z)"},
+	{[]string{"g", "vt"}, "L-DB2E81BA", "G and VT"},
+	{[]string{"p"}, "L-417A185B", "P"},
+	{[]string{"inf"}, "L-1945791B", "Inf"},
+	{[]string{"x"}, "L-7295265B", "X"},
+	{[]string{"f"}, "L-74FC7D96", "F"},
+}
+
+// quotaClass returns the letters of the instance type's family, which
+// decide its vCPU quota, e.g. "inf" for inf2.xlarge and "m" for m6i.large.
+func quotaClass(instanceType string) string {
+	family, _, _ := strings.Cut(instanceType, ".")
+	if i := strings.IndexFunc(family, unicode.IsDigit); i >= 0 {
+		family = family[:i]
+	}
+	return family
+}
+
+// validateLaunch checks, without creating anything, that a create with the
+// settings would succeed: the credentials, region, instance type, image,
+// network, key pair and vCPU quota.
+func validateLaunch(c context.Context, api ValidateEC2API, quotas ServiceQuotasAPI, s launchSettings) []validationCheck {
+	var checks []validationCheck
+	add := func(check validationCheck) { checks = append(checks, check) }
+
+	principal, err := lookupPrincipal(c)
+	if err != nil {
+		add(validationCheck{Name: "credentials", Err: err})
+		// Every other check would fail the same way.
+		return checks
+	}
+	add(validationCheck{Name: "credentials", Detail: principal})
+
+	regions, err := api.DescribeRegions(c, &ec2.DescribeRegionsInput{AllRegions: aws.Bool(true), RegionNames: []string{s.Region}})
+	switch {
+	case err != nil:
+		add(validationCheck{Name: "region", Err: err})
+	case len(regions.Regions) == 0:
+		add(validationCheck{Name: "region", Err: fmt.Errorf("%s is not a region", s.Region)})
+	case aws.ToString(regions.Regions[0].OptInStatus) == "not-opted-in":
+		add(validationCheck{Name: "region", Err: fmt.Errorf("%s is not enabled for the account", s.Region)})
+	default:
+		add(validationCheck{Name: "region", Detail: s.Region})
+	}
+
+	instanceType, err := findInstanceType(c, api, s.Region, s.InstanceType)
+	if err != nil {
+		add(validationCheck{Name: "instance type", Err: err})
+	} else {
+		add(validationCheck{Name: "instance type", Detail: fmt.Sprintf("%s, %d vCPUs, %g GiB", instanceType.Name, instanceType.VCPUs, float64(instanceType.MemoryMiB)/1024)})
+	}
+
+	add(validateImage(c, api, s.ImageID, instanceType))
+	if instanceType != nil {
+		checks = append(checks, acceleratorChecks(c, api, s, instanceType, s.GPUDrivers)...)
+	}
+	vpcID, check := validateSubnet(c, api, s.SubnetID, s.InstanceType)
+	add(check)
+	if len(s.SecurityGroupIDs) > 0 {
+		add(validateSecurityGroups(c, api, s.SecurityGroupIDs, vpcID))
+	}
+
+	if s.KeyName != "" {
+		if _, err := api.DescribeKeyPairs(c, &ec2.DescribeKeyPairsInput{KeyNames: []string{s.KeyName}}); err != nil {
+			add(validationCheck{Name: "key pair", Err: err})
+		} else {
+			add(validationCheck{Name: "key pair", Detail: s.KeyName})
+		}
+	}
+
+	if instanceType != nil {
+		add(validateQuota(c, api, quotas, s, instanceType))
+	}
+	return checks
+}
+
+// validateImage checks that the image is available and runs on the
+// instance type's architecture.
+func validateImage(c context.Context, api ValidateEC2API, imageID string, instanceType *instanceType) validationCheck {
+	check := validationCheck{Name: "image"}
+	result, err := api.DescribeImages(c, &ec2.DescribeImagesInput{ImageIds: []string{imageID}})
+	switch {
+	case err != nil:
+		check.Err = err
+	case len(result.Images) == 0:
+		check.Err = fmt.Errorf("%s does not exist or is not shared with the account", imageID)
+	case result.Images[0].State != types.ImageStateAvailable:
+		check.Err = fmt.Errorf("%s is %s", imageID, result.Images[0].State)
+	case instanceType != nil && !contains(instanceType.Architectures, string(result.Images[0].Architecture)):
+		check.Err = fmt.Errorf("%s is %s, but %s runs %s", imageID, result.Images[0].Architecture, instanceType.Name, strings.Join(instanceType.Architectures, ", "))
+	default:
+		check.Detail = imageID + " " + aws.ToString(result.Images[0].Name)
+	}
+	return check
+}
+
+// validateSubnet checks that the subnet exists and offers the instance type
+// in its availability zone, or that there is a default VPC without one. It
+// returns the VPC the instance would launch in.
+func validateSubnet(c context.Context, api ValidateEC2API, subnetID string, instanceType string) (string, validationCheck) {
+	check := validationCheck{Name: "subnet"}
+	if subnetID == "" {
+		vpcs, err := api.DescribeVpcs(c, &ec2.DescribeVpcsInput{Filters: []types.Filter{{Name: aws.String("is-default"), Values: []string{"true"}}}})
+		switch {
+		case err != nil:
+			check.Err = err
+		case len(vpcs.Vpcs) == 0:
+			check.Err = fmt.Errorf("no subnet_id is set and the region has no default VPC")
+		default:
+			check.Detail = "default VPC " + aws.ToString(vpcs.Vpcs[0].VpcId)
+			return aws.ToString(vpcs.Vpcs[0].VpcId), check
+		}
+		return "", check
+	}
+
+	subnets, err := api.DescribeSubnets(c, &ec2.DescribeSubnetsInput{SubnetIds: []string{subnetID}})
+	if err != nil {
+		check.Err = err
+		return "", check
+	}
+	if len(subnets.Subnets) == 0 {
+		check.Err = fmt.Errorf("%s does not exist", subnetID)
+		return "", check
+	}
+	subnet := subnets.Subnets[0]
+	az := aws.ToString(subnet.AvailabilityZone)
+	offerings, err := api.DescribeInstanceTypeOfferings(c, &ec2.DescribeInstanceTypeOfferingsInput{
+		LocationType: types.LocationTypeAvailabilityZone,
+		Filters: []types.Filter{
+			{Name: aws.String("location"), Values: []string{az}},
+			{Name: aws.String("instance-type"), Values: []string{instanceType}},
+		},
+	})
+	switch {
+	case err != nil:
+		check.Err = err
+	case len(offerings.InstanceTypeOfferings) == 0:
+		check.Err = fmt.Errorf("%s is in %s, which does not offer %s", subnetID, az, instanceType)
+	case aws.ToInt32(subnet.AvailableIpAddressCount) == 0:
+		check.Err = fmt.Errorf("%s has no free IP addresses", subnetID)
+	default:
+		check.Detail = fmt.Sprintf("%s in %s, %s, %d free addresses", subnetID, az, aws.ToString(subnet.VpcId), aws.ToInt32(subnet.AvailableIpAddressCount))
+	}
+	return aws.ToString(subnet.VpcId), check
+}
+
+// validateSecurityGroups checks that the security groups exist in the VPC
+// the instance launches in.
+func validateSecurityGroups(c context.Context, api ValidateEC2API, groupIDs []string, vpcID string) validationCheck {
+	check := validationCheck{Name: "security groups"}
+	groups, err := api.DescribeSecurityGroups(c, &ec2.DescribeSecurityGroupsInput{GroupIds: groupIDs})
+	if err != nil {
+		check.Err = err
+		return check
+	}
+	for _, g := range groups.SecurityGroups {
+		if vpcID != "" && aws.ToString(g.VpcId) != vpcID {
+			check.Err = fmt.Errorf("%s is in %s, not in the subnet's %s", aws.ToString(g.GroupId), aws.ToString(g.VpcId), vpcID)
+			return check
+		}
+	}
+	check.Detail = strings.Join(groupIDs, ", ")
+	return check
+}
+
+// validateQuota checks that the running On-Demand vCPU quota of the
+// instance type leaves room for the instances.
+func validateQuota(c context.Context, api ValidateEC2API, quotas ServiceQuotasAPI, s launchSettings, instanceType *instanceType) validationCheck {
+	check := validationCheck{Name: "vCPU quota"}
+	class := quotaClass(instanceType.Name)
+	var code, name string
+	var families []string
+	for _, q := range vcpuQuotas {
+		if contains(q.Families, class) {
+			code, name, families = q.Code, q.Name, q.Families
+		}
+	}
+	if code == "" {
+		check.Warning, check.Err = true, fmt.Errorf("the quota of %s instances is not known to aws-vmcreate", instanceType.Name)
+		return check
+	}
+
+	quota, err := quotas.GetServiceQuota(c, &awsapi.GetServiceQuotaInput{ServiceCode: "ec2", QuotaCode: code})
+	if err != nil {
+		check.Warning, check.Err = true, fmt.Errorf("reading the %s quota: %w", name, err)
+		return check
+	}
+
+	all, err := loadInstanceTypes(c, api, s.Region, instanceTypeCacheTTL)
+	if err != nil {
+		check.Warning, check.Err = true, err
+		return check
+	}
+	vcpus := map[string]int32{}
+	for _, t := range all {
+		vcpus[t.Name] = t.VCPUs
+	}
+	used := int32(0)
+	paginator := ec2.NewDescribeInstancesPaginator(api, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{{Name: aws.String("instance-state-name"), Values: []string{"pending", "running"}}},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(c)
+		if err != nil {
+			check.Warning, check.Err = true, err
+			return check
+		}
+		for _, r := range page.Reservations {
+			for _, i := range r.Instances {
+				if contains(families, quotaClass(string(i.InstanceType))) {
+					used += vcpus[string(i.InstanceType)]
+				}
+			}
+		}
+	}
+
+	count := s.Count
+	if count == 0 {
+		count = 1
+	}
+	needed := instanceType.VCPUs * int32(count)
+	limit := int32(quota.Quota.Value)
+	if used+needed > limit {
+		check.Err = fmt.Errorf("%s instances use %d of %d vCPUs, %d more are needed", name, used, limit, needed)
+	} else {
+		check.Detail = fmt.Sprintf("%s instances use %d of %d vCPUs, %d more are needed", name, used, limit, needed)
+	}
+	return check
+}
+
+func ValidateCmd(instanceType *string, imageID *string, subnetID *string, keyName *string) {
+	config, err := loadConfig()
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		exit(1)
+	}
+	settings := launchSettings{
+		Region:           awsConfig.Region,
+		InstanceType:     firstNonEmpty(*instanceType, config.InstanceType),
+		ImageID:          firstNonEmpty(*imageID, config.ImageId),
+		SubnetID:         firstNonEmpty(*subnetID, config.SubnetId),
+		SecurityGroupIDs: config.SecurityGroupIds,
+		KeyName:          *keyName,
+	}
+	var problems []string
+	if settings.InstanceType == "" || settings.ImageID == "" {
+		problems = append(problems, "an instance_type and image_id are required")
+	}
+	if err := validateFailover(config.RegionFailover); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		fmt.Fprintln(os.Stderr, "Error loading config:", strings.Join(problems, "; "))
+		exit(1)
+	}
+
+	checks := validateLaunch(context.TODO(), client, serviceQuotasClient, settings)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	failed := 0
+	for _, check := range checks {
+		status, detail := "ok", check.Detail
+		if check.Err != nil {
+			status, detail = "FAIL", check.Err.Error()
+			if check.Warning {
+				status = "WARN"
+			} else {
+				failed++
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", status, check.Name, detail)
+	}
+	w.Flush()
+
+	if failed > 0 {
+		fmt.Printf("%d of %d checks failed\n", failed, len(checks))
+		exit(1)
+	}
+	fmt.Printf("All %d checks passed\n", len(checks))
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"aws-vmcreate/internal/awsapi"
+	"aws-vmcreate/pkg/vmcreate/vmcreatetest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeValidateEC2 answers the describe calls of validate from its fields, and
+// instances and instance types from the embedded fake.
+type fakeValidateEC2 struct {
+	*vmcreatetest.FakeEC2
+	images  []types.Image
+	subnets []types.Subnet
+	groups  []types.SecurityGroup
+	keys    []string
+	zones   []string
+}
+
+func (f *fakeValidateEC2) DescribeRegions(ctx context.Context, params *ec2.DescribeRegionsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error) {
+	status := "opt-in-not-required"
+	if params.RegionNames[0] == "ap-east-1" {
+		status = "not-opted-in"
+	}
+	return &ec2.DescribeRegionsOutput{Regions: []types.Region{{RegionName: aws.String(params.RegionNames[0]), OptInStatus: aws.String(status)}}}, nil
+}
+
+func (f *fakeValidateEC2) DescribeImages(ctx context.Context, params *ec2.DescribeImagesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeImagesOutput, error) {
+	out := &ec2.DescribeImagesOutput{}
+	for _, i := range f.images {
+		switch {
+		case len(params.ImageIds) > 0:
+			if aws.ToString(i.ImageId) == params.ImageIds[0] {
+				out.Images = append(out.Images, i)
+			}
+		default:
+			// Searches filter on the name pattern first.
+			if ok, _ := path.Match(params.Filters[0].Values[0], aws.ToString(i.Name)); ok {
+				out.Images = append(out.Images, i)
+			}
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeValidateEC2) DescribeSubnets(ctx context.Context, params *ec2.DescribeSubnetsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSubnetsOutput, error) {
+	if len(params.SubnetIds) == 0 {
+		// Without ids, the default subnets are listed.
+		out := &ec2.DescribeSubnetsOutput{}
+		for _, s := range f.subnets {
+			if aws.ToBool(s.DefaultForAz) {
+				out.Subnets = append(out.Subnets, s)
+			}
+		}
+		return out, nil
+	}
+	for _, s := range f.subnets {
+		if aws.ToString(s.SubnetId) == params.SubnetIds[0] {
+			return &ec2.DescribeSubnetsOutput{Subnets: []types.Subnet{s}}, nil
+		}
+	}
+	return nil, vmcreatetest.APIError("InvalidSubnetID.NotFound", "The subnet ID '"+params.SubnetIds[0]+"' does not exist")
+}
+
+func (f *fakeValidateEC2) DescribeVpcs(ctx context.Context, params *ec2.DescribeVpcsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeVpcsOutput, error) {
+	return &ec2.DescribeVpcsOutput{Vpcs: []types.Vpc{{VpcId: aws.String("vpc-default")}}}, nil
+}
+
+func (f *fakeValidateEC2) DescribeSecurityGroups(ctx context.Context, params *ec2.DescribeSecurityGroupsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSecurityGroupsOutput, error) {
+	return &ec2.DescribeSecurityGroupsOutput{SecurityGroups: f.groups}, nil
+}
+
+func (f *fakeValidateEC2) DescribeKeyPairs(ctx context.Context, params *ec2.DescribeKeyPairsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeKeyPairsOutput, error) {
+	if !contains(f.keys, params.KeyNames[0]) {
+		return nil, vmcreatetest.APIError("InvalidKeyPair.NotFound", "The key pair '"+params.KeyNames[0]+"' does not exist")
+	}
+	return &ec2.DescribeKeyPairsOutput{KeyPairs: []types.KeyPairInfo{{KeyName: aws.String(params.KeyNames[0])}}}, nil
+}
+
+func (f *fakeValidateEC2) DescribeInstanceTypeOfferings(ctx context.Context, params *ec2.DescribeInstanceTypeOfferingsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceTypeOfferingsOutput, error) {
+	var location, instanceType string
+	for _, filter := range params.Filters {
+		switch aws.ToString(filter.Name) {
+		case "location":
+			location = filter.Values[0]
+		case "instance-type":
+			instanceType = filter.Values[0]
+		}
+	}
+	out := &ec2.DescribeInstanceTypeOfferingsOutput{}
+	for _, zone := range f.zones {
+		if location == "" || location == zone {
+			out.InstanceTypeOfferings = append(out.InstanceTypeOfferings, types.InstanceTypeOffering{InstanceType: types.InstanceType(instanceType), Location: aws.String(zone)})
+		}
+	}
+	return out, nil
+}
+
+type fakeServiceQuotas struct {
+	value float64
+	err   error
+}
+
+func (f *fakeServiceQuotas) GetServiceQuota(ctx context.Context, params *awsapi.GetServiceQuotaInput) (*awsapi.GetServiceQuotaOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &awsapi.GetServiceQuotaOutput{Quota: awsapi.ServiceQuota{QuotaCode: params.QuotaCode, Value: f.value}}, nil
+}
+
+func newFakeValidateEC2(t *testing.T) *fakeValidateEC2 {
+	return &fakeValidateEC2{
+		FakeEC2: useFakeEC2(t),
+		images:  []types.Image{{ImageId: aws.String("ami-ok"), Name: aws.String("al2023"), State: types.ImageStateAvailable, Architecture: types.ArchitectureValuesX8664}},
+		subnets: []types.Subnet{{SubnetId: aws.String("subnet-a"), VpcId: aws.String("vpc-app"), AvailabilityZone: aws.String("us-east-1a"), AvailableIpAddressCount: aws.Int32(250)}},
+		groups:  []types.SecurityGroup{{GroupId: aws.String("sg-app"), VpcId: aws.String("vpc-app")}},
+		keys:    []string{"ops"},
+		zones:   []string{"us-east-1a"},
+	}
+}
+
+func checkResults(checks []validationCheck) map[string]string {
+	results := map[string]string{}
+	for _, c := range checks {
+		results[c.Name] = "ok"
+		if c.Err != nil {
+			results[c.Name] = c.Err.Error()
+			if c.Warning {
+				results[c.Name] = "warning: " + c.Err.Error()
+			}
+		}
+	}
+	return results
+}
+
+func TestValidateLaunch(t *testing.T) {
+	api := newFakeValidateEC2(t)
+	api.AddInstance(types.Instance{InstanceType: "c6i.2xlarge"})
+	ok := launchSettings{Region: "us-east-1", InstanceType: "t3.micro", ImageID: "ami-ok", SubnetID: "subnet-a", SecurityGroupIDs: []string{"sg-app"}, KeyName: "ops"}
+
+	results := checkResults(validateLaunch(context.Background(), api, &fakeServiceQuotas{value: 32}, ok))
+	for _, name := range []string{"credentials", "region", "instance type", "image", "subnet", "security groups", "key pair", "vCPU quota"} {
+		if results[name] != "ok" {
+			t.Errorf("%s: %s", name, results[name])
+		}
+	}
+
+	bad := ok
+	bad.Region, bad.ImageID, bad.KeyName = "ap-east-1", "ami-missing", "nobody"
+	api.groups[0].VpcId = aws.String("vpc-other")
+	api.zones = nil
+	results = checkResults(validateLaunch(context.Background(), api, &fakeServiceQuotas{value: 8}, bad))
+	for name, want := range map[string]string{
+		"region":          "not enabled",
+		"image":           "does not exist",
+		"subnet":          "does not offer t3.micro",
+		"security groups": "not in the subnet's vpc-app",
+		"key pair":        "InvalidKeyPair.NotFound",
+		"vCPU quota":      "use 8 of 8 vCPUs, 2 more",
+	} {
+		if !strings.Contains(results[name], want) {
+			t.Errorf("%s: %q, want %q", name, results[name], want)
+		}
+	}
+
+	results = checkResults(validateLaunch(context.Background(), api, &fakeServiceQuotas{err: errors.New("AccessDenied")}, ok))
+	if !strings.HasPrefix(results["vCPU quota"], "warning: ") {
+		t.Errorf("an unreadable quota is %q, want a warning", results["vCPU quota"])
+	}
+}
+
+func TestQuotaClass(t *testing.T) {
+	for instanceType, want := range map[string]string{"m6i.large": "m", "inf2.xlarge": "inf", "t3a.micro": "t", "vt1.3xlarge": "vt", "g5.xlarge": "g"} {
+		if got := quotaClass(instanceType); got != want {
+			t.Errorf("quotaClass(%s) = %s, want %s", instanceType, got, want)
+		}
+	}
+}
+
+func TestValidateBrokenConfig(t *testing.T) {
+	useFakeEC2(t)
+	useConfig(t, ConfigMap{})
+	if err := os.WriteFile(configPath, []byte(`{"instance_type": 5}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, stderr, code := runCLIExit(t, false, "validate")
+	if !strings.Contains(stderr, "Error loading config:") || !strings.Contains(stderr, "/instance_type: must be a string") || strings.Contains(stderr, "configuring AWS") || code != 1 {
+		t.Errorf("validate exited %d with:\n%s", code, stderr)
+	}
+
+	// Other commands stop before running, saying it is the config.
+	_, stderr, code = runCLIExit(t, false, "list")
+	if !strings.Contains(stderr, "loading the config: data/config.json") || code != 1 {
+		t.Errorf("list exited %d with:\n%s", code, stderr)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// RootVolume changes the root volume of the image create launches. Fields
+// left empty keep those of the image.
+type RootVolume struct {
+	SizeGB    int32  `json:"size_gb,omitempty"`
+	Type      string `json:"type,omitempty"`
+	Encrypted *bool  `json:"encrypted,omitempty"`
+}
+
+// rootVolumeMapping returns the block device mapping launching the image
+// with the root volume v. The size cannot be below that of the image's
+// snapshot.
+func rootVolumeMapping(c context.Context, api ConfidentialAPI, imageID string, v *RootVolume) (*types.BlockDeviceMapping, error) {
+	result, err := api.DescribeImages(c, &ec2.DescribeImagesInput{ImageIds: []string{imageID}})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Images) == 0 {
+		return nil, fmt.Errorf("image %s not found", imageID)
+	}
+	image := result.Images[0]
+	device := aws.ToString(image.RootDeviceName)
+	if device == "" {
+		return nil, fmt.Errorf("%s has no root device", imageID)
+	}
+
+	ebs := &types.EbsBlockDevice{DeleteOnTermination: aws.Bool(true), Encrypted: v.Encrypted}
+	for _, m := range image.BlockDeviceMappings {
+		if aws.ToString(m.DeviceName) != device || m.Ebs == nil {
+			continue
+		}
+		if size := aws.ToInt32(m.Ebs.VolumeSize); v.SizeGB > 0 && v.SizeGB < size {
+			return nil, fmt.Errorf("the root volume of %s is %d GiB, size_gb cannot be smaller", imageID, size)
+		}
+		if m.Ebs.DeleteOnTermination != nil {
+			ebs.DeleteOnTermination = m.Ebs.DeleteOnTermination
+		}
+	}
+	if v.SizeGB > 0 {
+		ebs.VolumeSize = aws.Int32(v.SizeGB)
+	}
+	if v.Type != "" {
+		ebs.VolumeType = types.VolumeType(v.Type)
+	}
+	return &types.BlockDeviceMapping{DeviceName: aws.String(device), Ebs: ebs}, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestRootVolumeMapping(t *testing.T) {
+	api := fakeImages{{
+		ImageId:        aws.String("ami-1"),
+		RootDeviceName: aws.String("/dev/xvda"),
+		BlockDeviceMappings: []types.BlockDeviceMapping{
+			{DeviceName: aws.String("/dev/xvda"), Ebs: &types.EbsBlockDevice{VolumeSize: aws.Int32(8)}},
+		},
+	}}
+	c := context.Background()
+
+	m, err := rootVolumeMapping(c, api, "ami-1", &RootVolume{SizeGB: 50, Type: "gp3", Encrypted: aws.Bool(true)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.ToString(m.DeviceName) != "/dev/xvda" || aws.ToInt32(m.Ebs.VolumeSize) != 50 || m.Ebs.VolumeType != types.VolumeTypeGp3 || !aws.ToBool(m.Ebs.Encrypted) || !aws.ToBool(m.Ebs.DeleteOnTermination) {
+		t.Errorf("got %+v", m.Ebs)
+	}
+	if _, err := rootVolumeMapping(c, api, "ami-1", &RootVolume{SizeGB: 4}); err == nil {
+		t.Error("a root volume smaller than the snapshot was accepted")
+	}
+	if _, err := rootVolumeMapping(c, api, "ami-2", &RootVolume{SizeGB: 50}); err == nil {
+		t.Error("a missing image was accepted")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// The warm pool is the instances standby stopped, which the state keeps in
+// the warm phase. Starting one of them again skips the launch and the first
+// boot, so activate and create --from-warm-pool bring capacity back faster
+// than a new instance would.
+
+// warmInstances returns the warm instances that are stopped or stopping and
+// pass the filters, oldest first.
+func warmInstances(c context.Context, filters ...types.Filter) ([]types.Instance, error) {
+	state, err := stateStore.Load(c)
+	if err != nil {
+		return nil, fmt.Errorf("loading the warm pool: %w", err)
+	}
+	var ids []string
+	for id, m := range state.Instances {
+		if m.Phase == phaseWarm {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	sort.Strings(ids)
+	filters = append(filters, vmcreate.InstanceIDFilter(ids...), vmcreate.StateFilter("stopped", "stopping"))
+	instances, err := provisioner.List(c, filters...)
+	if err != nil {
+		return nil, fmt.Errorf("listing the warm pool: %w", err)
+	}
+	sort.SliceStable(instances, func(a, b int) bool {
+		return aws.ToTime(instances[a].LaunchTime).Before(aws.ToTime(instances[b].LaunchTime))
+	})
+	return instances, nil
+}
+
+// splitStopped returns the instances that are stopped, which are the only
+// ones that can be started, and the IDs of the others.
+func splitStopped(instances []types.Instance) (ready []types.Instance, stopping []string) {
+	for _, i := range instances {
+		if i.State != nil && i.State.Name == types.InstanceStateNameStopped {
+			ready = append(ready, i)
+		} else {
+			stopping = append(stopping, aws.ToString(i.InstanceId))
+		}
+	}
+	return ready, stopping
+}
+
+// startWarmInstances starts up to count warm instances with the tag, the
+// instance type and the image of a create, for the create to use instead of
+// launching new ones.
+func startWarmInstances(c context.Context, key, value, instanceType, imageID string, count int) ([]types.Instance, error) {
+	pool, err := warmInstances(c,
+		vmcreate.TagFilter(key, value),
+		types.Filter{Name: aws.String("instance-type"), Values: []string{instanceType}},
+		types.Filter{Name: aws.String("image-id"), Values: []string{imageID}})
+	if err != nil {
+		return nil, err
+	}
+	warm, _ := splitStopped(pool)
+	if len(warm) > count {
+		warm = warm[:count]
+	}
+	if len(warm) == 0 {
+		return nil, nil
+	}
+	if err := provisioner.Start(c, instanceIDs(warm)); err != nil {
+		return nil, fmt.Errorf("starting the warm instances: %w", err)
+	}
+	return warm, nil
+}
+
+// instanceIDs returns the IDs of the instances.
+func instanceIDs(instances []types.Instance) []string {
+	var ids []string
+	for _, i := range instances {
+		ids = append(ids, aws.ToString(i.InstanceId))
+	}
+	return ids
+}
+
+func StandbyCmd(name *string, value *string, dryRun *bool) {
+	c := context.TODO()
+	instances, err := provisioner.List(c, vmcreate.TagFilter(*name, strings.Split(*value, ",")...), vmcreate.StateFilter("running"))
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error listing the instances:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	if len(instances) == 0 {
+		fmt.Fprintln(os.Stderr, "No running instances to put on standby")
+		return
+	}
+	ids := instanceIDs(instances)
+	if *dryRun {
+		fmt.Println("Would stop " + strings.Join(ids, ", "))
+		return
+	}
+	if err := provisioner.Stop(c, ids); err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error stopping the instances:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	recordLifecycle(c, "standby", instances, awsConfig.Region, phaseWarm, "")
+	for _, id := range ids {
+		printResult("Put instance with ID "+id+" on standby", id)
+	}
+}
+
+func ActivateCmd(name *string, value *string, dryRun *bool) {
+	c := context.TODO()
+	pool, err := warmInstances(c, vmcreate.TagFilter(*name, strings.Split(*value, ",")...))
+	if err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error finding the warm instances:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	warm, stopping := splitStopped(pool)
+	if len(stopping) > 0 {
+		fmt.Fprintln(os.Stderr, "Skipping "+strings.Join(stopping, ", ")+", which are still stopping")
+	}
+	if len(warm) == 0 {
+		fmt.Fprintln(os.Stderr, "No warm instances to activate")
+		return
+	}
+	ids := instanceIDs(warm)
+	if *dryRun {
+		fmt.Println("Would start " + strings.Join(ids, ", "))
+		return
+	}
+	if err := provisioner.Start(c, ids); err != nil {
+		commandErr = err
+		fmt.Fprintln(os.Stderr, "Got an error starting the instances:")
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	var running []string
+	for _, id := range ids {
+		if _, err := provisioner.WaitForRunning(c, id, 0); err != nil {
+			commandErr = err
+			fmt.Fprintln(os.Stderr, "Got an error waiting for "+id+" to run:")
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		running = append(running, id)
+		printResult("Activated instance with ID "+id, id)
+	}
+	recordLifecycle(c, "activate", instancesOf(running), awsConfig.Region, phaseReady, "")
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestStandbyAndActivate(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1"})
+	web := fake.AddInstance(tagged("app", "web"))
+	other := fake.AddInstance(tagged("app", "db"))
+
+	out := runCLI(t, "standby", "--tag", "app=web")
+	if !strings.Contains(out, "Put instance with ID "+web+" on standby") {
+		t.Errorf("output:\n%s", out)
+	}
+	if s := fake.Instance(web).State.Name; s != types.InstanceStateNameStopped {
+		t.Errorf("%s is %s after standby", web, s)
+	}
+	if s := fake.Instance(other).State.Name; s != types.InstanceStateNameRunning {
+		t.Errorf("standby stopped %s of another tag", other)
+	}
+	if m := loadState(t).Instances[web]; m == nil || m.Phase != phaseWarm {
+		t.Fatalf("the state has %+v, want it warm", m)
+	}
+
+	out = runCLI(t, "activate", "--tag", "app=web")
+	if !strings.Contains(out, "Activated instance with ID "+web) {
+		t.Errorf("output:\n%s", out)
+	}
+	if s := fake.Instance(web).State.Name; s != types.InstanceStateNameRunning {
+		t.Errorf("%s is %s after activate", web, s)
+	}
+	if m := loadState(t).Instances[web]; m.Phase != phaseReady {
+		t.Errorf("%s is %s after activate", web, m.Phase)
+	}
+	if out := runCLI(t, "activate", "--tag", "app=web"); !strings.Contains(out, "No warm instances to activate") {
+		t.Errorf("second activate printed:\n%s", out)
+	}
+}
+
+func TestCreateFromWarmPool(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1"})
+	warm := tagged("app", "web")
+	warm.InstanceType, warm.ImageId = "t3.micro", aws.String("ami-1")
+	match := fake.AddInstance(warm)
+	// An instance of another image is not what the create launches.
+	warm.ImageId = aws.String("ami-old")
+	stale := fake.AddInstance(warm)
+	runCLI(t, "standby", "--tag", "app=web")
+
+	out := runCLI(t, "create", "--tag", "app=web", "--count", "2", "--from-warm-pool")
+
+	if !strings.Contains(out, "Started warm instance with ID "+match) {
+		t.Errorf("output:\n%s", out)
+	}
+	if s := fake.Instance(match).State.Name; s != types.InstanceStateNameRunning {
+		t.Errorf("the warm instance is %s", s)
+	}
+	if s := fake.Instance(stale).State.Name; s != types.InstanceStateNameStopped {
+		t.Errorf("the instance of another image was started")
+	}
+	if n := len(fake.Instances()); n != 3 {
+		t.Errorf("%d instances, want one launched besides the warm one", n)
+	}
+	if run := vmcreate.TagValue(fake.Instance(match), runIDTag); run == "" {
+		t.Error("the warm instance is not tagged with the run")
+	}
+	state := loadState(t)
+	if m := state.Instances[match]; m.Phase == phaseWarm {
+		t.Errorf("the started instance is still warm")
+	}
+	if m := state.Instances[stale]; m.Phase != phaseWarm {
+		t.Errorf("the instance left in the pool is %s", m.Phase)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+var cloudTrailClient *awsapi.CloudTrail
+
+// CloudTrailAPI defines the interface for the LookupEvents function.
+// We use this interface to test the functions using a mocked service.
+type CloudTrailAPI interface {
+	LookupEvents(ctx context.Context, params *awsapi.LookupEventsInput) (*awsapi.LookupEventsOutput, error)
+}
+
+// cloudTrailRetention is how far back the CloudTrail event history goes.
+const cloudTrailRetention = 90 * 24 * time.Hour
+
+// launchEvent is who launched an instance, from its RunInstances event.
+type launchEvent struct {
+	Time      time.Time
+	Principal string
+	Role      string
+	AccountID string
+	SourceIP  string
+	UserAgent string
+}
+
+// cloudTrailRecord is the part of a CloudTrail event record we report.
+type cloudTrailRecord struct {
+	EventTime    time.Time `json:"eventTime"`
+	UserIdentity struct {
+		Type           string `json:"type"`
+		Arn            string `json:"arn"`
+		AccountID      string `json:"accountId"`
+		InvokedBy      string `json:"invokedBy"`
+		SessionContext struct {
+			SessionIssuer struct {
+				Arn string `json:"arn"`
+			} `json:"sessionIssuer"`
+		} `json:"sessionContext"`
+	} `json:"userIdentity"`
+	SourceIPAddress string `json:"sourceIPAddress"`
+	UserAgent       string `json:"userAgent"`
+}
+
+// findLaunchEvent looks up the RunInstances event of the instance in the
+// event history. It returns nil when there is none, e.g. because the
+// instance is older than the history.
+func findLaunchEvent(c context.Context, api CloudTrailAPI, instanceID string) (*launchEvent, error) {
+	input := &awsapi.LookupEventsInput{
+		LookupAttributes: []awsapi.LookupAttribute{{AttributeKey: "ResourceName", AttributeValue: instanceID}},
+	}
+	for {
+		out, err := api.LookupEvents(c, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range out.Events {
+			if e.EventName != "RunInstances" {
+				continue
+			}
+			var record cloudTrailRecord
+			if err := json.Unmarshal([]byte(e.CloudTrailEvent), &record); err != nil {
+				return nil, fmt.Errorf("decoding event %s: %w", e.EventId, err)
+			}
+			event := &launchEvent{
+				Time:      record.EventTime,
+				Principal: record.UserIdentity.Arn,
+				Role:      record.UserIdentity.SessionContext.SessionIssuer.Arn,
+				AccountID: record.UserIdentity.AccountID,
+				SourceIP:  record.SourceIPAddress,
+				UserAgent: record.UserAgent,
+			}
+			if event.Principal == "" {
+				// Services such as Auto Scaling launch on their own behalf.
+				event.Principal = firstNonEmpty(record.UserIdentity.InvokedBy, e.Username, record.UserIdentity.Type)
+			}
+			if event.Time.IsZero() {
+				event.Time = time.Unix(int64(e.EventTime), 0)
+			}
+			return event, nil
+		}
+		if out.NextToken == "" {
+			return nil, nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
+func WhoCreatedCmd(instanceID *string) {
+	event, err := findLaunchEvent(context.TODO(), cloudTrailClient, *instanceID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Got an error looking up the CloudTrail events:")
+		fmt.Fprintln(os.Stderr, err)
+		commandErr = err
+		return
+	}
+
+	if event == nil {
+		instance, err := provisioner.Describe(context.TODO(), *instanceID)
+		if err != nil {
+			fmt.Println("No RunInstances event found for " + *instanceID + " in the CloudTrail event history of " + awsConfig.Region)
+			return
+		}
+		launched := aws.ToTime(instance.LaunchTime)
+		if time.Since(launched) > cloudTrailRetention {
+			fmt.Println("Instance " + *instanceID + " was launched on " + launched.UTC().Format(time.RFC3339) + ", before the 90 days of CloudTrail event history; look it up in a trail's S3 logs")
+			return
+		}
+		fmt.Println("No RunInstances event found for " + *instanceID + " launched on " + launched.UTC().Format(time.RFC3339) + "; events can take up to 15 minutes to appear")
+		return
+	}
+
+	fmt.Println("Instance " + *instanceID + " was launched by " + event.Principal)
+	if event.Role != "" {
+		fmt.Println("  Role:       " + event.Role)
+	}
+	if event.AccountID != "" {
+		fmt.Println("  Account:    " + event.AccountID)
+	}
+	fmt.Println("  Time:       " + event.Time.UTC().Format(time.RFC3339))
+	fmt.Println("  Source IP:  " + event.SourceIP)
+	if event.UserAgent != "" {
+		fmt.Println("  User agent: " + event.UserAgent)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"aws-vmcreate/internal/awsapi"
+)
+
+type fakeCloudTrail struct {
+	pages []awsapi.LookupEventsOutput
+	calls []awsapi.LookupEventsInput
+}
+
+func (f *fakeCloudTrail) LookupEvents(ctx context.Context, params *awsapi.LookupEventsInput) (*awsapi.LookupEventsOutput, error) {
+	f.calls = append(f.calls, *params)
+	page := f.pages[0]
+	f.pages = f.pages[1:]
+	return &page, nil
+}
+
+func TestFindLaunchEvent(t *testing.T) {
+	api := &fakeCloudTrail{pages: []awsapi.LookupEventsOutput{
+		{Events: []awsapi.TrailEvent{{EventName: "CreateTags"}}, NextToken: "page-2"},
+		{Events: []awsapi.TrailEvent{{
+			EventId:   "ev-1",
+			EventName: "RunInstances",
+			CloudTrailEvent: `{
+				"eventTime": "2023-03-01T10:00:00Z",
+				"userIdentity": {
+					"type": "AssumedRole",
+					"arn": "arn:aws:sts::111122223333:assumed-role/Deployer/alice",
+					"accountId": "111122223333",
+					"sessionContext": {"sessionIssuer": {"arn": "arn:aws:iam::111122223333:role/Deployer"}}
+				},
+				"sourceIPAddress": "203.0.113.7",
+				"userAgent": "aws-cli/2.9.0"
+			}`,
+		}}},
+	}}
+
+	event, err := findLaunchEvent(context.TODO(), api, "i-0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event == nil || event.Principal != "arn:aws:sts::111122223333:assumed-role/Deployer/alice" || event.Role != "arn:aws:iam::111122223333:role/Deployer" {
+		t.Fatalf("event = %+v", event)
+	}
+	if event.SourceIP != "203.0.113.7" || !event.Time.Equal(time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("event = %+v", event)
+	}
+	if len(api.calls) != 2 || api.calls[1].NextToken != "page-2" || api.calls[0].LookupAttributes[0].AttributeValue != "i-0123" {
+		t.Errorf("calls = %+v", api.calls)
+	}
+
+	api = &fakeCloudTrail{pages: []awsapi.LookupEventsOutput{{}}}
+	if event, err := findLaunchEvent(context.TODO(), api, "i-old"); err != nil || event != nil {
+		t.Errorf("findLaunchEvent without events = %+v, %v", event, err)
+	}
+}
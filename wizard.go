@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// WizardEC2API defines the interface for the functions the create wizard
+// populates its lists with.
+// We use this interface to test the functions using a mocked service.
+type WizardEC2API interface {
+	DescribeImages(ctx context.Context,
+		params *ec2.DescribeImagesInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeImagesOutput, error)
+
+	DescribeKeyPairs(ctx context.Context,
+		params *ec2.DescribeKeyPairsInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeKeyPairsOutput, error)
+
+	DescribeSubnets(ctx context.Context,
+		params *ec2.DescribeSubnetsInput,
+		optFns ...func(*ec2.Options)) (*ec2.DescribeSubnetsOutput, error)
+}
+
+// wizardAPIFor returns the EC2 client the wizard uses in region.
+var wizardAPIFor = func(region string) WizardEC2API {
+	cfg := awsConfig.Copy()
+	cfg.Region = region
+	return ec2.NewFromConfig(cfg)
+}
+
+// wizardOS is an operating system offered by the wizard, found as the newest
+// public image of its owner matching the name pattern.
+type wizardOS struct {
+	Label string
+	Owner string
+	Name  string
+}
+
+var wizardOSes = []wizardOS{
+	{"Amazon Linux 2023", "amazon", "al2023-ami-2023.*-x86_64"},
+	{"Amazon Linux 2", "amazon", "amzn2-ami-hvm-*-x86_64-gp2"},
+	{"Ubuntu 22.04 LTS", "099720109477", "ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-amd64-server-*"},
+	{"Red Hat Enterprise Linux 9", "309956199498", "RHEL-9.*_HVM-*-x86_64-*"},
+	{"Debian 12", "136693071363", "debian-12-amd64-*"},
+	{"Windows Server 2022", "amazon", "Windows_Server-2022-English-Full-Base-*"},
+}
+
+var wizardInstanceTypes = []string{"t3.micro", "t3.small", "t3.medium", "t3.large", "m6i.large", "c6i.large", "r6i.large"}
+
+// wizardChoice is what the wizard collected, as the flags of a create.
+type wizardChoice struct {
+	Region       string
+	ImageID      string
+	InstanceType string
+	KeyName      string
+	SubnetID     string
+	// TagKey and TagValue are the first tag, the others are ExtraTags.
+	TagKey    string
+	TagValue  string
+	ExtraTags map[string]string
+	Launch    bool
+}
+
+// option is an entry of a selectable list.
+type option struct {
+	Value string
+	Label string
+}
+
+type wizard struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask prints the prompt and returns the answer, or def when it is empty.
+func (w *wizard) ask(prompt string, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(w.out, "%s [%s]: ", prompt, def)
+	} else {
+		fmt.Fprintf(w.out, "%s: ", prompt)
+	}
+	line, err := w.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", errors.New("the wizard was cancelled")
+	}
+	if line = strings.TrimSpace(line); line == "" {
+		return def, nil
+	}
+	return line, nil
+}
+
+// choose lists the options and returns the value picked by number. When
+// custom is set, any other answer is taken as the value itself.
+func (w *wizard) choose(title string, options []option, def string, custom bool) (string, error) {
+	fmt.Fprintln(w.out, title)
+	defNumber := ""
+	for n, o := range options {
+		fmt.Fprintf(w.out, "  %2d) %s\n", n+1, o.Label)
+		if o.Value == def {
+			defNumber = strconv.Itoa(n + 1)
+		}
+	}
+	prompt := "Choose a number"
+	if custom {
+		prompt = "Choose a number or enter a value"
+	}
+	for {
+		answer, err := w.ask(prompt, defNumber)
+		if err != nil {
+			return "", err
+		}
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(options) {
+			return options[n-1].Value, nil
+		}
+		if custom && answer != "" {
+			return answer, nil
+		}
+		fmt.Fprintln(w.out, "Please choose one of the numbers above")
+	}
+}
+
+// runWizard walks through the settings of a create, listing the live
+// regions, images, key pairs and subnets to choose from.
+func runWizard(c context.Context, in io.Reader, out io.Writer, regionsAPI EC2RegionsAPI, defaults wizardChoice) (*wizardChoice, error) {
+	w := &wizard{in: bufio.NewReader(in), out: out}
+	choice := defaults
+
+	regions, err := resolveRegions(c, regionsAPI, "", true)
+	if err != nil {
+		return nil, fmt.Errorf("listing the regions: %w", err)
+	}
+	var regionOptions []option
+	for _, r := range regions {
+		regionOptions = append(regionOptions, option{r, r})
+	}
+	if choice.Region, err = w.choose("Region:", regionOptions, defaults.Region, true); err != nil {
+		return nil, err
+	}
+	api := wizardAPIFor(choice.Region)
+
+	var imageOptions []option
+	for _, os := range wizardOSes {
+		image, err := latestImage(c, api, os)
+		if err != nil {
+			return nil, fmt.Errorf("looking up %s images: %w", os.Label, err)
+		}
+		if image != nil {
+			imageOptions = append(imageOptions, option{aws.ToString(image.ImageId), os.Label + " (" + aws.ToString(image.ImageId) + ")"})
+		}
+	}
+	if choice.ImageID, err = w.choose("Operating system (or an AMI id):", imageOptions, defaults.ImageID, true); err != nil {
+		return nil, err
+	}
+
+	var typeOptions []option
+	for _, t := range wizardInstanceTypes {
+		typeOptions = append(typeOptions, option{t, t})
+	}
+	def := firstNonEmpty(defaults.InstanceType, "t3.micro")
+	if choice.InstanceType, err = w.choose("Instance size (or another instance type):", typeOptions, def, true); err != nil {
+		return nil, err
+	}
+
+	keys, err := api.DescribeKeyPairs(c, &ec2.DescribeKeyPairsInput{})
+	if err != nil {
+		return nil, fmt.Errorf("listing the key pairs: %w", err)
+	}
+	keyOptions := []option{{"", "None, connect with EC2 Instance Connect or SSM"}}
+	for _, k := range keys.KeyPairs {
+		keyOptions = append(keyOptions, option{aws.ToString(k.KeyName), aws.ToString(k.KeyName)})
+	}
+	if choice.KeyName, err = w.choose("Key pair:", keyOptions, defaults.KeyName, false); err != nil {
+		return nil, err
+	}
+
+	subnets, err := api.DescribeSubnets(c, &ec2.DescribeSubnetsInput{})
+	if err != nil {
+		return nil, fmt.Errorf("listing the subnets: %w", err)
+	}
+	sort.Slice(subnets.Subnets, func(i, j int) bool {
+		return aws.ToString(subnets.Subnets[i].AvailabilityZone)+aws.ToString(subnets.Subnets[i].SubnetId) <
+			aws.ToString(subnets.Subnets[j].AvailabilityZone)+aws.ToString(subnets.Subnets[j].SubnetId)
+	})
+	subnetOptions := []option{{"", "The default VPC, in any availability zone"}}
+	for _, s := range subnets.Subnets {
+		label := fmt.Sprintf("%s  %s  %s  %s", aws.ToString(s.SubnetId), aws.ToString(s.AvailabilityZone), aws.ToString(s.CidrBlock), aws.ToString(s.VpcId))
+		if name := subnetName(s); name != "" {
+			label += "  " + name
+		}
+		subnetOptions = append(subnetOptions, option{aws.ToString(s.SubnetId), label})
+	}
+	if choice.SubnetID, err = w.choose("Network:", subnetOptions, defaults.SubnetID, false); err != nil {
+		return nil, err
+	}
+
+	if choice.TagValue, err = w.ask("Name of the instance (the Name tag)", defaults.TagValue); err != nil {
+		return nil, err
+	}
+	choice.TagKey = "Name"
+	for choice.TagValue == "" {
+		fmt.Fprintln(w.out, "The instance needs a name")
+		if choice.TagValue, err = w.ask("Name of the instance (the Name tag)", ""); err != nil {
+			return nil, err
+		}
+	}
+	choice.ExtraTags = map[string]string{}
+	for k, v := range defaults.ExtraTags {
+		choice.ExtraTags[k] = v
+	}
+	for {
+		answer, err := w.ask("Another tag as KEY=VALUE (empty to finish)", "")
+		if err != nil {
+			return nil, err
+		}
+		if answer == "" {
+			break
+		}
+		k, v, ok := strings.Cut(answer, "=")
+		if !ok || k == "" {
+			fmt.Fprintln(w.out, "Tags are KEY=VALUE")
+			continue
+		}
+		choice.ExtraTags[k] = v
+	}
+
+	fmt.Fprintln(w.out)
+	fmt.Fprintln(w.out, "The same instance can be created without the wizard with:")
+	fmt.Fprintln(w.out, "  "+choice.command())
+	answer, err := w.ask("Create it now? (y/n)", "y")
+	if err != nil {
+		return nil, err
+	}
+	choice.Launch = strings.HasPrefix(strings.ToLower(answer), "y")
+	return &choice, nil
+}
+
+// latestImage returns the newest available image of os, or nil when the
+// region has none.
+func latestImage(c context.Context, api WizardEC2API, os wizardOS) (*types.Image, error) {
+	result, err := api.DescribeImages(c, &ec2.DescribeImagesInput{
+		Owners: []string{os.Owner},
+		Filters: []types.Filter{
+			{Name: aws.String("name"), Values: []string{os.Name}},
+			{Name: aws.String("state"), Values: []string{"available"}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var latest *types.Image
+	for i := range result.Images {
+		image := &result.Images[i]
+		if latest == nil || aws.ToString(image.CreationDate) > aws.ToString(latest.CreationDate) {
+			latest = image
+		}
+	}
+	return latest, nil
+}
+
+func subnetName(s types.Subnet) string {
+	for _, t := range s.Tags {
+		if aws.ToString(t.Key) == "Name" {
+			return aws.ToString(t.Value)
+		}
+	}
+	return ""
+}
+
+// command returns the non-interactive command line of the choice.
+func (c *wizardChoice) command() string {
+	args := []string{"AWS_REGION=" + c.Region, "aws-vmcreate", "create",
+		"--tag", commandArg(c.TagKey + "=" + c.TagValue),
+		"-t", c.InstanceType,
+		"--image-id", c.ImageID,
+	}
+	if c.SubnetID != "" {
+		args = append(args, "--subnet-id", c.SubnetID)
+	}
+	if c.KeyName != "" {
+		args = append(args, "--key-name", commandArg(c.KeyName))
+	}
+	if len(c.ExtraTags) > 0 {
+		var tags []string
+		for k, v := range c.ExtraTags {
+			tags = append(tags, k+"="+v)
+		}
+		sort.Strings(tags)
+		args = append(args, "--extra-tags", commandArg(strings.Join(tags, ",")))
+	}
+	return strings.Join(args, " ")
+}
+
+// commandArg returns s as a shell argument, quoted only when it has to be.
+func commandArg(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.:/=,@+") == "" {
+		return s
+	}
+	return shellQuote(s)
+}
+
+// parseTags parses KEY=VALUE pairs separated by commas.
+func parseTags(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("%q is not KEY=VALUE", pair)
+		}
+		tags[k] = v
+	}
+	return tags, nil
+}
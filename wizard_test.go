@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"aws-vmcreate/pkg/vmcreate"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+type fakeWizardEC2 struct{}
+
+func (fakeWizardEC2) DescribeRegions(ctx context.Context, params *ec2.DescribeRegionsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error) {
+	return &ec2.DescribeRegionsOutput{Regions: []types.Region{{RegionName: aws.String("us-east-1")}, {RegionName: aws.String("eu-west-1")}}}, nil
+}
+
+func (fakeWizardEC2) DescribeImages(ctx context.Context, params *ec2.DescribeImagesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeImagesOutput, error) {
+	if params.Owners[0] != "amazon" || !strings.HasPrefix(params.Filters[0].Values[0], "al2023") {
+		return &ec2.DescribeImagesOutput{}, nil
+	}
+	return &ec2.DescribeImagesOutput{Images: []types.Image{
+		{ImageId: aws.String("ami-old"), CreationDate: aws.String("2024-01-01T00:00:00.000Z")},
+		{ImageId: aws.String("ami-new"), CreationDate: aws.String("2024-06-01T00:00:00.000Z")},
+	}}, nil
+}
+
+func (fakeWizardEC2) DescribeKeyPairs(ctx context.Context, params *ec2.DescribeKeyPairsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeKeyPairsOutput, error) {
+	return &ec2.DescribeKeyPairsOutput{KeyPairs: []types.KeyPairInfo{{KeyName: aws.String("ops")}}}, nil
+}
+
+func (fakeWizardEC2) DescribeSubnets(ctx context.Context, params *ec2.DescribeSubnetsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSubnetsOutput, error) {
+	return &ec2.DescribeSubnetsOutput{Subnets: []types.Subnet{{SubnetId: aws.String("subnet-b"), AvailabilityZone: aws.String("eu-west-1b"), CidrBlock: aws.String("10.0.1.0/24"), VpcId: aws.String("vpc-1")}}}, nil
+}
+
+func TestRunWizard(t *testing.T) {
+	var region string
+	saved := wizardAPIFor
+	wizardAPIFor = func(r string) WizardEC2API {
+		region = r
+		return fakeWizardEC2{}
+	}
+	defer func() { wizardAPIFor = saved }()
+
+	// eu-west-1, the only image, a custom type, the ops key, the subnet, a
+	// name that has to be asked again, one extra tag and a bad one.
+	input := "1\n1\nm7i.large\n2\n2\n\nweb 1\nteam=core\nbad\n\ny\n"
+	var out bytes.Buffer
+	choice, err := runWizard(context.Background(), strings.NewReader(input), &out, fakeWizardEC2{}, wizardChoice{Region: "us-east-1"})
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out.String())
+	}
+	if region != "eu-west-1" {
+		t.Errorf("listed the resources of %q", region)
+	}
+	want := "AWS_REGION=eu-west-1 aws-vmcreate create --tag 'Name=web 1' -t m7i.large --image-id ami-new --subnet-id subnet-b --key-name ops --extra-tags team=core"
+	if got := choice.command(); got != want {
+		t.Errorf("command =\n%s\nwant\n%s", got, want)
+	}
+	if !strings.Contains(out.String(), want) || !choice.Launch {
+		t.Errorf("output:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "Amazon Linux 2023 (ami-new)") || strings.Contains(out.String(), "Ubuntu") {
+		t.Errorf("images without a match are listed:\n%s", out.String())
+	}
+
+	if _, err := runWizard(context.Background(), strings.NewReader("1\n"), &out, fakeWizardEC2{}, wizardChoice{}); err == nil {
+		t.Error("the wizard did not stop at the end of its input")
+	}
+}
+
+func TestCreateFlagsOverrideConfig(t *testing.T) {
+	fake := useFakeEC2(t)
+
+	out := runCLI(t, "create", "--tag", "Name=web-1", "-t", "t3.large", "--image-id", "ami-flag", "--key-name", "ops", "--extra-tags", "team=core,env=dev")
+
+	instances := fake.Instances()
+	if len(instances) != 1 {
+		t.Fatalf("launched %d instances\n%s", len(instances), out)
+	}
+	i := instances[0]
+	if i.InstanceType != "t3.large" || aws.ToString(i.ImageId) != "ami-flag" || aws.ToString(i.KeyName) != "ops" {
+		t.Errorf("launched %s %s with key %q", i.InstanceType, aws.ToString(i.ImageId), aws.ToString(i.KeyName))
+	}
+	if vmcreate.TagValue(&i, "team") != "core" || vmcreate.TagValue(&i, "env") != "dev" || vmcreate.TagValue(&i, "Name") != "web-1" {
+		t.Errorf("tags %v", i.Tags)
+	}
+}
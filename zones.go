@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// ZoneCount pins Count instances of a group to an availability zone, named
+// by Zone or by the SubnetId of a subnet in it.
+type ZoneCount struct {
+	Zone     string `json:"zone,omitempty"`
+	SubnetId string `json:"subnet_id,omitempty"`
+	Count    int    `json:"count"`
+}
+
+func (z ZoneCount) String() string {
+	return firstNonEmpty(z.SubnetId, z.Zone)
+}
+
+func (z ZoneCount) validate() error {
+	switch {
+	case (z.Zone == "") == (z.SubnetId == ""):
+		return errors.New("a zone needs one of zone and subnet_id")
+	case z.Count < 0:
+		return fmt.Errorf("zone %s has a negative count", z)
+	}
+	return nil
+}
+
+// holds reports whether the instance runs in the zone.
+func (z ZoneCount) holds(i types.Instance) bool {
+	if z.SubnetId != "" {
+		return aws.ToString(i.SubnetId) == z.SubnetId
+	}
+	return i.Placement != nil && aws.ToString(i.Placement.AvailabilityZone) == z.Zone
+}
+
+// parseZoneCounts parses the SUBNET=N pairs of scale --per-zone.
+func parseZoneCounts(spec string) ([]ZoneCount, error) {
+	var zones []ZoneCount
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "subnet-") {
+			return nil, fmt.Errorf("%q is not SUBNET=COUNT", pair)
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("the count of %s is not a number of instances", parts[0])
+		}
+		zones = append(zones, ZoneCount{SubnetId: parts[0], Count: n})
+	}
+	return zones, nil
+}
+
+// zoneTotal returns the number of instances of all the zones.
+func zoneTotal(zones []ZoneCount) int {
+	total := 0
+	for _, z := range zones {
+		total += z.Count
+	}
+	return total
+}
+
+// planZones returns how many instances each zone is missing, as zones of
+// those counts, and the instances beyond the count of their zone or in no
+// zone at all. The instances are in the order they are worth keeping, and
+// the first of each zone are kept.
+func planZones(zones []ZoneCount, instances []types.Instance) ([]ZoneCount, []types.Instance) {
+	kept := make([]int, len(zones))
+	var extra []types.Instance
+	for _, i := range instances {
+		placed := false
+		for n, z := range zones {
+			if z.holds(i) && kept[n] < z.Count {
+				kept[n]++
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			extra = append(extra, i)
+		}
+	}
+	var missing []ZoneCount
+	for n, z := range zones {
+		if kept[n] < z.Count {
+			z.Count -= kept[n]
+			missing = append(missing, z)
+		}
+	}
+	return missing, extra
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// inSubnet counts the instances in the subnet.
+func inSubnet(instances []types.Instance, subnetID string) int {
+	n := 0
+	for _, i := range instances {
+		if aws.ToString(i.SubnetId) == subnetID {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPlanZones(t *testing.T) {
+	var instances []types.Instance
+	for _, subnet := range []string{"subnet-a", "subnet-a", "subnet-a", "subnet-c"} {
+		instances = append(instances, types.Instance{InstanceId: aws.String("i-" + subnet), SubnetId: aws.String(subnet)})
+	}
+	missing, extra := planZones([]ZoneCount{{SubnetId: "subnet-a", Count: 2}, {SubnetId: "subnet-b", Count: 2}}, instances)
+	if len(missing) != 1 || missing[0].SubnetId != "subnet-b" || missing[0].Count != 2 {
+		t.Errorf("missing = %+v", missing)
+	}
+	// The third of subnet-a and the one outside the zones go.
+	if len(extra) != 2 || aws.ToString(extra[1].SubnetId) != "subnet-c" {
+		t.Errorf("extra = %v", instanceIDs(extra))
+	}
+
+	if zones, err := parseZoneCounts("subnet-a=2, subnet-b=0"); err != nil || len(zones) != 2 || zones[0].Count != 2 {
+		t.Errorf("parsed %+v, %v", zones, err)
+	}
+	for _, bad := range []string{"us-east-1a=2", "subnet-a", "subnet-a=-1"} {
+		if _, err := parseZoneCounts(bad); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
+
+func TestReconcileZones(t *testing.T) {
+	fake := useFakeEC2(t)
+	c := context.Background()
+	state := &DesiredState{Groups: []DesiredGroup{{
+		Name: "web", Count: 5, InstanceType: "t3.micro", ImageId: "ami-web",
+		Zones: []ZoneCount{{SubnetId: "subnet-a", Count: 2}, {SubnetId: "subnet-b", Count: 2}, {Zone: "us-east-1c", Count: 1}},
+	}}}
+
+	if err := reconcile(c, state, false, false); err != nil {
+		t.Fatal(err)
+	}
+	live := liveInstances(fake)
+	if len(live) != 5 || inSubnet(live, "subnet-a") != 2 || inSubnet(live, "subnet-b") != 2 {
+		t.Fatalf("%d instances, %d in subnet-a and %d in subnet-b", len(live), inSubnet(live, "subnet-a"), inSubnet(live, "subnet-b"))
+	}
+	zoned := 0
+	for _, i := range live {
+		if i.Placement != nil && aws.ToString(i.Placement.AvailabilityZone) == "us-east-1c" {
+			zoned++
+		}
+	}
+	if zoned != 1 {
+		t.Errorf("%d instances in us-east-1c", zoned)
+	}
+
+	// The instances lost with a zone are launched there again, and one that
+	// ended up elsewhere is terminated.
+	var lost []string
+	for _, i := range live {
+		if aws.ToString(i.SubnetId) == "subnet-a" {
+			lost = append(lost, aws.ToString(i.InstanceId))
+		}
+	}
+	if _, err := provisioner.Delete(c, lost); err != nil {
+		t.Fatal(err)
+	}
+	stray := tagged(groupTag, "web")
+	stray.SubnetId = aws.String("subnet-b")
+	fake.AddInstance(stray)
+	if err := reconcile(c, state, false, false); err != nil {
+		t.Fatal(err)
+	}
+	live = liveInstances(fake)
+	if len(live) != 5 || inSubnet(live, "subnet-a") != 2 || inSubnet(live, "subnet-b") != 2 {
+		t.Errorf("after the repair %d instances, %d in subnet-a and %d in subnet-b", len(live), inSubnet(live, "subnet-a"), inSubnet(live, "subnet-b"))
+	}
+}
+
+func TestDesiredStateZones(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fleet.yaml")
+	write := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`groups:
+  - name: web
+    instance_type: t3.micro
+    image_id: ami-1
+    zones:
+      - subnet_id: subnet-a
+        count: 2
+      - zone: us-east-1b
+        count: 2
+`)
+	state, err := loadDesiredState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := state.Groups[0]; g.Count != 4 || len(g.Zones) != 2 || g.Zones[1].Zone != "us-east-1b" {
+		t.Errorf("group = %+v", g)
+	}
+
+	write(`groups:
+  - name: web
+    count: 3
+    instance_type: t3.micro
+    image_id: ami-1
+    zones:
+      - subnet_id: subnet-a
+        count: 2
+`)
+	if _, err := loadDesiredState(path); err == nil || !strings.Contains(err.Error(), "add up to 2") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestScalePerZone(t *testing.T) {
+	fake := useFakeEC2(t)
+	useConfig(t, ConfigMap{InstanceType: "t3.micro", ImageId: "ami-1"})
+	for n := 0; n < 3; n++ {
+		i := tagged("app", "worker")
+		i.SubnetId = aws.String("subnet-a")
+		fake.AddInstance(i)
+	}
+
+	out := runCLI(t, "scale", "--tag", "app=worker", "--per-zone", "subnet-a=1,subnet-b=2")
+	live := liveInstances(fake)
+	if inSubnet(live, "subnet-a") != 1 || inSubnet(live, "subnet-b") != 2 {
+		t.Errorf("%d instances in subnet-a and %d in subnet-b\n%s", inSubnet(live, "subnet-a"), inSubnet(live, "subnet-b"), out)
+	}
+	if out := runCLI(t, "scale", "--tag", "app=worker", "--per-zone", "subnet-a=1,subnet-b=2"); !strings.Contains(out, "already has") {
+		t.Errorf("output:\n%s", out)
+	}
+}